@@ -20,7 +20,11 @@ CREATE TABLE IF NOT EXISTS analytics.events (
     device LowCardinality(String) DEFAULT '',
     country LowCardinality(String) DEFAULT '',
     city LowCardinality(String) DEFAULT '',
-    received_at DateTime64(6, 'UTC')
+    received_at DateTime64(6, 'UTC'),
+    -- Extracted at insert time so autocapture queries group on plain columns
+    props_text String MATERIALIZED simpleJSONExtractString(props, 'text'),
+    props_tag String MATERIALIZED simpleJSONExtractString(props, 'tag'),
+    props_href String MATERIALIZED simpleJSONExtractString(props, 'href')
 )
 ENGINE = ReplacingMergeTree()
 PARTITION BY toYYYYMM(timestamp)
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/shortid/clickresearch-stats/internal/auth"
+	"github.com/shortid/clickresearch-stats/internal/config"
+	"github.com/shortid/clickresearch-stats/internal/preflight"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// runCheck verifies the configuration and each dependency the server would
+// use, prints the results and returns the exit code: 1 if any check failed
+func runCheck() int {
+	backend := analyticsBackend()
+	useClickHouse := backend == "clickhouse" || backend == "migrate"
+
+	checks := []preflight.Check{
+		{Name: "config", Run: func(ctx context.Context) (string, error) {
+			if _, err := config.New(os.Getenv("CONFIG_FILE"), os.Getenv); err != nil {
+				return "", err
+			}
+			switch backend {
+			case "duckdb", "clickhouse", "postgres", "migrate":
+				return "analytics backend " + backend, nil
+			}
+			return "", fmt.Errorf("invalid ANALYTICS_BACKEND %q: want duckdb, clickhouse, postgres or migrate", backend)
+		}},
+		{Name: "postgres", Run: func(ctx context.Context) (string, error) {
+			return auth.CheckDB(ctx, os.Getenv("DATABASE_URL"))
+		}},
+		{Name: "s3", Run: func(ctx context.Context) (string, error) {
+			cfg := duckDBConfig(storeRules{})
+			if backend == "clickhouse" {
+				// ClickHouse syncs from the bucket; LOCAL_PARQUET_PATH is DuckDB only
+				cfg.LocalPath = ""
+			}
+			return stats.CheckS3(ctx, cfg)
+		}},
+		{Name: "clickhouse", Run: func(ctx context.Context) (string, error) {
+			return stats.CheckClickHouse(ctx, clickHouseConfig(storeRules{}))
+		}},
+		{Name: "stats postgres", Run: func(ctx context.Context) (string, error) {
+			return stats.CheckPostgres(ctx, statsDatabaseURL())
+		}},
+	}
+	if os.Getenv("DATABASE_URL") == "" {
+		checks[1].Skip = "DATABASE_URL not set; accounts and projects are disabled"
+	}
+	if backend == "postgres" {
+		checks[2].Skip = "not used with ANALYTICS_BACKEND=postgres"
+	}
+	if !useClickHouse {
+		checks[3].Skip = "not used with ANALYTICS_BACKEND=" + backend
+	}
+	if backend != "postgres" {
+		checks[4].Skip = "not used with ANALYTICS_BACKEND=" + backend
+	}
+
+	results := preflight.Run(context.Background(), checks, preflight.DefaultTimeout)
+	if err := preflight.Write(os.Stdout, results); err != nil {
+		return 1
+	}
+	if preflight.Failed(results) {
+		return 1
+	}
+	return 0
+}
@@ -1,18 +1,38 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"google.golang.org/grpc"
+
 	"github.com/shortid/clickresearch-stats/internal/auth"
+	"github.com/shortid/clickresearch-stats/internal/config"
+	"github.com/shortid/clickresearch-stats/internal/cors"
+	"github.com/shortid/clickresearch-stats/internal/errorsink"
+	statsgrpc "github.com/shortid/clickresearch-stats/internal/grpc"
+	"github.com/shortid/clickresearch-stats/internal/jobs"
+	"github.com/shortid/clickresearch-stats/internal/secretbox"
 	"github.com/shortid/clickresearch-stats/internal/stats"
+	"github.com/shortid/clickresearch-stats/internal/urlbuilder"
 )
 
 func main() {
+	// `server check` verifies the configured dependencies and exits
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck())
+	}
+
 	log.Println("Starting ClickResearch Stats server...")
 
 	// Config from env
@@ -21,36 +41,12 @@ func main() {
 		port = "8080"
 	}
 
-	// Analytics store - ClickHouse or DuckDB based on feature flag
-	var store stats.StoreInterface
-	var err error
-
-	if os.Getenv("USE_CLICKHOUSE") == "true" {
-		log.Println("Using ClickHouse store")
-		store, err = stats.NewClickHouseStore(stats.ClickHouseConfig{
-			Addr:       os.Getenv("CLICKHOUSE_ADDR"),
-			Database:   os.Getenv("CLICKHOUSE_DB"),
-			S3Endpoint: os.Getenv("S3_ENDPOINT"),
-			S3Key:      os.Getenv("S3_KEY"),
-			S3Secret:   os.Getenv("S3_SECRET"),
-			S3Bucket:   os.Getenv("S3_BUCKET"),
-			S3Prefix:   os.Getenv("S3_PREFIX"),
-		})
-	} else {
-		log.Println("Using DuckDB store")
-		store, err = stats.NewStore(stats.Config{
-			S3Endpoint: os.Getenv("S3_ENDPOINT"),
-			S3Key:      os.Getenv("S3_KEY"),
-			S3Secret:   os.Getenv("S3_SECRET"),
-			Bucket:     os.Getenv("S3_BUCKET"),
-			Prefix:     os.Getenv("S3_PREFIX"),
-			LocalPath:  os.Getenv("LOCAL_PARQUET_PATH"),
-		})
-	}
+	// CORS origins, query budget, cache TTL and refresh interval reload on SIGHUP;
+	// CONFIG_FILE optionally overrides the environment with KEY=VALUE lines
+	settings, err := config.New(os.Getenv("CONFIG_FILE"), os.Getenv)
 	if err != nil {
-		log.Fatalf("Failed to create stats store: %v", err)
+		log.Fatalf("Invalid config: %v", err)
 	}
-	defer store.Close()
 
 	// Auth DB for user/project management
 	authDB, err := auth.NewDB(os.Getenv("DATABASE_URL"))
@@ -60,11 +56,178 @@ func main() {
 		defer authDB.Close()
 	}
 
+	// Per-project event name allow-lists, loaded before the first data load
+	eventNames := stats.NewEventNameRules()
+	if authDB != nil {
+		if allow, guard, err := authDB.EventNameRules(); err != nil {
+			log.Printf("Warning: failed to load event name rules: %v", err)
+		} else {
+			eventNames.Set(allow, guard)
+		}
+	}
+	// Admin corrections of mis-enriched values, applied to scanned rows by the store
+	valueOverrides := stats.NewValueOverrides()
+	if authDB != nil {
+		if rules, err := authDB.ValueOverrideRules(); err != nil {
+			log.Printf("Warning: failed to load value overrides: %v", err)
+		} else {
+			valueOverrides.Set(rules)
+		}
+	}
+
+	// Visitors erased on request, left out of every load
+	tombstones := stats.NewTombstones()
+	if authDB != nil {
+		if visitors, err := authDB.TombstonedVisitors(); err != nil {
+			log.Printf("Warning: failed to load visitor tombstones: %v", err)
+		} else {
+			tombstones.Set(visitors)
+		}
+	}
+	rules := storeRules{eventNames: eventNames, tombstones: tombstones, overrides: valueOverrides}
+
+	// Analytics store: DuckDB, ClickHouse, both while migrating between them, or
+	// Postgres for small installs
+	var store stats.StoreInterface
+	backend := analyticsBackend()
+	// Set during a migration; its diff log is served to admins
+	var migration *stats.MigrationStore
+	// Set when ClickHouse is a backend; admins can start a full resync of it
+	var clickStore *stats.ClickHouseStore
+
+	switch backend {
+	case "clickhouse":
+		log.Println("Using ClickHouse store")
+		store, err = newClickHouseStore(rules)
+		clickStore, _ = store.(*stats.ClickHouseStore)
+	case "duckdb":
+		log.Println("Using DuckDB store")
+		store, err = newDuckDBStore(rules)
+	case "postgres":
+		log.Println("Using Postgres store")
+		store, err = newPostgresStore(rules)
+	case "migrate":
+		// Reads come from MIGRATE_PRIMARY and a sample is compared on the other backend
+		if os.Getenv("CLICKHOUSE_ADDR") == "" || (os.Getenv("S3_BUCKET") == "" && os.Getenv("LOCAL_PARQUET_PATH") == "") {
+			log.Fatalf("ANALYTICS_BACKEND=migrate needs CLICKHOUSE_ADDR and S3_BUCKET or LOCAL_PARQUET_PATH")
+		}
+		var duck, click stats.StoreInterface
+		if duck, err = newDuckDBStore(rules); err != nil {
+			break
+		}
+		if click, err = newClickHouseStore(rules); err != nil {
+			duck.Close()
+			break
+		}
+		clickStore, _ = click.(*stats.ClickHouseStore)
+		cfg := stats.DefaultMigrationConfig
+		if v, err := strconv.ParseFloat(os.Getenv("MIGRATE_SAMPLE_RATE"), 64); err == nil && v > 0 {
+			cfg.SampleRate = v
+		}
+		if n, err := strconv.Atoi(os.Getenv("MIGRATE_MAX_CONCURRENT")); err == nil && n > 0 {
+			cfg.MaxConcurrent = n
+		}
+		if v, err := strconv.ParseFloat(os.Getenv("MIGRATE_TOLERANCE"), 64); err == nil && v > 0 {
+			cfg.Tolerance = v
+		}
+		if os.Getenv("MIGRATE_PRIMARY") == "clickhouse" {
+			log.Printf("Migrating: reads from ClickHouse, %.0f%% mirrored to DuckDB", cfg.SampleRate*100)
+			migration = stats.NewMigrationStore(click, duck, cfg)
+		} else {
+			log.Printf("Migrating: reads from DuckDB, %.0f%% mirrored to ClickHouse", cfg.SampleRate*100)
+			migration = stats.NewMigrationStore(duck, click, cfg)
+		}
+		store = migration
+	default:
+		log.Fatalf("Invalid ANALYTICS_BACKEND %q: want duckdb, clickhouse, postgres or migrate", backend)
+	}
+	if err != nil {
+		log.Fatalf("Failed to create stats store: %v", err)
+	}
+	defer store.Close()
+
 	// Handlers
 	statsHandler := stats.NewHandler(store)
-	authHandler := auth.NewHandler(authDB, os.Getenv("JWT_SECRET"), os.Getenv("WEBHOOK_SECRET"),
-		os.Getenv("GOOGLE_CLIENT_ID"), os.Getenv("GOOGLE_CLIENT_SECRET"),
-		os.Getenv("GOOGLE_REDIRECT_URL"), os.Getenv("FRONTEND_URL"))
+	if authDB != nil {
+		statsHandler.SetSegmentSource(authDB)
+		statsHandler.SetAnnotationSource(authDB)
+		statsHandler.SetGoalSource(authDB)
+		statsHandler.SetPrivacySource(authDB)
+		statsHandler.SetDomainMatchSource(authDB)
+		statsHandler.SetAliasSource(authDB)
+		statsHandler.SetCampaignSource(authDB)
+		statsHandler.SetRevenueSource(authDB)
+		statsHandler.SetBrandingSource(authDB)
+	}
+	// Referrer spam blocklist: embedded defaults plus admin-managed extras
+	spamList := stats.NewSpamList()
+	statsHandler.SetSpamList(spamList, os.Getenv("EXCLUDE_REFERRER_SPAM") == "true")
+	statsHandler.SetEventNameRules(eventNames)
+	// Precompute the default dashboard of busy domains after each refresh
+	if os.Getenv("CACHE_WARM") == "true" {
+		warm := stats.DefaultWarmConfig
+		if n, err := strconv.Atoi(os.Getenv("CACHE_WARM_MAX_DOMAINS")); err == nil && n > 0 {
+			warm.MaxDomains = n
+		}
+		statsHandler.EnableCacheWarming(warm)
+	}
+	// Live events over SSE, diffed after each store refresh
+	liveStreams, _ := strconv.Atoi(os.Getenv("LIVE_STREAMS_MAX"))
+	statsHandler.EnableLiveEvents(liveStreams)
+	// Wallboard counters over SSE, every WALLBOARD_INTERVAL (at least 5s) per domain
+	wallboardInterval, _ := time.ParseDuration(os.Getenv("WALLBOARD_INTERVAL"))
+	statsHandler.EnableWallboard(wallboardInterval)
+	// Revenue is converted into each project's currency with rates refreshed
+	// daily; the embedded table applies until a refresh succeeds
+	rates := stats.NewExchangeRates()
+	statsHandler.SetExchangeRates(rates)
+	if url := os.Getenv("EXCHANGE_RATES_URL"); url != "" {
+		go refreshExchangeRates(rates, url)
+	}
+	// PDF/PNG reports render on a job runner; REPORT_CONCURRENCY caps the reports rendered at once
+	reportJobs := jobs.DefaultConfig
+	if n, err := strconv.Atoi(os.Getenv("REPORT_CONCURRENCY")); err == nil && n > 0 {
+		reportJobs.Concurrency = n
+	}
+	statsHandler.SetReportRunner(jobs.NewRunner(reportJobs))
+	// Per-domain store query budget; cache hits are free, admins and listed domains exempt.
+	// Reloads apply the new budget, cache TTL and refresh interval to running requests.
+	corsOrigins := cors.NewOrigins(nil)
+	settings.OnReload(func(d config.Dynamic) {
+		corsOrigins.Set(d.CORSOrigins)
+		statsHandler.SetQueryBudget(d.QueryBudgetPerMinute, d.QueryBudgetExempt)
+		statsHandler.SetCacheTTL(d.CacheTTL)
+		store.SetRefreshInterval(d.RefreshInterval)
+	})
+	stopWatch := settings.WatchSignals()
+	defer stopWatch()
+	// Strict param validation is on unless explicitly disabled for legacy clients
+	statsHandler.SetStrictParams(os.Getenv("STRICT_PARAMS") != "false")
+
+	var authHandler *auth.Handler
+	if authDB != nil {
+		opts, err := authOptions()
+		if err != nil {
+			log.Fatalf("Invalid auth config: %v", err)
+		}
+		// With STATS_PEER_URL, the domains of that stats server are synced into
+		// a cache that takes peer denials and shows on the debug endpoint
+		domains, err := domainCache(port)
+		if err != nil {
+			log.Fatalf("Invalid domain cache config: %v", err)
+		}
+		if domains != nil {
+			defer domains.Stop()
+			opts = append(opts, auth.WithDomainCache(domains))
+			statsHandler.SetDomainCacheSource(domains)
+		}
+		if authHandler, err = auth.NewHandler(authDB, opts...); err != nil {
+			log.Fatalf("Invalid auth config: %v", err)
+		}
+	}
+
+	// Recent server errors for /api/admin/errors; per process, lost on restart
+	errorLog := errorsink.New(errorsink.DefaultSize)
 
 	// Routes
 	mux := http.NewServeMux()
@@ -74,86 +237,458 @@ func main() {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write([]byte(`{"status":"ok"}`))
 	})
-
-	// Stats endpoints
-	mux.HandleFunc("/api/stats/overview", statsHandler.HandleOverview)
-	mux.HandleFunc("/api/stats/pageviews", statsHandler.HandlePageviews)
-	mux.HandleFunc("/api/stats/pages", statsHandler.HandlePages)
-	mux.HandleFunc("/api/stats/sources", statsHandler.HandleSources)
-	mux.HandleFunc("/api/stats/devices", statsHandler.HandleDevices)
-	mux.HandleFunc("/api/stats/geo", statsHandler.HandleGeo)
-	mux.HandleFunc("/api/stats/utm", statsHandler.HandleUTM)
-	mux.HandleFunc("/api/stats/events", statsHandler.HandleEvents)
-	mux.HandleFunc("/api/stats/funnel", statsHandler.HandleFunnel)
-	mux.HandleFunc("/api/stats/funnel-advanced", statsHandler.HandleFunnelAdvanced)
-	mux.HandleFunc("/api/stats/event-breakdown", statsHandler.HandleEventBreakdown)
-	mux.HandleFunc("/api/stats/unique-pages", statsHandler.HandleUniquePages)
-	mux.HandleFunc("/api/stats/autocapture-events", statsHandler.HandleAutocaptureEvents)
-	mux.HandleFunc("/api/stats/funnel-init", statsHandler.HandleFunnelInit)
+	// Stats endpoints, with the date range caps of MAX_RANGE_DAYS_*
+	caps, err := rangeCaps()
+	if err != nil {
+		log.Fatalf("Invalid range caps: %v", err)
+	}
+	statsHandler.SetRangeCaps(caps)
+	for _, route := range statsHandler.Routes() {
+		mux.HandleFunc(route.Path, route.Handler)
+	}
 
 	// Auth endpoints
 	if authHandler != nil {
-		mux.HandleFunc("/api/auth/register", authHandler.HandleRegister)
-		mux.HandleFunc("/api/auth/login", authHandler.HandleLogin)
-		mux.HandleFunc("/api/auth/demo", authHandler.HandleDemoLogin)
-		mux.HandleFunc("/api/auth/me", authHandler.HandleMe)
-		mux.HandleFunc("/api/auth/google", authHandler.HandleGoogleLogin)
-		mux.HandleFunc("/api/auth/google/callback", authHandler.HandleGoogleCallback)
-		mux.HandleFunc("/api/auth/google/verify", authHandler.HandleGoogleVerify)
-		mux.HandleFunc("/api/projects", authHandler.HandleGetProjects)
-		mux.HandleFunc("/api/projects/create", authHandler.HandleCreateProject)
-		mux.HandleFunc("/api/projects/delete", authHandler.HandleDeleteProject)
-		mux.HandleFunc("/api/admin/projects", authHandler.HandleAdminProjects)
-		mux.HandleFunc("/api/admin/users", authHandler.HandleAdminUsers)
-		mux.HandleFunc("/api/sync/domains", authHandler.HandleSyncDomains)
-
-		// Funnel management endpoints
-		mux.HandleFunc("/api/funnels", authHandler.HandleGetFunnels)
-		mux.HandleFunc("/api/funnels/create", authHandler.HandleCreateFunnel)
-		mux.HandleFunc("/api/funnels/update", authHandler.HandleUpdateFunnel)
-		mux.HandleFunc("/api/funnels/delete", authHandler.HandleDeleteFunnel)
-	}
-
-	// Middleware: CORS + logging
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+		statsHandler.SetRoleSource(authHandler)
+		statsHandler.SetEmbedSource(authHandler)
+		authHandler.SetStatsStore(store)
+		authHandler.StartKeyUsageRecorder()
+		authHandler.StartIdempotencyKeyCleanup()
+		// Caps on funnels, goals and segments per project; admins can override them per project
+		limits := auth.ProjectLimits{}
+		limits.Funnels, _ = strconv.Atoi(os.Getenv("MAX_FUNNELS_PER_PROJECT"))
+		limits.Goals, _ = strconv.Atoi(os.Getenv("MAX_GOALS_PER_PROJECT"))
+		limits.Segments, _ = strconv.Atoi(os.Getenv("MAX_SEGMENTS_PER_PROJECT"))
+		authHandler.SetDefaultProjectLimits(limits)
+		// Precompute daily results of saved funnels for trend charts
+		if os.Getenv("FUNNEL_HISTORY") != "false" {
+			authHandler.StartFunnelHistoryJob()
+		}
+		authHandler.SetSpamList(spamList)
+		if err := authHandler.ReloadSpamList(); err != nil {
+			log.Printf("Warning: failed to load spam referrers: %v", err)
+		}
+		authHandler.SetEventNameRules(eventNames)
+		authHandler.SetValueOverrides(valueOverrides)
+		authHandler.SetTombstones(tombstones)
+		badgeSlugs := stats.NewBadgeSlugs()
+		statsHandler.SetBadgeSlugs(badgeSlugs)
+		authHandler.SetBadgeSlugs(badgeSlugs)
+		if err := authHandler.ReloadBadgeSlugs(); err != nil {
+			log.Printf("Warning: failed to load badge slugs: %v", err)
+		}
+		// Deleting a project drops its cached stats and refuses its domain's
+		// events, here and in the domain caches of DOMAIN_CACHE_PEERS
+		authHandler.SetStatsCache(statsHandler)
+		if v := os.Getenv("DOMAIN_CACHE_PEERS"); v != "" {
+			authHandler.SetDomainCachePeers(strings.Split(v, ","))
+		}
+		if err := authHandler.ReloadDeniedDomains(); err != nil {
+			log.Printf("Warning: failed to load denied domains: %v", err)
+		}
+		// Pick up changes made through other instances
+		go func() {
+			for range time.Tick(5 * time.Minute) {
+				if err := authHandler.ReloadSpamList(); err != nil {
+					log.Printf("Failed to reload spam referrers: %v", err)
+				}
+				if err := authHandler.ReloadEventNameRules(); err != nil {
+					log.Printf("Failed to reload event name rules: %v", err)
+				}
+				if err := authHandler.ReloadTombstones(); err != nil {
+					log.Printf("Failed to reload visitor tombstones: %v", err)
+				}
+				if err := authHandler.ReloadBadgeSlugs(); err != nil {
+					log.Printf("Failed to reload badge slugs: %v", err)
+				}
+				if err := authHandler.ReloadValueOverrides(); err != nil {
+					log.Printf("Failed to reload value overrides: %v", err)
+				}
+				if err := authHandler.ReloadDeniedDomains(); err != nil {
+					log.Printf("Failed to reload denied domains: %v", err)
+				}
+			}
+		}()
+		// Nightly exports to customer S3 buckets and webhooks; credentials are sealed with EXPORT_SECRET_KEY
+		if key := os.Getenv("EXPORT_SECRET_KEY"); key != "" {
+			box, err := secretbox.New(key)
+			if err != nil {
+				log.Fatalf("Invalid EXPORT_SECRET_KEY: %v", err)
+			}
+			authHandler.SetExportSecretBox(box)
+			authHandler.StartExportJob()
+		}
+		// Push a 7-day stats digest of the domains Shortodella created back to it
+		authHandler.StartDigestJob(os.Getenv("SHORTODELLA_DIGEST_URL"))
+		// Sign-ins with use_cookie=true get an HttpOnly session cookie of this name
+		if name := os.Getenv("SESSION_COOKIE_NAME"); name != "" {
+			authHandler.SetSessionCookie(name)
+		}
+		// Reject registrations with passwords from Have I Been Pwned; the check fails open
+		if os.Getenv("PASSWORD_BREACH_CHECK") == "true" {
+			policy := auth.DefaultPasswordPolicy
+			policy.Breached = auth.NewHIBPChecker()
+			authHandler.SetPasswordPolicy(policy)
+		}
 
-		// CORS
-		origin := r.Header.Get("Origin")
-		if origin == "https://shortid.me" || origin == "http://localhost:3000" || origin == "http://localhost:3003" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		for _, route := range authHandler.Routes() {
+			mux.HandleFunc(route.Path, route.Handler)
+		}
+		mux.HandleFunc("/api/stats/debug", authHandler.RequireAdmin(statsHandler.HandleDebug))
+		mux.HandleFunc("/api/admin/errors", authHandler.RequireAdmin(errorLog.HandleErrors))
+		mux.HandleFunc("/api/admin/reload-config", authHandler.RequireAdmin(settings.HandleReload))
+		if migration != nil {
+			mux.HandleFunc("/api/admin/migration", authHandler.RequireAdmin(migration.HandleDiffs))
 		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		mux.HandleFunc("/api/admin/refresh-status", authHandler.RequireAdmin(statsHandler.HandleRefreshStatus))
+		if clickStore != nil {
+			mux.HandleFunc("/api/admin/resync", authHandler.RequireAdmin(clickStore.HandleResync))
+		}
+		errorLog.SetUserFunc(authHandler.RequestUser)
+		// Badges are served from a slug map and a 10 minute cache, not the auth database
+		mux.HandleFunc("/api/public/badge/", statsHandler.HandleBadge)
+	}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+	queryTimeout := stats.DefaultQueryTimeout
+	if v := os.Getenv("QUERY_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			queryTimeout = d
+		} else {
+			log.Printf("Warning: invalid QUERY_TIMEOUT %q, using %v", v, queryTimeout)
 		}
+	}
+	// Embed tokens are checked before the budget, dropping the session header and
+	// cookies, so embeds never inherit a session's role or exemption
+	limited := statsHandler.WithQueryBudget(statsHandler.WithQueryDebug(mux))
+	if authHandler != nil {
+		// Every package enforces what the session's role may do from its access policy
+		limited = authHandler.WithAccessPolicy(limited)
+	}
+	api := errorsink.Middleware(errorLog, stats.WithDeadline(statsHandler.WithEmbedTokens(limited), queryTimeout))
+	// Mirrored reads of a migration wait until the response is written
+	if migration != nil {
+		api = migration.WithMirrors(api)
+	}
 
-		mux.ServeHTTP(w, r)
+	// Middleware: logging, wrapped in CORS
+	logged := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		done := statsHandler.ObserveRequest(r.URL.Path)
+		api.ServeHTTP(w, r)
+		done()
 
 		// Log request
 		log.Printf("%s %s %v", r.Method, r.URL.Path, time.Since(start))
 	})
 
+	corsMaxAge := cors.DefaultMaxAge
+	if n, err := strconv.Atoi(os.Getenv("CORS_MAX_AGE")); err == nil && n > 0 {
+		corsMaxAge = time.Duration(n) * time.Second
+	}
+	handler := cors.Middleware(cors.Config{
+		Origins:        corsOrigins,
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key", "X-Request-ID", "Last-Event-ID", "Idempotency-Key", auth.CSRFHeader, "X-Use-Cookie"},
+		ExposeHeaders:  []string{"Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-Data-Warning", "X-Request-ID", "X-Total-Count", "X-Limit", "X-Total-Groups", "X-Truncated", "Idempotent-Replay", "X-Cache-TTL"},
+		MaxAge:         corsMaxAge,
+	}, logged)
+
 	server := &http.Server{
 		Addr:    ":" + port,
 		Handler: handler,
 	}
+	// Live streams never go idle on their own; end them so Shutdown can finish
+	server.RegisterOnShutdown(statsHandler.CloseLiveStreams)
+
+	// Internal services read aggregates over gRPC with a service token
+	var grpcServer *grpc.Server
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		var allowed []string
+		if v := os.Getenv("GRPC_ALLOWED_DOMAINS"); v != "" {
+			allowed = strings.Split(v, ",")
+		}
+		grpcServer, err = statsgrpc.NewServer(statsHandler, statsgrpc.Config{
+			Token:          os.Getenv("GRPC_TOKEN"),
+			AllowedDomains: allowed,
+			QueryTimeout:   queryTimeout,
+		})
+		if err != nil {
+			log.Fatalf("gRPC server: %v", err)
+		}
+		lis, err := net.Listen("tcp", ":"+grpcPort)
+		if err != nil {
+			log.Fatalf("gRPC server: %v", err)
+		}
+		go func() {
+			log.Printf("gRPC server starting on :%s", grpcPort)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatalf("gRPC server error: %v", err)
+			}
+		}()
+	}
 
 	// Graceful shutdown
+	shutdown := make(chan struct{})
 	go func() {
+		defer close(shutdown)
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
 		log.Println("Shutting down...")
-		server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if grpcServer != nil {
+			// In-flight calls get the same drain deadline as HTTP requests
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			defer func() {
+				select {
+				case <-stopped:
+				case <-ctx.Done():
+					grpcServer.Stop()
+				}
+			}()
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
 	}()
 
 	log.Printf("Stats server starting on :%s", port)
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	<-shutdown
+	if authHandler != nil {
+		authHandler.StopKeyUsageRecorder()
+	}
+}
+
+// authOptions configure the auth handler from the environment. Google sign-in
+// is on when GOOGLE_CLIENT_ID is set. Sync requests are checked against
+// SYNC_SECRET, falling back to WEBHOOK_SECRET as before it existed. Links are
+// built on PUBLIC_URL, or on the request's X-Forwarded-Proto and
+// X-Forwarded-Host when TRUST_PROXY_HEADERS=true, which also lets sign-in
+// notices name the X-Forwarded-For address.
+func authOptions() ([]auth.Option, error) {
+	urls, err := urlbuilder.New(os.Getenv("PUBLIC_URL"), os.Getenv("TRUST_PROXY_HEADERS") == "true")
+	if err != nil {
+		return nil, err
+	}
+	syncSecret := syncSecret()
+	if syncSecret != "" && os.Getenv("SYNC_SECRET") == "" {
+		log.Printf("Warning: SYNC_SECRET not set, checking sync requests against WEBHOOK_SECRET")
+	}
+	opts := []auth.Option{
+		auth.WithJWTSecret(os.Getenv("JWT_SECRET")),
+		auth.WithWebhookSecret(os.Getenv("WEBHOOK_SECRET")),
+		auth.WithSyncSecret(syncSecret),
+		auth.WithFrontendURL(os.Getenv("FRONTEND_URL")),
+		auth.WithURLBuilder(urls),
+	}
+	if os.Getenv("GOOGLE_CLIENT_ID") != "" {
+		opts = append(opts, auth.WithGoogleOAuth(auth.GoogleOAuthConfig{
+			ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+			ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+		}))
+	}
+	return opts, nil
+}
+
+// syncSecret is SYNC_SECRET, or WEBHOOK_SECRET as before it existed
+func syncSecret() string {
+	if secret := os.Getenv("SYNC_SECRET"); secret != "" {
+		return secret
+	}
+	return os.Getenv("WEBHOOK_SECRET")
+}
+
+// domainCache syncs the domains of STATS_PEER_URL, or is nil without one. Its
+// fallback file is DOMAIN_CACHE_FILE, by default one per port in the temp
+// directory, with the octal permissions of DOMAIN_CACHE_FILE_MODE, 0600 unless set.
+func domainCache(port string) (*auth.DomainCache, error) {
+	url := os.Getenv("STATS_PEER_URL")
+	if url == "" {
+		return nil, nil
+	}
+	cfg := auth.DomainCacheConfig{File: os.Getenv("DOMAIN_CACHE_FILE"), Instance: port}
+	if v := os.Getenv("DOMAIN_CACHE_FILE_MODE"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode&^0777 != 0 {
+			return nil, fmt.Errorf("DOMAIN_CACHE_FILE_MODE must be octal permissions such as 0600, got %q", v)
+		}
+		cfg.FileMode = os.FileMode(mode)
+	}
+	return auth.NewDomainCache(strings.TrimSuffix(url, "/"), syncSecret(), cfg), nil
+}
+
+// rangeCaps are the longest date ranges of stats endpoints by class:
+// MAX_RANGE_DAYS_EVENTS, _FUNNELS and _BREAKDOWNS in days, where 0 lifts the
+// cap and unset keeps the default
+func rangeCaps() (stats.RangeCaps, error) {
+	caps := maps.Clone(stats.DefaultRangeCaps)
+	for _, class := range stats.RangeClasses {
+		key := "MAX_RANGE_DAYS_" + strings.ToUpper(string(class))
+		v := os.Getenv(key)
+		if v == "" {
+			continue
+		}
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative number of days", key)
+		}
+		caps[class] = time.Duration(days) * 24 * time.Hour
+	}
+	return caps, nil
+}
+
+// s3UseSSL is whether S3 is reached over HTTPS; S3_USE_SSL=false is for e.g. a local MinIO
+func s3UseSSL() bool {
+	return os.Getenv("S3_USE_SSL") != "false"
+}
+
+// refreshExchangeRates fetches the rates table at url now and then daily
+func refreshExchangeRates(rates *stats.ExchangeRates, url string) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := rates.Refresh(ctx, client, url); err != nil {
+			log.Printf("Failed to refresh exchange rates: %v", err)
+		}
+		cancel()
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// storeRules are the project settings the stores apply to the events they load
+// and scan; each is optional
+type storeRules struct {
+	eventNames *stats.EventNameRules
+	tombstones *stats.Tombstones
+	overrides  *stats.ValueOverrides
+}
+
+// clickHouseConfig is the ClickHouse store's configuration from the environment
+func clickHouseConfig(rules storeRules) stats.ClickHouseConfig {
+	return stats.ClickHouseConfig{
+		Addr:       os.Getenv("CLICKHOUSE_ADDR"),
+		Database:   os.Getenv("CLICKHOUSE_DB"),
+		S3Endpoint: os.Getenv("S3_ENDPOINT"),
+		S3Key:      os.Getenv("S3_KEY"),
+		S3Secret:   os.Getenv("S3_SECRET"),
+		S3Bucket:   os.Getenv("S3_BUCKET"),
+		S3Prefix:   os.Getenv("S3_PREFIX"),
+		S3UrlStyle: os.Getenv("S3_URL_STYLE"),
+		S3Region:   os.Getenv("S3_REGION"),
+		S3UseSSL:   s3UseSSL(),
+
+		S3CredentialsMode: stats.S3CredentialsMode(os.Getenv("S3_CREDENTIALS_MODE")),
+		EventNames:        rules.eventNames,
+		Tombstones:        rules.tombstones,
+		Overrides:         rules.overrides,
+		Gaps:              gapThresholds(),
+		Timestamps:        timestampRules(),
+	}
+}
+
+// duckDBConfig is the DuckDB store's configuration from the environment
+func duckDBConfig(rules storeRules) stats.Config {
+	// Without a memory table, ranges over this many days are answered in part; 0 uses the default
+	fallbackDays, _ := strconv.Atoi(os.Getenv("DUCKDB_FALLBACK_MAX_DAYS"))
+	// Days of events kept in memory; 0 uses the default, negative keeps all of them
+	hotDays, _ := strconv.Atoi(os.Getenv("DUCKDB_HOT_DAYS"))
+	return stats.Config{
+		S3Endpoint: os.Getenv("S3_ENDPOINT"),
+		S3Key:      os.Getenv("S3_KEY"),
+		S3Secret:   os.Getenv("S3_SECRET"),
+		Bucket:     os.Getenv("S3_BUCKET"),
+		Prefix:     os.Getenv("S3_PREFIX"),
+		LocalPath:  os.Getenv("LOCAL_PARQUET_PATH"),
+		S3UrlStyle: os.Getenv("S3_URL_STYLE"),
+		S3Region:   os.Getenv("S3_REGION"),
+		S3UseSSL:   s3UseSSL(),
+
+		S3CredentialsMode: stats.S3CredentialsMode(os.Getenv("S3_CREDENTIALS_MODE")),
+
+		FallbackMaxDays: fallbackDays,
+		HotDays:         hotDays,
+		EventNames:      rules.eventNames,
+		Tombstones:      rules.tombstones,
+		Overrides:       rules.overrides,
+		Gaps:            gapThresholds(),
+		Timestamps:      timestampRules(),
+	}
+}
+
+// gapThresholds tune which hours the pageview chart flags as data gaps; unset
+// or invalid values use the defaults
+func gapThresholds() stats.GapThresholds {
+	var t stats.GapThresholds
+	t.Ratio, _ = strconv.ParseFloat(os.Getenv("DATA_GAP_RATIO"), 64)
+	t.TrailingHours, _ = strconv.Atoi(os.Getenv("DATA_GAP_TRAILING_HOURS"))
+	t.MinAverage, _ = strconv.ParseFloat(os.Getenv("DATA_GAP_MIN_AVERAGE"), 64)
+	return t
+}
+
+// timestampRules sanitize event timestamps: EVENT_TIMESTAMP_SKEW is how far
+// they may stray from received_at (e.g. "48h", "-1s" turns clamping off) and
+// EXCLUDE_FUTURE_EVENTS=true leaves events over a day ahead out of queries
+func timestampRules() stats.TimestampRules {
+	var r stats.TimestampRules
+	r.Skew, _ = time.ParseDuration(os.Getenv("EVENT_TIMESTAMP_SKEW"))
+	r.ExcludeFuture = os.Getenv("EXCLUDE_FUTURE_EVENTS") == "true"
+	return r
+}
+
+// newClickHouseStore creates the ClickHouse store from the environment
+func newClickHouseStore(rules storeRules) (stats.StoreInterface, error) {
+	return stats.NewClickHouseStore(clickHouseConfig(rules))
+}
+
+// newDuckDBStore creates the DuckDB store from the environment
+func newDuckDBStore(rules storeRules) (stats.StoreInterface, error) {
+	return stats.NewStore(duckDBConfig(rules))
+}
+
+// postgresConfig is the Postgres store's configuration from the environment
+func postgresConfig(rules storeRules) stats.PostgresConfig {
+	return stats.PostgresConfig{
+		DatabaseURL: statsDatabaseURL(),
+		EventNames:  rules.eventNames,
+		Tombstones:  rules.tombstones,
+		Overrides:   rules.overrides,
+		Gaps:        gapThresholds(),
+		Timestamps:  timestampRules(),
+	}
+}
+
+// statsDatabaseURL is where the Postgres store keeps events: STATS_DATABASE_URL,
+// or the accounts database of DATABASE_URL
+func statsDatabaseURL() string {
+	if url := os.Getenv("STATS_DATABASE_URL"); url != "" {
+		return url
+	}
+	return os.Getenv("DATABASE_URL")
+}
+
+// newPostgresStore creates the Postgres store from the environment
+func newPostgresStore(rules storeRules) (stats.StoreInterface, error) {
+	return stats.NewPostgresStore(postgresConfig(rules))
+}
+
+// analyticsBackend is ANALYTICS_BACKEND: duckdb, clickhouse, postgres or
+// migrate. It defaults to the USE_CLICKHOUSE feature flag.
+func analyticsBackend() string {
+	if backend := os.Getenv("ANALYTICS_BACKEND"); backend != "" {
+		return backend
+	}
+	if os.Getenv("USE_CLICKHOUSE") == "true" {
+		return "clickhouse"
+	}
+	return "duckdb"
 }
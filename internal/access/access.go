@@ -0,0 +1,52 @@
+// Package access carries what the caller of a request may do, derived from
+// their role by the auth middleware, so handlers of every package enforce
+// the same rules.
+package access
+
+import (
+	"context"
+	"slices"
+	"strings"
+)
+
+// Policy is what a caller may do. Requests without a policy are unrestricted;
+// handlers still authenticate the caller themselves.
+type Policy struct {
+	// CanWrite allows creating, changing and deleting anything
+	CanWrite bool
+	// AllowedDomains limits the domains whose stats the caller may read; nil
+	// allows every domain
+	AllowedDomains []string
+}
+
+// Unrestricted is the policy of requests that carry none
+var Unrestricted = Policy{CanWrite: true}
+
+// AllowsDomain reports whether the caller may read domain's stats
+func (p Policy) AllowsDomain(domain string) bool {
+	if p.AllowedDomains == nil {
+		return true
+	}
+	return slices.Contains(p.AllowedDomains, strings.ToLower(strings.TrimSpace(domain)))
+}
+
+type policyKey struct{}
+
+// WithPolicy attaches p to ctx
+func WithPolicy(ctx context.Context, p Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, p)
+}
+
+// FromContext returns the policy attached by WithPolicy and whether there was one
+func FromContext(ctx context.Context) (Policy, bool) {
+	p, ok := ctx.Value(policyKey{}).(Policy)
+	return p, ok
+}
+
+// PolicyFromContext returns the attached policy, or Unrestricted
+func PolicyFromContext(ctx context.Context) Policy {
+	if p, ok := FromContext(ctx); ok {
+		return p
+	}
+	return Unrestricted
+}
@@ -0,0 +1,31 @@
+package access
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPolicy_AllowsDomain(t *testing.T) {
+	p := Policy{AllowedDomains: []string{"shortid.me"}}
+	for domain, want := range map[string]bool{"shortid.me": true, " ShortID.me ": true, "example.com": false} {
+		if got := p.AllowsDomain(domain); got != want {
+			t.Errorf("AllowsDomain(%q) = %v, want %v", domain, got, want)
+		}
+	}
+	if !Unrestricted.AllowsDomain("example.com") {
+		t.Error("Unrestricted refused a domain")
+	}
+}
+
+func TestPolicyFromContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("empty context has a policy")
+	}
+	if p := PolicyFromContext(context.Background()); !p.CanWrite {
+		t.Errorf("default policy = %+v, want Unrestricted", p)
+	}
+	ctx := WithPolicy(context.Background(), Policy{AllowedDomains: []string{}})
+	if p, ok := FromContext(ctx); !ok || p.CanWrite || p.AllowsDomain("shortid.me") {
+		t.Errorf("attached policy = %+v, %v", p, ok)
+	}
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/shortid/clickresearch-stats/internal/access"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// policyForRole returns what callers of a role may do. Demo users only read,
+// and only the demo domain.
+func policyForRole(role string) access.Policy {
+	if role == "demo" {
+		return access.Policy{AllowedDomains: []string{stats.DemoDomain}}
+	}
+	return access.Unrestricted
+}
+
+// WithAccessPolicy attaches the policy of the bearer token's role to requests
+// that carry a valid one, for handlers of other packages to enforce
+func (h *Handler) WithAccessPolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := h.bearerClaims(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(access.WithPolicy(r.Context(), policyForRole(claims.Role))))
+	})
+}
+
+// accessPolicy returns the policy attached by WithAccessPolicy, or the one of
+// the bearer token's role when the handler is reached without the middleware
+func (h *Handler) accessPolicy(r *http.Request) access.Policy {
+	if p, ok := access.FromContext(r.Context()); ok {
+		return p
+	}
+	if claims, err := h.bearerClaims(r); err == nil {
+		return policyForRole(claims.Role)
+	}
+	return access.Unrestricted
+}
+
+// requireWrite rejects callers who may not change anything; handlers that
+// create, change or delete call it before touching the database
+func (h *Handler) requireWrite(w http.ResponseWriter, r *http.Request) bool {
+	if !h.accessPolicy(r).CanWrite {
+		writeJSON(w, map[string]string{"error": "Demo mode is read-only"}, http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAdminPageSize and maxAdminPageSize bound the admin lists
+	defaultAdminPageSize = 100
+	maxAdminPageSize     = 1000
+)
+
+// adminListDB is the storage the admin lists need; *DB implements it
+type adminListDB interface {
+	GetAllUsersAdmin(f AdminFilter) ([]User, int, error)
+	GetAllProjectsAdmin(f AdminFilter) ([]ProjectWithUser, int, error)
+}
+
+// parseAdminFilter reads ?email=&role=&synced_from=&created_after=&limit=&offset=.
+// created_after is a date or RFC 3339 time; limits above maxAdminPageSize are capped.
+func parseAdminFilter(q url.Values) (AdminFilter, error) {
+	f := AdminFilter{
+		Email:      strings.TrimSpace(q.Get("email")),
+		Role:       q.Get("role"),
+		SyncedFrom: q.Get("synced_from"),
+		Limit:      defaultAdminPageSize,
+	}
+	if s := q.Get("created_after"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, s); err != nil {
+				return f, fmt.Errorf("created_after must be YYYY-MM-DD or RFC 3339")
+			}
+		}
+		f.CreatedAfter = &t
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return f, fmt.Errorf("limit must be a positive integer")
+		}
+		f.Limit = min(n, maxAdminPageSize)
+	}
+	if s := q.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("offset must be a non-negative integer")
+		}
+		f.Offset = n
+	}
+	return f, nil
+}
+
+// writeCSV sends rows under header as a CSV download named filename
+func writeCSV(w http.ResponseWriter, filename string, header []string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, row := range rows {
+		for i, cell := range row {
+			row[i] = csvSafe(cell)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+}
+
+// csvSafe keeps spreadsheets from evaluating user-supplied cells as formulas
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// maskAPIKey keeps the first 8 characters of an API key, enough to tell keys
+// apart; short keys keep at most half
+func maskAPIKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key[:min(8, len(key)/2)] + "…"
+}
+
+func optional(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// serveAdminUsers answers a page of users as JSON or, with ?format=csv, CSV;
+// X-Total-Count holds the number of users matching the filters
+func serveAdminUsers(db adminListDB, w http.ResponseWriter, r *http.Request) {
+	f, err := parseAdminFilter(r.URL.Query())
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+	users, total, err := db.GetAllUsersAdmin(f)
+	if err != nil {
+		writeServerError(w, "Failed to get users", err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	if r.URL.Query().Get("format") == "csv" {
+		rows := make([][]string, len(users))
+		for i, u := range users {
+			rows[i] = []string{u.ID, u.Email, optional(u.Name), u.Role, u.CreatedAt, optional(u.SyncedFrom),
+				strconv.Itoa(u.PermanentEnergy), strconv.Itoa(u.SubscriptionEnergy), strconv.Itoa(u.DailyBonusEnergy)}
+		}
+		writeCSV(w, "users.csv", []string{"id", "email", "name", "role", "created_at", "synced_from",
+			"permanent_energy", "subscription_energy", "daily_bonus_energy"}, rows)
+		return
+	}
+	if users == nil {
+		users = []User{}
+	}
+	writeJSON(w, users, http.StatusOK)
+}
+
+// serveAdminProjects answers a page of projects like serveAdminUsers
+func serveAdminProjects(db adminListDB, w http.ResponseWriter, r *http.Request) {
+	f, err := parseAdminFilter(r.URL.Query())
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+	projects, total, err := db.GetAllProjectsAdmin(f)
+	if err != nil {
+		writeServerError(w, "Failed to get projects", err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	if r.URL.Query().Get("format") == "csv" {
+		rows := make([][]string, len(projects))
+		for i, p := range projects {
+			rows[i] = []string{p.ID, p.Domain, optional(p.Name), p.UserID, p.UserEmail, p.CreatedAt}
+		}
+		// API keys stay out of exports
+		writeCSV(w, "projects.csv", []string{"id", "domain", "name", "user_id", "user_email", "created_at"}, rows)
+		return
+	}
+	if projects == nil {
+		projects = []ProjectWithUser{}
+	}
+	// Full keys are only sent by the reveal endpoint, which is audited
+	for i := range projects {
+		projects[i].APIKeyLength = len(projects[i].APIKey)
+		projects[i].APIKey = maskAPIKey(projects[i].APIKey)
+	}
+	writeJSON(w, projects, http.StatusOK)
+}
@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxAnnotationLabel       = 120
+	maxAnnotationsPerProject = 500
+	// annotationRetention matches the analytics TTL; older markers have no data to sit on
+	annotationRetention = 365 * 24 * time.Hour
+)
+
+var annotationColorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+type AnnotationRequest struct {
+	Date  string `json:"date"` // YYYY-MM-DD
+	Label string `json:"label"`
+	Color string `json:"color,omitempty"`
+}
+
+// validateAnnotation checks label length, color format and that the date is within retention
+func validateAnnotation(req *AnnotationRequest, now time.Time) error {
+	if req.Label == "" {
+		return fmt.Errorf("Label required")
+	}
+	if utf8.RuneCountInString(req.Label) > maxAnnotationLabel {
+		return fmt.Errorf("Label must be at most %d characters", maxAnnotationLabel)
+	}
+	if req.Color != "" && !annotationColorRe.MatchString(req.Color) {
+		return fmt.Errorf("Color must be a hex value like #ff0000")
+	}
+
+	date, err := time.Parse("2006-01-02", req.Date)
+	if err != nil {
+		return fmt.Errorf("Date must be YYYY-MM-DD")
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if date.Before(today.Add(-annotationRetention)) || date.After(today.AddDate(0, 0, 1)) {
+		return fmt.Errorf("Date must be within the data retention window")
+	}
+	return nil
+}
+
+// createAnnotation validates, enforces the per-project cap and inserts
+func (h *Handler) createAnnotation(w http.ResponseWriter, r *http.Request, projectID, createdBy string) {
+	var req AnnotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateAnnotation(&req, time.Now().UTC()); err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	annotation, err := h.db.CreateAnnotation(projectID, req.Date, req.Label, req.Color, createdBy, maxAnnotationsPerProject)
+	if err != nil {
+		writeCreateError(w, "Failed to create annotation", err)
+		return
+	}
+
+	writeJSON(w, annotation, http.StatusCreated)
+}
+
+// HandleGetAnnotations returns all annotations for a project
+func (h *Handler) HandleGetAnnotations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	annotations, err := h.db.GetAnnotationsByProjectID(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get annotations", err)
+		return
+	}
+
+	if annotations == nil {
+		annotations = []Annotation{}
+	}
+
+	writeJSON(w, annotations, http.StatusOK)
+}
+
+// HandleCreateAnnotation creates an annotation for a project the user owns
+func (h *Handler) HandleCreateAnnotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	h.createAnnotation(w, r, project.ID, user.Email)
+}
+
+// HandleCreateAnnotationWithAPIKey lets CI mark deploys using the project API key
+func (h *Handler) HandleCreateAnnotationWithAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		writeJSON(w, map[string]string{"error": "API key required"}, http.StatusUnauthorized)
+		return
+	}
+
+	project, err := h.ValidateAPIKey(apiKey)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid API key"}, http.StatusUnauthorized)
+		return
+	}
+
+	h.createAnnotation(w, r, project.ID, "api-key")
+}
+
+// HandleUpdateAnnotation updates an annotation
+func (h *Handler) HandleUpdateAnnotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	annotationID := r.URL.Query().Get("id")
+	if domain == "" || annotationID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and annotation ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	var req AnnotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateAnnotation(&req, time.Now().UTC()); err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	annotation, err := h.db.UpdateAnnotation(annotationID, project.ID, req.Date, req.Label, req.Color)
+	if err != nil {
+		writeServerError(w, "Failed to update annotation", err)
+		return
+	}
+
+	writeJSON(w, annotation, http.StatusOK)
+}
+
+// HandleDeleteAnnotation deletes an annotation
+func (h *Handler) HandleDeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	annotationID := r.URL.Query().Get("id")
+	if domain == "" || annotationID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and annotation ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.DeleteAnnotation(annotationID, project.ID); err != nil {
+		writeServerError(w, "Failed to delete annotation", err)
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "deleted"}, http.StatusOK)
+}
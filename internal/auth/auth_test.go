@@ -2,13 +2,31 @@ package auth
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/shortid/clickresearch-stats/internal/access"
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/secretbox"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+	"github.com/shortid/clickresearch-stats/internal/urlbuilder"
 )
 
 func TestGenerateAPIKey(t *testing.T) {
@@ -215,6 +233,141 @@ func TestHandleRegister_MethodNotAllowed(t *testing.T) {
 	}
 }
 
+func TestHandleRegisterAndLogin_InvalidBody(t *testing.T) {
+	h := &Handler{}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		fields      string
+	}{
+		{"not json", "text/plain", `{"email":"a@example.com","password":"x"}`, http.StatusUnsupportedMediaType, ""},
+		{"syntax", "application/json", `{"email":`, http.StatusBadRequest, ""},
+		{"wrong type", "application/json", `{"email":"a@example.com","password":123}`, http.StatusBadRequest, "password"},
+		{"unknown field", "application/json", `{"email":"a@example.com","pasword":"x"}`, http.StatusBadRequest, "pasword"},
+		{"missing", "application/json", `{"email":" "}`, http.StatusUnprocessableEntity, "email,password"},
+	}
+	for _, tt := range tests {
+		for path, handle := range map[string]http.HandlerFunc{"/api/auth/register": h.HandleRegister, "/api/auth/login": h.HandleLogin} {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			handle(w, req)
+
+			var body struct {
+				Field  string `json:"field"`
+				Errors []struct {
+					Field string `json:"field"`
+				} `json:"errors"`
+			}
+			json.NewDecoder(w.Body).Decode(&body)
+			fields := body.Field
+			for i, e := range body.Errors {
+				if i > 0 {
+					fields += ","
+				}
+				fields += e.Field
+			}
+			if w.Code != tt.status || fields != tt.fields {
+				t.Errorf("%s %s: status = %d, fields = %q, want %d %q", path, tt.name, w.Code, fields, tt.status, tt.fields)
+			}
+		}
+	}
+}
+
+// stubBreaches is a BreachChecker with a fixed answer
+type stubBreaches struct {
+	breached bool
+	err      error
+}
+
+func (s stubBreaches) Breached(ctx context.Context, password string) (bool, error) {
+	return s.breached, s.err
+}
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		breaches BreachChecker
+		want     string
+	}{
+		{"ok", "Tr0ub4dor&3", nil, ""},
+		{"passphrase", "correcthorsebattery", nil, ""},
+		{"too short", "Xy7!kq", nil, PasswordTooShort},
+		{"email", "Alice.Smith@Example.com", nil, PasswordIsEmail},
+		{"email local part", "alice.smith", nil, PasswordIsEmail},
+		{"sequence", "1234567890", nil, PasswordTooWeak},
+		{"repeated", "zzzzzzzzz1", nil, PasswordTooWeak},
+		{"common", "Password123", nil, PasswordTooWeak},
+		{"breached", "Tr0ub4dor&3", stubBreaches{breached: true}, PasswordBreached},
+		{"breach check down", "Tr0ub4dor&3", stubBreaches{err: context.DeadlineExceeded}, ""},
+	}
+	for _, tt := range tests {
+		p := DefaultPasswordPolicy
+		p.Breached = tt.breaches
+		reason := p.Check(context.Background(), tt.password, "alice.smith@example.com")
+		got := ""
+		if reason != nil {
+			got = reason.Code
+		}
+		if got != tt.want {
+			t.Errorf("%s: code = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHIBPChecker(t *testing.T) {
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow/5BAA6" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if !strings.HasSuffix(r.URL.Path, "/5BAA6") || r.Header.Get("Add-Padding") != "true" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9659365\r\n")
+	}))
+	defer srv.Close()
+
+	c := &HIBPChecker{BaseURL: srv.URL + "/", Client: srv.Client()}
+	if breached, err := c.Breached(context.Background(), "password"); err != nil || !breached {
+		t.Errorf("password: breached = %v, err = %v", breached, err)
+	}
+	if breached, err := c.Breached(context.Background(), "Tr0ub4dor&3"); err == nil || breached {
+		// The stub only serves the 5BAA6 range
+		t.Errorf("other range: breached = %v, err = %v", breached, err)
+	}
+
+	// A slow API fails open
+	slow := &HIBPChecker{BaseURL: srv.URL + "/slow/", Client: &http.Client{Timeout: 50 * time.Millisecond}}
+	p := PasswordPolicy{MinLength: 1, Breached: slow}
+	if reason := p.Check(context.Background(), "password", ""); reason != nil {
+		t.Errorf("slow API rejected with %+v", reason)
+	}
+}
+
+func TestHandleRegister_WeakPassword(t *testing.T) {
+	h := &Handler{}
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/register", strings.NewReader(`{"email":"a@example.com","password":"short"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.HandleRegister(w, req)
+
+	var body struct {
+		Errors []struct {
+			Field string `json:"field"`
+			Code  string `json:"code"`
+		} `json:"errors"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusUnprocessableEntity || len(body.Errors) != 1 || body.Errors[0].Code != PasswordTooShort {
+		t.Errorf("status = %d, errors = %+v", w.Code, body.Errors)
+	}
+}
+
 func TestHandleMe_MethodNotAllowed(t *testing.T) {
 	h := &Handler{}
 
@@ -258,6 +411,51 @@ func TestHandleGoogleLogin_NotConfigured(t *testing.T) {
 	}
 }
 
+func TestHandleGoogleLogin_RedirectURI(t *testing.T) {
+	urls, err := urlbuilder.New("https://stats.example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{googleClientID: "id", frontendURL: "https://example.com", urls: urls}
+
+	req := httptest.NewRequest(http.MethodGet, "http://internal:8080/api/auth/google", nil)
+	req.Header.Set("X-Forwarded-Host", "evil.example.net")
+	w := httptest.NewRecorder()
+	h.HandleGoogleLogin(w, req)
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loc.Query().Get("redirect_uri"); got != "https://stats.example.com/api/auth/google/callback" {
+		t.Errorf("redirect_uri = %s, want the callback on the public URL", got)
+	}
+
+	h.googleRedirectURL = "https://auth.example.com/callback"
+	if got := h.googleRedirect(req); got != h.googleRedirectURL {
+		t.Errorf("redirect with GOOGLE_REDIRECT_URL = %s", got)
+	}
+}
+
+func TestNewBadgeSettings(t *testing.T) {
+	got := newBadgeSettings("https://stats.example.com", "abc")
+	if got.SVGURL != "https://stats.example.com/api/public/badge/abc.svg" || got.JSONURL != "https://stats.example.com/api/public/badge/abc.json" {
+		t.Errorf("badge settings = %+v", got)
+	}
+	if got := newBadgeSettings("https://stats.example.com", ""); got.Enabled || got.SVGURL != "" {
+		t.Errorf("disabled badge settings = %+v", got)
+	}
+}
+
+func TestTrackingSnippet(t *testing.T) {
+	if got := trackingSnippet("", "example.com"); !strings.Contains(got, `n.src="https://shortid.me/cr.js"`) {
+		t.Errorf("default snippet = %s", got)
+	}
+	if got := trackingSnippet("https://app.example.com/", "example.com"); !strings.Contains(got, `n.src="https://app.example.com/cr.js"`) {
+		t.Errorf("snippet = %s", got)
+	}
+}
+
 func TestHandleGoogleVerify_MethodNotAllowed(t *testing.T) {
 	h := &Handler{}
 
@@ -424,3 +622,2199 @@ func TestIsAdmin(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleSegments_MethodNotAllowed(t *testing.T) {
+	h := &Handler{}
+
+	tests := []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{"list", http.MethodPost, h.HandleGetSegments},
+		{"create", http.MethodGet, h.HandleCreateSegment},
+		{"update", http.MethodPost, h.HandleUpdateSegment},
+		{"delete", http.MethodGet, h.HandleDeleteSegment},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/segments", nil)
+			w := httptest.NewRecorder()
+
+			tt.handler(w, req)
+
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("Status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+			}
+		})
+	}
+}
+
+func TestDecodeSegmentRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"valid", `{"name":"Mobile DE","filters":{"country":"DE","device":"mobile"}}`, false},
+		{"missing name", `{"filters":{"country":"DE"}}`, true},
+		{"no filters", `{"name":"Empty","filters":{}}`, true},
+		{"unknown filter field", `{"name":"Bad","filters":{"planet":"Mars"}}`, true},
+		{"invalid json", `{`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/segments/create", bytes.NewReader([]byte(tt.body)))
+			_, err := decodeSegmentRequest(req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeSegmentRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateAnnotation(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	longLabel := strings.Repeat("é", maxAnnotationLabel+1)
+
+	tests := []struct {
+		name    string
+		req     AnnotationRequest
+		wantErr bool
+	}{
+		{"valid", AnnotationRequest{Date: "2024-06-01", Label: "v2 launch", Color: "#ff8800"}, false},
+		{"today", AnnotationRequest{Date: "2024-06-15", Label: "deploy"}, false},
+		{"max label", AnnotationRequest{Date: "2024-06-01", Label: strings.Repeat("é", maxAnnotationLabel)}, false},
+		{"label too long", AnnotationRequest{Date: "2024-06-01", Label: longLabel}, true},
+		{"empty label", AnnotationRequest{Date: "2024-06-01"}, true},
+		{"bad date", AnnotationRequest{Date: "06/01/2024", Label: "x"}, true},
+		{"outside retention", AnnotationRequest{Date: "2023-01-01", Label: "x"}, true},
+		{"far future", AnnotationRequest{Date: "2024-07-01", Label: "x"}, true},
+		{"bad color", AnnotationRequest{Date: "2024-06-01", Label: "x", Color: "red"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAnnotation(&tt.req, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateAnnotation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleCreateAnnotationWithAPIKey_NoKey(t *testing.T) {
+	h := &Handler{}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/annotations/ci", nil)
+	w := httptest.NewRecorder()
+
+	h.HandleCreateAnnotationWithAPIKey(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireAdmin_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	called := false
+	wrapped := h.RequireAdmin(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	w := httptest.NewRecorder()
+	wrapped(w, httptest.NewRequest(http.MethodGet, "/api/stats/debug", nil))
+
+	if w.Code != http.StatusForbidden || called {
+		t.Errorf("Status = %d, called = %v; want 403 and not called", w.Code, called)
+	}
+}
+
+func TestRequestRole(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	if role := h.RequestRole(httptest.NewRequest(http.MethodGet, "/api/stats/overview", nil)); role != "" {
+		t.Errorf("anonymous role = %q, want empty", role)
+	}
+
+	token, err := h.generateToken(&User{ID: "demo-1", Email: "demo@shortid.me", Role: "demo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/stats/overview", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if role := h.RequestRole(req); role != "demo" {
+		t.Errorf("role = %q, want demo", role)
+	}
+}
+
+func TestSessionCookie_Auth(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	h.SetSessionCookie("sid")
+	demo, _ := h.generateToken(&User{ID: "demo-1", Email: "demo@shortid.me", Role: "demo"})
+	admin, _ := h.generateToken(&User{ID: "admin-1", Email: "admin@example.com", Role: "admin"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stats/overview", nil)
+	req.AddCookie(&http.Cookie{Name: "sid", Value: demo})
+	if role := h.RequestRole(req); role != "demo" {
+		t.Errorf("cookie role = %q, want demo", role)
+	}
+
+	// The Authorization header wins over the cookie
+	req.Header.Set("Authorization", "Bearer "+admin)
+	if role := h.RequestRole(req); role != "admin" {
+		t.Errorf("header role = %q, want admin", role)
+	}
+
+	// Only the configured cookie name counts
+	req = httptest.NewRequest(http.MethodGet, "/api/stats/overview", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultSessionCookie, Value: demo})
+	if role := h.RequestRole(req); role != "" {
+		t.Errorf("role from %s = %q, want none", DefaultSessionCookie, role)
+	}
+}
+
+func TestSessionCookie_CSRF(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	token, _ := h.generateToken(&User{ID: "user-1", Email: "user@example.com", Role: "user"})
+	request := func(method, header string) *http.Request {
+		req := httptest.NewRequest(method, "/api/projects/delete?id=p1", nil)
+		req.AddCookie(&http.Cookie{Name: DefaultSessionCookie, Value: token})
+		req.AddCookie(&http.Cookie{Name: DefaultSessionCookie + "_csrf", Value: "csrf-1"})
+		if header != "" {
+			req.Header.Set(CSRFHeader, header)
+		}
+		return req
+	}
+
+	for _, header := range []string{"", "csrf-2"} {
+		if _, err := h.bearerClaims(request(http.MethodPost, header)); err == nil {
+			t.Errorf("POST with CSRF header %q authenticated", header)
+		}
+	}
+	if claims, err := h.bearerClaims(request(http.MethodPost, "csrf-1")); err != nil || claims.UserID != "user-1" {
+		t.Errorf("POST with matching CSRF header: %v, %v", claims, err)
+	}
+
+	// A rejected cookie session is no session: writes are refused before the database
+	w := httptest.NewRecorder()
+	h.HandleDeleteProject(w, request(http.MethodDelete, ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("delete without CSRF header: status %d, want 401", w.Code)
+	}
+
+	// Reads and bearer tokens need no CSRF token
+	if _, err := h.bearerClaims(request(http.MethodGet, "")); err != nil {
+		t.Errorf("GET with cookie: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/projects/create", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if _, err := h.bearerClaims(req); err != nil {
+		t.Errorf("POST with bearer token: %v", err)
+	}
+}
+
+func TestSessionResponse(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	user := &User{ID: "user-1", Email: "user@example.com"}
+
+	w := httptest.NewRecorder()
+	if resp := h.sessionResponse(w, httptest.NewRequest(http.MethodPost, "/api/auth/login", nil), "tok", user); resp.Token != "tok" || resp.CSRFToken != "" || len(w.Result().Cookies()) != 0 {
+		t.Errorf("bearer sign-in: %+v, cookies %v", resp, w.Result().Cookies())
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	req.Header.Set("X-Use-Cookie", "true")
+	resp := h.sessionResponse(w, req, "tok", user)
+	if resp.Token != "" || resp.CSRFToken == "" || resp.User != user {
+		t.Errorf("cookie sign-in: %+v", resp)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	session, csrf := cookies[DefaultSessionCookie], cookies[DefaultSessionCookie+"_csrf"]
+	if session == nil || session.Value != "tok" || !session.HttpOnly || !session.Secure || session.SameSite != http.SameSiteLaxMode || session.MaxAge != int(tokenTTL.Seconds()) {
+		t.Errorf("session cookie = %+v", session)
+	}
+	if csrf == nil || csrf.Value != resp.CSRFToken || csrf.HttpOnly || !csrf.Secure {
+		t.Errorf("CSRF cookie = %+v", csrf)
+	}
+}
+
+func TestHandleLogout(t *testing.T) {
+	h := &Handler{}
+	w := httptest.NewRecorder()
+	h.HandleLogout(w, httptest.NewRequest(http.MethodPost, "/api/auth/logout?use_cookie=true", nil))
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 2 {
+		t.Fatalf("status %d, cookies %v", w.Code, cookies)
+	}
+	for _, c := range cookies {
+		if c.MaxAge >= 0 || c.Value != "" {
+			t.Errorf("cookie %s not cleared: %+v", c.Name, c)
+		}
+	}
+}
+
+func TestHandleAdminSpamReferrers_RequiresAdmin(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/spam-referrers", nil)
+	w := httptest.NewRecorder()
+
+	h.HandleAdminSpamReferrers(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestHandleAdminLists_RequireAdmin(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	for path, handle := range map[string]http.HandlerFunc{"/api/admin/users": h.HandleAdminUsers, "/api/admin/projects": h.HandleAdminProjects,
+		"/api/admin/projects/limits?project_id=p1": h.HandleAdminProjectLimits, "/api/admin/value-overrides": h.HandleAdminValueOverrides,
+		"/api/admin/sync-status": h.HandleAdminSyncStatus} {
+		w := httptest.NewRecorder()
+		handle(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want %d", path, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestProjectLimits(t *testing.T) {
+	h := &Handler{}
+	if got := h.limits(); got != DefaultProjectLimits {
+		t.Errorf("unset limits = %+v", got)
+	}
+	h.SetDefaultProjectLimits(ProjectLimits{Funnels: 10})
+	if got := h.limits(); got != (ProjectLimits{Funnels: 10, Goals: DefaultProjectLimits.Goals, Segments: DefaultProjectLimits.Segments}) {
+		t.Errorf("configured limits = %+v", got)
+	}
+
+	goals := 500
+	if got := (ProjectLimitOverrides{Goals: &goals}).apply(h.limits()); got.Goals != 500 || got.Funnels != 10 {
+		t.Errorf("overridden limits = %+v", got)
+	}
+
+	neg := -1
+	errs := ProjectLimitsRequest{ProjectLimitOverrides: ProjectLimitOverrides{Segments: &neg}}.validate()
+	if len(errs) != 2 || errs[0].Field != "project_id" || errs[1].Field != "segments" {
+		t.Errorf("errs = %v", errs)
+	}
+}
+
+func TestWriteCreateError_Limit(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeCreateError(w, "Failed to create funnel", fmt.Errorf("create: %w", &LimitError{Resource: "funnel", Count: 50, Limit: 50}))
+	var body struct {
+		Error string `json:"error"`
+		Count int    `json:"count"`
+		Limit int    `json:"limit"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusForbidden || body.Error != "Funnel limit of 50 reached" || body.Count != 50 || body.Limit != 50 {
+		t.Errorf("status = %d, body = %+v", w.Code, body)
+	}
+
+	w = httptest.NewRecorder()
+	writeCreateError(w, "Failed to create funnel", sql.ErrConnDone)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("other error: status = %d", w.Code)
+	}
+}
+
+func TestParseAdminFilter(t *testing.T) {
+	f, err := parseAdminFilter(url.Values{})
+	if err != nil || f.Limit != defaultAdminPageSize || f.Offset != 0 || f.CreatedAfter != nil {
+		t.Errorf("defaults = %+v, err = %v", f, err)
+	}
+
+	f, err = parseAdminFilter(url.Values{"email": {" Acme "}, "role": {"admin"}, "synced_from": {"shortid"},
+		"created_after": {"2025-03-01"}, "limit": {"5000"}, "offset": {"200"}})
+	if err != nil || f.Email != "Acme" || f.Role != "admin" || f.SyncedFrom != "shortid" ||
+		f.Limit != maxAdminPageSize || f.Offset != 200 || !f.CreatedAfter.Equal(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("filter = %+v, err = %v", f, err)
+	}
+
+	for _, q := range []string{"limit=0", "limit=x", "offset=-1", "created_after=yesterday"} {
+		v, _ := url.ParseQuery(q)
+		if _, err := parseAdminFilter(v); err == nil {
+			t.Errorf("%s: no error", q)
+		}
+	}
+}
+
+func TestAdminFilterWhere(t *testing.T) {
+	if where, args := (AdminFilter{}).where("u.created_at"); where != "" || args != nil {
+		t.Errorf("empty filter: %q %v", where, args)
+	}
+
+	after := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	where, args := AdminFilter{Email: "50%_off", Role: "user", CreatedAfter: &after}.where("p.created_at")
+	if want := " WHERE u.email ILIKE $1 AND u.role = $2 AND p.created_at >= $3"; where != want {
+		t.Errorf("where = %q, want %q", where, want)
+	}
+	if len(args) != 3 || args[0] != `%50\%\_off%` {
+		t.Errorf("args = %v", args)
+	}
+	if page, pageArgs := (AdminFilter{Limit: 100, Offset: 300}).page(len(args)); page != " LIMIT $4 OFFSET $5" || pageArgs[1] != 300 {
+		t.Errorf("page = %q %v", page, pageArgs)
+	}
+}
+
+// fakeAdminDB serves fixed admin lists and records the filter it was given
+type fakeAdminDB struct {
+	filter   AdminFilter
+	projects []ProjectWithUser
+}
+
+func (db *fakeAdminDB) GetAllUsersAdmin(f AdminFilter) ([]User, int, error) {
+	db.filter = f
+	name := "=HYPERLINK(\"x\")"
+	return []User{{ID: "u1", Email: "a@example.com", Name: &name, Role: "user", CreatedAt: "2025-03-01T00:00:00Z", PermanentEnergy: 5}}, 42, nil
+}
+
+func (db *fakeAdminDB) GetAllProjectsAdmin(f AdminFilter) ([]ProjectWithUser, int, error) {
+	db.filter = f
+	return db.projects, len(db.projects), nil
+}
+
+func TestServeAdminLists(t *testing.T) {
+	db := &fakeAdminDB{}
+	w := httptest.NewRecorder()
+	serveAdminUsers(db, w, httptest.NewRequest(http.MethodGet, "/api/admin/users?role=user&limit=10", nil))
+	var users []User
+	json.NewDecoder(w.Body).Decode(&users)
+	if w.Code != 200 || w.Header().Get("X-Total-Count") != "42" || len(users) != 1 || db.filter.Role != "user" || db.filter.Limit != 10 {
+		t.Errorf("json: status = %d, total = %q, users = %v, filter = %+v", w.Code, w.Header().Get("X-Total-Count"), users, db.filter)
+	}
+
+	w = httptest.NewRecorder()
+	serveAdminUsers(db, w, httptest.NewRequest(http.MethodGet, "/api/admin/users?format=csv", nil))
+	want := "id,email,name,role,created_at,synced_from,permanent_energy,subscription_energy,daily_bonus_energy\n" +
+		"u1,a@example.com,\"'=HYPERLINK(\"\"x\"\")\",user,2025-03-01T00:00:00Z,,5,0,0\n"
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") || w.Body.String() != want {
+		t.Errorf("csv: content type %q, body:\n%s", ct, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	serveAdminProjects(db, w, httptest.NewRequest(http.MethodGet, "/api/admin/projects", nil))
+	if w.Code != 200 || w.Header().Get("X-Total-Count") != "0" || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("projects: status = %d, body = %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	serveAdminProjects(db, w, httptest.NewRequest(http.MethodGet, "/api/admin/projects?limit=-5", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad limit: status = %d", w.Code)
+	}
+}
+
+func TestMaskAPIKey(t *testing.T) {
+	key := generateAPIKey()
+	for in, want := range map[string]string{
+		key:          key[:8] + "…",
+		"0123456789": "01234…",
+		"ab":         "a…",
+		"":           "",
+	} {
+		if got := maskAPIKey(in); got != want {
+			t.Errorf("maskAPIKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	db := &fakeAdminDB{projects: []ProjectWithUser{{ID: "p1", Domain: "example.com", APIKey: key}}}
+	w := httptest.NewRecorder()
+	serveAdminProjects(db, w, httptest.NewRequest(http.MethodGet, "/api/admin/projects", nil))
+	var projects []ProjectWithUser
+	json.NewDecoder(w.Body).Decode(&projects)
+	if len(projects) != 1 || projects[0].APIKey != key[:8]+"…" || projects[0].APIKeyLength != 64 {
+		t.Errorf("admin projects = %+v, want the key masked", projects)
+	}
+}
+
+func TestNewSnapshotSlug(t *testing.T) {
+	slug1, err := newSnapshotSlug()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slug2, _ := newSnapshotSlug()
+
+	// 24 random bytes base64url-encoded, at least 128 bits of entropy
+	if len(slug1) != 32 || snapshotSlugBytes*8 < 128 {
+		t.Errorf("slug length = %d, want 32", len(slug1))
+	}
+	if slug1 == slug2 {
+		t.Error("slugs should be unique")
+	}
+	if strings.ContainsAny(slug1, "/+=") {
+		t.Errorf("slug %q is not URL-safe", slug1)
+	}
+}
+
+func TestNewSnapshotPayload_Anonymized(t *testing.T) {
+	req := &FunnelSnapshotRequest{
+		Period: "30d",
+		Window: 60,
+		Steps: []funnel.Step{
+			{Type: "pageview", Value: "/pricing"},
+			{Type: "event", Value: "signup"},
+			{Type: "pageview", Value: "/welcome"},
+		},
+	}
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	newResult := func() *stats.FunnelResult {
+		return &stats.FunnelResult{Steps: []stats.FunnelStep{{Name: "/pricing", Count: 10}, {Name: "event:signup", Count: 5}, {Name: "/welcome", Count: 2}}}
+	}
+
+	payload := newSnapshotPayload(req, "example.com", now.AddDate(0, 0, -30), now, newResult(), true, now)
+	data, _ := json.Marshal(payload)
+	if strings.Contains(string(data), "/pricing") || strings.Contains(string(data), "/welcome") {
+		t.Errorf("anonymized payload leaks pathnames: %s", data)
+	}
+	want := []string{"Step 1", "event:signup", "Step 3"}
+	for i, label := range want {
+		if payload.Steps[i] != label || payload.Result.Steps[i].Name != label {
+			t.Errorf("step %d = %q/%q, want %q", i, payload.Steps[i], payload.Result.Steps[i].Name, label)
+		}
+	}
+
+	payload = newSnapshotPayload(req, "example.com", now.AddDate(0, 0, -30), now, newResult(), false, now)
+	if payload.Steps[0] != "/pricing" || payload.Result.Steps[2].Name != "/welcome" {
+		t.Errorf("plain payload steps = %v", payload.Steps)
+	}
+}
+
+func TestHandleCreateFunnelSnapshot_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	w := httptest.NewRecorder()
+	h.HandleCreateFunnelSnapshot(w, httptest.NewRequest(http.MethodPost, "/api/stats/funnel-snapshot?domain=example.com", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHandlePublicFunnelSnapshot_BadSlug(t *testing.T) {
+	h := &Handler{}
+	for _, path := range []string{"/api/public/funnel/", "/api/public/funnel/a/b"} {
+		w := httptest.NewRecorder()
+		h.HandlePublicFunnelSnapshot(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: Status = %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+// fakeHistoryDB keeps funnel results in memory, deduping like the unique constraint
+type fakeHistoryDB struct {
+	funnels []SavedFunnel
+	results map[string]map[string][]byte // funnel ID -> date -> result
+}
+
+func (db *fakeHistoryDB) GetAllSavedFunnels() ([]SavedFunnel, error) { return db.funnels, nil }
+
+func (db *fakeHistoryDB) DomainAliases(domain string) ([]string, error) { return nil, nil }
+
+func (db *fakeHistoryDB) GetFunnelResultDates(funnelID string, since time.Time) (map[string]bool, error) {
+	dates := make(map[string]bool)
+	for date := range db.results[funnelID] {
+		if date >= since.Format("2006-01-02") {
+			dates[date] = true
+		}
+	}
+	return dates, nil
+}
+
+func (db *fakeHistoryDB) SaveFunnelResult(funnelID, date string, result []byte) error {
+	if db.results[funnelID] == nil {
+		db.results[funnelID] = make(map[string][]byte)
+	}
+	if _, ok := db.results[funnelID][date]; !ok {
+		db.results[funnelID][date] = result
+	}
+	return nil
+}
+
+// dailyFunnelStore has funnel entries every day except emptyDay
+type dailyFunnelStore struct {
+	stats.StoreInterface
+	emptyDay string
+	calls    int
+}
+
+func (s *dailyFunnelStore) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, windowMinutes int) (*stats.FunnelResult, error) {
+	s.calls++
+	if from.Format("2006-01-02") == s.emptyDay {
+		return &stats.FunnelResult{}, nil
+	}
+	return &stats.FunnelResult{TotalStart: 10, TotalFinish: 4, Conversion: 40}, nil
+}
+
+func TestRunFunnelHistory_BackfillsAndDedupes(t *testing.T) {
+	db := &fakeHistoryDB{
+		funnels: []SavedFunnel{
+			{Funnel: Funnel{ID: "f1", Steps: `[{"type":"pageview","value":"/"},{"type":"event","value":"signup"}]`, Window: 60}, Domain: "example.com"},
+			{Funnel: Funnel{ID: "bad", Steps: `[{"type":"pageview","value":"/"}]`}, Domain: "example.com"},
+		},
+		results: map[string]map[string][]byte{},
+	}
+	store := &dailyFunnelStore{emptyDay: "2024-03-12"}
+	now := time.Date(2024, 3, 15, 3, 0, 0, 0, time.UTC)
+
+	stored, err := runFunnelHistory(context.Background(), db, store, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// March 8-14 is seven completed days, one without data
+	if stored != 6 || len(db.results["f1"]) != 6 {
+		t.Errorf("stored = %d (%d rows), want 6", stored, len(db.results["f1"]))
+	}
+	if _, ok := db.results["f1"]["2024-03-12"]; ok {
+		t.Error("stored a result for a day without data")
+	}
+	if _, ok := db.results["f1"]["2024-03-15"]; ok {
+		t.Error("stored a result for the current, incomplete day")
+	}
+	if len(db.results["bad"]) != 0 {
+		t.Error("stored results for a funnel with fewer than 2 steps")
+	}
+
+	// A second run the same day only retries the empty day
+	store.calls = 0
+	stored, _ = runFunnelHistory(context.Background(), db, store, now)
+	if stored != 0 || store.calls != 1 {
+		t.Errorf("rerun stored %d with %d queries, want 0 and 1", stored, store.calls)
+	}
+}
+
+func TestNextFunnelHistoryRun(t *testing.T) {
+	before := time.Date(2024, 3, 15, 0, 5, 0, 0, time.UTC)
+	if got := nextFunnelHistoryRun(before); !got.Equal(time.Date(2024, 3, 15, 0, 15, 0, 0, time.UTC)) {
+		t.Errorf("next run = %v", got)
+	}
+	after := time.Date(2024, 3, 15, 0, 15, 0, 0, time.UTC)
+	if got := nextFunnelHistoryRun(after); !got.Equal(time.Date(2024, 3, 16, 0, 15, 0, 0, time.UTC)) {
+		t.Errorf("next run = %v", got)
+	}
+}
+
+func TestHandleGetFunnelHistory_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	w := httptest.NewRecorder()
+	h.HandleGetFunnelHistory(w, httptest.NewRequest(http.MethodGet, "/api/funnels/history?domain=example.com&id=x", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// fakeTransferDB keeps users, projects and transfers in memory
+type fakeTransferDB struct {
+	users     map[string]*User // by ID
+	projects  map[string]*Project
+	transfers []ProjectTransfer
+}
+
+func (db *fakeTransferDB) GetProjectByID(id string) (*Project, error) {
+	if p, ok := db.projects[id]; ok {
+		return p, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (db *fakeTransferDB) GetUserByEmail(email string) (*User, error) {
+	for _, u := range db.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (db *fakeTransferDB) GetUserByID(id string) (*User, error) {
+	if u, ok := db.users[id]; ok {
+		return u, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (db *fakeTransferDB) TransferProject(projectID, fromUserID, toUserID, toEmail, initiatedBy string) error {
+	db.projects[projectID].UserID = toUserID
+	db.transfers = append(db.transfers, ProjectTransfer{ProjectID: projectID, FromUserID: fromUserID, ToEmail: toEmail, ToUserID: &toUserID, InitiatedBy: initiatedBy, Status: "completed"})
+	return nil
+}
+
+func (db *fakeTransferDB) CreatePendingTransfer(projectID, fromUserID, toEmail, initiatedBy string) error {
+	db.transfers = append(db.transfers, ProjectTransfer{ID: "t1", ProjectID: projectID, Domain: db.projects[projectID].Domain, FromUserID: fromUserID, ToEmail: toEmail, InitiatedBy: initiatedBy, Status: "pending"})
+	return nil
+}
+
+func (db *fakeTransferDB) GetPendingTransfers(email string) ([]ProjectTransfer, error) {
+	var pending []ProjectTransfer
+	for _, t := range db.transfers {
+		if t.Status == "pending" && strings.EqualFold(t.ToEmail, email) {
+			pending = append(pending, t)
+		}
+	}
+	return pending, nil
+}
+
+func (db *fakeTransferDB) CompletePendingTransfer(transferID, toUserID string) error {
+	for i, t := range db.transfers {
+		if t.ID == transferID && t.Status == "pending" {
+			db.projects[t.ProjectID].UserID = toUserID
+			db.transfers[i].Status = "completed"
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+type recordingMailer struct{ sent []string }
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.sent = append(m.sent, to+": "+subject)
+	return nil
+}
+
+func newFakeTransferDB() *fakeTransferDB {
+	return &fakeTransferDB{
+		users: map[string]*User{
+			"u-leaver": {ID: "u-leaver", Email: "leaver@example.com"},
+			"u-mate":   {ID: "u-mate", Email: "mate@example.com"},
+			"u-admin":  {ID: "u-admin", Email: "admin@example.com", Role: "admin"},
+		},
+		projects: map[string]*Project{
+			"p1": {ID: "p1", UserID: "u-leaver", Domain: "example.com"},
+		},
+	}
+}
+
+func TestProjectTransfer_AdminInitiated(t *testing.T) {
+	db := newFakeTransferDB()
+	mailer := &recordingMailer{}
+	tr := projectTransfers{db: db, mailer: mailer}
+	req := TransferProjectRequest{ProjectID: "p1", NewOwnerEmail: "Mate@example.com"}
+
+	// Someone who is neither owner nor admin can't move it
+	if _, err := tr.start(db.users["u-mate"], false, req); err != errTransferForbidden {
+		t.Fatalf("non-owner err = %v, want errTransferForbidden", err)
+	}
+
+	status, err := tr.start(db.users["u-admin"], true, req)
+	if err != nil || status != "completed" {
+		t.Fatalf("start = %q, %v", status, err)
+	}
+	if got := db.projects["p1"].UserID; got != "u-mate" {
+		t.Errorf("owner = %s, want u-mate", got)
+	}
+	if len(db.transfers) != 1 || db.transfers[0].FromUserID != "u-leaver" || db.transfers[0].InitiatedBy != "u-admin" {
+		t.Errorf("transfers = %+v", db.transfers)
+	}
+	want := []string{"leaver@example.com: Project transferred", "mate@example.com: You are now a project owner"}
+	if strings.Join(mailer.sent, "|") != strings.Join(want, "|") {
+		t.Errorf("sent = %v, want %v", mailer.sent, want)
+	}
+
+	if _, err := tr.start(db.users["u-admin"], true, req); err != errTransferSameOwner {
+		t.Errorf("repeat transfer err = %v, want errTransferSameOwner", err)
+	}
+}
+
+func TestProjectTransfer_PendingCompletesOnFirstLogin(t *testing.T) {
+	db := newFakeTransferDB()
+	mailer := &recordingMailer{}
+	tr := projectTransfers{db: db, mailer: mailer}
+
+	status, err := tr.start(db.users["u-leaver"], false, TransferProjectRequest{ProjectID: "p1", NewOwnerEmail: "new@example.com"})
+	if err != nil || status != "pending" {
+		t.Fatalf("start = %q, %v", status, err)
+	}
+	if got := db.projects["p1"].UserID; got != "u-leaver" {
+		t.Fatalf("owner changed to %s before the new user signed up", got)
+	}
+
+	// Other users' logins leave it alone
+	tr.completePending(db.users["u-mate"])
+	if got := db.projects["p1"].UserID; got != "u-leaver" {
+		t.Fatalf("owner = %s after an unrelated login", got)
+	}
+
+	newUser := &User{ID: "u-new", Email: "new@example.com"}
+	db.users[newUser.ID] = newUser
+	mailer.sent = nil
+	tr.completePending(newUser)
+
+	if got := db.projects["p1"].UserID; got != "u-new" {
+		t.Errorf("owner = %s, want u-new", got)
+	}
+	if db.transfers[0].Status != "completed" {
+		t.Errorf("transfer status = %s", db.transfers[0].Status)
+	}
+	if len(mailer.sent) != 2 || !strings.HasPrefix(mailer.sent[0], "leaver@example.com") {
+		t.Errorf("sent = %v", mailer.sent)
+	}
+
+	// Logging in again is a no-op
+	mailer.sent = nil
+	tr.completePending(newUser)
+	if len(mailer.sent) != 0 {
+		t.Errorf("second login sent %v", mailer.sent)
+	}
+}
+
+func TestHandleTransferProject_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("test-secret")}
+	req := httptest.NewRequest(http.MethodPost, "/api/projects/transfer", strings.NewReader(`{"project_id":"p1","new_owner_email":"a@b.c"}`))
+	w := httptest.NewRecorder()
+	h.HandleTransferProject(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", w.Code)
+	}
+}
+
+// fakeSyncDB keeps users and projects in memory; domains are unique as in Postgres
+type fakeSyncDB struct {
+	users    map[string]*User // by email
+	projects map[string]*Project
+	aliases  map[string]bool
+	tagged   map[string]string
+}
+
+func newFakeSyncDB() *fakeSyncDB {
+	return &fakeSyncDB{
+		users:    map[string]*User{"other@example.com": {ID: "u-other", Email: "other@example.com"}},
+		projects: map[string]*Project{"taken.com": {ID: "p-taken", UserID: "u-other", Domain: "taken.com", APIKey: "key-taken"}},
+		aliases:  map[string]bool{"www.taken.com": true},
+		tagged:   map[string]string{},
+	}
+}
+
+func (db *fakeSyncDB) GetUserByEmail(email string) (*User, error) {
+	if u, ok := db.users[email]; ok {
+		return u, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (db *fakeSyncDB) CreateUser(email, passwordHash string, name *string, syncedFrom *string) (*User, error) {
+	u := &User{ID: fmt.Sprintf("u%d", len(db.users)), Email: email, SyncedFrom: syncedFrom}
+	db.users[email] = u
+	return u, nil
+}
+
+func (db *fakeSyncDB) CreateProject(userID, domain string, name *string) (*Project, error) {
+	if _, ok := db.projects[domain]; ok {
+		return nil, ErrDuplicateProject
+	}
+	if db.aliases[domain] {
+		return nil, ErrDomainIsAlias
+	}
+	p := &Project{ID: fmt.Sprintf("p%d", len(db.projects)), UserID: userID, Domain: domain, APIKey: "key-" + domain, Name: name}
+	db.projects[domain] = p
+	return p, nil
+}
+
+func (db *fakeSyncDB) GetProjectByDomain(domain string) (*Project, error) {
+	if p, ok := db.projects[domain]; ok {
+		return p, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (db *fakeSyncDB) SetProjectSyncedFrom(projectID, source string) error {
+	db.tagged[projectID] = source
+	return nil
+}
+
+func TestProjectSync_CreateThenResync(t *testing.T) {
+	db := newFakeSyncDB()
+	s := projectSyncs{db: db}
+
+	w := httptest.NewRecorder()
+	s.serve(w, SyncProjectPayload{Email: "new@example.com", Domain: "Shop.example.com"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("first sync status = %d, want 201: %s", w.Code, w.Body)
+	}
+	var first SyncProjectResponse
+	json.NewDecoder(w.Body).Decode(&first)
+	if first.Domain != "shop.example.com" || first.APIKey == "" || !strings.Contains(first.Snippet, "cr('init', 'shop.example.com')") {
+		t.Errorf("first sync = %+v", first)
+	}
+
+	// The retry spells the domain differently; it normalizes to the same project
+	w = httptest.NewRecorder()
+	s.serve(w, SyncProjectPayload{Email: "new@example.com", Domain: "www.shop.example.com"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("resync status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var again SyncProjectResponse
+	json.NewDecoder(w.Body).Decode(&again)
+	if again != first {
+		t.Errorf("resync = %+v, want %+v", again, first)
+	}
+	if len(db.projects) != 2 || len(db.users) != 2 {
+		t.Errorf("resync created records: %d projects, %d users", len(db.projects), len(db.users))
+	}
+	if got := db.tagged[db.projects["shop.example.com"].ID]; got != digestSource {
+		t.Errorf("project tagged %q, want %q", got, digestSource)
+	}
+}
+
+func TestProjectSync_OtherUsersDomain(t *testing.T) {
+	db := newFakeSyncDB()
+	w := httptest.NewRecorder()
+	projectSyncs{db: db}.serve(w, SyncProjectPayload{Email: "new@example.com", Domain: "taken.com"})
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409", w.Code)
+	}
+	var body map[string]any
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["owned_by_other_user"] != true || body["domain"] != "taken.com" {
+		t.Errorf("body = %v, want the conflict explained", body)
+	}
+	if strings.Contains(w.Body.String(), "key-taken") {
+		t.Error("conflict leaked the other user's API key")
+	}
+	if len(db.tagged) != 0 {
+		t.Errorf("tagged %v, want the other user's project left alone", db.tagged)
+	}
+}
+
+func TestProjectSync_AliasDomain(t *testing.T) {
+	db := newFakeSyncDB()
+	w := httptest.NewRecorder()
+	projectSyncs{db: db}.serve(w, SyncProjectPayload{Email: "new@example.com", Domain: "www.taken.com"})
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409", w.Code)
+	}
+	if len(db.projects) != 1 {
+		t.Errorf("projects = %v, want no project on the alias", db.projects)
+	}
+}
+
+// fakeDeniedDB keeps denied domains in memory
+type fakeDeniedDB struct {
+	mu     sync.Mutex
+	denied map[string]bool
+}
+
+func (f *fakeDeniedDB) DenyDomain(domain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.denied[domain] = true
+	return nil
+}
+
+func (f *fakeDeniedDB) AllowDomain(domain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.denied, domain)
+	return nil
+}
+
+func (f *fakeDeniedDB) DeniedDomains() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var domains []string
+	for d := range f.denied {
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+type fakePurger []string
+
+func (p *fakePurger) ForgetDomain(domain string) { *p = append(*p, domain) }
+
+func TestDomainDenials_DeleteThenCollect(t *testing.T) {
+	// A peer collector whose domain cache still lists the domain
+	peer := &DomainCache{
+		domains:    map[string]bool{"gone.com": true, "kept.com": true},
+		denied:     make(map[string]bool),
+		syncSecret: "sync",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(domainInvalidatePath, peer.HandleInvalidate)
+	mux.HandleFunc("/api/collect", func(w http.ResponseWriter, r *http.Request) {
+		if !peer.DomainExists(r.URL.Query().Get("domain")) {
+			http.Error(w, "Unknown domain", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	collect := func(domain string) int {
+		resp, err := http.Post(srv.URL+"/api/collect?domain="+domain, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	db := &fakeDeniedDB{denied: make(map[string]bool)}
+	purger := &fakePurger{}
+	d := newDomainDenials(db)
+	d.purger, d.peers, d.secret = purger, []string{srv.URL}, "sync"
+
+	if code := collect("gone.com"); code != http.StatusAccepted {
+		t.Fatalf("collect before deletion = %d, want 202", code)
+	}
+	start := time.Now()
+	d.deny("gone.com")
+	if !d.isDenied("gone.com") || !db.denied["gone.com"] {
+		t.Error("denial not applied locally and stored")
+	}
+	if len(*purger) != 1 || (*purger)[0] != "gone.com" {
+		t.Errorf("purged %v, want the cached stats of gone.com dropped", *purger)
+	}
+	for collect("gone.com") != http.StatusForbidden {
+		if time.Since(start) > time.Second {
+			t.Fatal("peer still accepts events of the deleted domain after a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if code := collect("kept.com"); code != http.StatusAccepted {
+		t.Errorf("collect of another domain = %d, want 202", code)
+	}
+
+	// Registering the domain again lifts the denial
+	projectSyncs{db: newFakeSyncDB(), denials: d}.serve(httptest.NewRecorder(),
+		SyncProjectPayload{Email: "new@example.com", Domain: "gone.com"})
+	if d.isDenied("gone.com") || db.denied["gone.com"] {
+		t.Error("denial kept after re-registration")
+	}
+	for collect("gone.com") != http.StatusAccepted {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("peer still refuses the re-registered domain")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDomainCache_HandleInvalidateRequiresSecret(t *testing.T) {
+	dc := &DomainCache{domains: map[string]bool{"a.com": true}, denied: make(map[string]bool), syncSecret: "sync"}
+	req := httptest.NewRequest(http.MethodPost, domainInvalidatePath, strings.NewReader(`{"domain":"a.com","denied":true}`))
+	req.Header.Set("X-Sync-Secret", "wrong")
+	w := httptest.NewRecorder()
+	dc.HandleInvalidate(w, req)
+	if w.Code != http.StatusUnauthorized || !dc.DomainExists("a.com") {
+		t.Errorf("status = %d, want 401 and the domain kept", w.Code)
+	}
+}
+
+func TestDomainCache_FileFallback(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() || r.Header.Get("X-Sync-Secret") != "sync" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, map[string][]string{"domains": {"a.com", "b.com"}, "denied": {"b.com"}}, http.StatusOK)
+	}))
+	defer srv.Close()
+	file := filepath.Join(t.TempDir(), "domains.json")
+
+	dc := NewDomainCache(srv.URL, "sync", DomainCacheConfig{File: file})
+	dc.Stop()
+	if st := dc.Status(); st.Source != "stats" || st.Domains != 2 || st.Denied != 1 || st.File != file {
+		t.Errorf("status = %+v, want 2 domains from stats", st)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("file mode = %o, want 600", mode)
+	}
+
+	// A non-200 answer falls back to the file of the configured path
+	up.Store(false)
+	dc = NewDomainCache(srv.URL, "sync", DomainCacheConfig{File: file})
+	dc.Stop()
+	if st := dc.Status(); st.Source != "file" || st.Domains != 2 {
+		t.Errorf("status = %+v, want 2 domains from the file", st)
+	}
+	if !dc.DomainExists("a.com") || dc.DomainExists("c.com") {
+		t.Error("domains from the file not applied")
+	}
+
+	if DefaultDomainCacheFile("8080") == DefaultDomainCacheFile("8081") {
+		t.Error("instances share the default file")
+	}
+}
+
+func TestNormalizeEventNameSettings(t *testing.T) {
+	got, err := normalizeEventNameSettings(EventNameSettings{
+		EnforceAllowList: true,
+		Names:            []string{" signup ", "signup", "checkout"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got.Names, ",") != "signup,checkout" {
+		t.Errorf("names = %v, want trimmed and deduped", got.Names)
+	}
+
+	for _, s := range []EventNameSettings{
+		{EnforceAllowList: true},
+		{Names: []string{"bad\nname"}},
+		{Names: []string{""}},
+	} {
+		if _, err := normalizeEventNameSettings(s); err == nil {
+			t.Errorf("%+v: no error", s)
+		}
+	}
+	// The guard alone needs no allow-list
+	if _, err := normalizeEventNameSettings(EventNameSettings{CardinalityGuard: true}); err != nil {
+		t.Errorf("guard only: %v", err)
+	}
+}
+
+// fakeExportDB records export runs in memory
+type fakeExportDB struct {
+	dests     []ExportDestination
+	exported  []string
+	failures  int
+	lastError string
+}
+
+func (db *fakeExportDB) GetAllExportDestinations() ([]ExportDestination, error) {
+	return db.dests, nil
+}
+
+func (db *fakeExportDB) DomainAliases(domain string) ([]string, error) { return nil, nil }
+
+func (db *fakeExportDB) RecordExportSuccess(id, date string) error {
+	db.exported = append(db.exported, date)
+	db.failures = 0
+	db.dests[0].LastExportedDate = &date
+	return nil
+}
+
+func (db *fakeExportDB) RecordExportFailure(id, errMsg string) (int, error) {
+	db.failures++
+	db.lastError = errMsg
+	return db.failures, nil
+}
+
+// exportStore returns n events for any day
+type exportStore struct {
+	stats.StoreInterface
+	n int
+}
+
+func (s exportStore) StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields stats.EventFields, fn func(stats.EventItem) error) error {
+	for i := 0; i < s.n; i++ {
+		if err := fn(stats.EventItem{Name: "pageview", Pathname: "/", Timestamp: from.Format(time.RFC3339)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newExportTest(t *testing.T, d ExportDestination, creds exportCredentials, events int) (exporter, *fakeExportDB) {
+	t.Helper()
+	box, err := secretbox.New(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := json.Marshal(creds)
+	if d.Credentials, err = box.Seal(plain); err != nil {
+		t.Fatal(err)
+	}
+	d.ID, d.Domain, d.OwnerEmail = "e1", "example.com", "owner@example.com"
+	// Only yesterday is missing
+	last := time.Now().UTC().AddDate(0, 0, -2).Format("2006-01-02")
+	d.LastExportedDate = &last
+	db := &fakeExportDB{dests: []ExportDestination{d}}
+	return exporter{db: db, store: exportStore{n: events}, box: box}, db
+}
+
+func TestExporter_WebhookBatchesSigned(t *testing.T) {
+	const secret = "0123456789abcdef"
+	var batches []exportBatch
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := r.Header.Get(exportSignatureHeader); got != signExportBody(secret, body) {
+			t.Errorf("signature = %q", got)
+		}
+		var b exportBatch
+		json.Unmarshal(body, &b)
+		batches = append(batches, b)
+	}))
+	defer srv.Close()
+
+	e, db := newExportTest(t, ExportDestination{Kind: "webhook", URL: srv.URL}, exportCredentials{Secret: secret}, exportBatchSize+1)
+	if n, err := e.run(context.Background(), time.Now()); err != nil || n != 1 {
+		t.Fatalf("run = %d, %v", n, err)
+	}
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	if len(db.exported) != 1 || db.exported[0] != yesterday {
+		t.Errorf("exported = %v, want %s", db.exported, yesterday)
+	}
+	if len(batches) != 2 || len(batches[0].Events) != exportBatchSize || len(batches[1].Events) != 1 {
+		t.Fatalf("got %d batches", len(batches))
+	}
+	if b := batches[1]; b.Batch != 2 || b.Batches != 2 || b.Date != yesterday || b.Domain != "example.com" {
+		t.Errorf("batch = %+v", b)
+	}
+
+	// Already exported days are skipped
+	if n, _ := e.run(context.Background(), time.Now()); n != 0 || len(batches) != 2 {
+		t.Errorf("second run exported %d days", n)
+	}
+}
+
+func TestExporter_S3Upload(t *testing.T) {
+	var path, auth string
+	var lines []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth = r.URL.Path, r.Header.Get("Authorization")
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("body not gzipped: %v", err)
+			return
+		}
+		data, _ := io.ReadAll(zr)
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	}))
+	defer srv.Close()
+
+	d := ExportDestination{Kind: "s3", Bucket: "exports", Region: "eu-west-1", Endpoint: srv.URL, Prefix: "raw/"}
+	e, db := newExportTest(t, d, exportCredentials{AccessKeyID: "AKID", SecretAccessKey: "s3cret"}, 3)
+	if _, err := e.run(context.Background(), time.Now()); err != nil || len(db.exported) != 1 {
+		t.Fatalf("run: %v, exported %v", err, db.exported)
+	}
+	if want := "/exports/raw/example.com/" + db.exported[0] + ".ndjson.gz"; path != want {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+		t.Errorf("authorization = %q", auth)
+	}
+	if strings.Contains(auth, "s3cret") {
+		t.Error("authorization leaks the secret key")
+	}
+	if len(lines) != 3 || !json.Valid([]byte(lines[0])) {
+		t.Errorf("ndjson = %q", lines)
+	}
+}
+
+func TestExporter_FailsDaysOverTheCap(t *testing.T) {
+	defer func(n int) { exportMaxEvents = n }(exportMaxEvents)
+	exportMaxEvents = 3
+
+	posts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { posts++ }))
+	defer srv.Close()
+
+	e, db := newExportTest(t, ExportDestination{Kind: "webhook", URL: srv.URL}, exportCredentials{Secret: "0123456789abcdef"}, exportMaxEvents+1)
+	if n, err := e.run(context.Background(), time.Now()); err != nil || n != 0 {
+		t.Fatalf("run = %d, %v", n, err)
+	}
+	if len(db.exported) != 0 || posts != 0 {
+		t.Errorf("exported %v in %d posts, want nothing sent", db.exported, posts)
+	}
+	if db.failures != 1 || !strings.Contains(db.lastError, "more than 3 events") {
+		t.Errorf("failures = %d, last error = %q", db.failures, db.lastError)
+	}
+
+	// A day at the cap still goes out whole
+	e.store = exportStore{n: exportMaxEvents}
+	if n, err := e.run(context.Background(), time.Now()); err != nil || n != 1 || posts != 1 {
+		t.Errorf("run = %d, %v after %d posts", n, err, posts)
+	}
+}
+
+func TestExporter_AlertsAfterConsecutiveFailures(t *testing.T) {
+	defer func(d time.Duration) { exportRetryDelay = d }(exportRetryDelay)
+	exportRetryDelay = 0
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	e, db := newExportTest(t, ExportDestination{Kind: "webhook", URL: srv.URL}, exportCredentials{Secret: "0123456789abcdef"}, 1)
+	mailer := &recordingMailer{}
+	e.mailer = mailer
+	for run := 1; run <= exportAlertAfter+1; run++ {
+		e.run(context.Background(), time.Now())
+		if db.failures != run {
+			t.Fatalf("run %d: failures = %d", run, db.failures)
+		}
+	}
+	if attempts != exportAttempts*(exportAlertAfter+1) {
+		t.Errorf("attempts = %d, want %d per run", attempts, exportAttempts)
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0] != "owner@example.com: Event export failing" {
+		t.Errorf("sent = %v, want one alert", mailer.sent)
+	}
+	if !strings.Contains(db.lastError, "503") {
+		t.Errorf("last error = %q", db.lastError)
+	}
+}
+
+func TestExportDestination_CredentialsNeverSerialized(t *testing.T) {
+	req := CreateExportRequest{Kind: "s3", Bucket: "b", AccessKeyID: "AKIDSECRET", SecretAccessKey: "topsecret"}
+	d, creds, err := req.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := json.Marshal(creds)
+	d.Credentials = plain
+	out, _ := json.Marshal([]ExportDestination{d})
+	if bytes.Contains(out, []byte("AKIDSECRET")) || bytes.Contains(out, []byte("topsecret")) {
+		t.Errorf("destination JSON leaks credentials: %s", out)
+	}
+	if d.Region != "us-east-1" {
+		t.Errorf("region = %q", d.Region)
+	}
+
+	for _, bad := range []CreateExportRequest{
+		{Kind: "ftp"},
+		{Kind: "s3", Bucket: "b"},
+		{Kind: "s3", Bucket: "b", AccessKeyID: "k", SecretAccessKey: "s", Endpoint: "http://minio.local"},
+		{Kind: "webhook", URL: "http://example.com/hook", Secret: "0123456789abcdef"},
+		{Kind: "webhook", URL: "https://example.com/hook", Secret: "short"},
+	} {
+		if _, _, err := bad.validate(); err == nil {
+			t.Errorf("%+v: expected an error", bad)
+		}
+	}
+}
+
+// fakeEmbedDB holds one project and its embed secret
+type fakeEmbedDB struct {
+	project Project
+	secret  string
+}
+
+func (db *fakeEmbedDB) GetProjectByID(id string) (*Project, error) {
+	if id != db.project.ID {
+		return nil, sql.ErrNoRows
+	}
+	p := db.project
+	return &p, nil
+}
+
+func (db *fakeEmbedDB) GetEmbedSecret(projectID string) (string, error) {
+	return db.secret, nil
+}
+
+func TestEmbedToken_Scope(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("test-secret")}
+	db := &fakeEmbedDB{project: Project{ID: "p1", Domain: "example.com"}, secret: "s1"}
+	endpoints := []string{"pageviews", "overview"}
+
+	token, err := h.generateEmbedToken(&db.project, db.secret, endpoints, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope, err := h.embedScope(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scope.Domain != "example.com" || strings.Join(scope.Endpoints, ",") != "pageviews,overview" {
+		t.Errorf("scope = %+v", scope)
+	}
+
+	// Embed tokens are never sessions
+	if _, err := h.validateToken(token); err == nil {
+		t.Error("embed token accepted as a session")
+	}
+	// Sessions are never embed tokens
+	session, _ := h.generateToken(&User{ID: "u1", Email: "a@example.com"})
+	if _, err := h.embedScope(db, session); err != stats.ErrInvalidEmbedToken {
+		t.Errorf("session as embed token: %v", err)
+	}
+
+	expired, _ := h.generateEmbedToken(&db.project, db.secret, endpoints, time.Now().Add(-time.Minute))
+	if _, err := h.embedScope(db, expired); err != stats.ErrInvalidEmbedToken {
+		t.Errorf("expired token: %v", err)
+	}
+
+	other := &Handler{jwtSecret: []byte("other-secret")}
+	forged, _ := other.generateEmbedToken(&db.project, db.secret, endpoints, time.Now().Add(time.Hour))
+	if _, err := h.embedScope(db, forged); err != stats.ErrInvalidEmbedToken {
+		t.Errorf("forged token: %v", err)
+	}
+
+	// Rotating the secret revokes issued tokens
+	db.secret = "s2"
+	if _, err := h.embedScope(db, token); err != stats.ErrInvalidEmbedToken {
+		t.Errorf("revoked token: %v", err)
+	}
+}
+
+func TestEmbedTokenRequest_Validate(t *testing.T) {
+	tests := []struct {
+		req     EmbedTokenRequest
+		wantTTL time.Duration
+		wantErr bool
+	}{
+		{EmbedTokenRequest{Endpoints: []string{"pageviews"}}, defaultEmbedTTL, false},
+		{EmbedTokenRequest{Endpoints: []string{"pageviews"}, ExpiresInSeconds: 3600}, time.Hour, false},
+		{EmbedTokenRequest{Endpoints: []string{"pageviews"}, ExpiresInSeconds: 7*24*3600 + 1}, 0, true},
+		{EmbedTokenRequest{Endpoints: []string{"pageviews"}, ExpiresInSeconds: -1}, 0, true},
+		{EmbedTokenRequest{Endpoints: []string{"debug"}}, 0, true},
+		{EmbedTokenRequest{}, 0, true},
+	}
+	for _, tt := range tests {
+		ttl, err := tt.req.validate()
+		if (err != nil) != tt.wantErr || ttl != tt.wantTTL {
+			t.Errorf("%+v: ttl = %v, err = %v", tt.req, ttl, err)
+		}
+	}
+}
+
+func TestHandleCreateEmbedToken_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("test-secret")}
+	w := httptest.NewRecorder()
+	h.HandleCreateEmbedToken(w, httptest.NewRequest("POST", "/api/projects/embed-token?domain=example.com", strings.NewReader(`{"endpoints":["pageviews"]}`)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestDomainSettingsHandlers_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("test-secret")}
+	w := httptest.NewRecorder()
+	h.HandleUpdateDomainSettings(w, httptest.NewRequest("PUT", "/api/projects/domain-settings?domain=example.com", strings.NewReader(`{"strict_domain":true}`)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("settings: Status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = httptest.NewRecorder()
+	h.HandleDomainMismatches(w, httptest.NewRequest("GET", "/api/projects/domain-mismatches?domain=example.com", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("mismatches: Status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = httptest.NewRecorder()
+	h.HandleDomainMismatches(w, httptest.NewRequest("POST", "/api/projects/domain-mismatches?domain=example.com", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("mismatches POST: Status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleProjectBadge_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("test-secret")}
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		w := httptest.NewRecorder()
+		h.HandleProjectBadge(w, httptest.NewRequest(method, "/api/projects/badge?domain=example.com", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: Status = %d, want %d", method, w.Code, http.StatusUnauthorized)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.HandleProjectBadge(w, httptest.NewRequest("PUT", "/api/projects/badge?domain=example.com", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: Status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+// fakeLoginDB keeps failed logins in memory
+type fakeLoginDB struct {
+	users    map[string]*User
+	attempts map[string]LoginAttempts
+	locks    map[string]string // email to unlock token hash
+}
+
+func newFakeLoginDB(t *testing.T) *fakeLoginDB {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeLoginDB{
+		users:    map[string]*User{"owner@example.com": {ID: "u1", Email: "owner@example.com", PasswordHash: hash}},
+		attempts: map[string]LoginAttempts{},
+		locks:    map[string]string{},
+	}
+}
+
+func (db *fakeLoginDB) GetUserByEmail(email string) (*User, error) {
+	if u, ok := db.users[email]; ok {
+		return u, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (db *fakeLoginDB) GetLoginAttempts(email string) (LoginAttempts, error) {
+	return db.attempts[email], nil
+}
+
+func (db *fakeLoginDB) RecordLoginFailure(email string, at time.Time) (LoginAttempts, error) {
+	a := db.attempts[email]
+	a.Failures++
+	a.LastFailureAt = at
+	db.attempts[email] = a
+	return a, nil
+}
+
+func (db *fakeLoginDB) LockLogin(email string, until time.Time, unlockTokenHash string) error {
+	a := db.attempts[email]
+	a.LockedUntil = &until
+	db.attempts[email] = a
+	db.locks[email] = unlockTokenHash
+	return nil
+}
+
+func (db *fakeLoginDB) ResetLoginAttempts(email string) error {
+	delete(db.attempts, email)
+	return nil
+}
+
+func TestLoginDelay(t *testing.T) {
+	for failures, want := range map[int]time.Duration{0: 0, 4: 0, 5: time.Second, 6: 2 * time.Second, 9: 16 * time.Second, 11: time.Minute, 100: time.Minute} {
+		if got := loginDelay(failures); got != want {
+			t.Errorf("loginDelay(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestLoginGuard_Thresholds(t *testing.T) {
+	db := newFakeLoginDB(t)
+	mailer := &recordingMailer{}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	g := loginGuard{db: db, mailer: mailer, frontendURL: "https://app.example.com", now: func() time.Time { return now }}
+
+	// Four failures in a row are not throttled
+	for i := 0; i < 4; i++ {
+		if _, err := g.authenticate("owner@example.com", "wrong", ""); err != errInvalidCredentials {
+			t.Fatalf("failure %d: err = %v", i+1, err)
+		}
+	}
+	// The fifth starts the delay
+	g.authenticate("owner@example.com", "wrong", "")
+	var throttled loginThrottledError
+	if _, err := g.authenticate("owner@example.com", "correct horse", ""); !errors.As(err, &throttled) || throttled.wait != time.Second {
+		t.Fatalf("after 5 failures: err = %v", err)
+	}
+
+	// Failures up to the tenth, each after its delay, lock the account
+	for i := 6; i <= loginLockAfter; i++ {
+		now = now.Add(loginDelay(i - 1))
+		if _, err := g.authenticate("owner@example.com", "wrong", ""); err != errInvalidCredentials {
+			t.Fatalf("failure %d: err = %v", i, err)
+		}
+	}
+	if db.locks["owner@example.com"] == "" || len(mailer.sent) != 1 || mailer.sent[0] != "owner@example.com: Sign-in to your account is locked" {
+		t.Fatalf("locks = %v, mail = %v", db.locks, mailer.sent)
+	}
+
+	// A locked account rejects the right password exactly like a wrong one
+	now = now.Add(maxLoginDelay)
+	if _, err := g.authenticate("owner@example.com", "correct horse", ""); err != errInvalidCredentials {
+		t.Errorf("locked: err = %v", err)
+	}
+	if a := db.attempts["owner@example.com"]; a.Failures != loginLockAfter {
+		t.Errorf("attempts while locked counted: %d", a.Failures)
+	}
+
+	// Once the lock expires, signing in resets the count and notifies the owner
+	now = now.Add(loginLockDuration)
+	user, err := g.authenticate("owner@example.com", "correct horse", "203.0.113.7 (curl)")
+	if err != nil || user.ID != "u1" {
+		t.Fatalf("after lock: user = %v, err = %v", user, err)
+	}
+	if _, ok := db.attempts["owner@example.com"]; ok || mailer.sent[len(mailer.sent)-1] != "owner@example.com: New sign-in to your account" {
+		t.Errorf("attempts = %v, mail = %v", db.attempts, mailer.sent)
+	}
+}
+
+func TestLoginGuard_UnknownEmail(t *testing.T) {
+	db := newFakeLoginDB(t)
+	mailer := &recordingMailer{}
+	now := time.Now()
+	g := loginGuard{db: db, mailer: mailer, now: func() time.Time { return now }}
+
+	for i := 1; i <= loginLockAfter; i++ {
+		now = now.Add(time.Minute)
+		if _, err := g.authenticate("nobody@example.com", "guess", ""); err != errInvalidCredentials {
+			t.Fatalf("failure %d: err = %v", i, err)
+		}
+	}
+	// Unknown emails are locked alike, but nobody is mailed
+	if db.locks["nobody@example.com"] == "" || len(mailer.sent) != 0 {
+		t.Errorf("locks = %v, mail = %v", db.locks, mailer.sent)
+	}
+}
+
+func TestWriteLoginError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeLoginError(w, loginThrottledError{wait: 1500 * time.Millisecond})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("throttled: status = %d, Retry-After = %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = httptest.NewRecorder()
+	writeLoginError(w, errInvalidCredentials)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Invalid credentials") {
+		t.Errorf("invalid: status = %d, body = %s", w.Code, w.Body)
+	}
+}
+
+// fakeKeyUsageDB records usage batches; fail makes writes fail as if Postgres were down
+type fakeKeyUsageDB struct {
+	mu      sync.Mutex
+	batches [][]APIKeyUsage
+	pruned  []time.Time
+	fail    bool
+}
+
+func (db *fakeKeyUsageDB) RecordAPIKeyUsage(usage []APIKeyUsage) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.fail {
+		return errors.New("connection refused")
+	}
+	db.batches = append(db.batches, usage)
+	return nil
+}
+
+func (db *fakeKeyUsageDB) PruneAPIKeyUsage(before time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.pruned = append(db.pruned, before)
+	return nil
+}
+
+func TestKeyUsageRecorder_Batching(t *testing.T) {
+	db := &fakeKeyUsageDB{}
+	now := time.Date(2026, 1, 1, 10, 59, 0, 0, time.UTC)
+	u := newKeyUsageRecorder(db, func() time.Time { return now })
+
+	u.record("p2", "bbbbbbbbkey")
+	u.record("p1", "aaaaaaaakey")
+	now = now.Add(30 * time.Second)
+	u.record("p1", "aaaaaaaakey")
+	now = now.Add(time.Minute) // the next hour
+	u.record("p1", "aaaaaaaakey")
+	if len(db.batches) != 0 {
+		t.Fatal("recording wrote to the database")
+	}
+
+	if err := u.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.batches) != 1 || len(db.batches[0]) != 3 {
+		t.Fatalf("batches = %v", db.batches)
+	}
+	first := db.batches[0][0]
+	if first.ProjectID != "p1" || first.KeyPrefix != "aaaaaaaa" || first.Requests != 2 ||
+		!first.Hour.Equal(time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)) || !first.LastUsedAt.Equal(time.Date(2026, 1, 1, 10, 59, 30, 0, time.UTC)) {
+		t.Errorf("first row = %+v", first)
+	}
+	if second := db.batches[0][1]; second.ProjectID != "p1" || second.Requests != 1 || second.Hour.Hour() != 11 {
+		t.Errorf("second row = %+v", second)
+	}
+	if err := u.flush(); err != nil || len(db.batches) != 1 {
+		t.Errorf("empty flush wrote %v, err = %v", db.batches, err)
+	}
+
+	// Counts survive failed writes and merge with later ones
+	db.fail = true
+	u.record("p1", "aaaaaaaakey")
+	if err := u.flush(); err == nil {
+		t.Fatal("flush succeeded with the database down")
+	}
+	u.record("p1", "aaaaaaaakey")
+	db.fail = false
+	if err := u.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if last := db.batches[len(db.batches)-1]; len(last) != 1 || last[0].Requests != 2 {
+		t.Errorf("after recovery wrote %+v", last)
+	}
+}
+
+func (db *fakeKeyUsageDB) waitBatches(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		db.mu.Lock()
+		got := len(db.batches)
+		db.mu.Unlock()
+		if got >= n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d batches", n)
+}
+
+func TestKeyUsageRecorder_Run(t *testing.T) {
+	db := &fakeKeyUsageDB{}
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	u := newKeyUsageRecorder(db, clock)
+	ticks := make(chan time.Time)
+	go u.run(ticks)
+
+	u.record("p1", "aaaaaaaakey")
+	ticks <- now
+	db.waitBatches(t, 1)
+	u.record("p1", "aaaaaaaakey")
+	mu.Lock()
+	now = now.Add(keyUsageFlushInterval)
+	mu.Unlock()
+	ticks <- now
+	db.waitBatches(t, 2)
+
+	// Stopping writes what the last tick has not
+	u.record("p1", "aaaaaaaakey")
+	u.close()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.batches) != 3 {
+		t.Fatalf("batches = %v, want one per tick and one on close", db.batches)
+	}
+	// Pruning runs on the first tick, then daily
+	if len(db.pruned) != 1 || !db.pruned[0].Equal(time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC).Add(-keyUsageRetention)) {
+		t.Errorf("pruned = %v", db.pruned)
+	}
+}
+
+type fakeIdempotencyRow struct {
+	IdempotencyRecord
+	createdAt, expiresAt time.Time
+}
+
+// fakeIdempotencyDB keeps idempotency keys in memory with the claim rules of *DB
+type fakeIdempotencyDB struct {
+	keys map[string]*fakeIdempotencyRow
+}
+
+func (db *fakeIdempotencyDB) ClaimIdempotencyKey(userID, key, requestHash string, now, staleBefore, expiresAt time.Time) (IdempotencyRecord, bool, error) {
+	if row, ok := db.keys[userID+"/"+key]; ok && row.expiresAt.After(now) && (row.Status != 0 || row.createdAt.After(staleBefore)) {
+		return row.IdempotencyRecord, false, nil
+	}
+	db.keys[userID+"/"+key] = &fakeIdempotencyRow{IdempotencyRecord{RequestHash: requestHash}, now, expiresAt}
+	return IdempotencyRecord{RequestHash: requestHash}, true, nil
+}
+
+func (db *fakeIdempotencyDB) SaveIdempotentResponse(userID, key string, status int, body []byte) error {
+	row := db.keys[userID+"/"+key]
+	row.Status, row.Body = status, body
+	return nil
+}
+
+func (db *fakeIdempotencyDB) ReleaseIdempotencyKey(userID, key string) error {
+	delete(db.keys, userID+"/"+key)
+	return nil
+}
+
+func TestIdempotency_ReplayConflictExpiry(t *testing.T) {
+	db := &fakeIdempotencyDB{keys: make(map[string]*fakeIdempotencyRow)}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	ik := idempotency{db: db, now: func() time.Time { return now }}
+	created := 0
+	create := func(w http.ResponseWriter, r *http.Request) {
+		created++
+		var req struct{ Domain string }
+		json.NewDecoder(r.Body).Decode(&req)
+		writeJSON(w, map[string]any{"id": created, "domain": req.Domain}, http.StatusCreated)
+	}
+	post := func(user, key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ik.serve(user, key, w, httptest.NewRequest(http.MethodPost, "/api/projects/create", strings.NewReader(body)), create)
+		return w
+	}
+
+	first := post("u1", "k1", `{"domain":"example.com"}`)
+	if first.Code != http.StatusCreated || first.Header().Get("Idempotent-Replay") != "" {
+		t.Fatalf("first: %d %v", first.Code, first.Header())
+	}
+
+	// A retry gets the original response without creating again
+	replay := post("u1", "k1", `{"domain":"example.com"}`)
+	if replay.Code != http.StatusCreated || replay.Header().Get("Idempotent-Replay") != "true" || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay: %d %v %s", replay.Code, replay.Header(), replay.Body)
+	}
+	if created != 1 {
+		t.Errorf("created %d times, want 1", created)
+	}
+
+	// The same key with another body is refused
+	if w := post("u1", "k1", `{"domain":"other.com"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("conflict: status = %d, want 422", w.Code)
+	}
+	// Keys belong to their user
+	if w := post("u2", "k1", `{"domain":"other.com"}`); w.Code != http.StatusCreated || created != 2 {
+		t.Errorf("other user: status = %d, created %d", w.Code, created)
+	}
+
+	// After 24 hours the key runs the request again
+	now = now.Add(idempotencyKeyTTL)
+	if w := post("u1", "k1", `{"domain":"example.com"}`); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replay") != "" || created != 3 {
+		t.Errorf("expired: status = %d, replay %q, created %d", w.Code, w.Header().Get("Idempotent-Replay"), created)
+	}
+}
+
+func TestIdempotency_InProgressAndServerErrors(t *testing.T) {
+	db := &fakeIdempotencyDB{keys: make(map[string]*fakeIdempotencyRow)}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	ik := idempotency{db: db, now: func() time.Time { return now }}
+	post := func(key string, next http.HandlerFunc) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ik.serve("u1", key, w, httptest.NewRequest(http.MethodPost, "/api/funnels/create", strings.NewReader(`{}`)), next)
+		return w
+	}
+
+	// A repeat while the first request runs is told to wait
+	var inner *httptest.ResponseRecorder
+	post("k1", func(w http.ResponseWriter, r *http.Request) {
+		inner = post("k1", func(http.ResponseWriter, *http.Request) { t.Error("ran twice") })
+		w.WriteHeader(http.StatusCreated)
+	})
+	if inner.Code != http.StatusConflict || inner.Header().Get("Retry-After") == "" {
+		t.Errorf("in progress: status = %d, headers %v", inner.Code, inner.Header())
+	}
+
+	// Server errors free the key for a retry
+	calls := 0
+	fail := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeJSON(w, map[string]string{"error": "Failed"}, http.StatusInternalServerError)
+	}
+	post("k2", fail)
+	if w := post("k2", fail); w.Header().Get("Idempotent-Replay") != "" || calls != 2 {
+		t.Errorf("after server error: replay %q, calls %d", w.Header().Get("Idempotent-Replay"), calls)
+	}
+
+	if w := post(strings.Repeat("k", maxIdempotencyKeyLen+1), fail); w.Code != http.StatusBadRequest {
+		t.Errorf("long key: status = %d, want 400", w.Code)
+	}
+}
+
+// fakeDigestDB keeps synced projects in memory
+type fakeDigestDB struct {
+	projects []DigestProject
+	aliases  map[string][]string
+}
+
+func (db *fakeDigestDB) DomainAliases(domain string) ([]string, error) {
+	return db.aliases[domain], nil
+}
+
+func (db *fakeDigestDB) GetDigestProjects(source string) ([]DigestProject, error) {
+	return db.projects, nil
+}
+
+func (db *fakeDigestDB) RecordDigestSent(projectID string, zero bool) error {
+	for i := range db.projects {
+		if db.projects[i].ID == projectID {
+			sent := time.Now().UTC().Format(time.RFC3339)
+			db.projects[i].DigestSentAt, db.projects[i].DigestZero = &sent, zero
+		}
+	}
+	return nil
+}
+
+// digestStore reports pageviews per domain, summed over the aliases of ctx;
+// other domains have no traffic
+type digestStore struct {
+	stats.StoreInterface
+	pageviews map[string]int64
+}
+
+func (s digestStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*stats.Overview, error) {
+	var pageviews int64
+	for _, d := range stats.AliasDomains(ctx, domain) {
+		pageviews += s.pageviews[d]
+	}
+	return &stats.Overview{Pageviews: pageviews, UniqueVisitors: pageviews / 2}, nil
+}
+
+func (s digestStore) GetTopSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]stats.TopItem, error) {
+	return []stats.TopItem{{Name: "google.com", Count: 1}}, nil
+}
+
+func TestDigester_MergesAliases(t *testing.T) {
+	db := &fakeDigestDB{aliases: map[string][]string{"site.sho.rt": {"www.site.sho.rt"}}}
+	d := digester{db: db, store: digestStore{pageviews: map[string]int64{"site.sho.rt": 4, "www.site.sho.rt": 6}}}
+
+	digest, err := d.digest(context.Background(), DigestProject{Domain: "site.sho.rt"}, time.Now().Add(-time.Hour), time.Now())
+	if err != nil || digest.Pageviews != 10 {
+		t.Errorf("digest = %+v, %v; want the alias's pageviews counted", digest, err)
+	}
+}
+
+func TestDigester_SignedBatchesSkipQuietDomains(t *testing.T) {
+	defer func(d time.Duration) { digestBatchDelay = d }(digestBatchDelay)
+	digestBatchDelay = 0
+	const secret = "service-secret"
+	var batches []digestBatch
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := r.Header.Get(digestSignatureHeader); got != signExportBody(secret, body) {
+			t.Errorf("signature = %q", got)
+		}
+		var b digestBatch
+		json.Unmarshal(body, &b)
+		batches = append(batches, b)
+	}))
+	defer srv.Close()
+
+	db := &fakeDigestDB{}
+	for i := 0; i < digestBatchSize+1; i++ {
+		db.projects = append(db.projects, DigestProject{ID: fmt.Sprintf("p%d", i), Domain: fmt.Sprintf("site%d.sho.rt", i)})
+	}
+	d := digester{db: db, store: digestStore{pageviews: map[string]int64{"site0.sho.rt": 40}}, url: srv.URL, secret: secret}
+
+	run, err := d.run(context.Background(), time.Now())
+	if err != nil || run.Sent != digestBatchSize+1 || run.Skipped != 0 {
+		t.Fatalf("first run = %+v, %v", run, err)
+	}
+	if len(batches) != 2 || batches[1].Batch != 2 || batches[1].Batches != 2 || len(batches[1].Digests) != 1 {
+		t.Fatalf("got %d batches: %+v", len(batches), batches)
+	}
+	if got := batches[0].Digests[0]; got != (Digest{Domain: "site0.sho.rt", Pageviews: 40, Visitors: 20, TopSource: "google.com"}) {
+		t.Errorf("digest = %+v", got)
+	}
+
+	// Domains without traffic were reported once; only the active one is sent again
+	batches = nil
+	run, err = d.run(context.Background(), time.Now())
+	if err != nil || run.Sent != 1 || run.Skipped != digestBatchSize {
+		t.Fatalf("second run = %+v, %v", run, err)
+	}
+	if len(batches) != 1 || len(batches[0].Digests) != 1 || batches[0].Digests[0].Domain != "site0.sho.rt" {
+		t.Errorf("second run batches = %+v", batches)
+	}
+}
+
+func TestDigester_FailedBatchRetriedNextRun(t *testing.T) {
+	defer func(d time.Duration) { exportRetryDelay = d }(exportRetryDelay)
+	exportRetryDelay = 0
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	db := &fakeDigestDB{projects: []DigestProject{{ID: "p1", Domain: "quiet.sho.rt"}}}
+	d := digester{db: db, store: digestStore{}, url: srv.URL, secret: "s"}
+	if run, _ := d.run(context.Background(), time.Now()); run.Failed != 1 || run.Error == "" || db.projects[0].DigestSentAt != nil {
+		t.Fatalf("failed run = %+v, project %+v", run, db.projects[0])
+	}
+	fail = false
+	if run, _ := d.run(context.Background(), time.Now()); run.Sent != 1 || !db.projects[0].DigestZero {
+		t.Errorf("retry = %+v, project %+v", run, db.projects[0])
+	}
+}
+
+func TestHandleAdminTriggerDigest(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	w := httptest.NewRecorder()
+	h.HandleAdminTriggerDigest(w, httptest.NewRequest(http.MethodPost, "/api/admin/sync-status/digest", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("no token: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	admin := &User{ID: "u1", Email: "admin@example.com", Role: "admin"}
+	token, err := h.generateToken(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/sync-status/digest", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	h.HandleAdminTriggerDigest(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unconfigured: status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// TestDemoWriteRoutes sends every write method of every route with a demo
+// session, which must be refused before the handler reaches the database
+func TestDemoWriteRoutes(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	token, _ := h.generateToken(&User{ID: "demo-1", Email: "demo@shortid.me", Role: "demo"})
+	// Sign-in flows, API key and public routes don't take sessions
+	exempt := map[string]bool{
+		"/api/auth/register": true, "/api/auth/login": true, "/api/auth/unlock": true, "/api/auth/logout": true,
+		"/api/auth/demo": true, "/api/auth/google": true, "/api/auth/google/callback": true, "/api/auth/google/verify": true,
+		"/api/annotations/ci": true, "/api/sync/domains": true,
+	}
+
+	for _, route := range h.Routes() {
+		if exempt[route.Path] || strings.HasPrefix(route.Path, "/api/public/") {
+			continue
+		}
+		for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+			t.Run(method+" "+route.Path, func(t *testing.T) {
+				defer func() {
+					if p := recover(); p != nil {
+						t.Errorf("handler reached the database: %v", p)
+					}
+				}()
+				req := httptest.NewRequest(method, route.Path+"?domain=shortid.me&id=1", strings.NewReader("{}"))
+				req.Header.Set("Authorization", "Bearer "+token)
+				w := httptest.NewRecorder()
+				route.Handler(w, req)
+				if w.Code != http.StatusForbidden && w.Code != http.StatusMethodNotAllowed {
+					t.Errorf("status = %d, want 403 or 405", w.Code)
+				}
+			})
+		}
+	}
+}
+
+func TestPolicyForRole(t *testing.T) {
+	demo := policyForRole("demo")
+	if demo.CanWrite || !demo.AllowsDomain(stats.DemoDomain) || demo.AllowsDomain("example.com") {
+		t.Errorf("demo policy = %+v", demo)
+	}
+	for _, role := range []string{"user", "admin"} {
+		if p := policyForRole(role); !p.CanWrite || !p.AllowsDomain("example.com") {
+			t.Errorf("%s policy = %+v", role, p)
+		}
+	}
+}
+
+func TestWithAccessPolicy(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	var got access.Policy
+	var attached bool
+	handler := h.WithAccessPolicy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, attached = access.FromContext(r.Context())
+	}))
+
+	token, _ := h.generateToken(&User{ID: "demo-1", Email: "demo@shortid.me", Role: "demo"})
+	req := httptest.NewRequest("GET", "/api/stats/overview", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !attached || got.CanWrite {
+		t.Errorf("demo session: policy = %+v, attached = %v", got, attached)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/stats/overview", nil))
+	if attached {
+		t.Error("anonymous request got a policy")
+	}
+}
+
+func TestRevenueSettingsHandler_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("test-secret")}
+	w := httptest.NewRecorder()
+	h.HandleProjectRevenueSettings(w, httptest.NewRequest("GET", "/api/projects/revenue-settings?domain=example.com", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET: Status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = httptest.NewRecorder()
+	h.HandleProjectRevenueSettings(w, httptest.NewRequest("POST", "/api/projects/revenue-settings?domain=example.com", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: Status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNewHandler_Options(t *testing.T) {
+	db := &DB{}
+	google := GoogleOAuthConfig{ClientID: "id", ClientSecret: "secret", RedirectURL: "https://stats.example.com/api/auth/google/callback"}
+	publicURLs, err := urlbuilder.New("https://stats.example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		db      *DB
+		opts    []Option
+		wantErr string
+	}{
+		{"no database", nil, []Option{WithJWTSecret("s")}, "database required"},
+		{"no JWT secret", db, nil, "JWT secret required"},
+		{"empty JWT secret", db, []Option{WithJWTSecret("")}, "JWT secret required"},
+		{"Google without secret", db, []Option{WithJWTSecret("s"), WithFrontendURL("https://example.com"),
+			WithGoogleOAuth(GoogleOAuthConfig{ClientID: "id", RedirectURL: google.RedirectURL})}, "client secret required"},
+		{"Google without frontend", db, []Option{WithJWTSecret("s"), WithGoogleOAuth(google)}, "requires a frontend URL"},
+		{"mailer without frontend", db, []Option{WithJWTSecret("s"), WithMailer(&recordingMailer{})}, "requires a frontend URL"},
+		{"plain HTTP frontend", db, []Option{WithJWTSecret("s"), WithFrontendURL("http://example.com")}, "must use https"},
+		{"plain HTTP redirect", db, []Option{WithJWTSecret("s"), WithFrontendURL("https://example.com"),
+			WithGoogleOAuth(GoogleOAuthConfig{ClientID: "id", ClientSecret: "secret", RedirectURL: "http://stats.example.com/cb"})}, "must use https"},
+		{"Google without redirect", db, []Option{WithJWTSecret("s"), WithFrontendURL("https://example.com"),
+			WithGoogleOAuth(GoogleOAuthConfig{ClientID: "id", ClientSecret: "secret"})}, "redirect URL required"},
+		{"Google redirect from public URL", db, []Option{WithJWTSecret("s"), WithFrontendURL("https://example.com"), WithURLBuilder(publicURLs),
+			WithGoogleOAuth(GoogleOAuthConfig{ClientID: "id", ClientSecret: "secret"})}, ""},
+		{"local frontend", db, []Option{WithJWTSecret("s"), WithFrontendURL("http://localhost:3000")}, ""},
+		{"minimal", db, []Option{WithJWTSecret("s")}, ""},
+		{"everything", db, []Option{WithJWTSecret("s"), WithWebhookSecret("w"), WithSyncSecret("y"),
+			WithGoogleOAuth(google), WithFrontendURL("https://example.com"), WithMailer(&recordingMailer{})}, ""},
+	}
+	for _, tt := range tests {
+		h, err := NewHandler(tt.db, tt.opts...)
+		if tt.wantErr == "" {
+			if err != nil || h == nil {
+				t.Errorf("%s: handler %v, err = %v", tt.name, h, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) || h != nil {
+			t.Errorf("%s: handler %v, err = %v; want %q", tt.name, h, err, tt.wantErr)
+		}
+	}
+
+	// Sync no longer reuses the webhook secret
+	h, _ := NewHandler(db, WithJWTSecret("s"), WithWebhookSecret("w"))
+	if h.webhookSecret != "w" || h.syncSecret != "" {
+		t.Errorf("webhook %q, sync %q", h.webhookSecret, h.syncSecret)
+	}
+}
+
+func TestNewHandlerWithSecrets(t *testing.T) {
+	if h := NewHandlerWithSecrets(nil, "s", "w", "", "", "", ""); h != nil {
+		t.Error("handler without a database")
+	}
+	h := NewHandlerWithSecrets(&DB{}, "s", "w", "id", "", "", "https://example.com")
+	if h == nil || string(h.jwtSecret) != "s" || h.syncSecret != "w" || h.googleClientID != "id" || h.frontendURL != "https://example.com" {
+		t.Errorf("handler = %+v", h)
+	}
+}
+
+// fakeRevealDB is a fakeLoginDB with projects
+type fakeRevealDB struct {
+	*fakeLoginDB
+	projects map[string]*Project
+}
+
+func (db fakeRevealDB) GetProjectByID(id string) (*Project, error) {
+	if p, ok := db.projects[id]; ok {
+		return p, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func TestKeyReveals(t *testing.T) {
+	logins := newFakeLoginDB(t)
+	db := fakeRevealDB{fakeLoginDB: logins, projects: map[string]*Project{"p1": {ID: "p1", Domain: "example.com", APIKey: "full-key"}}}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	k := keyReveals{db: db, logins: loginGuard{db: logins, now: func() time.Time { return now }}, now: func() time.Time { return now }}
+	claims := func(signedIn time.Duration) *Claims {
+		return &Claims{UserID: "u1", Email: "owner@example.com", Role: "admin", AuthTime: jwt.NewNumericDate(now.Add(-signedIn))}
+	}
+	reveal := func(c *Claims, id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		k.serve(w, httptest.NewRequest(http.MethodPost, "/api/admin/projects/reveal-key?id="+id, strings.NewReader(body)), c)
+		return w
+	}
+
+	if w := reveal(claims(time.Minute), "p1", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"api_key":"full-key"`) {
+		t.Errorf("fresh sign-in: %d %s", w.Code, w.Body)
+	}
+	if w := reveal(claims(11*time.Minute), "p1", ""); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "reauth_required") {
+		t.Errorf("stale sign-in: %d %s, want 401 reauth_required", w.Code, w.Body)
+	}
+	noAuthTime := claims(0)
+	noAuthTime.AuthTime = nil
+	if w := reveal(noAuthTime, "p1", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("token without auth_time: %d, want 401", w.Code)
+	}
+	if w := reveal(claims(time.Hour), "p1", `{"password":"wrong"}`); w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), "full-key") {
+		t.Errorf("wrong password: %d %s", w.Code, w.Body)
+	}
+	if w := reveal(claims(time.Hour), "p1", `{"password":"correct horse"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "full-key") {
+		t.Errorf("re-entered password: %d %s", w.Code, w.Body)
+	}
+	if w := reveal(claims(time.Minute), "nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown project: %d, want 404", w.Code)
+	}
+}
+
+func TestHandleAdminRevealKey_AdminOnly(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	token, _ := h.generateToken(&User{ID: "u1", Email: "user@example.com", Role: "user"})
+	claims, err := h.validateToken(token)
+	if err != nil || !recentlyAuthenticated(claims, time.Now()) {
+		t.Fatalf("new token claims = %+v, %v; want a fresh auth_time", claims, err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/projects/reveal-key?id=p1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.HandleAdminRevealKey(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("non-admin: status = %d, want 403", w.Code)
+	}
+}
+
+func TestCampaignRequest_Validate(t *testing.T) {
+	req := CampaignRequest{Name: " Spring sale ", Source: "newsletter", Medium: "email", Campaign: "spring_sale"}
+	req.normalize()
+	if errs := req.validate(); len(errs) != 0 || req.Name != "Spring sale" || req.LandingPath != "/" {
+		t.Errorf("valid request = %+v: %v", req, errs)
+	}
+
+	fields := func(req CampaignRequest) []string {
+		req.normalize()
+		var names []string
+		for _, e := range req.validate() {
+			names = append(names, e.Field)
+		}
+		return names
+	}
+	if got := fields(CampaignRequest{Campaign: " - "}); strings.Join(got, ",") != "name,utm_source,utm_medium,utm_campaign" {
+		t.Errorf("empty request fields = %v", got)
+	}
+	for _, path := range []string{"sale", "//evil.example.net/sale", "https://evil.example.net/", "/" + strings.Repeat("a", maxLandingPath)} {
+		if got := fields(CampaignRequest{Name: "a", Source: "a", Medium: "a", Campaign: "a", LandingPath: path}); len(got) != 1 || got[0] != "landing_path" {
+			t.Errorf("landing path %.30q fields = %v", path, got)
+		}
+	}
+}
+
+func TestCampaignURL(t *testing.T) {
+	c := &Campaign{Source: "newsletter", Medium: "email", Campaign: "spring sale", LandingPath: "/sale?ref=nav&utm_source=old#top"}
+	want := "https://example.com/sale?ref=nav&utm_campaign=spring+sale&utm_medium=email&utm_source=newsletter#top"
+	if got := campaignURL("example.com", c); got != want {
+		t.Errorf("campaignURL = %s, want %s", got, want)
+	}
+	c = &Campaign{Source: "google", Medium: "cpc", Campaign: "promo", Term: "shoes", LandingPath: "/"}
+	if got := campaignURL("example.com", c); got != "https://example.com/?utm_campaign=promo&utm_medium=cpc&utm_source=google&utm_term=shoes" {
+		t.Errorf("campaignURL = %s", got)
+	}
+}
+
+func TestHandleGetFunnelHealth_NoToken(t *testing.T) {
+	h := &Handler{jwtSecret: []byte("secret")}
+	w := httptest.NewRecorder()
+	h.HandleGetFunnelHealth(w, httptest.NewRequest(http.MethodGet, "/api/funnels/health?domain=example.com", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSuggestPaths(t *testing.T) {
+	pages := []string{"/", "/pricing", "/checkout/payment", "/checkout/pay", "/blog/launch", "/articles/launch", "/about"}
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"/checkout/payments", []string{"/checkout/payment", "/checkout/pay"}},
+		{"/prices", []string{"/pricing"}},
+		{"/posts/*", nil},
+		{"/blogs/*", []string{"/blog/*"}},
+		{"/careers", nil},
+	}
+	for _, tt := range tests {
+		if got := suggestPaths(tt.value, pages); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("suggestPaths(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
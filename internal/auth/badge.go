@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// BadgeSettings is whether a project publishes its badge, and where
+type BadgeSettings struct {
+	Enabled bool   `json:"enabled"`
+	Slug    string `json:"slug,omitempty"`
+	SVGURL  string `json:"svg_url,omitempty"`
+	JSONURL string `json:"json_url,omitempty"`
+}
+
+// newBadgeSettings are the settings of the badge published under slug, with
+// its URLs on baseURL
+func newBadgeSettings(baseURL, slug string) BadgeSettings {
+	if slug == "" {
+		return BadgeSettings{}
+	}
+	base := baseURL + "/api/public/badge/" + slug
+	return BadgeSettings{Enabled: true, Slug: slug, SVGURL: base + ".svg", JSONURL: base + ".json"}
+}
+
+// SetBadgeSlugs lets badge changes take effect without a restart
+func (h *Handler) SetBadgeSlugs(slugs *stats.BadgeSlugs) {
+	h.badgeSlugs = slugs
+}
+
+// ReloadBadgeSlugs loads the slugs of projects with a public badge into the slug map
+func (h *Handler) ReloadBadgeSlugs() error {
+	if h.badgeSlugs == nil {
+		return nil
+	}
+	slugs, err := h.db.GetBadgeSlugs()
+	if err != nil {
+		return err
+	}
+	h.badgeSlugs.Set(slugs)
+	return nil
+}
+
+// HandleProjectBadge shows (GET), enables or rotates (POST) and disables
+// (DELETE) a project's public badge. Rotating gives the badge a new slug, so
+// links to the old one stop working.
+func (h *Handler) HandleProjectBadge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method != http.MethodGet && !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		slug, err := h.db.GetProjectBadgeSlug(project.ID)
+		if err != nil {
+			writeServerError(w, "Failed to get badge", err)
+			return
+		}
+		writeJSON(w, newBadgeSettings(h.urls.Base(r), slug), http.StatusOK)
+		return
+	}
+
+	slug := ""
+	if r.Method == http.MethodPost {
+		if slug, err = newSnapshotSlug(); err != nil {
+			writeServerError(w, "Failed to update badge", err)
+			return
+		}
+	}
+	if err := h.db.SetBadgeSlug(project.ID, slug); err != nil {
+		writeServerError(w, "Failed to update badge", err)
+		return
+	}
+	if err := h.ReloadBadgeSlugs(); err != nil {
+		log.Printf("Failed to reload badge slugs: %v", err)
+	}
+
+	writeJSON(w, newBadgeSettings(h.urls.Base(r), slug), http.StatusOK)
+}
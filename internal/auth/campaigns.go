@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// maxCampaignValue caps the name and UTM values of a campaign, as the columns do
+const maxCampaignValue = 255
+
+// maxLandingPath caps a campaign's landing path, as the column does
+const maxLandingPath = 2000
+
+// CampaignRequest registers or changes a campaign. utm_campaign is its
+// canonical value; reports count observed values differing only in case and
+// separators toward it.
+type CampaignRequest struct {
+	Name        string `json:"name"`
+	Source      string `json:"utm_source"`
+	Medium      string `json:"utm_medium"`
+	Campaign    string `json:"utm_campaign"`
+	Content     string `json:"utm_content"`
+	Term        string `json:"utm_term"`
+	LandingPath string `json:"landing_path"`
+}
+
+// normalize trims the request's values and defaults the landing path to "/"
+func (req *CampaignRequest) normalize() {
+	for _, v := range []*string{&req.Name, &req.Source, &req.Medium, &req.Campaign, &req.Content, &req.Term, &req.LandingPath} {
+		*v = strings.TrimSpace(*v)
+	}
+	if req.LandingPath == "" {
+		req.LandingPath = "/"
+	}
+}
+
+// validate lists what is wrong with a normalized request
+func (req *CampaignRequest) validate() []reqbody.FieldError {
+	var errs []reqbody.FieldError
+	for _, f := range []struct {
+		field, value string
+		required     bool
+	}{
+		{"name", req.Name, true},
+		{"utm_source", req.Source, true},
+		{"utm_medium", req.Medium, true},
+		{"utm_campaign", req.Campaign, true},
+		{"utm_content", req.Content, false},
+		{"utm_term", req.Term, false},
+	} {
+		if f.required && f.value == "" {
+			errs = append(errs, reqbody.FieldError{Field: f.field, Message: "required"})
+		} else if len(f.value) > maxCampaignValue {
+			errs = append(errs, reqbody.FieldError{Field: f.field, Message: fmt.Sprintf("at most %d characters", maxCampaignValue)})
+		}
+	}
+	if req.Campaign != "" && stats.CampaignKey(req.Campaign) == "" {
+		errs = append(errs, reqbody.FieldError{Field: "utm_campaign", Message: "must contain more than separators"})
+	}
+	if err := checkLandingPath(req.LandingPath); err != nil {
+		errs = append(errs, reqbody.FieldError{Field: "landing_path", Message: err.Error()})
+	}
+	return errs
+}
+
+// checkLandingPath accepts a path on the project's site, with an optional
+// query and fragment; links to other hosts are refused
+func checkLandingPath(path string) error {
+	if len(path) > maxLandingPath {
+		return fmt.Errorf("at most %d characters", maxLandingPath)
+	}
+	u, err := url.Parse(path)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return errors.New(`must be a path on the project's site starting with "/"`)
+	}
+	return nil
+}
+
+// campaignURL is c's landing page on domain tagged with its UTM values, which
+// replace any the landing path sets
+func campaignURL(domain string, c *Campaign) string {
+	u, err := url.Parse(c.LandingPath)
+	if err != nil {
+		u = &url.URL{Path: "/"}
+	}
+	u.Scheme = "https"
+	u.Host = domain
+	q := u.Query()
+	for key, value := range map[string]string{
+		"utm_source": c.Source, "utm_medium": c.Medium, "utm_campaign": c.Campaign,
+		"utm_content": c.Content, "utm_term": c.Term,
+	} {
+		q.Del(key)
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// decodeCampaignRequest reads and validates a campaign, answering the request
+// if it is invalid
+func decodeCampaignRequest(w http.ResponseWriter, r *http.Request) (*CampaignRequest, bool) {
+	var req CampaignRequest
+	if err := reqbody.Decode(w, r, &req); err != nil {
+		reqbody.Write(w, err)
+		return nil, false
+	}
+	req.normalize()
+	if err := reqbody.Invalid(req.validate()...); err != nil {
+		reqbody.Write(w, err)
+		return nil, false
+	}
+	return &req, true
+}
+
+// writeCampaign answers with c and its tagged URL
+func writeCampaign(w http.ResponseWriter, domain string, c *Campaign, status int) {
+	c.URL = campaignURL(domain, c)
+	writeJSON(w, c, status)
+}
+
+// HandleGetCampaigns lists the campaigns of the project of ?domain= with their
+// tagged URLs
+func (h *Handler) HandleGetCampaigns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	campaigns, err := h.db.GetCampaigns(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get campaigns", err)
+		return
+	}
+	for i := range campaigns {
+		campaigns[i].URL = campaignURL(project.Domain, &campaigns[i])
+	}
+	writeUsageHeaders(w, len(campaigns), stats.MaxCampaigns)
+	writeJSON(w, campaigns, http.StatusOK)
+}
+
+// HandleCreateCampaign registers a campaign for the project of ?domain=.
+// Campaigns whose utm_campaign matches the same observed values as a
+// registered one are refused.
+func (h *Handler) HandleCreateCampaign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	req, ok := decodeCampaignRequest(w, r)
+	if !ok {
+		return
+	}
+
+	campaign, err := h.db.CreateCampaign(project.ID, *req, stats.MaxCampaigns)
+	if errors.Is(err, ErrDuplicateCampaign) {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeCreateError(w, "Failed to create campaign", err)
+		return
+	}
+	writeCampaign(w, project.Domain, campaign, http.StatusCreated)
+}
+
+// HandleUpdateCampaign replaces the campaign ?id= of the project of ?domain=
+func (h *Handler) HandleUpdateCampaign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	campaignID := r.URL.Query().Get("id")
+	if domain == "" || campaignID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and campaign ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	req, ok := decodeCampaignRequest(w, r)
+	if !ok {
+		return
+	}
+
+	campaign, err := h.db.UpdateCampaign(campaignID, project.ID, *req)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, map[string]string{"error": "Campaign not found"}, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrDuplicateCampaign) {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeServerError(w, "Failed to update campaign", err)
+		return
+	}
+	writeCampaign(w, project.Domain, campaign, http.StatusOK)
+}
+
+// HandleDeleteCampaign removes the campaign ?id= from the project of ?domain=
+func (h *Handler) HandleDeleteCampaign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	campaignID := r.URL.Query().Get("id")
+	if domain == "" || campaignID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and campaign ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	err = h.db.DeleteCampaign(campaignID, project.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, map[string]string{"error": "Campaign not found"}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeServerError(w, "Failed to delete campaign", err)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "deleted"}, http.StatusOK)
+}
+
+// HandleCampaignURL returns the tagged URL of the campaign ?id= of the project
+// of ?domain=, ready to copy into ads and emails
+func (h *Handler) HandleCampaignURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	campaignID := r.URL.Query().Get("id")
+	if domain == "" || campaignID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and campaign ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	campaign, err := h.db.GetCampaign(campaignID, project.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, map[string]string{"error": "Campaign not found"}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeServerError(w, "Failed to get campaign", err)
+		return
+	}
+	writeJSON(w, map[string]string{"url": campaignURL(project.Domain, campaign)}, http.StatusOK)
+}
@@ -2,9 +2,16 @@ package auth
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats"
 )
 
 type DB struct {
@@ -122,20 +129,65 @@ func (db *DB) GetUserByID(id string) (*User, error) {
 	return &user, nil
 }
 
-// CreateProject creates a new project
+// ErrDuplicateProject is returned by CreateProject when the domain already has a project
+var ErrDuplicateProject = errors.New("a project for this domain already exists")
+
+// isUniqueViolation reports whether err is Postgres refusing a duplicate key
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// ErrDomainIsAlias is returned by CreateProject when the domain is an alias of
+// a project
+var ErrDomainIsAlias = errors.New("this domain is an alias of another project")
+
+// lockHostname serializes, until tx ends, the transactions that give hostname
+// to a project as its domain or an alias, which check two tables
+func lockHostname(tx *sql.Tx, hostname string) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('clickresearch_hostname:' || $1))`, hostname)
+	return err
+}
+
+// CreateProject creates a new project; it fails with ErrDuplicateProject when
+// domain already has one and with ErrDomainIsAlias when it's an alias
 func (db *DB) CreateProject(userID, domain string, name *string) (*Project, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := lockHostname(tx, domain); err != nil {
+		return nil, err
+	}
+	var alias bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM clickresearch_project_domain_aliases WHERE hostname = $1)
+	`, domain).Scan(&alias); err != nil {
+		return nil, err
+	}
+	if alias {
+		return nil, ErrDomainIsAlias
+	}
+
 	apiKey := generateAPIKey()
 	var project Project
-	err := db.conn.QueryRow(`
+	err = tx.QueryRow(`
 		INSERT INTO clickresearch_projects (user_id, domain, api_key, name)
 		VALUES ($1, $2, $3, $4)
 		RETURNING id, user_id, domain, api_key, name, created_at
 	`, userID, domain, apiKey, name).Scan(
 		&project.ID, &project.UserID, &project.Domain, &project.APIKey, &project.Name, &project.CreatedAt,
 	)
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateProject
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return &project, nil
 }
 
@@ -177,10 +229,15 @@ func (db *DB) GetProjectByAPIKey(apiKey string) (*Project, error) {
 	return &project, nil
 }
 
-// DeleteProject deletes a project
-func (db *DB) DeleteProject(projectID, userID string) error {
-	_, err := db.conn.Exec(`DELETE FROM clickresearch_projects WHERE id = $1 AND user_id = $2`, projectID, userID)
-	return err
+// DeleteProject deletes a project of userID and returns its domain; it fails
+// with sql.ErrNoRows when the user has no such project
+func (db *DB) DeleteProject(projectID, userID string) (string, error) {
+	var domain string
+	err := db.conn.QueryRow(`
+		DELETE FROM clickresearch_projects WHERE id = $1 AND user_id = $2
+		RETURNING domain
+	`, projectID, userID).Scan(&domain)
+	return domain, err
 }
 
 // DomainExists checks if a domain exists in any project
@@ -190,9 +247,14 @@ func (db *DB) DomainExists(domain string) bool {
 	return err == nil && exists
 }
 
-// GetAllDomains returns all registered domains
+// GetAllDomains returns all registered domains, with the domain aliases of
+// projects, whose events are accepted as well
 func (db *DB) GetAllDomains() ([]string, error) {
-	rows, err := db.conn.Query(`SELECT domain FROM clickresearch_projects`)
+	rows, err := db.conn.Query(`
+		SELECT domain FROM clickresearch_projects
+		UNION
+		SELECT hostname FROM clickresearch_project_domain_aliases
+	`)
 	if err != nil {
 		return nil, err
 	}
@@ -231,25 +293,83 @@ func (db *DB) UpdateEnergyByEmail(email string, permanent, subscription, dailyBo
 
 // ProjectWithUser includes user info for admin view
 type ProjectWithUser struct {
-	ID        string  `json:"id"`
-	UserID    string  `json:"user_id"`
-	UserEmail string  `json:"user_email"`
-	Domain    string  `json:"domain"`
-	APIKey    string  `json:"api_key"`
-	Name      *string `json:"name,omitempty"`
-	CreatedAt string  `json:"created_at"`
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	UserEmail string `json:"user_email"`
+	Domain    string `json:"domain"`
+	// APIKey is masked in the admin list; see maskAPIKey
+	APIKey string `json:"api_key"`
+	// APIKeyLength is the length of the full key
+	APIKeyLength int     `json:"api_key_length"`
+	Name         *string `json:"name,omitempty"`
+	CreatedAt    string  `json:"created_at"`
 }
 
-// GetAllProjectsAdmin returns all projects with user info (admin only)
-func (db *DB) GetAllProjectsAdmin() ([]ProjectWithUser, error) {
-	rows, err := db.conn.Query(`
-		SELECT p.id, p.user_id, u.email, p.domain, p.api_key, p.name, p.created_at
+// AdminFilter narrows and pages the admin users and projects lists. For
+// projects the user fields match the owner.
+type AdminFilter struct {
+	Email        string // case-insensitive substring
+	Role         string
+	SyncedFrom   string
+	CreatedAfter *time.Time
+	Limit        int
+	Offset       int
+}
+
+// where returns the WHERE clause of f over clickresearch_users aliased u, with
+// created the column CreatedAfter compares, and its arguments
+func (f AdminFilter) where(created string) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Email != "" {
+		add(`u.email ILIKE $%d`, "%"+likeEscaper.Replace(f.Email)+"%")
+	}
+	if f.Role != "" {
+		add(`u.role = $%d`, f.Role)
+	}
+	if f.SyncedFrom != "" {
+		add(`u.synced_from = $%d`, f.SyncedFrom)
+	}
+	if f.CreatedAfter != nil {
+		add(created+` >= $%d`, *f.CreatedAfter)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// likeEscaper makes a string match literally in LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// page returns the LIMIT and OFFSET clause of f, numbering its arguments after n others
+func (f AdminFilter) page(n int) (string, []any) {
+	return fmt.Sprintf(" LIMIT $%d OFFSET $%d", n+1, n+2), []any{f.Limit, f.Offset}
+}
+
+// GetAllProjectsAdmin returns a page of projects with user info, newest first,
+// and how many match f in total (admin only)
+func (db *DB) GetAllProjectsAdmin(f AdminFilter) ([]ProjectWithUser, int, error) {
+	where, args := f.where("p.created_at")
+	const from = `
 		FROM clickresearch_projects p
-		JOIN clickresearch_users u ON p.user_id = u.id
-		ORDER BY p.created_at DESC
-	`)
+		JOIN clickresearch_users u ON p.user_id = u.id`
+
+	var total int
+	if err := db.conn.QueryRow(`SELECT COUNT(*)`+from+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	page, pageArgs := f.page(len(args))
+	rows, err := db.conn.Query(`
+		SELECT p.id, p.user_id, u.email, p.domain, p.api_key, p.name, p.created_at`+from+where+`
+		ORDER BY p.created_at DESC, p.id`+page, append(args, pageArgs...)...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
@@ -257,22 +377,30 @@ func (db *DB) GetAllProjectsAdmin() ([]ProjectWithUser, error) {
 	for rows.Next() {
 		var p ProjectWithUser
 		if err := rows.Scan(&p.ID, &p.UserID, &p.UserEmail, &p.Domain, &p.APIKey, &p.Name, &p.CreatedAt); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		projects = append(projects, p)
 	}
-	return projects, nil
+	return projects, total, rows.Err()
 }
 
-// GetAllUsersAdmin returns all users (admin only)
-func (db *DB) GetAllUsersAdmin() ([]User, error) {
+// GetAllUsersAdmin returns a page of users, newest first, and how many match f
+// in total (admin only)
+func (db *DB) GetAllUsersAdmin(f AdminFilter) ([]User, int, error) {
+	where, args := f.where("u.created_at")
+
+	var total int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM clickresearch_users u`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	page, pageArgs := f.page(len(args))
 	rows, err := db.conn.Query(`
-		SELECT id, email, password_hash, name, role, created_at, synced_from, permanent_energy, subscription_energy, daily_bonus_energy
-		FROM clickresearch_users
-		ORDER BY created_at DESC
-	`)
+		SELECT u.id, u.email, u.password_hash, u.name, u.role, u.created_at, u.synced_from, u.permanent_energy, u.subscription_energy, u.daily_bonus_energy
+		FROM clickresearch_users u`+where+`
+		ORDER BY u.created_at DESC, u.id`+page, append(args, pageArgs...)...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
@@ -281,11 +409,11 @@ func (db *DB) GetAllUsersAdmin() ([]User, error) {
 		var u User
 		if err := rows.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Name, &u.Role, &u.CreatedAt, &u.SyncedFrom,
 			&u.PermanentEnergy, &u.SubscriptionEnergy, &u.DailyBonusEnergy); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		users = append(users, u)
 	}
-	return users, nil
+	return users, total, rows.Err()
 }
 
 // Funnel represents a saved funnel configuration
@@ -299,10 +427,20 @@ type Funnel struct {
 	UpdatedAt string `json:"updated_at"`
 }
 
-// CreateFunnel creates a new funnel
-func (db *DB) CreateFunnel(projectID, name string, window int, steps string) (*Funnel, error) {
+// CreateFunnel creates a new funnel, or returns a *LimitError if the project
+// already has its limit, maxFunnels unless overridden
+func (db *DB) CreateFunnel(projectID, name string, window int, steps string, maxFunnels int) (*Funnel, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := checkQuota(tx, projectID, quotaFunnels, maxFunnels); err != nil {
+		return nil, err
+	}
+
 	var funnel Funnel
-	err := db.conn.QueryRow(`
+	err = tx.QueryRow(`
 		INSERT INTO clickresearch_funnels (project_id, name, funnel_window, steps)
 		VALUES ($1, $2, $3, $4)
 		RETURNING id, project_id, name, funnel_window, steps, created_at, updated_at
@@ -312,7 +450,7 @@ func (db *DB) CreateFunnel(projectID, name string, window int, steps string) (*F
 	if err != nil {
 		return nil, err
 	}
-	return &funnel, nil
+	return &funnel, tx.Commit()
 }
 
 // GetFunnelsByProjectID returns all funnels for a project
@@ -361,6 +499,21 @@ func (db *DB) DeleteFunnel(id, projectID string) error {
 	return err
 }
 
+// GetProjectByDomain finds the project of a domain, whoever owns it
+func (db *DB) GetProjectByDomain(domain string) (*Project, error) {
+	var project Project
+	err := db.conn.QueryRow(`
+		SELECT id, user_id, domain, api_key, name, created_at
+		FROM clickresearch_projects WHERE domain = $1
+	`, domain).Scan(
+		&project.ID, &project.UserID, &project.Domain, &project.APIKey, &project.Name, &project.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
 // GetProjectByDomainAndUserID finds a project by domain for a user
 func (db *DB) GetProjectByDomainAndUserID(domain, userID string) (*Project, error) {
 	var project Project
@@ -375,3 +528,1823 @@ func (db *DB) GetProjectByDomainAndUserID(domain, userID string) (*Project, erro
 	}
 	return &project, nil
 }
+
+// Segment represents a saved, named filter set
+type Segment struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	Name      string `json:"name"`
+	Filters   string `json:"filters"` // JSON string
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// CreateSegment creates a new segment
+func (db *DB) CreateSegment(projectID, name, filters string, maxSegments int) (*Segment, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := checkQuota(tx, projectID, quotaSegments, maxSegments); err != nil {
+		return nil, err
+	}
+
+	var segment Segment
+	err = tx.QueryRow(`
+		INSERT INTO clickresearch_segments (project_id, name, filters)
+		VALUES ($1, $2, $3)
+		RETURNING id, project_id, name, filters, created_at, updated_at
+	`, projectID, name, filters).Scan(
+		&segment.ID, &segment.ProjectID, &segment.Name, &segment.Filters, &segment.CreatedAt, &segment.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &segment, tx.Commit()
+}
+
+// GetSegmentsByProjectID returns all segments for a project
+func (db *DB) GetSegmentsByProjectID(projectID string) ([]Segment, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, project_id, name, filters, created_at, updated_at
+		FROM clickresearch_segments WHERE project_id = $1
+		ORDER BY created_at DESC
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []Segment
+	for rows.Next() {
+		var s Segment
+		if err := rows.Scan(&s.ID, &s.ProjectID, &s.Name, &s.Filters, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// UpdateSegment updates a segment
+func (db *DB) UpdateSegment(id, projectID, name, filters string) (*Segment, error) {
+	var segment Segment
+	err := db.conn.QueryRow(`
+		UPDATE clickresearch_segments
+		SET name = $3, filters = $4, updated_at = NOW()
+		WHERE id = $1 AND project_id = $2
+		RETURNING id, project_id, name, filters, created_at, updated_at
+	`, id, projectID, name, filters).Scan(
+		&segment.ID, &segment.ProjectID, &segment.Name, &segment.Filters, &segment.CreatedAt, &segment.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &segment, nil
+}
+
+// DeleteSegment deletes a segment
+func (db *DB) DeleteSegment(id, projectID string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_segments WHERE id = $1 AND project_id = $2`, id, projectID)
+	return err
+}
+
+// SegmentFilters loads a segment's filters, verifying it belongs to the project for domain
+func (db *DB) SegmentFilters(id, domain string) (stats.Filters, error) {
+	var raw string
+	err := db.conn.QueryRow(`
+		SELECT s.filters
+		FROM clickresearch_segments s
+		JOIN clickresearch_projects p ON s.project_id = p.id
+		WHERE s.id::text = $1 AND p.domain = $2
+	`, id, domain).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return stats.Filters{}, stats.ErrSegmentNotFound
+	}
+	if err != nil {
+		return stats.Filters{}, err
+	}
+
+	var filters stats.Filters
+	if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+		return stats.Filters{}, err
+	}
+	return filters, nil
+}
+
+// Annotation represents a dated marker on a project's charts
+type Annotation struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	Date      string `json:"date"`
+	Label     string `json:"label"`
+	Color     string `json:"color"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+}
+
+// CreateAnnotation adds an annotation, or returns a *LimitError if the
+// project already has maxAnnotations
+func (db *DB) CreateAnnotation(projectID, date, label, color, createdBy string, maxAnnotations int) (*Annotation, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := checkQuota(tx, projectID, quotaAnnotations, maxAnnotations); err != nil {
+		return nil, err
+	}
+
+	var a Annotation
+	err = tx.QueryRow(`
+		INSERT INTO clickresearch_annotations (project_id, annotation_date, label, color, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, project_id, to_char(annotation_date, 'YYYY-MM-DD'), label, color, created_by, created_at
+	`, projectID, date, label, color, createdBy).Scan(
+		&a.ID, &a.ProjectID, &a.Date, &a.Label, &a.Color, &a.CreatedBy, &a.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &a, tx.Commit()
+}
+
+// GetAnnotationsByProjectID returns all annotations for a project
+func (db *DB) GetAnnotationsByProjectID(projectID string) ([]Annotation, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, project_id, to_char(annotation_date, 'YYYY-MM-DD'), label, color, created_by, created_at
+		FROM clickresearch_annotations WHERE project_id = $1
+		ORDER BY annotation_date DESC
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var annotations []Annotation
+	for rows.Next() {
+		var a Annotation
+		if err := rows.Scan(&a.ID, &a.ProjectID, &a.Date, &a.Label, &a.Color, &a.CreatedBy, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, nil
+}
+
+// UpdateAnnotation updates an annotation
+func (db *DB) UpdateAnnotation(id, projectID, date, label, color string) (*Annotation, error) {
+	var a Annotation
+	err := db.conn.QueryRow(`
+		UPDATE clickresearch_annotations
+		SET annotation_date = $3, label = $4, color = $5
+		WHERE id = $1 AND project_id = $2
+		RETURNING id, project_id, to_char(annotation_date, 'YYYY-MM-DD'), label, color, created_by, created_at
+	`, id, projectID, date, label, color).Scan(
+		&a.ID, &a.ProjectID, &a.Date, &a.Label, &a.Color, &a.CreatedBy, &a.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// DeleteAnnotation deletes an annotation
+func (db *DB) DeleteAnnotation(id, projectID string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_annotations WHERE id = $1 AND project_id = $2`, id, projectID)
+	return err
+}
+
+// AnnotationsInRange returns the annotations of the project for domain between from and to
+func (db *DB) AnnotationsInRange(domain string, from, to time.Time) ([]stats.Annotation, error) {
+	rows, err := db.conn.Query(`
+		SELECT to_char(a.annotation_date, 'YYYY-MM-DD'), a.label, a.color
+		FROM clickresearch_annotations a
+		JOIN clickresearch_projects p ON a.project_id = p.id
+		WHERE p.domain = $1 AND a.annotation_date >= $2::date AND a.annotation_date <= $3::date
+		ORDER BY a.annotation_date
+	`, domain, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var annotations []stats.Annotation
+	for rows.Next() {
+		var a stats.Annotation
+		if err := rows.Scan(&a.Date, &a.Label, &a.Color); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
+
+// Goal represents a conversion target: a pageview path or a custom event name
+type Goal struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	CreatedAt string `json:"created_at"`
+}
+
+// CreateGoal creates a new goal
+func (db *DB) CreateGoal(projectID, name, goalType, value string, maxGoals int) (*Goal, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := checkQuota(tx, projectID, quotaGoals, maxGoals); err != nil {
+		return nil, err
+	}
+
+	var goal Goal
+	err = tx.QueryRow(`
+		INSERT INTO clickresearch_goals (project_id, name, goal_type, goal_value)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, project_id, name, goal_type, goal_value, created_at
+	`, projectID, name, goalType, value).Scan(
+		&goal.ID, &goal.ProjectID, &goal.Name, &goal.Type, &goal.Value, &goal.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &goal, tx.Commit()
+}
+
+// GetGoalsByProjectID returns all goals for a project
+func (db *DB) GetGoalsByProjectID(projectID string) ([]Goal, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, project_id, name, goal_type, goal_value, created_at
+		FROM clickresearch_goals WHERE project_id = $1
+		ORDER BY created_at DESC
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var goals []Goal
+	for rows.Next() {
+		var g Goal
+		if err := rows.Scan(&g.ID, &g.ProjectID, &g.Name, &g.Type, &g.Value, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		goals = append(goals, g)
+	}
+	return goals, nil
+}
+
+// DeleteGoal deletes a goal
+func (db *DB) DeleteGoal(id, projectID string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_goals WHERE id = $1 AND project_id = $2`, id, projectID)
+	return err
+}
+
+// GoalDef loads a goal definition, verifying it belongs to the project for domain
+func (db *DB) GoalDef(id, domain string) (funnel.Step, error) {
+	var def funnel.Step
+	err := db.conn.QueryRow(`
+		SELECT g.goal_type, g.goal_value
+		FROM clickresearch_goals g
+		JOIN clickresearch_projects p ON g.project_id = p.id
+		WHERE g.id::text = $1 AND p.domain = $2
+	`, id, domain).Scan(&def.Type, &def.Value)
+	if err == sql.ErrNoRows {
+		return def, stats.ErrGoalNotFound
+	}
+	return def, err
+}
+
+// SpamReferrer is an admin-managed referrer blocklist entry
+type SpamReferrer struct {
+	Domain    string `json:"domain"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+}
+
+// GetSpamReferrers returns all admin-managed spam referrer domains
+func (db *DB) GetSpamReferrers() ([]SpamReferrer, error) {
+	rows, err := db.conn.Query(`
+		SELECT domain, created_by, created_at
+		FROM clickresearch_spam_referrers
+		ORDER BY domain
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var referrers []SpamReferrer
+	for rows.Next() {
+		var s SpamReferrer
+		if err := rows.Scan(&s.Domain, &s.CreatedBy, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		referrers = append(referrers, s)
+	}
+	return referrers, nil
+}
+
+// AddSpamReferrer adds a domain to the blocklist; adding an existing domain is a no-op
+func (db *DB) AddSpamReferrer(domain, createdBy string) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO clickresearch_spam_referrers (domain, created_by)
+		VALUES ($1, $2)
+		ON CONFLICT (domain) DO NOTHING
+	`, domain, createdBy)
+	return err
+}
+
+// DeleteSpamReferrer removes a domain from the blocklist
+func (db *DB) DeleteSpamReferrer(domain string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_spam_referrers WHERE domain = $1`, domain)
+	return err
+}
+
+// ValueOverride is an admin-registered correction of stored values
+type ValueOverride struct {
+	ID string `json:"id"`
+	stats.ValueOverride
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+}
+
+// GetValueOverrides returns all value overrides, oldest first
+func (db *DB) GetValueOverrides() ([]ValueOverride, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, domain, column_name, match_value, replacement,
+			to_char(start_date, 'YYYY-MM-DD'), to_char(end_date, 'YYYY-MM-DD'), created_by, created_at
+		FROM clickresearch_value_overrides
+		ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []ValueOverride
+	for rows.Next() {
+		var o ValueOverride
+		if err := rows.Scan(&o.ID, &o.Domain, &o.Column, &o.Match, &o.Replacement, &o.StartDate, &o.EndDate, &o.CreatedBy, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// ValueOverrideRules returns the rules of all value overrides, oldest first
+func (db *DB) ValueOverrideRules() ([]stats.ValueOverride, error) {
+	overrides, err := db.GetValueOverrides()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]stats.ValueOverride, len(overrides))
+	for i, o := range overrides {
+		rules[i] = o.ValueOverride
+	}
+	return rules, nil
+}
+
+// AddValueOverride stores a value override and returns its ID
+func (db *DB) AddValueOverride(o stats.ValueOverride, createdBy string) (string, error) {
+	var id string
+	err := db.conn.QueryRow(`
+		INSERT INTO clickresearch_value_overrides (domain, column_name, match_value, replacement, start_date, end_date, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, o.Domain, o.Column, o.Match, o.Replacement, o.StartDate, o.EndDate, createdBy).Scan(&id)
+	return id, err
+}
+
+// DeleteValueOverride removes a value override
+func (db *DB) DeleteValueOverride(id string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_value_overrides WHERE id = $1`, id)
+	return err
+}
+
+// VisitorTombstone records a visitor whose events were erased from a domain
+type VisitorTombstone struct {
+	Domain       string `json:"domain"`
+	VisitorID    string `json:"visitor_id"`
+	EventsErased int64  `json:"events_erased"`
+	CreatedBy    string `json:"created_by"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// AddVisitorTombstone records an erasure; erasing a visitor again keeps the first record
+func (db *DB) AddVisitorTombstone(domain, visitorID, createdBy string) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO clickresearch_visitor_tombstones (domain, visitor_id, created_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (domain, visitor_id) DO NOTHING
+	`, domain, visitorID, createdBy)
+	return err
+}
+
+// AddTombstoneEvents adds n to the events erased of a tombstone
+func (db *DB) AddTombstoneEvents(domain, visitorID string, n int64) error {
+	_, err := db.conn.Exec(`
+		UPDATE clickresearch_visitor_tombstones SET events_erased = events_erased + $3
+		WHERE domain = $1 AND visitor_id = $2
+	`, domain, visitorID, n)
+	return err
+}
+
+// GetVisitorTombstones returns all tombstones, newest first
+func (db *DB) GetVisitorTombstones() ([]VisitorTombstone, error) {
+	rows, err := db.conn.Query(`
+		SELECT domain, visitor_id, events_erased, created_by, created_at
+		FROM clickresearch_visitor_tombstones
+		ORDER BY created_at DESC, domain, visitor_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tombstones []VisitorTombstone
+	for rows.Next() {
+		var t VisitorTombstone
+		if err := rows.Scan(&t.Domain, &t.VisitorID, &t.EventsErased, &t.CreatedBy, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, t)
+	}
+	return tombstones, rows.Err()
+}
+
+// TombstonedVisitors returns the tombstoned visitor ids of each domain
+func (db *DB) TombstonedVisitors() (map[string][]string, error) {
+	rows, err := db.conn.Query(`SELECT domain, visitor_id FROM clickresearch_visitor_tombstones ORDER BY domain, visitor_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	visitors := make(map[string][]string)
+	for rows.Next() {
+		var domain, visitorID string
+		if err := rows.Scan(&domain, &visitorID); err != nil {
+			return nil, err
+		}
+		visitors[domain] = append(visitors[domain], visitorID)
+	}
+	return visitors, rows.Err()
+}
+
+// DenyDomain records that events of domain are refused
+func (db *DB) DenyDomain(domain string) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO clickresearch_denied_domains (domain) VALUES ($1)
+		ON CONFLICT (domain) DO UPDATE SET denied_at = NOW()
+	`, domain)
+	return err
+}
+
+// AllowDomain removes domain from the denied domains
+func (db *DB) AllowDomain(domain string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_denied_domains WHERE domain = $1`, domain)
+	return err
+}
+
+// DeniedDomains returns every denied domain
+func (db *DB) DeniedDomains() ([]string, error) {
+	rows, err := db.conn.Query(`SELECT domain FROM clickresearch_denied_domains ORDER BY domain`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// FunnelSnapshot is a frozen funnel result shared by public link
+type FunnelSnapshot struct {
+	ID         string  `json:"id"`
+	ProjectID  string  `json:"project_id"`
+	Slug       string  `json:"slug"`
+	Name       string  `json:"name"`
+	Anonymized bool    `json:"anonymized"`
+	ExpiresAt  *string `json:"expires_at,omitempty"`
+	CreatedBy  string  `json:"created_by"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+// CreateFunnelSnapshot stores a serialized snapshot payload under slug
+func (db *DB) CreateFunnelSnapshot(projectID, slug, name, payload string, anonymized bool, expiresAt *time.Time, createdBy string) (*FunnelSnapshot, error) {
+	var s FunnelSnapshot
+	err := db.conn.QueryRow(`
+		INSERT INTO clickresearch_funnel_snapshots (project_id, slug, name, payload, anonymized, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, project_id, slug, name, anonymized, expires_at, created_by, created_at
+	`, projectID, slug, name, payload, anonymized, expiresAt, createdBy).Scan(
+		&s.ID, &s.ProjectID, &s.Slug, &s.Name, &s.Anonymized, &s.ExpiresAt, &s.CreatedBy, &s.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CountActiveFunnelSnapshots returns the number of unexpired snapshots for a project
+func (db *DB) CountActiveFunnelSnapshots(projectID string) (int, error) {
+	var count int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM clickresearch_funnel_snapshots
+		WHERE project_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	`, projectID).Scan(&count)
+	return count, err
+}
+
+// GetFunnelSnapshotsByProjectID returns all snapshots for a project, newest first
+func (db *DB) GetFunnelSnapshotsByProjectID(projectID string) ([]FunnelSnapshot, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, project_id, slug, name, anonymized, expires_at, created_by, created_at
+		FROM clickresearch_funnel_snapshots WHERE project_id = $1
+		ORDER BY created_at DESC
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []FunnelSnapshot
+	for rows.Next() {
+		var s FunnelSnapshot
+		if err := rows.Scan(&s.ID, &s.ProjectID, &s.Slug, &s.Name, &s.Anonymized, &s.ExpiresAt, &s.CreatedBy, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
+}
+
+// DeleteFunnelSnapshot deletes a snapshot
+func (db *DB) DeleteFunnelSnapshot(id, projectID string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_funnel_snapshots WHERE id = $1 AND project_id = $2`, id, projectID)
+	return err
+}
+
+// GetFunnelSnapshotPayload returns the payload of an unexpired snapshot, or sql.ErrNoRows
+func (db *DB) GetFunnelSnapshotPayload(slug string) (string, error) {
+	var payload string
+	err := db.conn.QueryRow(`
+		SELECT payload FROM clickresearch_funnel_snapshots
+		WHERE slug = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	`, slug).Scan(&payload)
+	return payload, err
+}
+
+// GetSnapshotsAnonymized reports whether a project hides pathnames from snapshots
+func (db *DB) GetSnapshotsAnonymized(projectID string) (bool, error) {
+	var anonymized bool
+	err := db.conn.QueryRow(`SELECT anonymize_snapshots FROM clickresearch_projects WHERE id = $1`, projectID).Scan(&anonymized)
+	return anonymized, err
+}
+
+// SetSnapshotsAnonymized sets whether a project hides pathnames from snapshots
+func (db *DB) SetSnapshotsAnonymized(projectID string, anonymized bool) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET anonymize_snapshots = $2 WHERE id = $1`, projectID, anonymized)
+	return err
+}
+
+// PrivacyMode returns the privacy mode of the project a domain belongs to. If
+// several projects track the domain the strictest mode wins; unknown domains are off.
+func (db *DB) PrivacyMode(domain string) (stats.PrivacyMode, error) {
+	var mode string
+	err := db.conn.QueryRow(`
+		SELECT privacy_mode FROM clickresearch_projects
+		WHERE domain = $1
+		ORDER BY CASE privacy_mode WHEN 'only_granted' THEN 0 WHEN 'exclude_denied' THEN 1 ELSE 2 END
+		LIMIT 1
+	`, domain).Scan(&mode)
+	if err == sql.ErrNoRows {
+		return stats.PrivacyOff, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return stats.PrivacyMode(mode), nil
+}
+
+// SetPrivacyMode sets a project's privacy mode
+func (db *DB) SetPrivacyMode(projectID string, mode stats.PrivacyMode) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET privacy_mode = $2 WHERE id = $1`, projectID, string(mode))
+	return err
+}
+
+// DomainMatch returns the domain policy of the project a domain belongs to. If
+// several projects track the domain the strictest policy wins; unknown domains
+// get the default.
+func (db *DB) DomainMatch(domain string) (stats.DomainMatch, error) {
+	var m stats.DomainMatch
+	err := db.conn.QueryRow(`
+		SELECT bool_or(strict_domain), bool_and(match_subdomains) FROM clickresearch_projects
+		WHERE domain = $1
+		HAVING COUNT(*) > 0
+	`, domain).Scan(&m.StrictDomain, &m.MatchSubdomains)
+	if err == sql.ErrNoRows {
+		return stats.DefaultDomainMatch, nil
+	}
+	return m, err
+}
+
+// GetProjectDomainMatch returns a project's own domain policy
+func (db *DB) GetProjectDomainMatch(projectID string) (stats.DomainMatch, error) {
+	var m stats.DomainMatch
+	err := db.conn.QueryRow(`SELECT strict_domain, match_subdomains FROM clickresearch_projects WHERE id = $1`, projectID).Scan(&m.StrictDomain, &m.MatchSubdomains)
+	return m, err
+}
+
+// SetDomainMatch sets a project's domain policy
+func (db *DB) SetDomainMatch(projectID string, m stats.DomainMatch) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET strict_domain = $2, match_subdomains = $3 WHERE id = $1`, projectID, m.StrictDomain, m.MatchSubdomains)
+	return err
+}
+
+// RevenueSettings returns the revenue settings of the project a domain belongs
+// to. If several projects track the domain the oldest one's apply; unknown
+// domains get the default.
+func (db *DB) RevenueSettings(domain string) (stats.RevenueSettings, error) {
+	var s stats.RevenueSettings
+	err := db.conn.QueryRow(`
+		SELECT revenue_event, currency FROM clickresearch_projects
+		WHERE domain = $1
+		ORDER BY created_at
+		LIMIT 1
+	`, domain).Scan(&s.Event, &s.Currency)
+	if err == sql.ErrNoRows {
+		return stats.DefaultRevenueSettings, nil
+	}
+	return s, err
+}
+
+// GetProjectRevenueSettings returns a project's own revenue settings
+func (db *DB) GetProjectRevenueSettings(projectID string) (stats.RevenueSettings, error) {
+	var s stats.RevenueSettings
+	err := db.conn.QueryRow(`SELECT revenue_event, currency FROM clickresearch_projects WHERE id = $1`, projectID).Scan(&s.Event, &s.Currency)
+	return s, err
+}
+
+// SetRevenueSettings sets a project's revenue settings
+func (db *DB) SetRevenueSettings(projectID string, s stats.RevenueSettings) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET revenue_event = $2, currency = $3 WHERE id = $1`, projectID, s.Event, s.Currency)
+	return err
+}
+
+// ReportBranding returns the report branding of the project a domain belongs
+// to. If several projects track the domain the oldest one's applies; unknown
+// domains get none.
+func (db *DB) ReportBranding(domain string) (stats.ReportBranding, error) {
+	var b stats.ReportBranding
+	err := db.conn.QueryRow(`
+		SELECT report_logo_url, report_accent_color FROM clickresearch_projects
+		WHERE domain = $1
+		ORDER BY created_at
+		LIMIT 1
+	`, domain).Scan(&b.LogoURL, &b.AccentColor)
+	if err == sql.ErrNoRows {
+		return stats.ReportBranding{}, nil
+	}
+	return b, err
+}
+
+// GetProjectReportBranding returns a project's own report branding
+func (db *DB) GetProjectReportBranding(projectID string) (stats.ReportBranding, error) {
+	var b stats.ReportBranding
+	err := db.conn.QueryRow(`SELECT report_logo_url, report_accent_color FROM clickresearch_projects WHERE id = $1`, projectID).Scan(&b.LogoURL, &b.AccentColor)
+	return b, err
+}
+
+// SetReportBranding sets a project's report branding
+func (db *DB) SetReportBranding(projectID string, b stats.ReportBranding) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET report_logo_url = $2, report_accent_color = $3 WHERE id = $1`, projectID, b.LogoURL, b.AccentColor)
+	return err
+}
+
+// errAliasOwnedElsewhere is returned for aliases another user's project has
+// as its domain or an alias
+var errAliasOwnedElsewhere = errors.New("hostname belongs to a project of another user")
+
+// errAliasTaken is returned for aliases another project of the same user has
+// as its domain or an alias
+var errAliasTaken = errors.New("hostname belongs to another project")
+
+// DomainAliases returns the aliases of the projects tracking a domain
+func (db *DB) DomainAliases(domain string) ([]string, error) {
+	rows, err := db.conn.Query(`
+		SELECT DISTINCT a.hostname
+		FROM clickresearch_project_domain_aliases a
+		JOIN clickresearch_projects p ON p.id = a.project_id
+		WHERE p.domain = $1
+		ORDER BY a.hostname
+	`, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aliases []string
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+// GetDomainAliases returns a project's aliases
+func (db *DB) GetDomainAliases(projectID string) ([]string, error) {
+	rows, err := db.conn.Query(`
+		SELECT hostname FROM clickresearch_project_domain_aliases
+		WHERE project_id = $1
+		ORDER BY hostname
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := []string{}
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+// AddDomainAlias adds an alias to a project of userID. It returns a
+// *LimitError if the project has maxAliases already, and
+// errAliasOwnedElsewhere if another user's project tracks hostname, or
+// errAliasTaken if another project of userID does. Adding an alias the
+// project has is a no-op.
+func (db *DB) AddDomainAlias(projectID, userID, hostname string, maxAliases int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := checkQuota(tx, projectID, quotaAliases, maxAliases); err != nil {
+		return err
+	}
+
+	if err := lockHostname(tx, hostname); err != nil {
+		return err
+	}
+
+	var owner string
+	err = tx.QueryRow(`
+		SELECT user_id FROM clickresearch_projects WHERE domain = $1
+		UNION ALL
+		SELECT p.user_id FROM clickresearch_project_domain_aliases a
+		JOIN clickresearch_projects p ON p.id = a.project_id
+		WHERE a.hostname = $1 AND a.project_id <> $2
+		LIMIT 1
+	`, hostname, projectID).Scan(&owner)
+	switch {
+	case err == nil && owner != userID:
+		return errAliasOwnedElsewhere
+	case err == nil:
+		return errAliasTaken
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	// The unique index on hostname backs the check above
+	_, err = tx.Exec(`
+		INSERT INTO clickresearch_project_domain_aliases (project_id, hostname)
+		VALUES ($1, $2)
+		ON CONFLICT (project_id, hostname) DO NOTHING
+	`, projectID, hostname)
+	if isUniqueViolation(err) {
+		return errAliasTaken
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteDomainAlias removes an alias from a project; sql.ErrNoRows if it had none
+func (db *DB) DeleteDomainAlias(projectID, hostname string) error {
+	res, err := db.conn.Exec(`DELETE FROM clickresearch_project_domain_aliases WHERE project_id = $1 AND hostname = $2`, projectID, hostname)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Campaign is a registered campaign with the canonical UTM values its links carry
+type Campaign struct {
+	ID          string `json:"id"`
+	ProjectID   string `json:"project_id"`
+	Name        string `json:"name"`
+	Source      string `json:"utm_source"`
+	Medium      string `json:"utm_medium"`
+	Campaign    string `json:"utm_campaign"`
+	Content     string `json:"utm_content"`
+	Term        string `json:"utm_term"`
+	LandingPath string `json:"landing_path"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	// URL is the tagged link, set by handlers
+	URL string `json:"url,omitempty"`
+}
+
+// ErrDuplicateCampaign is returned when a project already registers a campaign
+// whose utm_campaign matches the same observed values
+var ErrDuplicateCampaign = errors.New("a campaign with this utm_campaign is already registered")
+
+const campaignColumns = `id, project_id, name, utm_source, utm_medium, utm_campaign, utm_content, utm_term, landing_path, created_at, updated_at`
+
+func scanCampaign(row interface{ Scan(...any) error }) (*Campaign, error) {
+	var c Campaign
+	if err := row.Scan(&c.ID, &c.ProjectID, &c.Name, &c.Source, &c.Medium, &c.Campaign, &c.Content, &c.Term,
+		&c.LandingPath, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// CreateCampaign registers a campaign. It returns a *LimitError if the project
+// has maxCampaigns already, and ErrDuplicateCampaign if one has its key.
+func (db *DB) CreateCampaign(projectID string, c CampaignRequest, maxCampaigns int) (*Campaign, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := checkQuota(tx, projectID, quotaCampaigns, maxCampaigns); err != nil {
+		return nil, err
+	}
+
+	campaign, err := scanCampaign(tx.QueryRow(`
+		INSERT INTO clickresearch_campaigns (project_id, name, utm_source, utm_medium, utm_campaign, utm_content, utm_term, campaign_key, landing_path)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+campaignColumns,
+		projectID, c.Name, c.Source, c.Medium, c.Campaign, c.Content, c.Term, stats.CampaignKey(c.Campaign), c.LandingPath))
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateCampaign
+	}
+	if err != nil {
+		return nil, err
+	}
+	return campaign, tx.Commit()
+}
+
+// GetCampaigns returns a project's campaigns, oldest first
+func (db *DB) GetCampaigns(projectID string) ([]Campaign, error) {
+	rows, err := db.conn.Query(`SELECT `+campaignColumns+` FROM clickresearch_campaigns WHERE project_id = $1 ORDER BY created_at, id`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := []Campaign{}
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, *c)
+	}
+	return campaigns, rows.Err()
+}
+
+// GetCampaign returns a project's campaign; sql.ErrNoRows if it has none with id
+func (db *DB) GetCampaign(id, projectID string) (*Campaign, error) {
+	return scanCampaign(db.conn.QueryRow(`SELECT `+campaignColumns+` FROM clickresearch_campaigns WHERE id::text = $1 AND project_id = $2`, id, projectID))
+}
+
+// UpdateCampaign replaces a campaign's fields; sql.ErrNoRows if the project
+// has none with id, ErrDuplicateCampaign if another campaign has its new key
+func (db *DB) UpdateCampaign(id, projectID string, c CampaignRequest) (*Campaign, error) {
+	campaign, err := scanCampaign(db.conn.QueryRow(`
+		UPDATE clickresearch_campaigns
+		SET name = $3, utm_source = $4, utm_medium = $5, utm_campaign = $6, utm_content = $7, utm_term = $8,
+			campaign_key = $9, landing_path = $10, updated_at = NOW()
+		WHERE id::text = $1 AND project_id = $2
+		RETURNING `+campaignColumns,
+		id, projectID, c.Name, c.Source, c.Medium, c.Campaign, c.Content, c.Term, stats.CampaignKey(c.Campaign), c.LandingPath))
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateCampaign
+	}
+	return campaign, err
+}
+
+// DeleteCampaign removes a campaign; sql.ErrNoRows if the project has none with id
+func (db *DB) DeleteCampaign(id, projectID string) error {
+	res, err := db.conn.Exec(`DELETE FROM clickresearch_campaigns WHERE id::text = $1 AND project_id = $2`, id, projectID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RegisteredCampaigns returns the utm_campaign values registered for the
+// projects tracking a domain
+func (db *DB) RegisteredCampaigns(domain string) ([]string, error) {
+	rows, err := db.conn.Query(`
+		SELECT c.utm_campaign
+		FROM clickresearch_campaigns c
+		JOIN clickresearch_projects p ON p.id = c.project_id
+		WHERE p.domain = $1
+		ORDER BY c.created_at, c.id
+	`, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var campaigns []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+// GetBadgeSlugs returns the domains of projects with a public badge, keyed by badge slug
+func (db *DB) GetBadgeSlugs() (map[string]string, error) {
+	rows, err := db.conn.Query(`SELECT badge_slug, domain FROM clickresearch_projects WHERE badge_slug IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	slugs := make(map[string]string)
+	for rows.Next() {
+		var slug, domain string
+		if err := rows.Scan(&slug, &domain); err != nil {
+			return nil, err
+		}
+		slugs[slug] = domain
+	}
+	return slugs, rows.Err()
+}
+
+// GetProjectBadgeSlug returns a project's badge slug, or "" if its badge is disabled
+func (db *DB) GetProjectBadgeSlug(projectID string) (string, error) {
+	var slug sql.NullString
+	err := db.conn.QueryRow(`SELECT badge_slug FROM clickresearch_projects WHERE id = $1`, projectID).Scan(&slug)
+	return slug.String, err
+}
+
+// SetBadgeSlug sets a project's badge slug; "" disables its badge
+func (db *DB) SetBadgeSlug(projectID, slug string) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET badge_slug = NULLIF($2, '') WHERE id = $1`, projectID, slug)
+	return err
+}
+
+// SetProjectSyncedFrom tags a project as created by the sync flow of source
+func (db *DB) SetProjectSyncedFrom(projectID, source string) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET synced_from = $2 WHERE id = $1`, projectID, source)
+	return err
+}
+
+// DigestProject is a project created by the sync flow, with its last delivered digest
+type DigestProject struct {
+	ID           string            `json:"id"`
+	Domain       string            `json:"domain"`
+	SyncedFrom   string            `json:"synced_from"`
+	PrivacyMode  stats.PrivacyMode `json:"-"`
+	DigestSentAt *string           `json:"digest_sent_at,omitempty"`
+	// DigestZero is set when the last delivered digest had no traffic
+	DigestZero bool `json:"digest_zero"`
+}
+
+// GetDigestProjects returns the projects created by the sync flow of source
+func (db *DB) GetDigestProjects(source string) ([]DigestProject, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, domain, synced_from, privacy_mode, digest_sent_at, digest_zero
+		FROM clickresearch_projects
+		WHERE synced_from = $1
+		ORDER BY domain
+	`, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []DigestProject
+	for rows.Next() {
+		var p DigestProject
+		var sentAt sql.NullTime
+		if err := rows.Scan(&p.ID, &p.Domain, &p.SyncedFrom, &p.PrivacyMode, &sentAt, &p.DigestZero); err != nil {
+			return nil, err
+		}
+		if sentAt.Valid {
+			s := sentAt.Time.UTC().Format(time.RFC3339)
+			p.DigestSentAt = &s
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+// RecordDigestSent records that a project's digest was delivered and whether it had traffic
+func (db *DB) RecordDigestSent(projectID string, zero bool) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET digest_sent_at = NOW(), digest_zero = $2 WHERE id = $1`, projectID, zero)
+	return err
+}
+
+// SavedFunnel is a funnel with the domain and privacy mode of its project, for background jobs
+type SavedFunnel struct {
+	Funnel
+	Domain      string
+	PrivacyMode stats.PrivacyMode
+}
+
+// GetAllSavedFunnels returns every saved funnel with its project domain
+func (db *DB) GetAllSavedFunnels() ([]SavedFunnel, error) {
+	rows, err := db.conn.Query(`
+		SELECT f.id, f.project_id, f.name, f.funnel_window, f.steps, f.created_at, f.updated_at, p.domain, p.privacy_mode
+		FROM clickresearch_funnels f
+		JOIN clickresearch_projects p ON p.id = f.project_id
+		ORDER BY f.created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var funnels []SavedFunnel
+	for rows.Next() {
+		var f SavedFunnel
+		if err := rows.Scan(&f.ID, &f.ProjectID, &f.Name, &f.Window, &f.Steps, &f.CreatedAt, &f.UpdatedAt, &f.Domain, &f.PrivacyMode); err != nil {
+			return nil, err
+		}
+		funnels = append(funnels, f)
+	}
+	return funnels, rows.Err()
+}
+
+// FunnelResultDay is the stored funnel result of one UTC day
+type FunnelResultDay struct {
+	Date   string          `json:"date"` // YYYY-MM-DD
+	Result json.RawMessage `json:"result"`
+}
+
+// GetFunnelResultDates returns the days since since (inclusive) that already have a stored result
+func (db *DB) GetFunnelResultDates(funnelID string, since time.Time) (map[string]bool, error) {
+	rows, err := db.conn.Query(`
+		SELECT to_char(date, 'YYYY-MM-DD') FROM clickresearch_funnel_results
+		WHERE funnel_id = $1 AND date >= $2
+	`, funnelID, since.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dates := make(map[string]bool)
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			return nil, err
+		}
+		dates[date] = true
+	}
+	return dates, rows.Err()
+}
+
+// SaveFunnelResult stores a day's result; an existing row for the day is kept
+func (db *DB) SaveFunnelResult(funnelID, date string, result []byte) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO clickresearch_funnel_results (funnel_id, date, result)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (funnel_id, date) DO NOTHING
+	`, funnelID, date, string(result))
+	return err
+}
+
+// GetFunnelResults returns a project's funnel results since since, oldest first
+func (db *DB) GetFunnelResults(funnelID, projectID string, since time.Time) ([]FunnelResultDay, error) {
+	rows, err := db.conn.Query(`
+		SELECT to_char(r.date, 'YYYY-MM-DD'), r.result
+		FROM clickresearch_funnel_results r
+		JOIN clickresearch_funnels f ON f.id = r.funnel_id
+		WHERE r.funnel_id = $1 AND f.project_id = $2 AND r.date >= $3
+		ORDER BY r.date
+	`, funnelID, projectID, since.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make([]FunnelResultDay, 0)
+	for rows.Next() {
+		var d FunnelResultDay
+		var result string
+		if err := rows.Scan(&d.Date, &result); err != nil {
+			return nil, err
+		}
+		d.Result = json.RawMessage(result)
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+// GetProjectByID finds a project by ID
+func (db *DB) GetProjectByID(id string) (*Project, error) {
+	var project Project
+	err := db.conn.QueryRow(`
+		SELECT id, user_id, domain, api_key, name, created_at
+		FROM clickresearch_projects WHERE id = $1
+	`, id).Scan(
+		&project.ID, &project.UserID, &project.Domain, &project.APIKey, &project.Name, &project.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
+// ProjectTransfer is a pending or completed change of project owner
+type ProjectTransfer struct {
+	ID          string  `json:"id"`
+	ProjectID   string  `json:"project_id"`
+	Domain      string  `json:"domain"`
+	FromUserID  string  `json:"from_user_id"`
+	ToEmail     string  `json:"to_email"`
+	ToUserID    *string `json:"to_user_id,omitempty"`
+	InitiatedBy string  `json:"initiated_by"`
+	Status      string  `json:"status"` // pending, completed, cancelled
+	CreatedAt   string  `json:"created_at"`
+}
+
+// TransferProject moves a project from one owner to another and records the
+// transfer. Funnels, goals, segments and annotations belong to the project, so
+// they move with it. Returns sql.ErrNoRows if fromUserID no longer owns it.
+func (db *DB) TransferProject(projectID, fromUserID, toUserID, toEmail, initiatedBy string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := reassignProject(tx, projectID, fromUserID, toUserID); err != nil {
+		return err
+	}
+	// A direct transfer supersedes any pending one for the project
+	if _, err := tx.Exec(`
+		UPDATE clickresearch_project_transfers SET status = 'cancelled'
+		WHERE project_id = $1 AND status = 'pending'
+	`, projectID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO clickresearch_project_transfers (project_id, from_user_id, to_email, to_user_id, initiated_by, status, completed_at)
+		VALUES ($1, $2, $3, $4, $5, 'completed', NOW())
+	`, projectID, fromUserID, toEmail, toUserID, initiatedBy); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreatePendingTransfer records a transfer to an email without an account,
+// replacing any earlier pending transfer of the project
+func (db *DB) CreatePendingTransfer(projectID, fromUserID, toEmail, initiatedBy string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE clickresearch_project_transfers SET status = 'cancelled'
+		WHERE project_id = $1 AND status = 'pending'
+	`, projectID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO clickresearch_project_transfers (project_id, from_user_id, to_email, initiated_by)
+		VALUES ($1, $2, $3, $4)
+	`, projectID, fromUserID, toEmail, initiatedBy); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPendingTransfers returns the pending transfers to an email, oldest first
+func (db *DB) GetPendingTransfers(email string) ([]ProjectTransfer, error) {
+	rows, err := db.conn.Query(`
+		SELECT t.id, t.project_id, p.domain, t.from_user_id, t.to_email, t.to_user_id, t.initiated_by, t.status, t.created_at
+		FROM clickresearch_project_transfers t
+		JOIN clickresearch_projects p ON p.id = t.project_id
+		WHERE lower(t.to_email) = lower($1) AND t.status = 'pending'
+		ORDER BY t.created_at
+	`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []ProjectTransfer
+	for rows.Next() {
+		var t ProjectTransfer
+		if err := rows.Scan(&t.ID, &t.ProjectID, &t.Domain, &t.FromUserID, &t.ToEmail, &t.ToUserID, &t.InitiatedBy, &t.Status, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+// CompletePendingTransfer gives a pending transfer's project to toUserID. If the
+// project changed owner since the transfer was created, the transfer is
+// cancelled and sql.ErrNoRows returned.
+func (db *DB) CompletePendingTransfer(transferID, toUserID string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var projectID, fromUserID string
+	err = tx.QueryRow(`
+		SELECT project_id, from_user_id FROM clickresearch_project_transfers
+		WHERE id = $1 AND status = 'pending'
+		FOR UPDATE
+	`, transferID).Scan(&projectID, &fromUserID)
+	if err != nil {
+		return err
+	}
+
+	status := "completed"
+	reassignErr := reassignProject(tx, projectID, fromUserID, toUserID)
+	if reassignErr == sql.ErrNoRows {
+		status = "cancelled"
+	} else if reassignErr != nil {
+		return reassignErr
+	}
+	if _, err := tx.Exec(`
+		UPDATE clickresearch_project_transfers
+		SET status = $2, to_user_id = $3, completed_at = NOW()
+		WHERE id = $1
+	`, transferID, status, toUserID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return reassignErr
+}
+
+// reassignProject changes a project's owner within tx if fromUserID still owns it
+func reassignProject(tx *sql.Tx, projectID, fromUserID, toUserID string) error {
+	res, err := tx.Exec(`
+		UPDATE clickresearch_projects SET user_id = $3
+		WHERE id = $1 AND user_id = $2
+	`, projectID, fromUserID, toUserID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// EventNameSettings are a project's event name protections
+type EventNameSettings struct {
+	EnforceAllowList bool     `json:"enforce_allowlist"`
+	CardinalityGuard bool     `json:"cardinality_guard"`
+	Names            []string `json:"names"`
+}
+
+// GetEventNameSettings returns a project's event name protections
+func (db *DB) GetEventNameSettings(projectID string) (*EventNameSettings, error) {
+	settings := EventNameSettings{Names: []string{}}
+	err := db.conn.QueryRow(`
+		SELECT enforce_event_names, event_cardinality_guard FROM clickresearch_projects WHERE id = $1
+	`, projectID).Scan(&settings.EnforceAllowList, &settings.CardinalityGuard)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT name FROM clickresearch_project_event_names WHERE project_id = $1 ORDER BY name
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		settings.Names = append(settings.Names, name)
+	}
+	return &settings, rows.Err()
+}
+
+// SetEventNameSettings replaces a project's event name protections and allow-list
+func (db *DB) SetEventNameSettings(projectID string, settings EventNameSettings) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE clickresearch_projects SET enforce_event_names = $2, event_cardinality_guard = $3 WHERE id = $1
+	`, projectID, settings.EnforceAllowList, settings.CardinalityGuard); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM clickresearch_project_event_names WHERE project_id = $1`, projectID); err != nil {
+		return err
+	}
+	for _, name := range settings.Names {
+		if _, err := tx.Exec(`
+			INSERT INTO clickresearch_project_event_names (project_id, name) VALUES ($1, $2)
+		`, projectID, name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// EventNameRules returns, per domain, the allow-list of projects enforcing one
+// (merged when several projects share a domain) and whether any of its
+// projects has the cardinality guard on
+func (db *DB) EventNameRules() (allow map[string][]string, guard map[string]bool, err error) {
+	allow = make(map[string][]string)
+	guard = make(map[string]bool)
+
+	rows, err := db.conn.Query(`
+		SELECT domain, enforce_event_names, event_cardinality_guard FROM clickresearch_projects
+		WHERE enforce_event_names OR event_cardinality_guard
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var domain string
+		var enforce, guarded bool
+		if err := rows.Scan(&domain, &enforce, &guarded); err != nil {
+			return nil, nil, err
+		}
+		if enforce && allow[domain] == nil {
+			allow[domain] = []string{}
+		}
+		if guarded {
+			guard[domain] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	names, err := db.conn.Query(`
+		SELECT DISTINCT p.domain, n.name
+		FROM clickresearch_project_event_names n
+		JOIN clickresearch_projects p ON p.id = n.project_id
+		WHERE p.enforce_event_names
+		ORDER BY p.domain, n.name
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer names.Close()
+	for names.Next() {
+		var domain, name string
+		if err := names.Scan(&domain, &name); err != nil {
+			return nil, nil, err
+		}
+		allow[domain] = append(allow[domain], name)
+	}
+	return allow, guard, names.Err()
+}
+
+// ExportDestination is where a project's events are exported nightly. Its
+// sealed credentials are never serialized.
+type ExportDestination struct {
+	ID                  string     `json:"id"`
+	ProjectID           string     `json:"project_id"`
+	Kind                string     `json:"kind"` // s3, webhook
+	Bucket              string     `json:"bucket,omitempty"`
+	Region              string     `json:"region,omitempty"`
+	Endpoint            string     `json:"endpoint,omitempty"`
+	Prefix              string     `json:"prefix,omitempty"`
+	URL                 string     `json:"url,omitempty"`
+	Status              string     `json:"status"` // pending, ok, failing
+	LastRunAt           *time.Time `json:"last_run_at"`
+	LastExportedDate    *string    `json:"last_exported_date"` // YYYY-MM-DD
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CreatedAt           time.Time  `json:"created_at"`
+
+	Credentials []byte `json:"-"`
+	// Domain and OwnerEmail are set for the export job
+	Domain     string `json:"-"`
+	OwnerEmail string `json:"-"`
+}
+
+const exportDestinationColumns = `d.id, d.project_id, d.kind, d.bucket, d.region, d.endpoint, d.prefix, d.url,
+	d.credentials, d.status, d.last_run_at, to_char(d.last_exported_date, 'YYYY-MM-DD'), d.last_error,
+	d.consecutive_failures, d.created_at`
+
+func scanExportDestination(row interface{ Scan(...any) error }, extra ...any) (ExportDestination, error) {
+	var d ExportDestination
+	dest := []any{&d.ID, &d.ProjectID, &d.Kind, &d.Bucket, &d.Region, &d.Endpoint, &d.Prefix, &d.URL,
+		&d.Credentials, &d.Status, &d.LastRunAt, &d.LastExportedDate, &d.LastError,
+		&d.ConsecutiveFailures, &d.CreatedAt}
+	err := row.Scan(append(dest, extra...)...)
+	return d, err
+}
+
+// CreateExportDestination adds an export destination with sealed credentials
+func (db *DB) CreateExportDestination(d ExportDestination) (*ExportDestination, error) {
+	row := db.conn.QueryRow(`
+		INSERT INTO clickresearch_export_destinations AS d (project_id, kind, bucket, region, endpoint, prefix, url, credentials)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+exportDestinationColumns,
+		d.ProjectID, d.Kind, d.Bucket, d.Region, d.Endpoint, d.Prefix, d.URL, d.Credentials)
+	created, err := scanExportDestination(row)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// GetExportDestinationsByProjectID returns a project's export destinations
+func (db *DB) GetExportDestinationsByProjectID(projectID string) ([]ExportDestination, error) {
+	rows, err := db.conn.Query(`
+		SELECT `+exportDestinationColumns+`
+		FROM clickresearch_export_destinations d WHERE d.project_id = $1
+		ORDER BY d.created_at
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dests []ExportDestination
+	for rows.Next() {
+		d, err := scanExportDestination(rows)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, d)
+	}
+	return dests, rows.Err()
+}
+
+// GetAllExportDestinations returns every export destination with its project
+// domain and owner email, for the export job
+func (db *DB) GetAllExportDestinations() ([]ExportDestination, error) {
+	rows, err := db.conn.Query(`
+		SELECT ` + exportDestinationColumns + `, p.domain, u.email
+		FROM clickresearch_export_destinations d
+		JOIN clickresearch_projects p ON p.id = d.project_id
+		JOIN clickresearch_users u ON u.id = p.user_id
+		ORDER BY d.created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dests []ExportDestination
+	for rows.Next() {
+		var domain, email string
+		d, err := scanExportDestination(rows, &domain, &email)
+		if err != nil {
+			return nil, err
+		}
+		d.Domain, d.OwnerEmail = domain, email
+		dests = append(dests, d)
+	}
+	return dests, rows.Err()
+}
+
+// DeleteExportDestination deletes an export destination
+func (db *DB) DeleteExportDestination(id, projectID string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_export_destinations WHERE id = $1 AND project_id = $2`, id, projectID)
+	return err
+}
+
+// RecordExportSuccess marks date as exported and resets the failure count
+func (db *DB) RecordExportSuccess(id, date string) error {
+	_, err := db.conn.Exec(`
+		UPDATE clickresearch_export_destinations
+		SET status = 'ok', last_run_at = NOW(), last_exported_date = $2, last_error = '', consecutive_failures = 0
+		WHERE id = $1
+	`, id, date)
+	return err
+}
+
+// RecordExportFailure records a failed run and returns the consecutive failure count
+func (db *DB) RecordExportFailure(id, errMsg string) (int, error) {
+	var failures int
+	err := db.conn.QueryRow(`
+		UPDATE clickresearch_export_destinations
+		SET status = 'failing', last_run_at = NOW(), last_error = $2, consecutive_failures = consecutive_failures + 1
+		WHERE id = $1
+		RETURNING consecutive_failures
+	`, id, errMsg).Scan(&failures)
+	return failures, err
+}
+
+// GetEmbedSecret returns the secret a project's embed tokens are bound to
+func (db *DB) GetEmbedSecret(projectID string) (string, error) {
+	var secret string
+	err := db.conn.QueryRow(`SELECT embed_secret FROM clickresearch_projects WHERE id = $1`, projectID).Scan(&secret)
+	return secret, err
+}
+
+// SetEmbedSecret replaces a project's embed secret, revoking its embed tokens
+func (db *DB) SetEmbedSecret(projectID, secret string) error {
+	_, err := db.conn.Exec(`UPDATE clickresearch_projects SET embed_secret = $2 WHERE id = $1`, projectID, secret)
+	return err
+}
+
+// LoginAttempts are the consecutive failed logins of an email
+type LoginAttempts struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// GetLoginAttempts returns the failed logins of email; none is the zero value
+func (db *DB) GetLoginAttempts(email string) (LoginAttempts, error) {
+	var a LoginAttempts
+	err := db.conn.QueryRow(`
+		SELECT failures, last_failure_at, locked_until FROM clickresearch_login_attempts WHERE email = lower($1)`,
+		email).Scan(&a.Failures, &a.LastFailureAt, &a.LockedUntil)
+	if err == sql.ErrNoRows {
+		return LoginAttempts{}, nil
+	}
+	return a, err
+}
+
+// RecordLoginFailure counts a failed login of email at at
+func (db *DB) RecordLoginFailure(email string, at time.Time) (LoginAttempts, error) {
+	var a LoginAttempts
+	err := db.conn.QueryRow(`
+		INSERT INTO clickresearch_login_attempts (email, failures, last_failure_at) VALUES (lower($1), 1, $2)
+		ON CONFLICT (email) DO UPDATE SET failures = clickresearch_login_attempts.failures + 1, last_failure_at = $2
+		RETURNING failures, last_failure_at, locked_until`,
+		email, at).Scan(&a.Failures, &a.LastFailureAt, &a.LockedUntil)
+	return a, err
+}
+
+// LockLogin refuses logins of email until until, or until the token hashing to
+// unlockTokenHash is redeemed
+func (db *DB) LockLogin(email string, until time.Time, unlockTokenHash string) error {
+	_, err := db.conn.Exec(`
+		UPDATE clickresearch_login_attempts SET locked_until = $2, unlock_token_hash = $3 WHERE email = lower($1)`,
+		email, until, unlockTokenHash)
+	return err
+}
+
+// ResetLoginAttempts forgets the failed logins of email
+func (db *DB) ResetLoginAttempts(email string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_login_attempts WHERE email = lower($1)`, email)
+	return err
+}
+
+// UnlockLogin redeems an unlock token, returning the email it unlocked or sql.ErrNoRows
+func (db *DB) UnlockLogin(unlockTokenHash string) (string, error) {
+	var email string
+	err := db.conn.QueryRow(`
+		DELETE FROM clickresearch_login_attempts WHERE unlock_token_hash = $1 RETURNING email`,
+		unlockTokenHash).Scan(&email)
+	return email, err
+}
+
+// APIKeyUsage counts the requests made with one project API key in one hour
+type APIKeyUsage struct {
+	ProjectID  string
+	KeyPrefix  string
+	Hour       time.Time
+	Requests   int
+	LastUsedAt time.Time
+}
+
+// RecordAPIKeyUsage adds batched counts to the hourly totals. Counts for
+// projects deleted since are dropped.
+func (db *DB) RecordAPIKeyUsage(usage []APIKeyUsage) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO clickresearch_api_key_usage AS k (project_id, key_prefix, hour, requests, last_used_at)
+		SELECT $1::uuid, $2::varchar, $3::timestamptz, $4::bigint, $5::timestamptz
+		WHERE EXISTS (SELECT 1 FROM clickresearch_projects WHERE id = $1::uuid)
+		ON CONFLICT (project_id, key_prefix, hour) DO UPDATE
+		SET requests = k.requests + EXCLUDED.requests, last_used_at = GREATEST(k.last_used_at, EXCLUDED.last_used_at)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, u := range usage {
+		if _, err := stmt.Exec(u.ProjectID, u.KeyPrefix, u.Hour, u.Requests, u.LastUsedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PruneAPIKeyUsage deletes hourly counts from before before
+func (db *DB) PruneAPIKeyUsage(before time.Time) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_api_key_usage WHERE hour < $1`, before)
+	return err
+}
+
+// APIKeyInfo is the current API key of a project and how it has been used
+type APIKeyInfo struct {
+	ProjectID  string     `json:"project_id"`
+	Domain     string     `json:"domain"`
+	KeyPrefix  string     `json:"key_prefix"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Requests7d int64      `json:"requests_7d"`
+}
+
+// GetAPIKeyUsage returns the API keys of a user's projects with their last use
+// and the requests made since since
+func (db *DB) GetAPIKeyUsage(userID string, since time.Time) ([]APIKeyInfo, error) {
+	rows, err := db.conn.Query(`
+		SELECT p.id, p.domain, left(p.api_key, 8), MAX(k.last_used_at),
+			COALESCE(SUM(k.requests) FILTER (WHERE k.hour >= $2), 0)
+		FROM clickresearch_projects p
+		LEFT JOIN clickresearch_api_key_usage k ON k.project_id = p.id AND k.key_prefix = left(p.api_key, 8)
+		WHERE p.user_id = $1
+		GROUP BY p.id, p.domain, p.api_key
+		ORDER BY p.domain`, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKeyInfo
+	for rows.Next() {
+		var k APIKeyInfo
+		if err := rows.Scan(&k.ProjectID, &k.Domain, &k.KeyPrefix, &k.LastUsedAt, &k.Requests7d); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// quota is something projects may only have so many of
+type quota struct {
+	resource string // as named in errors
+	table    string
+	column   string // of clickresearch_projects, overriding the default limit
+}
+
+var (
+	quotaFunnels  = quota{"funnel", "clickresearch_funnels", "max_funnels"}
+	quotaGoals    = quota{"goal", "clickresearch_goals", "max_goals"}
+	quotaSegments = quota{"segment", "clickresearch_segments", "max_segments"}
+	// Admins can't override the alias, campaign and annotation limits
+	quotaAliases     = quota{"alias", "clickresearch_project_domain_aliases", "NULL::integer"}
+	quotaCampaigns   = quota{"campaign", "clickresearch_campaigns", "NULL::integer"}
+	quotaAnnotations = quota{"annotation", "clickresearch_annotations", "NULL::integer"}
+)
+
+// checkQuota returns a *LimitError if the project already has its limit of q,
+// defaultLimit unless overridden. It locks the project row until tx ends, so
+// concurrent creates are counted one after another.
+func checkQuota(tx *sql.Tx, projectID string, q quota, defaultLimit int) error {
+	var limit int
+	if err := tx.QueryRow(`SELECT COALESCE(`+q.column+`, $2) FROM clickresearch_projects WHERE id = $1 FOR UPDATE`,
+		projectID, defaultLimit).Scan(&limit); err != nil {
+		return err
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM `+q.table+` WHERE project_id = $1`, projectID).Scan(&count); err != nil {
+		return err
+	}
+	if count >= limit {
+		return &LimitError{Resource: q.resource, Count: count, Limit: limit}
+	}
+	return nil
+}
+
+// ProjectLimitOverrides are a project's own limits; nil uses the default
+type ProjectLimitOverrides struct {
+	Funnels  *int `json:"funnels"`
+	Goals    *int `json:"goals"`
+	Segments *int `json:"segments"`
+}
+
+// GetProjectLimitOverrides returns the limits set on a project by admins
+func (db *DB) GetProjectLimitOverrides(projectID string) (ProjectLimitOverrides, error) {
+	var o ProjectLimitOverrides
+	err := db.conn.QueryRow(`SELECT max_funnels, max_goals, max_segments FROM clickresearch_projects WHERE id = $1`,
+		projectID).Scan(&o.Funnels, &o.Goals, &o.Segments)
+	return o, err
+}
+
+// SetProjectLimitOverrides replaces the limits set on a project
+func (db *DB) SetProjectLimitOverrides(projectID string, o ProjectLimitOverrides) error {
+	res, err := db.conn.Exec(`UPDATE clickresearch_projects SET max_funnels = $2, max_goals = $3, max_segments = $4 WHERE id = $1`,
+		projectID, o.Funnels, o.Goals, o.Segments)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// IdempotencyRecord is the stored outcome of a request sent with an Idempotency-Key
+type IdempotencyRecord struct {
+	RequestHash string
+	Status      int // 0 while the first request is in progress
+	Body        []byte
+}
+
+// ClaimIdempotencyKey reserves key for a request hashing to requestHash until
+// expiresAt. A key that expired before now, or whose request was abandoned in
+// progress before staleBefore, is claimed afresh. Otherwise claimed is false
+// and the existing record is returned.
+func (db *DB) ClaimIdempotencyKey(userID, key, requestHash string, now, staleBefore, expiresAt time.Time) (rec IdempotencyRecord, claimed bool, err error) {
+	err = db.conn.QueryRow(`
+		INSERT INTO clickresearch_idempotency_keys (user_id, idempotency_key, request_hash, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $6)
+		ON CONFLICT (user_id, idempotency_key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = NULL, body = NULL,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+		WHERE clickresearch_idempotency_keys.expires_at <= $4
+			OR (clickresearch_idempotency_keys.status IS NULL AND clickresearch_idempotency_keys.created_at <= $5)
+		RETURNING request_hash`,
+		userID, key, requestHash, now, staleBefore, expiresAt).Scan(&rec.RequestHash)
+	if err == nil {
+		return rec, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return rec, false, err
+	}
+
+	var status sql.NullInt64
+	err = db.conn.QueryRow(`
+		SELECT request_hash, status, body FROM clickresearch_idempotency_keys
+		WHERE user_id = $1 AND idempotency_key = $2`,
+		userID, key).Scan(&rec.RequestHash, &status, &rec.Body)
+	rec.Status = int(status.Int64)
+	return rec, false, err
+}
+
+// SaveIdempotentResponse stores the response to replay for a claimed key
+func (db *DB) SaveIdempotentResponse(userID, key string, status int, body []byte) error {
+	_, err := db.conn.Exec(`
+		UPDATE clickresearch_idempotency_keys SET status = $3, body = $4
+		WHERE user_id = $1 AND idempotency_key = $2`,
+		userID, key, status, body)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a claimed key so the request can be retried
+func (db *DB) ReleaseIdempotencyKey(userID, key string) error {
+	_, err := db.conn.Exec(`DELETE FROM clickresearch_idempotency_keys WHERE user_id = $1 AND idempotency_key = $2`, userID, key)
+	return err
+}
+
+// DeleteExpiredIdempotencyKeys removes keys that expired before now
+func (db *DB) DeleteExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	res, err := db.conn.Exec(`DELETE FROM clickresearch_idempotency_keys WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,745 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// testDB connects to POSTGRES_TEST_URL in a throwaway schema holding the users
+// and projects tables, then applies migrations from migrations/
+func testDB(t *testing.T, migrations ...string) *DB {
+	t.Helper()
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if url == "" {
+		t.Skip("POSTGRES_TEST_URL not set")
+	}
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("clickresearch_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA IF EXISTS " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	// lib/pq passes search_path to the server for every connection of the pool
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	conn, err := sql.Open("postgres", url+sep+"search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	stmts := []string{
+		`CREATE TABLE clickresearch_users (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			email VARCHAR(255) NOT NULL UNIQUE,
+			password_hash VARCHAR(255) NOT NULL DEFAULT '',
+			name VARCHAR(255),
+			role VARCHAR(20) NOT NULL DEFAULT 'user',
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			synced_from VARCHAR(50),
+			permanent_energy INT NOT NULL DEFAULT 0,
+			subscription_energy INT NOT NULL DEFAULT 0,
+			daily_bonus_energy INT NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE clickresearch_projects (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			user_id UUID NOT NULL REFERENCES clickresearch_users(id),
+			domain VARCHAR(255) NOT NULL UNIQUE,
+			api_key VARCHAR(64) NOT NULL DEFAULT '',
+			name VARCHAR(255),
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)`,
+	}
+	for _, m := range migrations {
+		data, err := os.ReadFile(filepath.Join("..", "..", "migrations", m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts = append(stmts, string(data))
+	}
+	for _, stmt := range stmts {
+		if _, err := conn.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &DB{conn: conn}
+}
+
+func TestDBIntegration_AdminFilters(t *testing.T) {
+	db := testDB(t)
+	for _, u := range []struct {
+		email, role string
+		syncedFrom  any
+		created     string
+	}{
+		{"alice@acme.com", "admin", nil, "2025-01-10"},
+		{"bob@acme.com", "user", "shortid", "2025-02-10"},
+		{"carol@example.com", "user", "shortid", "2025-03-10"},
+		{"dave_50%@example.com", "user", nil, "2025-04-10"},
+	} {
+		if _, err := db.conn.Exec(`INSERT INTO clickresearch_users (email, role, synced_from, created_at) VALUES ($1, $2, $3, $4)`,
+			u.email, u.role, u.syncedFrom, u.created); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.conn.Exec(`
+		INSERT INTO clickresearch_projects (user_id, domain, created_at)
+		SELECT id, split_part(email, '@', 1) || '.test', created_at + INTERVAL '1 day' FROM clickresearch_users`); err != nil {
+		t.Fatal(err)
+	}
+
+	march := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		filter AdminFilter
+		emails string // newest first
+		total  int
+	}{
+		{"all", AdminFilter{Limit: 100}, "dave_50%@example.com,carol@example.com,bob@acme.com,alice@acme.com", 4},
+		{"email substring", AdminFilter{Email: "ACME", Limit: 100}, "bob@acme.com,alice@acme.com", 2},
+		{"email wildcards are literal", AdminFilter{Email: "_50%", Limit: 100}, "dave_50%@example.com", 1},
+		{"role", AdminFilter{Role: "admin", Limit: 100}, "alice@acme.com", 1},
+		{"synced from", AdminFilter{SyncedFrom: "shortid", Limit: 100}, "carol@example.com,bob@acme.com", 2},
+		{"created after", AdminFilter{CreatedAfter: &march, Limit: 100}, "dave_50%@example.com,carol@example.com", 2},
+		{"page", AdminFilter{Limit: 2, Offset: 1}, "carol@example.com,bob@acme.com", 4},
+		{"past the end", AdminFilter{Limit: 2, Offset: 10}, "", 4},
+	}
+	for _, tt := range tests {
+		users, total, err := db.GetAllUsersAdmin(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: users: %v", tt.name, err)
+		}
+		var emails string
+		for i, u := range users {
+			if i > 0 {
+				emails += ","
+			}
+			emails += u.Email
+		}
+		if emails != tt.emails || total != tt.total {
+			t.Errorf("%s: users = %q (total %d), want %q (total %d)", tt.name, emails, total, tt.emails, tt.total)
+		}
+
+		projects, total, err := db.GetAllProjectsAdmin(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: projects: %v", tt.name, err)
+		}
+		emails = ""
+		for i, p := range projects {
+			if i > 0 {
+				emails += ","
+			}
+			emails += p.UserEmail
+		}
+		if emails != tt.emails || total != tt.total {
+			t.Errorf("%s: project owners = %q (total %d), want %q (total %d)", tt.name, emails, total, tt.emails, tt.total)
+		}
+	}
+}
+
+func TestDBIntegration_CreateFunnelLimit(t *testing.T) {
+	db := testDB(t, "001_create_funnels.sql", "015_add_project_limits.sql")
+	var projectID string
+	if err := db.conn.QueryRow(`
+		WITH u AS (INSERT INTO clickresearch_users (email) VALUES ('owner@example.com') RETURNING id)
+		INSERT INTO clickresearch_projects (user_id, domain) SELECT id, 'example.com' FROM u RETURNING id`).Scan(&projectID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent creates are counted one after another
+	const limit = 3
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, limited := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.CreateFunnel(projectID, fmt.Sprintf("Funnel %d", i), 60, `[]`, limit)
+			var limitErr *LimitError
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+			case errors.As(err, &limitErr) && limitErr.Count == limit && limitErr.Limit == limit:
+				limited++
+			default:
+				t.Errorf("create %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if created != limit || limited != 10-limit {
+		t.Errorf("created %d, limited %d", created, limited)
+	}
+
+	// An admin override replaces the default
+	more := 5
+	if err := db.SetProjectLimitOverrides(projectID, ProjectLimitOverrides{Funnels: &more}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateFunnel(projectID, "Another", 60, `[]`, limit); err != nil {
+		t.Errorf("with override: %v", err)
+	}
+	if o, err := db.GetProjectLimitOverrides(projectID); err != nil || o.Funnels == nil || *o.Funnels != 5 || o.Goals != nil {
+		t.Errorf("overrides = %+v, err = %v", o, err)
+	}
+}
+
+func TestDBIntegration_IdempotencyKeys(t *testing.T) {
+	db := testDB(t, "016_create_idempotency_keys.sql")
+	var userID string
+	if err := db.conn.QueryRow(`INSERT INTO clickresearch_users (email) VALUES ('owner@example.com') RETURNING id`).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	claim := func(hash string, now time.Time) (IdempotencyRecord, bool) {
+		t.Helper()
+		rec, claimed, err := db.ClaimIdempotencyKey(userID, "k1", hash, now, now.Add(-time.Minute), now.Add(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec, claimed
+	}
+
+	if _, claimed := claim("h1", now); !claimed {
+		t.Fatal("first claim failed")
+	}
+	if rec, claimed := claim("h2", now.Add(time.Second)); claimed || rec.RequestHash != "h1" || rec.Status != 0 {
+		t.Errorf("claim in progress = %+v, %v", rec, claimed)
+	}
+	if err := db.SaveIdempotentResponse(userID, "k1", 201, []byte(`{"id":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if rec, claimed := claim("h1", now.Add(time.Hour)); claimed || rec.Status != 201 || string(rec.Body) != `{"id":1}` {
+		t.Errorf("claim after save = %+v, %v", rec, claimed)
+	}
+
+	// Expired keys are claimed afresh, then cleaned up once expired again
+	if _, claimed := claim("h2", now.Add(25*time.Hour)); !claimed {
+		t.Error("expired key not claimed")
+	}
+	if n, err := db.DeleteExpiredIdempotencyKeys(now.Add(50 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("deleted %d, err = %v", n, err)
+	}
+}
+
+func TestDBIntegration_DomainMatch(t *testing.T) {
+	db := testDB(t, "017_add_project_domain_match.sql")
+	var projectID string
+	if err := db.conn.QueryRow(`
+		WITH u AS (INSERT INTO clickresearch_users (email) VALUES ('owner@example.com') RETURNING id)
+		INSERT INTO clickresearch_projects (user_id, domain) SELECT id, 'example.com' FROM u RETURNING id`).Scan(&projectID); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err := db.DomainMatch("unknown.com"); err != nil || m != stats.DefaultDomainMatch {
+		t.Errorf("unknown domain = %+v, %v", m, err)
+	}
+	if m, err := db.DomainMatch("example.com"); err != nil || m != stats.DefaultDomainMatch {
+		t.Errorf("new project = %+v, %v", m, err)
+	}
+	strict := stats.DomainMatch{StrictDomain: true}
+	if err := db.SetDomainMatch(projectID, strict); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := db.DomainMatch("example.com"); err != nil || m != strict {
+		t.Errorf("after update = %+v, %v", m, err)
+	}
+	if m, err := db.GetProjectDomainMatch(projectID); err != nil || m != strict {
+		t.Errorf("project = %+v, %v", m, err)
+	}
+}
+
+func TestDBIntegration_RevenueSettings(t *testing.T) {
+	db := testDB(t, "022_add_project_revenue.sql")
+	var projectID string
+	if err := db.conn.QueryRow(`
+		WITH u AS (INSERT INTO clickresearch_users (email) VALUES ('owner@example.com') RETURNING id)
+		INSERT INTO clickresearch_projects (user_id, domain) SELECT id, 'example.com' FROM u RETURNING id`).Scan(&projectID); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := db.RevenueSettings("unknown.com"); err != nil || s != stats.DefaultRevenueSettings {
+		t.Errorf("unknown domain = %+v, %v", s, err)
+	}
+	if s, err := db.RevenueSettings("example.com"); err != nil || s != stats.DefaultRevenueSettings {
+		t.Errorf("new project = %+v, %v", s, err)
+	}
+	eur := stats.RevenueSettings{Event: "order_completed", Currency: "EUR"}
+	if err := db.SetRevenueSettings(projectID, eur); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.RevenueSettings("example.com"); err != nil || s != eur {
+		t.Errorf("after update = %+v, %v", s, err)
+	}
+	if s, err := db.GetProjectRevenueSettings(projectID); err != nil || s != eur {
+		t.Errorf("project = %+v, %v", s, err)
+	}
+}
+
+func TestDBIntegration_BadgeSlugs(t *testing.T) {
+	db := testDB(t, "018_add_project_badge_slug.sql")
+	var projectID string
+	if err := db.conn.QueryRow(`
+		WITH u AS (INSERT INTO clickresearch_users (email) VALUES ('owner@example.com') RETURNING id)
+		INSERT INTO clickresearch_projects (user_id, domain) SELECT id, 'example.com' FROM u RETURNING id`).Scan(&projectID); err != nil {
+		t.Fatal(err)
+	}
+
+	if slug, err := db.GetProjectBadgeSlug(projectID); err != nil || slug != "" {
+		t.Errorf("new project slug = %q, %v", slug, err)
+	}
+	if err := db.SetBadgeSlug(projectID, "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if slugs, err := db.GetBadgeSlugs(); err != nil || len(slugs) != 1 || slugs["abc123"] != "example.com" {
+		t.Errorf("slugs = %v, %v", slugs, err)
+	}
+	if err := db.SetBadgeSlug(projectID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if slugs, err := db.GetBadgeSlugs(); err != nil || len(slugs) != 0 {
+		t.Errorf("after disabling, slugs = %v, %v", slugs, err)
+	}
+}
+
+func TestDBIntegration_ValueOverrides(t *testing.T) {
+	db := testDB(t, "019_create_value_overrides.sql")
+	rule := stats.ValueOverride{Column: "browser", Match: "Chrome", Replacement: "Edge", StartDate: "2024-03-01", EndDate: "2024-03-14"}
+	id, err := db.AddValueOverride(rule, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules, err := db.ValueOverrideRules(); err != nil || len(rules) != 1 || rules[0] != rule {
+		t.Errorf("rules = %+v, %v", rules, err)
+	}
+	if err := db.DeleteValueOverride(id); err != nil {
+		t.Fatal(err)
+	}
+	if overrides, err := db.GetValueOverrides(); err != nil || len(overrides) != 0 {
+		t.Errorf("after delete = %+v, %v", overrides, err)
+	}
+}
+
+func TestDBIntegration_DigestProjects(t *testing.T) {
+	db := testDB(t, "020_add_project_sync_digest.sql")
+	var projectID string
+	if err := db.conn.QueryRow(`
+		WITH u AS (INSERT INTO clickresearch_users (email) VALUES ('owner@example.com') RETURNING id)
+		INSERT INTO clickresearch_projects (user_id, domain) SELECT id, 'abc.sho.rt' FROM u RETURNING id`).Scan(&projectID); err != nil {
+		t.Fatal(err)
+	}
+
+	if projects, err := db.GetDigestProjects(digestSource); err != nil || len(projects) != 0 {
+		t.Errorf("untagged projects = %+v, %v", projects, err)
+	}
+	if err := db.SetProjectSyncedFrom(projectID, digestSource); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordDigestSent(projectID, true); err != nil {
+		t.Fatal(err)
+	}
+	projects, err := db.GetDigestProjects(digestSource)
+	if err != nil || len(projects) != 1 || !projects[0].DigestZero || projects[0].DigestSentAt == nil {
+		t.Errorf("projects = %+v, %v", projects, err)
+	}
+}
+
+func TestDBIntegration_CreateProjectDuplicate(t *testing.T) {
+	db := testDB(t)
+	user, err := db.CreateUser("owner@example.com", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err := db.CreateProject(user.ID, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateProject(user.ID, "example.com", nil); !errors.Is(err, ErrDuplicateProject) {
+		t.Errorf("second CreateProject = %v, want ErrDuplicateProject", err)
+	}
+	if got, err := db.GetProjectByDomain("example.com"); err != nil || got.ID != project.ID || got.APIKey != project.APIKey {
+		t.Errorf("GetProjectByDomain = %+v, %v; want %+v", got, err, project)
+	}
+}
+
+func TestDBIntegration_DeniedDomains(t *testing.T) {
+	db := testDB(t, "023_create_denied_domains.sql")
+	user, err := db.CreateUser("owner@example.com", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err := db.CreateProject(user.ID, "gone.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeleteProject(project.ID, "someone-else"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeleteProject of another user = %v, want sql.ErrNoRows", err)
+	}
+	if domain, err := db.DeleteProject(project.ID, user.ID); err != nil || domain != "gone.com" {
+		t.Fatalf("DeleteProject = %q, %v; want gone.com", domain, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := db.DenyDomain("gone.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if domains, err := db.DeniedDomains(); err != nil || len(domains) != 1 || domains[0] != "gone.com" {
+		t.Errorf("DeniedDomains = %v, %v; want gone.com once", domains, err)
+	}
+	if err := db.AllowDomain("gone.com"); err != nil {
+		t.Fatal(err)
+	}
+	if domains, err := db.DeniedDomains(); err != nil || len(domains) != 0 {
+		t.Errorf("DeniedDomains after allow = %v, %v", domains, err)
+	}
+}
+
+func TestDBIntegration_ReportBranding(t *testing.T) {
+	db := testDB(t, "024_add_project_report_branding.sql")
+	user, err := db.CreateUser("owner@example.com", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err := db.CreateProject(user.ID, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.ReportBranding("example.com"); err != nil || b != (stats.ReportBranding{}) {
+		t.Errorf("default branding = %+v, %v", b, err)
+	}
+	want := stats.ReportBranding{LogoURL: "https://cdn.example.com/logo.png", AccentColor: "#ff8800"}
+	if err := db.SetReportBranding(project.ID, want); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.ReportBranding("example.com"); err != nil || b != want {
+		t.Errorf("branding = %+v, %v; want %+v", b, err, want)
+	}
+	if b, err := db.ReportBranding("unknown.com"); err != nil || b != (stats.ReportBranding{}) {
+		t.Errorf("branding of an unknown domain = %+v, %v", b, err)
+	}
+}
+
+func TestDBIntegration_DomainAliases(t *testing.T) {
+	db := testDB(t, "025_create_project_domain_aliases.sql")
+	owner, err := db.CreateUser("owner@example.com", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateUser("other@example.com", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err := db.CreateProject(owner.ID, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherProject, err := db.CreateProject(other.ID, "other.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := db.AddDomainAlias(project.ID, owner.ID, "www.example.com", 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if aliases, err := db.DomainAliases("example.com"); err != nil || len(aliases) != 1 || aliases[0] != "www.example.com" {
+		t.Errorf("DomainAliases = %v, %v; want www.example.com once", aliases, err)
+	}
+	if err := db.AddDomainAlias(project.ID, owner.ID, "other.com", 2); !errors.Is(err, errAliasOwnedElsewhere) {
+		t.Errorf("alias of another user's domain = %v, want errAliasOwnedElsewhere", err)
+	}
+	if err := db.AddDomainAlias(otherProject.ID, other.ID, "www.example.com", 2); !errors.Is(err, errAliasOwnedElsewhere) {
+		t.Errorf("alias of another user's alias = %v, want errAliasOwnedElsewhere", err)
+	}
+	ownedProject, err := db.CreateProject(owner.ID, "example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDomainAlias(ownedProject.ID, owner.ID, "www.example.com", 2); !errors.Is(err, errAliasTaken) {
+		t.Errorf("alias of another project's alias = %v, want errAliasTaken", err)
+	}
+	if err := db.AddDomainAlias(project.ID, owner.ID, "example.org", 2); !errors.Is(err, errAliasTaken) {
+		t.Errorf("alias of another project's domain = %v, want errAliasTaken", err)
+	}
+	if _, err := db.CreateProject(other.ID, "www.example.com", nil); !errors.Is(err, ErrDomainIsAlias) {
+		t.Errorf("project on an alias = %v, want ErrDomainIsAlias", err)
+	}
+	if domains, err := db.GetAllDomains(); err != nil || !slices.Contains(domains, "www.example.com") {
+		t.Errorf("GetAllDomains = %v, %v; want the alias included", domains, err)
+	}
+	if err := db.AddDomainAlias(project.ID, owner.ID, "staging.example.com", 2); err != nil {
+		t.Fatal(err)
+	}
+	var limitErr *LimitError
+	if err := db.AddDomainAlias(project.ID, owner.ID, "beta.example.com", 2); !errors.As(err, &limitErr) {
+		t.Errorf("alias past the limit = %v, want *LimitError", err)
+	}
+
+	if err := db.DeleteDomainAlias(project.ID, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteDomainAlias(project.ID, "www.example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second delete = %v, want sql.ErrNoRows", err)
+	}
+	if aliases, err := db.GetDomainAliases(project.ID); err != nil || len(aliases) != 1 || aliases[0] != "staging.example.com" {
+		t.Errorf("GetDomainAliases = %v, %v", aliases, err)
+	}
+}
+
+func TestMissingSchema(t *testing.T) {
+	present := make(map[string]bool)
+	for _, obj := range requiredSchema {
+		present[obj.table] = true
+		if obj.column != "" {
+			present[obj.table+"."+obj.column] = true
+		}
+	}
+	if missing := missingSchema(present); len(missing) != 0 {
+		t.Errorf("complete schema reported missing %v", missing)
+	}
+
+	delete(present, "clickresearch_projects.digest_zero")
+	delete(present, "clickresearch_goals")
+	want := []string{
+		"clickresearch_goals (migrations/004_create_goals.sql)",
+		"clickresearch_projects.digest_zero (migrations/020_add_project_sync_digest.sql)",
+	}
+	if missing := missingSchema(present); strings.Join(missing, ";") != strings.Join(want, ";") {
+		t.Errorf("missing = %v, want %v", missing, want)
+	}
+}
+
+func TestMissingSchema_Migrations(t *testing.T) {
+	// Every migration file is covered, so a new one can't be forgotten here
+	files, err := filepath.Glob("../../migrations/*.sql")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("migrations not found: %v", err)
+	}
+	covered := make(map[string]bool)
+	for _, obj := range requiredSchema {
+		covered[obj.migration] = true
+	}
+	for _, f := range files {
+		if !covered[filepath.Base(f)] {
+			t.Errorf("%s has no entry in requiredSchema", filepath.Base(f))
+		}
+	}
+}
+
+func TestDBIntegration_Campaigns(t *testing.T) {
+	db := testDB(t, "026_create_campaigns.sql")
+	owner, err := db.CreateUser("owner@example.com", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err := db.CreateProject(owner.ID, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spring := CampaignRequest{Name: "Spring sale", Source: "newsletter", Medium: "email", Campaign: "spring_sale", LandingPath: "/sale"}
+	created, err := db.CreateCampaign(project.ID, spring, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Campaign != "spring_sale" || created.LandingPath != "/sale" {
+		t.Errorf("created = %+v", created)
+	}
+	// Matching values would be counted twice, so they can't be registered twice
+	spring.Campaign = "Spring-Sale"
+	if _, err := db.CreateCampaign(project.ID, spring, 2); !errors.Is(err, ErrDuplicateCampaign) {
+		t.Errorf("campaign with a matching key = %v, want ErrDuplicateCampaign", err)
+	}
+	promo := CampaignRequest{Name: "Promo", Source: "google", Medium: "cpc", Campaign: "promo", LandingPath: "/"}
+	second, err := db.CreateCampaign(project.ID, promo, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limitErr *LimitError
+	if _, err := db.CreateCampaign(project.ID, CampaignRequest{Name: "x", Source: "x", Medium: "x", Campaign: "x", LandingPath: "/"}, 2); !errors.As(err, &limitErr) {
+		t.Errorf("campaign past the limit = %v, want *LimitError", err)
+	}
+
+	if registered, err := db.RegisteredCampaigns("example.com"); err != nil || len(registered) != 2 || registered[0] != "spring_sale" {
+		t.Errorf("RegisteredCampaigns = %v, %v", registered, err)
+	}
+
+	promo.Campaign = "SPRING.SALE"
+	if _, err := db.UpdateCampaign(second.ID, project.ID, promo); !errors.Is(err, ErrDuplicateCampaign) {
+		t.Errorf("update onto a registered key = %v, want ErrDuplicateCampaign", err)
+	}
+	promo.Campaign = "promo_2024"
+	if updated, err := db.UpdateCampaign(second.ID, project.ID, promo); err != nil || updated.Campaign != "promo_2024" {
+		t.Errorf("UpdateCampaign = %+v, %v", updated, err)
+	}
+	if _, err := db.UpdateCampaign("00000000-0000-0000-0000-000000000000", project.ID, promo); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("update of a missing campaign = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := db.DeleteCampaign(created.ID, project.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteCampaign(created.ID, project.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second delete = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := db.GetCampaign(created.ID, project.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetCampaign of a deleted campaign = %v", err)
+	}
+	if campaigns, err := db.GetCampaigns(project.ID); err != nil || len(campaigns) != 1 || campaigns[0].ID != second.ID {
+		t.Errorf("GetCampaigns = %v, %v", campaigns, err)
+	}
+}
+
+// stepTrafficStore has traffic on the pageview steps and pages it lists
+type stepTrafficStore struct {
+	stats.StoreInterface
+	pages []string
+	reads int
+}
+
+func (s *stepTrafficStore) GetStepMatchCounts(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step) ([]int64, error) {
+	s.reads++
+	counts := make([]int64, len(steps))
+	for i, step := range steps {
+		if slices.Contains(s.pages, step.Value) {
+			counts[i] = 10
+		}
+	}
+	return counts, nil
+}
+
+func (s *stepTrafficStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]stats.TopItem, error) {
+	items := make([]stats.TopItem, len(s.pages))
+	for i, page := range s.pages {
+		items[i] = stats.TopItem{Name: page, Count: 10}
+	}
+	return items, nil
+}
+
+func TestDBIntegration_FunnelHealth(t *testing.T) {
+	db := testDB(t, "001_create_funnels.sql", "009_add_project_privacy_mode.sql", "015_add_project_limits.sql")
+	owner, err := db.CreateUser("owner@example.com", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err := db.CreateProject(owner.ID, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checkout moved from /checkout/payment to /checkout/pay
+	if _, err := db.CreateFunnel(project.ID, "Checkout", 60, `[{"type":"pageview","value":"/cart"},{"type":"pageview","value":"/checkout/payment"},{"type":"pageview","value":"/thanks"}]`, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateFunnel(project.ID, "Cart", 60, `[{"type":"pageview","value":"/"},{"type":"pageview","value":"/sale","exclude":true},{"type":"pageview","value":"/cart"}]`, 10); err != nil {
+		t.Fatal(err)
+	}
+	funnels, err := db.GetFunnelsByProjectID(project.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &stepTrafficStore{pages: []string{"/", "/cart", "/checkout/pay", "/thanks"}}
+	h := &Handler{db: db, statsStore: store}
+	health, err := h.funnelHealth(context.Background(), "example.com", funnels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.reads != 1 {
+		t.Errorf("store reads = %d, want one for all funnels", store.reads)
+	}
+
+	byName := make(map[string]FunnelHealth)
+	for _, f := range health {
+		byName[f.Name] = f
+	}
+	checkout := byName["Checkout"]
+	if checkout.Healthy || checkout.StaleSteps != 1 || len(checkout.Steps) != 3 {
+		t.Fatalf("checkout = %+v, want one stale step", checkout)
+	}
+	dead := checkout.Steps[1]
+	if !dead.Stale || dead.Index != 1 || dead.Value != "/checkout/payment" || dead.Matches != 0 {
+		t.Errorf("step 2 = %+v, want it stale", dead)
+	}
+	if len(dead.Suggestions) == 0 || dead.Suggestions[0] != "/checkout/pay" {
+		t.Errorf("suggestions = %v, want /checkout/pay first", dead.Suggestions)
+	}
+	// Exclusions aren't checked, and keep their place in the indexes
+	cart := byName["Cart"]
+	if !cart.Healthy || len(cart.Steps) != 2 || cart.Steps[1].Index != 2 {
+		t.Errorf("cart = %+v, want healthy without the exclusion", cart)
+	}
+
+	result := make([]FunnelResponse, len(funnels))
+	h.addFunnelHealth(context.Background(), "example.com", funnels, result)
+	for i, f := range funnels {
+		if want := (FunnelHealthSummary{Healthy: f.Name == "Cart", StaleSteps: byName[f.Name].StaleSteps}); result[i].Health == nil || *result[i].Health != want {
+			t.Errorf("%s badge = %+v, want %+v", f.Name, result[i].Health, want)
+		}
+	}
+}
+
+func TestDBIntegration_CreateAnnotationLimit(t *testing.T) {
+	db := testDB(t, "003_create_annotations.sql")
+	owner, err := db.CreateUser("owner@example.com", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err := db.CreateProject(owner.ID, "example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent creates, as from parallel CI runs, are counted one after another
+	const limit = 3
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, limited := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.CreateAnnotation(project.ID, "2024-03-01", fmt.Sprintf("Deploy %d", i), "", "ci", limit)
+			var limitErr *LimitError
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+			case errors.As(err, &limitErr) && limitErr.Resource == "annotation" && limitErr.Limit == limit:
+				limited++
+			default:
+				t.Errorf("create %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if created != limit || limited != 10-limit {
+		t.Errorf("created %d, limited %d", created, limited)
+	}
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// domainInvalidatePath is where peers' domain caches take denial changes; see
+// DomainCache.HandleInvalidate
+const domainInvalidatePath = "/api/sync/domains/invalidate"
+
+// DomainPurger drops what is cached of a domain's stats; *stats.Handler implements it
+type DomainPurger interface {
+	ForgetDomain(domain string)
+}
+
+// deniedDomainsDB is the storage domain denials need; *DB implements it
+type deniedDomainsDB interface {
+	DenyDomain(domain string) error
+	AllowDomain(domain string) error
+	DeniedDomains() ([]string, error)
+}
+
+// domainInvalidation is the body pushed to peers when a domain is denied or allowed again
+type domainInvalidation struct {
+	Domain string `json:"domain"`
+	Denied bool   `json:"denied"`
+}
+
+// domainDenials holds the domains of deleted projects, whose events ingestion
+// refuses, in memory backed by Postgres. Changes drop the domain's cached
+// stats and are pushed to the domain caches of peers, which would otherwise
+// accept the domain's events until their next refresh.
+type domainDenials struct {
+	db     deniedDomainsDB
+	purger DomainPurger
+	peers  []string
+	secret string
+	client *http.Client
+
+	mu     sync.RWMutex
+	denied map[string]bool
+}
+
+func newDomainDenials(db deniedDomainsDB) *domainDenials {
+	return &domainDenials{
+		db:     db,
+		client: &http.Client{Timeout: 5 * time.Second},
+		denied: make(map[string]bool),
+	}
+}
+
+// SetStatsCache lets project deletions drop the cached stats of their domain
+func (h *Handler) SetStatsCache(p DomainPurger) {
+	h.denials.purger = p
+}
+
+// SetDomainCachePeers sets the base URLs of the servers whose domain caches
+// are told about deleted and re-registered domains, authenticated with the
+// sync secret
+func (h *Handler) SetDomainCachePeers(urls []string) {
+	h.denials.peers = urls
+	h.denials.secret = h.syncSecret
+}
+
+// ReloadDeniedDomains loads the denied domains from the database
+func (h *Handler) ReloadDeniedDomains() error {
+	return h.denials.reload()
+}
+
+// DomainDenied reports whether events of domain must be refused because its
+// project was deleted
+func (h *Handler) DomainDenied(domain string) bool {
+	return h.denials.isDenied(domain)
+}
+
+func (d *domainDenials) reload() error {
+	domains, err := d.db.DeniedDomains()
+	if err != nil {
+		return err
+	}
+	denied := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		denied[domain] = true
+	}
+	d.mu.Lock()
+	d.denied = denied
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *domainDenials) isDenied(domain string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.denied[domain]
+}
+
+// list returns the denied domains, sorted
+func (d *domainDenials) list() []string {
+	domains := []string{}
+	if d == nil {
+		return domains
+	}
+	d.mu.RLock()
+	for domain := range d.denied {
+		domains = append(domains, domain)
+	}
+	d.mu.RUnlock()
+	sort.Strings(domains)
+	return domains
+}
+
+// deny refuses domain's events from now on, after its project was deleted.
+// The denial applies in memory even when it can't be stored.
+func (d *domainDenials) deny(domain string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.denied[domain] = true
+	d.mu.Unlock()
+	if err := d.db.DenyDomain(domain); err != nil {
+		log.Printf("Deny domain %s: %v", domain, err)
+	}
+	if d.purger != nil {
+		d.purger.ForgetDomain(domain)
+	}
+	d.push(domainInvalidation{Domain: domain, Denied: true})
+}
+
+// allow lifts a denial of domain, which was registered again
+func (d *domainDenials) allow(domain string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	was := d.denied[domain]
+	delete(d.denied, domain)
+	d.mu.Unlock()
+	// Another instance may have denied it since the last reload
+	if err := d.db.AllowDomain(domain); err != nil {
+		log.Printf("Allow domain %s: %v", domain, err)
+	}
+	if was {
+		d.push(domainInvalidation{Domain: domain, Denied: false})
+	}
+}
+
+// push tells the peers about a change in the background; a peer that misses
+// it catches up on its next refresh
+func (d *domainDenials) push(change domainInvalidation) {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return
+	}
+	for _, peer := range d.peers {
+		go func(peer string) {
+			if err := d.send(peer, body); err != nil {
+				log.Printf("Domain cache invalidation of %s at %s: %v", change.Domain, peer, err)
+			}
+		}(peer)
+	}
+}
+
+func (d *domainDenials) send(peer string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, peer+domainInvalidatePath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sync-Secret", d.secret)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+const (
+	// digestSource is the synced_from tag of the projects Shortodella created
+	digestSource = "shortodella"
+	// digestInterval is how often digests are pushed
+	digestInterval = time.Hour
+	// digestPeriod is the range each digest covers
+	digestPeriod = "7d"
+	// digestBatchSize is the number of domains per POST
+	digestBatchSize = 100
+	// digestQueryTimeout bounds the stats queries of one domain
+	digestQueryTimeout = 30 * time.Second
+	// digestSignatureHeader carries the HMAC-SHA256 of digest bodies
+	digestSignatureHeader = "X-Digest-Signature"
+)
+
+// digestBatchDelay spaces consecutive POSTs so a large run doesn't flood the peer
+var digestBatchDelay = 2 * time.Second
+
+// Digest is a domain's traffic over the last 7 days
+type Digest struct {
+	Domain    string `json:"domain"`
+	Pageviews int64  `json:"pageviews"`
+	Visitors  int64  `json:"visitors"`
+	TopSource string `json:"top_source"`
+}
+
+// digestBatch is the body of one digest POST
+type digestBatch struct {
+	GeneratedAt string   `json:"generated_at"`
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	Batch       int      `json:"batch"`
+	Batches     int      `json:"batches"`
+	Digests     []Digest `json:"digests"`
+}
+
+// DigestRun is the outcome of one digest run
+type DigestRun struct {
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at"`
+	Domains    int    `json:"domains"`
+	Sent       int    `json:"sent"`
+	Skipped    int    `json:"skipped"`
+	Failed     int    `json:"failed"`
+	Error      string `json:"error,omitempty"`
+}
+
+// digestDB is the storage the digest job needs; *DB implements it
+type digestDB interface {
+	GetDigestProjects(source string) ([]DigestProject, error)
+	RecordDigestSent(projectID string, zero bool) error
+	stats.AliasSource
+}
+
+// digester pushes a digest of each synced project to the peer
+type digester struct {
+	db     digestDB
+	store  stats.StoreInterface
+	client *http.Client
+	url    string
+	secret string
+}
+
+// run POSTs the digests of every synced project in signed batches. A domain
+// without traffic is sent once and then skipped until it has traffic again.
+// Projects in a batch that failed are retried next run.
+func (d digester) run(ctx context.Context, now time.Time) (DigestRun, error) {
+	result := DigestRun{StartedAt: now.UTC().Format(time.RFC3339)}
+	projects, err := d.db.GetDigestProjects(digestSource)
+	if err != nil {
+		return result, err
+	}
+	result.Domains = len(projects)
+
+	from, to, err := stats.PeriodRange(digestPeriod, now.UTC())
+	if err != nil {
+		return result, err
+	}
+	var pending []DigestProject
+	var digests []Digest
+	for _, p := range projects {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		digest, err := d.digest(ctx, p, from, to)
+		if err != nil {
+			log.Printf("Digest %s: %v", p.Domain, err)
+			result.Failed++
+			result.Error = err.Error()
+			continue
+		}
+		if digest.Pageviews == 0 && p.DigestZero {
+			result.Skipped++
+			continue
+		}
+		pending = append(pending, p)
+		digests = append(digests, digest)
+	}
+
+	batches := (len(digests) + digestBatchSize - 1) / digestBatchSize
+	for i := 0; i < batches; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case <-time.After(digestBatchDelay):
+			}
+		}
+		start, end := i*digestBatchSize, min(len(digests), (i+1)*digestBatchSize)
+		body, err := json.Marshal(digestBatch{
+			GeneratedAt: result.StartedAt,
+			From:        from.Format(time.RFC3339),
+			To:          to.Format(time.RFC3339),
+			Batch:       i + 1,
+			Batches:     batches,
+			Digests:     digests[start:end],
+		})
+		if err != nil {
+			return result, err
+		}
+		if err := retry(ctx, func() error { return d.post(ctx, body) }); err != nil {
+			log.Printf("Digest batch %d/%d: %v", i+1, batches, err)
+			result.Failed += end - start
+			result.Error = fmt.Sprintf("batch %d/%d: %v", i+1, batches, err)
+			continue
+		}
+		for j := start; j < end; j++ {
+			if err := d.db.RecordDigestSent(pending[j].ID, digests[j].Pageviews == 0); err != nil {
+				log.Printf("Digest %s: %v", pending[j].Domain, err)
+			}
+		}
+		result.Sent += end - start
+	}
+	return result, nil
+}
+
+// digest reads one project's numbers, with its privacy mode and aliases applied
+func (d digester) digest(ctx context.Context, p DigestProject, from, to time.Time) (Digest, error) {
+	ctx, cancel := context.WithTimeout(ctx, digestQueryTimeout)
+	defer cancel()
+	digest := Digest{Domain: p.Domain}
+	ctx, err := stats.AliasContext(stats.WithPrivacyMode(stats.WithFilters(ctx, stats.Filters{}), p.PrivacyMode), d.db, p.Domain)
+	if err != nil {
+		return digest, err
+	}
+	overview, err := d.store.GetOverview(ctx, p.Domain, from, to)
+	if err != nil {
+		return digest, err
+	}
+	digest.Pageviews, digest.Visitors = overview.Pageviews, overview.UniqueVisitors
+	if digest.Pageviews == 0 {
+		return digest, nil
+	}
+	sources, err := d.store.GetTopSources(ctx, p.Domain, from, to, 1)
+	if err != nil {
+		return digest, err
+	}
+	if len(sources) > 0 {
+		digest.TopSource = sources[0].Name
+	}
+	return digest, nil
+}
+
+// post sends one signed batch; the signature is X-Digest-Signature: sha256=<hex
+// HMAC of the body> with the service secret
+func (d digester) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(digestSignatureHeader, signExportBody(d.secret, body))
+	return exporter{client: d.client}.do(req)
+}
+
+// digestJob runs the digester periodically or on demand, one run at a time
+type digestJob struct {
+	digester
+	mu      sync.Mutex
+	running bool
+	last    *DigestRun
+}
+
+// start begins a run unless one is in progress, and reports whether it did
+func (j *digestJob) start() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		return false
+	}
+	j.running = true
+	go func() {
+		result, err := j.run(context.Background(), time.Now())
+		result.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+		if err != nil {
+			log.Printf("Digest: %v", err)
+			result.Error = err.Error()
+		}
+		log.Printf("Digest: sent %d, skipped %d, failed %d of %d domains", result.Sent, result.Skipped, result.Failed, result.Domains)
+		j.mu.Lock()
+		j.running, j.last = false, &result
+		j.mu.Unlock()
+	}()
+	return true
+}
+
+// status returns whether a run is in progress and the last finished run
+func (j *digestJob) status() (bool, *DigestRun) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.running, j.last
+}
+
+// StartDigestJob pushes a digest of the projects Shortodella created to url
+// every digestInterval, signed with the service secret. It needs the stats store.
+func (h *Handler) StartDigestJob(url string) {
+	if h.db == nil || h.statsStore == nil || url == "" {
+		return
+	}
+	if h.webhookSecret == "" {
+		log.Printf("Warning: digest disabled, no service secret to sign it with")
+		return
+	}
+	h.digest = &digestJob{digester: digester{db: h.db, store: h.statsStore, url: url, secret: h.webhookSecret,
+		client: &http.Client{Timeout: 30 * time.Second}}}
+	go func() {
+		for {
+			h.digest.start()
+			time.Sleep(digestInterval)
+		}
+	}()
+}
+
+// SyncStatus is the admin view of the sync flow's projects and digest delivery
+type SyncStatus struct {
+	Digest struct {
+		Enabled bool       `json:"enabled"`
+		Running bool       `json:"running"`
+		LastRun *DigestRun `json:"last_run"`
+	} `json:"digest"`
+	Projects []DigestProject `json:"projects"`
+}
+
+// HandleAdminSyncStatus lists the projects Shortodella created with their last
+// digest, and the digest job's last run
+func (h *Handler) HandleAdminSyncStatus(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.getClaimsFromRequest(r)
+	if err != nil || claims.Role != "admin" {
+		writeJSON(w, map[string]string{"error": "Admin access required"}, http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var status SyncStatus
+	status.Projects, err = h.db.GetDigestProjects(digestSource)
+	if err != nil {
+		writeServerError(w, "Failed to get sync status", err)
+		return
+	}
+	if status.Projects == nil {
+		status.Projects = []DigestProject{}
+	}
+	if h.digest != nil {
+		status.Digest.Enabled = true
+		status.Digest.Running, status.Digest.LastRun = h.digest.status()
+	}
+	writeJSON(w, status, http.StatusOK)
+}
+
+// HandleAdminTriggerDigest starts a digest run now; the result shows in the sync status
+func (h *Handler) HandleAdminTriggerDigest(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.getClaimsFromRequest(r)
+	if err != nil || claims.Role != "admin" {
+		writeJSON(w, map[string]string{"error": "Admin access required"}, http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.digest == nil {
+		writeJSON(w, map[string]string{"error": "Digest not configured"}, http.StatusServiceUnavailable)
+		return
+	}
+	if !h.digest.start() {
+		writeJSON(w, map[string]string{"error": "Digest already running"}, http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "started"}, http.StatusAccepted)
+}
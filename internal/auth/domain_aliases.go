@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// DomainAliasRequest adds an alias to a project
+type DomainAliasRequest struct {
+	Hostname string `json:"hostname"`
+}
+
+// HandleGetDomainAliases lists the aliases of the project of ?domain=
+func (h *Handler) HandleGetDomainAliases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	aliases, err := h.db.GetDomainAliases(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get aliases", err)
+		return
+	}
+	writeJSON(w, map[string]any{"aliases": aliases}, http.StatusOK)
+}
+
+// HandleCreateDomainAlias adds an alias to the project of ?domain=, so its
+// reports include the events tracked under that hostname. Hostnames other
+// users' projects track are refused.
+func (h *Handler) HandleCreateDomainAlias(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	var req DomainAliasRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	hostname, err := stats.NormalizeAlias(req.Hostname)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid hostname"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+	if hostname == project.Domain {
+		writeJSON(w, map[string]string{"error": "Hostname is the project's domain"}, http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.AddDomainAlias(project.ID, user.ID, hostname, stats.MaxDomainAliases)
+	if errors.Is(err, errAliasOwnedElsewhere) {
+		writeJSON(w, map[string]string{"error": "Hostname belongs to another user's project"}, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errAliasTaken) {
+		writeJSON(w, map[string]string{"error": "Hostname belongs to another of your projects"}, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeCreateError(w, "Failed to add alias", err)
+		return
+	}
+	writeJSON(w, map[string]string{"hostname": hostname}, http.StatusCreated)
+}
+
+// HandleDeleteDomainAlias removes ?hostname= from the aliases of the project
+// of ?domain=
+func (h *Handler) HandleDeleteDomainAlias(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	hostname := r.URL.Query().Get("hostname")
+	if domain == "" || hostname == "" {
+		writeJSON(w, map[string]string{"error": "Domain and hostname required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if normalized, err := stats.NormalizeAlias(hostname); err == nil {
+		hostname = normalized
+	}
+	err = h.db.DeleteDomainAlias(project.ID, hostname)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, map[string]string{"error": "Alias not found"}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeServerError(w, "Failed to delete alias", err)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "deleted"}, http.StatusOK)
+}
@@ -1,31 +1,69 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
 )
 
-const domainCacheFile = "/tmp/domain_cache.json"
+// DomainCacheConfig says where a domain cache keeps the copy of its domains
+// it falls back to when the stats server is unreachable at start
+type DomainCacheConfig struct {
+	// File defaults to DefaultDomainCacheFile(Instance)
+	File string
+	// Instance tells apart the default files of instances sharing a host
+	Instance string
+	// FileMode defaults to 0600, the domains being the service's customer list
+	FileMode os.FileMode
+}
+
+// DefaultDomainCacheFile is the fallback file of instance in the temp directory
+func DefaultDomainCacheFile(instance string) string {
+	name := "clickresearch_domain_cache"
+	if instance != "" {
+		name += "_" + instance
+	}
+	return filepath.Join(os.TempDir(), name+".json")
+}
 
 // DomainCache caches domains from stats server
 type DomainCache struct {
 	domains    map[string]bool
+	denied     map[string]bool // of deleted projects, refused even while still in domains
+	source     string          // where domains were loaded from, see stats.DomainCacheStatus
+	loadedAt   time.Time
 	mu         sync.RWMutex
 	statsURL   string
 	syncSecret string
+	file       string
+	fileMode   os.FileMode
 	stopCh     chan struct{}
 }
 
 // NewDomainCache creates a new domain cache that syncs from stats server
-func NewDomainCache(statsURL, syncSecret string) *DomainCache {
+func NewDomainCache(statsURL, syncSecret string, cfg DomainCacheConfig) *DomainCache {
+	if cfg.File == "" {
+		cfg.File = DefaultDomainCacheFile(cfg.Instance)
+	}
+	if cfg.FileMode == 0 {
+		cfg.FileMode = 0600
+	}
 	dc := &DomainCache{
 		domains:    make(map[string]bool),
+		denied:     make(map[string]bool),
+		source:     "none",
 		statsURL:   statsURL,
 		syncSecret: syncSecret,
+		file:       cfg.File,
+		fileMode:   cfg.FileMode,
 		stopCh:     make(chan struct{}),
 	}
 
@@ -48,7 +86,49 @@ func NewDomainCache(statsURL, syncSecret string) *DomainCache {
 func (dc *DomainCache) DomainExists(domain string) bool {
 	dc.mu.RLock()
 	defer dc.mu.RUnlock()
-	return dc.domains[domain]
+	return dc.domains[domain] && !dc.denied[domain]
+}
+
+// Status reports the cache's size and age for the debug endpoint
+func (dc *DomainCache) Status() stats.DomainCacheStatus {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+	st := stats.DomainCacheStatus{Domains: len(dc.domains), Denied: len(dc.denied), Source: dc.source, File: dc.file}
+	if !dc.loadedAt.IsZero() {
+		st.AgeSeconds = time.Since(dc.loadedAt).Seconds()
+	}
+	return st
+}
+
+// HandleInvalidate takes the denials and re-registrations the stats server
+// pushes on project deletion and creation, so they apply before the next refresh
+func (dc *DomainCache) HandleInvalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	secret := r.Header.Get("X-Sync-Secret")
+	if dc.syncSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(dc.syncSecret)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var change domainInvalidation
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil || change.Domain == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	dc.mu.Lock()
+	if change.Denied {
+		delete(dc.domains, change.Domain)
+		dc.denied[change.Domain] = true
+	} else {
+		dc.domains[change.Domain] = true
+		delete(dc.denied, change.Domain)
+	}
+	dc.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
 }
 
 // Stop stops background refresh
@@ -72,11 +152,12 @@ func (dc *DomainCache) refresh() error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return err
+		return fmt.Errorf("stats server returned %s", resp.Status)
 	}
 
 	var result struct {
 		Domains []string `json:"domains"`
+		Denied  []string `json:"denied"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return err
@@ -88,6 +169,11 @@ func (dc *DomainCache) refresh() error {
 	for _, d := range result.Domains {
 		dc.domains[d] = true
 	}
+	dc.denied = make(map[string]bool)
+	for _, d := range result.Denied {
+		dc.denied[d] = true
+	}
+	dc.source, dc.loadedAt = "stats", time.Now()
 	dc.mu.Unlock()
 
 	// Save to file for fallback
@@ -97,16 +183,40 @@ func (dc *DomainCache) refresh() error {
 	return nil
 }
 
+// saveToFile replaces the fallback file, so a crash mid-write doesn't leave
+// a partial one and the file never has other permissions than dc.fileMode
 func (dc *DomainCache) saveToFile(domains []string) {
 	data, err := json.Marshal(domains)
 	if err != nil {
 		return
 	}
-	os.WriteFile(domainCacheFile, data, 0644)
+	tmp, err := os.CreateTemp(filepath.Dir(dc.file), filepath.Base(dc.file)+".*")
+	if err != nil {
+		log.Printf("Domain cache: save %s: %v", dc.file, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), dc.fileMode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dc.file)
+	}
+	if err != nil {
+		log.Printf("Domain cache: save %s: %v", dc.file, err)
+	}
 }
 
 func (dc *DomainCache) loadFromFile() error {
-	data, err := os.ReadFile(domainCacheFile)
+	info, err := os.Stat(dc.file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(dc.file)
 	if err != nil {
 		return err
 	}
@@ -121,6 +231,7 @@ func (dc *DomainCache) loadFromFile() error {
 	for _, d := range domains {
 		dc.domains[d] = true
 	}
+	dc.source, dc.loadedAt = "file", info.ModTime()
 	dc.mu.Unlock()
 
 	log.Printf("Domain cache loaded from file: %d domains", len(domains))
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// domainMismatchLimit caps the offending hostnames listed
+const domainMismatchLimit = 20
+
+// DomainMismatches are the hosts other than a project's domain its events came
+// from, over the last 7 days
+type DomainMismatches struct {
+	stats.DomainMatch
+	From      string               `json:"from"`
+	To        string               `json:"to"`
+	Events    int64                `json:"events"`
+	Hostnames []stats.HostnameItem `json:"hostnames"`
+}
+
+// HandleDomainMismatches lists the top hostnames a project's snippet reported
+// events from that don't match its domain. With strict_domain on these events
+// are already left out of the project's reports.
+func (h *Handler) HandleDomainMismatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	if h.statsStore == nil {
+		writeJSON(w, map[string]string{"error": "Stats not available"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	match, err := h.db.GetProjectDomainMatch(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get domain settings", err)
+		return
+	}
+
+	from, to, err := stats.PeriodRange("7d", time.Now().UTC())
+	if err != nil {
+		writeServerError(w, "Failed to get domain mismatches", err)
+		return
+	}
+	// Only the events stored under the domain itself: the hosts found there
+	// are what the project could add as aliases
+	hostnames, err := h.statsStore.GetDomainMismatches(r.Context(), domain, match.MatchSubdomains, from, to, domainMismatchLimit)
+	if errors.Is(err, stats.ErrNotReady) {
+		writeJSON(w, map[string]string{"error": "Stats not available"}, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		writeServerError(w, "Failed to get domain mismatches", err)
+		return
+	}
+
+	result := DomainMismatches{
+		DomainMatch: match,
+		From:        from.Format(time.RFC3339),
+		To:          to.Format(time.RFC3339),
+		Hostnames:   hostnames,
+	}
+	if result.Hostnames == nil {
+		result.Hostnames = []stats.HostnameItem{}
+	}
+	for _, item := range hostnames {
+		result.Events += item.Events
+	}
+	writeJSON(w, result, http.StatusOK)
+}
+
+// HandleUpdateDomainSettings sets whether a project's reports drop events from
+// other hosts and whether its subdomains count as its domain
+func (h *Handler) HandleUpdateDomainSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	match, err := h.db.GetProjectDomainMatch(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to update settings", err)
+		return
+	}
+	// Fields left out of the request keep their current value
+	if err := json.NewDecoder(r.Body).Decode(&match); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetDomainMatch(project.ID, match); err != nil {
+		writeServerError(w, "Failed to update settings", err)
+		return
+	}
+
+	writeJSON(w, match, http.StatusOK)
+}
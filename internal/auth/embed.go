@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+const (
+	// embedAudience marks embed tokens so they are never accepted as sessions
+	embedAudience = "clickresearch-embed"
+	// defaultEmbedTTL and maxEmbedTTL bound how long embed tokens last
+	defaultEmbedTTL = 24 * time.Hour
+	maxEmbedTTL     = 7 * 24 * time.Hour
+)
+
+// EmbedClaims scope an embed token to reads of some stats endpoints of one project
+type EmbedClaims struct {
+	Domain    string   `json:"domain"`
+	Endpoints []string `json:"endpoints"`
+	// Key fingerprints the project's embed secret; rotating it revokes the token
+	Key string `json:"key"`
+	jwt.RegisteredClaims
+}
+
+// EmbedTokenRequest asks for a token to embed charts of a project
+type EmbedTokenRequest struct {
+	Endpoints        []string `json:"endpoints"`
+	ExpiresInSeconds int      `json:"expires_in_seconds,omitempty"` // default 1 day, at most 7
+}
+
+// EmbedTokenResponse is a new embed token with what it grants
+type EmbedTokenResponse struct {
+	Token     string    `json:"token"`
+	Domain    string    `json:"domain"`
+	Endpoints []string  `json:"endpoints"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// embedSecretDB is the storage embed tokens need; *DB implements it
+type embedSecretDB interface {
+	GetProjectByID(id string) (*Project, error)
+	GetEmbedSecret(projectID string) (string, error)
+}
+
+// embedKey fingerprints a project's embed secret, so tokens carry a version
+// of it without revealing it
+func (h *Handler) embedKey(secret string) string {
+	mac := hmac.New(sha256.New, h.jwtSecret)
+	mac.Write([]byte("embed:" + secret))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// validate checks the requested endpoints and returns the token lifetime
+func (req EmbedTokenRequest) validate() (time.Duration, error) {
+	if len(req.Endpoints) == 0 {
+		return 0, errors.New("endpoints required")
+	}
+	for _, e := range req.Endpoints {
+		if !slices.Contains(stats.EmbedEndpoints, e) {
+			return 0, fmt.Errorf("endpoint %q cannot be embedded", e)
+		}
+	}
+	ttl := time.Duration(req.ExpiresInSeconds) * time.Second
+	switch {
+	case req.ExpiresInSeconds == 0:
+		ttl = defaultEmbedTTL
+	case req.ExpiresInSeconds < 0 || ttl > maxEmbedTTL:
+		return 0, fmt.Errorf("expires_in_seconds must be between 1 and %d", int(maxEmbedTTL.Seconds()))
+	}
+	return ttl, nil
+}
+
+// generateEmbedToken signs an embed token for project
+func (h *Handler) generateEmbedToken(project *Project, secret string, endpoints []string, expires time.Time) (string, error) {
+	claims := EmbedClaims{
+		Domain:    project.Domain,
+		Endpoints: endpoints,
+		Key:       h.embedKey(secret),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   project.ID,
+			Audience:  jwt.ClaimStrings{embedAudience},
+			ExpiresAt: jwt.NewNumericDate(expires),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(h.jwtSecret)
+}
+
+// embedScope verifies an embed token against the current embed secret of its project
+func (h *Handler) embedScope(db embedSecretDB, token string) (stats.EmbedScope, error) {
+	var claims EmbedClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		return h.jwtSecret, nil
+	}, jwt.WithAudience(embedAudience), jwt.WithExpirationRequired(), jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil {
+		return stats.EmbedScope{}, stats.ErrInvalidEmbedToken
+	}
+
+	project, err := db.GetProjectByID(claims.Subject)
+	if err == sql.ErrNoRows {
+		return stats.EmbedScope{}, stats.ErrInvalidEmbedToken
+	} else if err != nil {
+		return stats.EmbedScope{}, err
+	}
+	secret, err := db.GetEmbedSecret(project.ID)
+	if err != nil {
+		return stats.EmbedScope{}, err
+	}
+	if project.Domain != claims.Domain || !hmac.Equal([]byte(claims.Key), []byte(h.embedKey(secret))) {
+		return stats.EmbedScope{}, stats.ErrInvalidEmbedToken
+	}
+	return stats.EmbedScope{Domain: claims.Domain, Endpoints: claims.Endpoints}, nil
+}
+
+// EmbedScope implements stats.EmbedSource
+func (h *Handler) EmbedScope(token string) (stats.EmbedScope, error) {
+	return h.embedScope(h.db, token)
+}
+
+// HandleCreateEmbedToken issues a short-lived token that lets an iframe read
+// some stats endpoints of a project without a session
+func (h *Handler) HandleCreateEmbedToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	var req EmbedTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	ttl, err := req.validate()
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	secret, err := h.db.GetEmbedSecret(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to create embed token", err)
+		return
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := h.generateEmbedToken(project, secret, req.Endpoints, expires)
+	if err != nil {
+		writeServerError(w, "Failed to create embed token", err)
+		return
+	}
+
+	writeJSON(w, EmbedTokenResponse{Token: token, Domain: project.Domain, Endpoints: req.Endpoints, ExpiresAt: expires.UTC()}, http.StatusCreated)
+}
+
+// HandleRotateEmbedSecret revokes every embed token of a project
+func (h *Handler) HandleRotateEmbedSecret(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.SetEmbedSecret(project.ID, generateAPIKey()); err != nil {
+		writeServerError(w, "Failed to revoke embed tokens", err)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "rotated"}, http.StatusOK)
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// SetTombstones lets erasures take effect on the stores' next loads
+func (h *Handler) SetTombstones(tombstones *stats.Tombstones) {
+	h.tombstones = tombstones
+}
+
+// ReloadTombstones loads every erased visitor into the tombstones
+func (h *Handler) ReloadTombstones() error {
+	if h.tombstones == nil {
+		return nil
+	}
+	visitors, err := h.db.TombstonedVisitors()
+	if err != nil {
+		return err
+	}
+	h.tombstones.Set(visitors)
+	return nil
+}
+
+// EraseVisitorResponse reports an erasure
+type EraseVisitorResponse struct {
+	Domain       string `json:"domain"`
+	VisitorID    string `json:"visitor_id"`
+	EventsErased int64  `json:"events_erased"`
+}
+
+// HandleEraseVisitor deletes a visitor's events from a project's analytics,
+// its domain aliases included (GDPR erasure), for its owner or an admin. The visitor is tombstoned first,
+// so later loads from S3 leave their events out too. Erasing again is safe
+// and deletes whatever was loaded since.
+func (h *Handler) HandleEraseVisitor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	if h.statsStore == nil {
+		writeJSON(w, map[string]string{"error": "Stats not available"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		VisitorID string `json:"visitor_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	req.VisitorID = strings.TrimSpace(req.VisitorID)
+	if req.VisitorID == "" || len(req.VisitorID) > stats.MaxVisitorIDLen {
+		writeJSON(w, map[string]string{"error": fmt.Sprintf("visitor_id must be 1 to %d characters", stats.MaxVisitorIDLen)}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain; admins may erase from any
+	if user.Role != "admin" {
+		project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+		if err != nil {
+			writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+			return
+		}
+		domain = project.Domain
+	}
+
+	// Reports merge the project's aliases, so the visitor goes from all of them
+	ctx, err := stats.AliasContext(r.Context(), h.db, domain)
+	if err != nil {
+		writeServerError(w, "Failed to erase visitor", err)
+		return
+	}
+	for _, d := range stats.AliasDomains(ctx, domain) {
+		if err := h.db.AddVisitorTombstone(d, req.VisitorID, user.Email); err != nil {
+			writeServerError(w, "Failed to erase visitor", err)
+			return
+		}
+		if h.tombstones != nil {
+			h.tombstones.Add(d, req.VisitorID)
+		}
+	}
+	n, err := h.statsStore.EraseVisitor(ctx, domain, req.VisitorID)
+	if err != nil {
+		writeServerError(w, "Failed to erase visitor", err)
+		return
+	}
+	if err := h.db.AddTombstoneEvents(domain, req.VisitorID, n); err != nil {
+		log.Printf("Erasure of %s on %s: recording %d events: %v", req.VisitorID, domain, n, err)
+	}
+
+	writeJSON(w, EraseVisitorResponse{Domain: domain, VisitorID: req.VisitorID, EventsErased: n}, http.StatusOK)
+}
+
+// HandleAdminTombstones lists every erased visitor (admin only). They stay
+// outstanding for as long as the parquet files in S3 hold their events, which
+// only loads leave out.
+func (h *Handler) HandleAdminTombstones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.isAdmin(r) {
+		writeJSON(w, map[string]string{"error": "Admin access required"}, http.StatusForbidden)
+		return
+	}
+
+	tombstones, err := h.db.GetVisitorTombstones()
+	if err != nil {
+		writeServerError(w, "Failed to get tombstones", err)
+		return
+	}
+	if tombstones == nil {
+		tombstones = []VisitorTombstone{}
+	}
+	writeJSON(w, tombstones, http.StatusOK)
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// SetEventNameRules lets event name settings take effect without a restart
+func (h *Handler) SetEventNameRules(rules *stats.EventNameRules) {
+	h.eventNames = rules
+}
+
+// ReloadEventNameRules loads every project's event name protections into the rules
+func (h *Handler) ReloadEventNameRules() error {
+	if h.eventNames == nil {
+		return nil
+	}
+	allow, guard, err := h.db.EventNameRules()
+	if err != nil {
+		return err
+	}
+	h.eventNames.Set(allow, guard)
+	return nil
+}
+
+// normalizeEventNameSettings validates and dedupes an allow-list update
+func normalizeEventNameSettings(settings EventNameSettings) (EventNameSettings, error) {
+	seen := make(map[string]bool, len(settings.Names))
+	names := []string{}
+	for _, n := range settings.Names {
+		name, err := stats.NormalizeEventName(n)
+		if err != nil {
+			return settings, err
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) > stats.MaxAllowedEventNames {
+		return settings, fmt.Errorf("at most %d event names are allowed", stats.MaxAllowedEventNames)
+	}
+	if settings.EnforceAllowList && len(names) == 0 {
+		return settings, fmt.Errorf("names required to enforce the allow-list")
+	}
+	settings.Names = names
+	return settings, nil
+}
+
+// HandleProjectEventNames returns (GET) or replaces (PUT) a project's event name
+// allow-list and protections. Changes apply from the next data load.
+func (h *Handler) HandleProjectEventNames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method != http.MethodGet && !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		settings, err := h.db.GetEventNameSettings(project.ID)
+		if err != nil {
+			writeServerError(w, "Failed to get settings", err)
+			return
+		}
+		writeJSON(w, settings, http.StatusOK)
+		return
+	}
+
+	var req EventNameSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	settings, err := normalizeEventNameSettings(req)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetEventNameSettings(project.ID, settings); err != nil {
+		writeServerError(w, "Failed to update settings", err)
+		return
+	}
+	if err := h.ReloadEventNameRules(); err != nil {
+		log.Printf("Failed to reload event name rules: %v", err)
+	}
+
+	writeJSON(w, settings, http.StatusOK)
+}
@@ -0,0 +1,585 @@
+package auth
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/secretbox"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+const (
+	// exportRunAt is the UTC time of day of the nightly export
+	exportRunAt = 45 * time.Minute
+	// exportBackfillDays is how many missed days a destination catches up on per run
+	exportBackfillDays = 3
+	// exportBatchSize is the number of events per webhook POST
+	exportBatchSize = 5000
+	// exportAttempts is how often one delivery is tried within a run
+	exportAttempts = 3
+	// exportAlertAfter is how many consecutive failed runs trigger an alert
+	exportAlertAfter = 3
+	// exportTimeout bounds one destination's run
+	exportTimeout = 30 * time.Minute
+	// maxExportDestinations caps destinations per project
+	maxExportDestinations = 5
+	// exportSignatureHeader carries the HMAC-SHA256 of webhook bodies
+	exportSignatureHeader = "X-Export-Signature"
+)
+
+// exportRetryDelay is the first backoff between delivery attempts; it doubles after each
+var exportRetryDelay = 5 * time.Second
+
+// exportMaxEvents caps the events of a day a destination can be sent; days
+// with more fail instead of going out cut short
+var exportMaxEvents = 1_000_000
+
+// errExportTooLarge stops reading a day past exportMaxEvents events
+var errExportTooLarge = errors.New("too many events to export")
+
+// SetExportSecretBox enables export destinations, sealing their credentials with box
+func (h *Handler) SetExportSecretBox(box *secretbox.Box) {
+	h.exportBox = box
+}
+
+// exportCredentials are sealed before storage and only opened by the export job
+type exportCredentials struct {
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	// Secret signs webhook bodies
+	Secret string `json:"secret,omitempty"`
+}
+
+// CreateExportRequest adds an S3 or webhook export destination
+type CreateExportRequest struct {
+	Kind            string `json:"kind"`
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	Endpoint        string `json:"endpoint"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	URL             string `json:"url"`
+	Secret          string `json:"secret"`
+}
+
+// validate checks req and returns its destination and credentials
+func (req CreateExportRequest) validate() (ExportDestination, exportCredentials, error) {
+	d := ExportDestination{Kind: req.Kind}
+	switch req.Kind {
+	case "s3":
+		if req.Bucket == "" || req.AccessKeyID == "" || req.SecretAccessKey == "" {
+			return d, exportCredentials{}, errors.New("bucket, access_key_id and secret_access_key required")
+		}
+		if req.Region == "" {
+			req.Region = "us-east-1"
+		}
+		if strings.HasPrefix(req.Endpoint, "http://") {
+			return d, exportCredentials{}, errors.New("endpoint must use https")
+		}
+		d.Bucket, d.Region, d.Prefix = req.Bucket, req.Region, strings.TrimPrefix(req.Prefix, "/")
+		d.Endpoint = strings.TrimSuffix(strings.TrimPrefix(req.Endpoint, "https://"), "/")
+		return d, exportCredentials{AccessKeyID: req.AccessKeyID, SecretAccessKey: req.SecretAccessKey}, nil
+	case "webhook":
+		u, err := url.Parse(req.URL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return d, exportCredentials{}, errors.New("url must be an https URL")
+		}
+		if len(req.Secret) < 16 {
+			return d, exportCredentials{}, errors.New("secret must be at least 16 characters")
+		}
+		d.URL = req.URL
+		return d, exportCredentials{Secret: req.Secret}, nil
+	}
+	return d, exportCredentials{}, errors.New("kind must be s3 or webhook")
+}
+
+// exportDB is the storage the export job needs; *DB implements it
+type exportDB interface {
+	GetAllExportDestinations() ([]ExportDestination, error)
+	RecordExportSuccess(id, date string) error
+	RecordExportFailure(id, errMsg string) (int, error)
+	stats.AliasSource
+}
+
+// exporter pushes each destination's missing days of events
+type exporter struct {
+	db     exportDB
+	store  stats.StoreInterface
+	box    *secretbox.Box
+	client *http.Client
+	mailer Mailer
+}
+
+// run exports the completed UTC days each destination is missing, up to
+// exportBackfillDays of them, stopping at a destination's first failed day.
+// Returns the number of days exported.
+func (e exporter) run(ctx context.Context, now time.Time) (int, error) {
+	dests, err := e.db.GetAllExportDestinations()
+	if err != nil {
+		return 0, err
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	exported := 0
+	for _, d := range dests {
+		if err := ctx.Err(); err != nil {
+			return exported, err
+		}
+		day := today.AddDate(0, 0, -exportBackfillDays)
+		if d.LastExportedDate != nil {
+			if last, err := time.Parse("2006-01-02", *d.LastExportedDate); err == nil && !last.Before(day) {
+				day = last.AddDate(0, 0, 1)
+			}
+		}
+		for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+			dctx, cancel := context.WithTimeout(ctx, exportTimeout)
+			err := e.exportDay(dctx, d, day)
+			cancel()
+			date := day.Format("2006-01-02")
+			if err != nil {
+				e.recordFailure(d, date, err)
+				break
+			}
+			if err := e.db.RecordExportSuccess(d.ID, date); err != nil {
+				log.Printf("Export %s: %v", d.ID, err)
+				break
+			}
+			exported++
+		}
+	}
+	return exported, nil
+}
+
+func (e exporter) recordFailure(d ExportDestination, date string, err error) {
+	log.Printf("Export %s (%s) of %s: %v", d.ID, d.Domain, date, err)
+	failures, dbErr := e.db.RecordExportFailure(d.ID, err.Error())
+	if dbErr != nil {
+		log.Printf("Export %s: %v", d.ID, dbErr)
+		return
+	}
+	if failures == exportAlertAfter {
+		log.Printf("Alert: export %s (%s) to %s failed %d runs in a row: %v", d.ID, d.Domain, d.Kind, failures, err)
+		if e.mailer == nil || d.OwnerEmail == "" {
+			return
+		}
+		body := fmt.Sprintf("The %s export of %s has failed %d nights in a row: %v", d.Kind, d.Domain, failures, err)
+		if err := e.mailer.Send(d.OwnerEmail, "Event export failing", body); err != nil {
+			log.Printf("Mail to %s: %v", d.OwnerEmail, err)
+		}
+	}
+}
+
+// exportDay delivers one day of a destination's events, retrying with backoff
+func (e exporter) exportDay(ctx context.Context, d ExportDestination, day time.Time) error {
+	sealed, err := e.box.Open(d.Credentials)
+	if err != nil {
+		return err
+	}
+	var creds exportCredentials
+	if err := json.Unmarshal(sealed, &creds); err != nil {
+		return err
+	}
+
+	qctx, err := stats.AliasContext(stats.WithFilters(ctx, stats.Filters{}), e.db, d.Domain)
+	if err != nil {
+		return err
+	}
+
+	// Events are kept encoded as they are read: webhooks send them as they
+	// are, S3 gets them gzipped
+	date := day.Format("2006-01-02")
+	var events []json.RawMessage
+	var ndjson bytes.Buffer
+	zw := gzip.NewWriter(&ndjson)
+	n := 0
+	err = e.store.StreamRecentEvents(qctx, d.Domain, day, day.AddDate(0, 0, 1), exportMaxEvents+1, stats.AllEventFields,
+		func(ev stats.EventItem) error {
+			if n++; n > exportMaxEvents {
+				return errExportTooLarge
+			}
+			line, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			if d.Kind == "webhook" {
+				events = append(events, line)
+				return nil
+			}
+			_, err = zw.Write(append(line, '\n'))
+			return err
+		})
+	if errors.Is(err, errExportTooLarge) {
+		return fmt.Errorf("%s has more than %d events on %s; exports are capped at that many", d.Domain, exportMaxEvents, date)
+	}
+	if err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return retry(ctx, func() error {
+		if d.Kind == "webhook" {
+			return e.postWebhook(ctx, d, creds, date, events)
+		}
+		return e.putS3(ctx, d, creds, date, ndjson.Bytes())
+	})
+}
+
+// retry runs fn up to exportAttempts times, doubling the delay between attempts
+func retry(ctx context.Context, fn func() error) error {
+	delay := exportRetryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt == exportAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// exportBatch is the body of one webhook POST
+type exportBatch struct {
+	Domain  string `json:"domain"`
+	Date    string `json:"date"`
+	Batch   int    `json:"batch"`
+	Batches int    `json:"batches"`
+	// Events are stats.EventItem values
+	Events []json.RawMessage `json:"events"`
+}
+
+// postWebhook POSTs events in batches of exportBatchSize, each signed with
+// X-Export-Signature: sha256=<hex HMAC of the body>. Days without events send
+// one empty batch so receivers can tell them from missed days.
+func (e exporter) postWebhook(ctx context.Context, d ExportDestination, creds exportCredentials, date string, events []json.RawMessage) error {
+	batches := max(1, (len(events)+exportBatchSize-1)/exportBatchSize)
+	for i := 0; i < batches; i++ {
+		end := min(len(events), (i+1)*exportBatchSize)
+		body, err := json.Marshal(exportBatch{
+			Domain: d.Domain, Date: date, Batch: i + 1, Batches: batches,
+			Events: append([]json.RawMessage{}, events[min(end, i*exportBatchSize):end]...),
+		})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(exportSignatureHeader, signExportBody(creds.Secret, body))
+		if err := e.do(req); err != nil {
+			return fmt.Errorf("batch %d/%d: %w", i+1, batches, err)
+		}
+	}
+	return nil
+}
+
+// signExportBody returns the X-Export-Signature value of body
+func signExportBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// putS3 uploads ndjson, the day's gzipped NDJSON, to <prefix><domain>/<date>.ndjson.gz
+func (e exporter) putS3(ctx context.Context, d ExportDestination, creds exportCredentials, date string, ndjson []byte) error {
+
+	endpoint := d.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("s3.%s.amazonaws.com", d.Region)
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	key := fmt.Sprintf("%s%s/%s.ndjson.gz", d.Prefix, d.Domain, date)
+	objectURL := fmt.Sprintf("%s/%s/%s", endpoint, s3URIEncode(d.Bucket), s3URIEncode(key))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, bytes.NewReader(ndjson))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	signS3Request(req, ndjson, d.Region, creds, time.Now().UTC())
+	return e.do(req)
+}
+
+// do sends req and fails on non-2xx responses
+func (e exporter) do(req *http.Request) error {
+	client := e.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// s3URIEncode percent-encodes a path as SigV4 expects, keeping slashes
+func s3URIEncode(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signS3Request adds AWS Signature Version 4 headers to a path-style S3 request
+func signS3Request(req *http.Request, body []byte, region string, creds exportCredentials, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signed := []string{"content-encoding", "content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		headers.String(),
+		strings.Join(signed, ";"),
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, strings.Join(signed, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// nextExportRun returns the next nightly export time after now
+func nextExportRun(now time.Time) time.Time {
+	next := now.UTC().Truncate(24 * time.Hour).Add(exportRunAt)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// StartExportJob runs the nightly export of every destination; it needs the
+// stats store and an export key
+func (h *Handler) StartExportJob() {
+	if h.db == nil || h.statsStore == nil || h.exportBox == nil {
+		return
+	}
+	e := exporter{db: h.db, store: h.statsStore, box: h.exportBox, mailer: h.mailer,
+		client: &http.Client{Timeout: 2 * time.Minute}}
+	go func() {
+		for {
+			time.Sleep(time.Until(nextExportRun(time.Now())))
+			start := time.Now()
+			exported, err := e.run(context.Background(), start)
+			if err != nil {
+				log.Printf("Export: %v", err)
+			}
+			log.Printf("Export: exported %d destination-days in %v", exported, time.Since(start))
+		}
+	}()
+}
+
+// HandleGetExports lists a project's export destinations with their last run;
+// credentials are never included
+func (h *Handler) HandleGetExports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	dests, err := h.db.GetExportDestinationsByProjectID(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get exports", err)
+		return
+	}
+	if dests == nil {
+		dests = []ExportDestination{}
+	}
+	writeJSON(w, dests, http.StatusOK)
+}
+
+// HandleCreateExport adds an export destination to a project
+func (h *Handler) HandleCreateExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	if h.exportBox == nil {
+		writeJSON(w, map[string]string{"error": "Exports are not configured"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	var req CreateExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	dest, creds, err := req.validate()
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	existing, err := h.db.GetExportDestinationsByProjectID(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to create export", err)
+		return
+	}
+	if len(existing) >= maxExportDestinations {
+		writeJSON(w, map[string]string{"error": fmt.Sprintf("Export limit of %d reached", maxExportDestinations)}, http.StatusForbidden)
+		return
+	}
+
+	plain, err := json.Marshal(creds)
+	if err != nil {
+		writeServerError(w, "Failed to create export", err)
+		return
+	}
+	if dest.Credentials, err = h.exportBox.Seal(plain); err != nil {
+		writeServerError(w, "Failed to create export", err)
+		return
+	}
+	dest.ProjectID = project.ID
+
+	created, err := h.db.CreateExportDestination(dest)
+	if err != nil {
+		writeServerError(w, "Failed to create export", err)
+		return
+	}
+	writeJSON(w, created, http.StatusCreated)
+}
+
+// HandleDeleteExport removes an export destination
+func (h *Handler) HandleDeleteExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	id := r.URL.Query().Get("id")
+	if domain == "" || id == "" {
+		writeJSON(w, map[string]string{"error": "Domain and export ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.DeleteExportDestination(id, project.ID); err != nil {
+		writeServerError(w, "Failed to delete export", err)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "deleted"}, http.StatusOK)
+}
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+const (
+	// funnelHealthPeriod is how far back a step must have matched an event
+	funnelHealthPeriod = "30d"
+	// funnelHealthCandidates is how many of the top pages are searched for
+	// replacements of a stale pageview step
+	funnelHealthCandidates = 200
+	maxStepSuggestions     = 3
+	// minSuggestionScore is the similarity a current page needs to be suggested
+	minSuggestionScore = 0.5
+)
+
+// FunnelStepHealth is how many events a saved funnel step matched
+type FunnelStepHealth struct {
+	// Index is the step's position in the funnel's steps, exclusions included
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Matches int64  `json:"matches"`
+	Stale   bool   `json:"stale"`
+	// Suggestions are current pathnames similar to a stale pageview step
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// FunnelHealth reports the steps of a saved funnel that no longer match any
+// events, typically after the site's URLs changed. Exclusions aren't checked.
+type FunnelHealth struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Healthy    bool               `json:"healthy"`
+	StaleSteps int                `json:"stale_steps"`
+	Steps      []FunnelStepHealth `json:"steps"`
+}
+
+// FunnelHealthSummary is the badge of a funnel in the funnel list
+type FunnelHealthSummary struct {
+	Healthy    bool `json:"healthy"`
+	StaleSteps int  `json:"stale_steps"`
+}
+
+// funnelHealth checks the steps of funnels against the events of the last
+// funnelHealthPeriod, counting all steps in one store read
+func (h *Handler) funnelHealth(ctx context.Context, domain string, funnels []Funnel) ([]FunnelHealth, error) {
+	privacy, err := h.db.PrivacyMode(domain)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err = stats.AliasContext(stats.WithPrivacyMode(stats.WithFilters(ctx, stats.Filters{}), privacy), h.db, domain)
+	if err != nil {
+		return nil, err
+	}
+	from, to, err := stats.PeriodRange(funnelHealthPeriod, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	// Funnels often share steps, so each distinct step is counted once
+	index := make(map[funnel.Step]int)
+	var steps []funnel.Step
+	parsed := make([][]funnel.Step, len(funnels))
+	for i, f := range funnels {
+		parsed[i], _ = funnel.UnmarshalSteps(f.Steps)
+		for _, step := range parsed[i] {
+			key := stepKey(step)
+			if _, ok := index[key]; !ok && !step.Exclude {
+				index[key] = len(steps)
+				steps = append(steps, key)
+			}
+		}
+	}
+	matches, err := h.statsStore.GetStepMatchCounts(ctx, domain, from, to, steps)
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []string
+	result := make([]FunnelHealth, len(funnels))
+	for i, f := range funnels {
+		health := FunnelHealth{ID: f.ID, Name: f.Name, Healthy: true, Steps: []FunnelStepHealth{}}
+		for j, step := range parsed[i] {
+			if step.Exclude {
+				continue
+			}
+			sh := FunnelStepHealth{Index: j, Type: step.Type, Value: step.Value, Matches: matches[index[stepKey(step)]]}
+			if sh.Matches == 0 {
+				sh.Stale = true
+				health.Healthy = false
+				health.StaleSteps++
+				if step.Type == "pageview" {
+					if pages == nil {
+						if pages, err = h.currentPages(ctx, domain, from, to); err != nil {
+							return nil, err
+						}
+					}
+					sh.Suggestions = suggestPaths(step.Value, pages)
+				}
+			}
+			health.Steps = append(health.Steps, sh)
+		}
+		result[i] = health
+	}
+	return result, nil
+}
+
+// addFunnelHealth sets the health badge of the responses of funnels. The badge
+// is best effort: without stats the funnels are listed without it.
+func (h *Handler) addFunnelHealth(ctx context.Context, domain string, funnels []Funnel, result []FunnelResponse) {
+	if h.statsStore == nil {
+		return
+	}
+	health, err := h.funnelHealth(ctx, domain, funnels)
+	if err != nil {
+		log.Printf("Funnel health for %s: %v", domain, err)
+		return
+	}
+	for i := range health {
+		result[i].Health = &FunnelHealthSummary{Healthy: health[i].Healthy, StaleSteps: health[i].StaleSteps}
+	}
+}
+
+// stepKey is step as GetStepMatchCounts tells it apart from other steps
+func stepKey(step funnel.Step) funnel.Step {
+	return funnel.Step{Type: step.Type, Value: step.Value}
+}
+
+// currentPages returns the normalized pathnames of the top pages, never nil
+func (h *Handler) currentPages(ctx context.Context, domain string, from, to time.Time) ([]string, error) {
+	items, err := h.statsStore.GetTopPages(ctx, domain, from, to, funnelHealthCandidates)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	pages := make([]string, 0, len(items))
+	for _, item := range items {
+		path := funnel.NormalizePath(item.Name)
+		if !seen[path] {
+			seen[path] = true
+			pages = append(pages, path)
+		}
+	}
+	return pages, nil
+}
+
+// suggestPaths returns up to maxStepSuggestions of pages most similar to the
+// pageview step value, most similar first; pages keep their traffic order
+// among equally similar ones. A wildcard step suggests paths under a similar
+// prefix, as a replacement wildcard.
+func suggestPaths(value string, pages []string) []string {
+	prefix, wildcard := strings.CutSuffix(value, "*")
+	type candidate struct {
+		path  string
+		score float64
+	}
+	var candidates []candidate
+	seen := make(map[string]bool)
+	for _, page := range pages {
+		path := page
+		if wildcard {
+			// Compare the page's parent directory with the dead prefix
+			i := strings.LastIndex(strings.TrimSuffix(page, "/"), "/")
+			if i < 0 {
+				continue
+			}
+			path = page[:i+1] + "*"
+		}
+		if path == value || path == "/" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		if score := pathSimilarity(prefix, strings.TrimSuffix(path, "*")); score >= minSuggestionScore {
+			candidates = append(candidates, candidate{path, score})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+
+	var suggestions []string
+	for _, c := range candidates[:min(len(candidates), maxStepSuggestions)] {
+		suggestions = append(suggestions, c.path)
+	}
+	return suggestions
+}
+
+// pathSimilarity scores how alike two paths are from 0 to 1, as the better of
+// their edit distance relative to the longer path and the share of a that
+// b starts with
+func pathSimilarity(a, b string) float64 {
+	longest := max(len(a), len(b))
+	if longest == 0 {
+		return 1
+	}
+	edit := 1 - float64(levenshtein(a, b))/float64(longest)
+
+	common := 0
+	for common < len(a) && common < len(b) && a[common] == b[common] {
+		common++
+	}
+	// A shared leading slash alone says nothing
+	prefix := 0.0
+	if common > 1 {
+		prefix = float64(common) / float64(len(a))
+	}
+	return max(edit, prefix)
+}
+
+// levenshtein returns the edit distance between a and b in bytes
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// HandleGetFunnelHealth reports, for each saved funnel of a project, the steps
+// that matched no events in the last 30 days, with replacement pathnames for
+// the stale pageview steps
+func (h *Handler) HandleGetFunnelHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	if h.statsStore == nil {
+		writeJSON(w, map[string]string{"error": "Stats not available"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	funnels, err := h.db.GetFunnelsByProjectID(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get funnels", err)
+		return
+	}
+
+	result, err := h.funnelHealth(r.Context(), domain, funnels)
+	if errors.Is(err, stats.ErrNotReady) {
+		writeJSON(w, map[string]string{"error": "Stats not available"}, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		writeServerError(w, "Failed to check funnels", err)
+		return
+	}
+	writeJSON(w, result, http.StatusOK)
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+const (
+	// funnelHistoryBackfillDays is how many past days each run fills in, so the
+	// first run backfills a week and later runs recover from missed nights
+	funnelHistoryBackfillDays = 7
+	// funnelHistoryRunAt is the UTC time of day of the nightly run
+	funnelHistoryRunAt = 15 * time.Minute
+	// funnelHistoryTimeout bounds one funnel-day query
+	funnelHistoryTimeout = 2 * time.Minute
+	defaultHistoryDays   = 30
+	maxHistoryDays       = 365
+)
+
+// funnelHistoryDB is the storage the history job needs; *DB implements it
+type funnelHistoryDB interface {
+	GetAllSavedFunnels() ([]SavedFunnel, error)
+	GetFunnelResultDates(funnelID string, since time.Time) (map[string]bool, error)
+	SaveFunnelResult(funnelID, date string, result []byte) error
+	stats.AliasSource
+}
+
+// runFunnelHistory stores each saved funnel's result for the completed UTC days of
+// the last funnelHistoryBackfillDays that don't have one yet. Days without any
+// funnel entries are skipped. Returns the number of results stored.
+func runFunnelHistory(ctx context.Context, db funnelHistoryDB, store stats.StoreInterface, now time.Time) (int, error) {
+	funnels, err := db.GetAllSavedFunnels()
+	if err != nil {
+		return 0, err
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, -funnelHistoryBackfillDays)
+	stored := 0
+	for _, f := range funnels {
+		steps, err := funnel.UnmarshalSteps(f.Steps)
+		if err != nil || len(steps) < 2 {
+			continue
+		}
+		window := min(f.Window, funnel.MaxWindow)
+		if window <= 0 {
+			window = 60
+		}
+
+		done, err := db.GetFunnelResultDates(f.ID, since)
+		if err != nil {
+			log.Printf("Funnel history: funnel %s: %v", f.ID, err)
+			continue
+		}
+		fctx, err := stats.AliasContext(ctx, db, f.Domain)
+		if err != nil {
+			log.Printf("Funnel history: funnel %s: %v", f.ID, err)
+			continue
+		}
+		for day := since; day.Before(today); day = day.AddDate(0, 0, 1) {
+			if err := ctx.Err(); err != nil {
+				return stored, err
+			}
+			date := day.Format("2006-01-02")
+			if done[date] {
+				continue
+			}
+
+			qctx, cancel := context.WithTimeout(fctx, funnelHistoryTimeout)
+			result, err := store.GetFunnelAdvanced(stats.WithFunnelCohort(stats.WithPrivacyMode(stats.WithFilters(qctx, stats.Filters{}), f.PrivacyMode), stats.CohortEntry), f.Domain, day, day.AddDate(0, 0, 1), steps, window)
+			cancel()
+			if err != nil {
+				log.Printf("Funnel history: funnel %s on %s: %v", f.ID, date, err)
+				continue
+			}
+			if result == nil || result.TotalStart == 0 {
+				continue
+			}
+
+			payload, err := json.Marshal(result)
+			if err != nil {
+				continue
+			}
+			if err := db.SaveFunnelResult(f.ID, date, payload); err != nil {
+				log.Printf("Funnel history: funnel %s on %s: %v", f.ID, date, err)
+				continue
+			}
+			stored++
+		}
+	}
+	return stored, nil
+}
+
+// nextFunnelHistoryRun returns the next nightly run time after now
+func nextFunnelHistoryRun(now time.Time) time.Time {
+	next := now.UTC().Truncate(24 * time.Hour).Add(funnelHistoryRunAt)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// StartFunnelHistoryJob runs the funnel history job now, to backfill, and then nightly
+func (h *Handler) StartFunnelHistoryJob() {
+	if h.db == nil || h.statsStore == nil {
+		return
+	}
+	run := func() {
+		start := time.Now()
+		stored, err := runFunnelHistory(context.Background(), h.db, h.statsStore, start)
+		if err != nil {
+			log.Printf("Funnel history: %v", err)
+		}
+		log.Printf("Funnel history: stored %d results in %v", stored, time.Since(start))
+	}
+	go func() {
+		run()
+		for {
+			time.Sleep(time.Until(nextFunnelHistoryRun(time.Now())))
+			run()
+		}
+	}()
+}
+
+// HandleGetFunnelHistory returns the stored daily results of a saved funnel
+func (h *Handler) HandleGetFunnelHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, map[string]string{"error": "Funnel ID required"}, http.StatusBadRequest)
+		return
+	}
+	days := defaultHistoryDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > maxHistoryDays {
+			writeJSON(w, map[string]string{"error": "days must be between 1 and 365"}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -days)
+	results, err := h.db.GetFunnelResults(id, project.ID, since)
+	if err != nil {
+		writeServerError(w, "Failed to get funnel history", err)
+		return
+	}
+
+	writeJSON(w, results, http.StatusOK)
+}
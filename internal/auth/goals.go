@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+type GoalRequest struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`  // pageview or event
+	Value string `json:"value"` // path (trailing * for prefix) or event name
+}
+
+// HandleGetGoals returns all goals for a project
+func (h *Handler) HandleGetGoals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	goals, err := h.db.GetGoalsByProjectID(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get goals", err)
+		return
+	}
+	limits, err := h.projectLimits(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get goals", err)
+		return
+	}
+	writeUsageHeaders(w, len(goals), limits.Goals)
+
+	if goals == nil {
+		goals = []Goal{}
+	}
+
+	writeJSON(w, goals, http.StatusOK)
+}
+
+// HandleCreateGoal creates a new goal
+func (h *Handler) HandleCreateGoal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	var req GoalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		writeJSON(w, map[string]string{"error": "Name required"}, http.StatusBadRequest)
+		return
+	}
+	if err := stats.ValidateGoal(funnel.Step{Type: req.Type, Value: req.Value}); err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	goal, err := h.db.CreateGoal(project.ID, req.Name, req.Type, req.Value, h.limits().Goals)
+	if err != nil {
+		writeCreateError(w, "Failed to create goal", err)
+		return
+	}
+
+	writeJSON(w, goal, http.StatusCreated)
+}
+
+// HandleDeleteGoal deletes a goal
+func (h *Handler) HandleDeleteGoal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	goalID := r.URL.Query().Get("id")
+	if domain == "" || goalID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and goal ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.DeleteGoal(goalID, project.ID); err != nil {
+		writeServerError(w, "Failed to delete goal", err)
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "deleted"}, http.StatusOK)
+}
@@ -7,6 +7,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,6 +17,13 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
+
+	"github.com/shortid/clickresearch-stats/internal/errorsink"
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+	"github.com/shortid/clickresearch-stats/internal/secretbox"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+	"github.com/shortid/clickresearch-stats/internal/urlbuilder"
 )
 
 type Handler struct {
@@ -27,22 +35,22 @@ type Handler struct {
 	googleClientSecret string
 	googleRedirectURL  string
 	frontendURL        string
-}
-
-func NewHandler(db *DB, jwtSecret, webhookSecret, googleClientID, googleClientSecret, googleRedirectURL, frontendURL string) *Handler {
-	if db == nil {
-		return nil
-	}
-	return &Handler{
-		db:                 db,
-		jwtSecret:          []byte(jwtSecret),
-		webhookSecret:      webhookSecret,
-		syncSecret:         webhookSecret, // reuse webhook secret for sync
-		googleClientID:     googleClientID,
-		googleClientSecret: googleClientSecret,
-		googleRedirectURL:  googleRedirectURL,
-		frontendURL:        frontendURL,
-	}
+	urls               urlbuilder.Builder
+	spamList           *stats.SpamList
+	eventNames         *stats.EventNameRules
+	tombstones         *stats.Tombstones
+	sessionCookie      string
+	badgeSlugs         *stats.BadgeSlugs
+	valueOverrides     *stats.ValueOverrides
+	digest             *digestJob
+	statsStore         stats.StoreInterface
+	mailer             Mailer
+	exportBox          *secretbox.Box
+	passwordPolicy     *PasswordPolicy
+	keyUsage           *keyUsageRecorder
+	defaultLimits      ProjectLimits
+	denials            *domainDenials
+	domainCache        *DomainCache
 }
 
 // JWT claims
@@ -50,6 +58,9 @@ type Claims struct {
 	UserID string `json:"user_id"`
 	Email  string `json:"email"`
 	Role   string `json:"role"`
+	// AuthTime is when the user last proved who they are, with a password or
+	// Google; sensitive admin actions require it to be recent
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -66,8 +77,11 @@ type LoginRequest struct {
 }
 
 type AuthResponse struct {
-	Token string `json:"token"`
-	User  *User  `json:"user"`
+	// Token is left out for cookie sessions, whose CSRFToken mutating
+	// requests send in the X-CSRF-Token header
+	Token     string `json:"token,omitempty"`
+	CSRFToken string `json:"csrf_token,omitempty"`
+	User      *User  `json:"user"`
 }
 
 // Sync payload for cross-service user sync
@@ -102,6 +116,9 @@ func checkPassword(password, hash string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
+// tokenTTL is how long session tokens and cookies last
+const tokenTTL = 7 * 24 * time.Hour
+
 func (h *Handler) generateToken(user *User) (string, error) {
 	role := user.Role
 	if role == "" {
@@ -111,8 +128,10 @@ func (h *Handler) generateToken(user *User) (string, error) {
 		UserID: user.ID,
 		Email:  user.Email,
 		Role:   role,
+		// Tokens are only issued on sign-in
+		AuthTime: jwt.NewNumericDate(time.Now()),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -128,29 +147,31 @@ func (h *Handler) validateToken(tokenString string) (*Claims, error) {
 	if err != nil {
 		return nil, err
 	}
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	// Sessions carry no audience; embed tokens are signed with the same secret
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && len(claims.Audience) == 0 {
 		return claims, nil
 	}
 	return nil, fmt.Errorf("invalid token")
 }
 
 func (h *Handler) getUserFromRequest(r *http.Request) (*User, error) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return nil, fmt.Errorf("no authorization header")
+	claims, err := h.bearerClaims(r)
+	if err != nil {
+		return nil, err
 	}
 
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return nil, fmt.Errorf("invalid authorization header")
-	}
+	return h.db.GetUserByID(claims.UserID)
+}
 
-	claims, err := h.validateToken(parts[1])
+// bearerClaims validates the request's bearer token, or its session cookie,
+// without loading the user
+func (h *Handler) bearerClaims(r *http.Request) (*Claims, error) {
+	token, err := h.sessionToken(r)
 	if err != nil {
 		return nil, err
 	}
 
-	return h.db.GetUserByID(claims.UserID)
+	return h.validateToken(token)
 }
 
 // Sync user to other services (Woopicx, Shortodella)
@@ -199,13 +220,16 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+	if err := reqbody.Decode(w, r, &req); err != nil {
+		reqbody.Write(w, err)
 		return
 	}
-
-	if req.Email == "" || req.Password == "" {
-		writeJSON(w, map[string]string{"error": "Email and password required"}, http.StatusBadRequest)
+	if err := reqbody.Invalid(requireCredentials(req.Email, req.Password)...); err != nil {
+		reqbody.Write(w, err)
+		return
+	}
+	if reason := h.passwords().Check(r.Context(), req.Password, req.Email); reason != nil {
+		reqbody.Write(w, reqbody.Invalid(*reason))
 		return
 	}
 
@@ -218,7 +242,7 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	// Hash password
 	passwordHash, err := hashPassword(req.Password)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to hash password"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to hash password", err)
 		return
 	}
 
@@ -230,21 +254,35 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 
 	user, err := h.db.CreateUser(req.Email, passwordHash, name, nil)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to create user"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to create user", err)
 		return
 	}
 
 	// Generate token
 	token, err := h.generateToken(user)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to generate token"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to generate token", err)
 		return
 	}
 
 	// Sync to other services
 	go h.syncUserToOthers(user)
 
-	writeJSON(w, AuthResponse{Token: token, User: user}, http.StatusCreated)
+	h.completePendingTransfers(user)
+
+	writeJSON(w, h.sessionResponse(w, r, token, user), http.StatusCreated)
+}
+
+// requireCredentials lists which of email and password are missing
+func requireCredentials(email, password string) []reqbody.FieldError {
+	var errs []reqbody.FieldError
+	if strings.TrimSpace(email) == "" {
+		errs = append(errs, reqbody.FieldError{Field: "email", Message: "required"})
+	}
+	if password == "" {
+		errs = append(errs, reqbody.FieldError{Field: "password", Message: "required"})
+	}
+	return errs
 }
 
 func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
@@ -254,29 +292,30 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+	if err := reqbody.Decode(w, r, &req); err != nil {
+		reqbody.Write(w, err)
 		return
 	}
-
-	user, err := h.db.GetUserByEmail(req.Email)
-	if err != nil {
-		writeJSON(w, map[string]string{"error": "Invalid credentials"}, http.StatusUnauthorized)
+	if err := reqbody.Invalid(requireCredentials(req.Email, req.Password)...); err != nil {
+		reqbody.Write(w, err)
 		return
 	}
 
-	if !checkPassword(req.Password, user.PasswordHash) {
-		writeJSON(w, map[string]string{"error": "Invalid credentials"}, http.StatusUnauthorized)
+	user, err := h.logins().authenticate(req.Email, req.Password, loginOrigin(r, h.urls))
+	if err != nil {
+		writeLoginError(w, err)
 		return
 	}
 
 	token, err := h.generateToken(user)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to generate token"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to generate token", err)
 		return
 	}
 
-	writeJSON(w, AuthResponse{Token: token, User: user}, http.StatusOK)
+	h.completePendingTransfers(user)
+
+	writeJSON(w, h.sessionResponse(w, r, token, user), http.StatusOK)
 }
 
 func (h *Handler) HandleMe(w http.ResponseWriter, r *http.Request) {
@@ -310,10 +349,22 @@ type GoogleUserInfo struct {
 	Picture       string `json:"picture"`
 }
 
+// googleCallbackPath is where Google sends users back to after sign-in
+const googleCallbackPath = "/api/auth/google/callback"
+
+// googleRedirect is the redirect_uri of Google sign-in; the login and the
+// callback must send the same one
+func (h *Handler) googleRedirect(r *http.Request) string {
+	if h.googleRedirectURL != "" {
+		return h.googleRedirectURL
+	}
+	return h.urls.URL(r, googleCallbackPath)
+}
+
 // HandleGoogleLogin - redirects to Google OAuth
 func (h *Handler) HandleGoogleLogin(w http.ResponseWriter, r *http.Request) {
 	if h.googleClientID == "" {
-		writeJSON(w, map[string]string{"error": "Google OAuth not configured"}, http.StatusInternalServerError)
+		writeServerError(w, "Google OAuth not configured", nil)
 		return
 	}
 
@@ -326,10 +377,18 @@ func (h *Handler) HandleGoogleLogin(w http.ResponseWriter, r *http.Request) {
 	// Encode redirect URL in state (base64)
 	state := generateAPIKey()[:16] + ":" + redirectURL
 
+	// The callback can't see this request's query, so a cookie carries use_cookie
+	if wantsCookie(r) {
+		http.SetCookie(w, &http.Cookie{
+			Name: oauthCookieFlag, Value: "1", Path: googleCallbackPath, MaxAge: 600,
+			Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode,
+		})
+	}
+
 	authURL := fmt.Sprintf(
 		"https://accounts.google.com/o/oauth2/v2/auth?client_id=%s&redirect_uri=%s&response_type=code&scope=email%%20profile&state=%s&access_type=offline&prompt=select_account",
 		url.QueryEscape(h.googleClientID),
-		url.QueryEscape(h.googleRedirectURL),
+		url.QueryEscape(h.googleRedirect(r)),
 		url.QueryEscape(state),
 	)
 
@@ -356,7 +415,7 @@ func (h *Handler) HandleGoogleCallback(w http.ResponseWriter, r *http.Request) {
 		"code":          {code},
 		"client_id":     {h.googleClientID},
 		"client_secret": {h.googleClientSecret},
-		"redirect_uri":  {h.googleRedirectURL},
+		"redirect_uri":  {h.googleRedirect(r)},
 		"grant_type":    {"authorization_code"},
 	})
 	if err != nil {
@@ -415,6 +474,16 @@ func (h *Handler) HandleGoogleCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.completePendingTransfers(user)
+
+	// Cookie sessions keep the token out of the URL
+	if flag, err := r.Cookie(oauthCookieFlag); err == nil && flag.Value == "1" {
+		http.SetCookie(w, &http.Cookie{Name: oauthCookieFlag, Path: googleCallbackPath, MaxAge: -1})
+		h.setSessionCookies(w, token)
+		http.Redirect(w, r, frontendURL+"/auth/callback", http.StatusTemporaryRedirect)
+		return
+	}
+
 	// Redirect to frontend with token
 	http.Redirect(w, r, frontendURL+"/auth/callback?token="+token, http.StatusTemporaryRedirect)
 }
@@ -452,7 +521,7 @@ func (h *Handler) HandleGoogleVerify(w http.ResponseWriter, r *http.Request) {
 		}
 		user, err = h.db.CreateUser(payload.Email, "", name, nil)
 		if err != nil {
-			writeJSON(w, map[string]string{"error": "Failed to create user"}, http.StatusInternalServerError)
+			writeServerError(w, "Failed to create user", err)
 			return
 		}
 		go h.syncUserToOthers(user)
@@ -461,10 +530,16 @@ func (h *Handler) HandleGoogleVerify(w http.ResponseWriter, r *http.Request) {
 	// Generate JWT token
 	token, err := h.generateToken(user)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to generate token"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to generate token", err)
 		return
 	}
 
+	h.completePendingTransfers(user)
+
+	if wantsCookie(r) {
+		writeJSON(w, map[string]string{"csrf_token": h.setSessionCookies(w, token)}, http.StatusOK)
+		return
+	}
 	writeJSON(w, map[string]string{"token": token}, http.StatusOK)
 }
 
@@ -524,7 +599,8 @@ type SyncProjectResponse struct {
 }
 
 // HandleSyncProject - receives project sync from Shortodella
-// Creates user if needed, creates project, returns API key and snippet
+// Creates user if needed, creates project, returns API key and snippet.
+// Retried syncs get the project they created back; see projectSyncs.
 func (h *Handler) HandleSyncProject(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -549,46 +625,7 @@ func (h *Handler) HandleSyncProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Find or create user
-	user, err := h.db.GetUserByEmail(payload.Email)
-	if err != nil {
-		// User doesn't exist, create one
-		syncedFrom := "shortodella"
-		user, err = h.db.CreateUser(payload.Email, "", nil, &syncedFrom)
-		if err != nil {
-			writeJSON(w, map[string]string{"error": "Failed to create user"}, http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Create project
-	var name *string
-	if payload.Name != "" {
-		name = &payload.Name
-	}
-
-	project, err := h.db.CreateProject(user.ID, payload.Domain, name)
-	if err != nil {
-		// Project might already exist
-		writeJSON(w, map[string]string{"error": "Failed to create project: " + err.Error()}, http.StatusConflict)
-		return
-	}
-
-	// Generate snippet
-	snippet := fmt.Sprintf(`<script>
-!function(t,e){if(!e.cr){var n=t.createElement("script");
-n.src="https://shortid.me/cr.js";n.async=1;
-t.head.appendChild(n);e.cr=function(){
-(e.cr.q=e.cr.q||[]).push(arguments)}}}(document,window);
-
-cr('init', '%s');
-</script>`, payload.Domain)
-
-	writeJSON(w, SyncProjectResponse{
-		Domain:  project.Domain,
-		APIKey:  project.APIKey,
-		Snippet: snippet,
-	}, http.StatusCreated)
+	h.projectSyncs().serve(w, payload)
 }
 
 // Project handlers
@@ -606,7 +643,7 @@ func (h *Handler) HandleGetProjects(w http.ResponseWriter, r *http.Request) {
 
 	projects, err := h.db.GetProjectsByUserID(user.ID)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to get projects"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to get projects", err)
 		return
 	}
 
@@ -628,15 +665,13 @@ func (h *Handler) HandleCreateProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.getUserFromRequest(r)
-	if err != nil {
-		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+	if !h.requireWrite(w, r) {
 		return
 	}
 
-	// Demo users cannot create projects
-	if user.Role == "demo" {
-		writeJSON(w, map[string]string{"error": "Demo mode is read-only"}, http.StatusForbidden)
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
 		return
 	}
 
@@ -657,10 +692,15 @@ func (h *Handler) HandleCreateProject(w http.ResponseWriter, r *http.Request) {
 	}
 
 	project, err := h.db.CreateProject(user.ID, req.Domain, name)
+	if errors.Is(err, ErrDomainIsAlias) {
+		writeJSON(w, map[string]string{"error": "Domain is an alias of another project"}, http.StatusConflict)
+		return
+	}
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to create project"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to create project", err)
 		return
 	}
+	h.denials.allow(project.Domain)
 
 	writeJSON(w, project, http.StatusCreated)
 }
@@ -671,15 +711,13 @@ func (h *Handler) HandleDeleteProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.getUserFromRequest(r)
-	if err != nil {
-		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+	if !h.requireWrite(w, r) {
 		return
 	}
 
-	// Demo users cannot delete projects
-	if user.Role == "demo" {
-		writeJSON(w, map[string]string{"error": "Demo mode is read-only"}, http.StatusForbidden)
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
 		return
 	}
 
@@ -689,17 +727,26 @@ func (h *Handler) HandleDeleteProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.db.DeleteProject(projectID, user.ID); err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to delete project"}, http.StatusInternalServerError)
+	domain, err := h.db.DeleteProject(projectID, user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeServerError(w, "Failed to delete project", err)
 		return
 	}
+	if err == nil {
+		h.denials.deny(domain)
+	}
 
 	writeJSON(w, map[string]string{"status": "deleted"}, http.StatusOK)
 }
 
-// ValidateAPIKey checks if an API key is valid and returns the project
+// ValidateAPIKey checks if an API key is valid and returns the project.
+// Valid keys count as used; see StartKeyUsageRecorder.
 func (h *Handler) ValidateAPIKey(apiKey string) (*Project, error) {
-	return h.db.GetProjectByAPIKey(apiKey)
+	project, err := h.db.GetProjectByAPIKey(apiKey)
+	if err == nil && h.keyUsage != nil {
+		h.keyUsage.record(project.ID, apiKey)
+	}
+	return project, err
 }
 
 // GetUserProjects returns projects for a user (for filtering stats)
@@ -733,6 +780,18 @@ func writeJSON(w http.ResponseWriter, data interface{}, status int) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// writeServerError answers with a 500 carrying msg and records err, which
+// clients never see, for /api/admin/errors
+func writeServerError(w http.ResponseWriter, msg string, err error) {
+	if err == nil {
+		err = errors.New(msg)
+	} else {
+		err = fmt.Errorf("%s: %w", msg, err)
+	}
+	errorsink.Report(w, err, http.StatusInternalServerError)
+	writeJSON(w, map[string]string{"error": msg}, http.StatusInternalServerError)
+}
+
 // Admin handlers
 
 // isAdmin checks if user has admin role
@@ -745,20 +804,39 @@ func (h *Handler) isAdmin(r *http.Request) bool {
 }
 
 func (h *Handler) getClaimsFromRequest(r *http.Request) (*Claims, error) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		return nil, fmt.Errorf("no authorization header")
+	return h.bearerClaims(r)
+}
+
+// RequestRole returns the role from a valid bearer token, or "" if there is none
+func (h *Handler) RequestRole(r *http.Request) string {
+	claims, err := h.getClaimsFromRequest(r)
+	if err != nil {
+		return ""
 	}
+	return claims.Role
+}
 
-	parts := strings.Split(auth, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return nil, fmt.Errorf("invalid authorization header")
+// RequestUser returns the email from a valid bearer token, or "" if there is none
+func (h *Handler) RequestUser(r *http.Request) string {
+	claims, err := h.getClaimsFromRequest(r)
+	if err != nil {
+		return ""
 	}
+	return claims.Email
+}
 
-	return h.validateToken(parts[1])
+// RequireAdmin wraps a handler from another package so only admins can reach it
+func (h *Handler) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAdmin(r) {
+			writeJSON(w, map[string]string{"error": "Admin access required"}, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
 }
 
-// HandleAdminProjects returns all projects (admin only)
+// HandleAdminProjects returns a page of projects, filtered (admin only)
 func (h *Handler) HandleAdminProjects(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -770,20 +848,10 @@ func (h *Handler) HandleAdminProjects(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	projects, err := h.db.GetAllProjectsAdmin()
-	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to get projects"}, http.StatusInternalServerError)
-		return
-	}
-
-	if projects == nil {
-		projects = []ProjectWithUser{}
-	}
-
-	writeJSON(w, projects, http.StatusOK)
+	serveAdminProjects(h.db, w, r)
 }
 
-// HandleAdminUsers returns all users (admin only)
+// HandleAdminUsers returns a page of users, filtered (admin only)
 func (h *Handler) HandleAdminUsers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -795,17 +863,7 @@ func (h *Handler) HandleAdminUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := h.db.GetAllUsersAdmin()
-	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to get users"}, http.StatusInternalServerError)
-		return
-	}
-
-	if users == nil {
-		users = []User{}
-	}
-
-	writeJSON(w, users, http.StatusOK)
+	serveAdminUsers(h.db, w, r)
 }
 
 // HandleSyncDomains returns all domains for sync between servers
@@ -824,7 +882,7 @@ func (h *Handler) HandleSyncDomains(w http.ResponseWriter, r *http.Request) {
 
 	domains, err := h.db.GetAllDomains()
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to get domains"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to get domains", err)
 		return
 	}
 
@@ -832,37 +890,25 @@ func (h *Handler) HandleSyncDomains(w http.ResponseWriter, r *http.Request) {
 		domains = []string{}
 	}
 
-	writeJSON(w, map[string]interface{}{"domains": domains}, http.StatusOK)
+	writeJSON(w, map[string]interface{}{"domains": domains, "denied": h.denials.list()}, http.StatusOK)
 }
 
 // Funnel handlers
 
-type FunnelStepDef struct {
-	Type  string `json:"type"`
-	Value string `json:"value"`
-	Text  string `json:"text,omitempty"`
-	Tag   string `json:"tag,omitempty"`
-}
-
-type FunnelRequest struct {
-	Name   string          `json:"name"`
-	Window int             `json:"window"`
-	Steps  []FunnelStepDef `json:"steps"`
-}
-
 type FunnelResponse struct {
-	ID        string          `json:"id"`
-	ProjectID string          `json:"project_id"`
-	Name      string          `json:"name"`
-	Window    int             `json:"window"`
-	Steps     []FunnelStepDef `json:"steps"`
-	CreatedAt string          `json:"created_at"`
-	UpdatedAt string          `json:"updated_at"`
+	ID        string        `json:"id"`
+	ProjectID string        `json:"project_id"`
+	Name      string        `json:"name"`
+	Window    int           `json:"window"`
+	Steps     []funnel.Step `json:"steps"`
+	CreatedAt string        `json:"created_at"`
+	UpdatedAt string        `json:"updated_at"`
+	// Health is set for GET /api/funnels?include=health
+	Health *FunnelHealthSummary `json:"health,omitempty"`
 }
 
 func funnelToResponse(f *Funnel) FunnelResponse {
-	var steps []FunnelStepDef
-	json.Unmarshal([]byte(f.Steps), &steps)
+	steps, _ := funnel.UnmarshalSteps(f.Steps)
 	return FunnelResponse{
 		ID:        f.ID,
 		ProjectID: f.ProjectID,
@@ -902,15 +948,25 @@ func (h *Handler) HandleGetFunnels(w http.ResponseWriter, r *http.Request) {
 
 	funnels, err := h.db.GetFunnelsByProjectID(project.ID)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to get funnels"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to get funnels", err)
 		return
 	}
+	limits, err := h.projectLimits(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get funnels", err)
+		return
+	}
+	writeUsageHeaders(w, len(funnels), limits.Funnels)
 
 	result := make([]FunnelResponse, len(funnels))
 	for i, f := range funnels {
 		result[i] = funnelToResponse(&f)
 	}
 
+	if r.URL.Query().Get("include") == "health" {
+		h.addFunnelHealth(r.Context(), domain, funnels, result)
+	}
+
 	writeJSON(w, result, http.StatusOK)
 }
 
@@ -921,15 +977,13 @@ func (h *Handler) HandleCreateFunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.getUserFromRequest(r)
-	if err != nil {
-		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+	if !h.requireWrite(w, r) {
 		return
 	}
 
-	// Demo users cannot create funnels
-	if user.Role == "demo" {
-		writeJSON(w, map[string]string{"error": "Demo mode is read-only"}, http.StatusForbidden)
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
 		return
 	}
 
@@ -946,26 +1000,29 @@ func (h *Handler) HandleCreateFunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req FunnelRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+	var req funnel.Definition
+	if err := reqbody.Decode(w, r, &req); err != nil {
+		reqbody.Write(w, err)
 		return
 	}
-
-	if req.Name == "" || len(req.Steps) < 2 {
-		writeJSON(w, map[string]string{"error": "Name and at least 2 steps required"}, http.StatusBadRequest)
+	if err := reqbody.Invalid(req.Validate()...); err != nil {
+		reqbody.Write(w, err)
 		return
 	}
 
-	stepsJSON, _ := json.Marshal(req.Steps)
+	steps, err := funnel.MarshalSteps(funnel.NormalizeSteps(req.Steps))
+	if err != nil {
+		writeServerError(w, "Failed to create funnel", err)
+		return
+	}
 
-	funnel, err := h.db.CreateFunnel(project.ID, req.Name, req.Window, string(stepsJSON))
+	saved, err := h.db.CreateFunnel(project.ID, req.Name, req.Window, steps, h.limits().Funnels)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to create funnel"}, http.StatusInternalServerError)
+		writeCreateError(w, "Failed to create funnel", err)
 		return
 	}
 
-	writeJSON(w, funnelToResponse(funnel), http.StatusCreated)
+	writeJSON(w, funnelToResponse(saved), http.StatusCreated)
 }
 
 // HandleUpdateFunnel updates a funnel
@@ -975,15 +1032,13 @@ func (h *Handler) HandleUpdateFunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.getUserFromRequest(r)
-	if err != nil {
-		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+	if !h.requireWrite(w, r) {
 		return
 	}
 
-	// Demo users cannot update funnels
-	if user.Role == "demo" {
-		writeJSON(w, map[string]string{"error": "Demo mode is read-only"}, http.StatusForbidden)
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
 		return
 	}
 
@@ -1001,21 +1056,29 @@ func (h *Handler) HandleUpdateFunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req FunnelRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+	var req funnel.Definition
+	if err := reqbody.Decode(w, r, &req); err != nil {
+		reqbody.Write(w, err)
+		return
+	}
+	if err := reqbody.Invalid(req.Validate()...); err != nil {
+		reqbody.Write(w, err)
 		return
 	}
 
-	stepsJSON, _ := json.Marshal(req.Steps)
+	steps, err := funnel.MarshalSteps(funnel.NormalizeSteps(req.Steps))
+	if err != nil {
+		writeServerError(w, "Failed to update funnel", err)
+		return
+	}
 
-	funnel, err := h.db.UpdateFunnel(funnelID, project.ID, req.Name, req.Window, string(stepsJSON))
+	saved, err := h.db.UpdateFunnel(funnelID, project.ID, req.Name, req.Window, steps)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to update funnel"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to update funnel", err)
 		return
 	}
 
-	writeJSON(w, funnelToResponse(funnel), http.StatusOK)
+	writeJSON(w, funnelToResponse(saved), http.StatusOK)
 }
 
 // HandleDeleteFunnel deletes a funnel
@@ -1025,15 +1088,13 @@ func (h *Handler) HandleDeleteFunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.getUserFromRequest(r)
-	if err != nil {
-		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+	if !h.requireWrite(w, r) {
 		return
 	}
 
-	// Demo users cannot delete funnels
-	if user.Role == "demo" {
-		writeJSON(w, map[string]string{"error": "Demo mode is read-only"}, http.StatusForbidden)
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
 		return
 	}
 
@@ -1052,7 +1113,237 @@ func (h *Handler) HandleDeleteFunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.db.DeleteFunnel(funnelID, project.ID); err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to delete funnel"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to delete funnel", err)
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "deleted"}, http.StatusOK)
+}
+
+// Segment handlers
+
+type SegmentRequest struct {
+	Name    string        `json:"name"`
+	Filters stats.Filters `json:"filters"`
+}
+
+type SegmentResponse struct {
+	ID        string        `json:"id"`
+	ProjectID string        `json:"project_id"`
+	Name      string        `json:"name"`
+	Filters   stats.Filters `json:"filters"`
+	CreatedAt string        `json:"created_at"`
+	UpdatedAt string        `json:"updated_at"`
+}
+
+func segmentToResponse(s *Segment) SegmentResponse {
+	var filters stats.Filters
+	json.Unmarshal([]byte(s.Filters), &filters)
+	return SegmentResponse{
+		ID:        s.ID,
+		ProjectID: s.ProjectID,
+		Name:      s.Name,
+		Filters:   filters,
+		CreatedAt: s.CreatedAt,
+		UpdatedAt: s.UpdatedAt,
+	}
+}
+
+// decodeSegmentRequest decodes and validates a segment body against the Filters schema
+func decodeSegmentRequest(r *http.Request) (*SegmentRequest, error) {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	var req SegmentRequest
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("Invalid request: %v", err)
+	}
+	if req.Name == "" {
+		return nil, fmt.Errorf("Name required")
+	}
+	if req.Filters.IsEmpty() {
+		return nil, fmt.Errorf("At least one filter required")
+	}
+	if err := req.Filters.Validate(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// HandleGetSegments returns all segments for a project
+func (h *Handler) HandleGetSegments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	segments, err := h.db.GetSegmentsByProjectID(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get segments", err)
+		return
+	}
+	limits, err := h.projectLimits(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get segments", err)
+		return
+	}
+	writeUsageHeaders(w, len(segments), limits.Segments)
+
+	result := make([]SegmentResponse, len(segments))
+	for i, s := range segments {
+		result[i] = segmentToResponse(&s)
+	}
+
+	writeJSON(w, result, http.StatusOK)
+}
+
+// HandleCreateSegment creates a new segment
+func (h *Handler) HandleCreateSegment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	req, err := decodeSegmentRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	filtersJSON, _ := json.Marshal(req.Filters)
+
+	segment, err := h.db.CreateSegment(project.ID, req.Name, string(filtersJSON), h.limits().Segments)
+	if err != nil {
+		writeCreateError(w, "Failed to create segment", err)
+		return
+	}
+
+	writeJSON(w, segmentToResponse(segment), http.StatusCreated)
+}
+
+// HandleUpdateSegment updates a segment
+func (h *Handler) HandleUpdateSegment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	segmentID := r.URL.Query().Get("id")
+	if domain == "" || segmentID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and segment ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	req, err := decodeSegmentRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	filtersJSON, _ := json.Marshal(req.Filters)
+
+	segment, err := h.db.UpdateSegment(segmentID, project.ID, req.Name, string(filtersJSON))
+	if err != nil {
+		writeServerError(w, "Failed to update segment", err)
+		return
+	}
+
+	writeJSON(w, segmentToResponse(segment), http.StatusOK)
+}
+
+// HandleDeleteSegment deletes a segment
+func (h *Handler) HandleDeleteSegment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	segmentID := r.URL.Query().Get("id")
+	if domain == "" || segmentID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and segment ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.DeleteSegment(segmentID, project.ID); err != nil {
+		writeServerError(w, "Failed to delete segment", err)
 		return
 	}
 
@@ -1076,9 +1367,9 @@ func (h *Handler) HandleDemoLogin(w http.ResponseWriter, r *http.Request) {
 	// Generate token with demo role
 	token, err := h.generateToken(user)
 	if err != nil {
-		writeJSON(w, map[string]string{"error": "Failed to generate token"}, http.StatusInternalServerError)
+		writeServerError(w, "Failed to generate token", err)
 		return
 	}
 
-	writeJSON(w, AuthResponse{Token: token, User: user}, http.StatusOK)
+	writeJSON(w, h.sessionResponse(w, r, token, user), http.StatusOK)
 }
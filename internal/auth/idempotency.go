@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+)
+
+const (
+	// idempotencyKeyTTL is how long a key's response is replayed
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyStaleAfter frees keys whose first request never finished,
+	// e.g. because the instance serving it stopped
+	idempotencyStaleAfter = time.Minute
+	maxIdempotencyKeyLen  = 255
+)
+
+// idempotencyDB is the storage idempotency keys need; *DB implements it
+type idempotencyDB interface {
+	ClaimIdempotencyKey(userID, key, requestHash string, now, staleBefore, expiresAt time.Time) (IdempotencyRecord, bool, error)
+	SaveIdempotentResponse(userID, key string, status int, body []byte) error
+	ReleaseIdempotencyKey(userID, key string) error
+}
+
+// idempotency replays the response of the first request made with a key to
+// later requests with the same key and body
+type idempotency struct {
+	db  idempotencyDB
+	now func() time.Time
+}
+
+// requestHash identifies a request by everything that shapes its outcome
+func requestHash(r *http.Request, body []byte) string {
+	sum := sha256.New()
+	io.WriteString(sum, r.Method+"\n"+r.URL.Path+"\n"+r.URL.RawQuery+"\n")
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// serve runs next once per key of userID. Replays get the stored response with
+// Idempotent-Replay: true; a key reused for a different request gets 422, and
+// one whose first request is still running gets 409. Server errors are not
+// stored, so the client can retry them with the same key.
+func (ik idempotency) serve(userID, key string, w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if len(key) > maxIdempotencyKeyLen {
+		writeJSON(w, map[string]string{"error": "Idempotency-Key is too long"}, http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, reqbody.DefaultMaxBytes))
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Request body too large"}, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	hash := requestHash(r, body)
+
+	now := ik.now()
+	rec, claimed, err := ik.db.ClaimIdempotencyKey(userID, key, hash, now, now.Add(-idempotencyStaleAfter), now.Add(idempotencyKeyTTL))
+	if err != nil {
+		writeServerError(w, "Failed to check idempotency key", err)
+		return
+	}
+	if !claimed {
+		switch {
+		case rec.RequestHash != hash:
+			writeJSON(w, map[string]string{"error": "Idempotency-Key was already used for a different request"}, http.StatusUnprocessableEntity)
+		case rec.Status == 0:
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, map[string]string{"error": "A request with this Idempotency-Key is in progress"}, http.StatusConflict)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replay", "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+		}
+		return
+	}
+
+	rw := &responseRecorder{ResponseWriter: w}
+	next(rw, r)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.status >= 500 {
+		err = ik.db.ReleaseIdempotencyKey(userID, key)
+	} else {
+		err = ik.db.SaveIdempotentResponse(userID, key, rw.status, rw.body.Bytes())
+	}
+	if err != nil {
+		log.Printf("Idempotency key: %v", err)
+	}
+}
+
+// responseRecorder keeps a copy of the response it passes through
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Idempotent lets clients retry next safely: requests with an Idempotency-Key
+// header and a valid token run once per key for 24 hours, and repeats get the
+// first response. Other requests go straight to next.
+func (h *Handler) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		claims, err := h.bearerClaims(r)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		idempotency{db: h.db, now: time.Now}.serve(claims.UserID, key, w, r, next)
+	}
+}
+
+// StartIdempotencyKeyCleanup deletes expired idempotency keys every hour
+func (h *Handler) StartIdempotencyKeyCleanup() {
+	if h.db == nil {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			if n, err := h.db.DeleteExpiredIdempotencyKeys(time.Now()); err != nil {
+				log.Printf("Idempotency keys: cleanup: %v", err)
+			} else if n > 0 {
+				log.Printf("Idempotency keys: deleted %d expired", n)
+			}
+		}
+	}()
+}
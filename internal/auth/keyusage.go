@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"cmp"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// keyUsageFlushInterval batches API key usage so requests don't each write to Postgres
+	keyUsageFlushInterval = 30 * time.Second
+	// keyUsageRetention is how long hourly counts are kept
+	keyUsageRetention = 90 * 24 * time.Hour
+	// maxPendingKeyUsage caps the hourly counts held while Postgres is down;
+	// counts for further keys and hours are dropped until a flush succeeds
+	maxPendingKeyUsage = 10000
+)
+
+// apiKeyPrefix identifies an API key in usage counts without storing it
+func apiKeyPrefix(key string) string {
+	if len(key) > 8 {
+		return key[:8]
+	}
+	return key
+}
+
+// keyUsageDB is the storage API key usage needs; *DB implements it
+type keyUsageDB interface {
+	RecordAPIKeyUsage(usage []APIKeyUsage) error
+	PruneAPIKeyUsage(before time.Time) error
+}
+
+type keyUsageID struct {
+	projectID, keyPrefix string
+	hour                 time.Time
+}
+
+// keyUsageRecorder counts API key use in memory and writes the counts in
+// batches. Counts a write fails on are kept for the next one.
+type keyUsageRecorder struct {
+	db        keyUsageDB
+	now       func() time.Time
+	mu        sync.Mutex
+	pending   map[keyUsageID]*APIKeyUsage
+	lastPrune time.Time
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newKeyUsageRecorder(db keyUsageDB, now func() time.Time) *keyUsageRecorder {
+	return &keyUsageRecorder{
+		db:      db,
+		now:     now,
+		pending: make(map[keyUsageID]*APIKeyUsage),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// record counts one request made with apiKey
+func (u *keyUsageRecorder) record(projectID, apiKey string) {
+	now := u.now().UTC()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.add(APIKeyUsage{ProjectID: projectID, KeyPrefix: apiKeyPrefix(apiKey), Hour: now.Truncate(time.Hour), Requests: 1, LastUsedAt: now})
+}
+
+// add merges usage into the pending counts; u.mu must be held
+func (u *keyUsageRecorder) add(usage APIKeyUsage) {
+	id := keyUsageID{usage.ProjectID, usage.KeyPrefix, usage.Hour}
+	if p, ok := u.pending[id]; ok {
+		p.Requests += usage.Requests
+		if usage.LastUsedAt.After(p.LastUsedAt) {
+			p.LastUsedAt = usage.LastUsedAt
+		}
+		return
+	}
+	if len(u.pending) >= maxPendingKeyUsage {
+		return
+	}
+	u.pending[id] = &usage
+}
+
+// flush writes the pending counts, keeping them if the write fails
+func (u *keyUsageRecorder) flush() error {
+	u.mu.Lock()
+	batch := u.pending
+	u.pending = make(map[keyUsageID]*APIKeyUsage)
+	u.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	usage := make([]APIKeyUsage, 0, len(batch))
+	for _, p := range batch {
+		usage = append(usage, *p)
+	}
+	// A fixed order keeps concurrent flushes of several instances from deadlocking
+	slices.SortFunc(usage, func(a, b APIKeyUsage) int {
+		return cmp.Or(cmp.Compare(a.ProjectID, b.ProjectID), cmp.Compare(a.KeyPrefix, b.KeyPrefix), a.Hour.Compare(b.Hour))
+	})
+	if err := u.db.RecordAPIKeyUsage(usage); err != nil {
+		u.mu.Lock()
+		for _, p := range usage {
+			u.add(p)
+		}
+		u.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// run flushes on every tick and once more when stopped; old counts are pruned daily
+func (u *keyUsageRecorder) run(ticks <-chan time.Time) {
+	defer close(u.done)
+	for {
+		select {
+		case <-ticks:
+			if err := u.flush(); err != nil {
+				log.Printf("API key usage: %v", err)
+			}
+			if now := u.now(); now.Sub(u.lastPrune) >= 24*time.Hour {
+				if err := u.db.PruneAPIKeyUsage(now.Add(-keyUsageRetention)); err != nil {
+					log.Printf("API key usage: prune: %v", err)
+				} else {
+					u.lastPrune = now
+				}
+			}
+		case <-u.stop:
+			if err := u.flush(); err != nil {
+				log.Printf("API key usage: final flush: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// close stops run after a final flush
+func (u *keyUsageRecorder) close() {
+	close(u.stop)
+	<-u.done
+}
+
+// StartKeyUsageRecorder records API key use, writing it every 30 seconds
+func (h *Handler) StartKeyUsageRecorder() {
+	if h.db == nil || h.keyUsage != nil {
+		return
+	}
+	h.keyUsage = newKeyUsageRecorder(h.db, time.Now)
+	ticker := time.NewTicker(keyUsageFlushInterval)
+	go func() {
+		defer ticker.Stop()
+		h.keyUsage.run(ticker.C)
+	}()
+}
+
+// StopKeyUsageRecorder writes API key use not yet written; call it on shutdown
+func (h *Handler) StopKeyUsageRecorder() {
+	if h.keyUsage != nil {
+		h.keyUsage.close()
+	}
+}
+
+// HandleGetAPIKeys lists the API keys of the user's projects with when each was
+// last used and how many requests it made in the last 7 days
+func (h *Handler) HandleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := h.db.GetAPIKeyUsage(user.ID, time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		writeServerError(w, "Failed to get API keys", err)
+		return
+	}
+
+	if keys == nil {
+		keys = []APIKeyInfo{}
+	}
+
+	writeJSON(w, keys, http.StatusOK)
+}
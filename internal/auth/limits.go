@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+)
+
+// ProjectLimits cap how many funnels, goals and segments a project may have
+type ProjectLimits struct {
+	Funnels  int `json:"funnels"`
+	Goals    int `json:"goals"`
+	Segments int `json:"segments"`
+}
+
+// DefaultProjectLimits apply to projects without overrides unless the server sets others
+var DefaultProjectLimits = ProjectLimits{Funnels: 50, Goals: 100, Segments: 50}
+
+// LimitError is returned when creating something a project already has its limit of
+type LimitError struct {
+	Resource string
+	Count    int
+	Limit    int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d reached", e.Resource, e.Limit)
+}
+
+// SetDefaultProjectLimits replaces the limits of projects without overrides;
+// zero fields keep DefaultProjectLimits
+func (h *Handler) SetDefaultProjectLimits(l ProjectLimits) {
+	h.defaultLimits = l
+}
+
+func (h *Handler) limits() ProjectLimits {
+	l := h.defaultLimits
+	if l.Funnels <= 0 {
+		l.Funnels = DefaultProjectLimits.Funnels
+	}
+	if l.Goals <= 0 {
+		l.Goals = DefaultProjectLimits.Goals
+	}
+	if l.Segments <= 0 {
+		l.Segments = DefaultProjectLimits.Segments
+	}
+	return l
+}
+
+// apply returns limits with o's overrides
+func (o ProjectLimitOverrides) apply(limits ProjectLimits) ProjectLimits {
+	if o.Funnels != nil {
+		limits.Funnels = *o.Funnels
+	}
+	if o.Goals != nil {
+		limits.Goals = *o.Goals
+	}
+	if o.Segments != nil {
+		limits.Segments = *o.Segments
+	}
+	return limits
+}
+
+// projectLimits returns the limits a project is held to
+func (h *Handler) projectLimits(projectID string) (ProjectLimits, error) {
+	o, err := h.db.GetProjectLimitOverrides(projectID)
+	if err != nil {
+		return ProjectLimits{}, err
+	}
+	return o.apply(h.limits()), nil
+}
+
+// writeUsageHeaders tells list clients how many of limit a project uses
+func writeUsageHeaders(w http.ResponseWriter, count, limit int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(count))
+	w.Header().Set("X-Limit", strconv.Itoa(limit))
+}
+
+// writeCreateError answers a failed create: a 403 with the count and limit if
+// the project is at its limit, a server error otherwise
+func writeCreateError(w http.ResponseWriter, msg string, err error) {
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		writeServerError(w, msg, err)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"error":    fmt.Sprintf("%s limit of %d reached", strings.ToUpper(limitErr.Resource[:1])+limitErr.Resource[1:], limitErr.Limit),
+		"resource": limitErr.Resource,
+		"count":    limitErr.Count,
+		"limit":    limitErr.Limit,
+	}, http.StatusForbidden)
+}
+
+// ProjectLimitsRequest sets a project's own limits; null fields use the default
+type ProjectLimitsRequest struct {
+	ProjectID string `json:"project_id"`
+	ProjectLimitOverrides
+}
+
+// validate lists what is wrong with the request
+func (req ProjectLimitsRequest) validate() []reqbody.FieldError {
+	var errs []reqbody.FieldError
+	if req.ProjectID == "" {
+		errs = append(errs, reqbody.FieldError{Field: "project_id", Message: "required"})
+	}
+	for field, v := range map[string]*int{"funnels": req.Funnels, "goals": req.Goals, "segments": req.Segments} {
+		if v != nil && *v < 0 {
+			errs = append(errs, reqbody.FieldError{Field: field, Message: "must not be negative"})
+		}
+	}
+	return errs
+}
+
+// ProjectLimitsResponse shows a project's limits and where they come from
+type ProjectLimitsResponse struct {
+	ProjectID string                `json:"project_id"`
+	Limits    ProjectLimits         `json:"limits"`
+	Overrides ProjectLimitOverrides `json:"overrides"`
+	Defaults  ProjectLimits         `json:"defaults"`
+}
+
+// HandleAdminProjectLimits shows (GET ?project_id=) and overrides (PUT) the
+// limits of a project (admin only)
+func (h *Handler) HandleAdminProjectLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.isAdmin(r) {
+		writeJSON(w, map[string]string{"error": "Admin access required"}, http.StatusForbidden)
+		return
+	}
+
+	projectID := r.URL.Query().Get("project_id")
+	if r.Method == http.MethodPut {
+		var req ProjectLimitsRequest
+		if err := reqbody.Decode(w, r, &req); err != nil {
+			reqbody.Write(w, err)
+			return
+		}
+		if err := reqbody.Invalid(req.validate()...); err != nil {
+			reqbody.Write(w, err)
+			return
+		}
+		if err := h.db.SetProjectLimitOverrides(req.ProjectID, req.ProjectLimitOverrides); err == sql.ErrNoRows {
+			writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeServerError(w, "Failed to set project limits", err)
+			return
+		}
+		projectID = req.ProjectID
+	} else if projectID == "" {
+		writeJSON(w, map[string]string{"error": "project_id required"}, http.StatusBadRequest)
+		return
+	}
+
+	o, err := h.db.GetProjectLimitOverrides(projectID)
+	if err == sql.ErrNoRows {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeServerError(w, "Failed to get project limits", err)
+		return
+	}
+	writeJSON(w, ProjectLimitsResponse{ProjectID: projectID, Limits: o.apply(h.limits()), Overrides: o, Defaults: h.limits()}, http.StatusOK)
+}
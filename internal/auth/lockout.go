@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+	"github.com/shortid/clickresearch-stats/internal/urlbuilder"
+)
+
+const (
+	// loginDelayAfter failures of an email, each retry must wait longer
+	loginDelayAfter = 5
+	maxLoginDelay   = time.Minute
+	// loginLockAfter failures lock an email for loginLockDuration, or until
+	// the owner follows the emailed unlock link
+	loginLockAfter    = 10
+	loginLockDuration = time.Hour
+)
+
+// errInvalidCredentials is returned alike for unknown emails, wrong passwords
+// and locked accounts
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+// loginThrottledError asks the client to wait before trying an email again.
+// Unknown emails are throttled too, so it reveals nothing about accounts.
+type loginThrottledError struct {
+	wait time.Duration
+}
+
+func (e loginThrottledError) Error() string {
+	return "Too many failed logins, try again later"
+}
+
+// loginAttemptDB is the storage login protection needs; *DB implements it
+type loginAttemptDB interface {
+	GetUserByEmail(email string) (*User, error)
+	GetLoginAttempts(email string) (LoginAttempts, error)
+	RecordLoginFailure(email string, at time.Time) (LoginAttempts, error)
+	LockLogin(email string, until time.Time, unlockTokenHash string) error
+	ResetLoginAttempts(email string) error
+}
+
+// loginGuard checks passwords with per-account brute-force protection
+type loginGuard struct {
+	db          loginAttemptDB
+	mailer      Mailer
+	frontendURL string
+	now         func() time.Time
+}
+
+func (h *Handler) logins() loginGuard {
+	return loginGuard{db: h.db, mailer: h.mailer, frontendURL: h.frontendURL, now: time.Now}
+}
+
+// loginDelay is how long after its last failure an email may try again:
+// 1s after 5 failures, doubling up to a minute
+func loginDelay(failures int) time.Duration {
+	if failures < loginDelayAfter {
+		return 0
+	}
+	n := failures - loginDelayAfter
+	if n >= 6 {
+		return maxLoginDelay
+	}
+	return time.Second << n
+}
+
+func hashUnlockToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate returns the user with email and password. Errors are
+// errInvalidCredentials, loginThrottledError or storage failures. from
+// describes the client for the notification sent when a login succeeds after
+// failures.
+func (g loginGuard) authenticate(email, password, from string) (*User, error) {
+	now := g.now()
+	attempts, err := g.db.GetLoginAttempts(email)
+	if err != nil {
+		return nil, err
+	}
+	// Locked accounts fail like a wrong password; only the emailed link says why
+	if attempts.LockedUntil != nil && now.Before(*attempts.LockedUntil) {
+		return nil, errInvalidCredentials
+	}
+	if wait := attempts.LastFailureAt.Add(loginDelay(attempts.Failures)).Sub(now); wait > 0 {
+		return nil, loginThrottledError{wait: wait}
+	}
+
+	user, err := g.db.GetUserByEmail(email)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if user == nil || !checkPassword(password, user.PasswordHash) {
+		g.failed(email, user, now)
+		return nil, errInvalidCredentials
+	}
+
+	if attempts.Failures > 0 {
+		if err := g.db.ResetLoginAttempts(email); err != nil {
+			log.Printf("Reset failed logins of %s: %v", email, err)
+		}
+		g.notify(user.Email, "New sign-in to your account",
+			fmt.Sprintf("Your account was signed in to from %s after %d failed attempts. If this wasn't you, change your password now.",
+				from, attempts.Failures))
+	}
+	return user, nil
+}
+
+// failed counts a failed login, locking the email when it reaches loginLockAfter
+func (g loginGuard) failed(email string, user *User, now time.Time) {
+	attempts, err := g.db.RecordLoginFailure(email, now)
+	if err != nil {
+		log.Printf("Record failed login of %s: %v", email, err)
+		return
+	}
+	if attempts.Failures < loginLockAfter {
+		return
+	}
+
+	token := generateAPIKey()
+	if err := g.db.LockLogin(email, now.Add(loginLockDuration), hashUnlockToken(token)); err != nil {
+		log.Printf("Lock logins of %s: %v", email, err)
+		return
+	}
+	log.Printf("Audit: logins of %s locked after %d failures", email, attempts.Failures)
+	if user == nil {
+		return
+	}
+	g.notify(user.Email, "Sign-in to your account is locked",
+		fmt.Sprintf("After %d failed sign-in attempts, signing in is locked for %s. If they were you, unlock your account: %s/unlock-account?token=%s",
+			attempts.Failures, loginLockDuration, g.frontendURL, token))
+}
+
+func (g loginGuard) notify(to, subject, body string) {
+	if g.mailer == nil {
+		log.Printf("Mail to %s: %s", to, subject)
+		return
+	}
+	if err := g.mailer.Send(to, subject, body); err != nil {
+		log.Printf("Mail to %s: %v", to, err)
+	}
+}
+
+// loginOrigin describes the client of a login for notifications. Its address
+// only comes from X-Forwarded-For when urls trusts the proxy headers, so a
+// client can't forge where a sign-in came from.
+func loginOrigin(r *http.Request, urls urlbuilder.Builder) string {
+	ip := urls.ClientIP(r)
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		return fmt.Sprintf("%s (%s)", ip, ua)
+	}
+	return ip
+}
+
+// writeLoginError responds to a failed authenticate
+func writeLoginError(w http.ResponseWriter, err error) {
+	var throttled loginThrottledError
+	switch {
+	case errors.Is(err, errInvalidCredentials):
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusUnauthorized)
+	case errors.As(err, &throttled):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.wait.Seconds()))))
+		writeJSON(w, map[string]string{"error": throttled.Error()}, http.StatusTooManyRequests)
+	default:
+		writeServerError(w, "Failed to log in", err)
+	}
+}
+
+// UnlockLoginRequest redeems the token of an emailed unlock link
+type UnlockLoginRequest struct {
+	Token string `json:"token"`
+}
+
+// HandleUnlockLogin lifts a login lock with the token emailed when it was set
+func (h *Handler) HandleUnlockLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req UnlockLoginRequest
+	if err := reqbody.Decode(w, r, &req); err != nil {
+		reqbody.Write(w, err)
+		return
+	}
+	if req.Token == "" {
+		reqbody.Write(w, reqbody.Invalid(reqbody.FieldError{Field: "token", Message: "required"}))
+		return
+	}
+
+	email, err := h.db.UnlockLogin(hashUnlockToken(req.Token))
+	if err == sql.ErrNoRows {
+		writeJSON(w, map[string]string{"error": "Invalid or used unlock link"}, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeServerError(w, "Failed to unlock", err)
+		return
+	}
+	log.Printf("Audit: logins of %s unlocked by emailed link", email)
+	writeJSON(w, map[string]string{"status": "unlocked"}, http.StatusOK)
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shortid/clickresearch-stats/internal/urlbuilder"
+)
+
+// Option configures a Handler built by NewHandler
+type Option func(*Handler)
+
+// GoogleOAuthConfig is the OAuth client Google sign-in uses. All fields are
+// required, except RedirectURL with WithURLBuilder on a public URL, which
+// defaults to its /api/auth/google/callback.
+type GoogleOAuthConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// WithJWTSecret sets the key session and embed tokens are signed with; required
+func WithJWTSecret(secret string) Option {
+	return func(h *Handler) {
+		h.jwtSecret = []byte(secret)
+	}
+}
+
+// WithWebhookSecret sets the secret webhooks and service calls are checked
+// and signed with
+func WithWebhookSecret(secret string) Option {
+	return func(h *Handler) {
+		h.webhookSecret = secret
+	}
+}
+
+// WithSyncSecret sets the secret sync requests must carry; without one they
+// are refused
+func WithSyncSecret(secret string) Option {
+	return func(h *Handler) {
+		h.syncSecret = secret
+	}
+}
+
+// WithGoogleOAuth enables Google sign-in; it needs WithFrontendURL to
+// redirect back to
+func WithGoogleOAuth(cfg GoogleOAuthConfig) Option {
+	return func(h *Handler) {
+		h.googleClientID = cfg.ClientID
+		h.googleClientSecret = cfg.ClientSecret
+		h.googleRedirectURL = cfg.RedirectURL
+	}
+}
+
+// WithFrontendURL sets the dashboard URL sign-in redirects to and emails link to
+func WithFrontendURL(url string) Option {
+	return func(h *Handler) {
+		h.frontendURL = url
+	}
+}
+
+// WithURLBuilder sets how absolute URLs of this server, such as share links
+// and the Google redirect URI, are built. Without one they are built from the
+// request, ignoring proxy headers.
+func WithURLBuilder(b urlbuilder.Builder) Option {
+	return func(h *Handler) {
+		h.urls = b
+	}
+}
+
+// WithMailer sets where notification emails go; it needs WithFrontendURL for
+// their links. Without one emails are only logged.
+func WithMailer(m Mailer) Option {
+	return func(h *Handler) {
+		h.mailer = m
+	}
+}
+
+// WithDomainCache serves dc, the domains synced from the stats server, the
+// denials peers push on the sync invalidation route
+func WithDomainCache(dc *DomainCache) Option {
+	return func(h *Handler) {
+		h.domainCache = dc
+	}
+}
+
+// NewHandler builds the auth handler on db. It fails when a required option
+// is missing or an integration lacks settings it depends on.
+func NewHandler(db *DB, opts ...Option) (*Handler, error) {
+	if db == nil {
+		return nil, errors.New("auth: database required")
+	}
+	h := &Handler{db: db, denials: newDomainDenials(db)}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// validate checks the combinations of options NewHandler requires
+func (h *Handler) validate() error {
+	if len(h.jwtSecret) == 0 {
+		return errors.New("auth: JWT secret required")
+	}
+	if h.frontendURL != "" {
+		if err := urlbuilder.Check(h.frontendURL); err != nil {
+			return fmt.Errorf("auth: frontend URL %w", err)
+		}
+	}
+	google := []struct{ name, value string }{
+		{"client ID", h.googleClientID},
+		{"client secret", h.googleClientSecret},
+	}
+	if !h.urls.Configured() {
+		google = append(google, struct{ name, value string }{"redirect URL", h.googleRedirectURL})
+	}
+	if h.googleClientID != "" || h.googleClientSecret != "" || h.googleRedirectURL != "" {
+		for _, setting := range google {
+			if setting.value == "" {
+				return fmt.Errorf("auth: Google OAuth %s required", setting.name)
+			}
+		}
+		if h.googleRedirectURL != "" {
+			if err := urlbuilder.Check(h.googleRedirectURL); err != nil {
+				return fmt.Errorf("auth: Google OAuth redirect URL %w", err)
+			}
+		}
+		if h.frontendURL == "" {
+			return errors.New("auth: Google OAuth requires a frontend URL")
+		}
+	}
+	if h.mailer != nil && h.frontendURL == "" {
+		return errors.New("auth: mailer requires a frontend URL")
+	}
+	return nil
+}
+
+// NewHandlerWithSecrets builds the handler from positional settings, using
+// the webhook secret for sync requests too, and returns nil without a
+// database. It doesn't validate the settings.
+//
+// Deprecated: use NewHandler with options; this goes away in the next release.
+func NewHandlerWithSecrets(db *DB, jwtSecret, webhookSecret, googleClientID, googleClientSecret, googleRedirectURL, frontendURL string) *Handler {
+	if db == nil {
+		return nil
+	}
+	h := &Handler{db: db, denials: newDomainDenials(db)}
+	for _, opt := range []Option{
+		WithJWTSecret(jwtSecret),
+		WithWebhookSecret(webhookSecret),
+		WithSyncSecret(webhookSecret),
+		WithGoogleOAuth(GoogleOAuthConfig{ClientID: googleClientID, ClientSecret: googleClientSecret, RedirectURL: googleRedirectURL}),
+		WithFrontendURL(frontendURL),
+	} {
+		opt(h)
+	}
+	return h
+}
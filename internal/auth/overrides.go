@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// SetValueOverrides lets value override changes take effect without a restart
+func (h *Handler) SetValueOverrides(overrides *stats.ValueOverrides) {
+	h.valueOverrides = overrides
+}
+
+// ReloadValueOverrides loads the admin value overrides from the database into the rule set
+func (h *Handler) ReloadValueOverrides() error {
+	if h.valueOverrides == nil {
+		return nil
+	}
+	rules, err := h.db.ValueOverrideRules()
+	if err != nil {
+		return err
+	}
+	h.valueOverrides.Set(rules)
+	return nil
+}
+
+// HandleAdminValueOverrides lists (GET), adds (POST) and removes (DELETE ?id=)
+// value overrides, which correct values of the browser, os, device and country
+// columns in reports without rewriting stored events. Cached reports pick up a
+// change when they expire.
+func (h *Handler) HandleAdminValueOverrides(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.getClaimsFromRequest(r)
+	if err != nil || claims.Role != "admin" {
+		writeJSON(w, map[string]string{"error": "Admin access required"}, http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		overrides, err := h.db.GetValueOverrides()
+		if err != nil {
+			writeServerError(w, "Failed to get value overrides", err)
+			return
+		}
+		if overrides == nil {
+			overrides = []ValueOverride{}
+		}
+		writeJSON(w, overrides, http.StatusOK)
+		return
+
+	case http.MethodPost:
+		var req stats.ValueOverride
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+			return
+		}
+		req.Domain = strings.ToLower(strings.TrimSpace(req.Domain))
+		req.Match = strings.TrimSpace(req.Match)
+		req.Replacement = strings.TrimSpace(req.Replacement)
+		if err := req.Validate(); err != nil {
+			writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+			return
+		}
+		existing, err := h.db.GetValueOverrides()
+		if err != nil {
+			writeServerError(w, "Failed to add value override", err)
+			return
+		}
+		if len(existing) >= stats.MaxValueOverrides {
+			writeJSON(w, map[string]string{"error": "Value override limit reached"}, http.StatusConflict)
+			return
+		}
+		id, err := h.db.AddValueOverride(req, claims.Email)
+		if err != nil {
+			writeServerError(w, "Failed to add value override", err)
+			return
+		}
+		if err := h.ReloadValueOverrides(); err != nil {
+			log.Printf("Failed to reload value overrides: %v", err)
+		}
+		writeJSON(w, map[string]string{"status": "ok", "id": id}, http.StatusOK)
+		return
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			writeJSON(w, map[string]string{"error": "ID required"}, http.StatusBadRequest)
+			return
+		}
+		if err := h.db.DeleteValueOverride(id); err != nil {
+			writeServerError(w, "Failed to delete value override", err)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.ReloadValueOverrides(); err != nil {
+		log.Printf("Failed to reload value overrides: %v", err)
+	}
+	writeJSON(w, map[string]string{"status": "ok"}, http.StatusOK)
+}
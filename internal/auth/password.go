@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+)
+
+// Password rejection codes, for the frontend to localize
+const (
+	PasswordTooShort     = "password_too_short"
+	PasswordTooWeak      = "password_too_weak"
+	PasswordIsEmail      = "password_is_email"
+	PasswordBreached     = "password_breached"
+	defaultHIBPURL       = "https://api.pwnedpasswords.com/range/"
+	defaultBreachTimeout = 2 * time.Second
+)
+
+// BreachChecker reports whether a password appears in known breaches
+type BreachChecker interface {
+	Breached(ctx context.Context, password string) (bool, error)
+}
+
+// PasswordPolicy decides which passwords new and changed credentials may use
+type PasswordPolicy struct {
+	MinLength int
+	// MinEntropyBits is the estimated strength a password needs; see passwordEntropy
+	MinEntropyBits float64
+	// Breached is consulted last; nil skips the check. Errors fail open.
+	Breached BreachChecker
+}
+
+// DefaultPasswordPolicy applies when none is set
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 10, MinEntropyBits: 40}
+
+// SetPasswordPolicy replaces the policy registration enforces
+func (h *Handler) SetPasswordPolicy(p PasswordPolicy) {
+	h.passwordPolicy = &p
+}
+
+func (h *Handler) passwords() PasswordPolicy {
+	if h.passwordPolicy == nil {
+		return DefaultPasswordPolicy
+	}
+	return *h.passwordPolicy
+}
+
+// Check returns why password may not be used by the account with email, or nil
+func (p PasswordPolicy) Check(ctx context.Context, password, email string) *reqbody.FieldError {
+	reject := func(code, msg string) *reqbody.FieldError {
+		return &reqbody.FieldError{Field: "password", Code: code, Message: msg}
+	}
+
+	if n := len([]rune(password)); n < p.MinLength {
+		return reject(PasswordTooShort, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	lower := strings.ToLower(strings.TrimSpace(password))
+	email = strings.ToLower(strings.TrimSpace(email))
+	if local, _, _ := strings.Cut(email, "@"); email != "" && (lower == email || lower == local) {
+		return reject(PasswordIsEmail, "must not be your email address")
+	}
+	if commonPasswords[lower] || passwordEntropy(password) < p.MinEntropyBits {
+		return reject(PasswordTooWeak, "is too easy to guess; use a longer phrase or mix character types")
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Breached(ctx, password)
+		if err != nil {
+			log.Printf("Password breach check failed, allowing: %v", err)
+		} else if breached {
+			return reject(PasswordBreached, "appears in a known data breach; choose another")
+		}
+	}
+	return nil
+}
+
+// commonPasswords are rejected whatever their estimated entropy
+var commonPasswords = map[string]bool{
+	"password123": true, "password1234": true, "passw0rd123": true, "qwertyuiop": true,
+	"qwertyuiop1": true, "1q2w3e4r5t": true, "1qaz2wsx3edc": true, "iloveyou123": true,
+	"letmein1234": true, "welcome123": true, "administrator": true, "changeme123": true,
+	"trustno1234": true, "football123": true, "baseball123": true, "superman123": true,
+	"zaq12wsxcde3": true, "asdfghjkl1": true, "abcdefghij": true, "abc123abc123": true,
+}
+
+// passwordEntropy estimates the strength of a password in bits: its length
+// times log2 of the pool its character classes span. Runs of one character and
+// steps through the alphabet or digits, such as aaaa or 12345, count as one
+// character, so padding a weak password barely helps.
+func passwordEntropy(password string) float64 {
+	runes := []rune(password)
+	var lower, upper, digit, symbol, other bool
+	effective := 0
+	for i, r := range runes {
+		switch {
+		case r < unicode.MaxASCII && unicode.IsLower(r):
+			lower = true
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+		if i >= 2 {
+			d1, d2 := runes[i]-runes[i-1], runes[i-1]-runes[i-2]
+			if d1 == d2 && d1 >= -1 && d1 <= 1 {
+				continue
+			}
+		}
+		effective++
+	}
+
+	pool := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.used {
+			pool += c.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(effective) * math.Log2(float64(pool))
+}
+
+// HIBPChecker checks passwords against Have I Been Pwned's range API. Only the
+// first five hex characters of the password's SHA-1 leave the server.
+type HIBPChecker struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewHIBPChecker returns a checker of the public API with a strict timeout
+func NewHIBPChecker() *HIBPChecker {
+	return &HIBPChecker{BaseURL: defaultHIBPURL, Client: &http.Client{Timeout: defaultBreachTimeout}}
+}
+
+// Breached reports whether password's hash suffix is in its prefix range
+func (c *HIBPChecker) Breached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding hides which range a response belongs to from anyone measuring sizes
+	req.Header.Set("Add-Padding", "true")
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("HIBP range returned %d", resp.StatusCode)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		hashSuffix, count, ok := strings.Cut(strings.TrimSpace(sc.Text()), ":")
+		// Padding entries have a count of 0
+		if ok && hashSuffix == suffix && count != "0" {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// schemaObject is a table, or a column of one, that the server needs
+type schemaObject struct {
+	table, column string
+	migration     string // file in migrations/ creating it; empty for the base schema
+}
+
+// requiredSchema lists each table and each column added later by a migration
+var requiredSchema = []schemaObject{
+	{table: "clickresearch_users"},
+	{table: "clickresearch_projects"},
+	{"clickresearch_funnels", "", "001_create_funnels.sql"},
+	{"clickresearch_segments", "", "002_create_segments.sql"},
+	{"clickresearch_annotations", "", "003_create_annotations.sql"},
+	{"clickresearch_goals", "", "004_create_goals.sql"},
+	{"clickresearch_spam_referrers", "", "005_create_spam_referrers.sql"},
+	{"clickresearch_funnel_snapshots", "", "006_create_funnel_snapshots.sql"},
+	{"clickresearch_projects", "anonymize_snapshots", "006_create_funnel_snapshots.sql"},
+	{"clickresearch_funnel_results", "", "007_create_funnel_results.sql"},
+	{"clickresearch_project_transfers", "", "008_create_project_transfers.sql"},
+	{"clickresearch_projects", "privacy_mode", "009_add_project_privacy_mode.sql"},
+	{"clickresearch_project_event_names", "", "010_create_project_event_names.sql"},
+	{"clickresearch_projects", "event_cardinality_guard", "010_create_project_event_names.sql"},
+	{"clickresearch_export_destinations", "", "011_create_export_destinations.sql"},
+	{"clickresearch_projects", "embed_secret", "012_add_project_embed_secret.sql"},
+	{"clickresearch_login_attempts", "", "013_create_login_attempts.sql"},
+	{"clickresearch_api_key_usage", "", "014_create_api_key_usage.sql"},
+	{"clickresearch_projects", "max_segments", "015_add_project_limits.sql"},
+	{"clickresearch_idempotency_keys", "", "016_create_idempotency_keys.sql"},
+	{"clickresearch_projects", "match_subdomains", "017_add_project_domain_match.sql"},
+	{"clickresearch_projects", "badge_slug", "018_add_project_badge_slug.sql"},
+	{"clickresearch_value_overrides", "", "019_create_value_overrides.sql"},
+	{"clickresearch_projects", "digest_zero", "020_add_project_sync_digest.sql"},
+	{"clickresearch_visitor_tombstones", "", "021_create_visitor_tombstones.sql"},
+	{"clickresearch_projects", "currency", "022_add_project_revenue.sql"},
+	{"clickresearch_denied_domains", "", "023_create_denied_domains.sql"},
+	{"clickresearch_projects", "report_accent_color", "024_add_project_report_branding.sql"},
+	{"clickresearch_project_domain_aliases", "", "025_create_project_domain_aliases.sql"},
+	{"clickresearch_campaigns", "", "026_create_campaigns.sql"},
+	{"clickresearch_events", "", "027_create_events.sql"},
+}
+
+// missingSchema returns what requiredSchema lacks in present, which holds
+// "table" and "table.column" names, with the migration to apply for each
+func missingSchema(present map[string]bool) []string {
+	var missing []string
+	for _, obj := range requiredSchema {
+		name := obj.table
+		if obj.column != "" {
+			name += "." + obj.column
+		}
+		if present[name] {
+			continue
+		}
+		if obj.migration == "" {
+			missing = append(missing, name+" (base schema)")
+		} else {
+			missing = append(missing, name+" (migrations/"+obj.migration+")")
+		}
+	}
+	return missing
+}
+
+// CheckDB verifies Postgres answers and has every table and column the
+// server uses, naming the migrations that still need to run
+func CheckDB(ctx context.Context, databaseURL string) (string, error) {
+	if databaseURL == "" {
+		return "", fmt.Errorf("DATABASE_URL is not set")
+	}
+	db, err := NewDB(databaseURL)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT table_name, column_name FROM information_schema.columns
+		WHERE table_schema = current_schema()
+	`)
+	if err != nil {
+		return "", fmt.Errorf("reading the schema: %w", err)
+	}
+	defer rows.Close()
+	present := make(map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return "", err
+		}
+		present[table], present[table+"."+column] = true, true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if missing := missingSchema(present); len(missing) > 0 {
+		return "", fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return fmt.Sprintf("schema complete (%d tables and columns checked)", len(requiredSchema)), nil
+}
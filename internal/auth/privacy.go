@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// HandleUpdatePrivacySettings sets which hits a project's visitor-level reports count
+func (h *Handler) HandleUpdatePrivacySettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		PrivacyMode stats.PrivacyMode `json:"privacy_mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	if !req.PrivacyMode.Valid() {
+		writeJSON(w, map[string]string{"error": "privacy_mode must be off, exclude_denied or only_granted"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.SetPrivacyMode(project.ID, req.PrivacyMode); err != nil {
+		writeServerError(w, "Failed to update settings", err)
+		return
+	}
+
+	writeJSON(w, map[string]stats.PrivacyMode{"privacy_mode": req.PrivacyMode}, http.StatusOK)
+}
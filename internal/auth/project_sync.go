@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// errProjectOwnedElsewhere is returned by syncs of a domain another user's project has
+var errProjectOwnedElsewhere = errors.New("domain belongs to a project of another user")
+
+// projectSyncDB is the storage project syncs need; *DB implements it
+type projectSyncDB interface {
+	GetUserByEmail(email string) (*User, error)
+	CreateUser(email, passwordHash string, name *string, syncedFrom *string) (*User, error)
+	CreateProject(userID, domain string, name *string) (*Project, error)
+	GetProjectByDomain(domain string) (*Project, error)
+	SetProjectSyncedFrom(projectID, source string) error
+}
+
+// projectSyncs creates the projects Shortodella syncs. Shortodella retries
+// syncs, so a sync of a project the user already has returns that project.
+type projectSyncs struct {
+	db      projectSyncDB
+	denials *domainDenials
+	// frontendURL serves the tracker script snippets load
+	frontendURL string
+}
+
+func (h *Handler) projectSyncs() projectSyncs {
+	return projectSyncs{db: h.db, denials: h.denials, frontendURL: h.frontendURL}
+}
+
+// sync finds or creates the payload's user and project; created is false when
+// the user already had the project
+func (s projectSyncs) sync(payload SyncProjectPayload) (project *Project, created bool, err error) {
+	user, err := s.db.GetUserByEmail(payload.Email)
+	if err != nil {
+		// User doesn't exist, create one
+		syncedFrom := "shortodella"
+		if user, err = s.db.CreateUser(payload.Email, "", nil, &syncedFrom); err != nil {
+			return nil, false, fmt.Errorf("create user: %w", err)
+		}
+	}
+
+	var name *string
+	if payload.Name != "" {
+		name = &payload.Name
+	}
+	domain := stats.NormalizeHost(payload.Domain)
+	project, err = s.db.CreateProject(user.ID, domain, name)
+	if errors.Is(err, ErrDuplicateProject) {
+		if project, err = s.db.GetProjectByDomain(domain); err != nil {
+			return nil, false, err
+		}
+		if project.UserID != user.ID {
+			return nil, false, errProjectOwnedElsewhere
+		}
+	} else if err != nil {
+		return nil, false, err
+	} else {
+		created = true
+		s.denials.allow(domain)
+	}
+
+	// Tagged projects get a stats digest pushed back to Shortodella; a retry
+	// tags projects whose first sync failed to
+	if err := s.db.SetProjectSyncedFrom(project.ID, digestSource); err != nil {
+		log.Printf("Warning: failed to tag synced project %s: %v", project.Domain, err)
+	}
+	return project, created, nil
+}
+
+// serve syncs payload's project and answers with its API key and snippet:
+// 201 when it was created, 200 when it existed, 409 when another user owns the
+// domain or it's an alias of a project
+func (s projectSyncs) serve(w http.ResponseWriter, payload SyncProjectPayload) {
+	project, created, err := s.sync(payload)
+	if errors.Is(err, ErrDomainIsAlias) {
+		writeJSON(w, map[string]any{
+			"error":  err.Error(),
+			"domain": stats.NormalizeHost(payload.Domain),
+		}, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errProjectOwnedElsewhere) {
+		writeJSON(w, map[string]any{
+			"error":               err.Error(),
+			"domain":              stats.NormalizeHost(payload.Domain),
+			"owned_by_other_user": true,
+		}, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeServerError(w, "Failed to sync project", err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, SyncProjectResponse{
+		Domain:  project.Domain,
+		APIKey:  project.APIKey,
+		Snippet: trackingSnippet(s.frontendURL, project.Domain),
+	}, status)
+}
+
+// defaultFrontendURL serves the tracker script when no frontend URL is set
+const defaultFrontendURL = "https://shortid.me"
+
+// trackingSnippet is the script tag a site embeds to send its events, loading
+// the tracker from frontendURL
+func trackingSnippet(frontendURL, domain string) string {
+	if frontendURL == "" {
+		frontendURL = defaultFrontendURL
+	}
+	return fmt.Sprintf(`<script>
+!function(t,e){if(!e.cr){var n=t.createElement("script");
+n.src="%s/cr.js";n.async=1;
+t.head.appendChild(n);e.cr=function(){
+(e.cr.q=e.cr.q||[]).push(arguments)}}}(document,window);
+
+cr('init', '%s');
+</script>`, strings.TrimSuffix(frontendURL, "/"), domain)
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// HandleProjectReportBranding returns (GET) or updates (PUT) the logo and
+// accent color of a project's reports
+func (h *Handler) HandleProjectReportBranding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method != http.MethodGet && !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	branding, err := h.db.GetProjectReportBranding(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get report branding", err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, branding, http.StatusOK)
+		return
+	}
+
+	// Fields left out of the request keep their current value
+	if err := json.NewDecoder(r.Body).Decode(&branding); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	branding.LogoURL = strings.TrimSpace(branding.LogoURL)
+	branding.AccentColor = strings.ToLower(strings.TrimSpace(branding.AccentColor))
+	if err := branding.Validate(); err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetReportBranding(project.ID, branding); err != nil {
+		writeServerError(w, "Failed to update report branding", err)
+		return
+	}
+
+	writeJSON(w, branding, http.StatusOK)
+}
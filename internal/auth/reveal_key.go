@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/urlbuilder"
+)
+
+// reauthWindow is how long after signing in an admin may reveal API keys
+// without entering their password again
+const reauthWindow = 10 * time.Minute
+
+// RevealKeyRequest re-authenticates an admin whose sign-in is older than reauthWindow
+type RevealKeyRequest struct {
+	Password string `json:"password"`
+}
+
+// keyRevealDB is the storage key reveals need; *DB implements it
+type keyRevealDB interface {
+	loginAttemptDB
+	GetProjectByID(id string) (*Project, error)
+}
+
+// keyReveals hands out the full API keys the admin project list masks
+type keyReveals struct {
+	db     keyRevealDB
+	logins loginGuard
+	urls   urlbuilder.Builder
+	now    func() time.Time
+}
+
+func (h *Handler) keyReveals() keyReveals {
+	return keyReveals{db: h.db, logins: h.logins(), urls: h.urls, now: time.Now}
+}
+
+// recentlyAuthenticated reports whether claims were issued by a sign-in
+// within reauthWindow; tokens from before auth_time existed never are
+func recentlyAuthenticated(claims *Claims, now time.Time) bool {
+	return claims.AuthTime != nil && now.Sub(claims.AuthTime.Time) < reauthWindow
+}
+
+// HandleAdminRevealKey serves POST /api/admin/projects/reveal-key?id=..., the
+// full API key of a project (admin only). Admins who signed in more than
+// reauthWindow ago send their password. Every reveal is audit-logged.
+func (h *Handler) HandleAdminRevealKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := h.bearerClaims(r)
+	if err != nil || claims.Role != "admin" {
+		writeJSON(w, map[string]string{"error": "Admin access required"}, http.StatusForbidden)
+		return
+	}
+	h.keyReveals().serve(w, r, claims)
+}
+
+// serve answers a reveal request of the admin of claims
+func (k keyReveals) serve(w http.ResponseWriter, r *http.Request, claims *Claims) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, map[string]string{"error": "Project ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	var req RevealKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	if !recentlyAuthenticated(claims, k.now()) {
+		if req.Password == "" {
+			writeJSON(w, map[string]string{"error": "Sign in again or enter your password", "code": "reauth_required"}, http.StatusUnauthorized)
+			return
+		}
+		user, err := k.logins.authenticate(claims.Email, req.Password, loginOrigin(r, k.urls))
+		if err == nil && user.ID != claims.UserID {
+			err = errInvalidCredentials
+		}
+		if err != nil {
+			writeLoginError(w, err)
+			return
+		}
+	}
+
+	project, err := k.db.GetProjectByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeServerError(w, "Failed to get project", err)
+		return
+	}
+
+	log.Printf("Audit: API key of project %s (%s) revealed to admin %s", project.ID, project.Domain, claims.Email)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, map[string]string{"id": project.ID, "api_key": project.APIKey}, http.StatusOK)
+}
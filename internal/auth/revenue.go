@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// HandleProjectRevenueSettings returns (GET) or updates (PUT) the event a
+// project records purchases with and the currency its revenue is reported in
+func (h *Handler) HandleProjectRevenueSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method != http.MethodGet && !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	settings, err := h.db.GetProjectRevenueSettings(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get revenue settings", err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, settings, http.StatusOK)
+		return
+	}
+
+	// Fields left out of the request keep their current value
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	settings.Event = strings.TrimSpace(settings.Event)
+	settings.Currency = strings.ToUpper(strings.TrimSpace(settings.Currency))
+	if err := settings.Validate(); err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetRevenueSettings(project.ID, settings); err != nil {
+		writeServerError(w, "Failed to update settings", err)
+		return
+	}
+
+	writeJSON(w, settings, http.StatusOK)
+}
@@ -0,0 +1,102 @@
+package auth
+
+import "net/http"
+
+// Route is an endpoint served by the auth handler
+type Route struct {
+	Path    string
+	Handler http.HandlerFunc
+}
+
+// Routes lists the endpoints of the auth handler. Handlers of other packages
+// wrapped with RequireAdmin are registered by the server itself.
+func (h *Handler) Routes() []Route {
+	routes := []Route{
+		{"/api/auth/register", h.HandleRegister},
+		{"/api/auth/login", h.HandleLogin},
+		{"/api/auth/unlock", h.HandleUnlockLogin},
+		{"/api/auth/demo", h.HandleDemoLogin},
+		{"/api/auth/me", h.HandleMe},
+		{"/api/auth/logout", h.HandleLogout},
+		{"/api/auth/google", h.HandleGoogleLogin},
+		{"/api/auth/google/callback", h.HandleGoogleCallback},
+		{"/api/auth/google/verify", h.HandleGoogleVerify},
+		{"/api/projects", h.HandleGetProjects},
+		{"/api/projects/create", h.Idempotent(h.HandleCreateProject)},
+		{"/api/projects/delete", h.HandleDeleteProject},
+		{"/api/projects/transfer", h.HandleTransferProject},
+		{"/api/projects/keys", h.HandleGetAPIKeys},
+		{"/api/admin/projects", h.HandleAdminProjects},
+		{"/api/admin/projects/limits", h.HandleAdminProjectLimits},
+		{"/api/admin/projects/reveal-key", h.HandleAdminRevealKey},
+		{"/api/admin/users", h.HandleAdminUsers},
+		{"/api/admin/spam-referrers", h.HandleAdminSpamReferrers},
+		{"/api/admin/value-overrides", h.HandleAdminValueOverrides},
+		{"/api/admin/sync-status", h.HandleAdminSyncStatus},
+		{"/api/admin/sync-status/digest", h.HandleAdminTriggerDigest},
+		{"/api/admin/tombstones", h.HandleAdminTombstones},
+		{"/api/sync/domains", h.HandleSyncDomains},
+
+		// Funnel management endpoints
+		{"/api/funnels", h.HandleGetFunnels},
+		{"/api/funnels/create", h.Idempotent(h.HandleCreateFunnel)},
+		{"/api/funnels/update", h.HandleUpdateFunnel},
+		{"/api/funnels/delete", h.HandleDeleteFunnel},
+		{"/api/funnels/history", h.HandleGetFunnelHistory},
+		{"/api/funnels/health", h.HandleGetFunnelHealth},
+
+		// Segment management endpoints
+		{"/api/segments", h.HandleGetSegments},
+		{"/api/segments/create", h.Idempotent(h.HandleCreateSegment)},
+		{"/api/segments/update", h.HandleUpdateSegment},
+		{"/api/segments/delete", h.HandleDeleteSegment},
+
+		// Goal endpoints
+		{"/api/goals", h.HandleGetGoals},
+		{"/api/goals/create", h.Idempotent(h.HandleCreateGoal)},
+		{"/api/goals/delete", h.HandleDeleteGoal},
+
+		// Campaign registry endpoints
+		{"/api/campaigns", h.HandleGetCampaigns},
+		{"/api/campaigns/create", h.Idempotent(h.HandleCreateCampaign)},
+		{"/api/campaigns/update", h.HandleUpdateCampaign},
+		{"/api/campaigns/delete", h.HandleDeleteCampaign},
+		{"/api/campaigns/url", h.HandleCampaignURL},
+
+		// Annotation endpoints
+		{"/api/annotations", h.HandleGetAnnotations},
+		{"/api/annotations/create", h.HandleCreateAnnotation},
+		{"/api/annotations/update", h.HandleUpdateAnnotation},
+		{"/api/annotations/delete", h.HandleDeleteAnnotation},
+		{"/api/annotations/ci", h.HandleCreateAnnotationWithAPIKey},
+
+		// Funnel snapshot endpoints; the public one needs no auth
+		{"/api/stats/funnel-snapshot", h.HandleCreateFunnelSnapshot},
+		{"/api/funnel-snapshots", h.HandleGetFunnelSnapshots},
+		{"/api/funnel-snapshots/delete", h.HandleDeleteFunnelSnapshot},
+		{"/api/public/funnel/", h.HandlePublicFunnelSnapshot},
+
+		// Project settings
+		{"/api/projects/snapshot-settings", h.HandleUpdateSnapshotSettings},
+		{"/api/projects/privacy-settings", h.HandleUpdatePrivacySettings},
+		{"/api/projects/domain-settings", h.HandleUpdateDomainSettings},
+		{"/api/projects/domain-mismatches", h.HandleDomainMismatches},
+		{"/api/projects/revenue-settings", h.HandleProjectRevenueSettings},
+		{"/api/projects/report-branding", h.HandleProjectReportBranding},
+		{"/api/projects/event-names", h.HandleProjectEventNames},
+		{"/api/projects/embed-token", h.HandleCreateEmbedToken},
+		{"/api/projects/embed-token/rotate", h.HandleRotateEmbedSecret},
+		{"/api/projects/exports", h.HandleGetExports},
+		{"/api/projects/exports/create", h.HandleCreateExport},
+		{"/api/projects/exports/delete", h.HandleDeleteExport},
+		{"/api/projects/aliases", h.HandleGetDomainAliases},
+		{"/api/projects/aliases/create", h.HandleCreateDomainAlias},
+		{"/api/projects/aliases/delete", h.HandleDeleteDomainAlias},
+		{"/api/projects/badge", h.HandleProjectBadge},
+		{"/api/projects/erase-visitor", h.HandleEraseVisitor},
+	}
+	if h.domainCache != nil {
+		routes = append(routes, Route{domainInvalidatePath, h.domainCache.HandleInvalidate})
+	}
+	return routes
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultSessionCookie names the session cookie unless SetSessionCookie renames it
+const DefaultSessionCookie = "clickresearch_session"
+
+// Cookie sessions are protected by double submit: mutating requests must echo
+// the CSRF cookie, which other sites can't read, in CSRFHeader
+const (
+	CSRFHeader = "X-CSRF-Token"
+	// oauthCookieFlag remembers across the Google redirect that the client
+	// asked for a cookie session
+	oauthCookieFlag = "clickresearch_oauth_cookie"
+)
+
+// SetSessionCookie renames the session cookie; the CSRF cookie is named after it
+func (h *Handler) SetSessionCookie(name string) {
+	h.sessionCookie = name
+}
+
+func (h *Handler) sessionCookieName() string {
+	if h.sessionCookie == "" {
+		return DefaultSessionCookie
+	}
+	return h.sessionCookie
+}
+
+func (h *Handler) csrfCookieName() string {
+	return h.sessionCookieName() + "_csrf"
+}
+
+// wantsCookie reports whether a sign-in asked for a cookie session rather
+// than a token in the response
+func wantsCookie(r *http.Request) bool {
+	return r.URL.Query().Get("use_cookie") == "true" || r.Header.Get("X-Use-Cookie") == "true"
+}
+
+// setSessionCookies stores token in an HttpOnly cookie next to a fresh CSRF
+// cookie, returning the CSRF token for clients that can't read the cookie
+func (h *Handler) setSessionCookies(w http.ResponseWriter, token string) string {
+	csrf := generateAPIKey()
+	maxAge := int(tokenTTL.Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name: h.sessionCookieName(), Value: token, Path: "/", MaxAge: maxAge,
+		Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name: h.csrfCookieName(), Value: csrf, Path: "/", MaxAge: maxAge,
+		Secure: true, SameSite: http.SameSiteLaxMode,
+	})
+	return csrf
+}
+
+// clearSessionCookies expires the session and CSRF cookies
+func (h *Handler) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{h.sessionCookieName(), h.csrfCookieName()} {
+		http.SetCookie(w, &http.Cookie{
+			Name: name, Path: "/", MaxAge: -1,
+			Secure: true, HttpOnly: name == h.sessionCookieName(), SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// sessionResponse is the body of a sign-in: the token, or when the client
+// asked for a cookie session, the CSRF token of the cookies set instead
+func (h *Handler) sessionResponse(w http.ResponseWriter, r *http.Request, token string, user *User) AuthResponse {
+	if !wantsCookie(r) {
+		return AuthResponse{Token: token, User: user}
+	}
+	return AuthResponse{User: user, CSRFToken: h.setSessionCookies(w, token)}
+}
+
+// sessionToken returns the bearer token of the Authorization header or, for
+// requests without one, of the session cookie. Cookie sessions must pass the
+// CSRF check on anything but safe methods.
+func (h *Handler) sessionToken(r *http.Request) (string, error) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		parts := strings.Split(authHeader, " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			return "", fmt.Errorf("invalid authorization header")
+		}
+		return parts[1], nil
+	}
+
+	cookie, err := r.Cookie(h.sessionCookieName())
+	if err != nil || cookie.Value == "" {
+		return "", fmt.Errorf("no authorization header")
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !h.validCSRF(r) {
+			return "", fmt.Errorf("missing or invalid CSRF token")
+		}
+	}
+	return cookie.Value, nil
+}
+
+// validCSRF reports whether the CSRF header matches the CSRF cookie
+func (h *Handler) validCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(h.csrfCookieName())
+	header := r.Header.Get(CSRFHeader)
+	return err == nil && cookie.Value != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
+
+// HandleLogout ends a cookie session by expiring its cookies. Bearer tokens
+// stay valid until they expire; clients drop them themselves.
+func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.clearSessionCookies(w)
+	writeJSON(w, map[string]string{"status": "logged_out"}, http.StatusOK)
+}
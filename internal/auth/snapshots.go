@@ -0,0 +1,384 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+const (
+	maxSnapshotsPerProject = 100
+	maxSnapshotExpiryDays  = 365
+	// snapshotSlugBytes of randomness (192 bits) keeps public links unguessable
+	snapshotSlugBytes = 24
+	publicFunnelPath  = "/api/public/funnel/"
+)
+
+type FunnelSnapshotRequest struct {
+	Name          string        `json:"name,omitempty"`
+	Period        string        `json:"period"`
+	Steps         []funnel.Step `json:"steps"`
+	Window        int           `json:"window"` // minutes
+	ExpiresInDays int           `json:"expires_in_days,omitempty"`
+}
+
+// SnapshotPayload is the frozen JSON served by the public endpoint
+type SnapshotPayload struct {
+	Name       string              `json:"name,omitempty"`
+	Domain     string              `json:"domain"`
+	Period     string              `json:"period"`
+	From       string              `json:"from"`
+	To         string              `json:"to"`
+	Window     int                 `json:"window"`
+	Steps      []string            `json:"steps"`
+	Result     *stats.FunnelResult `json:"result"`
+	Anonymized bool                `json:"anonymized"`
+	CreatedAt  string              `json:"created_at"`
+}
+
+// SetStatsStore lets snapshot creation run funnel queries
+func (h *Handler) SetStatsStore(store stats.StoreInterface) {
+	h.statsStore = store
+}
+
+// newSnapshotSlug returns a random URL-safe slug
+func newSnapshotSlug() (string, error) {
+	b := make([]byte, snapshotSlugBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// snapshotStepLabels names the funnel steps results have, leaving out
+// exclusions; anonymized snapshots replace pathnames with their position
+func snapshotStepLabels(steps []funnel.Step, anonymized bool) []string {
+	steps = funnel.Included(steps)
+	labels := make([]string, len(steps))
+	for i, step := range steps {
+		switch {
+		case step.Type == "event":
+			labels[i] = "event:" + step.Value
+		case anonymized:
+			labels[i] = fmt.Sprintf("Step %d", i+1)
+		default:
+			labels[i] = step.Value
+		}
+	}
+	return labels
+}
+
+// newSnapshotPayload freezes a funnel result with the labels the public endpoint may show
+func newSnapshotPayload(req *FunnelSnapshotRequest, domain string, from, to time.Time, result *stats.FunnelResult, anonymized bool, now time.Time) SnapshotPayload {
+	labels := snapshotStepLabels(req.Steps, anonymized)
+	for i := range result.Steps {
+		if i < len(labels) {
+			result.Steps[i].Name = labels[i]
+		}
+	}
+	return SnapshotPayload{
+		Name:       req.Name,
+		Domain:     domain,
+		Period:     req.Period,
+		From:       from.Format(time.RFC3339),
+		To:         to.Format(time.RFC3339),
+		Window:     req.Window,
+		Steps:      labels,
+		Result:     result,
+		Anonymized: anonymized,
+		CreatedAt:  now.Format(time.RFC3339),
+	}
+}
+
+// HandleCreateFunnelSnapshot runs a funnel and stores the result under a public slug
+func (h *Handler) HandleCreateFunnelSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	if h.statsStore == nil {
+		writeJSON(w, map[string]string{"error": "Stats not available"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	var req FunnelSnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	if len(funnel.Included(req.Steps)) < 2 {
+		writeJSON(w, map[string]string{"error": "At least 2 steps required"}, http.StatusBadRequest)
+		return
+	}
+	if errs := funnel.ValidateSteps(req.Steps); len(errs) > 0 {
+		writeJSON(w, map[string]string{"error": errs[0].Field + " " + errs[0].Message}, http.StatusBadRequest)
+		return
+	}
+	req.Steps = funnel.NormalizeSteps(req.Steps)
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxSnapshotExpiryDays {
+		writeJSON(w, map[string]string{"error": fmt.Sprintf("expires_in_days must be between 0 and %d", maxSnapshotExpiryDays)}, http.StatusBadRequest)
+		return
+	}
+	if req.Period == "" {
+		req.Period = "7d"
+	}
+	// Default window to 60 minutes if not specified
+	if req.Window <= 0 {
+		req.Window = 60
+	} else if req.Window > funnel.MaxWindow {
+		writeJSON(w, map[string]string{"error": fmt.Sprintf("window must be at most %d minutes (30 days)", funnel.MaxWindow)}, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	from, to, err := stats.PeriodRange(req.Period, now)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	count, err := h.db.CountActiveFunnelSnapshots(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to create snapshot", err)
+		return
+	}
+	if count >= maxSnapshotsPerProject {
+		writeJSON(w, map[string]string{"error": fmt.Sprintf("Snapshot limit of %d reached", maxSnapshotsPerProject)}, http.StatusForbidden)
+		return
+	}
+
+	anonymized, err := h.db.GetSnapshotsAnonymized(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to create snapshot", err)
+		return
+	}
+
+	privacy, err := h.db.PrivacyMode(domain)
+	if err != nil {
+		writeServerError(w, "Failed to create snapshot", err)
+		return
+	}
+
+	ctx, err := stats.AliasContext(stats.WithFunnelCohort(stats.WithPrivacyMode(r.Context(), privacy), stats.CohortEntry), h.db, domain)
+	if err != nil {
+		writeServerError(w, "Failed to create snapshot", err)
+		return
+	}
+	result, err := h.statsStore.GetFunnelAdvanced(ctx, domain, from, to, req.Steps, req.Window)
+	if err != nil {
+		writeServerError(w, "Failed to run funnel", err)
+		return
+	}
+
+	payload, err := json.Marshal(newSnapshotPayload(&req, domain, from, to, result, anonymized, now))
+	if err != nil {
+		writeServerError(w, "Failed to create snapshot", err)
+		return
+	}
+
+	slug, err := newSnapshotSlug()
+	if err != nil {
+		writeServerError(w, "Failed to create snapshot", err)
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := now.AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	snapshot, err := h.db.CreateFunnelSnapshot(project.ID, slug, req.Name, string(payload), anonymized, expiresAt, user.Email)
+	if err != nil {
+		writeServerError(w, "Failed to create snapshot", err)
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"snapshot": snapshot,
+		"url":      h.urls.URL(r, publicFunnelPath+slug),
+	}, http.StatusCreated)
+}
+
+// HandleGetFunnelSnapshots returns all snapshots for a project
+func (h *Handler) HandleGetFunnelSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	snapshots, err := h.db.GetFunnelSnapshotsByProjectID(project.ID)
+	if err != nil {
+		writeServerError(w, "Failed to get snapshots", err)
+		return
+	}
+
+	if snapshots == nil {
+		snapshots = []FunnelSnapshot{}
+	}
+
+	writeJSON(w, snapshots, http.StatusOK)
+}
+
+// HandleDeleteFunnelSnapshot deletes a snapshot, revoking its public link
+func (h *Handler) HandleDeleteFunnelSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	snapshotID := r.URL.Query().Get("id")
+	if domain == "" || snapshotID == "" {
+		writeJSON(w, map[string]string{"error": "Domain and snapshot ID required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.DeleteFunnelSnapshot(snapshotID, project.ID); err != nil {
+		writeServerError(w, "Failed to delete snapshot", err)
+		return
+	}
+
+	writeJSON(w, map[string]string{"status": "deleted"}, http.StatusOK)
+}
+
+// HandleUpdateSnapshotSettings sets whether new snapshots of a project hide pathnames
+func (h *Handler) HandleUpdateSnapshotSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		writeJSON(w, map[string]string{"error": "Domain required"}, http.StatusBadRequest)
+		return
+	}
+
+	// Verify user owns this domain
+	project, err := h.db.GetProjectByDomainAndUserID(domain, user.ID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Anonymize bool `json:"anonymize"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetSnapshotsAnonymized(project.ID, req.Anonymize); err != nil {
+		writeServerError(w, "Failed to update settings", err)
+		return
+	}
+
+	writeJSON(w, map[string]bool{"anonymize": req.Anonymize}, http.StatusOK)
+}
+
+// HandlePublicFunnelSnapshot serves a frozen snapshot without auth or store queries
+func (h *Handler) HandlePublicFunnelSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	slug := strings.TrimPrefix(r.URL.Path, publicFunnelPath)
+	if slug == "" || strings.Contains(slug, "/") || len(slug) > 64 {
+		writeJSON(w, map[string]string{"error": "Snapshot not found"}, http.StatusNotFound)
+		return
+	}
+
+	payload, err := h.db.GetFunnelSnapshotPayload(slug)
+	if err == sql.ErrNoRows {
+		writeJSON(w, map[string]string{"error": "Snapshot not found"}, http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeServerError(w, "Failed to get snapshot", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write([]byte(payload))
+}
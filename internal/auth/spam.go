@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// SetSpamList lets admin changes to spam referrers take effect without a restart
+func (h *Handler) SetSpamList(list *stats.SpamList) {
+	h.spamList = list
+}
+
+// ReloadSpamList loads admin-managed spam referrers from the database into the list
+func (h *Handler) ReloadSpamList() error {
+	if h.spamList == nil {
+		return nil
+	}
+	referrers, err := h.db.GetSpamReferrers()
+	if err != nil {
+		return err
+	}
+	domains := make([]string, len(referrers))
+	for i, r := range referrers {
+		domains[i] = r.Domain
+	}
+	h.spamList.SetExtra(domains)
+	return nil
+}
+
+// HandleAdminSpamReferrers lists (GET), adds (POST {"domain"}) and removes (DELETE ?domain=) spam referrers
+func (h *Handler) HandleAdminSpamReferrers(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.getClaimsFromRequest(r)
+	if err != nil || claims.Role != "admin" {
+		writeJSON(w, map[string]string{"error": "Admin access required"}, http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		referrers, err := h.db.GetSpamReferrers()
+		if err != nil {
+			writeServerError(w, "Failed to get spam referrers", err)
+			return
+		}
+		if referrers == nil {
+			referrers = []SpamReferrer{}
+		}
+		writeJSON(w, referrers, http.StatusOK)
+		return
+
+	case http.MethodPost:
+		var req struct {
+			Domain string `json:"domain"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+			return
+		}
+		domain, err := stats.NormalizeSpamDomain(req.Domain)
+		if err != nil {
+			writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if err := h.db.AddSpamReferrer(domain, claims.Email); err != nil {
+			writeServerError(w, "Failed to add spam referrer", err)
+			return
+		}
+
+	case http.MethodDelete:
+		domain, err := stats.NormalizeSpamDomain(r.URL.Query().Get("domain"))
+		if err != nil {
+			writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if err := h.db.DeleteSpamReferrer(domain); err != nil {
+			writeServerError(w, "Failed to delete spam referrer", err)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.ReloadSpamList(); err != nil {
+		log.Printf("Failed to reload spam referrers: %v", err)
+	}
+	writeJSON(w, map[string]string{"status": "ok"}, http.StatusOK)
+}
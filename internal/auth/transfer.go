@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Mailer sends notification emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SetMailer sets where notification emails go; without one they are only logged
+func (h *Handler) SetMailer(m Mailer) {
+	h.mailer = m
+}
+
+// TransferProjectRequest moves a project to another user, by email
+type TransferProjectRequest struct {
+	ProjectID     string `json:"project_id"`
+	NewOwnerEmail string `json:"new_owner_email"`
+}
+
+var (
+	errTransferForbidden = errors.New("only the project owner or an admin can transfer a project")
+	errTransferSameOwner = errors.New("project already belongs to this user")
+)
+
+// projectTransferDB is the storage transfers need; *DB implements it
+type projectTransferDB interface {
+	GetProjectByID(id string) (*Project, error)
+	GetUserByEmail(email string) (*User, error)
+	GetUserByID(id string) (*User, error)
+	TransferProject(projectID, fromUserID, toUserID, toEmail, initiatedBy string) error
+	CreatePendingTransfer(projectID, fromUserID, toEmail, initiatedBy string) error
+	GetPendingTransfers(email string) ([]ProjectTransfer, error)
+	CompletePendingTransfer(transferID, toUserID string) error
+}
+
+type projectTransfers struct {
+	db          projectTransferDB
+	mailer      Mailer
+	frontendURL string
+}
+
+func (h *Handler) transfers() projectTransfers {
+	return projectTransfers{db: h.db, mailer: h.mailer, frontendURL: h.frontendURL}
+}
+
+// start transfers a project to the user with email, or leaves the transfer
+// pending until that email first logs in. Returns "completed" or "pending".
+func (t projectTransfers) start(actor *User, admin bool, req TransferProjectRequest) (string, error) {
+	project, err := t.db.GetProjectByID(req.ProjectID)
+	if err != nil {
+		return "", err
+	}
+	if project.UserID != actor.ID && !admin {
+		return "", errTransferForbidden
+	}
+
+	owner, err := t.db.GetUserByID(project.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	newOwner, err := t.db.GetUserByEmail(req.NewOwnerEmail)
+	if err == sql.ErrNoRows {
+		if err := t.db.CreatePendingTransfer(project.ID, owner.ID, req.NewOwnerEmail, actor.ID); err != nil {
+			return "", err
+		}
+		log.Printf("Audit: project %s (%s) transfer from %s to %s pending, initiated by %s",
+			project.ID, project.Domain, owner.Email, req.NewOwnerEmail, actor.Email)
+		t.notify(owner.Email, "Project transfer started",
+			fmt.Sprintf("%s will be transferred to %s when they sign in.", project.Domain, req.NewOwnerEmail))
+		t.notify(req.NewOwnerEmail, "A project was transferred to you",
+			fmt.Sprintf("%s transferred %s to you. Sign up or sign in with this email to accept: %s", owner.Email, project.Domain, t.frontendURL))
+		return "pending", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if newOwner.ID == owner.ID {
+		return "", errTransferSameOwner
+	}
+
+	if err := t.db.TransferProject(project.ID, owner.ID, newOwner.ID, newOwner.Email, actor.ID); err != nil {
+		return "", err
+	}
+	log.Printf("Audit: project %s (%s) transferred from %s to %s by %s",
+		project.ID, project.Domain, owner.Email, newOwner.Email, actor.Email)
+	t.notifyCompleted(project.Domain, owner.Email, newOwner.Email)
+	return "completed", nil
+}
+
+// completePending completes the transfers waiting for user's email
+func (t projectTransfers) completePending(user *User) {
+	pending, err := t.db.GetPendingTransfers(user.Email)
+	if err != nil {
+		log.Printf("Project transfers for %s: %v", user.Email, err)
+		return
+	}
+	for _, p := range pending {
+		if err := t.db.CompletePendingTransfer(p.ID, user.ID); err != nil {
+			log.Printf("Project transfer %s: %v", p.ID, err)
+			continue
+		}
+		log.Printf("Audit: project %s (%s) transferred from %s to %s on first login",
+			p.ProjectID, p.Domain, p.FromUserID, user.Email)
+		from := p.FromUserID
+		if owner, err := t.db.GetUserByID(p.FromUserID); err == nil {
+			from = owner.Email
+		}
+		t.notifyCompleted(p.Domain, from, user.Email)
+	}
+}
+
+func (t projectTransfers) notifyCompleted(domain, fromEmail, toEmail string) {
+	t.notify(fromEmail, "Project transferred",
+		fmt.Sprintf("%s now belongs to %s.", domain, toEmail))
+	t.notify(toEmail, "You are now a project owner",
+		fmt.Sprintf("%s transferred %s to you: %s", fromEmail, domain, t.frontendURL))
+}
+
+func (t projectTransfers) notify(to, subject, body string) {
+	if t.mailer == nil {
+		log.Printf("Mail to %s: %s", to, subject)
+		return
+	}
+	if err := t.mailer.Send(to, subject, body); err != nil {
+		log.Printf("Mail to %s: %v", to, err)
+	}
+}
+
+// completePendingTransfers runs after a login; failures don't block it
+func (h *Handler) completePendingTransfers(user *User) {
+	if user.Role == "demo" {
+		return
+	}
+	h.transfers().completePending(user)
+}
+
+// HandleTransferProject moves a project to another user
+func (h *Handler) HandleTransferProject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.requireWrite(w, r) {
+		return
+	}
+
+	user, err := h.getUserFromRequest(r)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "Unauthorized"}, http.StatusUnauthorized)
+		return
+	}
+
+	var req TransferProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, map[string]string{"error": "Invalid request"}, http.StatusBadRequest)
+		return
+	}
+	req.NewOwnerEmail = strings.TrimSpace(req.NewOwnerEmail)
+	if req.ProjectID == "" || !strings.Contains(req.NewOwnerEmail, "@") {
+		writeJSON(w, map[string]string{"error": "project_id and new_owner_email required"}, http.StatusBadRequest)
+		return
+	}
+
+	status, err := h.transfers().start(user, h.isAdmin(r), req)
+	switch {
+	case err == sql.ErrNoRows:
+		writeJSON(w, map[string]string{"error": "Project not found"}, http.StatusNotFound)
+	case err == errTransferForbidden:
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusForbidden)
+	case err == errTransferSameOwner:
+		writeJSON(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+	case err != nil:
+		writeServerError(w, "Failed to transfer project", err)
+	default:
+		writeJSON(w, map[string]string{"status": status}, http.StatusOK)
+	}
+}
@@ -3,6 +3,7 @@ package cache
 import (
 	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,31 +15,82 @@ type item struct {
 type Cache struct {
 	mu    sync.RWMutex
 	items map[string]item
-	ttl   time.Duration
+	ttl   atomic.Int64 // nanoseconds; see SetTTL
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// Stats is a point-in-time view of cache usage
+type Stats struct {
+	Entries  int     `json:"entries"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
 }
 
 func New(ttl time.Duration) *Cache {
 	c := &Cache{
 		items: make(map[string]item),
-		ttl:   ttl,
 	}
+	c.ttl.Store(int64(ttl))
 	go c.cleanup()
 	return c
 }
 
+// TTL is how long new entries are kept
+func (c *Cache) TTL() time.Duration {
+	return time.Duration(c.ttl.Load())
+}
+
+// SetTTL changes the lifetime of entries set from now on; existing entries keep theirs
+func (c *Cache) SetTTL(ttl time.Duration) {
+	if ttl > 0 {
+		c.ttl.Store(int64(ttl))
+	}
+}
+
 func (c *Cache) Get(key string, dest any) bool {
 	c.mu.RLock()
 	it, ok := c.items[key]
 	c.mu.RUnlock()
 
 	if !ok || time.Now().After(it.expiresAt) {
+		c.misses.Add(1)
+		return false
+	}
+
+	if json.Unmarshal(it.data, dest) != nil {
+		c.misses.Add(1)
 		return false
 	}
+	c.hits.Add(1)
+	return true
+}
 
-	return json.Unmarshal(it.data, dest) == nil
+// Stats returns entry count and hit/miss counters since start
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	entries := len(c.items)
+	c.mu.RUnlock()
+
+	st := Stats{
+		Entries: entries,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+	}
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	return st
 }
 
 func (c *Cache) Set(key string, val any) {
+	c.SetWithTTL(key, val, c.TTL())
+}
+
+// SetWithTTL caches val for ttl rather than the cache's TTL
+func (c *Cache) SetWithTTL(key string, val any, ttl time.Duration) {
 	data, err := json.Marshal(val)
 	if err != nil {
 		return
@@ -47,14 +99,28 @@ func (c *Cache) Set(key string, val any) {
 	c.mu.Lock()
 	c.items[key] = item{
 		data:      data,
-		expiresAt: time.Now().Add(c.ttl),
+		expiresAt: time.Now().Add(ttl),
 	}
 	c.mu.Unlock()
 }
 
+// DeleteFunc removes the entries whose key matches and returns how many there were
+func (c *Cache) DeleteFunc(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k := range c.items {
+		if match(k) {
+			delete(c.items, k)
+			n++
+		}
+	}
+	return n
+}
+
 func (c *Cache) cleanup() {
 	for {
-		time.Sleep(c.ttl)
+		time.Sleep(c.TTL())
 		c.mu.Lock()
 		now := time.Now()
 		for k, v := range c.items {
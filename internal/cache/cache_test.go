@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -125,3 +126,71 @@ func TestCache_Concurrent(t *testing.T) {
 	<-done
 	<-done
 }
+
+func TestCache_Stats(t *testing.T) {
+	c := New(1 * time.Minute)
+	c.Set("key1", "value")
+
+	var result string
+	c.Get("key1", &result)
+	c.Get("key1", &result)
+	c.Get("missing", &result)
+
+	st := c.Stats()
+	if st.Entries != 1 || st.Hits != 2 || st.Misses != 1 {
+		t.Errorf("Stats = %+v, want 1 entry, 2 hits, 1 miss", st)
+	}
+	if st.HitRatio < 0.66 || st.HitRatio > 0.67 {
+		t.Errorf("HitRatio = %v, want ~0.667", st.HitRatio)
+	}
+}
+
+func TestCache_SetTTL(t *testing.T) {
+	c := New(time.Hour)
+	c.SetTTL(50 * time.Millisecond)
+	c.Set("key", "value")
+
+	time.Sleep(100 * time.Millisecond)
+	var result string
+	if c.Get("key", &result) {
+		t.Error("entry set after SetTTL should use the new TTL")
+	}
+
+	c.SetTTL(0)
+	if c.TTL() != 50*time.Millisecond {
+		t.Errorf("TTL = %v, SetTTL(0) should be ignored", c.TTL())
+	}
+}
+
+func TestCache_SetWithTTL(t *testing.T) {
+	c := New(50 * time.Millisecond)
+	c.SetWithTTL("long", "value", time.Hour)
+	c.Set("short", "value")
+
+	time.Sleep(100 * time.Millisecond)
+	var result string
+	if !c.Get("long", &result) {
+		t.Error("entry set with a longer TTL expired with the cache's TTL")
+	}
+	if c.Get("short", &result) {
+		t.Error("entry set with the cache's TTL should have expired")
+	}
+}
+
+func TestCache_DeleteFunc(t *testing.T) {
+	c := New(1 * time.Minute)
+	c.Set("overview:a.com:7d", 1)
+	c.Set("pages:a.com:30d", 2)
+	c.Set("overview:b.com:7d", 3)
+
+	if n := c.DeleteFunc(func(key string) bool { return strings.Contains(key, ":a.com:") }); n != 2 {
+		t.Errorf("DeleteFunc removed %d entries, want 2", n)
+	}
+	var v int
+	if c.Get("pages:a.com:30d", &v) {
+		t.Error("matching entry kept")
+	}
+	if !c.Get("overview:b.com:7d", &v) || v != 3 {
+		t.Error("other entry removed")
+	}
+}
@@ -0,0 +1,264 @@
+// Package config holds the settings that can change while the server runs.
+// They are read from the environment, overridden by an optional KEY=VALUE
+// file, and reloaded on SIGHUP or from the admin endpoint.
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultCORSOrigins are allowed when CORS_ORIGINS is not set
+var DefaultCORSOrigins = []string{"https://shortid.me", "http://localhost:3000", "http://localhost:3003"}
+
+// DefaultCacheTTL is how long stats responses are cached when CACHE_TTL is not set
+const DefaultCacheTTL = 5 * time.Minute
+
+// staticKeys are read once at startup; changing them needs a restart
+var staticKeys = []string{
+	"PORT", "DATABASE_URL", "STATS_DATABASE_URL", "USE_CLICKHOUSE", "CLICKHOUSE_ADDR", "CLICKHOUSE_DB",
+	"S3_ENDPOINT", "S3_BUCKET", "S3_PREFIX", "S3_URL_STYLE", "S3_REGION", "S3_USE_SSL",
+	"S3_CREDENTIALS_MODE", "LOCAL_PARQUET_PATH", "JWT_SECRET", "PUBLIC_URL", "TRUST_PROXY_HEADERS",
+}
+
+// Dynamic is one snapshot of the reloadable settings
+type Dynamic struct {
+	CORSOrigins          []string      // CORS_ORIGINS, comma separated
+	QueryBudgetPerMinute int           // QUERY_BUDGET_PER_MINUTE; 0 disables the budget
+	QueryBudgetExempt    []string      // QUERY_BUDGET_EXEMPT, comma separated
+	CacheTTL             time.Duration // CACHE_TTL
+	RefreshInterval      time.Duration // REFRESH_INTERVAL; 0 uses the store's default
+}
+
+// parse reads the dynamic settings through lookup, reporting every invalid value
+func parse(lookup func(string) string) (Dynamic, error) {
+	d := Dynamic{
+		CORSOrigins:       list(lookup("CORS_ORIGINS")),
+		QueryBudgetExempt: list(lookup("QUERY_BUDGET_EXEMPT")),
+		CacheTTL:          DefaultCacheTTL,
+	}
+	if len(d.CORSOrigins) == 0 {
+		d.CORSOrigins = DefaultCORSOrigins
+	}
+
+	var errs []error
+	if v := lookup("QUERY_BUDGET_PER_MINUTE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("QUERY_BUDGET_PER_MINUTE must be a non-negative integer"))
+		}
+		d.QueryBudgetPerMinute = n
+	}
+	for key, dst := range map[string]*time.Duration{"CACHE_TTL": &d.CacheTTL, "REFRESH_INTERVAL": &d.RefreshInterval} {
+		v := lookup(key)
+		if v == "" {
+			continue
+		}
+		t, err := time.ParseDuration(v)
+		if err != nil || t <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive duration such as 5m", key))
+		}
+		*dst = t
+	}
+	return d, errors.Join(errs...)
+}
+
+// list splits a comma separated value, dropping empty entries
+func list(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// readFile parses KEY=VALUE lines; blank lines, # comments, "export " and quotes are allowed
+func readFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, sc.Err()
+}
+
+// Reloader keeps the current Dynamic snapshot and replaces it on reload.
+// A reload with an invalid value keeps the previous snapshot whole.
+type Reloader struct {
+	path    string // optional KEY=VALUE file overriding the environment
+	getenv  func(string) string
+	warnf   func(format string, args ...any)
+	current atomic.Pointer[Dynamic]
+	static  map[string]string // static settings as they were at startup
+
+	mu        sync.Mutex // serializes reloads and their callbacks
+	callbacks []func(Dynamic)
+}
+
+// New loads the settings from the environment and, if path is set, the file at path
+func New(path string, getenv func(string) string) (*Reloader, error) {
+	r := &Reloader{path: path, getenv: getenv, warnf: log.Printf}
+	lookup, err := r.lookup()
+	if err != nil {
+		return nil, err
+	}
+	d, err := parse(lookup)
+	if err != nil {
+		return nil, err
+	}
+	r.current.Store(&d)
+	r.static = make(map[string]string, len(staticKeys))
+	for _, key := range staticKeys {
+		r.static[key] = lookup(key)
+	}
+	return r, nil
+}
+
+// lookup reads the file again and returns its values over the environment's
+func (r *Reloader) lookup() (func(string) string, error) {
+	var file map[string]string
+	if r.path != "" {
+		var err error
+		if file, err = readFile(r.path); err != nil {
+			return nil, err
+		}
+	}
+	return func(key string) string {
+		if v, ok := file[key]; ok {
+			return v
+		}
+		return r.getenv(key)
+	}, nil
+}
+
+// Current returns the settings in effect
+func (r *Reloader) Current() Dynamic {
+	return *r.current.Load()
+}
+
+// OnReload runs fn with the current settings now and with the new ones after every reload
+func (r *Reloader) OnReload(fn func(Dynamic)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.callbacks = append(r.callbacks, fn)
+	fn(r.Current())
+}
+
+// Reload re-reads the settings and applies them. Changed static settings are
+// logged and ignored until the next restart.
+func (r *Reloader) Reload() (Dynamic, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lookup, err := r.lookup()
+	if err != nil {
+		return r.Current(), err
+	}
+	d, err := parse(lookup)
+	if err != nil {
+		return r.Current(), err
+	}
+	for _, key := range staticKeys {
+		if lookup(key) != r.static[key] {
+			r.warnf("Warning: %s changed but is not reloadable; restart to apply it", key)
+		}
+	}
+	r.current.Store(&d)
+	for _, fn := range r.callbacks {
+		fn(d)
+	}
+	return d, nil
+}
+
+// WatchSignals reloads on every SIGHUP until stop is called
+func (r *Reloader) WatchSignals() (stop func()) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigCh:
+				if _, err := r.Reload(); err != nil {
+					log.Printf("Config reload failed, keeping previous settings: %v", err)
+				} else {
+					log.Println("Config reloaded")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
+
+// settingsResponse shows the settings in effect after a reload
+type settingsResponse struct {
+	CORSOrigins          []string `json:"cors_origins"`
+	QueryBudgetPerMinute int      `json:"query_budget_per_minute"`
+	QueryBudgetExempt    []string `json:"query_budget_exempt"`
+	CacheTTL             string   `json:"cache_ttl"`
+	RefreshInterval      string   `json:"refresh_interval,omitempty"`
+}
+
+// HandleReload reloads the settings (POST) and answers the ones in effect;
+// invalid values are answered with 400 and leave the settings unchanged
+func (r *Reloader) HandleReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	d, err := r.Reload()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	resp := settingsResponse{
+		CORSOrigins:          d.CORSOrigins,
+		QueryBudgetPerMinute: d.QueryBudgetPerMinute,
+		QueryBudgetExempt:    d.QueryBudgetExempt,
+		CacheTTL:             d.CacheTTL.String(),
+	}
+	if d.RefreshInterval > 0 {
+		resp.RefreshInterval = d.RefreshInterval.String()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
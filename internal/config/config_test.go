@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/cors"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func env(values map[string]string) func(string) string {
+	return func(key string) string { return values[key] }
+}
+
+func TestNew_FileOverridesEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.env")
+	writeFile(t, path, "# reloadable\nexport CACHE_TTL=\"90s\"\nQUERY_BUDGET_EXEMPT = a.com, b.com\n")
+
+	r, err := New(path, env(map[string]string{"CACHE_TTL": "1m", "QUERY_BUDGET_PER_MINUTE": "60"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := r.Current()
+	if d.CacheTTL != 90*time.Second || d.QueryBudgetPerMinute != 60 || strings.Join(d.QueryBudgetExempt, ",") != "a.com,b.com" {
+		t.Errorf("settings = %+v", d)
+	}
+	if strings.Join(d.CORSOrigins, ",") != strings.Join(DefaultCORSOrigins, ",") {
+		t.Errorf("CORSOrigins = %v, want defaults", d.CORSOrigins)
+	}
+}
+
+func TestReload_CORSMiddlewarePicksUpOrigins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.env")
+	writeFile(t, path, "CORS_ORIGINS=https://old.example.com\n")
+	r, err := New(path, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origins := cors.NewOrigins(nil)
+	r.OnReload(func(d Dynamic) { origins.Set(d.CORSOrigins) })
+	h := cors.Middleware(cors.Config{Origins: origins}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	allowed := func(origin string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/stats/overview", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Header().Get("Access-Control-Allow-Origin") == origin
+	}
+
+	if !allowed("https://old.example.com") || allowed("https://new.example.com") {
+		t.Fatal("origins before reload not applied")
+	}
+	writeFile(t, path, "CORS_ORIGINS=https://new.example.com\n")
+	if _, err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if allowed("https://old.example.com") || !allowed("https://new.example.com") {
+		t.Error("origins after reload not applied")
+	}
+}
+
+func TestReload_InvalidValueKeepsPrevious(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.env")
+	writeFile(t, path, "CACHE_TTL=2m\nQUERY_BUDGET_PER_MINUTE=30\n")
+	r, err := New(path, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	r.OnReload(func(Dynamic) { calls++ })
+
+	writeFile(t, path, "CACHE_TTL=soon\nQUERY_BUDGET_PER_MINUTE=60\n")
+	if _, err := r.Reload(); err == nil || !strings.Contains(err.Error(), "CACHE_TTL") {
+		t.Fatalf("err = %v, want CACHE_TTL error", err)
+	}
+	if d := r.Current(); d.CacheTTL != 2*time.Minute || d.QueryBudgetPerMinute != 30 {
+		t.Errorf("settings = %+v, want previous", d)
+	}
+	if calls != 1 {
+		t.Errorf("callbacks ran %d times, want only on registration", calls)
+	}
+}
+
+func TestReload_WarnsOnStaticChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.env")
+	writeFile(t, path, "PORT=8080\nCACHE_TTL=1m\n")
+	r, err := New(path, env(map[string]string{"DATABASE_URL": "postgres://a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	r.warnf = func(format string, args ...any) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+
+	writeFile(t, path, "PORT=9090\nCACHE_TTL=3m\n")
+	d, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.CacheTTL != 3*time.Minute {
+		t.Errorf("CacheTTL = %v, want 3m", d.CacheTTL)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "PORT") {
+		t.Errorf("warnings = %q, want one about PORT", warnings)
+	}
+}
+
+func TestWatchSignals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.env")
+	writeFile(t, path, "REFRESH_INTERVAL=1m\n")
+	r, err := New(path, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan Dynamic, 1)
+	r.OnReload(func(d Dynamic) {
+		select {
+		case reloaded <- d:
+		default:
+		}
+	})
+	<-reloaded
+
+	stop := r.WatchSignals()
+	defer stop()
+	writeFile(t, path, "REFRESH_INTERVAL=30s\n")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-reloaded:
+		if d.RefreshInterval != 30*time.Second {
+			t.Errorf("RefreshInterval = %v, want 30s", d.RefreshInterval)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload after SIGHUP")
+	}
+}
+
+func TestHandleReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.env")
+	writeFile(t, path, "CACHE_TTL=1m\n")
+	r, err := New(path, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r.HandleReload(w, httptest.NewRequest(http.MethodGet, "/api/admin/reload-config", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", w.Code)
+	}
+
+	writeFile(t, path, "CACHE_TTL=10m\n")
+	w = httptest.NewRecorder()
+	r.HandleReload(w, httptest.NewRequest(http.MethodPost, "/api/admin/reload-config", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"cache_ttl":"10m0s"`) {
+		t.Errorf("POST = %d %s", w.Code, w.Body)
+	}
+
+	writeFile(t, path, "QUERY_BUDGET_PER_MINUTE=lots\n")
+	w = httptest.NewRecorder()
+	r.HandleReload(w, httptest.NewRequest(http.MethodPost, "/api/admin/reload-config", nil))
+	if w.Code != http.StatusBadRequest || r.Current().CacheTTL != 10*time.Minute {
+		t.Errorf("invalid POST = %d, CacheTTL %v", w.Code, r.Current().CacheTTL)
+	}
+}
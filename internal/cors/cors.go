@@ -0,0 +1,92 @@
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxAge is how long browsers may cache a preflight when none is configured
+const DefaultMaxAge = 600 * time.Second
+
+type Config struct {
+	AllowedOrigins []string
+	// Origins, when set, is used instead of AllowedOrigins and can change while serving
+	Origins        *Origins
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposeHeaders lists response headers the frontend may read, e.g. Retry-After
+	ExposeHeaders []string
+	// MaxAge lets browsers reuse a preflight instead of repeating it per request
+	MaxAge time.Duration
+}
+
+// Origins is a replaceable set of allowed origins; requests read the current set
+type Origins struct {
+	allowed atomic.Pointer[map[string]bool]
+}
+
+func NewOrigins(origins []string) *Origins {
+	o := &Origins{}
+	o.Set(origins)
+	return o
+}
+
+// Set replaces the allowed origins for requests from now on
+func (o *Origins) Set(origins []string) {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	o.allowed.Store(&allowed)
+}
+
+// Allowed reports whether origin may make credentialed requests
+func (o *Origins) Allowed(origin string) bool {
+	return (*o.allowed.Load())[origin]
+}
+
+// Middleware answers preflights and adds CORS headers for allowed origins.
+// Requests from other origins get no CORS headers, so browsers block them.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DefaultMaxAge
+	}
+	origins := cfg.Origins
+	if origins == nil {
+		origins = NewOrigins(cfg.AllowedOrigins)
+	}
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	expose := strings.Join(cfg.ExposeHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses differ per origin, so shared caches must key on it
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		allowed := origins.Allowed(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			if expose != "" {
+				w.Header().Set("Access-Control-Expose-Headers", expose)
+			}
+		}
+
+		if r.Method == http.MethodOptions {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
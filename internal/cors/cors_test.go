@@ -0,0 +1,101 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHandler() (http.Handler, *int) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	return Middleware(Config{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		ExposeHeaders:  []string{"Retry-After", "X-RateLimit-Remaining"},
+	}, next), &calls
+}
+
+func TestMiddleware_AllowedOrigin(t *testing.T) {
+	h, calls := newTestHandler()
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/api/stats/overview", nil)
+	preflight.Header.Set("Origin", "https://app.example.com")
+	preflight.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, preflight)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("preflight status = %d, want 200", w.Code)
+	}
+	if *calls != 0 {
+		t.Error("preflight reached the wrapped handler")
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "Content-Type, Authorization",
+		"Access-Control-Max-Age":           "600",
+		"Vary":                             "Origin",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("preflight %s = %q, want %q", k, got, v)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stats/overview", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if *calls != 1 {
+		t.Errorf("wrapped handler called %d times, want 1", *calls)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Allow-Origin = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != "Retry-After, X-RateLimit-Remaining" {
+		t.Errorf("Expose-Headers = %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Vary = %q, want Origin", got)
+	}
+}
+
+func TestMiddleware_DisallowedOrigin(t *testing.T) {
+	h, _ := newTestHandler()
+
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		req := httptest.NewRequest(method, "/api/stats/overview", nil)
+		req.Header.Set("Origin", "https://evil.example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		for k := range w.Header() {
+			if strings.HasPrefix(k, "Access-Control") {
+				t.Errorf("%s: unexpected header %s for disallowed origin", method, k)
+			}
+		}
+	}
+}
+
+func TestMiddleware_MaxAge(t *testing.T) {
+	h := Middleware(Config{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: time.Hour}, http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "3600" {
+		t.Errorf("Max-Age = %q, want 3600", got)
+	}
+}
@@ -0,0 +1,235 @@
+// Package errorsink keeps the most recent server errors in memory so admins can
+// inspect them without log aggregation. Records are per process and lost on restart.
+package errorsink
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSize is how many records a sink keeps
+const DefaultSize = 500
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// Record is one error response
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error"`
+	User      string    `json:"user,omitempty"`
+	Domain    string    `json:"domain,omitempty"`
+}
+
+// Sink is a fixed-size ring buffer of records, safe for concurrent use
+type Sink struct {
+	mu      sync.Mutex
+	records []Record
+	next    int
+	full    bool
+	started time.Time
+	user    func(*http.Request) string
+}
+
+// New returns a sink keeping the last size records
+func New(size int) *Sink {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &Sink{records: make([]Record, size), started: time.Now()}
+}
+
+// SetUserFunc sets how records name the requesting user; without one they don't
+func (s *Sink) SetUserFunc(fn func(*http.Request) string) {
+	s.user = fn
+}
+
+// Add stores rec, dropping the oldest record once the sink is full
+func (s *Sink) Add(rec Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[s.next] = rec
+	s.next = (s.next + 1) % len(s.records)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// Recent returns the stored records newest first, keeping those whose route
+// starts with route (if set) and that happened after since (if set)
+func (s *Sink) Recent(route string, since time.Time) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.next
+	if s.full {
+		n = len(s.records)
+	}
+	out := []Record{}
+	for i := 1; i <= n; i++ {
+		rec := s.records[(s.next-i+len(s.records))%len(s.records)]
+		if route != "" && !strings.HasPrefix(rec.Route, route) {
+			continue
+		}
+		if !since.IsZero() && !rec.Time.After(since) {
+			continue
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// Middleware gives each request an ID, echoed in X-Request-ID, and lets
+// handlers below it Report errors to s
+func Middleware(s *Sink, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(&writer{ResponseWriter: w, sink: s, req: r, id: id}, r)
+	})
+}
+
+// Report records err as the cause of the error response w is about to carry.
+// It does nothing for writers that didn't come through Middleware.
+func Report(w http.ResponseWriter, err error, status int) {
+	if err == nil {
+		return
+	}
+	ew := findWriter(w)
+	if ew == nil {
+		return
+	}
+	r := ew.req
+	rec := Record{
+		Time:      time.Now().UTC(),
+		RequestID: ew.id,
+		Method:    r.Method,
+		Route:     redactRoute(r.URL.Path),
+		Status:    status,
+		Error:     Redact(err.Error()),
+		Domain:    r.URL.Query().Get("domain"),
+	}
+	if ew.sink.user != nil {
+		rec.User = ew.sink.user(r)
+	}
+	ew.sink.Add(rec)
+}
+
+// writer ties a response to its request for Report
+type writer struct {
+	http.ResponseWriter
+	sink *Sink
+	req  *http.Request
+	id   string
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush streams
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// findWriter follows Unwrap through other middleware's writers
+func findWriter(w http.ResponseWriter) *writer {
+	for w != nil {
+		if ew, ok := w.(*writer); ok {
+			return ew
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+	return nil
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Authorization headers and bearer tokens
+	{regexp.MustCompile(`(?i)(authorization:?\s*)\S+(\s+\S+)?`), "${1}[redacted]"},
+	{regexp.MustCompile(`(?i)(bearer\s+)\S+`), "${1}[redacted]"},
+	// JWTs anywhere
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), "[redacted]"},
+	// Credentials in connection strings and URLs
+	{regexp.MustCompile(`://([^:/@\s]+):[^@\s]+@`), "://${1}:[redacted]@"},
+	// key=value and key: value pairs with secret-sounding keys
+	{regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[_-]?key|access[_-]?key|s3[_-]?key)["']?\s*[=:]\s*["']?)[^\s"'&,;]+`), "${1}[redacted]"},
+}
+
+// Redact masks credentials, tokens and Authorization headers in s
+func Redact(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// routeTokenPattern matches long opaque path segments such as share tokens
+var routeTokenPattern = regexp.MustCompile(`/[A-Za-z0-9_-]{20,}`)
+
+func redactRoute(path string) string {
+	return routeTokenPattern.ReplaceAllString(path, "/[redacted]")
+}
+
+// HandleErrors lists recent error records, newest first, optionally filtered by
+// a route prefix and an RFC 3339 since time. Admin-only; wrapped by auth in main.
+func (s *Sink) HandleErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "since must be an RFC 3339 time"})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": s.Recent(r.URL.Query().Get("route"), since),
+		"meta": map[string]any{
+			"capacity":      len(s.records),
+			"process_start": s.started.UTC(),
+			"scope":         "process",
+			"note":          "Errors are kept in memory by this server process only and are lost on restart",
+		},
+	})
+}
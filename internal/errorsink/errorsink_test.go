@@ -0,0 +1,137 @@
+package errorsink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSink_KeepsLastRecords(t *testing.T) {
+	s := New(3)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		route := "/api/stats/overview"
+		if i%2 == 1 {
+			route = "/api/projects"
+		}
+		s.Add(Record{Time: base.Add(time.Duration(i) * time.Minute), Route: route, Error: fmt.Sprint(i)})
+	}
+
+	got := s.Recent("", time.Time{})
+	if len(got) != 3 || got[0].Error != "4" || got[2].Error != "2" {
+		t.Fatalf("Recent = %+v, want records 4, 3, 2", got)
+	}
+	if got := s.Recent("/api/stats/", time.Time{}); len(got) != 2 || got[0].Error != "4" || got[1].Error != "2" {
+		t.Errorf("route filter = %+v, want records 4, 2", got)
+	}
+	if got := s.Recent("", base.Add(3*time.Minute)); len(got) != 1 || got[0].Error != "4" {
+		t.Errorf("since filter = %+v, want record 4", got)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, tt := range []struct {
+		in, leaked string
+	}{
+		{"Authorization: Bearer abc.def.ghi rejected", "abc.def.ghi"},
+		{"token eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig expired", "eyJzdWIiOiIxIn0"},
+		{"dial postgres://app:hunter2@db:5432/app failed", "hunter2"},
+		{"s3: invalid access_key=AKIA123 secret=shh", "AKIA123"},
+		{"s3: invalid access_key=AKIA123 secret=shh", "shh"},
+		{`config {"password": "pw1"}`, "pw1"},
+	} {
+		got := Redact(tt.in)
+		if strings.Contains(got, tt.leaked) {
+			t.Errorf("Redact(%q) = %q, leaks %q", tt.in, got, tt.leaked)
+		}
+	}
+	if got := Redact("query timed out"); got != "query timed out" {
+		t.Errorf("Redact changed a plain message: %q", got)
+	}
+}
+
+// unwrapWriter stands in for other middleware's response writers
+type unwrapWriter struct {
+	http.ResponseWriter
+}
+
+func (w unwrapWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func TestMiddleware_Report(t *testing.T) {
+	s := New(DefaultSize)
+	s.SetUserFunc(func(r *http.Request) string { return "admin@example.com" })
+	h := Middleware(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Report(unwrapWriter{w}, errors.New("connect: password=secret1 refused"), http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/public/funnel/AbCdEfGhIjKlMnOpQrStUv?domain=example.com", nil)
+	req.Header.Set("Authorization", "Bearer token-value")
+	req.Header.Set(requestIDHeader, "req-123")
+	h.ServeHTTP(w, req)
+
+	if got := w.Header().Get(requestIDHeader); got != "req-123" {
+		t.Errorf("%s = %q, want the incoming ID", requestIDHeader, got)
+	}
+	recs := s.Recent("", time.Time{})
+	if len(recs) != 1 {
+		t.Fatalf("records = %+v, want 1", recs)
+	}
+	rec := recs[0]
+	if rec.RequestID != "req-123" || rec.Status != 500 || rec.User != "admin@example.com" || rec.Domain != "example.com" {
+		t.Errorf("record = %+v", rec)
+	}
+	if rec.Route != "/api/public/funnel/[redacted]" {
+		t.Errorf("route = %q, want the share token redacted", rec.Route)
+	}
+	if strings.Contains(rec.Error, "secret1") {
+		t.Errorf("error = %q, leaks the password", rec.Error)
+	}
+
+	// Without the middleware there is nowhere to report to
+	Report(httptest.NewRecorder(), errors.New("lost"), 500)
+	if len(s.Recent("", time.Time{})) != 1 {
+		t.Error("Report outside the middleware was recorded")
+	}
+}
+
+func TestMiddleware_GeneratesRequestID(t *testing.T) {
+	h := Middleware(New(1), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/projects", nil)
+	req.Header.Set(requestIDHeader, "bad id\n")
+	h.ServeHTTP(w, req)
+	if got := w.Header().Get(requestIDHeader); len(got) != 16 {
+		t.Errorf("%s = %q, want a generated ID", requestIDHeader, got)
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	s := New(DefaultSize)
+	s.Add(Record{Time: time.Now().UTC(), Route: "/api/stats/pages", Error: "boom"})
+
+	w := httptest.NewRecorder()
+	s.HandleErrors(w, httptest.NewRequest("GET", "/api/admin/errors?route=/api/stats/", nil))
+	var resp struct {
+		Errors []Record       `json:"errors"`
+		Meta   map[string]any `json:"meta"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Errors) != 1 || resp.Meta["capacity"] != float64(DefaultSize) || resp.Meta["process_start"] == nil {
+		t.Errorf("response = %+v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	s.HandleErrors(w, httptest.NewRequest("GET", "/api/admin/errors?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad since: status = %d, want 400", w.Code)
+	}
+}
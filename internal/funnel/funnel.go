@@ -0,0 +1,197 @@
+// Package funnel defines funnels as saved by users and run by the stats
+// stores, so both sides share one step type and one set of rules.
+package funnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+)
+
+// Step is one step of a funnel: a pageview of a path, or an event by name
+type Step struct {
+	Type  string `json:"type"` // pageview, event
+	Value string `json:"value"`
+	// Text, Tag and Href match event props case-insensitively; a leading ~
+	// matches values containing the rest
+	Text string `json:"text,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+	Href string `json:"href,omitempty"`
+	// Exclude makes the step an exclusion: visitors it matches between the
+	// surrounding steps don't convert to the next one
+	Exclude bool `json:"exclude,omitempty"`
+}
+
+// MaxExclusions caps the exclusion steps of a funnel
+const MaxExclusions = 3
+
+// MaxWindow caps the minutes a funnel allows between steps at 30 days; entry
+// cohorts read events up to the window past their range
+const MaxWindow = 30 * 24 * 60
+
+// Definition is a saved funnel
+type Definition struct {
+	Name   string `json:"name"`
+	Window int    `json:"window"` // minutes; 0 uses the default
+	Steps  []Step `json:"steps"`
+}
+
+// Validate lists what is missing from a funnel
+func (d Definition) Validate() []reqbody.FieldError {
+	var errs []reqbody.FieldError
+	if strings.TrimSpace(d.Name) == "" {
+		errs = append(errs, reqbody.FieldError{Field: "name", Message: "required"})
+	}
+	if d.Window < 0 {
+		errs = append(errs, reqbody.FieldError{Field: "window", Message: "must not be negative"})
+	} else if d.Window > MaxWindow {
+		errs = append(errs, reqbody.FieldError{Field: "window", Message: fmt.Sprintf("must be at most %d minutes (30 days)", MaxWindow)})
+	}
+	return append(errs, ValidateSteps(d.Steps)...)
+}
+
+// ValidateSteps checks funnel steps: at least two that aren't exclusions, each
+// a pageview or event with a value, and at most MaxExclusions exclusions, each
+// between two other steps
+func ValidateSteps(steps []Step) []reqbody.FieldError {
+	var errs []reqbody.FieldError
+	included := Included(steps)
+	if len(included) < 2 {
+		errs = append(errs, reqbody.FieldError{Field: "steps", Message: "at least 2 steps required"})
+	}
+	if n := len(steps) - len(included); n > MaxExclusions {
+		errs = append(errs, reqbody.FieldError{Field: "steps", Message: fmt.Sprintf("at most %d exclusions allowed", MaxExclusions)})
+	}
+	first, last := -1, -1
+	for i, step := range steps {
+		if !step.Exclude {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	for i, step := range steps {
+		if step.Exclude && (i < first || i > last) {
+			errs = append(errs, reqbody.FieldError{Field: fmt.Sprintf("steps.%d.exclude", i), Message: "exclusions must sit between two steps"})
+		}
+		if step.Type != "pageview" && step.Type != "event" {
+			errs = append(errs, reqbody.FieldError{Field: fmt.Sprintf("steps.%d.type", i), Message: "must be pageview or event"})
+		}
+		if strings.TrimSpace(step.Value) == "" {
+			errs = append(errs, reqbody.FieldError{Field: fmt.Sprintf("steps.%d.value", i), Message: "required"})
+		}
+	}
+	return errs
+}
+
+// Included returns the steps that aren't exclusions, the ones a funnel counts
+func Included(steps []Step) []Step {
+	included := make([]Step, 0, len(steps))
+	for _, step := range steps {
+		if !step.Exclude {
+			included = append(included, step)
+		}
+	}
+	return included
+}
+
+// NormalizePath reduces a pathname to the form funnels compare: the path of
+// a full URL, without query string or fragment, duplicate or trailing
+// slashes (except the root's), in lower case. The stats stores' SQL applies
+// the same rules to stored pathnames.
+func NormalizePath(path string) string {
+	if isNormalPath(path) {
+		return path
+	}
+	if scheme, rest, ok := strings.Cut(path, "://"); ok && isScheme(scheme) {
+		path = ""
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			path = rest[i:]
+		}
+	}
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return strings.ToLower(path)
+}
+
+// isNormalPath reports whether NormalizePath would keep path as is; it spares
+// the Go-side funnel evaluation the work on paths the stores normalized
+func isNormalPath(path string) bool {
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '?', c == '#', c >= 'A' && c <= 'Z', c >= 0x80:
+			return false
+		case c == '/' && i > 0 && path[i-1] == '/':
+			return false
+		}
+	}
+	return len(path) <= 1 || path[len(path)-1] != '/'
+}
+
+// isScheme reports whether s is a URL scheme, as in RFC 3986
+func isScheme(s string) bool {
+	if s == "" || !isLetter(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if c := s[i]; !isLetter(c) && !(c >= '0' && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// NormalizePattern normalizes a pageview step's value: its path, or for a
+// trailing * its prefix, which keeps a trailing slash so "/blog/*" still
+// needs something after "/blog/"
+func NormalizePattern(value string) string {
+	prefix, ok := strings.CutSuffix(value, "*")
+	if !ok {
+		return NormalizePath(value)
+	}
+	normalized := NormalizePath(prefix)
+	if strings.HasSuffix(prefix, "/") && normalized != "/" {
+		normalized += "/"
+	}
+	return normalized + "*"
+}
+
+// NormalizeSteps returns steps with the values of pageview steps normalized
+func NormalizeSteps(steps []Step) []Step {
+	normalized := make([]Step, len(steps))
+	for i, step := range steps {
+		if step.Type == "pageview" {
+			step.Value = NormalizePattern(step.Value)
+		}
+		normalized[i] = step
+	}
+	return normalized
+}
+
+// MarshalSteps encodes steps as stored in Postgres
+func MarshalSteps(steps []Step) (string, error) {
+	data, err := json.Marshal(steps)
+	return string(data), err
+}
+
+// UnmarshalSteps decodes steps stored by MarshalSteps or any earlier version;
+// fields it doesn't know are ignored
+func UnmarshalSteps(data string) ([]Step, error) {
+	var steps []Step
+	err := json.Unmarshal([]byte(data), &steps)
+	return steps, err
+}
@@ -0,0 +1,142 @@
+package funnel
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefinition_Validate(t *testing.T) {
+	valid := []Step{{Type: "pageview", Value: "/"}, {Type: "event", Value: "signup", Href: "~/pricing"}}
+	if errs := (Definition{Name: "Signup", Steps: valid}).Validate(); len(errs) != 0 {
+		t.Errorf("valid funnel: %v", errs)
+	}
+
+	errs := Definition{Window: -1, Steps: []Step{{Type: "click", Value: "x"}}}.Validate()
+	var fields []string
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	if got := strings.Join(fields, ","); got != "name,window,steps,steps.0.type" {
+		t.Errorf("fields = %s", got)
+	}
+	if errs := (Definition{Name: "Signup", Window: MaxWindow + 1, Steps: valid}).Validate(); len(errs) != 1 || errs[0].Field != "window" {
+		t.Errorf("window over MaxWindow: %v", errs)
+	}
+}
+
+func TestValidateSteps(t *testing.T) {
+	errs := ValidateSteps([]Step{{Type: "pageview", Value: "/"}, {Type: "event", Value: " "}})
+	if len(errs) != 1 || errs[0].Field != "steps.1.value" {
+		t.Errorf("errs = %v", errs)
+	}
+}
+
+func TestValidateSteps_Exclusions(t *testing.T) {
+	page := func(path string) Step { return Step{Type: "pageview", Value: path} }
+	exclude := func(path string) Step { return Step{Type: "pageview", Value: path, Exclude: true} }
+	tests := []struct {
+		name   string
+		steps  []Step
+		fields string
+	}{
+		{"between steps", []Step{page("/pricing"), exclude("/enterprise"), page("/signup")}, ""},
+		{"three exclusions", []Step{page("/"), exclude("/a"), exclude("/b"), page("/pricing"), exclude("/c"), page("/signup")}, ""},
+		{"four exclusions", []Step{page("/"), exclude("/a"), exclude("/b"), exclude("/c"), exclude("/d"), page("/signup")}, "steps"},
+		{"exclusions don't count as steps", []Step{page("/"), exclude("/a")}, "steps,steps.1.exclude"},
+		{"leading", []Step{exclude("/a"), page("/"), page("/signup")}, "steps.0.exclude"},
+		{"trailing", []Step{page("/"), page("/signup"), exclude("/a"), exclude("/b")}, "steps.2.exclude,steps.3.exclude"},
+	}
+	for _, tt := range tests {
+		var fields []string
+		for _, e := range ValidateSteps(tt.steps) {
+			fields = append(fields, e.Field)
+		}
+		if got := strings.Join(fields, ","); got != tt.fields {
+			t.Errorf("%s: fields = %q, want %q", tt.name, got, tt.fields)
+		}
+	}
+}
+
+// Steps saved by earlier versions of the auth and stats packages must still load
+func TestUnmarshalSteps_Stored(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored string
+		want   []Step
+	}{
+		{"pageviews only", `[{"type":"pageview","value":"/"},{"type":"pageview","value":"/signup"}]`,
+			[]Step{{Type: "pageview", Value: "/"}, {Type: "pageview", Value: "/signup"}}},
+		{"autocapture props", `[{"type":"event","value":"$autocapture","text":"Buy","tag":"button"},{"type":"event","value":"purchase"}]`,
+			[]Step{{Type: "event", Value: "$autocapture", Text: "Buy", Tag: "button"}, {Type: "event", Value: "purchase"}}},
+		{"href", `[{"type":"event","value":"click","href":"~/pricing"},{"type":"pageview","value":"/checkout"}]`,
+			[]Step{{Type: "event", Value: "click", Href: "~/pricing"}, {Type: "pageview", Value: "/checkout"}}},
+		{"exclusion", `[{"type":"pageview","value":"/pricing"},{"type":"pageview","value":"/enterprise","exclude":true},{"type":"event","value":"signup"}]`,
+			[]Step{{Type: "pageview", Value: "/pricing"}, {Type: "pageview", Value: "/enterprise", Exclude: true}, {Type: "event", Value: "signup"}}},
+		// Old rows may carry empty optional props or fields since dropped
+		{"empty props and unknown fields", `[{"type":"pageview","value":"/","text":"","tag":"","label":"Home"}]`,
+			[]Step{{Type: "pageview", Value: "/"}}},
+	}
+	for _, tt := range tests {
+		got, err := UnmarshalSteps(tt.stored)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, err = %v", tt.name, got, err)
+			continue
+		}
+		stored, err := MarshalSteps(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := UnmarshalSteps(stored); !reflect.DeepEqual(again, tt.want) {
+			t.Errorf("%s: round trip through %s gave %+v", tt.name, stored, again)
+		}
+	}
+
+	if _, err := UnmarshalSteps(`{"type":"pageview"}`); err == nil {
+		t.Error("an object is not a list of steps")
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	for path, want := range map[string]string{
+		"":                            "",
+		"/":                           "/",
+		"//":                          "/",
+		"/pricing":                    "/pricing",
+		"/pricing/":                   "/pricing",
+		"/pricing?plan=pro":           "/pricing",
+		"/pricing/?plan=pro#faq":      "/pricing",
+		"/docs//api///v1/":            "/docs/api/v1",
+		"/Checkout/Step-2":            "/checkout/step-2",
+		"https://Example.com/Signup/": "/signup",
+		"https://example.com":         "",
+		"https://example.com?x=/y":    "/y",
+		"/redirect?to=https://a.com/": "/redirect",
+		"/docs/a:b":                   "/docs/a:b",
+	} {
+		if got := NormalizePath(path); got != want {
+			t.Errorf("NormalizePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestNormalizeSteps(t *testing.T) {
+	steps := []Step{
+		{Type: "pageview", Value: "/Pricing/"},
+		{Type: "pageview", Value: "/Blog//*"},
+		{Type: "pageview", Value: "/*"},
+		{Type: "event", Value: "Signup/"},
+	}
+	want := []Step{
+		{Type: "pageview", Value: "/pricing"},
+		{Type: "pageview", Value: "/blog/*"},
+		{Type: "pageview", Value: "/*"},
+		{Type: "event", Value: "Signup/"},
+	}
+	if got := NormalizeSteps(steps); !reflect.DeepEqual(got, want) {
+		t.Errorf("NormalizeSteps = %+v, want %+v", got, want)
+	}
+	if steps[0].Value != "/Pricing/" {
+		t.Error("NormalizeSteps changed its argument")
+	}
+}
@@ -0,0 +1,165 @@
+// Package grpc serves aggregate stats to internal services over gRPC. Calls
+// authenticate with a static service token and are answered by the stats
+// handler's Query methods, so the HTTP endpoints' checks and cache apply.
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/shortid/clickresearch-stats/internal/access"
+	"github.com/shortid/clickresearch-stats/internal/grpc/statspb"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+// Config configures the gRPC server
+type Config struct {
+	// Token is the service token callers send as "authorization: Bearer <token>"
+	Token string
+	// AllowedDomains limits the domains callers may read; nil allows every domain
+	AllowedDomains []string
+	// QueryTimeout bounds each call unless the caller's deadline is sooner; <= 0 disables it
+	QueryTimeout time.Duration
+}
+
+// NewServer returns a gRPC server answering the Stats service from h
+func NewServer(h *stats.Handler, cfg Config) (*grpclib.Server, error) {
+	if cfg.Token == "" {
+		return nil, errors.New("grpc: a service token is required")
+	}
+	var allowed []string
+	if cfg.AllowedDomains != nil {
+		allowed = make([]string, 0, len(cfg.AllowedDomains))
+		for _, d := range cfg.AllowedDomains {
+			if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+				allowed = append(allowed, d)
+			}
+		}
+	}
+	srv := grpclib.NewServer(grpclib.UnaryInterceptor(authInterceptor(cfg.Token, access.Policy{AllowedDomains: allowed}, cfg.QueryTimeout)))
+	statspb.RegisterStatsServer(srv, &service{stats: h})
+	return srv, nil
+}
+
+// authInterceptor rejects calls without the service token, attaches policy
+// for the domain checks and applies the query timeout
+func authInterceptor(token string, policy access.Policy, timeout time.Duration) grpclib.UnaryServerInterceptor {
+	want := []byte("Bearer " + token)
+	return func(ctx context.Context, req any, info *grpclib.UnaryServerInfo, handler grpclib.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get("authorization")
+		if len(values) != 1 || subtle.ConstantTimeCompare([]byte(values[0]), want) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "invalid service token")
+		}
+		ctx = access.WithPolicy(ctx, policy)
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return handler(ctx, req)
+	}
+}
+
+// service implements statspb.StatsServer
+type service struct {
+	statspb.UnimplementedStatsServer
+	stats *stats.Handler
+}
+
+func (s *service) Overview(ctx context.Context, req *statspb.OverviewRequest) (*statspb.OverviewResponse, error) {
+	o, err := s.stats.Overview(ctx, query(req.GetRange()))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &statspb.OverviewResponse{
+		Pageviews:      o.Pageviews,
+		UniqueVisitors: o.UniqueVisitors,
+		Events:         o.Events,
+		PrivacyMode:    string(o.PrivacyMode),
+		Warning:        o.Warning,
+		HasData:        o.HasData,
+		FirstEventAt:   o.FirstEventAt,
+	}, nil
+}
+
+func (s *service) TimeSeries(ctx context.Context, req *statspb.TimeSeriesRequest) (*statspb.TimeSeriesResponse, error) {
+	points, err := s.stats.TimeSeries(ctx, query(req.GetRange()), req.GetInterval())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &statspb.TimeSeriesResponse{Points: make([]*statspb.TimeSeriesPoint, len(points))}
+	for i, p := range points {
+		resp.Points[i] = &statspb.TimeSeriesPoint{Time: p.Time, Value: p.Value}
+	}
+	return resp, nil
+}
+
+func (s *service) Breakdown(ctx context.Context, req *statspb.BreakdownRequest) (*statspb.BreakdownResponse, error) {
+	data, err := s.stats.Breakdown(ctx, query(req.GetRange()), req.GetDimension(), int(req.GetLimit()))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &statspb.BreakdownResponse{
+		Items:       make([]*statspb.BreakdownItem, len(data.Items)),
+		TotalGroups: data.TotalGroups,
+		Truncated:   data.Truncated,
+	}
+	for i, item := range data.Items {
+		resp.Items[i] = &statspb.BreakdownItem{Name: item.Name, Count: item.Count}
+	}
+	return resp, nil
+}
+
+func (s *service) Funnel(ctx context.Context, req *statspb.FunnelRequest) (*statspb.FunnelResponse, error) {
+	f, err := s.stats.Funnel(ctx, query(req.GetRange()), req.GetSteps(), int(req.GetWindowMinutes()))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &statspb.FunnelResponse{
+		Steps:       make([]*statspb.FunnelStep, len(f.Steps)),
+		TotalStart:  f.TotalStart,
+		TotalFinish: f.TotalFinish,
+		Conversion:  f.Conversion,
+	}
+	for i, step := range f.Steps {
+		resp.Steps[i] = &statspb.FunnelStep{Name: step.Name, Count: step.Count, Percent: step.Percent}
+	}
+	return resp, nil
+}
+
+func query(r *statspb.Range) stats.Query {
+	return stats.Query{Domain: r.GetDomain(), Period: r.GetPeriod(), Timezone: r.GetTimezone(), Filters: r.GetFilters()}
+}
+
+// statusError maps stats errors onto the codes matching the endpoints' statuses
+func statusError(err error) error {
+	var queryErr *stats.QueryError
+	var budgetErr *stats.BudgetExceededError
+	code := codes.Internal
+	switch {
+	case errors.As(err, &queryErr):
+		code = codes.InvalidArgument
+	case errors.Is(err, stats.ErrDomainForbidden):
+		code = codes.PermissionDenied
+	case errors.Is(err, stats.ErrDomainUnknown):
+		code = codes.NotFound
+	case errors.Is(err, stats.ErrNotReady), errors.Is(err, stats.ErrStatsUnavailable):
+		code = codes.Unavailable
+	case errors.Is(err, stats.ErrQueryTimeout), errors.Is(err, context.DeadlineExceeded):
+		code, err = codes.DeadlineExceeded, stats.ErrQueryTimeout
+	case errors.Is(err, stats.ErrBusy), errors.As(err, &budgetErr):
+		code = codes.ResourceExhausted
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
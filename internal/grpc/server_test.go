@@ -0,0 +1,184 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/shortid/clickresearch-stats/internal/grpc/statspb"
+	"github.com/shortid/clickresearch-stats/internal/stats"
+)
+
+const testToken = "service-token"
+
+// countingStore answers fixed numbers and counts overview queries
+type countingStore struct {
+	stats.StoreInterface
+	overviews atomic.Int64
+}
+
+func (*countingStore) Status() stats.StoreStatus { return stats.StoreStatus{Ready: true} }
+func (*countingStore) GetFreshness(ctx context.Context, domain string) (stats.Freshness, error) {
+	return stats.Freshness{Domain: domain}, nil
+}
+func (*countingStore) GetFirstEventAt(ctx context.Context, domain string) (time.Time, error) {
+	return time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC), nil
+}
+func (s *countingStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*stats.Overview, error) {
+	s.overviews.Add(1)
+	return &stats.Overview{Pageviews: 42, UniqueVisitors: 7, Events: 50}, nil
+}
+func (*countingStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]stats.TimeSeriesPoint, error) {
+	return []stats.TimeSeriesPoint{{Time: from.Format("2006-01-02"), Value: 3}}, nil
+}
+func (*countingStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]stats.TopItem, error) {
+	return []stats.TopItem{{Name: "/", Count: 30}, {Name: "/pricing", Count: 12}}[:min(limit, 2)], nil
+}
+func (*countingStore) GetFunnel(ctx context.Context, domain string, from, to time.Time, steps []string) (*stats.FunnelResult, error) {
+	return &stats.FunnelResult{
+		Steps:      []stats.FunnelStep{{Name: steps[0], Count: 10, Percent: 100}, {Name: steps[1], Count: 4, Percent: 40}},
+		TotalStart: 10, TotalFinish: 4, Conversion: 40,
+	}, nil
+}
+
+// dial serves h over an in-memory listener and returns a client
+func dial(t *testing.T, h *stats.Handler, cfg Config) statspb.StatsClient {
+	t.Helper()
+	srv, err := NewServer(h, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpclib.NewClient("passthrough:///bufnet",
+		grpclib.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpclib.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return statspb.NewStatsClient(conn)
+}
+
+func authed(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestNewServer_RequiresToken(t *testing.T) {
+	if _, err := NewServer(stats.NewHandler(&countingStore{}), Config{}); err == nil {
+		t.Error("server started without a service token")
+	}
+}
+
+func TestServer_EndToEnd(t *testing.T) {
+	store := &countingStore{}
+	h := stats.NewHandler(store)
+	client := dial(t, h, Config{Token: testToken, AllowedDomains: []string{" Example.com "}})
+	rng := &statspb.Range{Domain: "example.com", Period: "30d"}
+
+	for _, ctx := range []context.Context{context.Background(), authed("wrong")} {
+		_, err := client.Overview(ctx, &statspb.OverviewRequest{Range: rng})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("overview without the token: %v", err)
+		}
+	}
+
+	ctx := authed(testToken)
+	overview, err := client.Overview(ctx, &statspb.OverviewRequest{Range: rng})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overview.Pageviews != 42 || overview.UniqueVisitors != 7 || !overview.HasData || overview.FirstEventAt != "2026-01-02T00:00:00Z" {
+		t.Errorf("overview = %+v", overview)
+	}
+	if _, err := client.Overview(ctx, &statspb.OverviewRequest{Range: rng}); err != nil {
+		t.Fatal(err)
+	}
+	// The HTTP endpoint reads the entry the gRPC calls cached
+	w := httptest.NewRecorder()
+	h.HandleOverview(w, httptest.NewRequest(http.MethodGet, "/api/stats/overview?domain=example.com&period=30d", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("HTTP overview: %d %s", w.Code, w.Body)
+	}
+	if n := store.overviews.Load(); n != 1 {
+		t.Errorf("store queried %d times, want 1", n)
+	}
+
+	_, err = client.Overview(ctx, &statspb.OverviewRequest{Range: &statspb.Range{Domain: "other.com"}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("overview of a domain outside the allowed list: %v", err)
+	}
+
+	series, err := client.TimeSeries(ctx, &statspb.TimeSeriesRequest{Range: &statspb.Range{Domain: "example.com", Period: "7d"}, Interval: "day"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series.Points) != 8 || series.Points[0].Value != 3 {
+		t.Errorf("series = %v", series.Points)
+	}
+
+	pages, err := client.Breakdown(ctx, &statspb.BreakdownRequest{Range: rng, Dimension: "pages", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages.Items) != 1 || pages.Items[0].Name != "/" || pages.Items[0].Count != 30 {
+		t.Errorf("pages = %v", pages.Items)
+	}
+
+	funnel, err := client.Funnel(ctx, &statspb.FunnelRequest{Range: rng, Steps: []string{"/", "/pricing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(funnel.Steps) != 2 || funnel.TotalFinish != 4 || funnel.Conversion != 40 {
+		t.Errorf("funnel = %+v", funnel)
+	}
+
+	invalid := map[string]func() error{
+		"dimension": func() error {
+			_, err := client.Breakdown(ctx, &statspb.BreakdownRequest{Range: rng, Dimension: "cities"})
+			return err
+		},
+		"period": func() error {
+			_, err := client.Overview(ctx, &statspb.OverviewRequest{Range: &statspb.Range{Domain: "example.com", Period: "5d"}})
+			return err
+		},
+		"interval": func() error {
+			_, err := client.TimeSeries(ctx, &statspb.TimeSeriesRequest{Range: rng, Interval: "minute"})
+			return err
+		},
+		"funnel steps": func() error {
+			_, err := client.Funnel(ctx, &statspb.FunnelRequest{Range: rng, Steps: []string{"/"}})
+			return err
+		},
+		"domain": func() error {
+			_, err := client.Overview(ctx, &statspb.OverviewRequest{})
+			return err
+		},
+	}
+	for name, call := range invalid {
+		if err := call(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("invalid %s: %v", name, err)
+		}
+	}
+}
+
+func TestServer_NotReady(t *testing.T) {
+	client := dial(t, stats.NewHandler(nil), Config{Token: testToken})
+	_, err := client.Overview(authed(testToken), &statspb.OverviewRequest{Range: &statspb.Range{Domain: "example.com"}})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("overview without a store: %v", err)
+	}
+}
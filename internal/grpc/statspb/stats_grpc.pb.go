@@ -0,0 +1,251 @@
+// Aggregate stats for internal services. Each RPC answers what the matching
+// HTTP endpoint does, from the same cache, for callers presenting the service
+// token as "authorization: Bearer <token>" metadata.
+//
+// Regenerate with:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative stats.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: stats.proto
+
+package statspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Stats_Overview_FullMethodName   = "/clickresearch.stats.v1.Stats/Overview"
+	Stats_TimeSeries_FullMethodName = "/clickresearch.stats.v1.Stats/TimeSeries"
+	Stats_Breakdown_FullMethodName  = "/clickresearch.stats.v1.Stats/Breakdown"
+	Stats_Funnel_FullMethodName     = "/clickresearch.stats.v1.Stats/Funnel"
+)
+
+// StatsClient is the client API for Stats service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type StatsClient interface {
+	// Overview mirrors /api/stats/overview
+	Overview(ctx context.Context, in *OverviewRequest, opts ...grpc.CallOption) (*OverviewResponse, error)
+	// TimeSeries mirrors /api/stats/pageviews
+	TimeSeries(ctx context.Context, in *TimeSeriesRequest, opts ...grpc.CallOption) (*TimeSeriesResponse, error)
+	// Breakdown mirrors the pages, sources, geo, devices and event breakdown endpoints
+	Breakdown(ctx context.Context, in *BreakdownRequest, opts ...grpc.CallOption) (*BreakdownResponse, error)
+	// Funnel mirrors /api/stats/funnel
+	Funnel(ctx context.Context, in *FunnelRequest, opts ...grpc.CallOption) (*FunnelResponse, error)
+}
+
+type statsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStatsClient(cc grpc.ClientConnInterface) StatsClient {
+	return &statsClient{cc}
+}
+
+func (c *statsClient) Overview(ctx context.Context, in *OverviewRequest, opts ...grpc.CallOption) (*OverviewResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(OverviewResponse)
+	err := c.cc.Invoke(ctx, Stats_Overview_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statsClient) TimeSeries(ctx context.Context, in *TimeSeriesRequest, opts ...grpc.CallOption) (*TimeSeriesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TimeSeriesResponse)
+	err := c.cc.Invoke(ctx, Stats_TimeSeries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statsClient) Breakdown(ctx context.Context, in *BreakdownRequest, opts ...grpc.CallOption) (*BreakdownResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BreakdownResponse)
+	err := c.cc.Invoke(ctx, Stats_Breakdown_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statsClient) Funnel(ctx context.Context, in *FunnelRequest, opts ...grpc.CallOption) (*FunnelResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FunnelResponse)
+	err := c.cc.Invoke(ctx, Stats_Funnel_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StatsServer is the server API for Stats service.
+// All implementations must embed UnimplementedStatsServer
+// for forward compatibility.
+type StatsServer interface {
+	// Overview mirrors /api/stats/overview
+	Overview(context.Context, *OverviewRequest) (*OverviewResponse, error)
+	// TimeSeries mirrors /api/stats/pageviews
+	TimeSeries(context.Context, *TimeSeriesRequest) (*TimeSeriesResponse, error)
+	// Breakdown mirrors the pages, sources, geo, devices and event breakdown endpoints
+	Breakdown(context.Context, *BreakdownRequest) (*BreakdownResponse, error)
+	// Funnel mirrors /api/stats/funnel
+	Funnel(context.Context, *FunnelRequest) (*FunnelResponse, error)
+	mustEmbedUnimplementedStatsServer()
+}
+
+// UnimplementedStatsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedStatsServer struct{}
+
+func (UnimplementedStatsServer) Overview(context.Context, *OverviewRequest) (*OverviewResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Overview not implemented")
+}
+func (UnimplementedStatsServer) TimeSeries(context.Context, *TimeSeriesRequest) (*TimeSeriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TimeSeries not implemented")
+}
+func (UnimplementedStatsServer) Breakdown(context.Context, *BreakdownRequest) (*BreakdownResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Breakdown not implemented")
+}
+func (UnimplementedStatsServer) Funnel(context.Context, *FunnelRequest) (*FunnelResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Funnel not implemented")
+}
+func (UnimplementedStatsServer) mustEmbedUnimplementedStatsServer() {}
+func (UnimplementedStatsServer) testEmbeddedByValue()               {}
+
+// UnsafeStatsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StatsServer will
+// result in compilation errors.
+type UnsafeStatsServer interface {
+	mustEmbedUnimplementedStatsServer()
+}
+
+func RegisterStatsServer(s grpc.ServiceRegistrar, srv StatsServer) {
+	// If the following call pancis, it indicates UnimplementedStatsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Stats_ServiceDesc, srv)
+}
+
+func _Stats_Overview_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OverviewRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServer).Overview(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stats_Overview_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServer).Overview(ctx, req.(*OverviewRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stats_TimeSeries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TimeSeriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServer).TimeSeries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stats_TimeSeries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServer).TimeSeries(ctx, req.(*TimeSeriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stats_Breakdown_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BreakdownRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServer).Breakdown(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stats_Breakdown_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServer).Breakdown(ctx, req.(*BreakdownRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stats_Funnel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FunnelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServer).Funnel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stats_Funnel_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServer).Funnel(ctx, req.(*FunnelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Stats_ServiceDesc is the grpc.ServiceDesc for Stats service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Stats_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "clickresearch.stats.v1.Stats",
+	HandlerType: (*StatsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Overview",
+			Handler:    _Stats_Overview_Handler,
+		},
+		{
+			MethodName: "TimeSeries",
+			Handler:    _Stats_TimeSeries_Handler,
+		},
+		{
+			MethodName: "Breakdown",
+			Handler:    _Stats_Breakdown_Handler,
+		},
+		{
+			MethodName: "Funnel",
+			Handler:    _Stats_Funnel_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "stats.proto",
+}
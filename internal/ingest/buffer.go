@@ -0,0 +1,433 @@
+// Package ingest buffers collected events on their way to the event sink.
+// Events wait in a bounded memory ring; when it fills up, the oldest batches
+// spill to a spool directory as gzipped NDJSON, and a drainer writes batches
+// to the sink in arrival order once it accepts them again. Only when both
+// memory and the spool are full are new events refused, which the collect
+// endpoint answers with 503 and Retry-After.
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrFull is returned by Add when neither memory nor the spool has room
+	ErrFull = errors.New("ingestion buffer is full, retry shortly")
+	// ErrSpoolFull is returned by spills that would grow the spool past its limit
+	ErrSpoolFull = errors.New("ingestion spool is full")
+	// ErrClosed is returned by Add after Close
+	ErrClosed = errors.New("ingestion buffer is closed")
+)
+
+// Sink receives batches of events, e.g. an insert into ClickHouse. A failed
+// Write is retried with the same batch, so sinks should be idempotent or
+// accept the rare duplicate.
+type Sink interface {
+	Write(ctx context.Context, batch []json.RawMessage) error
+}
+
+// Config bounds the buffer
+type Config struct {
+	// MemoryEvents is how many events the memory ring holds
+	MemoryEvents int
+	// BatchSize is how many events go to the sink, or to a spool file, at once
+	BatchSize int
+	// SpoolDir holds the spilled batches; it survives restarts
+	SpoolDir string
+	// MaxSpoolBytes caps the spool's size on disk; 0 leaves it unbounded
+	MaxSpoolBytes int64
+	// FlushInterval is how long events wait for a batch to fill up, and the
+	// first wait after a failed write
+	FlushInterval time.Duration
+	// RetryAfter is what refused requests are told to wait
+	RetryAfter time.Duration
+}
+
+// DefaultConfig holds a few seconds of peak traffic in memory and rides out
+// hours of sink downtime on disk
+var DefaultConfig = Config{
+	MemoryEvents:  50000,
+	BatchSize:     5000,
+	MaxSpoolBytes: 1 << 30,
+	FlushInterval: time.Second,
+	RetryAfter:    30 * time.Second,
+}
+
+// maxRetryWait caps the doubling wait between failed writes
+const maxRetryWait = time.Minute
+
+// Stats reports the buffer's state for the debug endpoint
+type Stats struct {
+	// MemoryEvents is the ring's depth, the batch being written included
+	MemoryEvents int `json:"memory_events"`
+	// SpoolBatches and SpoolBytes describe the batches waiting on disk
+	SpoolBatches int   `json:"spool_batches"`
+	SpoolBytes   int64 `json:"spool_bytes"`
+	// SpilledBytes and ReplayedBatches count since start
+	SpilledBytes    int64 `json:"spilled_bytes"`
+	ReplayedBatches int64 `json:"replayed_batches"`
+	// ReplayLag is how long the oldest spooled batch has waited, in seconds
+	ReplayLag float64 `json:"replay_lag_seconds"`
+	// Rejected counts events refused with ErrFull
+	Rejected int64 `json:"rejected"`
+	// CorruptBatches counts spool files set aside as unreadable
+	CorruptBatches      int64  `json:"corrupt_batches,omitempty"`
+	LastWriteError      string `json:"last_write_error,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures,omitempty"`
+	// LastFlush is when the sink last accepted a batch (RFC3339)
+	LastFlush string `json:"last_flush,omitempty"`
+}
+
+// Buffer holds events until the sink takes them. Add may be called from any
+// goroutine; Start runs the drainer and Close stops it.
+type Buffer struct {
+	cfg  Config
+	sink Sink
+
+	mu sync.Mutex
+	// ring holds the events not yet handed to the sink, oldest first, in a
+	// circular slice of cfg.MemoryEvents
+	ring       []json.RawMessage
+	head, size int
+	// inflight is the batch the drainer took from the ring; it stays counted
+	// in memory until the sink accepts it
+	inflight []json.RawMessage
+	spool    *spool
+	started  bool
+	closed   bool
+	stats    Stats
+	onFlush  []func(batch []json.RawMessage)
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBuffer opens the spool, picking up batches a previous run left, and
+// returns a buffer writing to sink once started
+func NewBuffer(sink Sink, cfg Config) (*Buffer, error) {
+	if cfg.MemoryEvents <= 0 || cfg.BatchSize <= 0 || cfg.BatchSize > cfg.MemoryEvents {
+		return nil, fmt.Errorf("ingest: batch size must be between 1 and the memory size, got %d and %d", cfg.BatchSize, cfg.MemoryEvents)
+	}
+	if cfg.SpoolDir == "" {
+		return nil, errors.New("ingest: a spool directory is required")
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultConfig.FlushInterval
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = DefaultConfig.RetryAfter
+	}
+	sp, err := openSpool(cfg.SpoolDir, cfg.MaxSpoolBytes)
+	if err != nil {
+		return nil, fmt.Errorf("ingest: open spool: %w", err)
+	}
+	return &Buffer{
+		cfg:   cfg,
+		sink:  sink,
+		ring:  make([]json.RawMessage, cfg.MemoryEvents),
+		spool: sp,
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// Add queues events, spilling the oldest memory batches to disk to make room.
+// It returns ErrFull, keeping none of events, when the spool can't take
+// them either.
+func (b *Buffer) Add(events []json.RawMessage) error {
+	if len(events) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+
+	for b.free() < len(events) && b.size > 0 {
+		if err := b.spillOldest(); err != nil {
+			return b.reject(len(events), err)
+		}
+	}
+	if b.free() < len(events) {
+		// Memory holds at most the inflight batch, so events are the newest
+		// and go to the end of the spool as one batch
+		if err := b.spill(events, false); err != nil {
+			return b.reject(len(events), err)
+		}
+	} else {
+		b.push(events)
+	}
+
+	if b.size >= b.cfg.BatchSize {
+		b.signal()
+	}
+	return nil
+}
+
+// free is how many more events memory holds
+func (b *Buffer) free() int {
+	return len(b.ring) - b.size - len(b.inflight)
+}
+
+// push appends events to the ring, which has room for them
+func (b *Buffer) push(events []json.RawMessage) {
+	for _, event := range events {
+		b.ring[(b.head+b.size)%len(b.ring)] = event
+		b.size++
+	}
+}
+
+// pop takes up to n of the oldest events off the ring
+func (b *Buffer) pop(n int) []json.RawMessage {
+	n = min(n, b.size)
+	batch := b.unwrap(n)
+	for i := 0; i < n; i++ {
+		b.ring[(b.head+i)%len(b.ring)] = nil
+	}
+	b.head = (b.head + n) % len(b.ring)
+	b.size -= n
+	return batch
+}
+
+// unwrap copies the n oldest events of the ring
+func (b *Buffer) unwrap(n int) []json.RawMessage {
+	out := make([]json.RawMessage, n)
+	for i := range out {
+		out[i] = b.ring[(b.head+i)%len(b.ring)]
+	}
+	return out
+}
+
+// spillOldest moves the oldest memory batch to the end of the spool
+func (b *Buffer) spillOldest() error {
+	n := min(b.cfg.BatchSize, b.size)
+	if err := b.spill(b.unwrap(n), false); err != nil {
+		return err
+	}
+	b.pop(n)
+	return nil
+}
+
+func (b *Buffer) spill(batch []json.RawMessage, front bool) error {
+	n, err := b.spool.write(batch, front)
+	if err != nil {
+		return err
+	}
+	b.stats.SpilledBytes += n
+	return nil
+}
+
+func (b *Buffer) reject(n int, err error) error {
+	b.stats.Rejected += int64(n)
+	if !errors.Is(err, ErrSpoolFull) {
+		log.Printf("ingest: spill: %v", err)
+	}
+	return ErrFull
+}
+
+// signal wakes the drainer without blocking
+func (b *Buffer) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the drainer in the background until Close
+func (b *Buffer) Start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.started || b.closed {
+		return
+	}
+	b.started = true
+	go b.drain()
+}
+
+// drain writes batches to the sink: the inflight batch first, then the spool
+// in order, then memory. Memory is flushed when a batch fills up or every
+// FlushInterval; failed writes wait longer each time.
+func (b *Buffer) drain() {
+	defer close(b.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-b.stop
+		cancel()
+	}()
+
+	wait, failing := b.cfg.FlushInterval, false
+	for {
+		// While writes fail, wake-ups from Add mustn't hammer the sink
+		wake := b.wake
+		if failing {
+			wake = nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-b.stop:
+			timer.Stop()
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		var err error
+		for more := true; more && err == nil; {
+			more, err = b.drainOne(ctx)
+		}
+		switch {
+		case err == nil || ctx.Err() != nil:
+			wait, failing = b.cfg.FlushInterval, false
+		case failing:
+			wait = min(wait*2, maxRetryWait)
+		default:
+			wait, failing = b.cfg.FlushInterval, true
+		}
+	}
+}
+
+// drainOne writes the next batch to the sink, reporting whether there was one
+func (b *Buffer) drainOne(ctx context.Context) (bool, error) {
+	b.mu.Lock()
+	var batch []json.RawMessage
+	file, spooled := spoolFile{}, false
+	switch {
+	case b.inflight != nil:
+		batch = b.inflight
+	case len(b.spool.files) > 0:
+		file, spooled = b.spool.oldest()
+	case b.size > 0:
+		b.inflight = b.pop(b.cfg.BatchSize)
+		batch = b.inflight
+	default:
+		b.mu.Unlock()
+		return false, nil
+	}
+	b.mu.Unlock()
+
+	if spooled {
+		// Reading outside the lock is safe: only the drainer removes files
+		var err error
+		if batch, err = b.spool.read(file); err != nil {
+			log.Printf("ingest: unreadable spool batch %d set aside: %v", file.seq, err)
+			b.mu.Lock()
+			b.stats.CorruptBatches++
+			err = b.spool.quarantine(file)
+			b.mu.Unlock()
+			return err == nil, err
+		}
+	}
+
+	if err := b.sink.Write(ctx, batch); err != nil {
+		b.mu.Lock()
+		b.stats.LastWriteError = err.Error()
+		b.stats.ConsecutiveFailures++
+		b.mu.Unlock()
+		return false, err
+	}
+
+	b.mu.Lock()
+	b.stats.LastWriteError, b.stats.ConsecutiveFailures = "", 0
+	b.stats.LastFlush = time.Now().UTC().Format(time.RFC3339)
+	onFlush := b.onFlush
+	var err error
+	if spooled {
+		b.stats.ReplayedBatches++
+		err = b.spool.remove(file)
+	} else {
+		b.inflight = nil
+	}
+	b.mu.Unlock()
+
+	for _, fn := range onFlush {
+		fn(batch)
+	}
+	return true, err
+}
+
+// OnFlush adds a callback run by the drainer with every batch the sink
+// accepted, e.g. to track how current the sink's data is. Callbacks must not
+// keep batch or block.
+func (b *Buffer) OnFlush(fn func(batch []json.RawMessage)) {
+	b.mu.Lock()
+	b.onFlush = append(b.onFlush, fn)
+	b.mu.Unlock()
+}
+
+// Close stops the drainer, waiting for a write in progress, and spills
+// what memory holds so the next run replays it. Events that don't fit the
+// spool are lost, which the error reports.
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	started := b.started
+	b.mu.Unlock()
+
+	close(b.stop)
+	if started {
+		<-b.done
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var errs []error
+	lost := 0
+	if b.inflight != nil {
+		// The inflight batch is older than anything spooled
+		if err := b.spill(b.inflight, true); err != nil {
+			errs = append(errs, err)
+			lost += len(b.inflight)
+		}
+		b.inflight = nil
+	}
+	for b.size > 0 {
+		if err := b.spillOldest(); err != nil {
+			errs = append(errs, err)
+			lost += b.size
+			b.pop(b.size)
+		}
+	}
+	if lost > 0 {
+		return fmt.Errorf("ingest: %d events lost at shutdown: %w", lost, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Stats returns the buffer's current state
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.stats
+	st.MemoryEvents = b.size + len(b.inflight)
+	st.SpoolBatches = len(b.spool.files)
+	st.SpoolBytes = b.spool.bytes
+	if f, ok := b.spool.oldest(); ok {
+		st.ReplayLag = time.Since(f.written).Seconds()
+	}
+	return st
+}
+
+// WriteFull answers a request refused with ErrFull: 503 with Retry-After
+func (b *Buffer) WriteFull(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int((b.cfg.RetryAfter+time.Second-1)/time.Second)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{"error": ErrFull.Error(), "code": "buffer_full"})
+}
@@ -0,0 +1,293 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallSink fails every write while stalled and records the batches it accepts
+type stallSink struct {
+	mu      sync.Mutex
+	stalled bool
+	got     []json.RawMessage
+	fails   int
+}
+
+func (s *stallSink) Write(ctx context.Context, batch []json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stalled {
+		s.fails++
+		return errors.New("clickhouse: connection refused")
+	}
+	s.got = append(s.got, batch...)
+	return nil
+}
+
+func (s *stallSink) setStalled(v bool) {
+	s.mu.Lock()
+	s.stalled = v
+	s.mu.Unlock()
+}
+
+func (s *stallSink) received() []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]json.RawMessage(nil), s.got...)
+}
+
+func (s *stallSink) failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fails
+}
+
+func events(from, n int) []json.RawMessage {
+	out := make([]json.RawMessage, n)
+	for i := range out {
+		out[i] = json.RawMessage(fmt.Sprintf(`{"n":%d}`, from+i))
+	}
+	return out
+}
+
+// checkSequence verifies got holds events 0..n-1 exactly once, in order
+func checkSequence(t *testing.T, got []json.RawMessage, n int) {
+	t.Helper()
+	if len(got) != n {
+		t.Fatalf("sink received %d events, want %d", len(got), n)
+	}
+	for i, raw := range got {
+		var e struct{ N int }
+		if err := json.Unmarshal(raw, &e); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if e.N != i {
+			t.Fatalf("event %d is %s, want n=%d", i, raw, i)
+		}
+	}
+}
+
+func testConfig(dir string) Config {
+	return Config{
+		MemoryEvents:  10,
+		BatchSize:     4,
+		SpoolDir:      dir,
+		FlushInterval: 5 * time.Millisecond,
+		RetryAfter:    2 * time.Second,
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestBuffer_SpillsWhileSinkStalls(t *testing.T) {
+	sink := &stallSink{stalled: true}
+	b, err := NewBuffer(sink, testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	defer b.Close()
+
+	for i := 0; i < 50; i += 5 {
+		if err := b.Add(events(i, 5)); err != nil {
+			t.Fatalf("Add(%d): %v", i, err)
+		}
+	}
+	waitFor(t, "a failed write", func() bool { return sink.failures() > 0 })
+
+	st := b.Stats()
+	if st.MemoryEvents > 10 {
+		t.Errorf("MemoryEvents = %d, want at most the ring size", st.MemoryEvents)
+	}
+	if st.SpoolBatches == 0 || st.SpoolBytes == 0 || st.SpilledBytes == 0 {
+		t.Errorf("stats = %+v, want spilled batches", st)
+	}
+	if st.LastWriteError == "" || st.ConsecutiveFailures == 0 {
+		t.Errorf("stats = %+v, want the sink's failure reported", st)
+	}
+
+	sink.setStalled(false)
+	waitFor(t, "the backlog to drain", func() bool { return len(sink.received()) == 50 })
+	checkSequence(t, sink.received(), 50)
+	if st := b.Stats(); st.SpoolBatches != 0 || st.SpoolBytes != 0 || st.ReplayedBatches == 0 || st.ReplayLag != 0 {
+		t.Errorf("stats after drain = %+v, want an empty spool and replayed batches", st)
+	}
+}
+
+func TestBuffer_NoLossAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	sink := &stallSink{stalled: true}
+	b, err := NewBuffer(sink, testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	for i := 0; i < 37; i += 3 {
+		if err := b.Add(events(i, min(3, 37-i))); err != nil {
+			t.Fatalf("Add(%d): %v", i, err)
+		}
+	}
+	// Let the drainer take an inflight batch before shutting down
+	waitFor(t, "a failed write", func() bool { return sink.failures() > 0 })
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := b.Add(events(37, 1)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Add after Close = %v, want ErrClosed", err)
+	}
+	if got := sink.received(); len(got) != 0 {
+		t.Fatalf("stalled sink received %d events", len(got))
+	}
+
+	sink.setStalled(false)
+	b, err = NewBuffer(sink, testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := b.Stats(); st.SpoolBatches == 0 {
+		t.Fatalf("stats after reopen = %+v, want the spilled batches picked up", st)
+	}
+	b.Start()
+	defer b.Close()
+	if err := b.Add(events(37, 3)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replay", func() bool { return len(sink.received()) == 40 })
+	checkSequence(t, sink.received(), 40)
+}
+
+func TestBuffer_FullWhenSpoolExhausted(t *testing.T) {
+	cfg := testConfig(t.TempDir())
+	cfg.MaxSpoolBytes = 1
+	sink := &stallSink{stalled: true}
+	b, err := NewBuffer(sink, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := b.Add(events(0, 10)); err != nil {
+		t.Fatalf("Add within memory: %v", err)
+	}
+	if err := b.Add(events(10, 2)); !errors.Is(err, ErrFull) {
+		t.Fatalf("Add past memory and spool = %v, want ErrFull", err)
+	}
+	if st := b.Stats(); st.Rejected != 2 || st.MemoryEvents != 10 || st.SpoolBatches != 0 {
+		t.Errorf("stats = %+v, want 2 rejected and memory untouched", st)
+	}
+
+	w := httptest.NewRecorder()
+	b.WriteFull(w)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("WriteFull = %d with Retry-After %q, want 503 and 2", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestBuffer_QuarantinesCorruptBatch(t *testing.T) {
+	dir := t.TempDir()
+	sink := &stallSink{}
+	sp, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.write(events(0, 2), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sp.path(firstSeq-1), []byte("not gzip"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Left over from a spill interrupted by a crash
+	if err := os.WriteFile(filepath.Join(dir, "spill-1.tmp"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBuffer(sink, testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	defer b.Close()
+	waitFor(t, "the replay", func() bool { return len(sink.received()) == 2 })
+	checkSequence(t, sink.received(), 2)
+	if st := b.Stats(); st.CorruptBatches != 1 {
+		t.Errorf("CorruptBatches = %d, want 1", st.CorruptBatches)
+	}
+	if _, err := os.Stat(sp.path(firstSeq-1) + ".corrupt"); err != nil {
+		t.Errorf("corrupt batch not set aside: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "spill-1.tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("leftover temp file kept: %v", err)
+	}
+}
+
+func TestNewBuffer_Validates(t *testing.T) {
+	sink := &stallSink{}
+	for _, cfg := range []Config{
+		{MemoryEvents: 10, BatchSize: 0, SpoolDir: t.TempDir()},
+		{MemoryEvents: 10, BatchSize: 11, SpoolDir: t.TempDir()},
+		{MemoryEvents: 10, BatchSize: 5},
+	} {
+		if _, err := NewBuffer(sink, cfg); err == nil {
+			t.Errorf("NewBuffer(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestBuffer_OnFlushSeesAcceptedBatches(t *testing.T) {
+	sink := &stallSink{stalled: true}
+	b, err := NewBuffer(sink, testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var flushed []json.RawMessage
+	b.OnFlush(func(batch []json.RawMessage) {
+		mu.Lock()
+		flushed = append(flushed, batch...)
+		mu.Unlock()
+	})
+	b.Start()
+	defer b.Close()
+
+	if err := b.Add(events(0, 6)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a failed write", func() bool { return sink.failures() > 0 })
+	mu.Lock()
+	n := len(flushed)
+	mu.Unlock()
+	if n != 0 || b.Stats().LastFlush != "" {
+		t.Fatalf("%d events flushed while the sink fails", n)
+	}
+
+	sink.setStalled(false)
+	waitFor(t, "the flushes", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(flushed) == 6
+	})
+	mu.Lock()
+	checkSequence(t, flushed, 6)
+	mu.Unlock()
+	if b.Stats().LastFlush == "" {
+		t.Error("LastFlush not set")
+	}
+}
@@ -0,0 +1,187 @@
+package ingest
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const spoolExt = ".ndjson.gz"
+
+// firstSeq is where sequence numbers of a new spool start: mid-range, so a
+// batch that must be replayed before the others can be put in front
+const firstSeq = int64(1) << 40
+
+// spoolFile is one batch spilled to disk
+type spoolFile struct {
+	seq     int64
+	size    int64
+	written time.Time
+}
+
+// spool keeps batches on disk as gzipped NDJSON files, replayed in sequence
+// order. It isn't safe for concurrent use; the buffer's lock guards it.
+type spool struct {
+	dir      string
+	maxBytes int64
+	files    []spoolFile
+	bytes    int64
+}
+
+// openSpool creates dir if needed and picks up the batches a previous run left
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// A spill interrupted before its rename; the events are still in
+			// the memory of the run that wrote it, or were lost with it
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if err != nil || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.files = append(s.files, spoolFile{seq: seq, size: info.Size(), written: info.ModTime()})
+		s.bytes += info.Size()
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].seq < s.files[j].seq })
+	return s, nil
+}
+
+func (s *spool) path(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
+
+// write stores batch after the others, or before them when front is set.
+// It fails with ErrSpoolFull rather than grow past maxBytes.
+func (s *spool) write(batch []json.RawMessage, front bool) (int64, error) {
+	seq := firstSeq
+	if n := len(s.files); n > 0 {
+		if front {
+			seq = s.files[0].seq - 1
+		} else {
+			seq = s.files[n-1].seq + 1
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.dir, "spill-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	bw := bufio.NewWriter(zw)
+	for _, event := range batch {
+		bw.Write(event)
+		bw.WriteByte('\n')
+	}
+	err = bw.Flush()
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	if s.maxBytes > 0 && s.bytes+info.Size() > s.maxBytes {
+		return 0, ErrSpoolFull
+	}
+	if err := os.Rename(tmp.Name(), s.path(seq)); err != nil {
+		return 0, err
+	}
+	f := spoolFile{seq: seq, size: info.Size(), written: time.Now()}
+	if front {
+		s.files = append([]spoolFile{f}, s.files...)
+	} else {
+		s.files = append(s.files, f)
+	}
+	s.bytes += f.size
+	return f.size, nil
+}
+
+// oldest returns the first batch to replay; ok is false when the spool is empty
+func (s *spool) oldest() (spoolFile, bool) {
+	if len(s.files) == 0 {
+		return spoolFile{}, false
+	}
+	return s.files[0], true
+}
+
+// read decodes a spooled batch
+func (s *spool) read(f spoolFile) ([]json.RawMessage, error) {
+	file, err := os.Open(s.path(f.seq))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	var batch []json.RawMessage
+	dec := json.NewDecoder(zr)
+	for {
+		var event json.RawMessage
+		if err := dec.Decode(&event); errors.Is(err, io.EOF) {
+			return batch, nil
+		} else if err != nil {
+			return nil, err
+		}
+		batch = append(batch, event)
+	}
+}
+
+// remove drops a batch once it was replayed
+func (s *spool) remove(f spoolFile) error {
+	if err := os.Remove(s.path(f.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i, g := range s.files {
+		if g.seq == f.seq {
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			s.bytes -= g.size
+			break
+		}
+	}
+	return nil
+}
+
+// quarantine moves an unreadable batch aside so replay can go on
+func (s *spool) quarantine(f spoolFile) error {
+	if err := os.Rename(s.path(f.seq), s.path(f.seq)+".corrupt"); err != nil {
+		return err
+	}
+	return s.remove(f)
+}
@@ -0,0 +1,202 @@
+// Package jobs runs background work under a cap on concurrent jobs and keeps
+// each job's result for a while, so that clients can wait for it or poll
+// and fetch it later.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned by Submit while the queue holds its maximum of jobs
+	ErrQueueFull = errors.New("jobs: queue full")
+	// ErrNotFound is returned for unknown and expired jobs
+	ErrNotFound = errors.New("jobs: job not found")
+)
+
+// State is where a job is in its lifecycle
+type State string
+
+const (
+	StateQueued  State = "queued"
+	StateRunning State = "running"
+	StateDone    State = "done"
+	StateFailed  State = "failed"
+)
+
+// Func is the work of a job; its result is kept until the job expires
+type Func func(ctx context.Context) (any, error)
+
+// Job is a snapshot of a submitted job
+type Job struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	State    State     `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished,omitempty"`
+	// Result is what the job's Func returned, set once it is done
+	Result any `json:"-"`
+	// Err is the error of a failed job
+	Err error `json:"-"`
+}
+
+// Config sizes a Runner; zero values use the defaults
+type Config struct {
+	// Concurrency caps the jobs running at once
+	Concurrency int
+	// MaxQueued caps the jobs waiting to run; Submit fails beyond it
+	MaxQueued int
+	// Keep is how long finished jobs and their results are kept
+	Keep time.Duration
+	// Timeout bounds one job's run
+	Timeout time.Duration
+}
+
+// DefaultConfig runs two jobs at once and keeps results for an hour
+var DefaultConfig = Config{Concurrency: 2, MaxQueued: 20, Keep: time.Hour, Timeout: 5 * time.Minute}
+
+func (c Config) withDefaults() Config {
+	if c.Concurrency <= 0 {
+		c.Concurrency = DefaultConfig.Concurrency
+	}
+	if c.MaxQueued <= 0 {
+		c.MaxQueued = DefaultConfig.MaxQueued
+	}
+	if c.Keep <= 0 {
+		c.Keep = DefaultConfig.Keep
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultConfig.Timeout
+	}
+	return c
+}
+
+// Runner runs submitted jobs in the background, at most Config.Concurrency at a time
+type Runner struct {
+	cfg   Config
+	slots chan struct{}
+	now   func() time.Time
+
+	mu     sync.Mutex
+	jobs   map[string]*entry
+	queued int
+}
+
+type entry struct {
+	job  Job
+	done chan struct{}
+}
+
+// NewRunner returns a runner sized by cfg
+func NewRunner(cfg Config) *Runner {
+	cfg = cfg.withDefaults()
+	return &Runner{
+		cfg:   cfg,
+		slots: make(chan struct{}, cfg.Concurrency),
+		now:   time.Now,
+		jobs:  make(map[string]*entry),
+	}
+}
+
+// Submit queues fn as a job of kind and returns its ID
+func (r *Runner) Submit(kind string, fn Func) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	r.expire()
+	if r.queued >= r.cfg.MaxQueued {
+		r.mu.Unlock()
+		return "", ErrQueueFull
+	}
+	e := &entry{
+		job:  Job{ID: id, Kind: kind, State: StateQueued, Created: r.now()},
+		done: make(chan struct{}),
+	}
+	r.jobs[id] = e
+	r.queued++
+	r.mu.Unlock()
+
+	go r.run(e, fn)
+	return id, nil
+}
+
+func (r *Runner) run(e *entry, fn Func) {
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+
+	r.mu.Lock()
+	r.queued--
+	e.job.State = StateRunning
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	result, err := fn(ctx)
+	cancel()
+
+	r.mu.Lock()
+	e.job.Finished = r.now()
+	if err != nil {
+		e.job.State, e.job.Error, e.job.Err = StateFailed, err.Error(), err
+	} else {
+		e.job.State, e.job.Result = StateDone, result
+	}
+	r.mu.Unlock()
+	close(e.done)
+}
+
+// Get returns the job with id, or ErrNotFound
+func (r *Runner) Get(id string) (Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+	e, ok := r.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return e.job, nil
+}
+
+// Wait blocks until the job with id finished or ctx is done, and returns it
+func (r *Runner) Wait(ctx context.Context, id string) (Job, error) {
+	r.mu.Lock()
+	e, ok := r.jobs[id]
+	r.mu.Unlock()
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return e.job, nil
+}
+
+// expire drops the jobs finished longer than Keep ago; r.mu must be held
+func (r *Runner) expire() {
+	cutoff := r.now().Add(-r.cfg.Keep)
+	for id, e := range r.jobs {
+		if !e.job.Finished.IsZero() && e.job.Finished.Before(cutoff) {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunner_CapsConcurrency(t *testing.T) {
+	r := NewRunner(Config{Concurrency: 2, MaxQueued: 10})
+	release := make(chan struct{})
+	var running, peak atomic.Int32
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := r.Submit("test", func(ctx context.Context) (any, error) {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			<-release
+			running.Add(-1)
+			return i, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if job, _ := r.Get(ids[4]); job.State != StateQueued && job.State != StateRunning {
+		t.Errorf("state = %s before release", job.State)
+	}
+	close(release)
+
+	for i, id := range ids {
+		job, err := r.Wait(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != StateDone || job.Result != i {
+			t.Errorf("job %d = %+v, want done with its result", i, job)
+		}
+	}
+	if p := peak.Load(); p > 2 {
+		t.Errorf("%d jobs ran at once, want at most 2", p)
+	}
+}
+
+func TestRunner_QueueFullAndFailures(t *testing.T) {
+	r := NewRunner(Config{Concurrency: 1, MaxQueued: 1})
+	release := make(chan struct{})
+	block := func(ctx context.Context) (any, error) { <-release; return nil, nil }
+
+	first, err := r.Submit("test", block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the first job to take the only slot
+	for job, _ := r.Get(first); job.State != StateRunning; job, _ = r.Get(first) {
+		time.Sleep(time.Millisecond)
+	}
+	second, err := r.Submit("test", block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Submit("test", block); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Submit past the queue = %v, want ErrQueueFull", err)
+	}
+	close(release)
+	if _, err := r.Wait(context.Background(), second); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := r.Submit("test", func(ctx context.Context) (any, error) { return nil, errors.New("boom") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, err := r.Wait(context.Background(), id); err != nil || job.State != StateFailed || job.Error != "boom" {
+		t.Errorf("failed job = %+v, %v", job, err)
+	}
+}
+
+func TestRunner_Expires(t *testing.T) {
+	r := NewRunner(Config{Keep: time.Minute})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	id, err := r.Submit("test", func(ctx context.Context) (any, error) { return "x", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wait(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := r.Get(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an expired job = %v, want ErrNotFound", err)
+	}
+}
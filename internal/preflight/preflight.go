@@ -0,0 +1,108 @@
+// Package preflight runs the dependency checks of `server check`, so a
+// deploy with bad credentials, an empty bucket or missing migrations fails
+// before it starts serving.
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultTimeout bounds each check
+const DefaultTimeout = 30 * time.Second
+
+// Check is one dependency to verify. Run returns a short description of what
+// it found, or an error saying what to fix. A Check with Skip set is not run;
+// Skip says why, e.g. that the dependency is not configured.
+type Check struct {
+	Name string
+	Skip string
+	Run  func(ctx context.Context) (string, error)
+}
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	Pass Status = "PASS"
+	Fail Status = "FAIL"
+	Skip Status = "SKIP"
+)
+
+// Result is a check's outcome with its detail or error message
+type Result struct {
+	Name     string
+	Status   Status
+	Detail   string
+	Duration time.Duration
+}
+
+// Run runs checks one after the other, each within timeout
+func Run(ctx context.Context, checks []Check, timeout time.Duration) []Result {
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		if c.Skip != "" {
+			results = append(results, Result{Name: c.Name, Status: Skip, Detail: c.Skip})
+			continue
+		}
+		results = append(results, run(ctx, c, timeout))
+	}
+	return results
+}
+
+func run(ctx context.Context, c Check, timeout time.Duration) (result Result) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	result = Result{Name: c.Name}
+	defer func() {
+		result.Duration = time.Since(start)
+		if p := recover(); p != nil {
+			result.Status, result.Detail = Fail, fmt.Sprintf("check panicked: %v", p)
+		}
+	}()
+	detail, err := c.Run(ctx)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return Result{Name: c.Name, Status: Fail, Detail: fmt.Sprintf("timed out after %v: %v", timeout, err)}
+		}
+		return Result{Name: c.Name, Status: Fail, Detail: err.Error()}
+	}
+	return Result{Name: c.Name, Status: Pass, Detail: detail}
+}
+
+// Failed reports whether any check failed
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Write prints results as a table followed by a summary line
+func Write(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tTIME\tDETAIL")
+	counts := make(map[Status]int)
+	for _, r := range results {
+		counts[r.Status]++
+		took := "-"
+		if r.Status != Skip {
+			took = r.Duration.Round(time.Millisecond).String()
+		}
+		// Errors can span lines; the table keeps one row per check
+		detail := strings.Join(strings.Fields(r.Detail), " ")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, r.Status, took, detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d passed, %d failed, %d skipped\n", counts[Pass], counts[Fail], counts[Skip])
+	return err
+}
@@ -0,0 +1,73 @@
+package preflight
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	checks := []Check{
+		{Name: "ok", Run: func(ctx context.Context) (string, error) { return "3 files", nil }},
+		{Name: "bad", Run: func(ctx context.Context) (string, error) { return "", errors.New("no such bucket") }},
+		{Name: "off", Skip: "not configured", Run: func(ctx context.Context) (string, error) {
+			t.Error("skipped check ran")
+			return "", nil
+		}},
+		{Name: "slow", Run: func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}},
+		{Name: "broken", Run: func(ctx context.Context) (string, error) { panic("nil config") }},
+	}
+	results := Run(context.Background(), checks, 20*time.Millisecond)
+
+	want := []struct {
+		status Status
+		detail string
+	}{
+		{Pass, "3 files"},
+		{Fail, "no such bucket"},
+		{Skip, "not configured"},
+		{Fail, "timed out after 20ms"},
+		{Fail, "check panicked: nil config"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		if r := results[i]; r.Name != checks[i].Name || r.Status != w.status || !strings.HasPrefix(r.Detail, w.detail) {
+			t.Errorf("result %d = %+v, want %s %q", i, r, w.status, w.detail)
+		}
+	}
+	if !Failed(results) {
+		t.Error("Failed = false with failing checks")
+	}
+	if Failed(results[:1]) {
+		t.Error("Failed = true with passing checks only")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var b strings.Builder
+	err := Write(&b, []Result{
+		{Name: "postgres", Status: Pass, Detail: "schema complete", Duration: 12 * time.Millisecond},
+		{Name: "s3", Status: Fail, Detail: "listing failed:\n  access denied", Duration: 1500 * time.Millisecond},
+		{Name: "clickhouse", Status: Skip, Detail: "not used"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `CHECK       STATUS  TIME  DETAIL
+postgres    PASS    12ms  schema complete
+s3          FAIL    1.5s  listing failed: access denied
+clickhouse  SKIP    -     not used
+
+1 passed, 1 failed, 1 skipped
+`
+	if b.String() != want {
+		t.Errorf("report =\n%s\nwant\n%s", b.String(), want)
+	}
+}
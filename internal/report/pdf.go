@@ -0,0 +1,219 @@
+package report
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WritePDF renders pages as a PDF with the standard Helvetica fonts. logo is
+// the image of KindImage elements. The output depends on its input only, so
+// the same report renders to the same bytes.
+func WritePDF(w io.Writer, pages []Page, logo image.Image) error {
+	pw := &pdfWriter{}
+	pw.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1 to 4 are the catalog, the page tree and the fonts; the logo
+	// follows when drawn, then each page and its content stream
+	const catalog, pageTree, regular, bold = 1, 2, 3, 4
+	next := 5
+	logoObj := 0
+	if logo != nil && hasImage(pages) {
+		logoObj = next
+		next++
+	}
+	pageObjs := make([]int, len(pages))
+	for i := range pages {
+		pageObjs[i] = next
+		next += 2
+	}
+
+	pw.object(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pageTree))
+	kids := make([]string, len(pages))
+	for i, obj := range pageObjs {
+		kids[i] = fmt.Sprintf("%d 0 R", obj)
+	}
+	pw.object(pageTree, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	pw.object(regular, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	pw.object(bold, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	xobjects := ""
+	if logoObj != 0 {
+		b := logo.Bounds()
+		data, err := deflate(rgbBytes(logo))
+		if err != nil {
+			return err
+		}
+		pw.stream(logoObj, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+			b.Dx(), b.Dy()), data)
+		xobjects = fmt.Sprintf(" /XObject << /Logo %d 0 R >>", logoObj)
+	}
+
+	for i, p := range pages {
+		content, err := deflate(pageContent(p))
+		if err != nil {
+			return err
+		}
+		pw.object(pageObjs[i], fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 %d 0 R /F2 %d 0 R >>%s >> /Contents %d 0 R >>",
+			pageTree, num(PageWidth), num(PageHeight), regular, bold, xobjects, pageObjs[i]+1))
+		pw.stream(pageObjs[i]+1, "/Filter /FlateDecode", content)
+	}
+
+	xref := pw.buf.Len()
+	pw.printf("xref\n0 %d\n0000000000 65535 f \n", next)
+	for obj := 1; obj < next; obj++ {
+		pw.printf("%010d 00000 n \n", pw.offsets[obj])
+	}
+	pw.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", next, catalog, xref)
+	_, err := w.Write(pw.buf.Bytes())
+	return err
+}
+
+// pdfWriter collects the file, remembering where each object starts
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets map[int]int
+}
+
+func (pw *pdfWriter) printf(format string, args ...any) {
+	fmt.Fprintf(&pw.buf, format, args...)
+}
+
+func (pw *pdfWriter) object(n int, body string) {
+	if pw.offsets == nil {
+		pw.offsets = make(map[int]int)
+	}
+	pw.offsets[n] = pw.buf.Len()
+	pw.printf("%d 0 obj\n%s\nendobj\n", n, body)
+}
+
+func (pw *pdfWriter) stream(n int, dict string, data []byte) {
+	pw.object(n, fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data))
+}
+
+func hasImage(pages []Page) bool {
+	for _, p := range pages {
+		for _, e := range p.Elements {
+			if e.Kind == KindImage {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pageContent is the content stream drawing p; PDF puts the origin at the
+// bottom left, so y coordinates are flipped
+func pageContent(p Page) []byte {
+	var b bytes.Buffer
+	for _, e := range p.Elements {
+		switch e.Kind {
+		case KindRect:
+			fmt.Fprintf(&b, "%s rg %s %s %s %s re f\n", rgb(e.Color), num(e.X), num(PageHeight-e.Y-e.H), num(e.W), num(e.H))
+		case KindLine:
+			if len(e.Points) < 2 {
+				continue
+			}
+			fmt.Fprintf(&b, "%s RG %s w 1 J 1 j ", rgb(e.Color), num(e.LineWidth))
+			for i, pt := range e.Points {
+				op := "l"
+				if i == 0 {
+					op = "m"
+				}
+				fmt.Fprintf(&b, "%s %s %s ", num(pt.X), num(PageHeight-pt.Y), op)
+			}
+			b.WriteString("S\n")
+		case KindText:
+			font := "F1"
+			if e.Bold {
+				font = "F2"
+			}
+			x := e.X
+			if e.AlignRight {
+				x -= textWidth(e.Text, e.Size)
+			}
+			fmt.Fprintf(&b, "BT /%s %s Tf %s rg %s %s Td (%s) Tj ET\n", font, num(e.Size), rgb(e.Color), num(x), num(PageHeight-e.Y), pdfString(e.Text))
+		case KindImage:
+			fmt.Fprintf(&b, "q %s 0 0 %s %s %s cm /Logo Do Q\n", num(e.W), num(e.H), num(e.X), num(PageHeight-e.Y-e.H))
+		}
+	}
+	return b.Bytes()
+}
+
+// num formats a coordinate with at most two decimals
+func num(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" || s == "" {
+		return "0"
+	}
+	return s
+}
+
+func rgb(c color.RGBA) string {
+	return fmt.Sprintf("%s %s %s", num(float64(c.R)/255), num(float64(c.G)/255), num(float64(c.B)/255))
+}
+
+// winAnsiExtras are the WinAnsi codes of the non-Latin-1 runes reports use
+var winAnsiExtras = map[rune]byte{'€': 0x80, '…': 0x85, '•': 0x95, '–': 0x96, '—': 0x97}
+
+// pdfString escapes s as the body of a literal string in WinAnsi encoding;
+// runes it lacks become '?'
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= ' ' && r <= '~':
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			if c, ok := winAnsiExtras[r]; ok {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
+
+// rgbBytes returns the pixels of img as RGB rows, blending transparency onto white
+func rgbBytes(img image.Image) []byte {
+	b := img.Bounds()
+	out := make([]byte, 0, b.Dx()*b.Dy()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := onWhite(img.At(x, y))
+			out = append(out, c.R, c.G, c.B)
+		}
+	}
+	return out
+}
+
+// onWhite blends c onto a white background
+func onWhite(c color.Color) color.RGBA {
+	r, g, b, a := c.RGBA()
+	blend := func(v uint32) uint8 { return uint8((v + (0xffff - a)) >> 8) }
+	return color.RGBA{blend(r), blend(g), blend(b), 0xff}
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,108 @@
+package report
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+)
+
+// pngScale is the pixels per point of PNG snapshots
+const pngScale = 1.5
+
+// WritePNG renders page as a PNG snapshot, text in a bitmap font. logo is the
+// image of KindImage elements.
+func WritePNG(w io.Writer, page Page, logo image.Image) error {
+	img := image.NewRGBA(image.Rect(0, 0, px(PageWidth), px(PageHeight)))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for _, e := range page.Elements {
+		switch e.Kind {
+		case KindRect:
+			fill(img, image.Rect(px(e.X), px(e.Y), px(e.X+e.W), px(e.Y+e.H)), e.Color)
+		case KindLine:
+			for i := 1; i < len(e.Points); i++ {
+				strokeLine(img, e.Points[i-1], e.Points[i], e.LineWidth, e.Color)
+			}
+		case KindText:
+			drawText(img, e)
+		case KindImage:
+			if logo != nil {
+				drawScaled(img, image.Rect(px(e.X), px(e.Y), px(e.X+e.W), px(e.Y+e.H)), logo)
+			}
+		}
+	}
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	return enc.Encode(w, img)
+}
+
+// px converts points to pixels
+func px(v float64) int {
+	return int(math.Round(v * pngScale))
+}
+
+func fill(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	draw.Draw(img, r.Intersect(img.Bounds()), image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// strokeLine steps along a segment stamping squares of the line's width
+func strokeLine(img *image.RGBA, a, b Point2, width float64, c color.RGBA) {
+	w := int(math.Max(1, math.Round(width*pngScale)))
+	x0, y0, x1, y1 := float64(px(a.X)), float64(px(a.Y)), float64(px(b.X)), float64(px(b.Y))
+	steps := int(math.Max(math.Abs(x1-x0), math.Abs(y1-y0)))
+	for i := 0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		x, y := int(math.Round(x0+(x1-x0)*t)), int(math.Round(y0+(y1-y0)*t))
+		fill(img, image.Rect(x-w/2, y-w/2, x-w/2+w, y-w/2+w), c)
+	}
+}
+
+// drawText draws e in the 5x7 font, each font pixel a square of about a
+// ninth of the text size
+func drawText(img *image.RGBA, e Element) {
+	dot := int(math.Max(1, math.Round(e.Size*pngScale/9)))
+	advance := 6 * dot
+	runes := []rune(e.Text)
+	x := px(e.X)
+	if e.AlignRight {
+		x -= len(runes)*advance - dot
+	}
+	top := px(e.Y) - 7*dot
+	for _, r := range runes {
+		g := glyph(r)
+		for row, bits := range g {
+			for col := 0; col < 5; col++ {
+				if bits&(0x10>>col) == 0 {
+					continue
+				}
+				x0, y0 := x+col*dot, top+row*dot
+				fill(img, image.Rect(x0, y0, x0+dot, y0+dot), e.Color)
+				if e.Bold {
+					fill(img, image.Rect(x0+1, y0, x0+dot+1, y0+dot), e.Color)
+				}
+			}
+		}
+		x += advance
+	}
+}
+
+// drawScaled draws src into r by nearest neighbour, transparency onto white
+func drawScaled(img *image.RGBA, r image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if r.Dx() <= 0 || r.Dy() <= 0 || sb.Empty() {
+		return
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		sy := sb.Min.Y + (y-r.Min.Y)*sb.Dy()/r.Dy()
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sx := sb.Min.X + (x-r.Min.X)*sb.Dx()/r.Dx()
+			if (image.Point{x, y}).In(img.Bounds()) {
+				img.SetRGBA(x, y, onWhite(src.At(sx, sy)))
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Package report lays out a stats report on A4 pages and renders it as a PDF,
+// or its first page as a PNG. Layouts are plain lists of text, rectangles,
+// lines and images, so tests can compare their structure without rendering.
+package report
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Page size and margins, in points
+const (
+	PageWidth  = 595.0
+	PageHeight = 842.0
+	margin     = 40.0
+	footerY    = PageHeight - 24
+	contentEnd = PageHeight - 48
+)
+
+// Layout constants, in points
+const (
+	metricHeight = 56.0
+	chartHeight  = 170.0
+	chartGutter  = 44.0
+	rowHeight    = 16.0
+	// lineChartMin is the number of points from which the series is drawn as a line rather than bars
+	lineChartMin = 32
+	maxLogoW     = 140.0
+	maxLogoH     = 40.0
+)
+
+var (
+	// DefaultAccent is the accent color of reports without branding
+	DefaultAccent = color.RGBA{0x25, 0x63, 0xeb, 0xff}
+	textColor     = color.RGBA{0x11, 0x18, 0x27, 0xff}
+	mutedColor    = color.RGBA{0x6b, 0x72, 0x80, 0xff}
+	gridColor     = color.RGBA{0xe5, 0xe7, 0xeb, 0xff}
+	cardColor     = color.RGBA{0xf3, 0xf4, 0xf6, 0xff}
+)
+
+// Report is the content of a report
+type Report struct {
+	Title   string
+	Domain  string
+	Period  string
+	Metrics []Metric
+	Series  Series
+	Tables  []Table
+	// Accent colors the header band, the chart and table bars; zero uses DefaultAccent
+	Accent color.RGBA
+	// Logo is drawn at the top right when set
+	Logo image.Image
+}
+
+// Metric is a headline number
+type Metric struct {
+	Label string
+	Value string
+}
+
+// Series is the chart of the report
+type Series struct {
+	Title  string
+	Points []Point
+}
+
+// Point is one bucket of the series
+type Point struct {
+	Label string
+	Value float64
+}
+
+// Table is a ranked list drawn with a bar per row
+type Table struct {
+	Title string
+	Rows  []Row
+}
+
+// Row is one entry of a table
+type Row struct {
+	Label string
+	Value int64
+}
+
+// Kind is the kind of an Element
+type Kind string
+
+const (
+	KindText  Kind = "text"
+	KindRect  Kind = "rect"
+	KindLine  Kind = "line"
+	KindImage Kind = "image"
+)
+
+// Element is something drawn on a page. Coordinates are in points from the
+// top left corner. Text is anchored at its baseline, at X for left aligned
+// text and ending at X for right aligned text.
+type Element struct {
+	Kind       Kind
+	X, Y, W, H float64
+	// Points of a line, drawn as a polyline
+	Points     []Point2
+	LineWidth  float64
+	Text       string
+	Size       float64
+	Bold       bool
+	AlignRight bool
+	Color      color.RGBA
+}
+
+// Point2 is a position on a page
+type Point2 struct{ X, Y float64 }
+
+// Page is the elements of one page, in drawing order
+type Page struct {
+	Elements []Element
+}
+
+// layout places the elements of a report page by page
+type layout struct {
+	r      Report
+	accent color.RGBA
+	pages  []Page
+	y      float64
+}
+
+// Layout lays out r on as many pages as it takes, each with a footer
+func Layout(r Report) []Page {
+	l := &layout{r: r, accent: r.Accent}
+	if l.accent == (color.RGBA{}) {
+		l.accent = DefaultAccent
+	}
+	l.newPage()
+	l.header()
+	l.metrics()
+	l.chart()
+	for _, t := range r.Tables {
+		l.table(t)
+	}
+	for i := range l.pages {
+		l.pages[i].Elements = append(l.pages[i].Elements, Element{
+			Kind: KindText, X: PageWidth - margin, Y: footerY, Size: 8, AlignRight: true, Color: mutedColor,
+			Text: fmt.Sprintf("%s - page %d of %d", r.Domain, i+1, len(l.pages)),
+		})
+	}
+	return l.pages
+}
+
+func (l *layout) newPage() {
+	l.pages = append(l.pages, Page{})
+	l.add(Element{Kind: KindRect, X: 0, Y: 0, W: PageWidth, H: 6, Color: l.accent})
+	l.y = margin
+}
+
+func (l *layout) add(e Element) {
+	p := &l.pages[len(l.pages)-1]
+	p.Elements = append(p.Elements, e)
+}
+
+func (l *layout) text(x, y, size float64, bold bool, c color.RGBA, s string) {
+	l.add(Element{Kind: KindText, X: x, Y: y, Size: size, Bold: bold, Color: c, Text: s})
+}
+
+func (l *layout) header() {
+	logoW := 0.0
+	if l.r.Logo != nil {
+		b := l.r.Logo.Bounds()
+		w, h := fitBox(float64(b.Dx()), float64(b.Dy()), maxLogoW, maxLogoH)
+		if w > 0 && h > 0 {
+			logoW = w + 12
+			l.add(Element{Kind: KindImage, X: PageWidth - margin - w, Y: l.y, W: w, H: h})
+		}
+	}
+	width := PageWidth - 2*margin - logoW
+	l.text(margin, l.y+18, 20, true, textColor, truncate(l.r.Title, 20, width))
+	l.text(margin, l.y+38, 12, false, textColor, truncate(l.r.Domain, 12, width))
+	l.text(margin, l.y+54, 10, false, mutedColor, truncate(l.r.Period, 10, width))
+	l.y += 72
+}
+
+func (l *layout) metrics() {
+	n := len(l.r.Metrics)
+	if n == 0 {
+		return
+	}
+	const gap = 10.0
+	w := (PageWidth - 2*margin - gap*float64(n-1)) / float64(n)
+	for i, m := range l.r.Metrics {
+		x := margin + float64(i)*(w+gap)
+		l.add(Element{Kind: KindRect, X: x, Y: l.y, W: w, H: metricHeight, Color: cardColor})
+		l.text(x+10, l.y+18, 9, false, mutedColor, truncate(m.Label, 9, w-20))
+		l.text(x+10, l.y+42, 18, true, textColor, truncate(m.Value, 18, w-20))
+	}
+	l.y += metricHeight + 24
+}
+
+func (l *layout) chart() {
+	s := l.r.Series
+	l.text(margin, l.y+12, 12, true, textColor, s.Title)
+	top := l.y + 24
+	left, right, bottom := margin+chartGutter, PageWidth-margin, top+chartHeight
+	l.y = bottom + 40
+
+	if len(s.Points) == 0 {
+		l.add(Element{Kind: KindRect, X: left, Y: top, W: right - left, H: chartHeight, Color: cardColor})
+		l.text(left+12, top+chartHeight/2, 10, false, mutedColor, "No data for this period")
+		return
+	}
+
+	max := 0.0
+	for _, p := range s.Points {
+		max = math.Max(max, p.Value)
+	}
+	step := niceStep(max / 4)
+	// Gridlines at multiples of step, labelled in the gutter
+	for i := 0; i <= 4; i++ {
+		v := step * float64(i)
+		y := bottom - chartHeight*float64(i)/4
+		l.add(Element{Kind: KindLine, Points: []Point2{{left, y}, {right, y}}, LineWidth: 0.5, Color: gridColor})
+		l.add(Element{Kind: KindText, X: left - 6, Y: y + 3, Size: 8, AlignRight: true, Color: mutedColor, Text: compact(v)})
+	}
+	scale := chartHeight / (step * 4)
+
+	n := len(s.Points)
+	slot := (right - left) / float64(n)
+	if n >= lineChartMin {
+		line := Element{Kind: KindLine, LineWidth: 1.5, Color: l.accent}
+		for i, p := range s.Points {
+			line.Points = append(line.Points, Point2{left + slot*(float64(i)+0.5), bottom - p.Value*scale})
+		}
+		l.add(line)
+	} else {
+		for i, p := range s.Points {
+			h := p.Value * scale
+			if h <= 0 {
+				continue
+			}
+			l.add(Element{Kind: KindRect, X: left + slot*float64(i) + slot*0.15, Y: bottom - h, W: slot * 0.7, H: h, Color: l.accent})
+		}
+	}
+
+	// The first, middle and last buckets are labelled
+	labels := []int{0}
+	if n > 2 {
+		labels = append(labels, n/2)
+	}
+	if n > 1 {
+		labels = append(labels, n-1)
+	}
+	for _, i := range labels {
+		x := left + slot*float64(i)
+		if i == n-1 && n > 1 {
+			l.add(Element{Kind: KindText, X: right, Y: bottom + 14, Size: 8, AlignRight: true, Color: mutedColor, Text: s.Points[i].Label})
+			continue
+		}
+		l.text(x, bottom+14, 8, false, mutedColor, s.Points[i].Label)
+	}
+}
+
+// table draws t, continuing on new pages as long as its rows don't fit
+func (l *layout) table(t Table) {
+	rows := t.Rows
+	title := t.Title
+	maxV := int64(0)
+	for _, r := range rows {
+		if r.Value > maxV {
+			maxV = r.Value
+		}
+	}
+	for {
+		// The title and at least one row, or the empty note, must fit
+		if l.y+24+rowHeight > contentEnd {
+			l.newPage()
+		}
+		l.text(margin, l.y+12, 12, true, textColor, title)
+		l.y += 24
+		if len(rows) == 0 {
+			l.text(margin, l.y+11, 9, false, mutedColor, "No data for this period")
+			l.y += rowHeight + 16
+			return
+		}
+
+		fit := int((contentEnd - l.y) / rowHeight)
+		if fit > len(rows) {
+			fit = len(rows)
+		}
+		width := PageWidth - 2*margin
+		tint := mix(l.accent, 0.8)
+		for _, r := range rows[:fit] {
+			if maxV > 0 && r.Value > 0 {
+				l.add(Element{Kind: KindRect, X: margin, Y: l.y + 1, W: width * float64(r.Value) / float64(maxV), H: rowHeight - 2, Color: tint})
+			}
+			value := FormatCount(r.Value)
+			l.text(margin+4, l.y+11, 9, false, textColor, truncate(r.Label, 9, width-textWidth(value, 9)-20))
+			l.add(Element{Kind: KindText, X: PageWidth - margin - 4, Y: l.y + 11, Size: 9, AlignRight: true, Color: textColor, Text: value})
+			l.y += rowHeight
+		}
+		rows = rows[fit:]
+		if len(rows) == 0 {
+			l.y += 16
+			return
+		}
+		l.newPage()
+		title = t.Title + " (continued)"
+	}
+}
+
+// fitBox scales w x h to fit within maxW x maxH, keeping the aspect ratio
+func fitBox(w, h, maxW, maxH float64) (float64, float64) {
+	if w <= 0 || h <= 0 {
+		return 0, 0
+	}
+	s := math.Min(maxW/w, maxH/h)
+	return math.Round(w * s), math.Round(h * s)
+}
+
+// niceStep rounds a gridline step up to 1, 2 or 5 times a power of ten
+func niceStep(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	p := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*p {
+			return m * p
+		}
+	}
+	return 10 * p
+}
+
+// compact formats axis values: 950, 1.5k, 2M
+func compact(v float64) string {
+	switch {
+	case v >= 1e6:
+		return strconv.FormatFloat(v/1e6, 'f', -1, 64) + "M"
+	case v >= 1e3:
+		return strconv.FormatFloat(v/1e3, 'f', -1, 64) + "k"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// FormatCount groups thousands: 12,437
+func FormatCount(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	if neg {
+		return "-" + b.String()
+	}
+	return b.String()
+}
+
+// mix blends c with white; amount 1 is white
+func mix(c color.RGBA, amount float64) color.RGBA {
+	m := func(v uint8) uint8 { return uint8(math.Round(float64(v) + (255-float64(v))*amount)) }
+	return color.RGBA{m(c.R), m(c.G), m(c.B), 0xff}
+}
+
+// truncate shortens s with "..." to fit width at size
+func truncate(s string, size, width float64) string {
+	if textWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && textWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// Outline lists the elements of pages one per line, coordinates rounded to
+// whole points, for comparing layouts in tests
+func Outline(pages []Page) string {
+	var b strings.Builder
+	for i, p := range pages {
+		fmt.Fprintf(&b, "page %d\n", i+1)
+		for _, e := range p.Elements {
+			switch e.Kind {
+			case KindText:
+				align := ""
+				if e.AlignRight {
+					align = " right"
+				}
+				weight := ""
+				if e.Bold {
+					weight = " bold"
+				}
+				fmt.Fprintf(&b, "  text %.0f,%.0f size %.0f%s%s %q\n", e.X, e.Y, e.Size, weight, align, e.Text)
+			case KindRect:
+				fmt.Fprintf(&b, "  rect %.0f,%.0f %.0fx%.0f #%02x%02x%02x\n", e.X, e.Y, e.W, e.H, e.Color.R, e.Color.G, e.Color.B)
+			case KindLine:
+				fmt.Fprintf(&b, "  line %d points from %.0f,%.0f to %.0f,%.0f\n", len(e.Points),
+					e.Points[0].X, e.Points[0].Y, e.Points[len(e.Points)-1].X, e.Points[len(e.Points)-1].Y)
+			case KindImage:
+				fmt.Fprintf(&b, "  image %.0f,%.0f %.0fx%.0f\n", e.X, e.Y, e.W, e.H)
+			}
+		}
+	}
+	return b.String()
+}
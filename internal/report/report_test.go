@@ -0,0 +1,194 @@
+package report
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata golden files")
+
+// fixture is a month of daily pageviews and a pages table long enough to
+// continue on a second page
+func fixture() Report {
+	r := Report{
+		Title:  "Traffic report",
+		Domain: "example.com",
+		Period: "1 Mar 2024 - 31 Mar 2024",
+		Metrics: []Metric{
+			{"Pageviews", "12,437"},
+			{"Unique visitors", "3,210"},
+			{"Events", "15,002"},
+		},
+		Series: Series{Title: "Pageviews"},
+		Accent: color.RGBA{0xff, 0x88, 0x00, 0xff},
+	}
+	for d := 1; d <= 31; d++ {
+		r.Series.Points = append(r.Series.Points, Point{Label: fmt.Sprintf("Mar %d", d), Value: float64(300 + d*7%90)})
+	}
+	pages := Table{Title: "Top pages"}
+	for i := 0; i < 40; i++ {
+		pages.Rows = append(pages.Rows, Row{Label: fmt.Sprintf("/blog/post-%d", i), Value: int64(2000 - i*40)})
+	}
+	r.Tables = []Table{
+		pages,
+		{Title: "Top sources", Rows: []Row{{"google.com", 5400}, {"(direct)", 3100}, {"news.ycombinator.com", 1200}}},
+		{Title: "Top countries"},
+	}
+	return r
+}
+
+func TestLayout_Golden(t *testing.T) {
+	got := Outline(Layout(fixture()))
+
+	path := filepath.Join("testdata", "layout.golden")
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("layout differs from %s:\n%s", path, got)
+	}
+}
+
+func TestLayout_Structure(t *testing.T) {
+	r := fixture()
+	r.Series.Points = r.Series.Points[:7]
+	r.Logo = image.NewRGBA(image.Rect(0, 0, 400, 100))
+	pages := Layout(r)
+	if len(pages) != 2 {
+		t.Fatalf("%d pages, want 2", len(pages))
+	}
+
+	count := func(p Page, kind Kind) int {
+		n := 0
+		for _, e := range p.Elements {
+			if e.Kind == kind {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(pages[0], KindImage); n != 1 {
+		t.Errorf("%d logos on page 1, want 1", n)
+	}
+	// A week is drawn as bars: the band, 3 cards and 7 bars, table bars after
+	if n := count(pages[0], KindLine); n != 5 {
+		t.Errorf("%d lines on page 1, want only the 5 gridlines", n)
+	}
+	for _, e := range pages[0].Elements {
+		if e.Kind == KindImage && (e.W != 140 || e.H != 35) {
+			t.Errorf("logo %vx%v, want 140x35 keeping the aspect ratio", e.W, e.H)
+		}
+		if e.Y > PageHeight-24+1 {
+			t.Errorf("%s element at y %v below the page", e.Kind, e.Y)
+		}
+	}
+	last := pages[1].Elements[len(pages[1].Elements)-1]
+	if last.Text != "example.com - page 2 of 2" {
+		t.Errorf("footer = %q", last.Text)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	long := "/" + strings.Repeat("very-long-path/", 20)
+	got := truncate(long, 9, 100)
+	if !strings.HasSuffix(got, "...") || textWidth(got, 9) > 100 {
+		t.Errorf("truncate = %q (%v wide)", got, textWidth(got, 9))
+	}
+	if got := truncate("/", 9, 100); got != "/" {
+		t.Errorf("short text truncated to %q", got)
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	for n, want := range map[int64]string{0: "0", 999: "999", 1000: "1,000", 1234567: "1,234,567", -4500: "-4,500"} {
+		if got := FormatCount(n); got != want {
+			t.Errorf("FormatCount(%d) = %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestWritePDF(t *testing.T) {
+	r := fixture()
+	logo := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	logo.Set(0, 0, color.RGBA{0xff, 0, 0, 0xff})
+	r.Logo = logo
+	pages := Layout(r)
+
+	var a, b bytes.Buffer
+	if err := WritePDF(&a, pages, logo); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePDF(&b, pages, logo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("rendering twice gave different files")
+	}
+
+	pdf := a.String()
+	if !strings.HasPrefix(pdf, "%PDF-1.4") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Fatal("not a PDF file")
+	}
+	if !strings.Contains(pdf, "/Count 2") || !strings.Contains(pdf, "/XObject << /Logo") {
+		t.Error("want 2 pages and the logo")
+	}
+
+	// Every xref entry must point at its object
+	start, err := strconv.Atoi(regexp.MustCompile(`startxref\n(\d+)`).FindStringSubmatch(pdf)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n`).FindAllStringSubmatch(pdf[start:], -1)
+	if len(entries) == 0 {
+		t.Fatal("empty xref")
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(e[1])
+		if want := fmt.Sprintf("%d 0 obj", i+1); !strings.HasPrefix(pdf[off:], want) {
+			t.Errorf("xref entry %d points at %q", i+1, pdf[off:off+10])
+		}
+	}
+}
+
+func TestPDFString(t *testing.T) {
+	if got := pdfString(`a (b) \ café – 日`); got != `a \(b\) \\ caf\351 \226 ?` {
+		t.Errorf("pdfString = %s", got)
+	}
+}
+
+func TestWritePNG(t *testing.T) {
+	r := fixture()
+	var buf bytes.Buffer
+	if err := WritePNG(&buf, Layout(r)[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != px(PageWidth) || b.Dy() != px(PageHeight) {
+		t.Errorf("size %v, want the page at %v pixels per point", b, pngScale)
+	}
+	if c := color.RGBAModel.Convert(img.At(10, 2)).(color.RGBA); c != r.Accent {
+		t.Errorf("header band %v, want the accent color", c)
+	}
+	if c := color.RGBAModel.Convert(img.At(px(PageWidth)-2, px(PageHeight/2))).(color.RGBA); c != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("margin %v, want white", c)
+	}
+}
@@ -0,0 +1,136 @@
+// Package reqbody decodes JSON request bodies strictly and describes what is
+// wrong with rejected ones, naming the offending field where there is one.
+package reqbody
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// DefaultMaxBytes caps request bodies
+const DefaultMaxBytes = 1 << 20
+
+// FieldError is one problem with a field; Field is a dotted path such as
+// steps.1.value. Code optionally names the rule broken, for clients to localize.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// Error is a rejected request body. Bodies that cannot be decoded are 400, 413
+// or 415 with Field and Expected set where known; decoded bodies failing
+// validation are 422 with Fields. Sending the same body again never helps,
+// so Retryable is always false.
+type Error struct {
+	Status    int          `json:"-"`
+	Message   string       `json:"error"`
+	Field     string       `json:"field,omitempty"`
+	Expected  string       `json:"expected,omitempty"`
+	Fields    []FieldError `json:"errors,omitempty"`
+	Retryable bool         `json:"retryable"`
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return e.Field + ": " + e.Message
+	}
+	return e.Message
+}
+
+// Invalid returns a 422 error listing fields, or nil when there are none
+func Invalid(fields ...FieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return &Error{Status: http.StatusUnprocessableEntity, Message: "validation failed", Fields: fields}
+}
+
+// Decode reads a JSON body of at most DefaultMaxBytes into v. The body must be
+// a single JSON value sent as application/json, and may not have fields v lacks.
+// Errors are *Error.
+func Decode(w http.ResponseWriter, r *http.Request, v any) error {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || (mt != "application/json" && !strings.HasSuffix(mt, "+json")) {
+		return &Error{Status: http.StatusUnsupportedMediaType, Message: "Content-Type must be application/json"}
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, DefaultMaxBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &Error{Status: http.StatusBadRequest, Message: "request body must be a single JSON value"}
+	}
+	return nil
+}
+
+// decodeError converts an encoding/json error into an *Error
+func decodeError(err error) *Error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		return &Error{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit)}
+	case errors.Is(err, io.EOF):
+		return &Error{Status: http.StatusBadRequest, Message: "request body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &Error{Status: http.StatusBadRequest, Message: "request body is truncated JSON"}
+	case errors.As(err, &syntaxErr):
+		return &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid JSON at offset %d: %v", syntaxErr.Offset, syntaxErr)}
+	case errors.As(err, &typeErr):
+		expected := jsonType(typeErr.Type)
+		if typeErr.Field == "" {
+			return &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("request body must be a JSON %s, got %s", expected, typeErr.Value), Expected: expected}
+		}
+		return &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("expected %s, got %s", expected, typeErr.Value), Field: typeErr.Field, Expected: expected}
+	}
+	// encoding/json has no error type for unknown fields
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &Error{Status: http.StatusBadRequest, Message: "unknown field", Field: strings.Trim(name, `"`)}
+	}
+	return &Error{Status: http.StatusBadRequest, Message: err.Error()}
+}
+
+// jsonType names the JSON type a Go type decodes from
+func jsonType(t reflect.Type) string {
+	if t == nil {
+		return "value"
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return "value"
+}
+
+// Write sends err as a JSON error response. Errors other than *Error are 400.
+func Write(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
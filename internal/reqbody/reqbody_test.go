@@ -0,0 +1,92 @@
+package reqbody
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type step struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type funnel struct {
+	Name   string `json:"name"`
+	Window int    `json:"window"`
+	Steps  []step `json:"steps"`
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		field       string
+		expected    string
+	}{
+		{"valid", "application/json", `{"name":"a","steps":[{"type":"pageview","value":"/"}]}`, 0, "", ""},
+		{"charset", "application/json; charset=utf-8", `{"name":"a"}`, 0, "", ""},
+		{"no content type", "", `{"name":"a"}`, 415, "", ""},
+		{"form", "application/x-www-form-urlencoded", `name=a`, 415, "", ""},
+		{"unknown field", "application/json", `{"name":"a","colour":"red"}`, 400, "colour", ""},
+		{"nested type", "application/json", `{"steps":[{"type":"event"},{"type":5}]}`, 400, "steps.1.type", "string"},
+		{"number", "application/json", `{"window":"60"}`, 400, "window", "number"},
+		{"array", "application/json", `{"steps":{}}`, 400, "steps", "array"},
+		{"top level", "application/json", `[1,2]`, 400, "", "object"},
+		{"syntax", "application/json", `{"name":"a",}`, 400, "", ""},
+		{"truncated", "application/json", `{"name":"a"`, 400, "", ""},
+		{"empty", "application/json", ``, 400, "", ""},
+		{"trailing", "application/json", `{"name":"a"} {"name":"b"}`, 400, "", ""},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("a", DefaultMaxBytes) + `"}`, 413, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			var v funnel
+			err := Decode(httptest.NewRecorder(), r, &v)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("error = %v, want *Error", err)
+			}
+			if e.Status != tt.status || e.Field != tt.field || e.Expected != tt.expected {
+				t.Errorf("error = %+v, want status %d field %q expected %q", e, tt.status, tt.field, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	if Invalid() != nil {
+		t.Error("Invalid() with no fields should be nil")
+	}
+
+	w := httptest.NewRecorder()
+	Write(w, Invalid(FieldError{Field: "email", Message: "required"}, FieldError{Field: "steps.0.value", Message: "required"}))
+	var body struct {
+		Error  string       `json:"error"`
+		Errors []FieldError `json:"errors"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusUnprocessableEntity || len(body.Errors) != 2 || body.Errors[1].Field != "steps.0.value" {
+		t.Errorf("status = %d, body = %+v", w.Code, body)
+	}
+
+	w = httptest.NewRecorder()
+	Write(w, &Error{Status: 400, Message: "expected string, got number", Field: "name", Expected: "string"})
+	if got := strings.TrimSpace(w.Body.String()); got != `{"error":"expected string, got number","field":"name","expected":"string","retryable":false}` {
+		t.Errorf("body = %s", got)
+	}
+}
@@ -0,0 +1,64 @@
+// Package secretbox encrypts small secrets, such as export credentials, for
+// storage in Postgres. The key comes from the environment and never touches the database.
+package secretbox
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	keySize   = 32
+	nonceSize = 24
+)
+
+// ErrDecrypt is returned for sealed values that were tampered with or sealed under another key
+var ErrDecrypt = errors.New("secretbox: decryption failed")
+
+// Box seals and opens secrets with one key
+type Box struct {
+	key [keySize]byte
+}
+
+// New returns a Box for a 32-byte key given as 64 hex characters or standard base64
+func New(key string) (*Box, error) {
+	key = strings.TrimSpace(key)
+	raw, err := hex.DecodeString(key)
+	if err != nil || len(raw) != keySize {
+		raw, err = base64.StdEncoding.DecodeString(key)
+	}
+	if err != nil || len(raw) != keySize {
+		return nil, errors.New("secretbox: key must be 32 bytes, hex or base64 encoded")
+	}
+	b := &Box{}
+	copy(b.key[:], raw)
+	return b, nil
+}
+
+// Seal encrypts and authenticates plaintext; the random nonce is prepended
+func (b *Box) Seal(plaintext []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plaintext, &nonce, &b.key), nil
+}
+
+// Open decrypts a value from Seal
+func (b *Box) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceSize+secretbox.Overhead {
+		return nil, ErrDecrypt
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed[:nonceSize])
+	plaintext, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, &b.key)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
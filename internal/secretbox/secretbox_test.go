@@ -0,0 +1,57 @@
+package secretbox
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var testKey = strings.Repeat("ab", keySize)
+
+func TestSealOpen(t *testing.T) {
+	b, err := New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte(`{"secret_access_key":"s3cr3t"}`)
+	sealed, err := b.Seal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("s3cr3t")) {
+		t.Error("sealed value contains the plaintext")
+	}
+	again, _ := b.Seal(secret)
+	if bytes.Equal(sealed, again) {
+		t.Error("two seals of one secret are identical; nonce not random")
+	}
+
+	got, err := b.Open(sealed)
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := b.Open(sealed); err != ErrDecrypt {
+		t.Errorf("tampered: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := b.Open(sealed[:10]); err != ErrDecrypt {
+		t.Errorf("short: err = %v, want ErrDecrypt", err)
+	}
+
+	other, _ := New(strings.Repeat("cd", keySize))
+	if _, err := other.Open(again); err != ErrDecrypt {
+		t.Errorf("other key: err = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestNew_Keys(t *testing.T) {
+	if _, err := New("q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s="); err != nil {
+		t.Errorf("base64 key: %v", err)
+	}
+	for _, key := range []string{"", "abcd", strings.Repeat("ab", keySize+1), "not a key"} {
+		if _, err := New(key); err == nil {
+			t.Errorf("New(%q) accepted a bad key", key)
+		}
+	}
+}
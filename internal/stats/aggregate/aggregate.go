@@ -0,0 +1,32 @@
+// Package aggregate holds the Go-side aggregation and normalization helpers of
+// stats reports: ranking counts, cleaning referrers, display labels and
+// funnel step matching. The SQL stores build their normalization expressions
+// from the same rules and apply these helpers to scanned rows, so every
+// backend reports the same names.
+package aggregate
+
+import "sort"
+
+// Item is a name with its count, as reports rank them
+type Item struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// TopN returns the n largest counts, descending, ties broken by name
+func TopN(counts map[string]int64, n int) []Item {
+	result := make([]Item, 0, len(counts))
+	for name, count := range counts {
+		result = append(result, Item{Name: name, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
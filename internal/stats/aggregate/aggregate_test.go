@@ -0,0 +1,60 @@
+package aggregate
+
+import (
+	"testing"
+)
+
+func TestTopN(t *testing.T) {
+	counts := map[string]int64{
+		"page1": 100,
+		"page2": 50,
+		"page3": 200,
+		"page4": 75,
+		"page5": 25,
+	}
+
+	tests := []struct {
+		n        int
+		expected int
+		first    string
+	}{
+		{3, 3, "page3"},
+		{5, 5, "page3"},
+		{10, 5, "page3"}, // more than available
+		{1, 1, "page3"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			result := TopN(counts, tt.n)
+			if len(result) != tt.expected {
+				t.Errorf("TopN(counts, %d) returned %d items, want %d", tt.n, len(result), tt.expected)
+			}
+			if len(result) > 0 && result[0].Name != tt.first {
+				t.Errorf("First item = %s, want %s", result[0].Name, tt.first)
+			}
+		})
+	}
+}
+
+func TestTopN_Sorted(t *testing.T) {
+	counts := map[string]int64{
+		"a": 10,
+		"b": 30,
+		"c": 20,
+	}
+
+	result := TopN(counts, 3)
+
+	if result[0].Count != 30 || result[1].Count != 20 || result[2].Count != 10 {
+		t.Errorf("TopN should be sorted descending: %v", result)
+	}
+}
+
+func TestTopN_Empty(t *testing.T) {
+	counts := map[string]int64{}
+	result := TopN(counts, 10)
+	if len(result) != 0 {
+		t.Errorf("TopN on empty map should return empty slice")
+	}
+}
@@ -0,0 +1,60 @@
+package aggregate
+
+import (
+	"sort"
+	"strings"
+)
+
+// LabelUnregistered groups utm_campaign values matching no registered campaign
+const LabelUnregistered = "(unregistered)"
+
+// CampaignKey folds a utm_campaign value to what registered campaigns are
+// matched by: lowercase, without spaces and the separators people swap for
+// them, so "Spring-Sale", "spring_sale" and "spring sale" are one campaign
+func CampaignKey(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '-', '_', '.', '+':
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(value)))
+}
+
+// MatchCampaigns maps observed utm_campaign counts onto registered, the
+// canonical values of a project's campaigns. Values with the CampaignKey of a
+// registered campaign count toward it, the rest toward LabelUnregistered.
+// Every registered campaign is listed, with 0 if it had no traffic, highest
+// counts first; LabelUnregistered is listed last when it has any.
+func MatchCampaigns(observed []Item, registered []string) []Item {
+	result := make([]Item, 0, len(registered)+1)
+	index := make(map[string]int, len(registered))
+	for _, name := range registered {
+		key := CampaignKey(name)
+		if _, ok := index[key]; ok {
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, Item{Name: name})
+	}
+
+	var unregistered int64
+	for _, item := range observed {
+		if i, ok := index[CampaignKey(item.Name)]; ok {
+			result[i].Count += item.Count
+		} else {
+			unregistered += item.Count
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Name < result[j].Name
+	})
+	if unregistered > 0 {
+		result = append(result, Item{Name: LabelUnregistered, Count: unregistered})
+	}
+	return result
+}
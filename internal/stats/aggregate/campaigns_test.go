@@ -0,0 +1,57 @@
+package aggregate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCampaignKey(t *testing.T) {
+	for _, value := range []string{"spring_sale", "Spring-Sale", "SPRING SALE", " spring.sale ", "spring+sale", "springsale"} {
+		if got := CampaignKey(value); got != "springsale" {
+			t.Errorf("CampaignKey(%q) = %q, want springsale", value, got)
+		}
+	}
+	if CampaignKey("spring_sale_2024") == CampaignKey("spring_sale") {
+		t.Error("different campaigns share a key")
+	}
+}
+
+func TestMatchCampaigns(t *testing.T) {
+	observed := []Item{
+		{Name: "spring_sale", Count: 40},
+		{Name: "Spring-Sale", Count: 10},
+		{Name: "newsletter", Count: 20},
+		{Name: "sprng_sale", Count: 3},
+		{Name: "retargeting", Count: 2},
+	}
+	got := MatchCampaigns(observed, []string{"spring_sale", "Newsletter", "black_friday"})
+	want := []Item{
+		{Name: "spring_sale", Count: 50},
+		{Name: "Newsletter", Count: 20},
+		{Name: "black_friday", Count: 0},
+		{Name: LabelUnregistered, Count: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchCampaigns = %v, want %v", got, want)
+	}
+}
+
+func TestMatchCampaigns_Edges(t *testing.T) {
+	// Without traffic, every registered campaign is listed with 0
+	got := MatchCampaigns(nil, []string{"b", "a"})
+	if want := []Item{{Name: "a"}, {Name: "b"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no traffic = %v, want %v", got, want)
+	}
+
+	// Without campaigns, all traffic is unregistered
+	got = MatchCampaigns([]Item{{Name: "x", Count: 1}, {Name: "y", Count: 2}}, nil)
+	if want := []Item{{Name: LabelUnregistered, Count: 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no campaigns = %v, want %v", got, want)
+	}
+
+	// Campaigns sharing a key are listed once, under the first name
+	got = MatchCampaigns([]Item{{Name: "promo", Count: 1}}, []string{"Promo", "promo"})
+	if want := []Item{{Name: "Promo", Count: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("duplicate keys = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,134 @@
+package aggregate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Display labels for values the tracker left empty, and the device classes
+// every device value is reported as
+const (
+	LabelUnknown = "Unknown"
+	LabelDirect  = "Direct"
+	LabelDesktop = "Desktop"
+	LabelMobile  = "Mobile"
+	LabelTablet  = "Tablet"
+	LabelOther   = "Other"
+	// LabelDirectTagged is direct traffic that carried UTM parameters, e.g.
+	// from email clients that drop the referrer
+	LabelDirectTagged = "Direct (tagged)"
+)
+
+// emptyLabels maps a dimension to the label shown for an empty value;
+// dimensions not listed fall back to LabelUnknown. Devices use NormalizeDevice.
+var emptyLabels = map[string]string{
+	"referrer": LabelDirect,
+}
+
+// Label maps a raw column value to the label reported for dimension
+func Label(dimension, value string) string {
+	switch dimension {
+	case "device":
+		return NormalizeDevice(value)
+	case "language":
+		return LanguageLabel(value)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		if label, ok := emptyLabels[dimension]; ok {
+			return label
+		}
+		return LabelUnknown
+	}
+	return value
+}
+
+// MergeLabels labels items and merges those that end up with the same label,
+// e.g. "" and "   ", keeping the highest counts first
+func MergeLabels(dimension string, items []Item) []Item {
+	result := make([]Item, 0, len(items))
+	index := make(map[string]int, len(items))
+	for _, item := range items {
+		name := Label(dimension, item.Name)
+		if i, ok := index[name]; ok {
+			result[i].Count += item.Count
+			continue
+		}
+		index[name] = len(result)
+		result = append(result, Item{Name: name, Count: item.Count})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+	return result
+}
+
+// DeviceRule assigns Class to values containing any of Match and none of Unless.
+// Values are lowercased first; older trackers sent full user agent strings.
+type DeviceRule struct {
+	Class  string
+	Match  []string
+	Unless []string
+}
+
+// DeviceRules are tried in order; empty values are Desktop and unmatched values Other.
+// The same table drives NormalizeDevice and the SQL expressions so they can't drift.
+var DeviceRules = []DeviceRule{
+	{LabelTablet, []string{"tablet", "ipad", "kindle", "silk", "playbook"}, nil},
+	// Android user agents without "mobile" are tablets
+	{LabelTablet, []string{"android"}, []string{"mobile"}},
+	{LabelMobile, []string{"mobile", "phone", "phablet", "android", "ipod", "blackberry", "opera mini"}, nil},
+	{LabelDesktop, []string{"desktop", "windows", "macintosh", "mac os", "linux", "x11", "cros"}, nil},
+}
+
+// NormalizeDevice maps a raw device value to Desktop, Mobile, Tablet or Other
+func NormalizeDevice(value string) string {
+	v := strings.ToLower(strings.TrimSpace(value))
+	if v == "" {
+		return LabelDesktop
+	}
+	for _, rule := range DeviceRules {
+		if containsAny(v, rule.Match) && !containsAny(v, rule.Unless) {
+			return rule.Class
+		}
+	}
+	return LabelOther
+}
+
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// languageNames labels the primary language subtags seen most; other codes are
+// reported as the bare code
+var languageNames = map[string]string{
+	"ar": "Arabic", "bg": "Bulgarian", "bn": "Bengali", "cs": "Czech", "da": "Danish",
+	"de": "German", "el": "Greek", "en": "English", "es": "Spanish", "et": "Estonian",
+	"fa": "Persian", "fi": "Finnish", "fr": "French", "he": "Hebrew", "hi": "Hindi",
+	"hr": "Croatian", "hu": "Hungarian", "id": "Indonesian", "it": "Italian", "ja": "Japanese",
+	"ko": "Korean", "lt": "Lithuanian", "lv": "Latvian", "ms": "Malay", "nb": "Norwegian",
+	"nl": "Dutch", "no": "Norwegian", "pl": "Polish", "pt": "Portuguese", "ro": "Romanian",
+	"ru": "Russian", "sk": "Slovak", "sl": "Slovenian", "sr": "Serbian", "sv": "Swedish",
+	"th": "Thai", "tr": "Turkish", "uk": "Ukrainian", "vi": "Vietnamese", "zh": "Chinese",
+}
+
+// LanguageLabel reports a language tag by its primary subtag, e.g. "en-US" as "English (en)"
+func LanguageLabel(value string) string {
+	code := strings.ToLower(strings.TrimSpace(value))
+	if i := strings.IndexAny(code, "-_"); i >= 0 {
+		code = code[:i]
+	}
+	if code == "" {
+		return LabelUnknown
+	}
+	if name, ok := languageNames[code]; ok {
+		return fmt.Sprintf("%s (%s)", name, code)
+	}
+	return code
+}
@@ -0,0 +1,65 @@
+package aggregate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabel(t *testing.T) {
+	tests := []struct {
+		dimension, value, want string
+	}{
+		{"browser", "", "Unknown"},
+		{"browser", "  ", "Unknown"},
+		{"browser", "Firefox", "Firefox"},
+		{"country", "", "Unknown"},
+		{"os", "", "Unknown"},
+		{"referrer", "", "Direct"},
+		{"referrer", "google.com", "google.com"},
+		{"device", "", "Desktop"},
+		{"device", "desktop", "Desktop"},
+		{"device", "mobile", "Mobile"},
+		{"device", "MOBILE", "Mobile"},
+		{"device", "tablet", "Tablet"},
+		{"device", "smarttv", "Other"},
+		{"name", "", "Unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := Label(tt.dimension, tt.value); got != tt.want {
+			t.Errorf("Label(%q, %q) = %q, want %q", tt.dimension, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLabelItems_Merges(t *testing.T) {
+	items := []Item{
+		{Name: "mobile", Count: 5},
+		{Name: "desktop", Count: 4},
+		{Name: "", Count: 3},
+		{Name: "Mobile", Count: 1},
+	}
+
+	got := MergeLabels("device", items)
+	want := []Item{{Name: "Desktop", Count: 7}, {Name: "Mobile", Count: 6}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeLabels = %+v, want %+v", got, want)
+	}
+}
+
+func TestLanguageLabel(t *testing.T) {
+	tests := []struct{ value, want string }{
+		{"en-US", "English (en)"},
+		{"EN", "English (en)"},
+		{"pt_BR", "Portuguese (pt)"},
+		{"zh-Hant-TW", "Chinese (zh)"},
+		{"gsw-CH", "gsw"},
+		{"", "Unknown"},
+		{" ", "Unknown"},
+	}
+	for _, tt := range tests {
+		if got := LanguageLabel(tt.value); got != tt.want {
+			t.Errorf("LanguageLabel(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
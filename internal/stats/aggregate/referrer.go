@@ -0,0 +1,43 @@
+package aggregate
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ReferrerHostPattern extracts the host from a referrer URL, matching what
+// ClickHouse domain() returns: scheme optional, no credentials or port
+const ReferrerHostPattern = `^(?:[a-zA-Z][a-zA-Z0-9+.-]*://|//)?(?:[^@/]*@)?([^/:?#]+)`
+
+var referrerHostRe = regexp.MustCompile(ReferrerHostPattern)
+
+// ReferrerHost returns the host of a referrer URL, "" if it has none
+func ReferrerHost(referrer string) string {
+	m := referrerHostRe.FindStringSubmatch(referrer)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// InternalHost reports whether host is domain or one of its subdomains, whose
+// referrals are navigation within the site
+func InternalHost(host, domain string) bool {
+	return strings.HasSuffix("."+host, "."+domain)
+}
+
+// ReferrerSource is the source a referrer is counted under: its host, or ""
+// when it has none or is internal
+func ReferrerSource(referrer, domain string) string {
+	host := ReferrerHost(referrer)
+	if InternalHost(host, domain) {
+		return ""
+	}
+	return host
+}
+
+// CleanReferrer reduces a referrer URL to its host, treating empty and
+// same-site referrers as Direct
+func CleanReferrer(referrer, domain string) string {
+	return Label("referrer", ReferrerSource(referrer, domain))
+}
@@ -0,0 +1,38 @@
+package aggregate
+
+import (
+	"testing"
+)
+
+func TestCleanReferrer(t *testing.T) {
+	tests := []struct {
+		referrer string
+		domain   string
+		expected string
+	}{
+		{"", "example.com", "Direct"},
+		{"https://google.com/search?q=test", "example.com", "google.com"},
+		{"https://facebook.com/share", "example.com", "facebook.com"},
+		{"https://example.com/page", "example.com", "Direct"},     // internal
+		{"https://sub.example.com/page", "example.com", "Direct"}, // internal subdomain
+		{"https://notexample.com/page", "example.com", "notexample.com"},
+		{"https://google.com/search?q=example.com", "example.com", "google.com"},
+		// Hosts are extracted as the SQL stores extract them
+		{"google.com/search", "example.com", "google.com"},
+		// Like ClickHouse domain(), a bare word without a scheme is a host
+		// rather than Direct, so every store counts it the same
+		{"invalid-url", "example.com", "invalid-url"},
+		{"https://user@news.ycombinator.com:443/item", "example.com", "news.ycombinator.com"},
+		{"://", "example.com", "Direct"},
+		{"https://twitter.com", "example.com", "twitter.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.referrer, func(t *testing.T) {
+			got := CleanReferrer(tt.referrer, tt.domain)
+			if got != tt.expected {
+				t.Errorf("CleanReferrer(%q, %q) = %q, want %q", tt.referrer, tt.domain, got, tt.expected)
+			}
+		})
+	}
+}
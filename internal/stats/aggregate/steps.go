@@ -0,0 +1,78 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+// MatchesStep compares a pathname against a step, both normalized as the SQL
+// side does; a trailing * matches any non-empty remainder after the prefix
+func MatchesStep(pathname, step string) bool {
+	pathname, step = funnel.NormalizePath(pathname), funnel.NormalizePattern(step)
+	if prefix, ok := strings.CutSuffix(step, "*"); ok {
+		return strings.HasPrefix(pathname, prefix) && len(pathname) > len(prefix)
+	}
+	return pathname == step
+}
+
+// MatchesPropText compares a prop value against a step's text, tag or href
+// case-insensitively; a leading ~ matches values containing the rest
+func MatchesPropText(value, want string) bool {
+	if want == "" {
+		return true
+	}
+	if sub, ok := strings.CutPrefix(want, "~"); ok {
+		return strings.Contains(strings.ToLower(value), strings.ToLower(sub))
+	}
+	return strings.EqualFold(value, want)
+}
+
+// ExtractJSONField returns the string stored under field in a JSON object: the
+// top-level value if there is one, else the first found depth-first in nested
+// objects and arrays, visiting keys in sorted order. Returns "" if field is
+// missing, not a string, or props is not JSON.
+func ExtractJSONField(props, field string) string {
+	if props == "" {
+		return ""
+	}
+	// Fast path: flat objects of strings, as autocapture sends
+	var flat map[string]string
+	if err := json.Unmarshal([]byte(props), &flat); err == nil {
+		return flat[field]
+	}
+	var v any
+	if err := json.Unmarshal([]byte(props), &v); err != nil {
+		return ""
+	}
+	s, _ := findJSONString(v, field)
+	return s
+}
+
+func findJSONString(v any, field string) (string, bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		if s, ok := v[field].(string); ok {
+			return s, true
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if s, ok := findJSONString(v[k], field); ok {
+				return s, true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if s, ok := findJSONString(item, field); ok {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
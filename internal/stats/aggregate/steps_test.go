@@ -0,0 +1,69 @@
+package aggregate
+
+import (
+	"testing"
+)
+
+func TestMatchesStep(t *testing.T) {
+	tests := []struct {
+		pathname string
+		step     string
+		expected bool
+	}{
+		{"/dashboard", "/dashboard", true},
+		{"/dashboard/settings", "/dashboard", false},
+		{"/dashboard/settings", "/dashboard/*", true},
+		{"/dashboard", "/dashboard/*", false}, // no trailing content
+		{"/", "/", true},
+		{"/page", "/other", false},
+		{"/api/v1/users", "/api/*", true},
+		{"/dashboard/", "/dashboard", true},
+		{"/dashboard", "/dashboard/", true},
+		{"/dashboard?tab=1", "/dashboard", true},
+		{"/Dashboard//Settings/", "/dashboard/*", true},
+		{"/dashboard/", "/dashboard/*", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pathname+"_"+tt.step, func(t *testing.T) {
+			got := MatchesStep(tt.pathname, tt.step)
+			if got != tt.expected {
+				t.Errorf("MatchesStep(%q, %q) = %v, want %v", tt.pathname, tt.step, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExtractJSONField(t *testing.T) {
+	tests := []struct {
+		json     string
+		field    string
+		expected string
+	}{
+		{`{"text":"hello","tag":"button"}`, "text", "hello"},
+		{`{"text":"hello","tag":"button"}`, "tag", "button"},
+		{`{"text":"hello","tag":"button"}`, "missing", ""},
+		{`{"text": "spaced"}`, "text", "spaced"},
+		{`{}`, "text", ""},
+		{`{"nested":{"text":"inner"}}`, "text", "inner"},
+		{`{"text":"Say \"hi\"","tag":"button"}`, "text", `Say "hi"`},
+		{`{"text":"a\"b","tag":"button"}`, "tag", "button"},
+		{`{"label":"\"text\":\"fake\"","text":"real"}`, "text", "real"},
+		{`{"text":"Kaufen \u00fcber ✓"}`, "text", "Kaufen über ✓"},
+		{`{"items":[{"id":1},{"text":"in array"}]}`, "text", "in array"},
+		{`{"a":{"text":"first"},"b":{"text":"second"}}`, "text", "first"},
+		{`{"text":{"nested":"object"},"inner":{"text":"string"}}`, "text", "string"},
+		{`{"text":42}`, "text", ""},
+		{`not json "text":"x"`, "text", ""},
+		{``, "text", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field+"_"+tt.json, func(t *testing.T) {
+			got := ExtractJSONField(tt.json, tt.field)
+			if got != tt.expected {
+				t.Errorf("ExtractJSONField(%q, %q) = %q, want %q", tt.json, tt.field, got, tt.expected)
+			}
+		})
+	}
+}
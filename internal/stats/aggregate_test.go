@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// Fixture values in the shapes trackers send, including the edge cases where
+// the SQL normalization and the aggregate helpers could disagree
+var (
+	randomReferrers = []string{
+		"", "https://google.com/search?q=x", "https://www.google.com/", "google.com/search",
+		"https://example.com/pricing", "https://blog.example.com/post", "https://notexample.com/",
+		"https://news.ycombinator.com/item?id=1", "https://user@news.ycombinator.com:443/",
+		"https://twitter.com/search?q=example.com", "//cdn.example.com/x", "android-app://com.slack/",
+		"not a url", "://",
+	}
+	randomDevices = []string{
+		"", " ", "desktop", "Mobile", "tablet", "iPad", "smarttv",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile Safari/537.36",
+		"Mozilla/5.0 (Linux; Android 13; SM-X710) Safari/537.36",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64)",
+	}
+)
+
+// TestStore_MatchesAggregate checks on random fixtures that the DuckDB store
+// reports what the aggregate helpers compute from the raw events
+func TestStore_MatchesAggregate(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	from := now.Add(-daysAgo(7))
+	ctx := WithFilters(context.Background(), Filters{})
+
+	for seed := int64(1); seed <= 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		var events []seedEvent
+		sources := make(map[string]int64)
+		devices := make(map[string]int64)
+		for i := 0; i < 20+rng.Intn(40); i++ {
+			ev := seedEvent{
+				VisitorID: fmt.Sprintf("v%d", rng.Intn(10)),
+				Referrer:  randomReferrers[rng.Intn(len(randomReferrers))],
+				Device:    randomDevices[rng.Intn(len(randomDevices))],
+				Ago:       time.Duration(rng.Int63n(int64(daysAgo(6)))),
+			}
+			events = append(events, ev)
+			sources[aggregate.CleanReferrer(ev.Referrer, fixtureDomain)]++
+			devices[aggregate.NormalizeDevice(ev.Device)]++
+		}
+		s := seedStore(t, now, events...)
+
+		gotSources, err := s.GetTopSources(ctx, fixtureDomain, from, now, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := countsByName(gotSources); !reflect.DeepEqual(got, sources) {
+			t.Errorf("seed %d: sources = %v, aggregate = %v", seed, got, sources)
+		}
+		gotDevices, err := s.GetTopDevices(ctx, fixtureDomain, from, now, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := countsByName(gotDevices); !reflect.DeepEqual(got, devices) {
+			t.Errorf("seed %d: devices = %v, aggregate = %v", seed, got, devices)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shortid/clickresearch-stats/internal/cache"
+)
+
+const (
+	// badgePath serves /api/public/badge/{slug}.json and .svg
+	badgePath = "/api/public/badge/"
+	// badgeTTL is how long badge numbers are reused, and how long clients and
+	// CDNs may keep them
+	badgeTTL = 10 * time.Minute
+	// badgeMissTTL lets CDNs absorb hotlinks to disabled or mistyped badges
+	badgeMissTTL = time.Minute
+	// maxBadgeLabel caps the label query param, in characters
+	maxBadgeLabel = 40
+)
+
+// BadgeSlugs maps the public badge slugs projects enabled to their domains,
+// so badge requests never wait on the auth database
+type BadgeSlugs struct {
+	mu      sync.RWMutex
+	domains map[string]string
+}
+
+// NewBadgeSlugs returns an empty slug map; projects' slugs are loaded with Set
+func NewBadgeSlugs() *BadgeSlugs {
+	return &BadgeSlugs{domains: map[string]string{}}
+}
+
+// Set replaces the slugs with domains, keyed by slug
+func (b *BadgeSlugs) Set(domains map[string]string) {
+	b.mu.Lock()
+	b.domains = domains
+	b.mu.Unlock()
+}
+
+// Domain returns the domain of the project that enabled slug
+func (b *BadgeSlugs) Domain(slug string) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	domain, ok := b.domains[slug]
+	return domain, ok
+}
+
+// SetBadgeSlugs enables the public badge endpoint for the slugs in slugs
+func (h *Handler) SetBadgeSlugs(slugs *BadgeSlugs) {
+	h.badges = slugs
+	h.badgeCache = cache.New(badgeTTL)
+}
+
+// Badge is a project's traffic this calendar month (UTC), as the public badge shows it
+type Badge struct {
+	Pageviews int64  `json:"pageviews"`
+	Visitors  int64  `json:"visitors"`
+	Since     string `json:"since"`
+}
+
+// HandleBadge serves the public badge of a project as JSON or as an SVG image.
+// The image takes label, color (hex or a named color) and metric (pageviews or
+// visitors) query params.
+func (h *Handler) HandleBadge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, badgePath)
+	slug, format, _ := strings.Cut(name, ".")
+	domain, ok := "", false
+	if h.badges != nil && h.store != nil {
+		domain, ok = h.badges.Domain(slug)
+	}
+	if !ok || (format != "json" && format != "svg") {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(badgeMissTTL.Seconds())))
+		writeError(w, nil, http.StatusNotFound)
+		return
+	}
+
+	var opts badgeOptions
+	if format == "svg" {
+		var err error
+		if opts, err = parseBadgeOptions(r); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	badge, err := h.badge(r.Context(), domain, time.Now().UTC())
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", int(badgeTTL.Seconds()), int(badgeTTL.Seconds())))
+	if format == "json" {
+		writeJSON(w, badge)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.Write([]byte(renderBadge(opts, badge)))
+}
+
+// badge returns domain's numbers for the month of now, reading the store at
+// most once per badgeTTL. The project's privacy mode, aliases and strict
+// domain policy apply as on the dashboard.
+func (h *Handler) badge(ctx context.Context, domain string, now time.Time) (Badge, error) {
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	cacheKey := fmt.Sprintf("badge:%s:%s", domain, from.Format("2006-01"))
+	var badge Badge
+	if h.badgeCache.Get(cacheKey, &badge) {
+		return badge, nil
+	}
+
+	ctx, _, err := h.privacyContext(WithFilters(ctx, Filters{}), domain, "")
+	if err != nil {
+		return badge, err
+	}
+	if ctx, _, err = h.aliasContext(ctx, domain, ""); err != nil {
+		return badge, err
+	}
+	if ctx, _, err = h.domainMatchContext(ctx, domain, ""); err != nil {
+		return badge, err
+	}
+	overview, err := h.store.GetOverview(ctx, domain, from, now)
+	if err != nil {
+		return badge, err
+	}
+	badge = Badge{Pageviews: overview.Pageviews, Visitors: overview.UniqueVisitors, Since: from.Format("2006-01-02")}
+	h.badgeCache.Set(cacheKey, badge)
+	return badge, nil
+}
+
+// badgeOptions are the query params of the SVG badge
+type badgeOptions struct {
+	label  string
+	color  string
+	metric string
+}
+
+var badgeHexColor = regexp.MustCompile(`^[0-9a-fA-F]{3}([0-9a-fA-F]{3})?$`)
+
+// badgeColors are the named colors the color param accepts, as shields.io names them
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"grey":        "#555",
+	"lightgrey":   "#9f9f9f",
+}
+
+func parseBadgeOptions(r *http.Request) (badgeOptions, error) {
+	q := r.URL.Query()
+	opts := badgeOptions{label: strings.TrimSpace(q.Get("label")), color: badgeColors["blue"], metric: q.Get("metric")}
+	switch opts.metric {
+	case "", "pageviews":
+		opts.metric = "pageviews"
+	case "visitors":
+	default:
+		return opts, fmt.Errorf("unknown metric %q, use pageviews or visitors", opts.metric)
+	}
+	if opts.label == "" {
+		opts.label = opts.metric + " this month"
+	}
+	if utf8.RuneCountInString(opts.label) > maxBadgeLabel {
+		return opts, fmt.Errorf("label exceeds %d characters", maxBadgeLabel)
+	}
+	if c := strings.TrimPrefix(q.Get("color"), "#"); c != "" {
+		if named, ok := badgeColors[c]; ok {
+			opts.color = named
+		} else if badgeHexColor.MatchString(c) {
+			opts.color = "#" + strings.ToLower(c)
+		} else {
+			return opts, fmt.Errorf("unknown color %q, use a hex color or one of brightgreen, green, yellow, orange, red, blue, grey, lightgrey", c)
+		}
+	}
+	return opts, nil
+}
+
+// formatBadgeCount shortens n for a badge: 950, 12.4k, 3.1M
+func formatBadgeCount(n int64) string {
+	short := func(v float64, unit string) string {
+		return strings.TrimSuffix(strconv.FormatFloat(v, 'f', 1, 64), ".0") + unit
+	}
+	switch {
+	case n < 1000:
+		return strconv.FormatInt(n, 10)
+	case n < 999_950:
+		return short(float64(n)/1e3, "k")
+	default:
+		return short(float64(n)/1e6, "M")
+	}
+}
+
+// badgeTextWidth approximates the width of s in 11px Verdana, enough to size
+// the badge without font metrics
+func badgeTextWidth(s string) int {
+	return utf8.RuneCountInString(s)*7 + 10
+}
+
+// renderBadge draws a flat two-part badge: the label on grey, the value on color
+func renderBadge(opts badgeOptions, badge Badge) string {
+	count := badge.Pageviews
+	if opts.metric == "visitors" {
+		count = badge.Visitors
+	}
+	value := formatBadgeCount(count)
+	label := html.EscapeString(opts.label)
+	lw, vw := badgeTextWidth(opts.label), badgeTextWidth(value)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[4]s</text><text x="%[7]d" y="14">%[4]s</text>
+<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text><text x="%[8]d" y="14">%[5]s</text>
+</g>
+</svg>
+`, lw+vw, lw, vw, label, value, opts.color, lw/2, lw+vw/2)
+}
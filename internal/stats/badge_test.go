@@ -0,0 +1,124 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata golden files")
+
+func TestRenderBadge_Golden(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		badge Badge
+	}{
+		{"default", "", Badge{Pageviews: 12_437, Visitors: 3_210}},
+		{"visitors_green", "?metric=visitors&color=brightgreen", Badge{Pageviews: 12_437, Visitors: 3_210}},
+		{"custom_label", "?label=%3Cviews%3E+%26+more&color=%23FF8800", Badge{Pageviews: 2_480_000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseBadgeOptions(httptest.NewRequest("GET", "/api/public/badge/x.svg"+tt.query, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := renderBadge(opts, tt.badge)
+
+			path := filepath.Join("testdata", "badge_"+tt.name+".svg")
+			if *updateGolden {
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("badge differs from %s:\n%s", path, got)
+			}
+		})
+	}
+}
+
+func TestParseBadgeOptions_Invalid(t *testing.T) {
+	for _, query := range []string{
+		"?metric=bounce_rate",
+		"?color=url(javascript:x)",
+		"?color=12345",
+		"?label=" + strings.Repeat("x", maxBadgeLabel+1),
+	} {
+		if _, err := parseBadgeOptions(httptest.NewRequest("GET", "/api/public/badge/x.svg"+query, nil)); err == nil {
+			t.Errorf("%s: want error", query)
+		}
+	}
+}
+
+func TestFormatBadgeCount(t *testing.T) {
+	for n, want := range map[int64]string{0: "0", 999: "999", 1000: "1k", 12_437: "12.4k", 999_949: "999.9k", 999_950: "1M", 3_140_000: "3.1M"} {
+		if got := formatBadgeCount(n); got != want {
+			t.Errorf("formatBadgeCount(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+// badgeStore counts overview reads
+type badgeStore struct {
+	fakeStore
+	reads int
+}
+
+func (s *badgeStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	s.reads++
+	return &Overview{Pageviews: 1500, UniqueVisitors: 40}, nil
+}
+
+func TestHandleBadge(t *testing.T) {
+	store := &badgeStore{}
+	h := NewHandler(store)
+	slugs := NewBadgeSlugs()
+	slugs.Set(map[string]string{"k3yS1ug": "example.com"})
+	h.SetBadgeSlugs(slugs)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.HandleBadge(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/api/public/badge/k3yS1ug.json")
+	var badge Badge
+	json.Unmarshal(w.Body.Bytes(), &badge)
+	if w.Code != http.StatusOK || badge.Pageviews != 1500 || badge.Visitors != 40 {
+		t.Fatalf("json: code %d, badge %+v", w.Code, badge)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=600, stale-while-revalidate=600" {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+
+	w = get("/api/public/badge/k3yS1ug.svg?label=views")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml; charset=utf-8" {
+		t.Fatalf("svg: code %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if store.reads != 1 {
+		t.Errorf("store read %d times, want the cached overview reused", store.reads)
+	}
+
+	for _, path := range []string{"/api/public/badge/unknown.json", "/api/public/badge/k3yS1ug.png", "/api/public/badge/k3yS1ug"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: code = %d, want 404", path, w.Code)
+		}
+	}
+	if w := get("/api/public/badge/k3yS1ug.svg?color=nope"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad color: code = %d, want 400", w.Code)
+	}
+}
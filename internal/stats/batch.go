@@ -0,0 +1,219 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+)
+
+const (
+	// maxBatchRequests caps the sub-requests of one batch
+	maxBatchRequests = 10
+	// maxBatchBodyBytes caps a batch request body; sub-requests have no bodies
+	// of their own, so this is far below reqbody.DefaultMaxBytes
+	maxBatchBodyBytes = 64 << 10
+	// maxBatchResponseBytes caps the combined bodies of a batch's results
+	maxBatchResponseBytes = 4 << 20
+)
+
+// BatchEndpoints are the report endpoints a batch may include, by the path
+// under /api/stats/. Endpoints with request bodies, streams and jobs are left out.
+var BatchEndpoints = []string{
+	"overview", "pageviews", "pages", "sources", "search", "devices", "geo", "geo/map", "utm",
+	"events", "event", "event-breakdown", "unique-pages", "errors", "funnel",
+	"campaign-conversions", "autocapture-events", "revenue", "freshness",
+}
+
+// BatchRequest is one sub-request of a batch. Params are the endpoint's query
+// parameters; they extend those of the batch request, except domain, which
+// the whole batch shares.
+type BatchRequest struct {
+	ID       string            `json:"id"`
+	Endpoint string            `json:"endpoint"`
+	Params   map[string]string `json:"params"`
+}
+
+// BatchResult is the response a sub-request got
+type BatchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// batchHandler returns the handler of a batch endpoint
+func (h *Handler) batchHandler(endpoint string) http.HandlerFunc {
+	switch endpoint {
+	case "overview":
+		return h.HandleOverview
+	case "pageviews":
+		return h.HandlePageviews
+	case "pages":
+		return h.HandlePages
+	case "sources":
+		return h.HandleSources
+	case "search":
+		return h.HandleSearch
+	case "devices":
+		return h.HandleDevices
+	case "geo":
+		return h.HandleGeo
+	case "geo/map":
+		return h.HandleGeoMap
+	case "utm":
+		return h.HandleUTM
+	case "events":
+		return h.HandleEvents
+	case "event":
+		return h.HandleEvent
+	case "event-breakdown":
+		return h.HandleEventBreakdown
+	case "unique-pages":
+		return h.HandleUniquePages
+	case "errors":
+		return h.HandleErrorPages
+	case "funnel":
+		return h.HandleFunnel
+	case "campaign-conversions":
+		return h.HandleCampaignConversions
+	case "autocapture-events":
+		return h.HandleAutocaptureEvents
+	case "revenue":
+		return h.HandleRevenue
+	case "freshness":
+		return h.HandleFreshness
+	}
+	return nil
+}
+
+// validateBatch lists what is wrong with the sub-requests of a batch
+func validateBatch(reqs []BatchRequest) []reqbody.FieldError {
+	if len(reqs) == 0 {
+		return []reqbody.FieldError{{Field: "requests", Message: "at least one request required"}}
+	}
+	if len(reqs) > maxBatchRequests {
+		return []reqbody.FieldError{{Field: "requests", Message: fmt.Sprintf("at most %d requests allowed", maxBatchRequests)}}
+	}
+	var errs []reqbody.FieldError
+	seen := make(map[string]bool)
+	for i, req := range reqs {
+		switch {
+		case req.ID == "":
+			errs = append(errs, reqbody.FieldError{Field: fmt.Sprintf("%d.id", i), Message: "required"})
+		case seen[req.ID]:
+			errs = append(errs, reqbody.FieldError{Field: fmt.Sprintf("%d.id", i), Message: fmt.Sprintf("duplicate id %q", req.ID)})
+		}
+		seen[req.ID] = true
+		if !slices.Contains(BatchEndpoints, req.Endpoint) {
+			errs = append(errs, reqbody.FieldError{Field: fmt.Sprintf("%d.endpoint", i), Message: fmt.Sprintf("unsupported endpoint %q", req.Endpoint)})
+		}
+		if _, ok := req.Params["domain"]; ok {
+			errs = append(errs, reqbody.FieldError{Field: fmt.Sprintf("%d.params.domain", i), Message: "set domain on the batch request"})
+		}
+	}
+	return errs
+}
+
+// HandleBatch serves POST /api/stats/batch?domain=..., which runs up to
+// maxBatchRequests report requests of one domain concurrently and answers
+// with each one's status and body by id, so one failing report doesn't fail
+// the others. Sub-requests go through the endpoints' own handlers, so they
+// share their cache entries, and run under the batch request's deadline.
+// Results past maxBatchResponseBytes are replaced by a 413.
+func (h *Handler) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain, _, _, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+
+	var reqs []BatchRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)
+	if err := reqbody.Decode(w, r, &reqs); err != nil {
+		reqbody.Write(w, err)
+		return
+	}
+	if err := reqbody.Invalid(validateBatch(reqs)...); err != nil {
+		reqbody.Write(w, err)
+		return
+	}
+
+	bufs := make([]*batchWriter, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		bufs[i] = &batchWriter{bufferedWriter: bufferedWriter{header: make(http.Header)}, parent: w}
+		sub := batchSubRequest(r, domain, req)
+		handle := h.batchHandler(req.Endpoint)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle(bufs[i], sub)
+		}()
+	}
+	wg.Wait()
+
+	results := make(map[string]BatchResult, len(reqs))
+	size := 0
+	for i, req := range reqs {
+		res := bufs[i].result()
+		if size += len(res.Body); size > maxBatchResponseBytes {
+			res = BatchResult{Status: http.StatusRequestEntityTooLarge, Body: json.RawMessage(
+				fmt.Sprintf(`{"error":"batch response exceeds %d bytes","code":"batch_too_large"}`, maxBatchResponseBytes))}
+		}
+		results[req.ID] = res
+	}
+	writeJSON(w, results)
+}
+
+// batchSubRequest is the GET of req's endpoint, with the batch request's
+// headers, context and query parameters
+func batchSubRequest(r *http.Request, domain string, req BatchRequest) *http.Request {
+	q := url.Values{}
+	for k, v := range r.URL.Query() {
+		q[k] = slices.Clone(v)
+	}
+	for k, v := range req.Params {
+		q.Set(k, v)
+	}
+	q.Set("domain", domain)
+
+	sub := r.Clone(r.Context())
+	sub.Method = http.MethodGet
+	sub.URL.Path = "/api/stats/" + req.Endpoint
+	sub.URL.RawQuery = q.Encode()
+	sub.Body, sub.ContentLength = http.NoBody, 0
+	return sub
+}
+
+// batchWriter holds a sub-request's response. It unwraps to the batch
+// response so errors of sub-requests are reported as the batch's.
+type batchWriter struct {
+	bufferedWriter
+	parent http.ResponseWriter
+}
+
+func (w *batchWriter) Unwrap() http.ResponseWriter { return w.parent }
+
+// result is the held response; bodies that aren't JSON become JSON strings
+func (w *batchWriter) result() BatchResult {
+	res := BatchResult{Status: w.code, Body: json.RawMessage(w.body.Bytes())}
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	if !json.Valid(res.Body) {
+		res.Body, _ = json.Marshal(w.body.String())
+	}
+	return res
+}
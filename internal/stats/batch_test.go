@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// overviewCountingStore counts overview queries
+type overviewCountingStore struct {
+	emptyStore
+	overviews *atomic.Int64
+}
+
+func (s overviewCountingStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	s.overviews.Add(1)
+	return &Overview{Pageviews: 3}, nil
+}
+
+func batchRequest(query, body string) *http.Request {
+	r := httptest.NewRequest("POST", "/api/stats/batch"+query, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func TestHandleBatch(t *testing.T) {
+	var overviews atomic.Int64
+	h := NewHandler(overviewCountingStore{overviews: &overviews})
+
+	w := httptest.NewRecorder()
+	h.HandleBatch(w, batchRequest("?domain=example.com&period=30d", `[
+		{"id": "o", "endpoint": "overview"},
+		{"id": "p", "endpoint": "pages", "params": {"limit": "5"}},
+		{"id": "bad", "endpoint": "overview", "params": {"period": "forever"}}
+	]`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var results map[string]BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("results = %v, want 3", results)
+	}
+	var o Overview
+	if err := json.Unmarshal(results["o"].Body, &o); err != nil || results["o"].Status != http.StatusOK || o.Pageviews != 3 {
+		t.Errorf("overview result = %d %s", results["o"].Status, results["o"].Body)
+	}
+	if results["p"].Status != http.StatusOK || string(results["p"].Body) != "[]" {
+		t.Errorf("pages result = %d %s", results["p"].Status, results["p"].Body)
+	}
+	if results["bad"].Status != http.StatusBadRequest {
+		t.Errorf("invalid period result = %d, want 400", results["bad"].Status)
+	}
+
+	// The sub-request filled the overview endpoint's cache entry
+	w = httptest.NewRecorder()
+	h.HandleOverview(w, httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period=30d", nil))
+	if w.Code != http.StatusOK || overviews.Load() != 1 {
+		t.Errorf("overview after batch: status %d, %d overview queries; want the cached one", w.Code, overviews.Load())
+	}
+}
+
+func TestHandleBatch_Rejects(t *testing.T) {
+	h := NewHandler(emptyStore{})
+	tooMany := "[" + strings.Repeat(`{"id": "x", "endpoint": "overview"},`, maxBatchRequests) + `{"id": "y", "endpoint": "overview"}]`
+	for name, tc := range map[string]struct {
+		query, body string
+		want        int
+	}{
+		"no domain":            {"", `[{"id": "o", "endpoint": "overview"}]`, http.StatusBadRequest},
+		"empty":                {"?domain=example.com", `[]`, http.StatusUnprocessableEntity},
+		"too many":             {"?domain=example.com", tooMany, http.StatusUnprocessableEntity},
+		"duplicate id":         {"?domain=example.com", `[{"id": "o", "endpoint": "overview"}, {"id": "o", "endpoint": "pages"}]`, http.StatusUnprocessableEntity},
+		"missing id":           {"?domain=example.com", `[{"endpoint": "overview"}]`, http.StatusUnprocessableEntity},
+		"unsupported endpoint": {"?domain=example.com", `[{"id": "f", "endpoint": "funnel-advanced"}]`, http.StatusUnprocessableEntity},
+		"other domain":         {"?domain=example.com", `[{"id": "o", "endpoint": "overview", "params": {"domain": "other.com"}}]`, http.StatusUnprocessableEntity},
+		"body too large":       {"?domain=example.com", `[{"id": "` + strings.Repeat("x", maxBatchBodyBytes) + `"}]`, http.StatusRequestEntityTooLarge},
+	} {
+		w := httptest.NewRecorder()
+		h.HandleBatch(w, batchRequest(tc.query, tc.body))
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d: %s", name, w.Code, tc.want, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.HandleBatch(w, httptest.NewRequest("GET", "/api/stats/batch?domain=example.com", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want 405", w.Code)
+	}
+}
+
+func TestBatchWriter_Result(t *testing.T) {
+	w := &batchWriter{bufferedWriter: bufferedWriter{header: make(http.Header)}}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	res := w.result()
+	if res.Status != http.StatusMethodNotAllowed || string(res.Body) != `"Method not allowed\n"` {
+		t.Errorf("result = %d %s, want the text as a JSON string", res.Status, res.Body)
+	}
+}
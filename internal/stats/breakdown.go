@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BreakdownResult is the top values of a dimension and how many values they
+// were cut from, so clients can show "top 10 of 3,482 pages"
+type BreakdownResult struct {
+	Items []TopItem `json:"items"`
+	// TotalGroups is the number of distinct labelled values before the limit,
+	// as the query counts them. Under value overrides, values left unread
+	// count as one label each, so it can exceed the labels they merge into.
+	TotalGroups int64 `json:"total_groups"`
+	// Truncated is set when Items leaves values out
+	Truncated bool `json:"truncated"`
+}
+
+// groupCounter receives the number of groups a top values query found before
+// its limit; the first report wins, so mirrored reads don't overwrite it
+type groupCounter struct {
+	mu      sync.Mutex
+	groups  int64
+	counted bool
+}
+
+type groupCounterKey struct{}
+
+// withGroupCounter asks the stores reading with the returned context to report
+// the groups of their top values query into the returned counter
+func withGroupCounter(ctx context.Context) (context.Context, *groupCounter) {
+	c := &groupCounter{}
+	return context.WithValue(ctx, groupCounterKey{}, c), c
+}
+
+// countGroups reports the groups of a top values query to the counter of ctx,
+// if it carries one
+func countGroups(ctx context.Context, groups int64) {
+	c, _ := ctx.Value(groupCounterKey{}).(*groupCounter)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.counted {
+		c.groups, c.counted = groups, true
+	}
+}
+
+// count returns the reported groups, or 0 when no store reported any
+func (c *groupCounter) count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.groups
+}
+
+// newBreakdownResult wraps items cut from groups values; with fewer groups
+// than items, as when no store counted them, the items are taken as complete
+func newBreakdownResult(items []TopItem, groups int64) BreakdownResult {
+	if items == nil {
+		items = []TopItem{}
+	}
+	total := max(groups, int64(len(items)))
+	return BreakdownResult{Items: items, TotalGroups: total, Truncated: total > int64(len(items))}
+}
+
+// topBreakdown reads the top limit values with fetch, counting the groups
+// they were cut from, and caches the result under cacheKey
+func (h *Handler) topBreakdown(ctx context.Context, cacheKey string, fetch func(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error), domain string, from, to time.Time, limit int) (BreakdownResult, error) {
+	var data BreakdownResult
+	if h.cacheGet(ctx, cacheKey, &data) {
+		return data, nil
+	}
+	countCtx, counter := withGroupCounter(ctx)
+	items, err := fetch(countCtx, domain, from, to, limit)
+	if err != nil {
+		return data, err
+	}
+	data = newBreakdownResult(items, counter.count())
+	h.cacheSet(ctx, cacheKey, data)
+	return data, nil
+}
+
+// writeBreakdownHeaders adds the group count of data to the response of an
+// endpoint whose body has always been a bare list, as X-Total-Groups and
+// X-Truncated
+func writeBreakdownHeaders(w http.ResponseWriter, data BreakdownResult) {
+	w.Header().Set("X-Total-Groups", strconv.FormatInt(data.TotalGroups, 10))
+	w.Header().Set("X-Truncated", strconv.FormatBool(data.Truncated))
+}
@@ -0,0 +1,156 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore_GroupCount(t *testing.T) {
+	now := time.Now().UTC()
+	s := seedStore(t, now,
+		seedEvent{Pathname: "/", Ago: time.Hour},
+		seedEvent{Pathname: "/", Ago: time.Hour},
+		seedEvent{Pathname: "/pricing", Ago: time.Hour},
+		seedEvent{Pathname: "/docs", Ago: time.Hour},
+		seedEvent{Referrer: "https://news.ycombinator.com/", Ago: time.Hour},
+		seedEvent{Referrer: "https://www.bing.com/", Ago: time.Hour},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+	from := now.Add(-24 * time.Hour)
+
+	countCtx, counter := withGroupCounter(ctx)
+	pages, err := s.GetTopPages(countCtx, fixtureDomain, from, now, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BreakdownResult{Items: []TopItem{{Name: "/", Count: 4}}, TotalGroups: 3, Truncated: true}
+	if got := newBreakdownResult(pages, counter.count()); !reflect.DeepEqual(got, want) {
+		t.Errorf("pages = %+v, want %+v", got, want)
+	}
+
+	countCtx, counter = withGroupCounter(ctx)
+	sources, err := s.GetTopSources(countCtx, fixtureDomain, from, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := newBreakdownResult(sources, counter.count()); got.TotalGroups != 3 || got.Truncated {
+		t.Errorf("sources = %+v, want 3 complete", got)
+	}
+}
+
+func TestStore_GroupCountMergesLabels(t *testing.T) {
+	now := time.Now().UTC()
+	s := seedStore(t, now,
+		seedEvent{Browser: "Chrome", Ago: time.Hour},
+		seedEvent{Browser: "Chrome", Ago: time.Hour},
+		seedEvent{Browser: " Chrome ", Ago: time.Hour},
+		seedEvent{Browser: "Firefox", Ago: time.Hour},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+	from := now.Add(-24 * time.Hour)
+
+	// Three raw values over a limit of two merge into two labels, all shown
+	countCtx, counter := withGroupCounter(ctx)
+	browsers, err := s.GetTopBrowsers(countCtx, fixtureDomain, from, now, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BreakdownResult{Items: []TopItem{{Name: "Chrome", Count: 3}, {Name: "Firefox", Count: 1}}, TotalGroups: 2, Truncated: false}
+	if got := newBreakdownResult(browsers, counter.count()); !reflect.DeepEqual(got, want) {
+		t.Errorf("browsers = %+v, want %+v", got, want)
+	}
+
+	countCtx, counter = withGroupCounter(ctx)
+	browsers, err = s.GetTopBrowsers(countCtx, fixtureDomain, from, now, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = BreakdownResult{Items: []TopItem{{Name: "Chrome", Count: 3}}, TotalGroups: 2, Truncated: true}
+	if got := newBreakdownResult(browsers, counter.count()); !reflect.DeepEqual(got, want) {
+		t.Errorf("browsers over the limit = %+v, want %+v", got, want)
+	}
+}
+
+func TestStore_GroupCountReadsOnce(t *testing.T) {
+	now := time.Now().UTC()
+	var events []seedEvent
+	for i := 0; i < 30; i++ {
+		events = append(events, seedEvent{Pathname: fmt.Sprintf("/page-%d", i), Ago: time.Hour})
+	}
+	s := seedStore(t, now, events...)
+	rec := &QueryRecorder{}
+	ctx, counter := withGroupCounter(WithQueryRecorder(WithFilters(context.Background(), Filters{}), rec))
+
+	pages, err := s.GetTopPages(ctx, fixtureDomain, now.Add(-24*time.Hour), now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := newBreakdownResult(pages, counter.count()); len(got.Items) != 10 || got.TotalGroups != 30 || !got.Truncated {
+		t.Errorf("pages = %+v, want 10 of 30", got)
+	}
+	queries := rec.Queries()
+	if len(queries) != 1 || len(queries[0].Params) < 4 || queries[0].Params[3] != 10 {
+		t.Errorf("queries = %+v, want one with LIMIT 10", queries)
+	}
+}
+
+func TestNewBreakdownResult(t *testing.T) {
+	items := []TopItem{{Name: "/", Count: 2}, {Name: "/a", Count: 1}}
+	for _, tt := range []struct {
+		groups    int64
+		total     int64
+		truncated bool
+	}{
+		{0, 2, false},
+		{2, 2, false},
+		// Labels merge raw values, so stores may count fewer items than groups
+		{1, 2, false},
+		{5, 5, true},
+	} {
+		got := newBreakdownResult(items, tt.groups)
+		if got.TotalGroups != tt.total || got.Truncated != tt.truncated {
+			t.Errorf("groups %d: %+v, want total %d truncated %v", tt.groups, got, tt.total, tt.truncated)
+		}
+	}
+	if got := newBreakdownResult(nil, 0); got.Items == nil {
+		t.Error("nil items are encoded as null")
+	}
+}
+
+func TestHandlePages_BreakdownHeaders(t *testing.T) {
+	now := time.Now().UTC()
+	h := NewHandler(seedStore(t, now,
+		seedEvent{Pathname: "/", Ago: time.Hour},
+		seedEvent{Pathname: "/pricing", Ago: time.Hour},
+		seedEvent{Pathname: "/docs", Ago: time.Hour},
+	))
+
+	// The cached response keeps its headers
+	for range 2 {
+		w := httptest.NewRecorder()
+		h.HandlePages(w, httptest.NewRequest("GET", "/api/stats/pages?domain=example.com&period=7d&limit=2", nil))
+		if got := w.Header().Get("X-Total-Groups"); got != "3" {
+			t.Errorf("X-Total-Groups = %q, want 3", got)
+		}
+		if got := w.Header().Get("X-Truncated"); got != "true" {
+			t.Errorf("X-Truncated = %q, want true", got)
+		}
+		var items []TopItem
+		if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil || len(items) != 2 {
+			t.Errorf("body = %s, want the bare list of 2 pages", w.Body)
+		}
+	}
+
+	data, err := h.Breakdown(context.Background(), Query{Domain: fixtureDomain}, "pages", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.TotalGroups != 3 || data.Truncated || len(data.Items) != 3 {
+		t.Errorf("Breakdown = %+v", data)
+	}
+}
@@ -0,0 +1,523 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+// budgetIdleTTL is how long a full, unused bucket is kept before it is dropped
+const budgetIdleTTL = 10 * time.Minute
+
+// BudgetExceededError is returned instead of running a store query once a
+// domain has used up its query budget
+type BudgetExceededError struct {
+	Domain     string
+	RetryAfter time.Duration
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("query budget exceeded for %s, retry in %ds", e.Domain, retryAfterSeconds(e.RetryAfter))
+}
+
+// retryAfterSeconds rounds up so clients never retry before a token is available
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// DomainBudget reports one domain's query budget for the debug endpoint
+type DomainBudget struct {
+	Domain   string  `json:"domain"`
+	Tokens   float64 `json:"tokens"`
+	Used     int64   `json:"used"`
+	Rejected int64   `json:"rejected"`
+}
+
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	used     int64
+	rejected int64
+}
+
+// domainBudget is a token bucket per domain: perMinute tokens refill evenly over
+// a minute, up to a burst of perMinute. Each store query spends one token.
+// The limits can be replaced while serving; perMinute <= 0 lifts them.
+type domainBudget struct {
+	limits atomic.Pointer[budgetLimits]
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// budgetLimits is one snapshot of the budget settings, read once per query
+type budgetLimits struct {
+	perMinute int
+	exempt    map[string]bool
+}
+
+func newDomainBudget(perMinute int, exempt []string) *domainBudget {
+	b := &domainBudget{buckets: make(map[string]*tokenBucket)}
+	b.set(perMinute, exempt)
+	return b
+}
+
+// set replaces the limits; buckets keep their tokens, capped to the new burst
+func (b *domainBudget) set(perMinute int, exempt []string) {
+	l := &budgetLimits{perMinute: perMinute, exempt: map[string]bool{DemoDomain: true}}
+	for _, domain := range exempt {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			l.exempt[domain] = true
+		}
+	}
+	b.limits.Store(l)
+}
+
+// limited reports whether domain is budgeted under l
+func (l *budgetLimits) limited(domain string) bool {
+	return l.perMinute > 0 && !l.exempt[domain]
+}
+
+// take spends a token for domain, or reports how long until one is available
+func (b *domainBudget) take(domain string, now time.Time) (bool, time.Duration) {
+	l := b.limits.Load()
+	if !l.limited(domain) {
+		return true, 0
+	}
+	rate := float64(l.perMinute) / 60 // tokens per second
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(now)
+
+	bucket, ok := b.buckets[domain]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.perMinute), last: now}
+		b.buckets[domain] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.perMinute), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		bucket.rejected++
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	bucket.tokens--
+	bucket.used++
+	return true, 0
+}
+
+// peek reports the budget of domain, the tokens left and how long until its bucket
+// is full, without spending any. limited is false for exempt domains.
+func (b *domainBudget) peek(domain string, now time.Time) (limit, remaining int, reset time.Duration, limited bool) {
+	l := b.limits.Load()
+	if !l.limited(domain) {
+		return 0, 0, 0, false
+	}
+	rate := float64(l.perMinute) / 60
+
+	b.mu.Lock()
+	tokens := float64(l.perMinute)
+	if bucket, ok := b.buckets[domain]; ok {
+		tokens = math.Min(tokens, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	}
+	b.mu.Unlock()
+
+	return l.perMinute, int(tokens), time.Duration((float64(l.perMinute) - tokens) / rate * float64(time.Second)), true
+}
+
+// sweep drops buckets idle long enough to have refilled, so the map only holds
+// recently active domains. Called with mu held.
+func (b *domainBudget) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < budgetIdleTTL {
+		return
+	}
+	b.lastSweep = now
+	for domain, bucket := range b.buckets {
+		if now.Sub(bucket.last) > budgetIdleTTL {
+			delete(b.buckets, domain)
+		}
+	}
+}
+
+// snapshot lists active domains by tokens used, refilled to now
+func (b *domainBudget) snapshot(now time.Time) []DomainBudget {
+	l := b.limits.Load()
+	if l.perMinute <= 0 {
+		return nil
+	}
+	rate := float64(l.perMinute) / 60
+
+	b.mu.Lock()
+	result := make([]DomainBudget, 0, len(b.buckets))
+	for domain, bucket := range b.buckets {
+		result = append(result, DomainBudget{
+			Domain:   domain,
+			Tokens:   math.Floor(math.Min(float64(l.perMinute), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)),
+			Used:     bucket.used,
+			Rejected: bucket.rejected,
+		})
+	}
+	b.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Used != result[j].Used {
+			return result[i].Used > result[j].Used
+		}
+		return result[i].Domain < result[j].Domain
+	})
+	return result
+}
+
+type budgetExemptKey struct{}
+
+// withBudgetExempt marks store calls made with ctx as free, for admins and cache warming
+func withBudgetExempt(ctx context.Context) context.Context {
+	return context.WithValue(ctx, budgetExemptKey{}, true)
+}
+
+// SetQueryBudget limits each domain to perMinute store queries per minute; cache hits
+// are free. The demo domain and exempt domains are unlimited. perMinute <= 0 disables it.
+// The first call must come before serving; later calls change the limits in place.
+func (h *Handler) SetQueryBudget(perMinute int, exempt []string) {
+	if h.budget != nil {
+		h.budget.set(perMinute, exempt)
+		return
+	}
+	if h.store == nil {
+		return
+	}
+	h.budget = newDomainBudget(perMinute, exempt)
+	h.store = &budgetStore{StoreInterface: h.store, budget: h.budget}
+}
+
+// WithQueryBudget exempts admin requests from the per-domain query budget and adds
+// X-RateLimit-* headers to stats responses for budgeted domains
+func (h *Handler) WithQueryBudget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.budget == nil || !strings.HasPrefix(r.URL.Path, "/api/stats/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if h.roles != nil && h.roles.RequestRole(r) == "admin" {
+			next.ServeHTTP(w, r.WithContext(withBudgetExempt(r.Context())))
+			return
+		}
+		if domain := r.URL.Query().Get("domain"); domain != "" {
+			w = &rateLimitWriter{ResponseWriter: w, budget: h.budget, domain: domain}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitWriter sets rate limit headers just before the response starts, so they
+// reflect the tokens the request itself spent
+type rateLimitWriter struct {
+	http.ResponseWriter
+	budget *domainBudget
+	domain string
+	done   bool
+}
+
+func (w *rateLimitWriter) setHeaders() {
+	if w.done {
+		return
+	}
+	w.done = true
+	limit, remaining, reset, limited := w.budget.peek(w.domain, time.Now())
+	if !limited {
+		return
+	}
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	// Seconds until the budget is fully refilled
+	h.Set("X-RateLimit-Reset", strconv.Itoa(retryAfterSeconds(reset)))
+}
+
+func (w *rateLimitWriter) WriteHeader(code int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *rateLimitWriter) Write(p []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush streams
+func (w *rateLimitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// budgetSnapshot returns per-domain consumption, or nil when no budget is set
+func (h *Handler) budgetSnapshot() []DomainBudget {
+	if h.budget == nil {
+		return nil
+	}
+	return h.budget.snapshot(time.Now())
+}
+
+// budgetStore spends a domain's token before every store query
+type budgetStore struct {
+	StoreInterface
+	budget *domainBudget
+}
+
+func (s *budgetStore) spend(ctx context.Context, domain string) error {
+	if exempt, _ := ctx.Value(budgetExemptKey{}).(bool); exempt {
+		return nil
+	}
+	if ok, retry := s.budget.take(domain, time.Now()); !ok {
+		return &BudgetExceededError{Domain: domain, RetryAfter: retry}
+	}
+	return nil
+}
+
+func (s *budgetStore) GetDimensionValues(ctx context.Context, domain, column string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetDimensionValues(ctx, domain, column, from, to, limit)
+}
+
+func (s *budgetStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetOverview(ctx, domain, from, to)
+}
+
+func (s *budgetStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetPageviewsTimeSeries(ctx, domain, from, to, interval)
+}
+
+func (s *budgetStore) GetActivity(ctx context.Context, domain string, from, to time.Time, step time.Duration) ([]ActivityBucket, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetActivity(ctx, domain, from, to, step)
+}
+
+func (s *budgetStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopPages(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetTopSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopSources(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetSourceBuckets(ctx context.Context, domain string, from, to time.Time, limit int) ([]SourceBucket, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetSourceBuckets(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetTopReferrerURLs(ctx context.Context, domain string, from, to time.Time, limit int) ([]ReferrerURLItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopReferrerURLs(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetSearchEngines(ctx context.Context, domain string, from, to time.Time, limit int) ([]SearchEngineItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetSearchEngines(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetTopBrowsers(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopBrowsers(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetTopCountries(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopCountries(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetTopDevices(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopDevices(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetTopLanguages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopLanguages(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetScreenSizes(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetScreenSizes(ctx, domain, from, to)
+}
+
+func (s *budgetStore) GetCountryMap(ctx context.Context, domain string, from, to time.Time) ([]GeoItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetCountryMap(ctx, domain, from, to)
+}
+
+func (s *budgetStore) GetTopRegions(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopRegions(ctx, domain, country, from, to, limit)
+}
+
+func (s *budgetStore) GetTopCities(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopCities(ctx, domain, country, from, to, limit)
+}
+
+func (s *budgetStore) GetDomainMismatches(ctx context.Context, domain string, subdomains bool, from, to time.Time, limit int) ([]HostnameItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetDomainMismatches(ctx, domain, subdomains, from, to, limit)
+}
+
+func (s *budgetStore) GetTopUTMSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopUTMSources(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetTopUTMMediums(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopUTMMediums(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetTopUTMCampaigns(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetTopUTMCampaigns(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields) ([]EventItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetRecentEvents(ctx, domain, from, to, limit, fields)
+}
+
+func (s *budgetStore) StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields, fn func(EventItem) error) error {
+	if err := s.spend(ctx, domain); err != nil {
+		return err
+	}
+	return s.StoreInterface.StreamRecentEvents(ctx, domain, from, to, limit, fields, fn)
+}
+
+func (s *budgetStore) GetEvent(ctx context.Context, domain, id string) (*EventItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetEvent(ctx, domain, id)
+}
+
+func (s *budgetStore) GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]EventBreakdownItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetEventBreakdown(ctx, domain, from, to)
+}
+
+func (s *budgetStore) GetEventCardinality(ctx context.Context, domain string, from, to time.Time) (EventCardinality, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return EventCardinality{}, err
+	}
+	return s.StoreInterface.GetEventCardinality(ctx, domain, from, to)
+}
+
+func (s *budgetStore) GetUniquePages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetUniquePages(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetFunnel(ctx context.Context, domain string, from, to time.Time, steps []string) (*FunnelResult, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetFunnel(ctx, domain, from, to, steps)
+}
+
+func (s *budgetStore) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, windowMinutes int) (*FunnelResult, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetFunnelAdvanced(ctx, domain, from, to, steps, windowMinutes)
+}
+
+func (s *budgetStore) GetStepMatchCounts(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step) ([]int64, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetStepMatchCounts(ctx, domain, from, to, steps)
+}
+
+func (s *budgetStore) GetErrorPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]ErrorPage, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetErrorPages(ctx, domain, from, to, limit)
+}
+
+func (s *budgetStore) GetCampaignConversions(ctx context.Context, domain string, goal funnel.Step, from, to time.Time, opts CampaignOptions, limit int) ([]CampaignConversion, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetCampaignConversions(ctx, domain, goal, from, to, opts, limit)
+}
+
+func (s *budgetStore) GetRevenue(ctx context.Context, domain string, from, to time.Time) (*Revenue, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetRevenue(ctx, domain, from, to)
+}
+
+func (s *budgetStore) GetAutocaptureEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]AutocaptureEvent, error) {
+	if err := s.spend(ctx, domain); err != nil {
+		return nil, err
+	}
+	return s.StoreInterface.GetAutocaptureEvents(ctx, domain, from, to, limit)
+}
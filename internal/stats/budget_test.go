@@ -0,0 +1,164 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// overviewStore counts store queries
+type overviewStore struct {
+	fakeStore
+	queries int
+}
+
+func (s *overviewStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	s.queries++
+	return &Overview{Pageviews: 1}, nil
+}
+
+func TestDomainBudget_Take(t *testing.T) {
+	b := newDomainBudget(2, []string{" internal.example.com "})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take("example.com", now); !ok {
+			t.Fatalf("query %d rejected within budget", i+1)
+		}
+	}
+	ok, retry := b.take("example.com", now)
+	if ok {
+		t.Fatal("third query allowed with a budget of 2/min")
+	}
+	if retry != 30*time.Second {
+		t.Errorf("retry = %v, want 30s", retry)
+	}
+	if ok, _ := b.take("example.com", now.Add(30*time.Second)); !ok {
+		t.Error("query rejected after a token refilled")
+	}
+
+	// Other domains have their own bucket
+	if ok, _ := b.take("other.com", now); !ok {
+		t.Error("other.com rejected by example.com's budget")
+	}
+
+	for _, domain := range []string{DemoDomain, "internal.example.com"} {
+		for i := 0; i < 5; i++ {
+			if ok, _ := b.take(domain, now); !ok {
+				t.Errorf("exempt domain %s rejected", domain)
+			}
+		}
+	}
+
+	snap := b.snapshot(now.Add(30 * time.Second))
+	if len(snap) != 2 || snap[0].Domain != "example.com" || snap[0].Used != 3 || snap[0].Rejected != 1 {
+		t.Errorf("snapshot = %+v", snap)
+	}
+}
+
+func TestDomainBudget_SweepsIdleDomains(t *testing.T) {
+	b := newDomainBudget(10, nil)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.take("a.com", now)
+	b.take("b.com", now.Add(budgetIdleTTL+time.Minute))
+
+	if snap := b.snapshot(now); len(snap) != 1 || snap[0].Domain != "b.com" {
+		t.Errorf("snapshot = %+v, want only b.com", snap)
+	}
+}
+
+func TestHandler_QueryBudget(t *testing.T) {
+	store := &overviewStore{}
+	h := NewHandler(store)
+	h.SetQueryBudget(1, nil)
+
+	get := func(url string, role string) *httptest.ResponseRecorder {
+		h.SetRoleSource(fakeRoles(role))
+		w := httptest.NewRecorder()
+		h.WithQueryBudget(http.HandlerFunc(h.HandleOverview)).ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	if w := get("/api/stats/overview?domain=example.com&period=7d", ""); w.Code != http.StatusOK {
+		t.Fatalf("first query: status = %d", w.Code)
+	}
+
+	w := get("/api/stats/overview?domain=example.com&period=30d", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over budget: status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	var body map[string]any
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["code"] != "query_budget_exceeded" {
+		t.Errorf("body = %v", body)
+	}
+
+	// Cached responses don't need a token
+	if w := get("/api/stats/overview?domain=example.com&period=7d", ""); w.Code != http.StatusOK {
+		t.Errorf("cached query: status = %d, want 200", w.Code)
+	}
+
+	// Admins are exempt
+	if w := get("/api/stats/overview?domain=example.com&period=90d", "admin"); w.Code != http.StatusOK {
+		t.Errorf("admin query: status = %d, want 200", w.Code)
+	}
+
+	if store.queries != 2 {
+		t.Errorf("store queries = %d, want 2", store.queries)
+	}
+}
+
+func TestWithQueryBudget_RateLimitHeaders(t *testing.T) {
+	h := NewHandler(&overviewStore{})
+	h.SetQueryBudget(10, nil)
+	api := h.WithQueryBudget(http.HandlerFunc(h.HandleOverview))
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/overview?domain=example.com", nil))
+	want := map[string]string{
+		"X-RateLimit-Limit":     "10",
+		"X-RateLimit-Remaining": "9",
+		"X-RateLimit-Reset":     "6",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+
+	// Exempt domains are not limited, so they get no headers
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/overview?domain="+DemoDomain, nil))
+	if got := w.Header().Get("X-RateLimit-Limit"); got != "" {
+		t.Errorf("exempt domain got X-RateLimit-Limit %q", got)
+	}
+}
+
+func TestSetQueryBudget_ChangesLimitsInPlace(t *testing.T) {
+	h := NewHandler(&overviewStore{})
+	h.SetQueryBudget(0, nil)
+	api := h.WithQueryBudget(http.HandlerFunc(h.HandleOverview))
+	limit := func(period string) string {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period="+period, nil))
+		return w.Header().Get("X-RateLimit-Limit")
+	}
+
+	if got := limit("7d"); got != "" {
+		t.Errorf("disabled budget: X-RateLimit-Limit = %q", got)
+	}
+	h.SetQueryBudget(20, nil)
+	if got := limit("30d"); got != "20" {
+		t.Errorf("after enabling: X-RateLimit-Limit = %q, want 20", got)
+	}
+	h.SetQueryBudget(5, []string{"example.com"})
+	if got := limit("90d"); got != "" {
+		t.Errorf("after exempting: X-RateLimit-Limit = %q", got)
+	}
+}
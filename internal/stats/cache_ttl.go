@@ -0,0 +1,61 @@
+package stats
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Responses over ranges that ended before the day before yesterday are cached
+// for historicalCacheTTL: late events and resyncs settle within a day or two,
+// after which the numbers no longer move. Their cache keys pin the range, so
+// a calendar period that moves on misses rather than reading old entries.
+const (
+	historicalCacheTTL = 12 * time.Hour
+	historicalAfter    = 48 * time.Hour
+)
+
+// cacheTTLHeader reports in seconds how long the response is cached, for debugging
+const cacheTTLHeader = "X-Cache-TTL"
+
+type cacheTTLKey struct{}
+
+// rangeCacheTTL picks the TTL of a range ending at to: historicalCacheTTL
+// when to is at least historicalAfter before the midnight starting today in
+// loc, else short. Ranges touching today or yesterday keep the short TTL.
+func rangeCacheTTL(to, now time.Time, loc *time.Location, short time.Duration) time.Duration {
+	local := now.In(loc)
+	y, m, d := local.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	if to.After(today.Add(-historicalAfter)) || short >= historicalCacheTTL {
+		return short
+	}
+	return historicalCacheTTL
+}
+
+// cacheTTLContext records in ctx the TTL responses over [from, to) in loc are
+// cached with and reports it in header's cacheTTLHeader. Partial answers keep
+// the short TTL, as the full data may be back at the next load.
+func (h *Handler) cacheTTLContext(ctx context.Context, header http.Header, loc *time.Location, to time.Time) context.Context {
+	if h.cache == nil {
+		return ctx
+	}
+	ttl := h.cache.TTL()
+	if !isPartialData(ctx) {
+		ttl = rangeCacheTTL(to, time.Now(), loc, ttl)
+	}
+	header.Set(cacheTTLHeader, strconv.Itoa(int(ttl.Seconds())))
+	return context.WithValue(ctx, cacheTTLKey{}, ttl)
+}
+
+// cacheSet caches a response with the TTL cacheTTLContext chose for ctx, or
+// the cache's own TTL
+func (h *Handler) cacheSet(ctx context.Context, key string, val any) {
+	ttl, ok := ctx.Value(cacheTTLKey{}).(time.Duration)
+	if !ok {
+		h.cache.Set(key, val)
+		return
+	}
+	h.cache.SetWithTTL(key, val, ttl)
+}
@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRangeCacheTTL(t *testing.T) {
+	short := 5 * time.Minute
+	now := time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		period string
+		want   time.Duration
+	}{
+		{"today", short},
+		{"yesterday", short},
+		{"7d", short},
+		{"last_month", historicalCacheTTL},
+	} {
+		_, to, err := PeriodRange(tt.period, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rangeCacheTTL(to, now, time.UTC, short); got != tt.want {
+			t.Errorf("%s: TTL %v, want %v", tt.period, got, tt.want)
+		}
+	}
+
+	// Early on March 3rd in UTC last month ended two days ago; in New York it
+	// is still March 2nd and last month ended yesterday
+	now = time.Date(2024, 3, 3, 1, 0, 0, 0, time.UTC)
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		loc  *time.Location
+		want time.Duration
+	}{
+		{time.UTC, historicalCacheTTL},
+		{ny, short},
+	} {
+		_, to, _ := PeriodRange("last_month", now.In(tt.loc))
+		if got := rangeCacheTTL(to, now, tt.loc, short); got != tt.want {
+			t.Errorf("last_month in %s: TTL %v, want %v", tt.loc, got, tt.want)
+		}
+	}
+
+	if got := rangeCacheTTL(now.AddDate(0, -1, 0), now, time.UTC, 24*time.Hour); got != 24*time.Hour {
+		t.Errorf("short TTL above the historical one lowered to %v", got)
+	}
+}
+
+func TestHandleOverview_CacheTTLHeader(t *testing.T) {
+	h := NewHandler(emptyStore{})
+	get := func(period string) string {
+		w := httptest.NewRecorder()
+		h.HandleOverview(w, httptest.NewRequest("GET", "/api/stats/overview?domain=new.example.com&period="+period, nil))
+		return w.Header().Get(cacheTTLHeader)
+	}
+
+	if got := get("today"); got != "300" {
+		t.Errorf("today: %s = %q, want 300", cacheTTLHeader, got)
+	}
+	// last_month ends at most two days ago on the 1st and 2nd
+	if time.Now().UTC().Day() > 2 {
+		if got := get("last_month"); got != "43200" {
+			t.Errorf("last_month: %s = %q, want 43200", cacheTTLHeader, got)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package stats
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// MaxCampaigns caps the campaigns a project registers
+const MaxCampaigns = 200
+
+// campaignScanLimit is how many utm_campaign values the registered campaigns
+// report reads before matching; the long tail past it is left out
+const campaignScanLimit = 1000
+
+// CampaignSource loads the canonical utm_campaign values registered for a domain
+type CampaignSource interface {
+	RegisteredCampaigns(domain string) ([]string, error)
+}
+
+// SetCampaignSource enables campaigns=registered on the UTM endpoint
+func (h *Handler) SetCampaignSource(src CampaignSource) {
+	h.campaigns = src
+}
+
+// CampaignKey is the form registered campaigns are matched and kept unique by
+func CampaignKey(value string) string {
+	return aggregate.CampaignKey(value)
+}
+
+// registeredCampaigns returns the campaigns registered for domain and
+// extends filterKey with them, so cached reports follow registry changes
+func (h *Handler) registeredCampaigns(domain, filterKey string) ([]string, string, error) {
+	if h.campaigns == nil {
+		return nil, filterKey + "|campaigns=", nil
+	}
+	registered, err := h.campaigns.RegisteredCampaigns(domain)
+	if err != nil {
+		return nil, "", err
+	}
+	return registered, filterKey + "|campaigns=" + strings.Join(registered, ","), nil
+}
+
+// topRegisteredCampaigns counts domain's utm_campaign values toward its
+// registered campaigns, see aggregate.MatchCampaigns
+func (h *Handler) topRegisteredCampaigns(ctx context.Context, domain string, registered []string, from, to time.Time) ([]TopItem, error) {
+	observed, err := h.store.GetTopUTMCampaigns(ctx, domain, from, to, campaignScanLimit)
+	if err != nil {
+		return nil, err
+	}
+	return aggregate.MatchCampaigns(observed, registered), nil
+}
@@ -0,0 +1,71 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeCampaignSource map[string][]string
+
+func (f fakeCampaignSource) RegisteredCampaigns(domain string) ([]string, error) {
+	return f[domain], nil
+}
+
+// utmCampaignStore reports fixed utm_campaign counts, recording the limit asked for
+type utmCampaignStore struct {
+	emptyStore
+	limit *int
+}
+
+func (s utmCampaignStore) GetTopUTMCampaigns(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	*s.limit = limit
+	return []TopItem{{Name: "spring_sale", Count: 7}, {Name: "Spring-Sale", Count: 3}, {Name: "promo", Count: 2}}, nil
+}
+
+func TestHandleUTM_RegisteredCampaigns(t *testing.T) {
+	var limit int
+	registry := fakeCampaignSource{"example.com": {"spring_sale", "black_friday"}}
+	h := NewHandler(utmCampaignStore{limit: &limit})
+	h.SetCampaignSource(registry)
+
+	get := func(query string) (int, UTMData) {
+		w := httptest.NewRecorder()
+		h.HandleUTM(w, httptest.NewRequest("GET", "/api/stats/utm?domain=example.com&period=7d"+query, nil))
+		var data UTMData
+		json.Unmarshal(w.Body.Bytes(), &data)
+		return w.Code, data
+	}
+
+	if _, data := get(""); len(data.Campaigns) != 3 || limit != 10 {
+		t.Errorf("default mode = %v with limit %d, want the observed values", data.Campaigns, limit)
+	}
+
+	_, data := get("&campaigns=registered")
+	want := []TopItem{{Name: "spring_sale", Count: 10}, {Name: "black_friday"}, {Name: "(unregistered)", Count: 2}}
+	if len(data.Campaigns) != len(want) {
+		t.Fatalf("registered mode = %v, want %v", data.Campaigns, want)
+	}
+	for i := range want {
+		if data.Campaigns[i] != want[i] {
+			t.Errorf("registered mode = %v, want %v", data.Campaigns, want)
+			break
+		}
+	}
+	if limit != campaignScanLimit {
+		t.Errorf("registered mode read %d values, want %d", limit, campaignScanLimit)
+	}
+
+	// Registering a campaign changes the report despite the cache
+	registry["example.com"] = append(registry["example.com"], "promo")
+	if _, data := get("&campaigns=registered"); len(data.Campaigns) != 3 || data.Campaigns[1].Name != "promo" {
+		t.Errorf("after registering promo = %v", data.Campaigns)
+	}
+
+	if code, _ := get("&campaigns=all"); code != http.StatusBadRequest {
+		t.Errorf("unknown mode status = %d, want 400", code)
+	}
+}
@@ -0,0 +1,130 @@
+package stats
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//go:embed countries.tsv
+var countriesTSV string
+
+// Country is the metadata of an ISO 3166-1 alpha-2 code
+type Country struct {
+	Code          string `json:"code"`
+	Name          string `json:"name"`
+	Flag          string `json:"flag,omitempty"`
+	Continent     string `json:"continent,omitempty"`
+	ContinentName string `json:"continent_name,omitempty"`
+}
+
+// continentNames labels the continent codes GeoNames assigns countries
+var continentNames = map[string]string{
+	"AF": "Africa", "AN": "Antarctica", "AS": "Asia", "EU": "Europe",
+	"NA": "North America", "OC": "Oceania", "SA": "South America",
+}
+
+// countries lists the embedded metadata in code order, including XX for
+// unknown countries; countryIndex maps codes to their entry
+var countries, countryIndex = parseCountries(countriesTSV)
+
+// parseCountries reads the code, name and continent columns of the
+// generated table, deriving flags from the codes
+func parseCountries(table string) ([]Country, map[string]int) {
+	var list []Country
+	for _, line := range strings.Split(table, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			panic(fmt.Sprintf("countries.tsv: malformed line %q", line))
+		}
+		c := Country{Code: fields[0], Name: fields[1], Continent: fields[2], ContinentName: continentNames[fields[2]]}
+		if code := countryCode(c.Code); code != "" {
+			c.Flag = flagEmoji(code)
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	index := make(map[string]int, len(list))
+	for i, c := range list {
+		index[c.Code] = i
+	}
+	return list, index
+}
+
+// flagEmoji spells an alpha-2 code in regional indicator symbols, which
+// renders as the country's flag
+func flagEmoji(code string) string {
+	return string([]rune{rune(code[0]) - 'A' + 0x1F1E6, rune(code[1]) - 'A' + 0x1F1E6})
+}
+
+// lookupCountry returns the metadata of an alpha-2 code
+func lookupCountry(code string) (Country, bool) {
+	i, ok := countryIndex[code]
+	if !ok {
+		return Country{}, false
+	}
+	return countries[i], true
+}
+
+// countryContinents sets the continent of country items
+func countryContinents(items []GeoItem) []GeoItem {
+	for i := range items {
+		if c, ok := lookupCountry(items[i].Code); ok {
+			items[i].Continent = c.Continent
+		}
+	}
+	return items
+}
+
+// rollupContinents sums country items per continent, busiest first. Countries
+// without one are reported as LabelUnknown.
+func rollupContinents(items []GeoItem) []GeoItem {
+	result := []GeoItem{}
+	index := make(map[string]int)
+	for _, item := range countryContinents(items) {
+		i, ok := index[item.Continent]
+		if !ok {
+			name := continentNames[item.Continent]
+			if name == "" {
+				name = LabelUnknown
+			}
+			i = len(result)
+			index[item.Continent] = i
+			result = append(result, GeoItem{Code: item.Continent, Name: name})
+		}
+		// Visitors can't be deduplicated across countries; the sum is an upper bound
+		result[i].Count += item.Count
+		result[i].Visitors += item.Visitors
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Count > result[j].Count })
+	return result
+}
+
+// parseGeoLevel reads the level of HandleGeo; "" means countries
+func parseGeoLevel(r *http.Request) (string, error) {
+	switch level := r.URL.Query().Get("level"); level {
+	case "", GeoLevelCountry:
+		return GeoLevelCountry, nil
+	case GeoLevelContinent:
+		return level, nil
+	default:
+		return "", errors.New("level must be country or continent")
+	}
+}
+
+// countriesMaxAge is how long clients may cache the country metadata, which
+// only changes with a deploy
+const countriesMaxAge = 24 * 60 * 60
+
+// HandleCountries returns the metadata of every country code: English name,
+// flag and continent
+func (h *Handler) HandleCountries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", countriesMaxAge))
+	writeJSON(w, countries)
+}
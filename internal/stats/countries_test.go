@@ -0,0 +1,100 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// iso3166 lists every officially assigned ISO 3166-1 alpha-2 code
+const iso3166 = `AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ
+BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ
+DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP
+GQ GR GS GT GU GW GY HK HM HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI
+KM KN KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP
+MQ MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM
+PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX
+SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU
+WF WS YE YT ZA ZM ZW`
+
+func TestCountries_Complete(t *testing.T) {
+	codes := strings.Fields(iso3166)
+	if len(codes) != 249 {
+		t.Fatalf("reference lists %d codes, want 249", len(codes))
+	}
+	for _, code := range codes {
+		c, ok := lookupCountry(code)
+		if !ok {
+			t.Errorf("%s missing", code)
+			continue
+		}
+		if c.Name == "" || c.ContinentName == "" || utf8.RuneCountInString(c.Flag) != 2 {
+			t.Errorf("%s = %+v", code, c)
+		}
+	}
+	if c, ok := lookupCountry("XX"); !ok || c.Name != "Unknown" || c.Continent != "" {
+		t.Errorf("XX = %+v, %v", c, ok)
+	}
+	if c, _ := lookupCountry("DE"); c.Flag != "🇩🇪" || c.Name != "Germany" || c.ContinentName != "Europe" {
+		t.Errorf("DE = %+v", c)
+	}
+	for i := 1; i < len(countries); i++ {
+		if countries[i-1].Code >= countries[i].Code {
+			t.Errorf("countries out of order at %s", countries[i].Code)
+		}
+	}
+}
+
+func TestRollupContinents(t *testing.T) {
+	got := rollupContinents([]GeoItem{
+		{Code: "DE", Count: 2, Visitors: 2},
+		{Code: "US", Count: 4, Visitors: 3},
+		{Code: "FR", Count: 1, Visitors: 1},
+		{Code: "QQ", Count: 1, Visitors: 1},
+	})
+	want := []GeoItem{
+		{Code: "NA", Name: "North America", Count: 4, Visitors: 3},
+		{Code: "EU", Name: "Europe", Count: 3, Visitors: 3},
+		{Name: LabelUnknown, Count: 1, Visitors: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("continents = %+v, want %+v", got, want)
+	}
+}
+
+func TestHandleGeo_Continent(t *testing.T) {
+	h := NewHandler(newGeoStore(t))
+
+	w := httptest.NewRecorder()
+	h.HandleGeo(w, httptest.NewRequest("GET", "/api/stats/geo?domain=example.com&period=7d&level=continent", nil))
+	var continents []GeoItem
+	if err := json.Unmarshal(w.Body.Bytes(), &continents); err != nil {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	want := []GeoItem{{Code: "NA", Name: "North America", Count: 4, Visitors: 3}, {Code: "EU", Name: "Europe", Count: 2, Visitors: 2}}
+	if !reflect.DeepEqual(continents, want) {
+		t.Errorf("continents = %+v, want %+v", continents, want)
+	}
+
+	w = httptest.NewRecorder()
+	h.HandleGeo(w, httptest.NewRequest("GET", "/api/stats/geo?domain=example.com&level=city", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("level=city: status %d, want 400", w.Code)
+	}
+}
+
+func TestHandleCountries(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Handler{}).HandleCountries(w, httptest.NewRequest("GET", "/api/stats/meta/countries", nil))
+	var got []Country
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(countries) || w.Header().Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("%d countries, Cache-Control %q", len(got), w.Header().Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,29 @@
+package stats
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultQueryTimeout bounds a stats request when no timeout is configured
+const DefaultQueryTimeout = 15 * time.Second
+
+// statusClientClosedRequest is the nginx convention for requests the client abandoned
+const statusClientClosedRequest = 499
+
+// WithDeadline bounds /api/stats/* requests by timeout so slow store queries
+// end in a 504 instead of hanging until the client gives up
+func WithDeadline(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streams stay open until the client leaves
+		if timeout <= 0 || !strings.HasPrefix(r.URL.Path, "/api/stats/") || isStreamPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,99 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/errorsink"
+)
+
+// blockingStore never answers until the request context ends
+type blockingStore struct {
+	fakeStore
+}
+
+func (blockingStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestWithDeadline_Timeout(t *testing.T) {
+	h := NewHandler(blockingStore{})
+	handler := WithDeadline(http.HandlerFunc(h.HandleOverview), 20*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/overview?domain=example.com", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", w.Code)
+	}
+	var body map[string]any
+	json.NewDecoder(w.Body).Decode(&body)
+	if body["code"] != "query_timeout" || body["error"] != "query timed out" {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestWithDeadline_TimeoutReported(t *testing.T) {
+	h := NewHandler(blockingStore{})
+	sink := errorsink.New(errorsink.DefaultSize)
+	handler := errorsink.Middleware(sink, WithDeadline(http.HandlerFunc(h.HandleOverview), 20*time.Millisecond))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/stats/overview?domain=example.com", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/stats/overview", nil))
+
+	// The 400 for the missing domain is the client's fault and isn't kept
+	recs := sink.Recent("", time.Time{})
+	if len(recs) != 1 || recs[0].Status != http.StatusGatewayTimeout || recs[0].Domain != "example.com" ||
+		recs[0].Route != "/api/stats/overview" || recs[0].Error != "query timed out" {
+		t.Errorf("records = %+v", recs)
+	}
+}
+
+func TestWithDeadline_ClientCanceled(t *testing.T) {
+	h := NewHandler(blockingStore{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/api/stats/overview?domain=example.com", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	WithDeadline(http.HandlerFunc(h.HandleOverview), time.Minute).ServeHTTP(w, req)
+
+	if w.Code != statusClientClosedRequest {
+		t.Errorf("status = %d, want %d", w.Code, statusClientClosedRequest)
+	}
+}
+
+func TestWithDeadline_OnlyStats(t *testing.T) {
+	var deadline bool
+	handler := WithDeadline(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, deadline = r.Context().Deadline()
+	}), time.Second)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/projects", nil))
+	if deadline {
+		t.Error("non-stats request got a deadline")
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/stats/pages", nil))
+	if !deadline {
+		t.Error("stats request has no deadline")
+	}
+}
+
+func TestStoreLock_HonorsContext(t *testing.T) {
+	s := withState(&Store{}, storeSnapshot{ready: true})
+	s.mu.Lock() // a refresh in progress
+	defer s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := s.GetTopBrowsers(ctx, "example.com", time.Now(), time.Now(), 10)
+	if !errors.Is(err, ErrQueryTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want ErrQueryTimeout wrapping context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,171 @@
+package stats
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// latencyWindow is how far back debug percentiles look
+	latencyWindow = 5 * time.Minute
+	// latencySamples bounds the ring buffer; older samples are overwritten
+	latencySamples = 4096
+)
+
+type latencySample struct {
+	path string
+	at   time.Time
+	d    time.Duration
+}
+
+// latencyRecorder keeps recent request durations in a fixed ring buffer.
+// Recording is O(1); percentiles are only computed when the debug endpoint is read.
+type latencyRecorder struct {
+	mu       sync.Mutex
+	samples  [latencySamples]latencySample
+	next     int
+	inFlight atomic.Int64
+}
+
+func (l *latencyRecorder) record(path string, at time.Time, d time.Duration) {
+	l.mu.Lock()
+	l.samples[l.next] = latencySample{path: path, at: at, d: d}
+	l.next = (l.next + 1) % latencySamples
+	l.mu.Unlock()
+}
+
+// EndpointLatency summarizes one endpoint over latencyWindow
+type EndpointLatency struct {
+	Count int     `json:"count"`
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+}
+
+func (l *latencyRecorder) snapshot(now time.Time) map[string]EndpointLatency {
+	l.mu.Lock()
+	samples := l.samples
+	l.mu.Unlock()
+
+	byPath := make(map[string][]time.Duration)
+	cutoff := now.Add(-latencyWindow)
+	for _, s := range samples {
+		if s.path == "" || s.at.Before(cutoff) {
+			continue
+		}
+		byPath[s.path] = append(byPath[s.path], s.d)
+	}
+
+	result := make(map[string]EndpointLatency, len(byPath))
+	for path, ds := range byPath {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		result[path] = EndpointLatency{
+			Count: len(ds),
+			P50Ms: percentile(ds, 0.50),
+			P95Ms: percentile(ds, 0.95),
+		}
+	}
+	return result
+}
+
+// percentile uses nearest-rank on sorted durations, in milliseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p*float64(len(sorted))+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return float64(sorted[idx].Microseconds()) / 1000
+}
+
+// ObserveRequest is called by the logging middleware; the returned func records
+// the request's latency once it completes. Only /api/ paths are tracked.
+func (h *Handler) ObserveRequest(path string) func() {
+	// Live streams last minutes and would swamp the latency percentiles
+	if !strings.HasPrefix(path, "/api/") || isStreamPath(path) {
+		return func() {}
+	}
+	start := time.Now()
+	h.latency.inFlight.Add(1)
+	return func() {
+		h.latency.inFlight.Add(-1)
+		h.latency.record(path, start, time.Since(start))
+	}
+}
+
+// DomainCacheStatus describes the domain list events are validated against
+type DomainCacheStatus struct {
+	Domains int `json:"domains"`
+	Denied  int `json:"denied"`
+	// Source is where the domains were loaded from: "stats", "file" or "none"
+	Source string `json:"source"`
+	// AgeSeconds is how old the domains are; for a file, since it was written
+	AgeSeconds float64 `json:"age_seconds"`
+	// File is the fallback copy read when the stats server is unreachable
+	File string `json:"file"`
+}
+
+// DomainCacheSource reports the domain cache's state; *auth.DomainCache implements it
+type DomainCacheSource interface {
+	Status() DomainCacheStatus
+}
+
+// SetDomainCacheSource adds the domain cache's size and age to the debug endpoint
+func (h *Handler) SetDomainCacheSource(src DomainCacheSource) {
+	h.domainCache = src
+}
+
+// HandleDebug returns cache, latency and store diagnostics. Admin-only; wrapped by auth in main.
+func (h *Handler) HandleDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := map[string]any{
+		"cache":           h.cache.Stats(),
+		"latency":         h.latency.snapshot(time.Now()),
+		"window_seconds":  int(latencyWindow.Seconds()),
+		"active_requests": h.latency.inFlight.Load(),
+		"cache_warm":      h.warmStats(),
+		"query_budget":    h.budgetSnapshot(),
+	}
+	if h.store != nil {
+		resp["store"] = h.store.Status()
+	}
+	if h.domainCache != nil {
+		resp["domain_cache"] = h.domainCache.Status()
+	}
+	if h.spam != nil {
+		defaults, extra := h.spam.Size()
+		resp["referrer_spam"] = map[string]any{
+			"enabled":         h.excludeSpam,
+			"default_domains": defaults,
+			"extra_domains":   extra,
+			"excluded_events": h.spamExcluded.Load(),
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// HandleRefreshStatus returns the store's refresh status, with the progress of
+// a ClickHouse resync. Admin-only; wrapped by auth in main.
+func (h *Handler) HandleRefreshStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, h.store.Status())
+}
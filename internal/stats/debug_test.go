@@ -0,0 +1,99 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyRecorder_Snapshot(t *testing.T) {
+	l := &latencyRecorder{}
+	now := time.Now()
+
+	for i := 1; i <= 100; i++ {
+		l.record("/api/stats/pages", now, time.Duration(i)*time.Millisecond)
+	}
+	l.record("/api/stats/overview", now.Add(-10*time.Minute), time.Second) // outside window
+
+	snap := l.snapshot(now)
+	pages := snap["/api/stats/pages"]
+	if pages.Count != 100 || pages.P50Ms != 50 || pages.P95Ms != 95 {
+		t.Errorf("pages latency = %+v, want count 100, p50 50, p95 95", pages)
+	}
+	if _, ok := snap["/api/stats/overview"]; ok {
+		t.Error("samples older than the window should be excluded")
+	}
+}
+
+func TestLatencyRecorder_Wraps(t *testing.T) {
+	l := &latencyRecorder{}
+	now := time.Now()
+	for i := 0; i < latencySamples+10; i++ {
+		l.record("/api/stats/pages", now, time.Millisecond)
+	}
+	if got := l.snapshot(now)["/api/stats/pages"].Count; got != latencySamples {
+		t.Errorf("Count = %d, want %d", got, latencySamples)
+	}
+}
+
+type statusStore struct {
+	fakeStore
+}
+
+func (statusStore) Status() StoreStatus {
+	return StoreStatus{Backend: "duckdb", Ready: true}
+}
+
+func TestHandleDebug(t *testing.T) {
+	h := NewHandler(statusStore{})
+
+	done := h.ObserveRequest("/api/stats/overview")
+	done()
+	h.ObserveRequest("/favicon.ico")() // not tracked
+
+	w := httptest.NewRecorder()
+	h.HandleDebug(w, httptest.NewRequest("GET", "/api/stats/debug", nil))
+
+	var body struct {
+		Latency        map[string]EndpointLatency `json:"latency"`
+		Store          StoreStatus                `json:"store"`
+		ActiveRequests int64                      `json:"active_requests"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if body.Latency["/api/stats/overview"].Count != 1 || len(body.Latency) != 1 {
+		t.Errorf("latency = %+v", body.Latency)
+	}
+	if body.Store.Backend != "duckdb" || body.ActiveRequests != 0 {
+		t.Errorf("body = %s", w.Body.String())
+	}
+}
+
+type resyncingStore struct {
+	fakeStore
+}
+
+func (resyncingStore) Status() StoreStatus {
+	return StoreStatus{Backend: "clickhouse", Ready: true, Resync: &ResyncProgress{State: "running", PartitionsDone: 3, PartitionsTotal: 12}}
+}
+
+func TestHandleRefreshStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewHandler(resyncingStore{}).HandleRefreshStatus(w, httptest.NewRequest("GET", "/api/admin/refresh-status", nil))
+	var st StoreStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Resync == nil || st.Resync.PartitionsDone != 3 || st.Resync.PartitionsTotal != 12 {
+		t.Errorf("status = %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	NewHandler(statusStore{}).HandleRefreshStatus(w, httptest.NewRequest("GET", "/api/admin/refresh-status", nil))
+	if strings.Contains(w.Body.String(), "resync") {
+		t.Errorf("status without a resync = %s", w.Body)
+	}
+}
@@ -0,0 +1,60 @@
+package stats
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// Device classes. Every device value is reported as exactly one of these.
+const (
+	LabelMobile = aggregate.LabelMobile
+	LabelTablet = aggregate.LabelTablet
+	LabelOther  = aggregate.LabelOther
+)
+
+// deviceCaseExpr renders aggregate.DeviceRules as a CASE over the lowercased, trimmed value v,
+// using contains to build a substring test
+func deviceCaseExpr(v string, contains func(v, sub string) string) string {
+	anyOf := func(subs []string) string {
+		parts := make([]string, len(subs))
+		for i, sub := range subs {
+			parts[i] = contains(v, sub)
+		}
+		return "(" + strings.Join(parts, " OR ") + ")"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CASE WHEN %s = '' THEN '%s'", v, LabelDesktop)
+	for _, rule := range aggregate.DeviceRules {
+		cond := anyOf(rule.Match)
+		if len(rule.Unless) > 0 {
+			cond += " AND NOT " + anyOf(rule.Unless)
+		}
+		fmt.Fprintf(&sb, " WHEN %s THEN '%s'", cond, rule.Class)
+	}
+	fmt.Fprintf(&sb, " ELSE '%s' END", LabelOther)
+	return sb.String()
+}
+
+// duckdbDeviceExpr normalizes a device column in DuckDB like aggregate.NormalizeDevice
+func duckdbDeviceExpr(column string) string {
+	return deviceCaseExpr(fmt.Sprintf("lower(trim(COALESCE(%s, '')))", column), func(v, sub string) string {
+		return fmt.Sprintf("contains(%s, '%s')", v, sub)
+	})
+}
+
+// clickhouseDeviceExpr normalizes a device column in ClickHouse like aggregate.NormalizeDevice
+func clickhouseDeviceExpr(column string) string {
+	return deviceCaseExpr(fmt.Sprintf("lower(trimBoth(ifNull(%s, '')))", column), func(v, sub string) string {
+		return fmt.Sprintf("position(%s, '%s') > 0", v, sub)
+	})
+}
+
+// postgresDeviceExpr normalizes a device column in Postgres like aggregate.NormalizeDevice
+func postgresDeviceExpr(column string) string {
+	return deviceCaseExpr(fmt.Sprintf("lower(trim(COALESCE(%s, '')))", column), func(v, sub string) string {
+		return fmt.Sprintf("strpos(%s, '%s') > 0", v, sub)
+	})
+}
@@ -0,0 +1,134 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+var deviceCases = []struct {
+	value string
+	want  string
+}{
+	{"", LabelDesktop},
+	{"   ", LabelDesktop},
+	{"desktop", LabelDesktop},
+	{"Desktop", LabelDesktop},
+	{"mobile", LabelMobile},
+	{"MOBILE ", LabelMobile},
+	{"smartphone", LabelMobile},
+	{"phablet", LabelMobile},
+	{"tablet", LabelTablet},
+	{"Tablet", LabelTablet},
+	{"iPad", LabelTablet},
+	{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148", LabelMobile},
+	{"Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile Safari/537.36", LabelMobile},
+	{"Mozilla/5.0 (Linux; Android 13; SM-X710) Safari/537.36", LabelTablet},
+	{"Mozilla/5.0 (Windows NT 10.0; Win64; x64)", LabelDesktop},
+	{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0)", LabelDesktop},
+	{"smarttv", LabelOther},
+	{"console", LabelOther},
+}
+
+func TestNormalizeDevice(t *testing.T) {
+	for _, tt := range deviceCases {
+		if got := aggregate.NormalizeDevice(tt.value); got != tt.want {
+			t.Errorf("aggregate.NormalizeDevice(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDuckDBDeviceExpr_MatchesNormalizeDevice(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	query := "SELECT " + duckdbDeviceExpr("$1::VARCHAR")
+	for _, tt := range append(deviceCases, struct{ value, want string }{}) {
+		var got string
+		if err := db.QueryRow(query, tt.value).Scan(&got); err != nil {
+			t.Fatalf("%q: %v", tt.value, err)
+		}
+		if want := aggregate.NormalizeDevice(tt.value); got != want {
+			t.Errorf("SQL device class of %q = %q, want %q", tt.value, got, want)
+		}
+	}
+
+	var got string
+	if err := db.QueryRow("SELECT " + duckdbDeviceExpr("NULL")).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != LabelDesktop {
+		t.Errorf("SQL device class of NULL = %q, want %q", got, LabelDesktop)
+	}
+}
+
+func TestClickhouseDeviceExpr_CoversRules(t *testing.T) {
+	expr := clickhouseDeviceExpr("device")
+	for _, rule := range aggregate.DeviceRules {
+		for _, sub := range rule.Match {
+			if !strings.Contains(expr, "'"+sub+"'") {
+				t.Errorf("expression missing %q", sub)
+			}
+		}
+	}
+	if strings.Count(expr, " WHEN ") != len(aggregate.DeviceRules)+1 {
+		t.Errorf("expression has %d branches, want %d", strings.Count(expr, " WHEN "), len(aggregate.DeviceRules)+1)
+	}
+}
+
+func TestStoreTopDevices_Normalized(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, 'v' || i AS visitor_id, 'pageview' AS name,
+			'' AS url, '/' AS pathname, '' AS referrer, '' AS country, '' AS browser, '' AS os,
+			d AS device, '' AS props, TIMESTAMP '2024-01-01 10:00:00' AS timestamp
+		FROM (VALUES
+			(1, 'mobile'), (2, 'Mobile'), (3, 'iPhone'), (4, 'tablet'), (5, 'iPad'),
+			(6, ''), (7, NULL), (8, 'Desktop'), (9, 'smarttv'), (10, 'console')
+		) t(i, d)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+
+	ctx := WithFilters(context.Background(), Filters{})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	devices, err := s.GetTopDevices(ctx, "example.com", from, from.Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) > 4 {
+		t.Errorf("got %d device rows, want at most 4: %+v", len(devices), devices)
+	}
+	want := map[string]int64{LabelMobile: 3, LabelTablet: 2, LabelDesktop: 3, LabelOther: 2}
+	got := countsByName(devices)
+	for name, count := range want {
+		if got[name] != count {
+			t.Errorf("%s = %d, want %d", name, got[name], count)
+		}
+	}
+
+	// Filtering on a class matches every raw spelling of it
+	ctx = WithFilters(context.Background(), Filters{Device: "tablet"})
+	devices, err = s.GetTopDevices(ctx, "example.com", from, from.Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []TopItem{{Name: LabelTablet, Count: 2}}; len(devices) != 1 || devices[0] != want[0] {
+		t.Errorf("tablet devices = %+v, want %+v", devices, want)
+	}
+}
@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// MaxDomainAliases caps the hostnames a project attributes to its domain
+const MaxDomainAliases = 10
+
+// AliasSource loads the hostnames whose events count toward the project of a
+// domain, besides the domain itself. Events stay stored under the hostname
+// the tracker reported, so reports read all of them.
+type AliasSource interface {
+	DomainAliases(domain string) ([]string, error)
+}
+
+// SetAliasSource makes stats endpoints merge the events of each domain's aliases
+func (h *Handler) SetAliasSource(src AliasSource) {
+	h.aliases = src
+}
+
+// NormalizeAlias lowercases and validates an alias hostname. Unlike
+// NormalizeHost it keeps "www.", as events are stored under the exact host.
+func NormalizeAlias(host string) (string, error) {
+	h := strings.ToLower(strings.TrimSpace(host))
+	if len(h) > 253 || !spamDomainRe.MatchString(h) {
+		return "", fmt.Errorf("invalid hostname %q", host)
+	}
+	return h, nil
+}
+
+type domainAliasesKey struct{}
+
+// withDomainAliases makes store queries of a domain read the events of
+// aliases as well
+func withDomainAliases(ctx context.Context, aliases []string) context.Context {
+	if len(aliases) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, domainAliasesKey{}, aliases)
+}
+
+// domainAliasesFromContext returns the aliases of withDomainAliases, if any
+func domainAliasesFromContext(ctx context.Context) []string {
+	aliases, _ := ctx.Value(domainAliasesKey{}).([]string)
+	return aliases
+}
+
+// queryDomains is domain followed by the aliases ctx carries: the set of
+// domains store queries read, bound as one parameter. ClickHouse binds it as
+// is to domain IN ?.
+func queryDomains(ctx context.Context, domain string) []string {
+	return append([]string{domain}, domainAliasesFromContext(ctx)...)
+}
+
+// duckdbDomains binds the domains of queryDomains to a DuckDB query reading
+// them with list_contains(from_json($1, '["VARCHAR"]'), domain), as the
+// driver binds no lists
+func duckdbDomains(ctx context.Context, domain string) string {
+	set, _ := json.Marshal(queryDomains(ctx, domain))
+	return string(set)
+}
+
+// postgresDomains binds the domains of queryDomains to a Postgres query
+// reading them with domain = ANY($1)
+func postgresDomains(ctx context.Context, domain string) any {
+	return pq.Array(queryDomains(ctx, domain))
+}
+
+// AliasContext makes store queries of domain with the returned context read
+// the events of the aliases src has for it as well, as stats endpoints do;
+// a nil src leaves ctx as it is
+func AliasContext(ctx context.Context, src AliasSource, domain string) (context.Context, error) {
+	if src == nil {
+		return ctx, nil
+	}
+	aliases, err := src.DomainAliases(domain)
+	if err != nil {
+		return nil, err
+	}
+	aliases = slices.DeleteFunc(slices.Clone(aliases), func(a string) bool { return a == domain })
+	slices.Sort(aliases)
+	return withDomainAliases(ctx, slices.Compact(aliases)), nil
+}
+
+// AliasDomains is domain followed by the aliases AliasContext put in ctx
+func AliasDomains(ctx context.Context, domain string) []string {
+	return queryDomains(ctx, domain)
+}
+
+// aliasContext is AliasContext with the aliases of h, extending filterKey
+// with them so cached reports follow alias changes
+func (h *Handler) aliasContext(ctx context.Context, domain, filterKey string) (context.Context, string, error) {
+	ctx, err := AliasContext(ctx, h.aliases, domain)
+	if err != nil {
+		return nil, "", err
+	}
+	if aliases := domainAliasesFromContext(ctx); len(aliases) > 0 {
+		filterKey += "|aliases=" + strings.Join(aliases, ",")
+	}
+	return ctx, filterKey, nil
+}
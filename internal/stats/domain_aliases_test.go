@@ -0,0 +1,115 @@
+package stats
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeAliasSource map[string][]string
+
+func (f fakeAliasSource) DomainAliases(domain string) ([]string, error) {
+	return f[domain], nil
+}
+
+func TestNormalizeAlias(t *testing.T) {
+	if got, err := NormalizeAlias(" WWW.Example.com "); err != nil || got != "www.example.com" {
+		t.Errorf("NormalizeAlias = %q, %v; want www.example.com", got, err)
+	}
+	for _, bad := range []string{"", "example", "exa mple.com", "https://example.com"} {
+		if _, err := NormalizeAlias(bad); err == nil {
+			t.Errorf("NormalizeAlias(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestDuckdbDomains(t *testing.T) {
+	if got := duckdbDomains(context.Background(), fixtureDomain); got != `["example.com"]` {
+		t.Errorf("without aliases = %s", got)
+	}
+	ctx := withDomainAliases(context.Background(), []string{"www.example.com"})
+	if got := duckdbDomains(ctx, `a.com","b.com`); got != `["a.com\",\"b.com","www.example.com"]` {
+		t.Errorf("with aliases = %s, want the domain kept whole", got)
+	}
+}
+
+func TestHandler_AliasContext(t *testing.T) {
+	h := NewHandler(emptyStore{})
+	h.SetAliasSource(fakeAliasSource{fixtureDomain: {"www.example.com", fixtureDomain, "staging.example.com", "www.example.com"}})
+
+	ctx, key, err := h.aliasContext(context.Background(), fixtureDomain, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domainAliasesFromContext(ctx); strings.Join(got, ",") != "staging.example.com,www.example.com" {
+		t.Errorf("aliases = %v, want sorted and without the domain", got)
+	}
+	if key != "f|aliases=staging.example.com,www.example.com" {
+		t.Errorf("filter key = %q", key)
+	}
+	if _, key, _ := h.aliasContext(context.Background(), "other.com", "f"); key != "f" {
+		t.Errorf("filter key without aliases = %q", key)
+	}
+}
+
+func TestStore_OverviewMergesAliases(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	s := seedStore(t, now,
+		seedEvent{Ago: time.Hour},
+		seedEvent{Domain: "www.example.com", VisitorID: "v2", Ago: time.Hour},
+		seedEvent{Domain: "other.com", VisitorID: "v3", Ago: time.Hour},
+	)
+	from := now.Add(-daysAgo(7))
+	ctx := WithFilters(context.Background(), Filters{})
+
+	o, err := s.GetOverview(ctx, fixtureDomain, from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 1 {
+		t.Errorf("pageviews without aliases = %d, want 1", o.Pageviews)
+	}
+	o, err = s.GetOverview(withDomainAliases(ctx, []string{"www.example.com"}), fixtureDomain, from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 2 || o.UniqueVisitors != 2 {
+		t.Errorf("overview with aliases = %d pageviews, %d visitors; want 2 and 2", o.Pageviews, o.UniqueVisitors)
+	}
+	// The domain set is bound, so a domain can't smuggle in another
+	o, err = s.GetOverview(ctx, `other.com","example.com`, from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 0 {
+		t.Errorf("pageviews of a quoted domain list = %d, want 0", o.Pageviews)
+	}
+}
+
+func TestStore_EraseVisitorOnAliases(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	s := seedStore(t, now,
+		seedEvent{VisitorID: "v1", Ago: time.Hour},
+		seedEvent{Domain: "www.example.com", VisitorID: "v1", Ago: time.Hour},
+		seedEvent{Domain: "www.example.com", VisitorID: "v2", Ago: time.Hour},
+		seedEvent{Domain: "other.com", VisitorID: "v1", Ago: time.Hour},
+	)
+	ctx, err := AliasContext(WithFilters(context.Background(), Filters{}), fakeAliasSource{fixtureDomain: {"www.example.com"}}, fixtureDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := AliasDomains(ctx, fixtureDomain); strings.Join(got, ",") != "example.com,www.example.com" {
+		t.Errorf("AliasDomains = %v", got)
+	}
+
+	if n, err := s.EraseVisitor(ctx, fixtureDomain, "v1"); err != nil || n != 2 {
+		t.Fatalf("EraseVisitor = %d, %v; want the events on the alias too", n, err)
+	}
+	if o, err := s.GetOverview(ctx, fixtureDomain, now.Add(-daysAgo(1)), now); err != nil || o.Pageviews != 1 {
+		t.Errorf("merged overview = %+v, %v; want v2's pageview only", o, err)
+	}
+	if o, err := s.GetOverview(WithFilters(context.Background(), Filters{}), "other.com", now.Add(-daysAgo(1)), now); err != nil || o.Pageviews != 1 {
+		t.Errorf("other.com overview = %+v, %v; want it untouched", o, err)
+	}
+}
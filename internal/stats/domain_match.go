@@ -0,0 +1,120 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DomainMatch is a project's policy for events recorded under its domain whose
+// page URL is on another host, typically because the snippet was pasted into
+// an unrelated site
+type DomainMatch struct {
+	// StrictDomain leaves mismatched events out of every report
+	StrictDomain bool `json:"strict_domain"`
+	// MatchSubdomains counts hosts under the domain, such as blog.example.com, as a match
+	MatchSubdomains bool `json:"match_subdomains"`
+}
+
+// DefaultDomainMatch counts every event and treats subdomains as a match
+var DefaultDomainMatch = DomainMatch{MatchSubdomains: true}
+
+// DomainMatchSource loads the domain policy of the project a domain belongs
+// to; unknown domains get DefaultDomainMatch
+type DomainMatchSource interface {
+	DomainMatch(domain string) (DomainMatch, error)
+}
+
+// SetDomainMatchSource enables per-project strict domain matching on stats endpoints
+func (h *Handler) SetDomainMatchSource(src DomainMatchSource) {
+	h.domainMatch = src
+}
+
+// HostnameItem is a page host events were recorded on
+type HostnameItem struct {
+	Hostname string `json:"hostname"`
+	Events   int64  `json:"events"`
+	LastSeen string `json:"last_seen"`
+}
+
+// NormalizeHost lowercases a host or registered domain and drops a leading
+// "www.", the form hosts are compared in
+func NormalizeHost(host string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www.")
+}
+
+// Page host of an event's URL in NormalizeHost form, "" when the URL has none
+const (
+	duckdbURLHostExpr     = `regexp_replace(lower(regexp_extract(COALESCE(url, ''), '^[a-zA-Z][a-zA-Z0-9+.-]*://([^/:?#]+)', 1)), '^www\.', '')`
+	clickhouseURLHostExpr = `replaceRegexpOne(lower(domain(ifNull(url, ''))), '^www\\.', '')`
+	postgresURLHostExpr   = `regexp_replace(lower(COALESCE((regexp_match(url, '^[a-zA-Z][a-zA-Z0-9+.-]*://([^/:?#]+)'))[1], '')), '^www\.', '')`
+)
+
+// hostScope limits reports to events on a project's domain and its aliases
+type hostScope struct {
+	domain     string
+	aliases    []string
+	subdomains bool
+}
+
+// condition renders the scope as a condition on host; events without a page
+// host can't be told apart and always match
+func (m hostScope) condition(host string, endsWith func(s, suffix string) string, quote func(string) string) string {
+	cond := fmt.Sprintf("%[1]s = '' OR %[1]s = %[2]s", host, quote(m.domain))
+	for _, alias := range m.aliases {
+		cond += fmt.Sprintf(" OR %s = %s", host, quote(alias))
+	}
+	if m.subdomains {
+		cond += " OR " + endsWith(host, quote("."+m.domain))
+	}
+	return "(" + cond + ")"
+}
+
+func (m hostScope) duckdbCondition() string {
+	return m.condition(duckdbURLHostExpr, func(s, suffix string) string {
+		return fmt.Sprintf("ends_with(%s, %s)", s, suffix)
+	}, duckdbQuote)
+}
+
+func (m hostScope) clickhouseCondition() string {
+	return m.condition(clickhouseURLHostExpr, func(s, suffix string) string {
+		return fmt.Sprintf("endsWith(%s, %s)", s, suffix)
+	}, clickhouseQuote)
+}
+
+func (m hostScope) postgresCondition() string {
+	return m.condition(postgresURLHostExpr, postgresEndsWith, postgresQuote)
+}
+
+type hostScopeKey struct{}
+
+// withHostScope asks the store to drop events whose page host isn't domain
+// (or, with subdomains, one of its subdomains) or one of the domain's aliases
+// ctx carries
+func withHostScope(ctx context.Context, domain string, subdomains bool) context.Context {
+	scope := hostScope{domain: NormalizeHost(domain), subdomains: subdomains}
+	for _, alias := range domainAliasesFromContext(ctx) {
+		scope.aliases = append(scope.aliases, NormalizeHost(alias))
+	}
+	return context.WithValue(ctx, hostScopeKey{}, scope)
+}
+
+// domainMatchContext applies domain's strict domain policy and extends
+// filterKey with it, so cached reports are never shared between policies
+func (h *Handler) domainMatchContext(ctx context.Context, domain, filterKey string) (context.Context, string, error) {
+	if h.domainMatch == nil {
+		return ctx, filterKey, nil
+	}
+	m, err := h.domainMatch.DomainMatch(domain)
+	if err != nil {
+		return nil, "", err
+	}
+	if !m.StrictDomain {
+		return ctx, filterKey, nil
+	}
+	key := filterKey + "|strict_domain"
+	if m.MatchSubdomains {
+		key += "+subdomains"
+	}
+	return withHostScope(ctx, domain, m.MatchSubdomains), key, nil
+}
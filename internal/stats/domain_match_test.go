@@ -0,0 +1,102 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newHostsStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, 'v' || i AS visitor_id, 'pageview' AS name, url, '/' AS pathname,
+			'' AS referrer, '' AS country, '' AS browser, '' AS os, '' AS device, '' AS props,
+			CURRENT_TIMESTAMP::TIMESTAMP - INTERVAL 1 HOUR AS timestamp
+		FROM (VALUES
+			(1, 'https://example.com/'),
+			(2, 'https://WWW.Example.com/pricing'),
+			(3, 'https://blog.example.com/post'),
+			(4, 'https://copycat.net/'),
+			(5, 'http://copycat.net:8080/about?x=1'),
+			(6, 'https://notexample.com/'),
+			(7, '')
+		) t(i, url)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+}
+
+type fakeDomainMatch map[string]DomainMatch
+
+func (m fakeDomainMatch) DomainMatch(domain string) (DomainMatch, error) {
+	if match, ok := m[domain]; ok {
+		return match, nil
+	}
+	return DefaultDomainMatch, nil
+}
+
+func TestStore_GetDomainMismatches(t *testing.T) {
+	s := newHostsStore(t)
+	from, to := time.Now().Add(-24*time.Hour), time.Now().Add(time.Hour)
+	hostnames := func(subdomains bool) map[string]int64 {
+		t.Helper()
+		items, err := s.GetDomainMismatches(context.Background(), "example.com", subdomains, from, to, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]int64)
+		for _, item := range items {
+			got[item.Hostname] = item.Events
+		}
+		return got
+	}
+
+	// www. is always the domain; events without a URL can't be told apart
+	if got, want := hostnames(true), map[string]int64{"copycat.net": 2, "notexample.com": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with subdomains = %v, want %v", got, want)
+	}
+	if got, want := hostnames(false), map[string]int64{"copycat.net": 2, "notexample.com": 1, "blog.example.com": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without subdomains = %v, want %v", got, want)
+	}
+}
+
+func TestStrictDomain_ExcludesMismatchedEvents(t *testing.T) {
+	h := NewHandler(newHostsStore(t))
+	pageviews := func(match DomainMatch) (int64, string) {
+		t.Helper()
+		h.SetDomainMatchSource(fakeDomainMatch{"example.com": match})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period=7d", nil)
+		ctx, key, ok := h.filterContext(w, r, "example.com", time.Now().Add(-24*time.Hour), time.Now().Add(time.Hour))
+		if !ok {
+			t.Fatalf("filterContext failed: %d %s", w.Code, w.Body)
+		}
+		o, err := h.store.GetOverview(ctx, "example.com", time.Now().Add(-24*time.Hour), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o.Pageviews, key
+	}
+
+	if got, key := pageviews(DefaultDomainMatch); got != 7 || key != "" {
+		t.Errorf("default: pageviews = %d, key %q; want every event and no key", got, key)
+	}
+	if got, key := pageviews(DomainMatch{StrictDomain: true, MatchSubdomains: true}); got != 4 || key != "|strict_domain+subdomains" {
+		t.Errorf("strict: pageviews = %d, key %q", got, key)
+	}
+	if got, key := pageviews(DomainMatch{StrictDomain: true}); got != 3 || key != "|strict_domain" {
+		t.Errorf("strict without subdomains: pageviews = %d, key %q", got, key)
+	}
+}
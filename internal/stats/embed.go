@@ -0,0 +1,87 @@
+package stats
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// EmbedEndpoints are the read-only stats endpoints embed tokens may grant, by
+// the path under /api/stats/
+var EmbedEndpoints = []string{
+	"overview", "pageviews", "pages", "sources", "search", "devices", "geo", "geo/map", "utm",
+	"events", "event", "event-breakdown", "unique-pages", "errors", "funnel",
+	"wallboard/stream",
+}
+
+// ErrInvalidEmbedToken is returned for embed tokens that are malformed, expired or revoked
+var ErrInvalidEmbedToken = errors.New("invalid or expired embed token")
+
+// EmbedScope is what an embed token grants: reads of some endpoints of one domain
+type EmbedScope struct {
+	Domain    string
+	Endpoints []string
+}
+
+// EmbedSource verifies embed tokens
+type EmbedSource interface {
+	EmbedScope(token string) (EmbedScope, error)
+}
+
+// SetEmbedSource lets stats requests authenticate with ?embed_token=
+func (h *Handler) SetEmbedSource(src EmbedSource) {
+	h.embeds = src
+}
+
+// WithEmbedTokens limits requests carrying ?embed_token= to GETs of the
+// endpoints and domain the token grants. Any Authorization header and cookies
+// are dropped, so an embed never acts with a session's role, not even that of
+// the viewer's browser session. Requests without the parameter pass through
+// unchanged.
+func (h *Handler) WithEmbedTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("embed_token")
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if h.embeds == nil {
+			writeError(w, ErrInvalidEmbedToken, http.StatusUnauthorized)
+			return
+		}
+		scope, err := h.embeds.EmbedScope(token)
+		if errors.Is(err, ErrInvalidEmbedToken) {
+			writeError(w, err, http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			writeError(w, errors.New("embed tokens are read-only"), http.StatusForbidden)
+			return
+		}
+		endpoint, ok := strings.CutPrefix(r.URL.Path, "/api/stats/")
+		if !ok || !slices.Contains(scope.Endpoints, endpoint) {
+			writeError(w, errors.New("endpoint not allowed by embed token"), http.StatusForbidden)
+			return
+		}
+
+		q := r.URL.Query()
+		switch domain := strings.TrimSpace(q.Get("domain")); domain {
+		case "":
+			q.Set("domain", scope.Domain)
+		case scope.Domain:
+		default:
+			writeError(w, errors.New("domain not allowed by embed token"), http.StatusForbidden)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = q.Encode()
+		r.Header.Del("Authorization")
+		r.Header.Del("Cookie")
+		next.ServeHTTP(w, r)
+	})
+}
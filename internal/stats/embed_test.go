@@ -0,0 +1,78 @@
+package stats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeEmbeds map[string]EmbedScope
+
+func (f fakeEmbeds) EmbedScope(token string) (EmbedScope, error) {
+	if scope, ok := f[token]; ok {
+		return scope, nil
+	}
+	return EmbedScope{}, ErrInvalidEmbedToken
+}
+
+func TestWithEmbedTokens(t *testing.T) {
+	h := NewHandler(fakeStore{})
+	h.SetEmbedSource(fakeEmbeds{"tok": {Domain: "example.com", Endpoints: []string{"pageviews"}}})
+
+	var gotDomain, gotAuth string
+	var gotCookies []*http.Cookie
+	next := h.WithEmbedTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotDomain, gotAuth, gotCookies = r.URL.Query().Get("domain"), r.Header.Get("Authorization"), r.Cookies()
+	}))
+
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/api/stats/pageviews?embed_token=tok", 200},
+		{"GET", "/api/stats/pageviews?embed_token=tok&domain=example.com&period=30d", 200},
+		{"GET", "/api/stats/pageviews?embed_token=tok&domain=other.com", 403},
+		{"GET", "/api/stats/overview?embed_token=tok", 403},
+		{"GET", "/api/stats/pageviews/extra?embed_token=tok", 403},
+		{"GET", "/api/projects?embed_token=tok", 403},
+		{"POST", "/api/stats/pageviews?embed_token=tok", 403},
+		{"DELETE", "/api/annotations/delete?embed_token=tok&id=1", 403},
+		{"GET", "/api/stats/pageviews?embed_token=forged", 401},
+		{"GET", "/api/stats/overview?domain=any.com", 200}, // no token: unchanged
+	}
+	for _, tt := range tests {
+		gotDomain = ""
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		next.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+
+	// Embedded requests get the token's domain and lose the session header
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/stats/pageviews?embed_token=tok", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	next.ServeHTTP(w, req)
+	if gotDomain != "example.com" || gotAuth != "" {
+		t.Errorf("domain = %q, authorization = %q", gotDomain, gotAuth)
+	}
+
+	// A browser's session cookie is dropped too, so the viewer's role doesn't apply
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/api/stats/pageviews?embed_token=tok", nil)
+	req.AddCookie(&http.Cookie{Name: "clickresearch_session", Value: "admin-session"})
+	next.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || len(gotCookies) != 0 {
+		t.Errorf("with a session cookie: status = %d, cookies = %v", w.Code, gotCookies)
+	}
+
+	// Without an embed source tokens are refused
+	w = httptest.NewRecorder()
+	NewHandler(fakeStore{}).WithEmbedTokens(next).ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/pageviews?embed_token=tok", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("no source: status = %d", w.Code)
+	}
+}
@@ -0,0 +1,23 @@
+package stats
+
+import "testing"
+
+func TestAttachTopReferrers(t *testing.T) {
+	pages := []ErrorPage{{Path: "/old-blog"}, {Path: "/missing"}}
+	refs := []referrerCount{
+		{"/old-blog", "https://news.ycombinator.com/item?id=1", 3},
+		{"/old-blog", "https://news.ycombinator.com/item?id=2", 2},
+		{"/old-blog", "https://reddit.com/r/golang", 4},
+		{"/missing", "", 1},
+		{"/missing", "https://example.com/nav", 5},
+	}
+
+	attachTopReferrers(pages, refs, "example.com")
+
+	if pages[0].TopReferrer != "news.ycombinator.com" {
+		t.Errorf("/old-blog top referrer = %q, want news.ycombinator.com", pages[0].TopReferrer)
+	}
+	if pages[1].TopReferrer != "Direct" {
+		t.Errorf("/missing top referrer = %q, want Direct", pages[1].TopReferrer)
+	}
+}
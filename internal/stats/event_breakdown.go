@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// maxSparklinePoints caps an event breakdown sparkline; longer ranges widen
+// each point to several days
+const maxSparklinePoints = 30
+
+// EventBreakdownItem is an event name's count, unique visitors and a
+// sparkline of its count over the range, oldest point first. A rolled-up
+// OtherEventName item has neither visitors nor sparkline.
+type EventBreakdownItem struct {
+	TopItem
+	Visitors  int64   `json:"visitors,omitempty"`
+	Sparkline []int64 `json:"sparkline,omitempty"`
+}
+
+// topItems drops the detail of a breakdown, the shape clients asking for
+// detail=false get
+func topItems(items []EventBreakdownItem) []TopItem {
+	result := make([]TopItem, len(items))
+	for i, item := range items {
+		result[i] = item.TopItem
+	}
+	return result
+}
+
+// sparklineLayout returns the number of points of a sparkline over [from, to)
+// and the days each covers. Days are counted from from, not calendar days.
+func sparklineLayout(from, to time.Time) (points, days int) {
+	total := int((to.Sub(from) + 24*time.Hour - 1) / (24 * time.Hour))
+	if total < 1 {
+		total = 1
+	}
+	days = (total + maxSparklinePoints - 1) / maxSparklinePoints
+	return (total + days - 1) / days, days
+}
+
+// breakdownRow is an event name's count on one day of the range, with the
+// name's totals; day 0 starts at from
+type breakdownRow struct {
+	name     string
+	count    int64
+	visitors int64
+	day      int64
+	dayCount int64
+}
+
+// pivotBreakdown folds per-day rows into breakdown items, keeping the order
+// names first appear in
+func pivotBreakdown(rows []breakdownRow, from, to time.Time) []EventBreakdownItem {
+	points, days := sparklineLayout(from, to)
+	var items []EventBreakdownItem
+	index := make(map[string]int)
+	for _, row := range rows {
+		i, ok := index[row.name]
+		if !ok {
+			i = len(items)
+			index[row.name] = i
+			items = append(items, EventBreakdownItem{
+				TopItem:   TopItem{Name: aggregate.Label("name", row.name), Count: row.count},
+				Visitors:  row.visitors,
+				Sparkline: make([]int64, points),
+			})
+		}
+		point := min(max(int(row.day)/days, 0), points-1)
+		items[i].Sparkline[point] += row.dayCount
+	}
+	return items
+}
@@ -0,0 +1,129 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// breakdownItems wraps items as a breakdown without detail
+func breakdownItems(items []TopItem) []EventBreakdownItem {
+	result := make([]EventBreakdownItem, len(items))
+	for i, item := range items {
+		result[i] = EventBreakdownItem{TopItem: item}
+	}
+	return result
+}
+
+func TestSparklineLayout(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		to           time.Time
+		points, days int
+	}{
+		{from.Add(5 * time.Hour), 1, 1},
+		{from.AddDate(0, 0, 7), 7, 1},
+		{from.AddDate(0, 0, 7).Add(time.Hour), 8, 1},
+		{from.AddDate(0, 0, 30), 30, 1},
+		{from.AddDate(0, 0, 31), 16, 2},
+		{from.AddDate(0, 0, 90), 30, 3},
+		{from.AddDate(0, 0, 365), 29, 13},
+	}
+	for _, tt := range tests {
+		points, days := sparklineLayout(from, tt.to)
+		if points != tt.points || days != tt.days {
+			t.Errorf("%v: %d points of %d days, want %d of %d", tt.to.Sub(from), points, days, tt.points, tt.days)
+		}
+		if points > maxSparklinePoints || points*days < int(tt.to.Sub(from).Hours()/24) {
+			t.Errorf("%v: %d points of %d days do not cover the range", tt.to.Sub(from), points, days)
+		}
+	}
+}
+
+func TestPivotBreakdown(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := []breakdownRow{
+		{name: "signup", count: 6, visitors: 4, day: 0, dayCount: 1},
+		{name: "signup", count: 6, visitors: 4, day: 2, dayCount: 2},
+		{name: "signup", count: 6, visitors: 4, day: 40, dayCount: 3},
+		{name: "", count: 1, visitors: 1, day: 89, dayCount: 1},
+	}
+	got := pivotBreakdown(rows, from, from.AddDate(0, 0, 90))
+	if len(got) != 2 || got[0].Name != "signup" || got[1].Name != LabelUnknown {
+		t.Fatalf("items = %+v", got)
+	}
+	want := make([]int64, 30)
+	want[0], want[13] = 3, 3
+	if got[0].Count != 6 || got[0].Visitors != 4 || !reflect.DeepEqual(got[0].Sparkline, want) {
+		t.Errorf("signup = %+v, want sparkline %v", got[0], want)
+	}
+	if got[1].Sparkline[29] != 1 {
+		t.Errorf("last day lands in point %v", got[1].Sparkline)
+	}
+}
+
+func TestStore_GetEventBreakdown(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := seedStore(t, day,
+		seedEvent{VisitorID: "v1", Name: "signup", At: day.Add(time.Hour)},
+		seedEvent{VisitorID: "v1", Name: "signup", At: day.Add(2 * time.Hour)},
+		seedEvent{VisitorID: "v2", Name: "signup", At: day.AddDate(0, 0, 2)},
+		seedEvent{VisitorID: "v3", Name: "signup", Props: `{"consent":"denied"}`, At: day.AddDate(0, 0, 6).Add(23 * time.Hour)},
+		seedEvent{VisitorID: "v1", Name: "upgrade", At: day.AddDate(0, 0, 3)},
+		seedEvent{VisitorID: "v1", Name: "upgrade", At: day.AddDate(0, 0, 7)},
+	)
+	from, to := day, day.AddDate(0, 0, 7)
+	ctx := WithFilters(context.Background(), Filters{})
+
+	items, err := s.GetEventBreakdown(ctx, fixtureDomain, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EventBreakdownItem{
+		{TopItem: TopItem{Name: "signup", Count: 4}, Visitors: 3, Sparkline: []int64{2, 0, 1, 0, 0, 0, 1}},
+		{TopItem: TopItem{Name: "upgrade", Count: 1}, Visitors: 1, Sparkline: []int64{0, 0, 0, 1, 0, 0, 0}},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("breakdown = %+v, want %+v", items, want)
+	}
+
+	// Visitors follow the privacy mode; counts and sparklines do not
+	items, err = s.GetEventBreakdown(WithPrivacyMode(ctx, PrivacyExcludeDenied), fixtureDomain, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Visitors != 2 || items[0].Count != 4 {
+		t.Errorf("breakdown excluding denied = %+v", items)
+	}
+}
+
+func TestHandleEventBreakdown_Detail(t *testing.T) {
+	now := time.Now().UTC()
+	h := NewHandler(seedStore(t, now,
+		seedEvent{VisitorID: "v1", Ago: daysAgo(1)},
+		seedEvent{VisitorID: "v2", Ago: daysAgo(3)},
+	))
+
+	w := httptest.NewRecorder()
+	h.HandleEventBreakdown(w, httptest.NewRequest("GET", "/api/stats/event-breakdown?domain=example.com&period=7d", nil))
+	var items []EventBreakdownItem
+	if err := json.NewDecoder(w.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Count != 2 || items[0].Visitors != 2 || len(items[0].Sparkline) != 7 {
+		t.Errorf("detailed breakdown = %+v", items)
+	}
+
+	w = httptest.NewRecorder()
+	h.HandleEventBreakdown(w, httptest.NewRequest("GET", "/api/stats/event-breakdown?domain=example.com&period=7d&detail=false", nil))
+	var plain []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if want := []map[string]any{{"name": "pageview", "count": 2.0}}; !reflect.DeepEqual(plain, want) {
+		t.Errorf("detail=false breakdown = %v, want %v", plain, want)
+	}
+}
@@ -0,0 +1,113 @@
+package stats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidEventID is returned for event ids not made by eventID
+var ErrInvalidEventID = errors.New("invalid event id")
+
+// eventID identifies an event by its timestamp in microseconds and a hash of
+// its visitor, so events lists can leave props out and fetch them per row.
+// The visitor id itself is never exposed.
+func eventID(ts time.Time, visitorID string) string {
+	sum := sha256.Sum256([]byte(visitorID))
+	return strconv.FormatInt(ts.UnixMicro(), 10) + "-" + hex.EncodeToString(sum[:6])
+}
+
+// parseEventID returns the timestamp of an id made by eventID
+func parseEventID(id string) (time.Time, error) {
+	micros, hash, ok := strings.Cut(id, "-")
+	us, err := strconv.ParseInt(micros, 10, 64)
+	if !ok || err != nil || len(hash) != 12 {
+		return time.Time{}, ErrInvalidEventID
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return time.Time{}, ErrInvalidEventID
+	}
+	return time.UnixMicro(us).UTC(), nil
+}
+
+// eventScanner is a row of an events query, with the columns of EventFields.columns
+type eventScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanEvent reads one events row of fields, applying the value overrides and
+// labels; false means the row could not be read and is skipped
+func scanEvent(row eventScanner, domain string, fields EventFields, overrides *ValueOverrides) (EventItem, bool) {
+	var e EventItem
+	var visitorID string
+	var ts time.Time
+	if err := row.Scan(fields.dest(&e, &visitorID, &ts)...); err != nil {
+		return e, false
+	}
+	// Postgres hands timestamps back in the session time zone
+	e.Timestamp = ts.UTC().Format("2006-01-02 15:04:05")
+	e.ID = eventID(ts, visitorID)
+	overrides.overrideEvent(domain, &e, ts)
+	labelEvent(&e)
+	return e, true
+}
+
+// findEvent returns the row whose eventID is id, with every field, or nil
+func findEvent(rows interface {
+	eventScanner
+	Next() bool
+	Err() error
+}, domain, id string, overrides *ValueOverrides) (*EventItem, error) {
+	for rows.Next() {
+		if e, ok := scanEvent(rows, domain, AllEventFields, overrides); ok && e.ID == id {
+			return &e, nil
+		}
+	}
+	return nil, rows.Err()
+}
+
+// HandleEvent returns one event of /api/stats/events, by its id, with the
+// full props the list leaves out
+func (h *Handler) HandleEvent(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if _, err := parseEventID(id); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx, _, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+
+	cacheKey := fmt.Sprintf("event:%s:%s", domain, id)
+	var event EventItem
+	if h.cacheGet(r.Context(), cacheKey, &event) {
+		writeJSON(w, event)
+		return
+	}
+	found, err := h.store.GetEvent(ctx, domain, id)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if found == nil {
+		writeError(w, errors.New("event not found"), http.StatusNotFound)
+		return
+	}
+	h.cacheSet(ctx, cacheKey, *found)
+	writeJSON(w, found)
+}
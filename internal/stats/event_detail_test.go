@@ -0,0 +1,150 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventID(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 123456000, time.UTC)
+	id := eventID(ts, "visitor-1")
+	if strings.Contains(id, "visitor-1") {
+		t.Errorf("id %q exposes the visitor", id)
+	}
+	if id == eventID(ts, "visitor-2") {
+		t.Error("visitors of the same microsecond share an id")
+	}
+	got, err := parseEventID(id)
+	if err != nil || !got.Equal(ts) {
+		t.Errorf("parseEventID(%q) = %v, %v; want %v", id, got, err, ts)
+	}
+	for _, bad := range []string{"", "123", "abc-0123456789ab", "123-0123456789", "123-0123456789zz"} {
+		if _, err := parseEventID(bad); err != ErrInvalidEventID {
+			t.Errorf("parseEventID(%q) err = %v", bad, err)
+		}
+	}
+}
+
+func TestStore_GetRecentEvents_Props(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := seedStore(t, day,
+		seedEvent{VisitorID: "v1", Name: "signup", Props: `{"plan":"pro"}`, At: day.Add(time.Hour)},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+
+	events, err := s.GetRecentEvents(ctx, fixtureDomain, day, day.AddDate(0, 0, 1), 10, DefaultEventFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Props != "" || events[0].ID != eventID(day.Add(time.Hour), "v1") {
+		t.Fatalf("events without props = %+v", events)
+	}
+	events, err = s.GetRecentEvents(ctx, fixtureDomain, day, day.AddDate(0, 0, 1), 10, AllEventFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Props != `{"plan":"pro"}` {
+		t.Errorf("events with props = %+v", events)
+	}
+}
+
+func TestStore_GetEvent(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC).Truncate(time.Microsecond)
+	long := `{"text":"` + strings.Repeat("x", maxPropsBytes) + `"}`
+	s := seedStore(t, at,
+		seedEvent{VisitorID: "v1", Name: "click", Props: long, At: at},
+		seedEvent{VisitorID: "v2", Name: "signup", Props: `{"plan":"pro"}`, At: at},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+
+	e, err := s.GetEvent(ctx, fixtureDomain, eventID(at, "v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Name != "click" || e.Props != long || e.PropsTruncated {
+		t.Errorf("event v1 = %+v, want the untruncated props", e)
+	}
+	if e, _ := s.GetEvent(ctx, fixtureDomain, eventID(at, "v2")); e == nil || e.Name != "signup" {
+		t.Errorf("event v2 = %+v", e)
+	}
+	if e, err := s.GetEvent(ctx, fixtureDomain, eventID(at, "v3")); e != nil || err != nil {
+		t.Errorf("unknown visitor = %+v, %v; want nil", e, err)
+	}
+	if e, err := s.GetEvent(ctx, "other.com", eventID(at, "v1")); e != nil || err != nil {
+		t.Errorf("other domain = %+v, %v; want nil", e, err)
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	now := time.Now().UTC()
+	h := NewHandler(seedStore(t, now,
+		seedEvent{VisitorID: "v1", Name: "signup", Props: `{"plan":"pro"}`, Ago: time.Hour},
+	))
+
+	w := httptest.NewRecorder()
+	h.HandleEvents(w, httptest.NewRequest("GET", "/api/stats/events?domain=example.com&period=7d", nil))
+	var events []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0]["props"] != nil || events[0]["id"] == nil {
+		t.Fatalf("events = %v, want an id and no props", events)
+	}
+
+	w = httptest.NewRecorder()
+	h.HandleEvent(w, httptest.NewRequest("GET", fmt.Sprintf("/api/stats/event?domain=example.com&id=%s", events[0]["id"]), nil))
+	var event EventItem
+	if err := json.NewDecoder(w.Body).Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || event.Name != "signup" || event.Props != `{"plan":"pro"}` {
+		t.Errorf("event = %d %+v", w.Code, event)
+	}
+
+	w = httptest.NewRecorder()
+	h.HandleEvents(w, httptest.NewRequest("GET", "/api/stats/events?domain=example.com&period=7d&include_props=true", nil))
+	if !strings.Contains(w.Body.String(), `"props":"{\"plan\":\"pro\"}"`) {
+		t.Errorf("include_props=true events = %s", w.Body)
+	}
+
+	for id, code := range map[string]int{"nope": 400, eventID(now, "v9"): 404} {
+		w = httptest.NewRecorder()
+		h.HandleEvent(w, httptest.NewRequest("GET", "/api/stats/event?domain=example.com&id="+id, nil))
+		if w.Code != code {
+			t.Errorf("id %q: status %d, want %d", id, w.Code, code)
+		}
+	}
+}
+
+// BenchmarkHandleEvents_Props compares the events list with and without
+// props; B/response is the size of the JSON body
+func BenchmarkHandleEvents_Props(b *testing.B) {
+	now := time.Now().UTC()
+	props := `{"text":"` + strings.Repeat("lorem ipsum ", 100) + `","tag":"button"}`
+	events := make([]seedEvent, 1000)
+	for i := range events {
+		events[i] = seedEvent{VisitorID: fmt.Sprintf("v%d", i), Name: "click", Props: props, Ago: time.Duration(i) * time.Minute}
+	}
+	s := seedStore(b, now, events...)
+
+	for _, include := range []bool{true, false} {
+		b.Run(fmt.Sprintf("include_props=%t", include), func(b *testing.B) {
+			// Over maxCachedEvents, so every request reaches the store
+			h := NewHandler(s)
+			req := httptest.NewRequest("GET", fmt.Sprintf("/api/stats/events?domain=example.com&period=7d&limit=1000&include_props=%t", include), nil)
+			var size int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				h.HandleEvents(w, req)
+				size = w.Body.Len()
+			}
+			b.ReportMetric(float64(size), "B/response")
+		})
+	}
+}
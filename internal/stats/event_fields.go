@@ -0,0 +1,118 @@
+package stats
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// EventFields are the fields an events query reads, in the order of
+// AllEventFields. The visitor and the timestamp are read either way, for ids.
+type EventFields []string
+
+// AllEventFields are every field of EventItem that can be selected
+var AllEventFields = EventFields{"name", "url", "pathname", "country", "browser", "os", "device", "timestamp", "props"}
+
+// DefaultEventFields leave props out; they are fetched per event from HandleEvent
+var DefaultEventFields = EventFields{"name", "url", "pathname", "country", "browser", "os", "device", "timestamp"}
+
+// ParseEventFields parses a comma-separated fields parameter, rejecting
+// unknown names
+func ParseEventFields(s string) (EventFields, error) {
+	var fields EventFields
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(AllEventFields, name) {
+			return nil, fmt.Errorf("unknown field %q, want some of %s", name, strings.Join(AllEventFields, ","))
+		}
+		fields = append(fields, name)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("fields must name at least one of %s", strings.Join(AllEventFields, ","))
+	}
+	// Sorted like AllEventFields, so equal sets share a cache key
+	var sorted EventFields
+	for _, name := range AllEventFields {
+		if slices.Contains(fields, name) {
+			sorted = append(sorted, name)
+		}
+	}
+	return sorted, nil
+}
+
+// Has reports whether field is selected
+func (f EventFields) Has(field string) bool {
+	return slices.Contains(f, field)
+}
+
+// String is the fields parameter selecting f
+func (f EventFields) String() string {
+	return strings.Join(f, ",")
+}
+
+// columns returns the SELECT list of an events query: the selected columns,
+// wrapped in the dialect's null function, then visitor_id and ts. props is
+// the expression of the props column.
+func (f EventFields) columns(ifNull, props string) string {
+	var cols []string
+	for _, field := range f {
+		switch field {
+		case "name":
+			cols = append(cols, "name")
+		case "timestamp":
+			// Read below either way
+		case "props":
+			cols = append(cols, props+" as props")
+		default:
+			cols = append(cols, fmt.Sprintf("%s(%s, '') as %s", ifNull, field, field))
+		}
+	}
+	cols = append(cols, ifNull+"(visitor_id, '') as visitor_id", "timestamp as ts")
+	return strings.Join(cols, ",\n\t\t\t")
+}
+
+// dest returns the scan destinations of columns' rows
+func (f EventFields) dest(e *EventItem, visitorID *string, ts any) []any {
+	var dest []any
+	for _, field := range f {
+		switch field {
+		case "name":
+			dest = append(dest, &e.Name)
+		case "url":
+			dest = append(dest, &e.URL)
+		case "pathname":
+			dest = append(dest, &e.Pathname)
+		case "country":
+			dest = append(dest, &e.Country)
+		case "browser":
+			dest = append(dest, &e.Browser)
+		case "os":
+			dest = append(dest, &e.OS)
+		case "device":
+			dest = append(dest, &e.Device)
+		case "props":
+			dest = append(dest, &e.Props)
+		}
+	}
+	return append(dest, visitorID, ts)
+}
+
+// project returns e with only the selected fields and its id, for responses
+// that asked for some fields
+func (f EventFields) project(e EventItem) map[string]any {
+	values := map[string]string{
+		"name": e.Name, "url": e.URL, "pathname": e.Pathname, "country": e.Country,
+		"browser": e.Browser, "os": e.OS, "device": e.Device, "timestamp": e.Timestamp, "props": e.Props,
+	}
+	out := map[string]any{"id": e.ID}
+	for _, field := range f {
+		out[field] = values[field]
+	}
+	if e.PropsTruncated && f.Has("props") {
+		out["props_truncated"] = true
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEventFields(t *testing.T) {
+	fields, err := ParseEventFields(" timestamp,name ,pathname,name")
+	if err != nil || fields.String() != "name,pathname,timestamp" {
+		t.Errorf("fields = %v, %v; want name,pathname,timestamp", fields, err)
+	}
+	for _, bad := range []string{"", ",", "name,visitor_id", "Name"} {
+		if _, err := ParseEventFields(bad); err == nil {
+			t.Errorf("ParseEventFields(%q) accepted", bad)
+		}
+	}
+}
+
+func TestStore_GetRecentEvents_Fields(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := seedStore(t, day,
+		seedEvent{VisitorID: "v1", Name: "signup", Pathname: "/pricing", Props: `{"plan":"pro"}`, At: day.Add(time.Hour)},
+	)
+	rec := &QueryRecorder{}
+	ctx := WithQueryRecorder(WithFilters(context.Background(), Filters{}), rec)
+
+	events, err := s.GetRecentEvents(ctx, fixtureDomain, day, day.AddDate(0, 0, 1), 10, EventFields{"name", "pathname"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Name != "signup" || events[0].Pathname != "/pricing" || events[0].ID != eventID(day.Add(time.Hour), "v1") {
+		t.Fatalf("events = %+v", events)
+	}
+
+	queries := rec.Queries()
+	if len(queries) != 1 {
+		t.Fatalf("recorded %d queries, want 1", len(queries))
+	}
+	selected, _, _ := strings.Cut(queries[0].SQL, "FROM")
+	for _, column := range []string{"name", "pathname", "visitor_id", "timestamp as ts"} {
+		if !strings.Contains(selected, column) {
+			t.Errorf("SELECT list misses %s:\n%s", column, selected)
+		}
+	}
+	for _, column := range []string{"url", "country", "browser", " os", "device", "props"} {
+		if strings.Contains(selected, column) {
+			t.Errorf("SELECT list reads unrequested %s:\n%s", column, selected)
+		}
+	}
+}
+
+func TestHandleEvents_Fields(t *testing.T) {
+	now := time.Now().UTC()
+	h := NewHandler(seedStore(t, now,
+		seedEvent{VisitorID: "v1", Name: "signup", Pathname: "/pricing", Props: `{"plan":"pro"}`, Ago: time.Hour},
+	))
+
+	w := httptest.NewRecorder()
+	h.HandleEvents(w, httptest.NewRequest("GET", "/api/stats/events?domain=example.com&period=7d&fields=name,props", nil))
+	var events []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("events = %v", events)
+	}
+	if e := events[0]; len(e) != 3 || e["id"] == nil || e["name"] != "signup" || e["props"] != `{"plan":"pro"}` {
+		t.Errorf("event = %v, want only id, name and props", e)
+	}
+
+	w = httptest.NewRecorder()
+	h.HandleEvents(w, httptest.NewRequest("GET", "/api/stats/events?domain=example.com&period=7d&fields=name,visitor_id", nil))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "visitor_id") {
+		t.Errorf("unknown field: %d %s", w.Code, w.Body)
+	}
+}
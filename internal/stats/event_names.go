@@ -0,0 +1,238 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// OtherEventName replaces names outside a project's allow-list at load time
+	// and collects the long tail of guarded event breakdowns
+	OtherEventName = "_other"
+	// originalNameProp keeps the name an event was sent with when it is replaced
+	originalNameProp = "original_name"
+	// maxEventNameLen caps allow-list entries
+	maxEventNameLen = 200
+	// MaxAllowedEventNames caps a project's allow-list
+	MaxAllowedEventNames = 500
+	// eventCardinalityThreshold is how many distinct names a guarded breakdown
+	// may have before its long tail is rolled up
+	eventCardinalityThreshold = 200
+	// eventBreakdownLimit is how many names the event breakdown lists
+	eventBreakdownLimit = 10
+	// dataWarningCardinality flags a breakdown whose long tail was rolled up
+	dataWarningCardinality = "high_cardinality"
+)
+
+// NormalizeEventName validates an allow-list entry
+func NormalizeEventName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > maxEventNameLen {
+		return "", fmt.Errorf("event names must be 1 to %d characters", maxEventNameLen)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("invalid event name %q", name)
+		}
+	}
+	return name, nil
+}
+
+// EventNameRules holds the per-domain event name protections projects enable:
+// allow-lists applied when events are loaded, and the reporting cardinality guard.
+// It is shared between the stores, the stats handler and auth, which reloads it.
+type EventNameRules struct {
+	mu    sync.RWMutex
+	allow map[string][]string
+	guard map[string]bool
+}
+
+// NewEventNameRules returns rules with every protection off
+func NewEventNameRules() *EventNameRules {
+	return &EventNameRules{}
+}
+
+// Set replaces the rules: allow maps domains enforcing an allow-list to their
+// names, guard marks domains with the cardinality guard on
+func (r *EventNameRules) Set(allow map[string][]string, guard map[string]bool) {
+	r.mu.Lock()
+	r.allow = allow
+	r.guard = guard
+	r.mu.Unlock()
+}
+
+// Guarded reports whether domain's event breakdowns roll up their long tail
+func (r *EventNameRules) Guarded(domain string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.guard[domain]
+}
+
+// allowLists returns the enforced allow-lists in domain order
+func (r *EventNameRules) allowLists() (domains []string, names [][]string) {
+	if r == nil {
+		return nil, nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for d := range r.allow {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		names = append(names, r.allow[d])
+	}
+	return domains, names
+}
+
+// unknownNameCondition renders a condition true for events whose domain
+// enforces an allow-list without their name, or "" when no domain does
+func (r *EventNameRules) unknownNameCondition(quote func(string) string) string {
+	domains, names := r.allowLists()
+	if len(domains) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("CASE domain")
+	for i, d := range domains {
+		quoted := make([]string, len(names[i]))
+		for j, n := range names[i] {
+			quoted[j] = quote(n)
+		}
+		fmt.Fprintf(&b, " WHEN %s THEN ", quote(d))
+		if len(quoted) == 0 {
+			b.WriteString("name <> " + quote(OtherEventName))
+		} else {
+			fmt.Fprintf(&b, "name NOT IN (%s, %s)", strings.Join(quoted, ", "), quote(OtherEventName))
+		}
+	}
+	b.WriteString(" ELSE false END")
+	return b.String()
+}
+
+// unknownName reports whether domain enforces an allow-list without name, the
+// Go form of unknownNameCondition for stores written to event by event
+func (r *EventNameRules) unknownName(domain, name string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names, ok := r.allow[domain]
+	return ok && name != OtherEventName && !slices.Contains(names, name)
+}
+
+// duckdbIngestSource wraps a parquet scan so names outside allow-lists load as
+// OtherEventName, keeping the sent name in props
+func (r *EventNameRules) duckdbIngestSource(scan string) string {
+	cond := r.unknownNameCondition(duckdbQuote)
+	if cond == "" {
+		return scan
+	}
+	return fmt.Sprintf(`(SELECT * REPLACE (
+			CASE WHEN %[1]s THEN '%[2]s' ELSE name END AS name,
+			CASE WHEN %[1]s THEN json_merge_patch(
+				CASE WHEN json_valid(props) AND starts_with(trim(props), '{') THEN props ELSE '{}' END,
+				json_object('%[3]s', name))::VARCHAR ELSE props END AS props
+		) FROM %[4]s)`, cond, OtherEventName, originalNameProp, scan)
+}
+
+// clickhouseIngestSource is duckdbIngestSource for ClickHouse
+func (r *EventNameRules) clickhouseIngestSource(scan string) string {
+	cond := r.unknownNameCondition(clickhouseQuote)
+	if cond == "" {
+		return scan
+	}
+	return fmt.Sprintf(`(SELECT * REPLACE (
+			if(%[1]s, '%[2]s', name) AS name,
+			if(%[1]s, concat('{"%[3]s":', toJSONString(name),
+				if(isValidJSON(ifNull(props, '')) AND startsWith(trimBoth(ifNull(props, '')), '{') AND trimBoth(ifNull(props, '')) <> '{}',
+					concat(',', substring(trimBoth(ifNull(props, '')), 2)), '}')), props) AS props
+		) FROM %[4]s)`, cond, OtherEventName, originalNameProp, scan)
+}
+
+func duckdbQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// postgresQuote relies on standard_conforming_strings, on by default
+func postgresQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func clickhouseQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// EventCardinality counts the distinct event names and events of a range
+type EventCardinality struct {
+	Names  int64 `json:"names"`
+	Events int64 `json:"events"`
+}
+
+// rollupEvents caps a breakdown at limit names and adds the remaining events
+// as one OtherEventName item. Events already loaded as OtherEventName are
+// merged into it rather than listed separately. The rolled-up item has a count
+// only, as the names it stands for were not all read.
+func rollupEvents(top []EventBreakdownItem, card EventCardinality, limit int) []EventBreakdownItem {
+	var result []EventBreakdownItem
+	var listed, other int64
+	for _, item := range top {
+		if item.Name == OtherEventName {
+			other += item.Count
+			listed += item.Count
+			continue
+		}
+		if len(result) == limit {
+			continue
+		}
+		result = append(result, item)
+		listed += item.Count
+	}
+	if rest := card.Events - listed; rest > 0 {
+		other += rest
+	}
+	if other > 0 {
+		result = append(result, EventBreakdownItem{TopItem: TopItem{Name: OtherEventName, Count: other}})
+	}
+	return result
+}
+
+// eventBreakdownResult is a cached event breakdown
+type eventBreakdownResult struct {
+	Items    []EventBreakdownItem `json:"items"`
+	RolledUp bool                 `json:"rolled_up"`
+}
+
+// eventBreakdown returns the event breakdown of a domain; for guarded domains
+// with more than eventCardinalityThreshold names the long tail is rolled up,
+// which the result records so the response can be flagged with
+// dataWarningCardinality
+func (h *Handler) eventBreakdown(ctx context.Context, domain string, from, to time.Time) (eventBreakdownResult, error) {
+	top, err := h.store.GetEventBreakdown(ctx, domain, from, to)
+	if err != nil || !h.eventNames.Guarded(domain) {
+		return eventBreakdownResult{Items: top}, err
+	}
+	card, err := h.store.GetEventCardinality(ctx, domain, from, to)
+	if err != nil {
+		return eventBreakdownResult{}, err
+	}
+	if card.Names <= eventCardinalityThreshold {
+		return eventBreakdownResult{Items: top}, nil
+	}
+	return eventBreakdownResult{Items: rollupEvents(top, card, eventBreakdownLimit), RolledUp: true}, nil
+}
+
+// SetEventNameRules enables the event breakdown cardinality guard of projects that turn it on
+func (h *Handler) SetEventNameRules(rules *EventNameRules) {
+	h.eventNames = rules
+}
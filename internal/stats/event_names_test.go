@@ -0,0 +1,209 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollupEvents(t *testing.T) {
+	top := []TopItem{{Name: "pageview", Count: 500}, {Name: "signup", Count: 40}, {Name: "click", Count: 30}}
+	tests := []struct {
+		name  string
+		top   []TopItem
+		card  EventCardinality
+		limit int
+		want  []TopItem
+	}{
+		{
+			name:  "tail rolled up",
+			top:   top,
+			card:  EventCardinality{Names: 1000, Events: 600},
+			limit: 3,
+			want:  []TopItem{{Name: "pageview", Count: 500}, {Name: "signup", Count: 40}, {Name: "click", Count: 30}, {Name: OtherEventName, Count: 30}},
+		},
+		{
+			name:  "capped below the store limit",
+			top:   top,
+			card:  EventCardinality{Names: 1000, Events: 600},
+			limit: 2,
+			want:  []TopItem{{Name: "pageview", Count: 500}, {Name: "signup", Count: 40}, {Name: OtherEventName, Count: 60}},
+		},
+		{
+			name:  "loaded _other merged",
+			top:   []TopItem{{Name: "pageview", Count: 500}, {Name: OtherEventName, Count: 70}, {Name: "signup", Count: 40}},
+			card:  EventCardinality{Names: 300, Events: 620},
+			limit: 10,
+			want:  []TopItem{{Name: "pageview", Count: 500}, {Name: "signup", Count: 40}, {Name: OtherEventName, Count: 80}},
+		},
+		{
+			name:  "nothing left over",
+			top:   top,
+			card:  EventCardinality{Names: 3, Events: 570},
+			limit: 10,
+			want:  top,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rolled := rollupEvents(breakdownItems(tt.top), tt.card, tt.limit)
+			got := topItems(rolled)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			var sum int64
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("item %d = %v, want %v", i, got[i], tt.want[i])
+				}
+				sum += got[i].Count
+			}
+			if last := rolled[len(rolled)-1]; last.Name == OtherEventName && (last.Visitors != 0 || last.Sparkline != nil) {
+				t.Errorf("rolled-up item has detail: %+v", last)
+			}
+			if tt.card.Events > 0 && sum != tt.card.Events {
+				t.Errorf("items sum to %d, want all %d events", sum, tt.card.Events)
+			}
+		})
+	}
+}
+
+func TestUnknownNameCondition(t *testing.T) {
+	var rules *EventNameRules
+	if cond := rules.unknownNameCondition(duckdbQuote); cond != "" {
+		t.Errorf("nil rules: %q", cond)
+	}
+
+	rules = NewEventNameRules()
+	rules.Set(map[string][]string{"b.com": {"it's"}, "a.com": {"signup", `back\slash`}}, nil)
+	got := rules.unknownNameCondition(clickhouseQuote)
+	want := `CASE domain WHEN 'a.com' THEN name NOT IN ('signup', 'back\\slash', '_other') WHEN 'b.com' THEN name NOT IN ('it\'s', '_other') ELSE false END`
+	if got != want {
+		t.Errorf("condition =\n%s\nwant\n%s", got, want)
+	}
+	if got := rules.unknownNameCondition(duckdbQuote); !strings.Contains(got, `'it''s'`) {
+		t.Errorf("duckdb condition = %s", got)
+	}
+}
+
+func TestStoreRefresh_EventNameAllowList(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	path := filepath.Join(t.TempDir(), "events.parquet")
+	_, err = db.Exec(`
+		COPY (
+			SELECT * FROM (VALUES
+				('example.com', 'v1', 'signup', '{"plan":"pro"}'),
+				('example.com', 'v2', 'item_123', '{"plan":"free"}'),
+				('example.com', 'v3', 'item_456', NULL),
+				('other.com', 'v4', 'item_789', '{}')
+			) t(domain, visitor_id, name, props)
+			CROSS JOIN (SELECT '' AS url, '/' AS pathname, '' AS referrer, '' AS country, '' AS browser,
+				'' AS os, '' AS device, TIMESTAMP '2024-01-02 12:00:00' AS timestamp, TIMESTAMP '2024-01-02 12:00:00' AS received_at)
+		) TO '` + path + `' (FORMAT PARQUET)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := NewEventNameRules()
+	rules.Set(map[string][]string{"example.com": {"signup"}}, nil)
+	s := withState(&Store{db: db, parquetPath: path, eventNames: rules}, storeSnapshot{ready: true})
+	s.refreshMemoryTable()
+	if st := s.Status(); st.LastError != "" {
+		t.Fatal(st.LastError)
+	}
+
+	ctx := WithFilters(context.Background(), Filters{})
+	from, to := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+	items, err := s.GetEventBreakdown(ctx, "example.com", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int64{}
+	for _, it := range items {
+		counts[it.Name] = it.Count
+	}
+	if counts["signup"] != 1 || counts[OtherEventName] != 2 || len(counts) != 2 {
+		t.Errorf("example.com breakdown = %v, want signup 1 and %s 2", items, OtherEventName)
+	}
+	// Domains without an allow-list are untouched
+	if items, _ := s.GetEventBreakdown(ctx, "other.com", from, to); len(items) != 1 || items[0].Name != "item_789" {
+		t.Errorf("other.com breakdown = %v", items)
+	}
+
+	rows, err := db.Query(`SELECT props FROM events WHERE name = '_other' ORDER BY visitor_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var originals []string
+	for rows.Next() {
+		var props string
+		if err := rows.Scan(&props); err != nil {
+			t.Fatal(err)
+		}
+		var p map[string]string
+		if err := json.Unmarshal([]byte(props), &p); err != nil {
+			t.Fatalf("props %q: %v", props, err)
+		}
+		originals = append(originals, p[originalNameProp])
+		if p[originalNameProp] == "item_123" && p["plan"] != "free" {
+			t.Errorf("props %q lost the sent props", props)
+		}
+	}
+	if strings.Join(originals, ",") != "item_123,item_456" {
+		t.Errorf("original names = %v", originals)
+	}
+}
+
+// cardinalityStore has many more event names than its breakdown lists
+type cardinalityStore struct {
+	fakeStore
+}
+
+func (cardinalityStore) GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]EventBreakdownItem, error) {
+	return breakdownItems([]TopItem{{Name: "pageview", Count: 100}, {Name: "id_1", Count: 1}}), nil
+}
+
+func (cardinalityStore) GetEventCardinality(ctx context.Context, domain string, from, to time.Time) (EventCardinality, error) {
+	return EventCardinality{Names: eventCardinalityThreshold + 1, Events: 301}, nil
+}
+
+func TestHandleEventBreakdown_CardinalityGuard(t *testing.T) {
+	rules := NewEventNameRules()
+	rules.Set(nil, map[string]bool{"guarded.com": true})
+	h := NewHandler(cardinalityStore{})
+	h.SetEventNameRules(rules)
+
+	for _, tt := range []struct {
+		domain  string
+		items   int
+		warning string
+	}{
+		{"guarded.com", 3, dataWarningCardinality},
+		{"example.com", 2, ""},
+	} {
+		// The second request is answered from the cache, which keeps the warning
+		for _, detail := range []string{"true", "false"} {
+			w := httptest.NewRecorder()
+			h.HandleEventBreakdown(w, httptest.NewRequest("GET", "/api/stats/event-breakdown?detail="+detail+"&domain="+tt.domain, nil))
+			var items []TopItem
+			json.NewDecoder(w.Body).Decode(&items)
+			if len(items) != tt.items || w.Header().Get(dataWarningHeader) != tt.warning {
+				t.Errorf("%s: items = %v, warning = %q", tt.domain, items, w.Header().Get(dataWarningHeader))
+			}
+			if tt.warning != "" && items[2] != (TopItem{Name: OtherEventName, Count: 200}) {
+				t.Errorf("%s: rollup = %v", tt.domain, items[2])
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package stats
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// maxCachedEvents is the largest events response kept in the cache; larger
+	// limits are streamed from the store on every request
+	maxCachedEvents = 100
+	// eventsFlushEvery is how many events are written between flushes
+	eventsFlushEvery = 500
+	// brotliStreamLevel trades ratio for speed, since rows are compressed as they arrive
+	brotliStreamLevel = 4
+)
+
+// collectEvents gathers a streamed events query into a slice
+func collectEvents(stream func(fn func(EventItem) error) error) ([]EventItem, error) {
+	var result []EventItem
+	err := stream(func(e EventItem) error {
+		result = append(result, e)
+		return nil
+	})
+	return result, err
+}
+
+// negotiateEncoding picks br over gzip from Accept-Encoding; "" means uncompressed
+func negotiateEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = true
+	}
+	switch {
+	case accepted["br"]:
+		return "br"
+	case accepted["gzip"]:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressor is the subset of the gzip and brotli writers used for streaming
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// eventStream writes a JSON array of events one element at a time, so memory
+// stays flat however many rows the query returns. Headers are only sent with
+// the first element; until then the caller can still write an error response.
+type eventStream struct {
+	w   http.ResponseWriter
+	r   *http.Request
+	out io.Writer
+	cw  compressor
+	enc *json.Encoder
+	n   int
+}
+
+func newEventStream(w http.ResponseWriter, r *http.Request) *eventStream {
+	return &eventStream{w: w, r: r}
+}
+
+// started reports whether any of the response has been written
+func (s *eventStream) started() bool {
+	return s.out != nil
+}
+
+func (s *eventStream) start() error {
+	h := s.w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Add("Vary", "Accept-Encoding")
+	s.out = s.w
+	switch negotiateEncoding(s.r) {
+	case "br":
+		h.Set("Content-Encoding", "br")
+		s.cw = brotli.NewWriterLevel(s.w, brotliStreamLevel)
+		s.out = s.cw
+	case "gzip":
+		h.Set("Content-Encoding", "gzip")
+		s.cw = gzip.NewWriter(s.w)
+		s.out = s.cw
+	}
+	s.enc = json.NewEncoder(s.out)
+	_, err := io.WriteString(s.out, "[")
+	return err
+}
+
+// write appends one event, flushing to the client every eventsFlushEvery events
+func (s *eventStream) write(e any) error {
+	if !s.started() {
+		if err := s.start(); err != nil {
+			return err
+		}
+	} else if _, err := io.WriteString(s.out, ","); err != nil {
+		return err
+	}
+	if err := s.enc.Encode(e); err != nil {
+		return err
+	}
+	s.n++
+	if s.n%eventsFlushEvery == 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *eventStream) flush() error {
+	if s.cw != nil {
+		if err := s.cw.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := http.NewResponseController(s.w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// finish closes the array; an empty stream produces []
+func (s *eventStream) finish() error {
+	if !s.started() {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(s.out, "]\n"); err != nil {
+		return err
+	}
+	if s.cw != nil {
+		return s.cw.Close()
+	}
+	return nil
+}
+
+// abort ends a stream that failed part way. The array is left unterminated so
+// clients see a parse error rather than silently short results.
+func (s *eventStream) abort() {
+	if s.cw != nil {
+		s.cw.Close()
+	}
+}
@@ -0,0 +1,184 @@
+package stats
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// streamingStore generates n events without holding them in memory
+type streamingStore struct {
+	fakeStore
+	n    int
+	sent int
+	err  error
+}
+
+func (s *streamingStore) StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields, fn func(EventItem) error) error {
+	if s.err != nil {
+		return s.err
+	}
+	for i := 0; i < s.n && i < limit; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e := EventItem{Name: "pageview", URL: "https://example.com/", Pathname: "/", Country: "DE",
+			Browser: "Firefox", OS: "Linux", Device: LabelDesktop, Timestamp: "2024-01-01 10:00:00"}
+		if err := fn(e); err != nil {
+			return err
+		}
+		s.sent++
+	}
+	return nil
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0, gzip", "gzip"},
+		{"br; q=0.0, gzip;q=0", ""},
+		{"identity", ""},
+		{"GZIP;q=0.5", "gzip"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := negotiateEncoding(r); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestHandleEvents_Stream(t *testing.T) {
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"": func(r io.Reader) (io.Reader, error) { return r, nil },
+		"gzip": func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		"br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	}
+	for encoding, decode := range decoders {
+		t.Run("encoding="+encoding, func(t *testing.T) {
+			h := NewHandler(&streamingStore{n: 1200})
+			req := httptest.NewRequest("GET", "/api/stats/events?domain=example.com&limit=5000", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			w := httptest.NewRecorder()
+			h.HandleEvents(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			body, err := decode(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var events []EventItem
+			if err := json.NewDecoder(body).Decode(&events); err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 1200 {
+				t.Errorf("got %d events, want 1200", len(events))
+			}
+		})
+	}
+}
+
+func TestHandleEvents_Empty(t *testing.T) {
+	h := NewHandler(&streamingStore{})
+	w := httptest.NewRecorder()
+	h.HandleEvents(w, httptest.NewRequest("GET", "/api/stats/events?domain=example.com", nil))
+
+	if w.Body.String() != "[]\n" {
+		t.Errorf("body = %q, want []", w.Body.String())
+	}
+}
+
+func TestHandleEvents_ErrorBeforeFirstRow(t *testing.T) {
+	h := NewHandler(&streamingStore{err: errors.New("boom")})
+	w := httptest.NewRecorder()
+	h.HandleEvents(w, httptest.NewRequest("GET", "/api/stats/events?domain=example.com", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+}
+
+// failingWriter stands in for a client that disconnected mid-response
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	budget int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.budget -= len(p); w.budget < 0 {
+		return 0, errors.New("broken pipe")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestHandleEvents_StopsOnWriteError(t *testing.T) {
+	store := &streamingStore{n: 10000}
+	h := NewHandler(store)
+	w := &failingWriter{ResponseRecorder: httptest.NewRecorder(), budget: 4096}
+	h.HandleEvents(w, httptest.NewRequest("GET", "/api/stats/events?domain=example.com&limit=10000", nil))
+
+	if store.sent >= store.n {
+		t.Errorf("store sent all %d events after the client went away", store.sent)
+	}
+}
+
+func TestHandleEvents_CachesSmallResponses(t *testing.T) {
+	store := &streamingStore{n: 10}
+	h := NewHandler(store)
+	for i := 0; i < 2; i++ {
+		h.HandleEvents(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/stats/events?domain=example.com", nil))
+	}
+	if store.sent != 10 {
+		t.Errorf("store sent %d events, want 10 (second request cached)", store.sent)
+	}
+}
+
+// discardWriter is a ResponseWriter that drops the body, so benchmarks measure
+// the handler rather than the recorder's buffer
+type discardWriter struct{ header http.Header }
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// BenchmarkEvents_Buffered is the previous approach: collect every row, then encode
+func BenchmarkEvents_Buffered(b *testing.B) {
+	store := &streamingStore{n: 10000}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, _ := collectEvents(func(fn func(EventItem) error) error {
+			return store.StreamRecentEvents(context.Background(), "example.com", time.Time{}, time.Time{}, 10000, AllEventFields, fn)
+		})
+		writeJSON(&discardWriter{header: http.Header{}}, data)
+	}
+}
+
+func BenchmarkEvents_Streamed(b *testing.B) {
+	h := NewHandler(&streamingStore{n: 10000})
+	req := httptest.NewRequest("GET", "/api/stats/events?domain=example.com&limit=10000", nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.HandleEvents(&discardWriter{header: http.Header{}}, req)
+	}
+}
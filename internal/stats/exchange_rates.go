@@ -0,0 +1,137 @@
+package stats
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// frozenRatesJSON is the rates table used until a refresh succeeds, in the
+// format refreshes read
+//
+//go:embed exchange_rates.json
+var frozenRatesJSON []byte
+
+// maxRatesSize caps the body a refresh reads
+const maxRatesSize = 1 << 20
+
+// currencyRe matches ISO 4217 codes, the only form rendered into queries
+var currencyRe = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// rateTable holds how many units of each currency one unit of Base buys, as
+// served by the usual rates APIs: {"base": "USD", "date": "...", "rates": {"EUR": 0.92}}
+type rateTable struct {
+	Base  string             `json:"base"`
+	Date  string             `json:"date"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// parseRates reads and validates a rates table; entries with malformed codes
+// or rates are dropped, and the base is added at 1
+func parseRates(data []byte) (rateTable, error) {
+	var t rateTable
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, fmt.Errorf("invalid rates table: %w", err)
+	}
+	if !currencyRe.MatchString(t.Base) {
+		return t, fmt.Errorf("invalid rates base %q", t.Base)
+	}
+	rates := make(map[string]float64, len(t.Rates)+1)
+	for code, rate := range t.Rates {
+		if currencyRe.MatchString(code) && rate > 0 && !math.IsInf(rate, 0) {
+			rates[code] = rate
+		}
+	}
+	rates[t.Base] = 1
+	if len(rates) < 2 {
+		return t, fmt.Errorf("rates table has no rates")
+	}
+	t.Rates = rates
+	return t, nil
+}
+
+// frozenRates is the embedded fallback table
+var frozenRates = func() rateTable {
+	t, err := parseRates(frozenRatesJSON)
+	if err != nil {
+		panic("exchange_rates.json: " + err.Error())
+	}
+	return t
+}()
+
+// ExchangeRates converts revenue into a project's currency. It starts with the
+// embedded table and is replaced by each successful Refresh; failed refreshes
+// keep the last table.
+type ExchangeRates struct {
+	mu    sync.RWMutex
+	table rateTable
+}
+
+// NewExchangeRates returns rates holding the embedded table
+func NewExchangeRates() *ExchangeRates {
+	return &ExchangeRates{table: frozenRates}
+}
+
+// Refresh fetches the table at url. A table without a date is dated by the
+// UTC day it was fetched, which versions cached reports.
+func (r *ExchangeRates) Refresh(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rates: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRatesSize))
+	if err != nil {
+		return err
+	}
+	t, err := parseRates(data)
+	if err != nil {
+		return err
+	}
+	if t.Date == "" {
+		t.Date = time.Now().UTC().Format("2006-01-02")
+	}
+	r.mu.Lock()
+	r.table = t
+	r.mu.Unlock()
+	return nil
+}
+
+// current returns the table in use; nil rates use the embedded one
+func (r *ExchangeRates) current() rateTable {
+	if r == nil {
+		return frozenRates
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.table
+}
+
+// factors maps each currency the table knows to what one unit of it is worth
+// in target. The target itself is always worth 1, even when the table lacks it.
+func (t rateTable) factors(target string) map[string]float64 {
+	factors := map[string]float64{target: 1}
+	targetRate, ok := t.Rates[target]
+	if !ok {
+		return factors
+	}
+	for code, rate := range t.Rates {
+		factors[code] = targetRate / rate
+	}
+	factors[target] = 1
+	return factors
+}
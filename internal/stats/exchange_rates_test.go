@@ -0,0 +1,83 @@
+package stats
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRates(t *testing.T) {
+	table, err := parseRates([]byte(`{"base":"EUR","date":"2026-10-01","rates":{"USD":1.25,"GBP":0.8,"usd":2,"XYZW":3,"JPY":0,"CHF":-1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"EUR": 1, "USD": 1.25, "GBP": 0.8}
+	if len(table.Rates) != len(want) {
+		t.Fatalf("rates = %v, want %v", table.Rates, want)
+	}
+	for code, rate := range want {
+		if table.Rates[code] != rate {
+			t.Errorf("%s = %v, want %v", code, table.Rates[code], rate)
+		}
+	}
+
+	for _, body := range []string{`not json`, `{"base":"eur","rates":{"USD":1}}`, `{"base":"EUR","rates":{}}`} {
+		if _, err := parseRates([]byte(body)); err == nil {
+			t.Errorf("%s: no error", body)
+		}
+	}
+	if frozenRates.Rates["USD"] != 1 || frozenRates.Date == "" {
+		t.Errorf("embedded table = %+v", frozenRates)
+	}
+}
+
+func TestRateTableFactors(t *testing.T) {
+	table := rateTable{Base: "USD", Rates: map[string]float64{"USD": 1, "EUR": 0.8, "GBP": 0.5}}
+	factors := table.factors("EUR")
+	if factors["EUR"] != 1 || factors["USD"] != 0.8 || factors["GBP"] != 1.6 {
+		t.Errorf("EUR factors = %v", factors)
+	}
+	// A currency the table lacks still sums its own amounts
+	if factors := table.factors("CHF"); len(factors) != 1 || factors["CHF"] != 1 {
+		t.Errorf("CHF factors = %v", factors)
+	}
+}
+
+func TestExchangeRates_Refresh(t *testing.T) {
+	body, status := `{"base":"USD","rates":{"EUR":0.9}}`, http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	rates := NewExchangeRates()
+	if rates.current().Date != frozenRates.Date {
+		t.Fatal("new rates don't start with the embedded table")
+	}
+	if err := rates.Refresh(context.Background(), srv.Client(), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if got := rates.current(); got.Rates["EUR"] != 0.9 || got.Date == "" {
+		t.Errorf("refreshed table = %+v", got)
+	}
+
+	// Failed refreshes keep the last table
+	status = http.StatusBadGateway
+	if err := rates.Refresh(context.Background(), srv.Client(), srv.URL); err == nil {
+		t.Error("failed refresh: no error")
+	}
+	body, status = `{"base":"USD","rates":{}}`, http.StatusOK
+	if err := rates.Refresh(context.Background(), srv.Client(), srv.URL); err == nil {
+		t.Error("empty table: no error")
+	}
+	if got := rates.current(); got.Rates["EUR"] != 0.9 {
+		t.Errorf("table after failures = %+v", got)
+	}
+
+	var none *ExchangeRates
+	if none.current().Date != frozenRates.Date {
+		t.Error("nil rates don't use the embedded table")
+	}
+}
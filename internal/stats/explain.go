@@ -0,0 +1,339 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// RecordedQuery is one store query run while serving a debug request
+type RecordedQuery struct {
+	SQL        string  `json:"sql"`
+	Params     []any   `json:"params"`
+	Rows       int     `json:"rows"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// QueryRecorder collects the store queries of one request; safe for parallel queries
+type QueryRecorder struct {
+	mu      sync.Mutex
+	queries []RecordedQuery
+}
+
+// Queries returns the recorded queries in the order they finished
+func (rec *QueryRecorder) Queries() []RecordedQuery {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]RecordedQuery(nil), rec.queries...)
+}
+
+type queryRecorderKey struct{}
+
+// WithQueryRecorder makes stores record the queries they run with ctx into rec
+func WithQueryRecorder(ctx context.Context, rec *QueryRecorder) context.Context {
+	return context.WithValue(ctx, queryRecorderKey{}, rec)
+}
+
+// queryTrace times one query and counts its rows; a nil trace records nothing
+type queryTrace struct {
+	rec    *QueryRecorder
+	sql    string
+	params []any
+	start  time.Time
+	rows   int
+	done   bool
+}
+
+// startQuery begins a trace when ctx carries a recorder, and returns nil otherwise
+func startQuery(ctx context.Context, query string, params []any) *queryTrace {
+	rec, _ := ctx.Value(queryRecorderKey{}).(*QueryRecorder)
+	if rec == nil {
+		return nil
+	}
+	return &queryTrace{rec: rec, sql: strings.TrimSpace(query), params: params, start: time.Now()}
+}
+
+func (t *queryTrace) row() {
+	if t != nil {
+		t.rows++
+	}
+}
+
+// finish records the query once; later calls are ignored
+func (t *queryTrace) finish(err error) {
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	q := RecordedQuery{
+		SQL:        t.sql,
+		Params:     t.params,
+		Rows:       t.rows,
+		DurationMs: float64(time.Since(t.start).Microseconds()) / 1000,
+	}
+	if q.Params == nil {
+		q.Params = []any{}
+	}
+	if err != nil {
+		q.Error = err.Error()
+	}
+	t.rec.mu.Lock()
+	t.rec.queries = append(t.rec.queries, q)
+	t.rec.mu.Unlock()
+}
+
+// sqlRows counts the rows of a DuckDB or Postgres query and records it on Close
+type sqlRows struct {
+	*sql.Rows
+	trace *queryTrace
+}
+
+func (r *sqlRows) Next() bool {
+	if r.Rows.Next() {
+		r.trace.row()
+		return true
+	}
+	return false
+}
+
+func (r *sqlRows) Close() error {
+	err := r.Rows.Close()
+	r.trace.finish(r.Rows.Err())
+	return err
+}
+
+// queryContext runs a DuckDB query, recording it for debug requests
+func (s *Store) queryContext(ctx context.Context, query string, args ...any) (*sqlRows, error) {
+	trace := startQuery(ctx, query, args)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		trace.finish(err)
+		return nil, storeError(ctx, err)
+	}
+	return &sqlRows{Rows: rows, trace: trace}, nil
+}
+
+// sqlRow records a single-row DuckDB or Postgres query on Scan
+type sqlRow struct {
+	*sql.Row
+	ctx   context.Context
+	trace *queryTrace
+}
+
+func (r *sqlRow) Scan(dest ...any) error {
+	err := r.Row.Scan(dest...)
+	if err == nil {
+		r.trace.row()
+	}
+	if err == sql.ErrNoRows {
+		r.trace.finish(nil)
+		return err
+	}
+	r.trace.finish(err)
+	return storeError(r.ctx, err)
+}
+
+// queryRowContext runs a single-row DuckDB query, recording it for debug requests
+func (s *Store) queryRowContext(ctx context.Context, query string, args ...any) *sqlRow {
+	return &sqlRow{Row: s.db.QueryRowContext(ctx, query, args...), ctx: ctx, trace: startQuery(ctx, query, args)}
+}
+
+// queryContext runs a Postgres query, recording it for debug requests
+func (s *PostgresStore) queryContext(ctx context.Context, query string, args ...any) (*sqlRows, error) {
+	trace := startQuery(ctx, query, args)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		trace.finish(err)
+		return nil, storeError(ctx, err)
+	}
+	return &sqlRows{Rows: rows, trace: trace}, nil
+}
+
+// queryRowContext runs a single-row Postgres query, recording it for debug requests
+func (s *PostgresStore) queryRowContext(ctx context.Context, query string, args ...any) *sqlRow {
+	return &sqlRow{Row: s.db.QueryRowContext(ctx, query, args...), ctx: ctx, trace: startQuery(ctx, query, args)}
+}
+
+// chRows counts the rows of a ClickHouse query and records it on Close
+type chRows struct {
+	driver.Rows
+	trace *queryTrace
+}
+
+func (r *chRows) Next() bool {
+	if r.Rows.Next() {
+		r.trace.row()
+		return true
+	}
+	return false
+}
+
+func (r *chRows) Close() error {
+	err := r.Rows.Close()
+	r.trace.finish(r.Rows.Err())
+	return err
+}
+
+// query runs a ClickHouse query, recording it for debug requests. Before the
+// first sync the events table is empty, so queries fail with ErrNotReady.
+func (s *ClickHouseStore) query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	if err := statusError(s.Status()); err != nil {
+		return nil, err
+	}
+	trace := startQuery(ctx, query, args)
+	rows, err := s.conn.Query(ctx, query, args...)
+	if err != nil {
+		trace.finish(err)
+		return nil, storeError(ctx, err)
+	}
+	if trace == nil {
+		return rows, nil
+	}
+	return &chRows{Rows: rows, trace: trace}, nil
+}
+
+// chRow records a single-row ClickHouse query on Scan and classifies its error
+type chRow struct {
+	driver.Row
+	ctx   context.Context
+	trace *queryTrace
+}
+
+func (r *chRow) Scan(dest ...any) error {
+	err := r.Row.Scan(dest...)
+	if err == nil {
+		r.trace.row()
+	}
+	if err == sql.ErrNoRows {
+		r.trace.finish(nil)
+		return err
+	}
+	r.trace.finish(err)
+	return storeError(r.ctx, err)
+}
+
+// errRow is a row that failed before its query ran
+type errRow struct{ err error }
+
+func (r errRow) Err() error           { return r.err }
+func (r errRow) Scan(...any) error    { return r.err }
+func (r errRow) ScanStruct(any) error { return r.err }
+
+// queryRow runs a single-row ClickHouse query, recording it for debug requests;
+// like query it fails with ErrNotReady before the first sync
+func (s *ClickHouseStore) queryRow(ctx context.Context, query string, args ...any) driver.Row {
+	if err := statusError(s.Status()); err != nil {
+		return errRow{err}
+	}
+	trace := startQuery(ctx, query, args)
+	return &chRow{Row: s.conn.QueryRow(ctx, query, args...), ctx: ctx, trace: trace}
+}
+
+// debugging reports whether r asked for query debugging and may have it: admins only
+func (h *Handler) debugging(r *http.Request) bool {
+	return r.URL.Query().Get("debug") == "1" && h.roles != nil && h.roles.RequestRole(r) == "admin"
+}
+
+// cacheGet reads a cached response unless ctx records queries, so debug
+// requests always show the queries behind their results
+func (h *Handler) cacheGet(ctx context.Context, key string, dest any) bool {
+	if ctx.Value(queryRecorderKey{}) != nil {
+		return false
+	}
+	return h.cache.Get(key, dest)
+}
+
+// WithQueryDebug honors debug=1 on stats endpoints for admins: the store queries
+// run for the request are added to the JSON response under "_debug". Responses
+// that are not JSON objects are wrapped as {"data": ..., "_debug": ...}.
+// Other requests pass through untouched.
+func (h *Handler) WithQueryDebug(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streams never end, so there is no response to add queries to
+		if !strings.HasPrefix(r.URL.Path, "/api/stats/") || strings.HasSuffix(r.URL.Path, "/stream") || !h.debugging(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &QueryRecorder{}
+		buf := &bufferedWriter{header: make(http.Header)}
+		next.ServeHTTP(buf, r.WithContext(WithQueryRecorder(r.Context(), rec)))
+
+		body := buf.body.Bytes()
+		if strings.HasPrefix(buf.header.Get("Content-Type"), "application/json") {
+			if out, err := appendDebug(body, rec.Queries()); err == nil {
+				body = out
+				buf.header.Del("Content-Length")
+			}
+		}
+		for k, v := range buf.header {
+			w.Header()[k] = v
+		}
+		if buf.code == 0 {
+			buf.code = http.StatusOK
+		}
+		w.WriteHeader(buf.code)
+		w.Write(body)
+	})
+}
+
+// appendDebug adds queries to a JSON response body under "_debug"
+func appendDebug(body []byte, queries []RecordedQuery) ([]byte, error) {
+	debug, err := json.Marshal(map[string]any{"queries": queries})
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(body)
+	if !json.Valid(trimmed) {
+		return nil, &json.SyntaxError{}
+	}
+	var out bytes.Buffer
+	if trimmed[0] == '{' {
+		inner := bytes.TrimSpace(trimmed[1 : len(trimmed)-1])
+		out.WriteByte('{')
+		if len(inner) > 0 {
+			out.Write(inner)
+			out.WriteByte(',')
+		}
+		out.WriteString(`"_debug":`)
+		out.Write(debug)
+		out.WriteString("}\n")
+		return out.Bytes(), nil
+	}
+	out.WriteString(`{"data":`)
+	out.Write(trimmed)
+	out.WriteString(`,"_debug":`)
+	out.Write(debug)
+	out.WriteString("}\n")
+	return out.Bytes(), nil
+}
+
+// bufferedWriter holds a response so it can be amended before it is sent
+type bufferedWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) Header() http.Header { return w.header }
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(p)
+}
@@ -0,0 +1,127 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+func newExplainStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, 'v' || i AS visitor_id, 'pageview' AS name,
+			'' AS url, p AS pathname, '' AS referrer, '' AS country, '' AS browser, '' AS os,
+			'' AS device, '' AS props, CURRENT_TIMESTAMP::TIMESTAMP - INTERVAL 1 HOUR AS timestamp
+		FROM (VALUES (1, '/'), (2, '/'), (3, '/pricing')) t(i, p)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+}
+
+func TestWithQueryDebug_AdminOnly(t *testing.T) {
+	h := NewHandler(newExplainStore(t))
+	api := h.WithQueryDebug(http.HandlerFunc(h.HandlePages))
+	get := func(url, role string) map[string]json.RawMessage {
+		t.Helper()
+		h.SetRoleSource(fakeRoles(role))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s as %q: status = %d: %s", url, role, w.Code, w.Body)
+		}
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			// Without debug the pages response is a plain array
+			return nil
+		}
+		return body
+	}
+
+	if body := get("/api/stats/pages?domain=example.com&period=7d&debug=1", "user"); body["_debug"] != nil {
+		t.Error("debug payload for a non-admin")
+	}
+	if body := get("/api/stats/pages?domain=example.com&period=7d", "admin"); body["_debug"] != nil {
+		t.Error("debug payload without debug=1")
+	}
+
+	// The response above is cached; debug requests still run and show the queries
+	body := get("/api/stats/pages?domain=example.com&period=7d&debug=1", "admin")
+	var debug struct {
+		Queries []RecordedQuery `json:"queries"`
+	}
+	if err := json.Unmarshal(body["_debug"], &debug); err != nil {
+		t.Fatalf("_debug = %s: %v", body["_debug"], err)
+	}
+	if len(debug.Queries) != 1 {
+		t.Fatalf("queries = %+v, want 1", debug.Queries)
+	}
+	q := debug.Queries[0]
+	if !strings.Contains(q.SQL, "FROM events") || q.Rows != 2 || len(q.Params) == 0 || q.Params[0] != `["example.com"]` || q.Error != "" {
+		t.Errorf("query = %+v", q)
+	}
+	var pages []TopItem
+	if err := json.Unmarshal(body["data"], &pages); err != nil || len(pages) != 2 {
+		t.Errorf("data = %s, want the 2 pages", body["data"])
+	}
+}
+
+func TestAppendDebug_Object(t *testing.T) {
+	out, err := appendDebug([]byte(`{"pageviews":3}`+"\n"), []RecordedQuery{{SQL: "SELECT 1", Params: []any{}, Rows: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"pageviews":3,"_debug":{"queries":[{"sql":"SELECT 1","params":[],"rows":1,"duration_ms":0}]}}`
+	if strings.TrimSpace(string(out)) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+	if out, _ := appendDebug([]byte(`{}`), nil); !strings.HasPrefix(string(out), `{"_debug":`) {
+		t.Errorf("empty object: got %s", out)
+	}
+}
+
+// countingRows returns n rows of nothing
+type countingRows struct {
+	driver.Rows
+	n int
+}
+
+func (r *countingRows) Next() bool {
+	r.n--
+	return r.n >= 0
+}
+func (r *countingRows) Close() error { return nil }
+func (r *countingRows) Err() error   { return nil }
+
+func TestChRows_RecordsRowCount(t *testing.T) {
+	rec := &QueryRecorder{}
+	ctx := WithQueryRecorder(context.Background(), rec)
+	rows := &chRows{Rows: &countingRows{n: 3}, trace: startQuery(ctx, " SELECT path FROM events ", []any{"example.com"})}
+	for rows.Next() {
+	}
+	rows.Close()
+	rows.Close()
+
+	queries := rec.Queries()
+	if len(queries) != 1 || queries[0].Rows != 3 || queries[0].SQL != "SELECT path FROM events" {
+		t.Errorf("queries = %+v", queries)
+	}
+
+	if startQuery(context.Background(), "SELECT 1", nil) != nil {
+		t.Error("trace started without a recorder")
+	}
+}
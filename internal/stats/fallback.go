@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultFallbackMaxDays is the longest range answered in full from parquet
+// while the DuckDB memory table is not loaded
+const defaultFallbackMaxDays = 7
+
+const (
+	// dataWarningHeader carries dataWarningPartial on responses that cover
+	// only the most recent part of the requested range
+	dataWarningHeader  = "X-Data-Warning"
+	dataWarningPartial = "partial_data"
+	// dataWarningStale flags responses served while background refreshes are
+	// failing, so the data may be older than the refresh interval
+	dataWarningStale = "stale_data"
+)
+
+// partialRange moves from forward so [from, to) spans at most maxRange,
+// reporting whether it did. A zero maxRange or to leaves the range as is.
+func partialRange(from, to time.Time, maxRange time.Duration) (time.Time, bool) {
+	if maxRange <= 0 || to.IsZero() || to.Sub(from) <= maxRange {
+		return from, false
+	}
+	return to.Add(-maxRange), true
+}
+
+type partialDataKey struct{}
+
+// partialDataContext marks ctx when the store will answer [from, to) only in
+// part, and adds the warning to header; failing refreshes add the stale warning.
+// Returns the cache key suffix for the state.
+func (h *Handler) partialDataContext(ctx context.Context, header http.Header, from, to time.Time) (context.Context, string) {
+	if h.store == nil {
+		return ctx, ""
+	}
+	st := h.store.Status()
+	if statusError(st) == nil && st.ConsecutiveFailures > 0 {
+		header.Add(dataWarningHeader, dataWarningStale)
+	}
+	if st.MemoryTable || st.FallbackMaxDays <= 0 {
+		return ctx, ""
+	}
+	if _, partial := partialRange(from, to, time.Duration(st.FallbackMaxDays)*24*time.Hour); !partial {
+		return ctx, ""
+	}
+	header.Add(dataWarningHeader, dataWarningPartial)
+	return context.WithValue(ctx, partialDataKey{}, true), "|partial"
+}
+
+// isPartialData reports whether partialDataContext marked ctx
+func isPartialData(ctx context.Context) bool {
+	partial, _ := ctx.Value(partialDataKey{}).(bool)
+	return partial
+}
+
+// HandleReady answers 200 with the store status once the store serves queries,
+// and 503 with Retry-After before that, for load balancer readiness checks
+func (h *Handler) HandleReady(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+	st := h.store.Status()
+	if statusError(st) != nil {
+		// Not reported to the error log: probes poll this during every startup
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(notReadyRetryAfter)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(st)
+		return
+	}
+	writeJSON(w, st)
+}
@@ -0,0 +1,154 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fallbackDay = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeParquet writes one pageview per day at noon, for days days from fallbackDay
+func writeParquet(t *testing.T, db *sql.DB, path string, days int) {
+	t.Helper()
+	_, err := db.Exec(`
+		COPY (
+			SELECT 'example.com' AS domain, 'v' || i AS visitor_id, 'pageview' AS name, '' AS url, '/' AS pathname,
+				'' AS referrer, '' AS country, '' AS browser, '' AS os, '' AS device, '{}' AS props,
+				TIMESTAMP '2024-01-01 12:00:00' + INTERVAL (i) DAY AS timestamp,
+				TIMESTAMP '2024-01-01 12:00:00' + INTERVAL (i) DAY AS received_at
+			FROM range(?) t(i)
+		) TO '`+path+`' (FORMAT PARQUET)
+	`, days)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newParquetStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	dir := t.TempDir()
+	return withState(&Store{db: db, fallbackMaxRange: 7 * 24 * time.Hour}, storeSnapshot{ready: true}), dir
+}
+
+func TestStoreRefresh_KeepsPreviousTableOnFailure(t *testing.T) {
+	s, dir := newParquetStore(t)
+	writeParquet(t, s.db, filepath.Join(dir, "a.parquet"), 10)
+	s.parquetPath = filepath.Join(dir, "*.parquet")
+	ctx := WithFilters(context.Background(), Filters{})
+	to := fallbackDay.AddDate(0, 0, 30)
+
+	s.refreshMemoryTable()
+	if st := s.Status(); !st.MemoryTable || st.LastError != "" {
+		t.Fatalf("first refresh: status = %+v", st)
+	}
+
+	// Inject a load failure: the source disappears
+	s.parquetPath = filepath.Join(dir, "missing", "*.parquet")
+	s.refreshMemoryTable()
+	st := s.Status()
+	if st.LastError == "" || !st.MemoryTable {
+		t.Errorf("failed refresh: status = %+v, want an error and the previous table", st)
+	}
+	o, err := s.GetOverview(ctx, "example.com", fallbackDay, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 10 {
+		t.Errorf("pageviews after failed refresh = %d, want 10 from the previous table", o.Pageviews)
+	}
+
+	// A later successful load replaces the table
+	writeParquet(t, s.db, filepath.Join(dir, "b.parquet"), 2)
+	s.parquetPath = filepath.Join(dir, "*.parquet")
+	s.refreshMemoryTable()
+	if o, err = s.GetOverview(ctx, "example.com", fallbackDay, to); err != nil || o.Pageviews != 12 {
+		t.Errorf("pageviews after recovery = %v, %v, want 12", o, err)
+	}
+	if st := s.Status(); st.LastError != "" {
+		t.Errorf("recovered status = %+v", st)
+	}
+}
+
+func TestStoreFallback_BoundedRange(t *testing.T) {
+	s, dir := newParquetStore(t)
+	writeParquet(t, s.db, filepath.Join(dir, "a.parquet"), 30)
+	s.parquetPath = filepath.Join(dir, "*.parquet")
+	ctx := WithFilters(context.Background(), Filters{})
+
+	// No memory table: a 5-day range is answered in full
+	from := fallbackDay.AddDate(0, 0, 10)
+	o, err := s.GetOverview(ctx, "example.com", from, from.AddDate(0, 0, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 5 {
+		t.Errorf("5-day pageviews = %d, want 5", o.Pageviews)
+	}
+
+	// 30 days keep the last 7
+	o, err = s.GetOverview(ctx, "example.com", fallbackDay, fallbackDay.AddDate(0, 0, 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 7 {
+		t.Errorf("30-day pageviews = %d, want the last 7 days", o.Pageviews)
+	}
+}
+
+func TestPartialRange(t *testing.T) {
+	week := 7 * 24 * time.Hour
+	to := fallbackDay.AddDate(0, 0, 30)
+	if from, partial := partialRange(fallbackDay, to, week); !partial || !from.Equal(to.Add(-week)) {
+		t.Errorf("30 days: %v, %v", from, partial)
+	}
+	if _, partial := partialRange(to.Add(-week), to, week); partial {
+		t.Error("7 days reported partial")
+	}
+	if _, partial := partialRange(fallbackDay, time.Time{}, week); partial {
+		t.Error("open range reported partial")
+	}
+}
+
+// fallbackStore reports no memory table
+type fallbackStore struct {
+	fakeStore
+}
+
+func (fallbackStore) Status() StoreStatus {
+	return StoreStatus{Backend: "duckdb", Ready: true, FallbackMaxDays: 7}
+}
+
+func (fallbackStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	return &Overview{Pageviews: 1}, nil
+}
+
+func TestHandleOverview_PartialDataWarning(t *testing.T) {
+	h := NewHandler(fallbackStore{})
+
+	for _, tt := range []struct {
+		period, want string
+	}{
+		{"7d", ""},
+		{"30d", dataWarningPartial},
+		{"30d", dataWarningPartial}, // from cache
+	} {
+		w := httptest.NewRecorder()
+		h.HandleOverview(w, httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period="+tt.period, nil))
+		if got := w.Header().Get(dataWarningHeader); got != tt.want {
+			t.Errorf("%s: %s = %q, want %q", tt.period, dataWarningHeader, got, tt.want)
+		}
+		if tt.want != "" && !strings.Contains(w.Body.String(), `"warning":"partial_data"`) {
+			t.Errorf("%s: body = %s", tt.period, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ErrSegmentNotFound is returned when a segment doesn't exist for the requested domain
+var ErrSegmentNotFound = errors.New("segment not found")
+
+// maxFilterValueLen caps a single filter value
+const maxFilterValueLen = 200
+
+// Filters narrows a report to events matching every non-empty field
+type Filters struct {
+	Country     string `json:"country,omitempty"`
+	Browser     string `json:"browser,omitempty"`
+	OS          string `json:"os,omitempty"`
+	Device      string `json:"device,omitempty"`
+	Page        string `json:"page,omitempty"`
+	Referrer    string `json:"referrer,omitempty"`
+	UTMSource   string `json:"utm_source,omitempty"`
+	UTMMedium   string `json:"utm_medium,omitempty"`
+	UTMCampaign string `json:"utm_campaign,omitempty"`
+
+	// host is the strict domain scope of the request; it is never saved or keyed
+	host hostScope
+}
+
+// filterField maps a filter query param onto its events column
+type filterField struct {
+	param  string
+	column string
+	get    func(f *Filters) *string
+}
+
+var filterFields = []filterField{
+	{"country", "country", func(f *Filters) *string { return &f.Country }},
+	{"browser", "browser", func(f *Filters) *string { return &f.Browser }},
+	{"os", "os", func(f *Filters) *string { return &f.OS }},
+	{"device", "device", func(f *Filters) *string { return &f.Device }},
+	{"page", "pathname", func(f *Filters) *string { return &f.Page }},
+	{"referrer", "referrer", func(f *Filters) *string { return &f.Referrer }},
+	{"utm_source", "utm_source", func(f *Filters) *string { return &f.UTMSource }},
+	{"utm_medium", "utm_medium", func(f *Filters) *string { return &f.UTMMedium }},
+	{"utm_campaign", "utm_campaign", func(f *Filters) *string { return &f.UTMCampaign }},
+}
+
+// ParseFilters reads inline filters from query params
+func ParseFilters(q url.Values) Filters {
+	var f Filters
+	for _, ff := range filterFields {
+		*ff.get(&f) = strings.TrimSpace(q.Get(ff.param))
+	}
+	return f
+}
+
+// Validate checks filter values are within limits
+func (f Filters) Validate() error {
+	for _, ff := range filterFields {
+		if len(*ff.get(&f)) > maxFilterValueLen {
+			return fmt.Errorf("filter %s exceeds %d characters", ff.param, maxFilterValueLen)
+		}
+	}
+	return nil
+}
+
+// Merge overlays other onto f; non-empty fields in other win
+func (f Filters) Merge(other Filters) Filters {
+	for _, ff := range filterFields {
+		if v := *ff.get(&other); v != "" {
+			*ff.get(&f) = v
+		}
+	}
+	return f
+}
+
+// IsEmpty reports whether no filter is set
+func (f Filters) IsEmpty() bool {
+	return f.Key() == ""
+}
+
+// Key returns a canonical representation for cache keys
+func (f Filters) Key() string {
+	var parts []string
+	for _, ff := range filterFields {
+		if v := *ff.get(&f); v != "" {
+			parts = append(parts, ff.param+"="+url.QueryEscape(v))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+// duckdbClause renders filters as AND conditions with numbered params starting at argIndex
+func (f Filters) duckdbClause(argIndex int) (string, []any) {
+	var sb strings.Builder
+	var args []any
+	for _, ff := range filterFields {
+		v := *ff.get(&f)
+		if v == "" {
+			continue
+		}
+		switch ff.param {
+		case "referrer":
+			fmt.Fprintf(&sb, " AND %s LIKE '%%' || $%d || '%%'", ff.column, argIndex)
+		case "device":
+			// Reports show normalized classes; compare on the class so any casing of a label matches
+			fmt.Fprintf(&sb, " AND lower(%s) = $%d", duckdbDeviceExpr("device"), argIndex)
+			v = strings.ToLower(v)
+		default:
+			fmt.Fprintf(&sb, " AND %s = $%d", ff.column, argIndex)
+		}
+		args = append(args, v)
+		argIndex++
+	}
+	if f.host.domain != "" {
+		sb.WriteString(" AND " + f.host.duckdbCondition())
+	}
+	return sb.String(), args
+}
+
+// clickhouseClause renders filters as AND conditions with positional params
+func (f Filters) clickhouseClause() (string, []any) {
+	var sb strings.Builder
+	var args []any
+	for _, ff := range filterFields {
+		v := *ff.get(&f)
+		if v == "" {
+			continue
+		}
+		switch ff.param {
+		case "referrer":
+			fmt.Fprintf(&sb, " AND position(%s, ?) > 0", ff.column)
+		case "device":
+			fmt.Fprintf(&sb, " AND lower(%s) = ?", clickhouseDeviceExpr("device"))
+			v = strings.ToLower(v)
+		default:
+			fmt.Fprintf(&sb, " AND %s = ?", ff.column)
+		}
+		args = append(args, v)
+	}
+	if f.host.domain != "" {
+		sb.WriteString(" AND " + f.host.clickhouseCondition())
+	}
+	return sb.String(), args
+}
+
+// postgresClause renders filters as AND conditions with numbered params starting at argIndex
+func (f Filters) postgresClause(argIndex int) (string, []any) {
+	var sb strings.Builder
+	var args []any
+	for _, ff := range filterFields {
+		v := *ff.get(&f)
+		if v == "" {
+			continue
+		}
+		switch ff.param {
+		case "referrer":
+			fmt.Fprintf(&sb, " AND strpos(%s, $%d) > 0", ff.column, argIndex)
+		case "device":
+			fmt.Fprintf(&sb, " AND lower(%s) = $%d", postgresDeviceExpr("device"), argIndex)
+			v = strings.ToLower(v)
+		default:
+			fmt.Fprintf(&sb, " AND %s = $%d", ff.column, argIndex)
+		}
+		args = append(args, v)
+		argIndex++
+	}
+	if f.host.domain != "" {
+		sb.WriteString(" AND " + f.host.postgresCondition())
+	}
+	return sb.String(), args
+}
+
+type filtersKey struct{}
+
+// WithFilters attaches filters to the context passed to store methods
+func WithFilters(ctx context.Context, f Filters) context.Context {
+	return context.WithValue(ctx, filtersKey{}, f)
+}
+
+// filtersFromContext returns the filters attached by WithFilters, if any, with
+// the host scope of withHostScope
+func filtersFromContext(ctx context.Context) Filters {
+	f, _ := ctx.Value(filtersKey{}).(Filters)
+	f.host, _ = ctx.Value(hostScopeKey{}).(hostScope)
+	return f
+}
+
+// SegmentSource loads saved segments scoped to the domain they belong to
+type SegmentSource interface {
+	SegmentFilters(id, domain string) (Filters, error)
+}
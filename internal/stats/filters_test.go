@@ -0,0 +1,100 @@
+package stats
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestParseFilters(t *testing.T) {
+	q, _ := url.ParseQuery("country=DE&device=mobile&page=%2Fpricing&limit=10")
+	f := ParseFilters(q)
+
+	if f.Country != "DE" || f.Device != "mobile" || f.Page != "/pricing" {
+		t.Errorf("ParseFilters = %+v", f)
+	}
+	if f.Browser != "" {
+		t.Errorf("Browser = %q, want empty", f.Browser)
+	}
+}
+
+func TestFilters_MergeInlineWins(t *testing.T) {
+	segment := Filters{Country: "DE", Device: "mobile"}
+	inline := Filters{Device: "desktop", Browser: "Firefox"}
+
+	got := segment.Merge(inline)
+
+	if got.Country != "DE" {
+		t.Errorf("Country = %q, want DE", got.Country)
+	}
+	if got.Device != "desktop" {
+		t.Errorf("Device = %q, want desktop (inline wins)", got.Device)
+	}
+	if got.Browser != "Firefox" {
+		t.Errorf("Browser = %q, want Firefox", got.Browser)
+	}
+}
+
+func TestFilters_Key(t *testing.T) {
+	a := Filters{Country: "DE", Device: "mobile"}
+	b := Filters{}.Merge(Filters{Device: "mobile"}).Merge(Filters{Country: "DE"})
+
+	if a.Key() != b.Key() {
+		t.Errorf("Key not canonical: %q vs %q", a.Key(), b.Key())
+	}
+	if (Filters{}).Key() != "" {
+		t.Errorf("empty filters should have empty key")
+	}
+	if a.Key() == (Filters{Country: "DE"}).Key() {
+		t.Errorf("different filters should have different keys")
+	}
+}
+
+func TestFilters_Validate(t *testing.T) {
+	long := make([]byte, maxFilterValueLen+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+
+	if err := (Filters{Country: "DE"}).Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+	if err := (Filters{Page: string(long)}).Validate(); err == nil {
+		t.Error("Validate() should reject oversized values")
+	}
+}
+
+func TestFilters_DuckDBClause(t *testing.T) {
+	clause, args := Filters{Country: "DE", Referrer: "google"}.duckdbClause(5)
+
+	want := " AND country = $5 AND referrer LIKE '%' || $6 || '%'"
+	if clause != want {
+		t.Errorf("clause = %q, want %q", clause, want)
+	}
+	if len(args) != 2 || args[0] != "DE" || args[1] != "google" {
+		t.Errorf("args = %v", args)
+	}
+}
+
+func TestFilters_ClickHouseClause(t *testing.T) {
+	clause, args := Filters{Page: "/a", UTMSource: "news"}.clickhouseClause()
+
+	want := " AND pathname = ? AND utm_source = ?"
+	if clause != want {
+		t.Errorf("clause = %q, want %q", clause, want)
+	}
+	if len(args) != 2 {
+		t.Errorf("args = %v", args)
+	}
+}
+
+func TestFiltersContext(t *testing.T) {
+	if !filtersFromContext(context.Background()).IsEmpty() {
+		t.Error("background context should carry no filters")
+	}
+
+	ctx := WithFilters(context.Background(), Filters{OS: "Linux"})
+	if filtersFromContext(ctx).OS != "Linux" {
+		t.Error("filters not carried through context")
+	}
+}
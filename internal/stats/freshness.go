@@ -0,0 +1,224 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Freshness tells how current a domain's queryable data is, so dashboards can
+// say "data as of 2 minutes ago". Times are RFC3339.
+type Freshness struct {
+	Domain string `json:"domain"`
+	// DataAsOf is the latest received_at of domain's queryable events, empty
+	// while it has none
+	DataAsOf string `json:"data_as_of,omitempty"`
+	// LastRefresh is when data last became queryable: the last load or, with
+	// live ingestion, the last buffer flush
+	LastRefresh string `json:"last_refresh,omitempty"`
+	// NextRefresh estimates when newer events become queryable
+	NextRefresh string `json:"next_refresh,omitempty"`
+}
+
+// watermarks holds each domain's latest queryable received_at, recorded from
+// the local table after every load and raised by ingestion buffer flushes.
+// Both stores embed it, so GetFreshness never queries.
+type watermarks struct {
+	marksMu    sync.RWMutex
+	marks      map[string]time.Time
+	flushedAt  time.Time
+	flushEvery time.Duration
+}
+
+// recordMarks replaces the watermarks with those of a load
+func (w *watermarks) recordMarks(marks map[string]time.Time) {
+	w.marksMu.Lock()
+	w.marks = marks
+	w.marksMu.Unlock()
+}
+
+// flushedEvent holds the fields of an ingested event watermarks need
+type flushedEvent struct {
+	Domain     string    `json:"domain"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// ObserveFlush raises the watermarks to the events of batch, which the
+// ingestion buffer just wrote to the events table; every is the buffer's
+// flush interval. Events without received_at count as received at the flush.
+func (w *watermarks) ObserveFlush(batch []json.RawMessage, every time.Duration) {
+	now := time.Now().UTC()
+	latest := make(map[string]time.Time)
+	for _, raw := range batch {
+		var ev flushedEvent
+		if err := json.Unmarshal(raw, &ev); err != nil || ev.Domain == "" {
+			continue
+		}
+		at := ev.ReceivedAt.UTC()
+		if at.IsZero() || at.After(now) {
+			at = now
+		}
+		if at.After(latest[ev.Domain]) {
+			latest[ev.Domain] = at
+		}
+	}
+
+	w.raiseMarks(latest)
+	w.marksMu.Lock()
+	w.flushedAt, w.flushEvery = now, every
+	w.marksMu.Unlock()
+}
+
+// raiseMarks raises the watermarks of the domains of marks, keeping the others
+func (w *watermarks) raiseMarks(marks map[string]time.Time) {
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	if w.marks == nil {
+		w.marks = make(map[string]time.Time)
+	}
+	for domain, at := range marks {
+		if at.After(w.marks[domain]) {
+			w.marks[domain] = at
+		}
+	}
+}
+
+// freshness returns the freshness of domains, a domain and its aliases, given
+// the store's status; a flush after the last load makes the next flush the
+// next refresh
+func (w *watermarks) freshness(domains []string, st StoreStatus) Freshness {
+	domain := domains[0]
+	w.marksMu.RLock()
+	var mark time.Time
+	for _, d := range domains {
+		if w.marks[d].After(mark) {
+			mark = w.marks[d]
+		}
+	}
+	flushedAt, every := w.flushedAt, w.flushEvery
+	w.marksMu.RUnlock()
+
+	f := Freshness{Domain: domain, LastRefresh: st.LastRefresh, NextRefresh: st.NextRefresh}
+	if !mark.IsZero() {
+		f.DataAsOf = mark.UTC().Format(time.RFC3339)
+	}
+	if last, err := time.Parse(time.RFC3339, st.LastRefresh); !flushedAt.IsZero() && (err != nil || flushedAt.After(last)) {
+		f.LastRefresh = flushedAt.Format(time.RFC3339)
+		f.NextRefresh = flushedAt.Add(every).Format(time.RFC3339)
+	}
+	return f
+}
+
+// recordWatermarks records each domain's latest received_at from the memory
+// table, for GetFreshness
+func (s *Store) recordWatermarks() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT domain, max(received_at)
+		FROM %s
+		WHERE received_at IS NOT NULL
+		GROUP BY domain
+	`, s.snapshot().table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	marks := make(map[string]time.Time)
+	for rows.Next() {
+		var domain string
+		var at time.Time
+		if err := rows.Scan(&domain, &at); err != nil {
+			return err
+		}
+		marks[domain] = at.UTC()
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.recordMarks(marks)
+	return nil
+}
+
+// GetFreshness returns how current domain's data in the memory table is
+func (s *Store) GetFreshness(ctx context.Context, domain string) (Freshness, error) {
+	return s.freshness(queryDomains(ctx, domain), s.Status()), nil
+}
+
+// recordWatermarks records each domain's latest received_at from the events
+// table, for GetFreshness
+func (s *ClickHouseStore) recordWatermarks(ctx context.Context) error {
+	rows, err := s.conn.Query(ctx, `
+		SELECT domain, max(received_at)
+		FROM events
+		GROUP BY domain
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	marks := make(map[string]time.Time)
+	for rows.Next() {
+		var domain string
+		var at time.Time
+		if err := rows.Scan(&domain, &at); err != nil {
+			return err
+		}
+		if at.Unix() > 0 {
+			marks[domain] = at.UTC()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.recordMarks(marks)
+	return nil
+}
+
+// GetFreshness returns how current domain's data in the events table is
+func (s *ClickHouseStore) GetFreshness(ctx context.Context, domain string) (Freshness, error) {
+	return s.freshness(queryDomains(ctx, domain), s.Status()), nil
+}
+
+// HandleFreshness serves GET /api/stats/freshness?domain=..., which tells
+// when domain's queryable data was received up to and when newer events
+// should show up. It isn't cached, as it's cheap and cached answers would
+// lag the refresh they describe.
+func (h *Handler) HandleFreshness(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, _, _, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, _, err := h.aliasContext(r.Context(), domain, "")
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	f, err := h.store.GetFreshness(ctx, domain)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, f)
+}
+
+// dataAsOf is the DataAsOf of domain's freshness, or "" when unknown
+func (h *Handler) dataAsOf(ctx context.Context, domain string) string {
+	f, err := h.store.GetFreshness(ctx, domain)
+	if err != nil {
+		log.Printf("stats: freshness of %s: %v", domain, err)
+		return ""
+	}
+	return f.DataAsOf
+}
@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStore_GetFreshness(t *testing.T) {
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	s := seedStore(t, now,
+		seedEvent{Ago: time.Hour},
+		seedEvent{Ago: 2 * time.Hour, ReceivedAt: now.Add(-10 * time.Minute)},
+		seedEvent{Domain: "other.com", Ago: daysAgo(1)},
+	)
+	s.setStatus(func(st *StoreStatus) { st.LastRefresh = now.Format(time.RFC3339) })
+
+	if err := s.recordWatermarks(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.GetFreshness(context.Background(), fixtureDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.DataAsOf != "2024-03-04T11:50:00Z" || f.LastRefresh != "2024-03-04T12:00:00Z" {
+		t.Errorf("freshness = %+v, want the latest received_at and the last load", f)
+	}
+	if f, _ := s.GetFreshness(context.Background(), "other.com"); f.DataAsOf != "2024-03-03T12:00:00Z" {
+		t.Errorf("other.com freshness = %+v", f)
+	}
+	if f, _ := s.GetFreshness(context.Background(), "unknown.com"); f.DataAsOf != "" {
+		t.Errorf("unknown.com freshness = %+v, want no data_as_of", f)
+	}
+}
+
+func TestWatermarks_ObserveFlush(t *testing.T) {
+	var w watermarks
+	w.recordMarks(map[string]time.Time{"example.com": time.Now().Add(-time.Hour)})
+	load := StoreStatus{
+		LastRefresh: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+		NextRefresh: time.Now().Add(4 * time.Minute).UTC().Format(time.RFC3339),
+	}
+	if f := w.freshness([]string{"example.com"}, load); f.LastRefresh != load.LastRefresh || f.NextRefresh != load.NextRefresh {
+		t.Errorf("freshness = %+v, want the load's refresh times before any flush", f)
+	}
+
+	received := time.Now().Add(-5 * time.Second).UTC().Truncate(time.Second)
+	w.ObserveFlush([]json.RawMessage{
+		json.RawMessage(`{"domain":"example.com","received_at":"` + received.Format(time.RFC3339) + `"}`),
+		json.RawMessage(`{"domain":"new.com"}`),
+		json.RawMessage(`not json`),
+	}, time.Second)
+
+	f := w.freshness([]string{"example.com"}, load)
+	if f.DataAsOf != received.Format(time.RFC3339) {
+		t.Errorf("data_as_of = %s, want the flushed event's received_at %s", f.DataAsOf, received.Format(time.RFC3339))
+	}
+	last, err := time.Parse(time.RFC3339, f.LastRefresh)
+	if err != nil || last.Before(received) {
+		t.Errorf("last_refresh = %s, want the flush", f.LastRefresh)
+	}
+	if next, err := time.Parse(time.RFC3339, f.NextRefresh); err != nil || next.Sub(last) > 2*time.Second {
+		t.Errorf("next_refresh = %s, want the next flush", f.NextRefresh)
+	}
+	if f := w.freshness([]string{"new.com"}, load); f.DataAsOf == "" {
+		t.Error("an event without received_at counts as received at the flush")
+	}
+
+	// A flush of older events doesn't lower the watermark
+	w.ObserveFlush([]json.RawMessage{json.RawMessage(`{"domain":"example.com","received_at":"2020-01-01T00:00:00Z"}`)}, time.Second)
+	if f := w.freshness([]string{"example.com"}, load); f.DataAsOf != received.Format(time.RFC3339) {
+		t.Errorf("data_as_of = %s after an older flush", f.DataAsOf)
+	}
+}
+
+// freshStore reports fixed freshness
+type freshStore struct {
+	emptyStore
+}
+
+func (freshStore) GetFreshness(ctx context.Context, domain string) (Freshness, error) {
+	return Freshness{Domain: domain, DataAsOf: "2024-03-04T11:58:00Z", LastRefresh: "2024-03-04T12:00:00Z", NextRefresh: "2024-03-04T12:05:00Z"}, nil
+}
+
+func TestHandleFreshness(t *testing.T) {
+	h := NewHandler(freshStore{})
+	w := httptest.NewRecorder()
+	h.HandleFreshness(w, httptest.NewRequest("GET", "/api/stats/freshness?domain=example.com", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var f Freshness
+	if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f != (Freshness{Domain: "example.com", DataAsOf: "2024-03-04T11:58:00Z", LastRefresh: "2024-03-04T12:00:00Z", NextRefresh: "2024-03-04T12:05:00Z"}) {
+		t.Errorf("freshness = %+v", f)
+	}
+
+	w = httptest.NewRecorder()
+	h.HandleFreshness(w, httptest.NewRequest("GET", "/api/stats/freshness", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("without domain = %d, want 400", w.Code)
+	}
+}
+
+func TestHandleOverview_DataAsOf(t *testing.T) {
+	h := NewHandler(freshStore{})
+	w := httptest.NewRecorder()
+	h.HandleOverview(w, httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period=7d", nil))
+	var body struct {
+		DataAsOf string `json:"data_as_of"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if body.DataAsOf != "2024-03-04T11:58:00Z" {
+		t.Errorf("data_as_of = %q", body.DataAsOf)
+	}
+}
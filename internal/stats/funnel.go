@@ -0,0 +1,298 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// maxFunnelEvents caps rows loaded for Go-side funnel evaluation
+const maxFunnelEvents = 1_000_000
+
+// Event is a single row loaded for Go-side funnel evaluation
+type Event struct {
+	VisitorID string
+	Name      string
+	Pathname  string
+	Props     string
+	Timestamp time.Time
+}
+
+// FunnelCohort says which visitors a funnel counts
+type FunnelCohort string
+
+const (
+	// CohortAny counts the steps visitors completed during the range; the
+	// simple funnel counts each step's visitors on their own
+	CohortAny FunnelCohort = "any"
+	// CohortEntry counts the visitors who completed the first step during the
+	// range, in order, with later steps up to the window after their entry
+	// even when that ends past the range
+	CohortEntry FunnelCohort = "entry"
+)
+
+// ParseFunnelCohort parses the cohort param, def when it is empty
+func ParseFunnelCohort(v string, def FunnelCohort) (FunnelCohort, error) {
+	switch c := FunnelCohort(v); c {
+	case "":
+		return def, nil
+	case CohortAny, CohortEntry:
+		return c, nil
+	}
+	return "", fmt.Errorf("cohort must be %q or %q", CohortAny, CohortEntry)
+}
+
+type funnelCohortKey struct{}
+
+// WithFunnelCohort sets the cohort funnel reads count; without it they count CohortAny
+func WithFunnelCohort(ctx context.Context, c FunnelCohort) context.Context {
+	return context.WithValue(ctx, funnelCohortKey{}, c)
+}
+
+func funnelCohortFromContext(ctx context.Context) FunnelCohort {
+	if c, ok := ctx.Value(funnelCohortKey{}).(FunnelCohort); ok {
+		return c
+	}
+	return CohortAny
+}
+
+// funnelScan returns until when an advanced funnel of the range ending at to
+// reads events, and before when its visitors must enter, zero for any time
+func funnelScan(ctx context.Context, to time.Time, windowMinutes int) (scanTo, entryEnd time.Time) {
+	if funnelCohortFromContext(ctx) != CohortEntry {
+		return to, time.Time{}
+	}
+	return to.Add(time.Duration(windowMinutes) * time.Minute), to
+}
+
+// duckdbFunnelPath normalizes a pathname expression like funnel.NormalizePath
+func duckdbFunnelPath(expr string) string {
+	return fmt.Sprintf(`lower(regexp_replace(regexp_replace(regexp_replace(regexp_replace(%s, '^[a-zA-Z][a-zA-Z0-9+.-]*://[^/]*', ''), '[?#].*$', ''), '/+', '/', 'g'), '(.)/$', '\1'))`, expr)
+}
+
+// clickhouseFunnelPath normalizes a pathname expression like funnel.NormalizePath
+func clickhouseFunnelPath(expr string) string {
+	return fmt.Sprintf(`lowerUTF8(replaceRegexpOne(replaceRegexpAll(replaceRegexpOne(replaceRegexpOne(%s, '^[a-zA-Z][a-zA-Z0-9+.-]*://[^/]*', ''), '[?#].*$', ''), '/+', '/'), '(.)/$', '\\1'))`, expr)
+}
+
+// postgresFunnelPath is duckdbFunnelPath, whose functions Postgres has too
+func postgresFunnelPath(expr string) string {
+	return duckdbFunnelPath(expr)
+}
+
+// matchesStepDef reports whether an event satisfies a funnel step
+func matchesStepDef(e Event, step funnel.Step) bool {
+	switch step.Type {
+	case "pageview":
+		return e.Name == "pageview" && aggregate.MatchesStep(e.Pathname, step.Value)
+	case "event":
+		if e.Name != step.Value {
+			return false
+		}
+		return aggregate.MatchesPropText(aggregate.ExtractJSONField(e.Props, "text"), step.Text) &&
+			aggregate.MatchesPropText(aggregate.ExtractJSONField(e.Props, "tag"), step.Tag) &&
+			aggregate.MatchesPropText(aggregate.ExtractJSONField(e.Props, "href"), step.Href)
+	}
+	return false
+}
+
+// funnelEventNames returns the event names worth loading for steps
+func funnelEventNames(steps []funnel.Step) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, step := range steps {
+		name := step.Value
+		if step.Type == "pageview" {
+			name = "pageview"
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pathCount is the events of one name and normalized pathname
+type pathCount struct {
+	Name     string
+	Pathname string
+	Count    int64
+}
+
+// sumStepMatches counts the events of counts matching each step. Event steps
+// match on the name alone, as counts carry no props.
+func sumStepMatches(counts []pathCount, steps []funnel.Step) []int64 {
+	matches := make([]int64, len(steps))
+	for _, c := range counts {
+		for i, step := range steps {
+			if step.Type == "event" && c.Name == step.Value ||
+				step.Type == "pageview" && c.Name == "pageview" && aggregate.MatchesStep(c.Pathname, step.Value) {
+				matches[i] += c.Count
+			}
+		}
+	}
+	return matches
+}
+
+// funnelPlan is a funnel's counted steps with, for each, the exclusions that
+// invalidate a conversion from it to the next
+type funnelPlan struct {
+	steps      []funnel.Step
+	exclusions [][]funnel.Step
+}
+
+func newFunnelPlan(steps []funnel.Step) funnelPlan {
+	var p funnelPlan
+	for _, step := range steps {
+		if !step.Exclude {
+			p.steps = append(p.steps, step)
+			p.exclusions = append(p.exclusions, nil)
+		} else if n := len(p.steps); n > 0 {
+			p.exclusions[n-1] = append(p.exclusions[n-1], step)
+		}
+	}
+	return p
+}
+
+// excluded reports whether e invalidates the conversion from step i to step i+1
+func (p funnelPlan) excluded(e Event, i int) bool {
+	for _, step := range p.exclusions[i] {
+		if matchesStepDef(e, step) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateFunnel counts visitors reaching each step in order, with every step
+// completed within window of the visitor's first step and no exclusion matched
+// between two steps. Counts cover the steps that aren't exclusions. Events
+// must be grouped by visitor and sorted by time within each visitor. First
+// steps at or after a non-zero entryEnd don't enter the funnel.
+func evaluateFunnel(events []Event, steps []funnel.Step, window time.Duration, entryEnd time.Time) []int64 {
+	plan := newFunnelPlan(steps)
+	counts := make([]int64, len(plan.steps))
+	if len(plan.steps) == 0 {
+		return counts
+	}
+
+	for start := 0; start < len(events); {
+		end := start
+		for end < len(events) && events[end].VisitorID == events[start].VisitorID {
+			end++
+		}
+
+		depth := funnelDepth(events[start:end], plan, window, entryEnd)
+		for i := 0; i < depth; i++ {
+			counts[i]++
+		}
+		start = end
+	}
+	return counts
+}
+
+// funnelDepth returns how many steps one visitor completed, trying every entry
+// point before a non-zero entryEnd
+func funnelDepth(events []Event, plan funnelPlan, window time.Duration, entryEnd time.Time) int {
+	steps := plan.steps
+	best := 0
+	for i, e := range events {
+		if !entryEnd.IsZero() && !e.Timestamp.Before(entryEnd) {
+			break
+		}
+		if !matchesStepDef(e, steps[0]) {
+			continue
+		}
+		depth := 1
+		deadline := e.Timestamp.Add(window)
+		for _, next := range events[i+1:] {
+			if depth == len(steps) || next.Timestamp.After(deadline) {
+				break
+			}
+			if matchesStepDef(next, steps[depth]) {
+				depth++
+			} else if plan.excluded(next, depth-1) {
+				break
+			}
+		}
+		if depth > best {
+			best = depth
+		}
+		if best == len(steps) {
+			break
+		}
+	}
+	return best
+}
+
+// newFunnelResult builds a FunnelResult with percentages relative to the first
+// step; exclusions in steps get no entry
+func newFunnelResult(steps []funnel.Step, counts []int64) *FunnelResult {
+	steps = funnel.Included(steps)
+	result := &FunnelResult{Steps: make([]FunnelStep, len(steps))}
+	for i, step := range steps {
+		name := step.Value
+		if step.Type == "event" {
+			name = "event:" + step.Value
+		}
+		result.Steps[i] = FunnelStep{Name: name, Count: counts[i]}
+	}
+	if len(steps) == 0 {
+		return result
+	}
+
+	result.TotalStart = counts[0]
+	result.TotalFinish = counts[len(counts)-1]
+	if result.TotalStart > 0 {
+		for i := range result.Steps {
+			result.Steps[i].Percent = float64(result.Steps[i].Count) / float64(result.TotalStart) * 100
+		}
+		result.Conversion = float64(result.TotalFinish) / float64(result.TotalStart) * 100
+	}
+	return result
+}
+
+// ParseFunnelSteps parses the GET funnel `steps` grammar: comma-separated steps,
+// each a pathname (optionally with a trailing *) or `event:<name>`. Pathnames
+// are normalized with funnel.NormalizePattern, as in saved funnels.
+func ParseFunnelSteps(param string) ([]funnel.Step, error) {
+	var steps []funnel.Step
+	for _, raw := range splitSteps(param) {
+		s := strings.TrimSpace(raw)
+		if s == "" {
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(s, "event:"); ok {
+			if name == "" {
+				return nil, fmt.Errorf("step %q: event name required after event:", s)
+			}
+			steps = append(steps, funnel.Step{Type: "event", Value: name})
+			continue
+		}
+
+		// Pathnames may contain colons; anything else with a prefix is a typo
+		if prefix, _, ok := strings.Cut(s, ":"); ok && !strings.HasPrefix(s, "/") {
+			return nil, fmt.Errorf("step %q: unknown prefix %q, use a /path or event:<name>", s, prefix+":")
+		}
+		steps = append(steps, funnel.Step{Type: "pageview", Value: funnel.NormalizePattern(s)})
+	}
+	return steps, nil
+}
+
+// hasEventSteps reports whether any step needs event matching
+func hasEventSteps(steps []funnel.Step) bool {
+	for _, step := range steps {
+		if step.Type == "event" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,410 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
+)
+
+func TestParseFunnelSteps(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		want    []funnel.Step
+		wantErr bool
+	}{
+		{
+			name:  "paths only",
+			param: "/,/dashboard/",
+			want:  []funnel.Step{{Type: "pageview", Value: "/"}, {Type: "pageview", Value: "/dashboard"}},
+		},
+		{
+			name:  "mixed",
+			param: "/,event:signup_click,/welcome",
+			want: []funnel.Step{
+				{Type: "pageview", Value: "/"},
+				{Type: "event", Value: "signup_click"},
+				{Type: "pageview", Value: "/welcome"},
+			},
+		},
+		{
+			name:  "colon inside pathname",
+			param: "/docs/a:b,/pricing",
+			want:  []funnel.Step{{Type: "pageview", Value: "/docs/a:b"}, {Type: "pageview", Value: "/pricing"}},
+		},
+		{
+			name:  "blank steps skipped",
+			param: "/, ,/x",
+			want:  []funnel.Step{{Type: "pageview", Value: "/"}, {Type: "pageview", Value: "/x"}},
+		},
+		{name: "unknown prefix", param: "/,evnt:signup", wantErr: true},
+		{name: "empty event name", param: "/,event:", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFunnelSteps(tt.param)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFunnelSteps(%q) error = %v, wantErr %v", tt.param, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseFunnelSteps(%q) = %+v, want %+v", tt.param, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("step %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateFunnel(t *testing.T) {
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+
+	steps := []funnel.Step{
+		{Type: "pageview", Value: "/"},
+		{Type: "event", Value: "signup_click"},
+		{Type: "pageview", Value: "/welcome"},
+	}
+	events := []Event{
+		// v1 completes in order
+		{VisitorID: "v1", Name: "pageview", Pathname: "/", Timestamp: at(0)},
+		{VisitorID: "v1", Name: "signup_click", Timestamp: at(1)},
+		{VisitorID: "v1", Name: "pageview", Pathname: "/welcome", Timestamp: at(2)},
+		// v2 clicks before landing, so only step 1 counts
+		{VisitorID: "v2", Name: "signup_click", Timestamp: at(0)},
+		{VisitorID: "v2", Name: "pageview", Pathname: "/", Timestamp: at(1)},
+		// v3 finishes outside the window
+		{VisitorID: "v3", Name: "pageview", Pathname: "/", Timestamp: at(0)},
+		{VisitorID: "v3", Name: "signup_click", Timestamp: at(5)},
+		{VisitorID: "v3", Name: "pageview", Pathname: "/welcome", Timestamp: at(90)},
+		// v4 only completes from a later entry
+		{VisitorID: "v4", Name: "pageview", Pathname: "/", Timestamp: at(0)},
+		{VisitorID: "v4", Name: "pageview", Pathname: "/", Timestamp: at(100)},
+		{VisitorID: "v4", Name: "signup_click", Timestamp: at(101)},
+		{VisitorID: "v4", Name: "pageview", Pathname: "/welcome", Timestamp: at(102)},
+	}
+
+	got := evaluateFunnel(events, steps, 60*time.Minute, time.Time{})
+	want := []int64{4, 3, 2}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("counts = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestEvaluateFunnel_Exclusions(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	steps := []funnel.Step{
+		{Type: "pageview", Value: "/pricing"},
+		{Type: "pageview", Value: "/enterprise*", Exclude: true},
+		{Type: "event", Value: "signup"},
+		{Type: "pageview", Value: "/welcome"},
+	}
+	events := []Event{
+		// v1 converts without detours
+		{VisitorID: "v1", Name: "pageview", Pathname: "/pricing", Timestamp: at(0)},
+		{VisitorID: "v1", Name: "signup", Timestamp: at(1)},
+		{VisitorID: "v1", Name: "pageview", Pathname: "/welcome", Timestamp: at(2)},
+		// v2 looks at enterprise plans in between, so only the first step counts
+		{VisitorID: "v2", Name: "pageview", Pathname: "/pricing", Timestamp: at(0)},
+		{VisitorID: "v2", Name: "pageview", Pathname: "/enterprise/sso", Timestamp: at(1)},
+		{VisitorID: "v2", Name: "signup", Timestamp: at(2)},
+		{VisitorID: "v2", Name: "pageview", Pathname: "/welcome", Timestamp: at(3)},
+		// v3 visits enterprise after signing up, which the exclusion doesn't cover
+		{VisitorID: "v3", Name: "pageview", Pathname: "/pricing", Timestamp: at(0)},
+		{VisitorID: "v3", Name: "signup", Timestamp: at(1)},
+		{VisitorID: "v3", Name: "pageview", Pathname: "/enterprise/sso", Timestamp: at(2)},
+		{VisitorID: "v3", Name: "pageview", Pathname: "/welcome", Timestamp: at(3)},
+		// v4 comes back to pricing after the detour and converts from there
+		{VisitorID: "v4", Name: "pageview", Pathname: "/pricing", Timestamp: at(0)},
+		{VisitorID: "v4", Name: "pageview", Pathname: "/enterprise", Timestamp: at(1)},
+		{VisitorID: "v4", Name: "pageview", Pathname: "/pricing", Timestamp: at(2)},
+		{VisitorID: "v4", Name: "signup", Timestamp: at(3)},
+	}
+
+	got := evaluateFunnel(events, steps, 60*time.Minute, time.Time{})
+	if want := []int64{4, 3, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+	result := newFunnelResult(steps, got)
+	if len(result.Steps) != 3 || result.Steps[1].Name != "event:signup" {
+		t.Errorf("result steps = %+v, want the three counted steps", result.Steps)
+	}
+}
+
+// funnelStore records which funnel method the handler used
+type funnelStore struct {
+	fakeStore
+	simple   []string
+	advanced []funnel.Step
+}
+
+func (f *funnelStore) GetFunnel(ctx context.Context, domain string, from, to time.Time, steps []string) (*FunnelResult, error) {
+	f.simple = steps
+	return &FunnelResult{}, nil
+}
+
+func (f *funnelStore) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, windowMinutes int) (*FunnelResult, error) {
+	f.advanced = steps
+	return newFunnelResult(steps, make([]int64, len(steps))), nil
+}
+
+func TestHandleFunnel_Routing(t *testing.T) {
+	store := &funnelStore{}
+	h := NewHandler(store)
+
+	req := httptest.NewRequest("GET", "/api/stats/funnel?domain=example.com&steps=/,/pricing", nil)
+	w := httptest.NewRecorder()
+	h.HandleFunnel(w, req)
+	if w.Code != http.StatusOK || len(store.simple) != 2 || store.advanced != nil {
+		t.Fatalf("paths-only funnel: code %d, simple %v, advanced %v", w.Code, store.simple, store.advanced)
+	}
+
+	req = httptest.NewRequest("GET", "/api/stats/funnel?domain=example.com&steps=/,event%3Asignup_click,/welcome", nil)
+	w = httptest.NewRecorder()
+	h.HandleFunnel(w, req)
+	if w.Code != http.StatusOK || len(store.advanced) != 3 || store.advanced[1].Type != "event" {
+		t.Fatalf("event funnel: code %d, advanced %+v", w.Code, store.advanced)
+	}
+
+	var result FunnelResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Steps[1].Name != "event:signup_click" {
+		t.Errorf("step name = %q, want event:signup_click", result.Steps[1].Name)
+	}
+
+	req = httptest.NewRequest("GET", "/api/stats/funnel?domain=example.com&steps=/,click:signup", nil)
+	w = httptest.NewRecorder()
+	h.HandleFunnel(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown prefix: code = %d, want 400", w.Code)
+	}
+
+	// Entry cohorts need the ordered evaluation even for paths
+	store.simple, store.advanced = nil, nil
+	req = httptest.NewRequest("GET", "/api/stats/funnel?domain=example.com&steps=/,/pricing&cohort=entry", nil)
+	w = httptest.NewRecorder()
+	h.HandleFunnel(w, req)
+	if w.Code != http.StatusOK || store.simple != nil || len(store.advanced) != 2 {
+		t.Fatalf("entry cohort funnel: code %d, simple %v, advanced %v", w.Code, store.simple, store.advanced)
+	}
+
+	req = httptest.NewRequest("GET", "/api/stats/funnel?domain=example.com&steps=/,/pricing&cohort=first", nil)
+	w = httptest.NewRecorder()
+	h.HandleFunnel(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown cohort: code = %d, want 400", w.Code)
+	}
+}
+
+func TestHandleFunnelAdvanced_InvalidBody(t *testing.T) {
+	h := NewHandler(fakeStore{})
+	tests := []struct {
+		body   string
+		status int
+		field  string
+	}{
+		{`{"steps":[{"type":"pageview","value":"/"}],"window":"60"}`, http.StatusBadRequest, "window"},
+		{`{"steps":[{"type":"pageview","value":"/","name":"x"}]}`, http.StatusBadRequest, "name"},
+		{`{"steps":[{"type":"pageview","value":"/"}]}`, http.StatusUnprocessableEntity, "steps"},
+		{`{"steps":[{"type":"pageview","value":"/"},{"type":"event"}]}`, http.StatusUnprocessableEntity, "steps.1.value"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/stats/funnel-advanced?domain=example.com", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.HandleFunnelAdvanced(w, req)
+
+		var body struct {
+			Field  string               `json:"field"`
+			Errors []reqbody.FieldError `json:"errors"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		field := body.Field
+		if len(body.Errors) > 0 {
+			field = body.Errors[0].Field
+		}
+		if w.Code != tt.status || field != tt.field {
+			t.Errorf("%s: status = %d, field = %q, want %d %q", tt.body, w.Code, field, tt.status, tt.field)
+		}
+	}
+}
+
+func TestHandleFunnel_WindowCap(t *testing.T) {
+	h := NewHandler(&funnelStore{})
+	steps := `{"steps":[{"type":"pageview","value":"/"},{"type":"pageview","value":"/pricing"}],"window":%d}`
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		window int
+		status int
+	}{
+		{"window at the cap", http.MethodPost, "period=7d", funnel.MaxWindow, http.StatusOK},
+		{"window over the cap", http.MethodPost, "period=7d", funnel.MaxWindow + 1, http.StatusBadRequest},
+		// An entry cohort reads the window past the range, over the 92 day cap
+		{"entry window past the range cap", http.MethodPost, "period=90d", funnel.MaxWindow, http.StatusBadRequest},
+		{"any cohort reads only the range", http.MethodPost, "period=90d&cohort=any", funnel.MaxWindow, http.StatusOK},
+		{"GET window over the cap", http.MethodGet, "period=7d&steps=/,/pricing", funnel.MaxWindow + 1, http.StatusBadRequest},
+		{"GET entry window past the range cap", http.MethodGet, "period=90d&steps=/,/pricing&cohort=entry", funnel.MaxWindow, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		if tt.method == http.MethodPost {
+			req := httptest.NewRequest(tt.method, "/api/stats/funnel-advanced?domain=example.com&"+tt.query, strings.NewReader(fmt.Sprintf(steps, tt.window)))
+			req.Header.Set("Content-Type", "application/json")
+			h.HandleFunnelAdvanced(w, req)
+		} else {
+			h.HandleFunnel(w, httptest.NewRequest(tt.method, fmt.Sprintf("/api/stats/funnel?domain=example.com&%s&window=%d", tt.query, tt.window), nil))
+		}
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestStore_FunnelNormalizesPaths(t *testing.T) {
+	now := time.Now()
+	s := seedStore(t, now,
+		seedEvent{VisitorID: "v1", Pathname: "/pricing/", Ago: 3 * time.Minute},
+		seedEvent{VisitorID: "v1", Pathname: "/Signup?plan=pro", Ago: 2 * time.Minute},
+		seedEvent{VisitorID: "v2", Pathname: "/pricing?ref=ad#plans", Ago: 3 * time.Minute},
+		seedEvent{VisitorID: "v2", Pathname: "//signup//", Ago: 2 * time.Minute},
+		seedEvent{VisitorID: "v3", Pathname: "/pricing-old", Ago: 3 * time.Minute},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+	from, to := now.Add(-time.Hour), now
+
+	steps, err := ParseFunnelSteps("/pricing,/signup/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{steps[0].Value, steps[1].Value}
+	simple, err := s.GetFunnel(ctx, fixtureDomain, from, to, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if simple.Steps[0].Count != 2 || simple.Steps[1].Count != 2 {
+		t.Errorf("funnel counts = %d, %d, want 2, 2", simple.Steps[0].Count, simple.Steps[1].Count)
+	}
+
+	advanced, err := s.GetFunnelAdvanced(ctx, fixtureDomain, from, to, []funnel.Step{
+		{Type: "pageview", Value: "/Pricing/"},
+		{Type: "pageview", Value: "/signup"},
+	}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if advanced.TotalStart != 2 || advanced.TotalFinish != 2 {
+		t.Errorf("advanced funnel = %d to %d, want 2 to 2", advanced.TotalStart, advanced.TotalFinish)
+	}
+}
+
+func TestStore_GetStepMatchCounts(t *testing.T) {
+	now := time.Now()
+	s := seedStore(t, now,
+		seedEvent{VisitorID: "v1", Pathname: "/pricing/", Ago: 3 * time.Minute},
+		seedEvent{VisitorID: "v2", Pathname: "/Pricing?ref=ad", Ago: 3 * time.Minute},
+		seedEvent{VisitorID: "v1", Pathname: "/blog/launch", Ago: 2 * time.Minute},
+		seedEvent{VisitorID: "v1", Name: "signup", Pathname: "/pricing", Ago: time.Minute},
+		seedEvent{VisitorID: "v3", Pathname: "/checkout", Ago: 48 * time.Hour},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+
+	steps := []funnel.Step{
+		{Type: "pageview", Value: "/pricing"},
+		{Type: "pageview", Value: "/blog/*"},
+		{Type: "pageview", Value: "/checkout"},
+		{Type: "event", Value: "signup", Text: "ignored"},
+		{Type: "pageview", Value: "/blog/"},
+	}
+	counts, err := s.GetStepMatchCounts(ctx, fixtureDomain, now.Add(-time.Hour), now, steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checkout pageview is out of range, and only the wildcard matches below /blog/
+	if want := []int64{2, 1, 0, 1, 0}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts = %v, want %v", counts, want)
+	}
+}
+
+func TestFunnelCohorts(t *testing.T) {
+	now := time.Now().UTC()
+	from, to := now.Add(-3*time.Hour), now.Add(-time.Hour)
+	s := seedStore(t, now,
+		// Enters just before the end and converts after it, within the window
+		seedEvent{VisitorID: "straddles", Pathname: "/pricing", At: to.Add(-10 * time.Minute)},
+		seedEvent{VisitorID: "straddles", Pathname: "/signup", At: to.Add(10 * time.Minute)},
+		// Entered before the range and convert during it
+		seedEvent{VisitorID: "returning", Pathname: "/pricing", At: from.Add(-time.Hour)},
+		seedEvent{VisitorID: "returning", Pathname: "/signup", At: from.Add(time.Hour)},
+		seedEvent{VisitorID: "returning2", Pathname: "/pricing", At: from.Add(-24 * time.Hour)},
+		seedEvent{VisitorID: "returning2", Pathname: "/signup", At: from.Add(10 * time.Minute)},
+		// Converts within the range
+		seedEvent{VisitorID: "inside", Pathname: "/pricing", At: from.Add(time.Minute)},
+		seedEvent{VisitorID: "inside", Pathname: "/signup", At: from.Add(2 * time.Minute)},
+		// Converts past the range and the window
+		seedEvent{VisitorID: "late", Pathname: "/pricing", At: to.Add(-5 * time.Minute)},
+		seedEvent{VisitorID: "late", Pathname: "/signup", At: to.Add(2 * time.Hour)},
+		// First steps after the range don't enter it
+		seedEvent{VisitorID: "after", Pathname: "/pricing", At: to.Add(time.Minute)},
+		seedEvent{VisitorID: "after", Pathname: "/signup", At: to.Add(2 * time.Minute)},
+	)
+	h := NewHandler(s)
+	ctx := WithFilters(context.Background(), Filters{})
+	steps := []funnel.Step{{Type: "pageview", Value: "/pricing"}, {Type: "pageview", Value: "/signup"}}
+
+	for _, tt := range []struct {
+		name          string
+		ctx           context.Context
+		start, finish int64
+	}{
+		// The simple funnel counts each step's visitors, entered or not
+		{"simple", ctx, 3, 3},
+		{"simple entry", WithFunnelCohort(ctx, CohortEntry), 3, 2},
+	} {
+		got, err := h.funnel(tt.ctx, fixtureDomain, from, to, steps, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.TotalStart != tt.start || got.TotalFinish != tt.finish {
+			t.Errorf("%s: %d to %d, want %d to %d", tt.name, got.TotalStart, got.TotalFinish, tt.start, tt.finish)
+		}
+	}
+
+	for _, tt := range []struct {
+		cohort        FunnelCohort
+		start, finish int64
+	}{
+		// Only the visitor converting within the range
+		{CohortAny, 3, 1},
+		// The straddling visitor too
+		{CohortEntry, 3, 2},
+	} {
+		got, err := s.GetFunnelAdvanced(WithFunnelCohort(ctx, tt.cohort), fixtureDomain, from, to, steps, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.TotalStart != tt.start || got.TotalFinish != tt.finish {
+			t.Errorf("%s: %d to %d, want %d to %d", tt.cohort, got.TotalStart, got.TotalFinish, tt.start, tt.finish)
+		}
+	}
+}
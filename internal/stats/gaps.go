@@ -0,0 +1,159 @@
+package stats
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dataGapWindow is how far back hourly event counts are recorded after each load
+const dataGapWindow = 48 * time.Hour
+
+// GapThresholds tune when an hour of loaded data counts as a gap
+type GapThresholds struct {
+	// Ratio flags hours with fewer events than this share of the trailing average
+	Ratio float64
+	// TrailingHours is how many preceding hours the average covers
+	TrailingHours int
+	// MinAverage skips hours whose trailing average is lower, as quiet sites
+	// have empty hours anyway
+	MinAverage float64
+}
+
+// DefaultGapThresholds apply to the zero fields of configured thresholds
+var DefaultGapThresholds = GapThresholds{Ratio: 0.1, TrailingHours: 6, MinAverage: 10}
+
+func (t GapThresholds) withDefaults() GapThresholds {
+	if t.Ratio <= 0 {
+		t.Ratio = DefaultGapThresholds.Ratio
+	}
+	if t.TrailingHours <= 0 {
+		t.TrailingHours = DefaultGapThresholds.TrailingHours
+	}
+	if t.MinAverage <= 0 {
+		t.MinAverage = DefaultGapThresholds.MinAverage
+	}
+	return t
+}
+
+// DataGap is an hour whose events look missing from the loaded data, most
+// likely parquet files the pipeline didn't deliver
+type DataGap struct {
+	Hour  time.Time `json:"hour"`
+	Count int64     `json:"count"`
+	// Expected is the trailing average the count fell short of
+	Expected float64 `json:"expected"`
+}
+
+// hourlyCounts holds each domain's event counts per hour of the last
+// dataGapWindow, recorded from the local table after every load. Both stores
+// embed it, so GetDataGaps never queries.
+type hourlyCounts struct {
+	hoursMu       sync.RWMutex
+	hours         map[string]map[time.Time]int64
+	hoursSince    time.Time
+	hoursUntil    time.Time
+	gapThresholds GapThresholds
+}
+
+// recordHours replaces the counts, which cover the hours of [since, until)
+func (c *hourlyCounts) recordHours(hours map[string]map[time.Time]int64, since, until time.Time) {
+	c.hoursMu.Lock()
+	c.hours, c.hoursSince, c.hoursUntil = hours, since, until
+	c.hoursMu.Unlock()
+}
+
+// GetDataGaps returns the hours of [from, to) where the recorded counts of
+// domain and its aliases drop out: no events between hours that have some,
+// or fewer than the thresholds' share of the trailing average. Only the last dataGapWindow is
+// recorded, and hours after the latest one with events are never gaps, as
+// their files may just not have arrived yet.
+func (c *hourlyCounts) GetDataGaps(ctx context.Context, domain string, from, to time.Time) ([]DataGap, error) {
+	c.hoursMu.RLock()
+	counts, since, until := c.hours[domain], c.hoursSince, c.hoursUntil
+	if aliases := domainAliasesFromContext(ctx); len(aliases) > 0 {
+		merged := make(map[time.Time]int64, len(counts))
+		for _, d := range queryDomains(ctx, domain) {
+			for hour, n := range c.hours[d] {
+				merged[hour] += n
+			}
+		}
+		counts = merged
+	}
+	c.hoursMu.RUnlock()
+	return detectGaps(counts, since, until, from, to, c.gapThresholds.withDefaults()), nil
+}
+
+// detectGaps finds the gaps of counts, recorded for [since, until), in [from, to)
+func detectGaps(counts map[time.Time]int64, since, until, from, to time.Time, t GapThresholds) []DataGap {
+	var last time.Time
+	for hour, n := range counts {
+		if n > 0 && hour.After(last) && hour.Before(until) {
+			last = hour
+		}
+	}
+
+	gaps := []DataGap{}
+	for hour := since; hour.Before(last); hour = hour.Add(time.Hour) {
+		if !hour.Add(time.Hour).After(from) || !hour.Before(to) {
+			continue
+		}
+		var sum int64
+		n := 0
+		for prev := hour.Add(-time.Hour); n < t.TrailingHours && !prev.Before(since); prev = prev.Add(-time.Hour) {
+			sum += counts[prev]
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		avg := float64(sum) / float64(n)
+		if avg < t.MinAverage {
+			continue
+		}
+		count := counts[hour]
+		isolated := count == 0 && counts[hour.Add(-time.Hour)] > 0 && counts[hour.Add(time.Hour)] > 0
+		if isolated || float64(count) < t.Ratio*avg {
+			gaps = append(gaps, DataGap{Hour: hour, Count: count, Expected: avg})
+		}
+	}
+	return gaps
+}
+
+// gapBuckets returns the labels of the points that contain a gap, in order
+func gapBuckets(gaps []DataGap, points []TimeSeriesPoint, interval string, loc *time.Location) []string {
+	labels := make(map[string]bool, len(points))
+	for _, p := range points {
+		labels[p.Time] = true
+	}
+	flagged := map[string]bool{}
+	for _, g := range gaps {
+		local := g.Hour.In(loc)
+		var label string
+		switch interval {
+		case "hour":
+			label = local.Add(-time.Duration(local.Minute()) * time.Minute).Format("2006-01-02T15:00")
+		case "day":
+			label = local.Format("2006-01-02")
+		default:
+			// Weeks are labelled by their first day; the gap is in the last one before it
+			day := local.Format("2006-01-02")
+			for _, p := range points {
+				if p.Time <= day {
+					label = p.Time
+				}
+			}
+		}
+		if labels[label] {
+			flagged[label] = true
+		}
+	}
+
+	result := make([]string, 0, len(flagged))
+	for label := range flagged {
+		result = append(result, label)
+	}
+	sort.Strings(result)
+	return result
+}
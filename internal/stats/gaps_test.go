@@ -0,0 +1,141 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDetectGaps(t *testing.T) {
+	since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(24 * time.Hour)
+	counts := map[time.Time]int64{}
+	for h := 0; h < 20; h++ {
+		counts[since.Add(time.Duration(h)*time.Hour)] = 100
+	}
+	counts[since.Add(8*time.Hour)] = 0  // dropped out
+	counts[since.Add(12*time.Hour)] = 5 // below 10% of the average
+	counts[since.Add(15*time.Hour)] = 40
+	hour := func(h int) time.Time { return since.Add(time.Duration(h) * time.Hour) }
+
+	gaps := detectGaps(counts, since, until, since, until, DefaultGapThresholds)
+	var got []time.Time
+	for _, g := range gaps {
+		got = append(got, g.Hour)
+	}
+	if want := []time.Time{hour(8), hour(12)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gaps at %v, want %v", got, want)
+	}
+	if gaps[0].Count != 0 || gaps[0].Expected != 100 {
+		t.Errorf("first gap = %+v", gaps[0])
+	}
+
+	// Only gaps in range are reported
+	if gaps := detectGaps(counts, since, until, hour(10), hour(20), DefaultGapThresholds); len(gaps) != 1 || !gaps[0].Hour.Equal(hour(12)) {
+		t.Errorf("gaps from 10:00 = %+v", gaps)
+	}
+
+	// Hours 20 to 23 have no events yet; they may still arrive
+	for _, g := range gaps {
+		if !g.Hour.Before(hour(20)) {
+			t.Errorf("trailing hour %v flagged", g.Hour)
+		}
+	}
+
+	// Empty hours of quiet sites are normal
+	quiet := map[time.Time]int64{hour(0): 2, hour(1): 3, hour(3): 2}
+	if gaps := detectGaps(quiet, since, until, since, until, DefaultGapThresholds); len(gaps) != 0 {
+		t.Errorf("quiet site gaps = %+v", gaps)
+	}
+	if gaps := detectGaps(quiet, since, until, since, until, GapThresholds{Ratio: 0.1, TrailingHours: 2, MinAverage: 1}); len(gaps) != 1 || !gaps[0].Hour.Equal(hour(2)) {
+		t.Errorf("quiet site gaps with a lower minimum = %+v", gaps)
+	}
+}
+
+func TestStore_GetDataGaps(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Hour)
+	var events []seedEvent
+	for ago := 8; ago >= 1; ago-- {
+		if ago == 3 {
+			continue
+		}
+		for i := 0; i < 6; i++ {
+			events = append(events, seedEvent{VisitorID: "v", At: now.Add(time.Duration(-ago)*time.Hour + 10*time.Minute)})
+		}
+	}
+	s := seedStore(t, now, events...)
+	s.gapThresholds = GapThresholds{MinAverage: 1}
+
+	if err := s.recordHourlyCounts(); err != nil {
+		t.Fatal(err)
+	}
+	gaps, err := s.GetDataGaps(context.Background(), fixtureDomain, now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 1 || !gaps[0].Hour.Equal(now.Add(-3*time.Hour)) {
+		t.Errorf("gaps = %+v, want the hour 3 hours ago", gaps)
+	}
+	if gaps, _ := s.GetDataGaps(context.Background(), "other.com", now.Add(-24*time.Hour), now); len(gaps) != 0 {
+		t.Errorf("other.com gaps = %+v", gaps)
+	}
+}
+
+func TestGapBuckets(t *testing.T) {
+	gaps := []DataGap{{Hour: time.Date(2024, 3, 4, 3, 0, 0, 0, time.UTC)}, {Hour: time.Date(2024, 3, 4, 5, 0, 0, 0, time.UTC)}}
+	minus5 := time.FixedZone("UTC-5", -5*60*60)
+	for _, tt := range []struct {
+		interval string
+		loc      *time.Location
+		points   []string
+		want     []string
+	}{
+		{"hour", time.UTC, []string{"2024-03-04T03:00", "2024-03-04T04:00", "2024-03-04T05:00"}, []string{"2024-03-04T03:00", "2024-03-04T05:00"}},
+		{"hour", minus5, []string{"2024-03-03T22:00", "2024-03-03T23:00"}, []string{"2024-03-03T22:00"}},
+		{"day", minus5, []string{"2024-03-03", "2024-03-04"}, []string{"2024-03-03", "2024-03-04"}},
+		{"week", time.UTC, []string{"2024-02-26", "2024-03-04"}, []string{"2024-03-04"}},
+		{"day", time.UTC, []string{"2024-03-05"}, []string{}},
+	} {
+		var points []TimeSeriesPoint
+		for _, p := range tt.points {
+			points = append(points, TimeSeriesPoint{Time: p})
+		}
+		if got := gapBuckets(gaps, points, tt.interval, tt.loc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s in %s: %v, want %v", tt.interval, tt.loc, got, tt.want)
+		}
+	}
+}
+
+// gapStore reports one data gap, three hours ago
+type gapStore struct {
+	emptyStore
+}
+
+func (gapStore) GetDataGaps(ctx context.Context, domain string, from, to time.Time) ([]DataGap, error) {
+	return []DataGap{{Hour: time.Now().UTC().Truncate(time.Hour).Add(-3 * time.Hour)}}, nil
+}
+
+func TestHandlePageviews_Gaps(t *testing.T) {
+	h := NewHandler(gapStore{})
+	gapHour := time.Now().UTC().Truncate(time.Hour).Add(-3 * time.Hour)
+	for query, want := range map[string]string{
+		"period=7d":               gapHour.Format("2006-01-02T15:00"),
+		"period=30d":              gapHour.Format("2006-01-02"),
+		"period=7d&hour_offset=2": gapHour.Add(2 * time.Hour).Format("2006-01-02T15:00"),
+	} {
+		w := httptest.NewRecorder()
+		h.HandlePageviews(w, httptest.NewRequest("GET", "/api/stats/pageviews?domain=example.com&"+query, nil))
+		var body struct {
+			Gaps []string `json:"gaps"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v: %s", query, err, w.Body)
+		}
+		if len(body.Gaps) != 1 || body.Gaps[0] != want {
+			t.Errorf("%s: gaps = %v, want [%s]", query, body.Gaps, want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GeoItem is one area of the visitor map: a country or subdivision by ISO code,
+// or a city by name
+type GeoItem struct {
+	Code     string `json:"code,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Count    int64  `json:"count"`
+	Visitors int64  `json:"visitors"`
+	// Continent is the GeoNames continent code of countries
+	Continent string `json:"continent,omitempty"`
+}
+
+// Drill-down levels of a country on the map, and the levels of HandleGeo
+const (
+	GeoLevelRegion    = "region"
+	GeoLevelCity      = "city"
+	GeoLevelCountry   = "country"
+	GeoLevelContinent = "continent"
+)
+
+// GeoDrillDown is the breakdown of one country. Supported is false when no
+// subdivision data was recorded, in which case Items lists cities instead.
+type GeoDrillDown struct {
+	Country   string    `json:"country"`
+	Supported bool      `json:"supported"`
+	Level     string    `json:"level"`
+	Items     []GeoItem `json:"items"`
+}
+
+// Placeholder codes some geolocation providers use for unknown countries
+var unknownCountryCodes = map[string]bool{"XX": true, "ZZ": true}
+
+// countryCode normalizes a country value to an ISO 3166-1 alpha-2 code, or ""
+func countryCode(value string) string {
+	code := strings.ToUpper(strings.TrimSpace(value))
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' || unknownCountryCodes[code] {
+		return ""
+	}
+	return code
+}
+
+// The country column as the map groups it; countryCode drops what isn't a code
+const (
+	duckdbCountryCodeExpr     = `upper(trim(COALESCE(country, '')))`
+	clickhouseCountryCodeExpr = `upper(trimBoth(ifNull(country, '')))`
+	postgresCountryCodeExpr   = `upper(trim(COALESCE(country, '')))`
+)
+
+// duckdbRegionExpr is the ISO 3166-2 code of the region prop in DuckDB. Trackers
+// send either the full code ("US-CA") or the subdivision part ("CA"), which is
+// prefixed with country.
+func duckdbRegionExpr(country string) string {
+	return regionCodeExpr(`upper(trim(COALESCE(CASE WHEN json_valid(props) THEN json_extract_string(props, '$.region') END, '')))`, duckdbQuote(country+"-"))
+}
+
+// clickhouseRegionExpr is duckdbRegionExpr for ClickHouse
+func clickhouseRegionExpr(country string) string {
+	return regionCodeExpr(`upper(trimBoth(JSONExtractString(ifNull(props, ''), 'region')))`, clickhouseQuote(country+"-"))
+}
+
+// postgresRegionExpr is duckdbRegionExpr for Postgres
+func postgresRegionExpr(country string) string {
+	return regionCodeExpr(`upper(trim(COALESCE(props->>'region', '')))`, postgresQuote(country+"-"))
+}
+
+func regionCodeExpr(region, prefix string) string {
+	return fmt.Sprintf(`CASE WHEN %[1]s = '' THEN '' WHEN position('-' IN %[1]s) > 0 THEN %[1]s ELSE concat(%[2]s, %[1]s) END`, region, prefix)
+}
+
+// mapCountries keeps the items with a country code, merging values that
+// normalize to the same one
+func mapCountries(items []GeoItem) []GeoItem {
+	result := make([]GeoItem, 0, len(items))
+	index := make(map[string]int, len(items))
+	for _, item := range items {
+		code := countryCode(item.Code)
+		if code == "" {
+			continue
+		}
+		if i, ok := index[code]; ok {
+			// Visitors can't be deduplicated across rows; the sum is an upper bound
+			result[i].Count += item.Count
+			result[i].Visitors += item.Visitors
+			continue
+		}
+		index[code] = len(result)
+		item.Code = code
+		result = append(result, item)
+	}
+	return result
+}
+
+// countryRegions keeps the regions that belong to country, dropping codes
+// recorded under another country
+func countryRegions(country string, items []GeoItem) []GeoItem {
+	result := make([]GeoItem, 0, len(items))
+	for _, item := range items {
+		if strings.HasPrefix(item.Code, country+"-") && len(item.Code) > len(country)+1 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// geoNames moves the grouped values of city items from Code to Name
+func geoNames(items []GeoItem) []GeoItem {
+	for i := range items {
+		items[i].Name, items[i].Code = items[i].Code, ""
+	}
+	return items
+}
+
+// HandleGeoMap returns pageviews and visitors per country code for the world
+// map. With country=XX it returns that country's breakdown instead: regions
+// when the tracker recorded them, cities with supported=false otherwise.
+func (h *Handler) HandleGeoMap(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	country := ""
+	if v := r.URL.Query().Get("country"); v != "" {
+		if country = countryCode(v); country == "" {
+			writeError(w, errors.New("country must be an ISO 3166-1 alpha-2 code"), http.StatusBadRequest)
+			return
+		}
+		// The drill-down country matches case-insensitively in the store; it
+		// must not also apply as the exact-match country filter
+		q := r.URL.Query()
+		q.Del("country")
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = q.Encode()
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	limit := parseLimit(r, 50)
+
+	cacheKey := fmt.Sprintf("geo-map:%s:%s:%s:%d:%s", domain, r.URL.Query().Get("period"), country, limit, filterKey)
+	if country == "" {
+		var data []GeoItem
+		if h.cacheGet(r.Context(), cacheKey, &data) {
+			writeJSON(w, data)
+			return
+		}
+		data, err := h.store.GetCountryMap(ctx, domain, from, to)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		data = countryContinents(mapCountries(data))
+		h.cacheSet(ctx, cacheKey, data)
+		writeJSON(w, data)
+		return
+	}
+
+	var data GeoDrillDown
+	if h.cacheGet(r.Context(), cacheKey, &data) {
+		writeJSON(w, data)
+		return
+	}
+	regions, err := h.store.GetTopRegions(ctx, domain, country, from, to, limit)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	data = GeoDrillDown{Country: country, Supported: true, Level: GeoLevelRegion, Items: countryRegions(country, regions)}
+	if len(data.Items) == 0 {
+		cities, err := h.store.GetTopCities(ctx, domain, country, from, to, limit)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		data = GeoDrillDown{Country: country, Level: GeoLevelCity, Items: emptyIfNil(cities)}
+	}
+	h.cacheSet(ctx, cacheKey, data)
+	writeJSON(w, data)
+}
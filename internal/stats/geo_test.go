@@ -0,0 +1,134 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newGeoStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, v AS visitor_id, name, '' AS url, '/' AS pathname,
+			'' AS referrer, country, city, '' AS browser, '' AS os, '' AS device, props,
+			CURRENT_TIMESTAMP::TIMESTAMP - INTERVAL 1 HOUR AS timestamp
+		FROM (VALUES
+			('v1', 'pageview', 'US', 'San Jose', '{"region":"US-CA"}'),
+			('v1', 'pageview', 'us', 'San Jose', '{"region":"ca"}'),
+			('v2', 'pageview', ' US', 'Austin', '{"region":"TX"}'),
+			('v3', 'pageview', 'US', 'Austin', '{"region":"MX-JAL"}'),
+			('v4', 'click', 'US', 'Austin', '{"region":"NY"}'),
+			('v5', 'pageview', 'DE', 'Berlin', '{}'),
+			('v6', 'pageview', 'DE', 'Munich', ''),
+			('v7', 'pageview', 'XX', '', ''),
+			('v8', 'pageview', '', '', '')
+		) t(v, name, country, city, props)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+}
+
+func TestStore_GeoMap(t *testing.T) {
+	s := newGeoStore(t)
+	ctx := WithFilters(context.Background(), Filters{})
+	from, to := time.Now().Add(-24*time.Hour), time.Now().Add(time.Hour)
+
+	countries, err := s.GetCountryMap(ctx, "example.com", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GeoItem{{Code: "US", Count: 4, Visitors: 3}, {Code: "DE", Count: 2, Visitors: 2}}
+	if got := mapCountries(countries); !reflect.DeepEqual(got, want) {
+		t.Errorf("countries = %+v, want %+v", got, want)
+	}
+
+	regions, err := s.GetTopRegions(ctx, "example.com", "US", from, to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both spellings of California merge; the Mexican state recorded under US is dropped
+	want = []GeoItem{{Code: "US-CA", Count: 2, Visitors: 1}, {Code: "US-TX", Count: 1, Visitors: 1}}
+	if got := countryRegions("US", regions); !reflect.DeepEqual(got, want) {
+		t.Errorf("regions = %+v, want %+v", got, want)
+	}
+
+	regions, err = s.GetTopRegions(ctx, "example.com", "DE", from, to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regions) != 0 {
+		t.Errorf("DE regions = %+v, want none", regions)
+	}
+	cities, err := s.GetTopCities(ctx, "example.com", "DE", from, to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []GeoItem{{Name: "Berlin", Count: 1, Visitors: 1}, {Name: "Munich", Count: 1, Visitors: 1}}
+	if !reflect.DeepEqual(cities, want) {
+		t.Errorf("DE cities = %+v, want %+v", cities, want)
+	}
+}
+
+func TestHandleGeoMap(t *testing.T) {
+	h := NewHandler(newGeoStore(t))
+	get := func(url string, dest any) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.HandleGeoMap(w, httptest.NewRequest("GET", url, nil))
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), dest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	const base = "/api/stats/geo/map?domain=example.com&period=7d"
+
+	var countries []GeoItem
+	if code := get(base, &countries); code != http.StatusOK || len(countries) != 2 || countries[0].Code != "US" || countries[0].Continent != "NA" {
+		t.Errorf("map: status %d, %+v", code, countries)
+	}
+
+	var us GeoDrillDown
+	if code := get(base+"&country=us", &us); code != http.StatusOK || !us.Supported || us.Level != GeoLevelRegion || len(us.Items) != 2 {
+		t.Errorf("US: status %d, %+v", code, us)
+	}
+
+	var de GeoDrillDown
+	if code := get(base+"&country=DE", &de); code != http.StatusOK || de.Supported || de.Level != GeoLevelCity || len(de.Items) != 2 || de.Items[0].Name != "Berlin" {
+		t.Errorf("DE: status %d, %+v", code, de)
+	}
+
+	var fr GeoDrillDown
+	if code := get(base+"&country=FR", &fr); code != http.StatusOK || fr.Supported || fr.Items == nil {
+		t.Errorf("FR: status %d, %+v", code, fr)
+	}
+
+	for _, country := range []string{"USA", "1A", "XX"} {
+		if code := get(base+"&country="+country, &us); code != http.StatusBadRequest {
+			t.Errorf("country=%s: status %d, want 400", country, code)
+		}
+	}
+}
+
+func TestCountryCode(t *testing.T) {
+	for in, want := range map[string]string{"us": "US", " de ": "DE", "ZZ": "", "": "", "GBR": "", "é1": ""} {
+		if got := countryCode(in); got != want {
+			t.Errorf("countryCode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+// ErrGoalNotFound is returned when a goal doesn't exist for the requested domain
+var ErrGoalNotFound = errors.New("goal not found")
+
+// DirectCampaign is the bucket for sessions that arrived without UTM parameters
+const DirectCampaign = "(direct/none)"
+
+// GoalSource loads goal definitions scoped to the domain they belong to.
+// A goal is a single step: a pageview path (trailing * for prefix) or an event name.
+type GoalSource interface {
+	GoalDef(id, domain string) (funnel.Step, error)
+}
+
+// CampaignOptions controls how conversions are attributed to campaigns
+type CampaignOptions struct {
+	// Attribution is "first" or "last": the campaign on the visitor's first or last pageview in range
+	Attribution string
+	// BySourceMedium splits each campaign by utm_source and utm_medium
+	BySourceMedium bool
+}
+
+// CampaignConversion is goal performance for one campaign bucket
+type CampaignConversion struct {
+	Campaign       string  `json:"campaign"`
+	Source         string  `json:"source,omitempty"`
+	Medium         string  `json:"medium,omitempty"`
+	Sessions       int64   `json:"sessions"`
+	Conversions    int64   `json:"conversions"`
+	Completions    int64   `json:"completions"`
+	ConversionRate float64 `json:"conversion_rate"`
+	// Revenue sums the converted sessions' purchases, for goals on the
+	// project's purchase event only
+	Revenue *float64 `json:"revenue,omitempty"`
+}
+
+// ValidateGoal checks a goal definition is a pageview path or an event name
+func ValidateGoal(goal funnel.Step) error {
+	switch goal.Type {
+	case "pageview":
+		if !strings.HasPrefix(goal.Value, "/") {
+			return fmt.Errorf("pageview goal must be a path starting with /")
+		}
+	case "event":
+		if goal.Value == "" {
+			return fmt.Errorf("event goal requires an event name")
+		}
+	default:
+		return fmt.Errorf("goal type must be pageview or event")
+	}
+	return nil
+}
+
+// goalRevenue returns the revenue conversion attached to ctx when goal is
+// its purchase event
+func goalRevenue(ctx context.Context, goal funnel.Step) (revenueConversion, bool) {
+	c, ok := revenueFromContext(ctx)
+	return c, ok && goal.Type == "event" && goal.Value == c.event
+}
+
+// setConversionRates fills ConversionRate as converted sessions over sessions
+func setConversionRates(rows []CampaignConversion) {
+	for i := range rows {
+		if rows[i].Sessions > 0 {
+			rows[i].ConversionRate = float64(rows[i].Conversions) / float64(rows[i].Sessions) * 100
+		}
+	}
+}
+
+// duckdbGoalClause renders a goal as a condition with numbered params starting at argIndex
+func duckdbGoalClause(goal funnel.Step, argIndex int) (string, []any) {
+	if goal.Type == "event" {
+		return fmt.Sprintf("name = $%d", argIndex), []any{goal.Value}
+	}
+	if prefix, ok := strings.CutSuffix(goal.Value, "*"); ok {
+		return fmt.Sprintf("name = 'pageview' AND starts_with(pathname, $%d)", argIndex), []any{prefix}
+	}
+	return fmt.Sprintf("name = 'pageview' AND pathname = $%d", argIndex), []any{goal.Value}
+}
+
+// clickhouseGoalClause renders a goal as a condition with positional params
+func clickhouseGoalClause(goal funnel.Step) (string, []any) {
+	if goal.Type == "event" {
+		return "name = ?", []any{goal.Value}
+	}
+	if prefix, ok := strings.CutSuffix(goal.Value, "*"); ok {
+		return "name = 'pageview' AND startsWith(pathname, ?)", []any{prefix}
+	}
+	return "name = 'pageview' AND pathname = ?", []any{goal.Value}
+}
+
+// postgresGoalClause is duckdbGoalClause, whose functions Postgres has too
+func postgresGoalClause(goal funnel.Step, argIndex int) (string, []any) {
+	return duckdbGoalClause(goal, argIndex)
+}
@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+func TestValidateGoal(t *testing.T) {
+	tests := []struct {
+		goal    funnel.Step
+		wantErr bool
+	}{
+		{funnel.Step{Type: "pageview", Value: "/thanks"}, false},
+		{funnel.Step{Type: "pageview", Value: "/checkout/*"}, false},
+		{funnel.Step{Type: "event", Value: "signup"}, false},
+		{funnel.Step{Type: "pageview", Value: "thanks"}, true},
+		{funnel.Step{Type: "event"}, true},
+		{funnel.Step{Type: "click", Value: "x"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.goal.Type+"_"+tt.goal.Value, func(t *testing.T) {
+			if err := ValidateGoal(tt.goal); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateGoal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGoalClauses(t *testing.T) {
+	clause, args := duckdbGoalClause(funnel.Step{Type: "pageview", Value: "/docs/*"}, 5)
+	if clause != "name = 'pageview' AND starts_with(pathname, $5)" || args[0] != "/docs/" {
+		t.Errorf("duckdb prefix clause = %q %v", clause, args)
+	}
+
+	clause, args = clickhouseGoalClause(funnel.Step{Type: "event", Value: "signup"})
+	if clause != "name = ?" || args[0] != "signup" {
+		t.Errorf("clickhouse event clause = %q %v", clause, args)
+	}
+}
+
+func TestSetConversionRates(t *testing.T) {
+	rows := []CampaignConversion{
+		{Campaign: "spring", Sessions: 200, Conversions: 10},
+		{Campaign: DirectCampaign, Sessions: 0},
+	}
+	setConversionRates(rows)
+
+	if rows[0].ConversionRate != 5 {
+		t.Errorf("ConversionRate = %v, want 5", rows[0].ConversionRate)
+	}
+	if rows[1].ConversionRate != 0 {
+		t.Errorf("ConversionRate with no sessions = %v, want 0", rows[1].ConversionRate)
+	}
+}
+
+func TestHandleCampaignConversions_Validation(t *testing.T) {
+	h := NewHandler(fakeStore{})
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"domain=example.com", http.StatusBadRequest},
+		{"domain=example.com&goal_id=g1&attribution=middle", http.StatusBadRequest},
+		{"domain=example.com&goal_id=g1", http.StatusNotFound}, // no goal source
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/stats/campaign-conversions?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		h.HandleCampaignConversions(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.query, w.Code, tt.code)
+		}
+	}
+}
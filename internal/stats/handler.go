@@ -1,59 +1,426 @@
 package stats
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/shortid/clickresearch-stats/internal/access"
 	"github.com/shortid/clickresearch-stats/internal/cache"
+	"github.com/shortid/clickresearch-stats/internal/jobs"
+	"github.com/shortid/clickresearch-stats/internal/errorsink"
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/reqbody"
 )
 
 type Handler struct {
-	store StoreInterface
-	cache *cache.Cache
+	store       StoreInterface
+	cache       *cache.Cache
+	segments    SegmentSource
+	annotations AnnotationSource
+	goals       GoalSource
+	revenue     RevenueSource
+	rates       *ExchangeRates
+	privacy     PrivacySource
+	domainMatch DomainMatchSource
+	aliases     AliasSource
+	campaigns   CampaignSource
+	roles       RoleSource
+	latency     *latencyRecorder
+	warmer      *cacheWarmer
+	budget      *domainBudget
+
+	strictParams bool
+	rangeCaps    RangeCaps
+	rangeClasses map[string]RangeClass
+
+	spam         *SpamList
+	excludeSpam  bool
+	spamExcluded atomic.Int64
+
+	eventNames *EventNameRules
+	live       *liveHub
+	wallboard  *wallboardHub
+	embeds     EmbedSource
+	badges     *BadgeSlugs
+	badgeCache *cache.Cache
+
+	reports    *jobs.Runner
+	branding   BrandingSource
+	logoClient *http.Client
+
+	domainCache DomainCacheSource
+}
+
+// Annotation marks a date on time-series charts
+type Annotation struct {
+	Date  string `json:"date"`
+	Label string `json:"label"`
+	Color string `json:"color,omitempty"`
+}
+
+// AnnotationSource loads chart annotations for a domain
+type AnnotationSource interface {
+	AnnotationsInRange(domain string, from, to time.Time) ([]Annotation, error)
 }
 
 func NewHandler(store StoreInterface) *Handler {
-	return &Handler{
-		store: store,
-		cache: cache.New(5 * time.Minute), // 5 min TTL
+	h := &Handler{
+		store:   store,
+		cache:   cache.New(5 * time.Minute), // 5 min TTL
+		latency: &latencyRecorder{},
+
+		strictParams: true,
+		rangeCaps:    DefaultRangeCaps,
+	}
+	h.rangeClasses = h.routeRanges()
+	return h
+}
+
+// SetCacheTTL changes how long stats responses are cached, from the next one cached on
+func (h *Handler) SetCacheTTL(ttl time.Duration) {
+	h.cache.SetTTL(ttl)
+}
+
+// ForgetDomain drops the cached responses of domain, e.g. once its project is
+// deleted. Cache keys name the report first and the domain second.
+func (h *Handler) ForgetDomain(domain string) {
+	match := func(key string) bool {
+		parts := strings.SplitN(key, ":", 3)
+		return len(parts) > 1 && parts[1] == domain
+	}
+	n := h.cache.DeleteFunc(match)
+	if h.badgeCache != nil {
+		n += h.badgeCache.DeleteFunc(match)
+	}
+	if n > 0 {
+		log.Printf("stats: dropped %d cached responses of %s", n, domain)
+	}
+}
+
+// SetStrictParams toggles rejecting unknown periods and missing domains with 400
+func (h *Handler) SetStrictParams(strict bool) {
+	h.strictParams = strict
+}
+
+// SetRoleSource lets demo callers omit domain in strict mode
+func (h *Handler) SetRoleSource(src RoleSource) {
+	h.roles = src
+}
+
+// SetSegmentSource enables segment_id resolution on stats endpoints
+func (h *Handler) SetSegmentSource(src SegmentSource) {
+	h.segments = src
+}
+
+// SetAnnotationSource enables include_annotations on the pageviews endpoint
+func (h *Handler) SetAnnotationSource(src AnnotationSource) {
+	h.annotations = src
+}
+
+// SetGoalSource enables goal_id resolution for conversion reports
+func (h *Handler) SetGoalSource(src GoalSource) {
+	h.goals = src
+}
+
+// SetSpamList sets the referrer blocklist; exclude turns on filtering in overview and sources
+func (h *Handler) SetSpamList(list *SpamList, exclude bool) {
+	h.spam = list
+	h.excludeSpam = exclude
+}
+
+// spamContext enables referrer spam exclusion when configured, returning a cache key suffix
+// that changes with the list
+func (h *Handler) spamContext(ctx context.Context) (context.Context, string) {
+	if h.spam == nil || !h.excludeSpam {
+		return ctx, ""
+	}
+	return withSpamPattern(ctx, h.spam.Pattern()), fmt.Sprintf("spam%d", h.spam.Version())
+}
+
+// filterContext resolves inline filters, the optional saved segment and the
+// domain's privacy mode and strict domain policy into a store context, flags ranges the store can
+// answer only in part and picks the cache TTL of the range. Inline filters win over segment filters on conflicts.
+// Returns the canonical filter key for cache keys; on failure the error is written.
+func (h *Handler) filterContext(w http.ResponseWriter, r *http.Request, domain string, from, to time.Time) (context.Context, string, bool) {
+	filters := ParseFilters(r.URL.Query())
+
+	if segmentID := r.URL.Query().Get("segment_id"); segmentID != "" {
+		if h.segments == nil {
+			writeError(w, ErrSegmentNotFound, http.StatusNotFound)
+			return nil, "", false
+		}
+		segment, err := h.segments.SegmentFilters(segmentID, domain)
+		if errors.Is(err, ErrSegmentNotFound) {
+			writeError(w, err, http.StatusNotFound)
+			return nil, "", false
+		} else if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return nil, "", false
+		}
+		filters = segment.Merge(filters)
+	}
+
+	if err := filters.Validate(); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	ctx, key, err := h.privacyContext(WithFilters(r.Context(), filters), domain, filters.Key())
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return nil, "", false
+	}
+	if ctx, key, err = h.aliasContext(ctx, domain, key); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return nil, "", false
+	}
+	if ctx, key, err = h.domainMatchContext(ctx, domain, key); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return nil, "", false
 	}
+	ctx, partialKey := h.partialDataContext(ctx, w.Header(), from, to)
+	// requestParams already rejected invalid zones in strict mode; lenient
+	// mode falls back to UTC like the range itself
+	loc, _ := reportingLocation(r)
+	ctx = h.cacheTTLContext(ctx, w.Header(), loc, to)
+	return ctx, key + partialKey + calendarKey(r.URL.Query().Get("period"), from), true
+}
+
+// DemoDomain is the domain demo users read; they may omit domain
+const DemoDomain = "shortid.me"
+
+// validPeriods lists the accepted period values in display order
+var validPeriods = []string{"today", "yesterday", "this_week", "7d", "30d", "this_month", "last_month", "90d", "last_12_months"}
+
+// calendarPeriods are the periods bounded by midnights in the reporting zone
+// rather than by the current time alone
+var calendarPeriods = map[string]bool{
+	"today": true, "yesterday": true, "this_week": true,
+	"this_month": true, "last_month": true, "last_12_months": true,
 }
 
-// parseParams extracts common query parameters
-func parseParams(r *http.Request) (domain string, from, to time.Time) {
-	domain = r.URL.Query().Get("domain")
+// RoleSource reports the role of the authenticated caller, or "" for anonymous requests
+type RoleSource interface {
+	RequestRole(r *http.Request) string
+}
+
+// parseParams extracts common query parameters. In strict mode unknown periods and
+// missing or blank domains are errors; demo callers still default to DemoDomain.
+// Lenient mode keeps the old fallbacks (DemoDomain, 7d).
+func parseParams(r *http.Request, strict, demo bool) (domain string, from, to time.Time, err error) {
+	raw, hasDomain := r.URL.Query()["domain"]
+	if hasDomain {
+		domain = strings.TrimSpace(raw[0])
+	}
 	if domain == "" {
-		domain = "shortid.me"
-	}
-
-	to = time.Now().UTC()
-	from = to.AddDate(0, 0, -7)
-
-	if period := r.URL.Query().Get("period"); period != "" {
-		switch period {
-		case "today":
-			from = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
-		case "7d":
-			from = to.AddDate(0, 0, -7)
-		case "30d":
-			from = to.AddDate(0, 0, -30)
-		case "90d":
-			from = to.AddDate(0, 0, -90)
+		switch {
+		case strict && hasDomain:
+			return "", from, to, fmt.Errorf("domain must not be empty")
+		case strict && !demo:
+			return "", from, to, fmt.Errorf("domain is required")
+		}
+		domain = DemoDomain
+	}
+
+	weekStart, err := ParseWeekStart(r.URL.Query().Get("week_start"))
+	if err != nil && strict {
+		return "", from, to, err
+	}
+	loc, err := reportingLocation(r)
+	if err != nil && strict {
+		return "", from, to, err
+	}
+	from, to, err = PeriodRangeWeek(r.URL.Query().Get("period"), time.Now().In(loc), weekStart)
+	if err != nil {
+		if strict {
+			return "", from, to, err
+		}
+		from, to, _ = PeriodRange("", time.Now().UTC())
+	}
+
+	return domain, from, to, nil
+}
+
+// PeriodRange returns the range a period value covers, ending at now; "" means 7d.
+// Weeks start on Monday.
+func PeriodRange(period string, now time.Time) (from, to time.Time, err error) {
+	return PeriodRangeWeek(period, now, WeekStartMonday)
+}
+
+// PeriodRangeWeek is PeriodRange with weeks starting on weekStart. Calendar
+// periods start and end at midnight in now's location: yesterday ends where
+// today starts, last_month ends where this_month starts, and last_12_months
+// starts on the first of the month 11 months back. Both times are returned in UTC.
+func PeriodRangeWeek(period string, now time.Time, weekStart WeekStart) (from, to time.Time, err error) {
+	to = now
+	y, m, d := now.Date()
+	switch period {
+	case "today":
+		from = time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	case "yesterday":
+		from, to = time.Date(y, m, d-1, 0, 0, 0, 0, now.Location()), time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	case "this_week":
+		from = weekStart.StartOfWeek(now)
+	case "", "7d":
+		from = to.AddDate(0, 0, -7)
+	case "30d":
+		from = to.AddDate(0, 0, -30)
+	case "this_month":
+		from = time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+	case "last_month":
+		from, to = time.Date(y, m-1, 1, 0, 0, 0, 0, now.Location()), time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+	case "90d":
+		from = to.AddDate(0, 0, -90)
+	case "last_12_months":
+		from = time.Date(y, m-11, 1, 0, 0, 0, 0, now.Location())
+	default:
+		return from, to, fmt.Errorf("unknown period %q, valid options: %s", period, strings.Join(validPeriods, ", "))
+	}
+	return from.UTC(), to.UTC(), nil
+}
+
+// reportingLocation resolves the zone calendar periods and weekly buckets
+// follow: tz, an IANA zone name, else hour_offset, whole hours east of UTC,
+// else UTC. An invalid value yields UTC and an error.
+func reportingLocation(r *http.Request) (*time.Location, error) {
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return time.UTC, fmt.Errorf("unknown tz %q", tz)
 		}
+		return loc, nil
 	}
+	offset := r.URL.Query().Get("hour_offset")
+	if offset == "" {
+		return time.UTC, nil
+	}
+	hours, err := strconv.Atoi(offset)
+	if err != nil || hours < -12 || hours > 14 {
+		return time.UTC, fmt.Errorf("hour_offset must be a whole number from -12 to 14")
+	}
+	if hours == 0 {
+		return time.UTC, nil
+	}
+	return time.FixedZone(fmt.Sprintf("UTC%+d", hours), hours*60*60), nil
+}
 
-	return domain, from, to
+// calendarKey extends cache keys of calendar periods with the start of their
+// range, which moves at midnight and with the reporting zone and week start
+func calendarKey(period string, from time.Time) string {
+	if !calendarPeriods[period] {
+		return ""
+	}
+	return "|from=" + from.UTC().Format(time.RFC3339)
 }
 
+// ErrDomainForbidden is returned for domains outside the caller's access policy
+var ErrDomainForbidden = errors.New("stats of this domain are not available to you")
+
+// requestParams parses common query parameters for a stats request, writing a 400
+// on failure or a range over the endpoint's cap, and a 403 for domains the
+// caller's access policy excludes
+func (h *Handler) requestParams(w http.ResponseWriter, r *http.Request) (string, time.Time, time.Time, bool) {
+	demo := h.roles != nil && h.roles.RequestRole(r) == "demo"
+	domain, from, to, err := parseParams(r, h.strictParams, demo)
+	if err == nil {
+		err = h.checkRange(r.URL.Path, from, to)
+	}
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return "", from, to, false
+	}
+	if !access.PolicyFromContext(r.Context()).AllowsDomain(domain) {
+		writeError(w, ErrDomainForbidden, http.StatusForbidden)
+		return "", from, to, false
+	}
+	return domain, from, to, true
+}
+
+// writeJSON encodes data; a nil list is written as [] so clients never see null
+// where they expect a list
 func writeJSON(w http.ResponseWriter, data any) {
 	w.Header().Set("Content-Type", "application/json")
+	if v := reflect.ValueOf(data); v.Kind() == reflect.Slice && v.IsNil() {
+		data = []struct{}{}
+	}
 	json.NewEncoder(w).Encode(data)
 }
 
+// emptyIfNil returns s, or an empty list that encodes as [] rather than null
+func emptyIfNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// Retry-After hints for store errors: the first load takes a while, a busy
+// backend frees up quickly
+const (
+	notReadyRetryAfter = 10 * time.Second
+	busyRetryAfter     = 2 * time.Second
+)
+
+// writeError sends err as the JSON error envelope: error, an optional code,
+// and retryable, which tells clients whether the same request may succeed
+// later. Store states and limits override code. Retryable errors with a known
+// wait send it as retry_after_ms and in Retry-After, which handlers may set
+// before calling writeError.
 func writeError(w http.ResponseWriter, err error, code int) {
+	body := map[string]any{}
+	var retryAfter time.Duration
+	var budgetErr *BudgetExceededError
+	var rangeErr *RangeTooLongError
+	switch {
+	case errors.Is(err, ErrNotReady):
+		code = http.StatusServiceUnavailable
+		body["code"] = "not_ready"
+		retryAfter = notReadyRetryAfter
+	case errors.Is(err, ErrDomainUnknown):
+		code = http.StatusNotFound
+		body["code"] = "domain_unknown"
+	case errors.Is(err, ErrQueryTimeout), errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusGatewayTimeout
+		body["code"] = "query_timeout"
+		err = ErrQueryTimeout
+	case errors.Is(err, ErrBusy):
+		code = http.StatusTooManyRequests
+		body["code"] = "busy"
+		retryAfter = busyRetryAfter
+		err = ErrBusy
+	case errors.As(err, &budgetErr):
+		code = http.StatusTooManyRequests
+		body["code"] = "query_budget_exceeded"
+		retryAfter = budgetErr.RetryAfter
+	case errors.As(err, &rangeErr):
+		body["code"] = "range_too_long"
+		body["max_days"] = int(rangeErr.MaxRange / (24 * time.Hour))
+	case errors.Is(err, context.Canceled):
+		// The client is gone; the status only shows up in logs
+		code = statusClientClosedRequest
+		log.Printf("stats: %d client closed request: %v", code, err)
+	}
+	if retryAfter == 0 {
+		if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil && secs > 0 {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+	}
+
+	body["retryable"] = retryable(code, retryAfter)
+	if retryAfter > 0 && body["retryable"] == true {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+		body["retry_after_ms"] = retryAfter.Milliseconds()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	msg := "unknown error"
@@ -62,7 +429,24 @@ func writeError(w http.ResponseWriter, err error, code int) {
 	} else if code == http.StatusServiceUnavailable {
 		msg = "stats not available"
 	}
-	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	body["error"] = msg
+	if code >= http.StatusInternalServerError {
+		errorsink.Report(w, errors.New(msg), code)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// retryable reports whether a request answered with code may succeed when
+// sent again: rate limits and timeouts pass, and so do other states with a
+// known wait, such as a loading store. Unavailable features don't.
+func retryable(code int, retryAfter time.Duration) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusGatewayTimeout:
+		return true
+	case http.StatusServiceUnavailable:
+		return retryAfter > 0
+	}
+	return false
 }
 
 func (h *Handler) HandleOverview(w http.ResponseWriter, r *http.Request) {
@@ -71,52 +455,297 @@ func (h *Handler) HandleOverview(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
-	cacheKey := fmt.Sprintf("overview:%s:%s", domain, r.URL.Query().Get("period"))
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	ctx, spamKey := h.spamContext(ctx)
+	cacheKey := overviewCacheKey(domain, r.URL.Query().Get("period"), filterKey, spamKey)
 
 	// Try cache first
 	var data *Overview
-	if h.cache.Get(cacheKey, &data) {
-		writeJSON(w, data)
+	if h.cacheGet(r.Context(), cacheKey, &data) {
+		h.writeOverview(ctx, w, domain, data)
 		return
 	}
 
 	// Cache miss - fetch and cache
-	data, err := h.store.GetOverview(r.Context(), domain, from, to)
+	data, err := h.store.GetOverview(ctx, domain, from, to)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
-	h.cache.Set(cacheKey, data)
+	h.spamExcluded.Add(data.ExcludedSpam)
+	h.cacheSet(ctx, cacheKey, data)
+	h.writeOverview(ctx, w, domain, data)
+}
+
+// writeOverview adds the request-specific notes to an overview and writes it
+func (h *Handler) writeOverview(ctx context.Context, w http.ResponseWriter, domain string, data *Overview) {
+	h.annotateOverview(ctx, domain, data)
 	writeJSON(w, data)
 }
 
+// annotateOverview adds the request-specific notes to an overview
+func (h *Handler) annotateOverview(ctx context.Context, domain string, data *Overview) {
+	data.PrivacyMode = privacyModeFromContext(ctx)
+	if isPartialData(ctx) {
+		data.Warning = dataWarningPartial
+	}
+	data.HasData = data.Events > 0
+	data.FirstEventAt = ""
+	if first, err := h.firstEventAt(ctx, domain); err != nil {
+		log.Printf("stats: first event of %s: %v", domain, err)
+	} else if !first.IsZero() {
+		data.HasData = true
+		data.FirstEventAt = first.UTC().Format(time.RFC3339)
+	}
+	data.DataAsOf = h.dataAsOf(ctx, domain)
+}
+
+// firstEventAt returns when domain's first event happened, or the zero time
+// for a domain without events; cached like reports
+func (h *Handler) firstEventAt(ctx context.Context, domain string) (time.Time, error) {
+	cacheKey := "first-event:" + domain
+	var first time.Time
+	if h.cacheGet(ctx, cacheKey, &first) {
+		return first, nil
+	}
+	first, err := h.store.GetFirstEventAt(ctx, domain)
+	if errors.Is(err, ErrDomainUnknown) {
+		first, err = time.Time{}, nil
+	}
+	if err != nil {
+		return first, err
+	}
+	h.cache.Set(cacheKey, first)
+	return first, nil
+}
+
+// HandlePageviews returns the pageview series as {"interval", "points", "gaps"},
+// its points stepping by the interval chosen and gaps listing the points with
+// data missing from the store. Hours and days start in the
+// reporting zone. interval=week sums it into weeks starting on week_start at
+// midnight in tz, dated by their first day. legacy=true returns the bare
+// series as before the envelope; it goes away in the next release.
+// overlay=previous_period or previous_year adds the series of the range before
+// or a year before, aligned with the points; see overlaySeries.
 func (h *Handler) HandlePageviews(w http.ResponseWriter, r *http.Request) {
 	if h.store == nil {
 		writeError(w, nil, http.StatusServiceUnavailable)
 		return
 	}
 
-	domain, from, to := parseParams(r)
-	interval := "hour"
-	if to.Sub(from) > 7*24*time.Hour {
-		interval = "day"
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	loc, err := reportingLocation(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if loc != time.UTC {
+		filterKey += "|tz=" + loc.String()
+	}
+	var weekStart WeekStart
+	interval := r.URL.Query().Get("interval")
+	switch interval {
+	case "":
+		interval = periodInterval(r.URL.Query().Get("period"), from, to)
+	case "hour", "day", "week":
+	default:
+		writeError(w, fmt.Errorf("unknown interval %q, valid options: hour, day, week", interval), http.StatusBadRequest)
+		return
+	}
+	if interval == "week" {
+		if weekStart, err = ParseWeekStart(r.URL.Query().Get("week_start")); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		filterKey += fmt.Sprintf("|week_start=%s", weekStart)
+	}
+
+	overlay, err := parseOverlay(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if overlay != "" {
+		filterKey += "|overlay=" + overlay
+	}
+
+	cacheKey := pageviewsCacheKey(domain, r.URL.Query().Get("period"), interval, filterKey)
+	if overlay != "" {
+		var data overlaySeries
+		if !h.cacheGet(r.Context(), cacheKey, &data) {
+			if data, err = h.overlaySeries(ctx, domain, r.URL.Query().Get("period"), from, to, interval, weekStart, loc, overlay); err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			h.cacheSet(ctx, cacheKey, data)
+		}
+		h.writePageviews(w, r, domain, from, to, interval, data.Points, h.pageviewGaps(ctx, domain, from, to, interval, loc, data.Points), &data)
+		return
 	}
 
-	cacheKey := fmt.Sprintf("pageviews:%s:%s", domain, r.URL.Query().Get("period"))
 	var data []TimeSeriesPoint
-	if h.cache.Get(cacheKey, &data) {
-		writeJSON(w, data)
+	if h.cacheGet(r.Context(), cacheKey, &data) {
+		h.writePageviews(w, r, domain, from, to, interval, data, h.pageviewGaps(ctx, domain, from, to, interval, loc, data), nil)
 		return
 	}
 
-	data, err := h.store.GetPageviewsTimeSeries(r.Context(), domain, from, to, interval)
+	data, err = h.pageviewSeries(ctx, domain, from, to, interval, weekStart, loc)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
-	h.cache.Set(cacheKey, data)
-	writeJSON(w, data)
+	h.cacheSet(ctx, cacheKey, data)
+	h.writePageviews(w, r, domain, from, to, interval, data, h.pageviewGaps(ctx, domain, from, to, interval, loc, data), nil)
+}
+
+// pageviewSeries fetches the pageviews of [from, to) with one point per
+// interval in loc, weeks starting on weekStart
+func (h *Handler) pageviewSeries(ctx context.Context, domain string, from, to time.Time, interval string, weekStart WeekStart, loc *time.Location) ([]TimeSeriesPoint, error) {
+	switch {
+	case interval == "week":
+		// Weeks are summed from hourly points in Go so both stores bucket alike
+		data, err := h.store.GetPageviewsTimeSeries(ctx, domain, from, to, "hour")
+		if err != nil {
+			return nil, err
+		}
+		return bucketWeeks(data, from, to, weekStart, loc), nil
+	case loc == time.UTC:
+		data, err := h.store.GetPageviewsTimeSeries(ctx, domain, from, to, interval)
+		if err != nil {
+			return nil, err
+		}
+		return fillSeries(data, from, to, interval), nil
+	default:
+		// The stores bucket in UTC, so local hours and days are summed from hourly points
+		data, err := h.store.GetPageviewsTimeSeries(ctx, domain, from, to, "hour")
+		if err != nil {
+			return nil, err
+		}
+		return localSeries(data, from, to, interval, loc), nil
+	}
+}
+
+// pageviewGaps returns the labels of the points with data gaps. Gaps change
+// with every load, so they are looked up rather than cached; a failed lookup
+// only leaves the chart unshaded.
+func (h *Handler) pageviewGaps(ctx context.Context, domain string, from, to time.Time, interval string, loc *time.Location, points []TimeSeriesPoint) []string {
+	gaps, err := h.store.GetDataGaps(ctx, domain, from, to)
+	if err != nil {
+		return []string{}
+	}
+	return gapBuckets(gaps, points, interval, loc)
+}
+
+// writePageviews writes the series with its interval and gaps, the overlay
+// when one was asked for, and the annotations in range when requested
+func (h *Handler) writePageviews(w http.ResponseWriter, r *http.Request, domain string, from, to time.Time, interval string, points []TimeSeriesPoint, gaps []string, overlay *overlaySeries) {
+	legacy := r.URL.Query().Get("legacy") == "true"
+	if r.URL.Query().Get("include_annotations") != "true" || h.annotations == nil {
+		if legacy {
+			writeJSON(w, points)
+			return
+		}
+		body := map[string]any{
+			"interval": interval,
+			"points":   emptyIfNil(points),
+			"gaps":     emptyIfNil(gaps),
+		}
+		overlay.addTo(body)
+		writeJSON(w, body)
+		return
+	}
+
+	annotations, err := h.annotations.AnnotationsInRange(domain, from, to)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if annotations == nil {
+		annotations = []Annotation{}
+	}
+	body := map[string]any{
+		"points":      emptyIfNil(points),
+		"annotations": annotations,
+	}
+	if !legacy {
+		body["interval"] = interval
+		body["gaps"] = emptyIfNil(gaps)
+		overlay.addTo(body)
+	}
+	writeJSON(w, body)
+}
+
+// fillSeries returns one point per UTC hour or day of [from, to), in order,
+// with zero for buckets the store returned no point for
+func fillSeries(points []TimeSeriesPoint, from, to time.Time, interval string) []TimeSeriesPoint {
+	step, format := 24*time.Hour, "2006-01-02"
+	if interval == "hour" {
+		step, format = time.Hour, "2006-01-02T15:00"
+	}
+	counts := make(map[string]int64, len(points))
+	for _, p := range points {
+		counts[p.Time] += p.Value
+	}
+
+	filled := make([]TimeSeriesPoint, 0, int(to.Sub(from)/step)+1)
+	for t := from.UTC().Truncate(step); t.Before(to); t = t.Add(step) {
+		key := t.Format(format)
+		filled = append(filled, TimeSeriesPoint{Time: key, Value: counts[key]})
+	}
+	return filled
+}
+
+// localSeries sums hourly points into one point per hour or day of [from, to)
+// in loc, in order, labelled with local times. In zones a fraction of an hour
+// off UTC, an hour's pageviews count towards the local hour it starts in.
+func localSeries(points []TimeSeriesPoint, from, to time.Time, interval string, loc *time.Location) []TimeSeriesPoint {
+	format := "2006-01-02"
+	if interval == "hour" {
+		format = "2006-01-02T15:00"
+	}
+	bucket := func(t time.Time) time.Time {
+		t = t.In(loc)
+		if interval == "hour" {
+			return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+		}
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+
+	// Buckets are keyed by instant, as a local hour repeats when DST ends
+	counts := make(map[int64]int64, len(points))
+	for _, p := range points {
+		t, err := time.Parse("2006-01-02T15:04", p.Time)
+		if err != nil {
+			continue
+		}
+		counts[bucket(t).Unix()] += p.Value
+	}
+
+	filled := []TimeSeriesPoint{}
+	for t := bucket(from); t.Before(to); {
+		filled = append(filled, TimeSeriesPoint{Time: t.Format(format), Value: counts[t.Unix()]})
+		if interval == "hour" {
+			t = t.Add(time.Hour)
+		} else {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		}
+	}
+	return filled
 }
 
 func (h *Handler) HandlePages(w http.ResponseWriter, r *http.Request) {
@@ -125,23 +754,24 @@ func (h *Handler) HandlePages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
-	limit := parseLimit(r, 10)
-
-	cacheKey := fmt.Sprintf("pages:%s:%s:%d", domain, r.URL.Query().Get("period"), limit)
-	var data []TopItem
-	if h.cache.Get(cacheKey, &data) {
-		writeJSON(w, data)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
 		return
 	}
+	limit := parseLimit(r, 10)
 
-	data, err := h.store.GetTopPages(r.Context(), domain, from, to, limit)
+	cacheKey := pagesCacheKey(domain, r.URL.Query().Get("period"), limit, filterKey)
+	data, err := h.topBreakdown(ctx, cacheKey, h.store.GetTopPages, domain, from, to, limit)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
-	h.cache.Set(cacheKey, data)
-	writeJSON(w, data)
+	writeBreakdownHeaders(w, data)
+	writeJSON(w, data.Items)
 }
 
 func (h *Handler) HandleSources(w http.ResponseWriter, r *http.Request) {
@@ -150,84 +780,186 @@ func (h *Handler) HandleSources(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 	limit := parseLimit(r, 10)
 
-	cacheKey := fmt.Sprintf("sources:%s:%s:%d", domain, r.URL.Query().Get("period"), limit)
-	var data []TopItem
-	if h.cache.Get(cacheKey, &data) {
-		writeJSON(w, data)
+	ctx, spamKey := h.spamContext(ctx)
+	// Buckets keep tagged direct traffic split by medium, so the plain and
+	// classified responses share one entry
+	cacheKey := fmt.Sprintf("source-buckets:%s:%s:%d:%s:%s", domain, r.URL.Query().Get("period"), limit, filterKey, spamKey)
+	classify := r.URL.Query().Get("classify") == "true"
+	if r.URL.Query().Get("detail") == "url" {
+		h.handleSourceURLs(ctx, w, domain, from, to, limit, cacheKey+":url", classify)
 		return
 	}
-
-	data, err := h.store.GetTopSources(r.Context(), domain, from, to, limit)
-	if err != nil {
-		writeError(w, err, http.StatusInternalServerError)
+	var data sourceBuckets
+	if !h.cacheGet(r.Context(), cacheKey, &data) {
+		countCtx, counter := withGroupCounter(ctx)
+		var err error
+		data.Buckets, err = h.store.GetSourceBuckets(countCtx, domain, from, to, limit)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		data.TotalGroups = counter.count()
+		h.cacheSet(ctx, cacheKey, data)
+	}
+	sources := newBreakdownResult(topSources(data.Buckets), data.TotalGroups)
+	writeBreakdownHeaders(w, sources)
+	if classify {
+		writeJSON(w, classifySources(data.Buckets))
 		return
 	}
-	h.cache.Set(cacheKey, data)
-	writeJSON(w, data)
+	writeJSON(w, sources.Items)
+}
+
+// deviceBreakdowns are the optional breakdowns of HandleDevices
+type deviceBreakdowns struct {
+	languages, screens bool
+}
+
+// deviceIncludes reads include=languages,screens; unknown names are ignored
+func deviceIncludes(r *http.Request) deviceBreakdowns {
+	var include deviceBreakdowns
+	for _, name := range strings.Split(r.URL.Query().Get("include"), ",") {
+		switch strings.TrimSpace(name) {
+		case "languages":
+			include.languages = true
+		case "screens":
+			include.screens = true
+		}
+	}
+	return include
 }
 
+// HandleDevices returns browsers and device classes; include=languages,screens
+// adds the lang prop and viewport width breakdowns of pageviews
 func (h *Handler) HandleDevices(w http.ResponseWriter, r *http.Request) {
 	if h.store == nil {
 		writeError(w, nil, http.StatusServiceUnavailable)
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 	limit := parseLimit(r, 10)
+	include := deviceIncludes(r)
 
-	cacheKey := fmt.Sprintf("devices:%s:%s:%d", domain, r.URL.Query().Get("period"), limit)
+	cacheKey := fmt.Sprintf("devices:%s:%s:%d:%s:%v", domain, r.URL.Query().Get("period"), limit, filterKey, include)
 	var cached map[string]any
-	if h.cache.Get(cacheKey, &cached) {
+	if h.cacheGet(r.Context(), cacheKey, &cached) {
 		writeJSON(w, cached)
 		return
 	}
 
-	browsers, err := h.store.GetTopBrowsers(r.Context(), domain, from, to, limit)
-	if err != nil {
-		writeError(w, err, http.StatusInternalServerError)
-		return
+	var browsers, devices, languages, screens []TopItem
+	queries := []func(context.Context) error{
+		func(ctx context.Context) (err error) {
+			browsers, err = h.store.GetTopBrowsers(ctx, domain, from, to, limit)
+			return err
+		},
+		func(ctx context.Context) (err error) {
+			devices, err = h.store.GetTopDevices(ctx, domain, from, to, limit)
+			return err
+		},
 	}
-
-	devices, err := h.store.GetTopDevices(r.Context(), domain, from, to, limit)
+	if include.languages {
+		queries = append(queries, func(ctx context.Context) (err error) {
+			languages, err = h.store.GetTopLanguages(ctx, domain, from, to, limit)
+			return err
+		})
+	}
+	if include.screens {
+		queries = append(queries, func(ctx context.Context) (err error) {
+			screens, err = h.store.GetScreenSizes(ctx, domain, from, to)
+			return err
+		})
+	}
+	err := runParallel(ctx, queries...)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	result := map[string]any{
-		"browsers": browsers,
-		"devices":  devices,
+		"browsers": emptyIfNil(browsers),
+		"devices":  emptyIfNil(devices),
+	}
+	if include.languages {
+		result["languages"] = emptyIfNil(languages)
+	}
+	if include.screens {
+		result["screens"] = emptyIfNil(screens)
 	}
-	h.cache.Set(cacheKey, result)
+	h.cacheSet(ctx, cacheKey, result)
 	writeJSON(w, result)
 }
 
+// HandleGeo returns the top countries. level=continent sums every country of
+// the visitor map into continents instead.
 func (h *Handler) HandleGeo(w http.ResponseWriter, r *http.Request) {
 	if h.store == nil {
 		writeError(w, nil, http.StatusServiceUnavailable)
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	level, err := parseGeoLevel(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 	limit := parseLimit(r, 10)
 
-	cacheKey := fmt.Sprintf("geo:%s:%s:%d", domain, r.URL.Query().Get("period"), limit)
-	var data []TopItem
-	if h.cache.Get(cacheKey, &data) {
+	if level == GeoLevelContinent {
+		cacheKey := fmt.Sprintf("geo-continents:%s:%s:%d:%s", domain, r.URL.Query().Get("period"), limit, filterKey)
+		var data []GeoItem
+		if h.cacheGet(r.Context(), cacheKey, &data) {
+			writeJSON(w, data)
+			return
+		}
+		countries, err := h.store.GetCountryMap(ctx, domain, from, to)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		data = rollupContinents(mapCountries(countries))
+		if len(data) > limit {
+			data = data[:limit]
+		}
+		h.cacheSet(ctx, cacheKey, data)
 		writeJSON(w, data)
 		return
 	}
 
-	data, err := h.store.GetTopCountries(r.Context(), domain, from, to, limit)
+	cacheKey := fmt.Sprintf("geo:%s:%s:%d:%s", domain, r.URL.Query().Get("period"), limit, filterKey)
+	data, err := h.topBreakdown(ctx, cacheKey, h.store.GetTopCountries, domain, from, to, limit)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
-	h.cache.Set(cacheKey, data)
-	writeJSON(w, data)
+	writeBreakdownHeaders(w, data)
+	writeJSON(w, data.Items)
 }
 
 // UTMData holds all UTM dimensions
@@ -243,40 +975,69 @@ func (h *Handler) HandleUTM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 	limit := parseLimit(r, 10)
 
-	cacheKey := fmt.Sprintf("utm:%s:%s:%d", domain, r.URL.Query().Get("period"), limit)
+	// campaigns=registered reports campaigns as registered for the project
+	var registered []string
+	byRegistry := false
+	switch mode := r.URL.Query().Get("campaigns"); mode {
+	case "":
+	case "registered":
+		var err error
+		if registered, filterKey, err = h.registeredCampaigns(domain, filterKey); err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		byRegistry = true
+	default:
+		writeError(w, fmt.Errorf("unknown campaigns mode %q, valid options: registered", mode), http.StatusBadRequest)
+		return
+	}
+
+	cacheKey := fmt.Sprintf("utm:%s:%s:%d:%s", domain, r.URL.Query().Get("period"), limit, filterKey)
 	var cached UTMData
-	if h.cache.Get(cacheKey, &cached) {
+	if h.cacheGet(r.Context(), cacheKey, &cached) {
 		writeJSON(w, cached)
 		return
 	}
 
-	sources, err := h.store.GetTopUTMSources(r.Context(), domain, from, to, limit)
+	sources, err := h.store.GetTopUTMSources(ctx, domain, from, to, limit)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	mediums, err := h.store.GetTopUTMMediums(r.Context(), domain, from, to, limit)
+	mediums, err := h.store.GetTopUTMMediums(ctx, domain, from, to, limit)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	campaigns, err := h.store.GetTopUTMCampaigns(r.Context(), domain, from, to, limit)
+	var campaigns []TopItem
+	if byRegistry {
+		campaigns, err = h.topRegisteredCampaigns(ctx, domain, registered, from, to)
+	} else {
+		campaigns, err = h.store.GetTopUTMCampaigns(ctx, domain, from, to, limit)
+	}
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	result := UTMData{
-		Sources:   sources,
-		Mediums:   mediums,
-		Campaigns: campaigns,
+		Sources:   emptyIfNil(sources),
+		Mediums:   emptyIfNil(mediums),
+		Campaigns: emptyIfNil(campaigns),
 	}
-	h.cache.Set(cacheKey, result)
+	h.cacheSet(ctx, cacheKey, result)
 	writeJSON(w, result)
 }
 
@@ -295,26 +1056,73 @@ func (h *Handler) HandleEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	ctx, propKey, ok := propContext(ctx, w, r)
+	if !ok {
+		return
+	}
 	limit := parseLimit(r, 50)
+	// Props are fetched per event from HandleEvent unless asked for here
+	fields := DefaultEventFields
+	if r.URL.Query().Get("include_props") == "true" {
+		fields = AllEventFields
+	}
+	// With fields, only those columns are read and only they are sent
+	encode := func(e EventItem) any { return e }
+	if raw := r.URL.Query().Get("fields"); raw != "" {
+		var err error
+		if fields, err = ParseEventFields(raw); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		encode = func(e EventItem) any { return fields.project(e) }
+	}
 
-	cacheKey := fmt.Sprintf("events:%s:%s:%d", domain, r.URL.Query().Get("period"), limit)
+	stream := newEventStream(w, r)
+
+	// Small responses are cached; large ones would hold megabytes per entry
+	cacheable := limit <= maxCachedEvents
+	cacheKey := fmt.Sprintf("events:%s:%s:%d:%s:%s:%s", domain, r.URL.Query().Get("period"), limit, fields, filterKey, propKey)
 	var data []EventItem
-	if h.cache.Get(cacheKey, &data) {
-		writeJSON(w, data)
+	if cacheable && h.cacheGet(r.Context(), cacheKey, &data) {
+		for _, e := range data {
+			if stream.write(encode(e)) != nil {
+				return
+			}
+		}
+		stream.finish()
 		return
 	}
 
-	data, err := h.store.GetRecentEvents(r.Context(), domain, from, to, limit)
+	err := h.store.StreamRecentEvents(ctx, domain, from, to, limit, fields, func(e EventItem) error {
+		if cacheable {
+			data = append(data, e)
+		}
+		return stream.write(encode(e))
+	})
 	if err != nil {
-		writeError(w, err, http.StatusInternalServerError)
+		if !stream.started() {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		log.Printf("stats: events stream aborted after %d events: %v", stream.n, err)
+		stream.abort()
+		return
+	}
+	if stream.finish() != nil || !cacheable {
 		return
 	}
 	if data == nil {
 		data = []EventItem{}
 	}
-	h.cache.Set(cacheKey, data)
-	writeJSON(w, data)
+	h.cacheSet(ctx, cacheKey, data)
 }
 
 func (h *Handler) HandleFunnel(w http.ResponseWriter, r *http.Request) {
@@ -323,7 +1131,14 @@ func (h *Handler) HandleFunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, _, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 
 	// Parse steps from query param (comma-separated)
 	stepsParam := r.URL.Query().Get("steps")
@@ -332,11 +1147,10 @@ func (h *Handler) HandleFunnel(w http.ResponseWriter, r *http.Request) {
 		stepsParam = "/,/dashboard/"
 	}
 
-	steps := []string{}
-	for _, s := range splitSteps(stepsParam) {
-		if s != "" {
-			steps = append(steps, s)
-		}
+	steps, err := ParseFunnelSteps(stepsParam)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
 	}
 
 	if len(steps) < 2 {
@@ -344,7 +1158,21 @@ func (h *Handler) HandleFunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := h.store.GetFunnel(r.Context(), domain, from, to, steps)
+	window := defaultFunnelWindow
+	if v, err := strconv.Atoi(r.URL.Query().Get("window")); err == nil && v > 0 {
+		window = v
+	}
+	cohort, err := ParseFunnelCohort(r.URL.Query().Get("cohort"), CohortAny)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx = WithFunnelCohort(ctx, cohort)
+	if err := h.checkFunnelRange(ctx, r.URL.Path, from, to, window); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	data, err := h.funnel(ctx, domain, from, to, steps, window)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
@@ -352,21 +1180,44 @@ func (h *Handler) HandleFunnel(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, data)
 }
 
+// defaultFunnelWindow is how many minutes a funnel with event steps allows
+// between steps unless asked otherwise
+const defaultFunnelWindow = 60
+
+// checkFunnelRange reports a window over funnel.MaxWindow, and a range over
+// the cap of path counting the window past to an entry cohort reads
+func (h *Handler) checkFunnelRange(ctx context.Context, path string, from, to time.Time, window int) error {
+	if window > funnel.MaxWindow {
+		return fmt.Errorf("window must be at most %d minutes (30 days)", funnel.MaxWindow)
+	}
+	scanTo, _ := funnelScan(ctx, to, window)
+	return h.checkRange(path, from, scanTo)
+}
+
+// funnel runs a funnel of at least two steps. Event steps and CohortEntry need
+// ordered per-visitor evaluation within window minutes; plain paths keep the
+// simple flow.
+func (h *Handler) funnel(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, window int) (*FunnelResult, error) {
+	if hasEventSteps(steps) || funnelCohortFromContext(ctx) == CohortEntry {
+		return h.store.GetFunnelAdvanced(ctx, domain, from, to, steps, window)
+	}
+	paths := make([]string, len(steps))
+	for i, step := range steps {
+		paths[i] = step.Value
+	}
+	return h.store.GetFunnel(ctx, domain, from, to, paths)
+}
+
+// splitSteps splits a comma-separated steps param; a trailing comma adds no step
 func splitSteps(s string) []string {
-	var result []string
-	current := ""
-	for _, c := range s {
-		if c == ',' {
-			result = append(result, current)
-			current = ""
-		} else {
-			current += string(c)
-		}
+	if s == "" {
+		return nil
 	}
-	if current != "" {
-		result = append(result, current)
+	steps := strings.Split(s, ",")
+	if steps[len(steps)-1] == "" {
+		steps = steps[:len(steps)-1]
 	}
-	return result
+	return steps
 }
 
 func (h *Handler) HandleEventBreakdown(w http.ResponseWriter, r *http.Request) {
@@ -375,13 +1226,40 @@ func (h *Handler) HandleEventBreakdown(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
-	data, err := h.store.GetEventBreakdown(r.Context(), domain, from, to)
-	if err != nil {
-		writeError(w, err, http.StatusInternalServerError)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
 		return
 	}
-	writeJSON(w, data)
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	ctx, propKey, ok := propContext(ctx, w, r)
+	if !ok {
+		return
+	}
+	// Items carry visitors and a daily sparkline unless detail=false asks for
+	// the plain name and count list
+	detail := r.URL.Query().Get("detail") != "false"
+
+	cacheKey := fmt.Sprintf("event-breakdown:%s:%s:%s:%s", domain, r.URL.Query().Get("period"), filterKey, propKey)
+	var data eventBreakdownResult
+	if !h.cacheGet(r.Context(), cacheKey, &data) {
+		var err error
+		if data, err = h.eventBreakdown(ctx, domain, from, to); err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		h.cacheSet(ctx, cacheKey, data)
+	}
+	if data.RolledUp {
+		w.Header().Set(dataWarningHeader, dataWarningCardinality)
+	}
+	if !detail {
+		writeJSON(w, topItems(data.Items))
+		return
+	}
+	writeJSON(w, data.Items)
 }
 
 func (h *Handler) HandleUniquePages(w http.ResponseWriter, r *http.Request) {
@@ -390,22 +1268,137 @@ func (h *Handler) HandleUniquePages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 	limit := parseLimit(r, 100)
 
-	cacheKey := fmt.Sprintf("unique-pages:%s:%s:%d", domain, r.URL.Query().Get("period"), limit)
+	cacheKey := fmt.Sprintf("unique-pages:%s:%s:%d:%s", domain, r.URL.Query().Get("period"), limit, filterKey)
 	var data []PageItem
-	if h.cache.Get(cacheKey, &data) {
+	if h.cacheGet(r.Context(), cacheKey, &data) {
+		writeJSON(w, data)
+		return
+	}
+
+	data, err := h.store.GetUniquePages(ctx, domain, from, to, limit)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h.cacheSet(ctx, cacheKey, data)
+	writeJSON(w, data)
+}
+
+func (h *Handler) HandleErrorPages(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	limit := parseLimit(r, 20)
+
+	cacheKey := fmt.Sprintf("errors:%s:%s:%d:%s", domain, r.URL.Query().Get("period"), limit, filterKey)
+	var data []ErrorPage
+	if h.cacheGet(r.Context(), cacheKey, &data) {
+		writeJSON(w, data)
+		return
+	}
+
+	data, err := h.store.GetErrorPages(ctx, domain, from, to, limit)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h.cacheSet(ctx, cacheKey, data)
+	writeJSON(w, data)
+}
+
+// HandleCampaignConversions reports goal conversions per utm_campaign.
+// Query params: goal_id (required), attribution=first|last, breakdown=source_medium.
+func (h *Handler) HandleCampaignConversions(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	limit := parseLimit(r, 20)
+
+	goalID := r.URL.Query().Get("goal_id")
+	if goalID == "" {
+		writeError(w, errors.New("goal_id required"), http.StatusBadRequest)
+		return
+	}
+
+	opts := CampaignOptions{
+		Attribution:    r.URL.Query().Get("attribution"),
+		BySourceMedium: r.URL.Query().Get("breakdown") == "source_medium",
+	}
+	switch opts.Attribution {
+	case "":
+		opts.Attribution = "first"
+	case "first", "last":
+	default:
+		writeError(w, errors.New("attribution must be first or last"), http.StatusBadRequest)
+		return
+	}
+
+	if h.goals == nil {
+		writeError(w, ErrGoalNotFound, http.StatusNotFound)
+		return
+	}
+	goal, err := h.goals.GoalDef(goalID, domain)
+	if errors.Is(err, ErrGoalNotFound) {
+		writeError(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Goals on the purchase event report the revenue of converted sessions too
+	ctx, _, revenueKey, err := h.revenueContext(ctx, domain)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if _, ok := goalRevenue(ctx, goal); ok {
+		filterKey += "|" + revenueKey
+	}
+
+	cacheKey := fmt.Sprintf("campaign-conversions:%s:%s:%s:%s:%t:%d:%s", domain, r.URL.Query().Get("period"), goalID, opts.Attribution, opts.BySourceMedium, limit, filterKey)
+	var data []CampaignConversion
+	if h.cacheGet(r.Context(), cacheKey, &data) {
 		writeJSON(w, data)
 		return
 	}
 
-	data, err := h.store.GetUniquePages(r.Context(), domain, from, to, limit)
+	data, err = h.store.GetCampaignConversions(ctx, domain, goal, from, to, opts, limit)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
-	h.cache.Set(cacheKey, data)
+	h.cacheSet(ctx, cacheKey, data)
 	writeJSON(w, data)
 }
 
@@ -415,29 +1408,36 @@ func (h *Handler) HandleAutocaptureEvents(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 	limit := parseLimit(r, 100)
 
-	cacheKey := fmt.Sprintf("autocapture-events:%s:%s:%d", domain, r.URL.Query().Get("period"), limit)
+	cacheKey := fmt.Sprintf("autocapture-events:%s:%s:%d:%s", domain, r.URL.Query().Get("period"), limit, filterKey)
 	var data []AutocaptureEvent
-	if h.cache.Get(cacheKey, &data) {
+	if h.cacheGet(r.Context(), cacheKey, &data) {
 		writeJSON(w, data)
 		return
 	}
 
-	data, err := h.store.GetAutocaptureEvents(r.Context(), domain, from, to, limit)
+	data, err := h.store.GetAutocaptureEvents(ctx, domain, from, to, limit)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
-	h.cache.Set(cacheKey, data)
+	h.cacheSet(ctx, cacheKey, data)
 	writeJSON(w, data)
 }
 
 // FunnelAdvancedRequest is the request body for advanced funnel
 type FunnelAdvancedRequest struct {
-	Steps  []FunnelStepDef `json:"steps"`
-	Window int             `json:"window"` // minutes
+	Steps  []funnel.Step `json:"steps"`
+	Window int           `json:"window"` // minutes
 }
 
 // FunnelPageInit returns pages + events in one request
@@ -452,13 +1452,20 @@ func (h *Handler) HandleFunnelInit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 	limit := 100
 
 	// Check cache first
-	cacheKey := fmt.Sprintf("funnel-init:%s:%s", domain, r.URL.Query().Get("period"))
+	cacheKey := fmt.Sprintf("funnel-init:%s:%s:%s", domain, r.URL.Query().Get("period"), filterKey)
 	var cached FunnelPageInit
-	if h.cache.Get(cacheKey, &cached) {
+	if h.cacheGet(r.Context(), cacheKey, &cached) {
 		writeJSON(w, cached)
 		return
 	}
@@ -471,12 +1478,12 @@ func (h *Handler) HandleFunnelInit(w http.ResponseWriter, r *http.Request) {
 	done := make(chan bool, 2)
 
 	go func() {
-		pages, pagesErr = h.store.GetUniquePages(r.Context(), domain, from, to, limit)
+		pages, pagesErr = h.store.GetUniquePages(ctx, domain, from, to, limit)
 		done <- true
 	}()
 
 	go func() {
-		events, eventsErr = h.store.GetAutocaptureEvents(r.Context(), domain, from, to, limit)
+		events, eventsErr = h.store.GetAutocaptureEvents(ctx, domain, from, to, limit)
 		done <- true
 	}()
 
@@ -489,10 +1496,10 @@ func (h *Handler) HandleFunnelInit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	result := FunnelPageInit{
-		Pages:  pages,
-		Events: events,
+		Pages:  emptyIfNil(pages),
+		Events: emptyIfNil(events),
 	}
-	h.cache.Set(cacheKey, result)
+	h.cacheSet(ctx, cacheKey, result)
 	writeJSON(w, result)
 }
 
@@ -507,26 +1514,45 @@ func (h *Handler) HandleFunnelAdvanced(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	domain, from, to := parseParams(r)
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, _, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
 
 	var req FunnelAdvancedRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, err, http.StatusBadRequest)
+	if err := reqbody.Decode(w, r, &req); err != nil {
+		reqbody.Write(w, err)
 		return
 	}
-
-	if len(req.Steps) < 2 {
-		writeError(w, nil, http.StatusBadRequest)
+	if err := reqbody.Invalid(funnel.ValidateSteps(req.Steps)...); err != nil {
+		reqbody.Write(w, err)
 		return
 	}
+	req.Steps = funnel.NormalizeSteps(req.Steps)
 
 	// Default window to 60 minutes if not specified
 	window := req.Window
 	if window <= 0 {
 		window = 60
 	}
+	// Visitors who entered before the range don't inflate its conversion
+	// unless cohort=any asks for the steps completed during the range
+	cohort, err := ParseFunnelCohort(r.URL.Query().Get("cohort"), CohortEntry)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx = WithFunnelCohort(ctx, cohort)
+	if err := h.checkFunnelRange(ctx, r.URL.Path, from, to, window); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
 
-	data, err := h.store.GetFunnelAdvanced(r.Context(), domain, from, to, req.Steps, window)
+	data, err := h.store.GetFunnelAdvanced(ctx, domain, from, to, req.Steps, window)
 	if err != nil {
 		writeError(w, err, http.StatusInternalServerError)
 		return
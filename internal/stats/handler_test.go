@@ -1,18 +1,27 @@
 package stats
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/access"
 )
 
 func TestParseParams_Default(t *testing.T) {
-	req := httptest.NewRequest("GET", "/api/stats/overview", nil)
-	domain, from, to := parseParams(req)
+	req := httptest.NewRequest("GET", "/api/stats/overview?domain=example.com", nil)
+	domain, from, to, err := parseParams(req, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if domain != "shortid.me" {
-		t.Errorf("domain = %s, want shortid.me", domain)
+	if domain != "example.com" {
+		t.Errorf("domain = %s, want example.com", domain)
 	}
 
 	expectedFrom := time.Now().UTC().AddDate(0, 0, -7)
@@ -26,8 +35,11 @@ func TestParseParams_Default(t *testing.T) {
 }
 
 func TestParseParams_CustomDomain(t *testing.T) {
-	req := httptest.NewRequest("GET", "/api/stats/overview?domain=example.com", nil)
-	domain, _, _ := parseParams(req)
+	req := httptest.NewRequest("GET", "/api/stats/overview?domain=+example.com+", nil)
+	domain, _, _, err := parseParams(req, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if domain != "example.com" {
 		t.Errorf("domain = %s, want example.com", domain)
@@ -40,29 +52,217 @@ func TestParseParams_Periods(t *testing.T) {
 		expectedAge int // days ago
 	}{
 		{"today", 0},
+		{"yesterday", 1},
 		{"7d", 7},
 		{"30d", 30},
+		{"this_month", 0},
+		{"last_month", 0},
 		{"90d", 90},
+		{"last_12_months", 0},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.period, func(t *testing.T) {
-			req := httptest.NewRequest("GET", "/api/stats/overview?period="+tt.period, nil)
-			_, from, to := parseParams(req)
+			req := httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period="+tt.period, nil)
+			_, from, to, err := parseParams(req, true, false)
+			if err != nil {
+				t.Fatal(err)
+			}
 
 			diff := int(to.Sub(from).Hours() / 24)
-			if tt.period == "today" {
-				// today is special - from start of day
+			switch tt.period {
+			case "today", "yesterday":
 				if from.Hour() != 0 || from.Minute() != 0 {
-					t.Errorf("today should start at midnight")
+					t.Errorf("%s should start at midnight", tt.period)
+				}
+				if tt.period == "yesterday" && diff != 1 {
+					t.Errorf("yesterday: diff = %d days, want 1", diff)
+				}
+			case "this_month", "last_month", "last_12_months":
+				// Calendar months, whatever their length
+				if from.Day() != 1 || from.Hour() != 0 {
+					t.Errorf("%s should start on the first of a month: %v", tt.period, from)
+				}
+			default:
+				if diff != tt.expectedAge {
+					t.Errorf("period %s: diff = %d days, want %d", tt.period, diff, tt.expectedAge)
+				}
+			}
+		})
+	}
+
+	// hour_offset moves today to the caller's midnight
+	req := httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period=today&hour_offset=-5", nil)
+	_, from, _, err := parseParams(req, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local := from.In(time.FixedZone("", -5*60*60)); local.Hour() != 0 || from.Hour() != 5 {
+		t.Errorf("today at -5 starts at %v", from)
+	}
+}
+
+func TestPeriodRangeWeek_Calendar(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	utc := func(s string) time.Time {
+		t.Helper()
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	// 20:30 on March 1st 2024 in New York, already March 2nd in UTC
+	now := time.Date(2024, 3, 1, 20, 30, 0, 0, newYork)
+	tests := []struct {
+		period   string
+		now      time.Time
+		from, to string
+	}{
+		{"today", now, "2024-03-01T05:00:00Z", "2024-03-02T01:30:00Z"},
+		{"today", now.UTC(), "2024-03-02T00:00:00Z", "2024-03-02T01:30:00Z"},
+		{"yesterday", now, "2024-02-29T05:00:00Z", "2024-03-01T05:00:00Z"},
+		{"this_month", now, "2024-03-01T05:00:00Z", "2024-03-02T01:30:00Z"},
+		{"last_month", now, "2024-02-01T05:00:00Z", "2024-03-01T05:00:00Z"},
+		{"last_month", now.UTC(), "2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z"},
+		// The range spans the DST change of March 10th: midnight moves to 04:00 UTC
+		{"this_month", time.Date(2024, 3, 31, 12, 0, 0, 0, newYork), "2024-03-01T05:00:00Z", "2024-03-31T16:00:00Z"},
+		{"last_month", time.Date(2024, 4, 15, 12, 0, 0, 0, newYork), "2024-03-01T05:00:00Z", "2024-04-01T04:00:00Z"},
+		// January wraps to the previous year
+		{"last_month", time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC), "2023-12-01T00:00:00Z", "2024-01-01T00:00:00Z"},
+		{"yesterday", time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC), "2023-12-31T00:00:00Z", "2024-01-01T00:00:00Z"},
+		{"last_12_months", time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC), "2023-04-01T00:00:00Z", "2024-03-15T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		from, to, err := PeriodRangeWeek(tt.period, tt.now, WeekStartMonday)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !from.Equal(utc(tt.from)) || !to.Equal(utc(tt.to)) {
+			t.Errorf("%s at %v = %v to %v, want %s to %s", tt.period, tt.now, from, to, tt.from, tt.to)
+		}
+		if from.Location() != time.UTC || to.Location() != time.UTC {
+			t.Errorf("%s: range is not in UTC", tt.period)
+		}
+	}
+}
+
+func TestReportingLocation(t *testing.T) {
+	tests := []struct {
+		query   string
+		offset  int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"hour_offset=0", 0, false},
+		{"hour_offset=-5", -5 * 60 * 60, false},
+		{"hour_offset=%2B14", 14 * 60 * 60, false},
+		{"tz=Asia/Tokyo&hour_offset=-5", 9 * 60 * 60, false},
+		{"hour_offset=15", 0, true},
+		{"hour_offset=5.5", 0, true},
+		{"tz=Mars/Olympus", 0, true},
+	}
+	for _, tt := range tests {
+		loc, err := reportingLocation(httptest.NewRequest("GET", "/?"+tt.query, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v", tt.query, err)
+		}
+		if _, offset := time.Date(2024, 1, 1, 0, 0, 0, 0, loc).Zone(); offset != tt.offset {
+			t.Errorf("%s: offset = %d, want %d", tt.query, offset, tt.offset)
+		}
+	}
+}
+
+func TestParseParams_Strict(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		demo    bool
+		wantErr string
+		domain  string
+	}{
+		{"unknown period", "?domain=example.com&period=7days", false, "valid options: today, yesterday, this_week, 7d, 30d, this_month, last_month, 90d, last_12_months", ""},
+		{"missing domain", "", false, "domain is required", ""},
+		{"bad hour_offset", "?domain=example.com&period=today&hour_offset=abc", false, "hour_offset must be", ""},
+		{"empty domain", "?domain=", false, "domain must not be empty", ""},
+		{"blank domain", "?domain=%20%20", false, "domain must not be empty", ""},
+		{"blank domain demo", "?domain=%20", true, "domain must not be empty", ""},
+		{"missing domain demo", "", true, "", DemoDomain},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/stats/overview"+tt.query, nil)
+			domain, _, _, err := parseParams(req, true, tt.demo)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
 				}
-			} else if diff != tt.expectedAge {
-				t.Errorf("period %s: diff = %d days, want %d", tt.period, diff, tt.expectedAge)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if domain != tt.domain {
+				t.Errorf("domain = %s, want %s", domain, tt.domain)
 			}
 		})
 	}
 }
 
+func TestParseParams_Lenient(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/stats/overview?period=7days", nil)
+	domain, from, to, err := parseParams(req, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain != DemoDomain {
+		t.Errorf("domain = %s, want %s", domain, DemoDomain)
+	}
+	if diff := int(to.Sub(from).Hours() / 24); diff != 7 {
+		t.Errorf("diff = %d days, want 7", diff)
+	}
+}
+
+type fakeRoles string
+
+func (f fakeRoles) RequestRole(r *http.Request) string { return string(f) }
+
+func TestRequestParams_Demo(t *testing.T) {
+	h := NewHandler(fakeStore{})
+
+	rec := httptest.NewRecorder()
+	h.HandleOverview(rec, httptest.NewRequest("GET", "/api/stats/overview", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("anonymous without domain: status = %d, want 400", rec.Code)
+	}
+
+	h.SetRoleSource(fakeRoles("demo"))
+	if _, _, _, ok := h.requestParams(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/stats/overview", nil)); !ok {
+		t.Error("demo without domain should default")
+	}
+}
+
+func TestRequestParams_Policy(t *testing.T) {
+	h := NewHandler(fakeStore{})
+	demo := access.Policy{AllowedDomains: []string{DemoDomain}}
+
+	for domain, code := range map[string]int{"example.com": http.StatusForbidden, DemoDomain: http.StatusOK} {
+		req := httptest.NewRequest("GET", "/api/stats/overview?domain="+domain, nil)
+		rec := httptest.NewRecorder()
+		_, _, _, ok := h.requestParams(rec, req.WithContext(access.WithPolicy(req.Context(), demo)))
+		if ok != (code == http.StatusOK) || rec.Code != code {
+			t.Errorf("%s: ok = %v, status = %d, want %d", domain, ok, rec.Code, code)
+		}
+	}
+	if _, _, _, ok := h.requestParams(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/stats/overview?domain=example.com", nil)); !ok {
+		t.Error("request without a policy was refused")
+	}
+}
+
 func TestParseLimit(t *testing.T) {
 	tests := []struct {
 		query    string
@@ -98,6 +298,9 @@ func TestSplitSteps(t *testing.T) {
 		{"single", []string{"single"}},
 		{"", []string{}},
 		{"/path/with/slash,/other", []string{"/path/with/slash", "/other"}},
+		{"/a,", []string{"/a"}},
+		{"/a,,/b", []string{"/a", "", "/b"}},
+		{"event:Café,/ü", []string{"event:Café", "/ü"}},
 	}
 
 	for _, tt := range tests {
@@ -185,3 +388,344 @@ func TestWriteError(t *testing.T) {
 		})
 	}
 }
+
+type fakeSegments map[string]Filters
+
+func (f fakeSegments) SegmentFilters(id, domain string) (Filters, error) {
+	filters, ok := f[domain+"/"+id]
+	if !ok {
+		return Filters{}, ErrSegmentNotFound
+	}
+	return filters, nil
+}
+
+func TestFilterContext_Segment(t *testing.T) {
+	h := &Handler{segments: fakeSegments{
+		"example.com/seg1": {Country: "DE", Device: "mobile"},
+	}}
+
+	req := httptest.NewRequest("GET", "/api/stats/overview?segment_id=seg1&device=desktop", nil)
+	w := httptest.NewRecorder()
+	ctx, key, ok := h.filterContext(w, req, "example.com", time.Time{}, time.Time{})
+	if !ok {
+		t.Fatalf("filterContext failed: %d %s", w.Code, w.Body.String())
+	}
+
+	f := filtersFromContext(ctx)
+	if f.Country != "DE" || f.Device != "desktop" {
+		t.Errorf("filters = %+v, want segment country with inline device", f)
+	}
+	if key != f.Key() {
+		t.Errorf("cache key %q should be the resolved filter key %q", key, f.Key())
+	}
+}
+
+func TestFilterContext_SegmentOtherDomain(t *testing.T) {
+	h := &Handler{segments: fakeSegments{
+		"example.com/seg1": {Country: "DE"},
+	}}
+
+	req := httptest.NewRequest("GET", "/api/stats/overview?segment_id=seg1", nil)
+	w := httptest.NewRecorder()
+	if _, _, ok := h.filterContext(w, req, "other.com", time.Time{}, time.Time{}); ok {
+		t.Fatal("segment from another domain should not resolve")
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+type fakeAnnotations []Annotation
+
+func (f fakeAnnotations) AnnotationsInRange(domain string, from, to time.Time) ([]Annotation, error) {
+	return f, nil
+}
+
+func TestWritePageviews_Annotations(t *testing.T) {
+	h := &Handler{annotations: fakeAnnotations{{Date: "2024-01-10", Label: "v2 launch"}}}
+	points := []TimeSeriesPoint{{Time: "2024-01-10", Value: 5}}
+
+	req := httptest.NewRequest("GET", "/api/stats/pageviews?include_annotations=true", nil)
+	w := httptest.NewRecorder()
+	h.writePageviews(w, req, "example.com", time.Now(), time.Now(), "day", points, nil, nil)
+
+	var body struct {
+		Interval    string            `json:"interval"`
+		Points      []TimeSeriesPoint `json:"points"`
+		Annotations []Annotation      `json:"annotations"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if body.Interval != "day" || len(body.Points) != 1 || len(body.Annotations) != 1 || body.Annotations[0].Label != "v2 launch" {
+		t.Errorf("body = %s", w.Body.String())
+	}
+
+	// Without the flag the envelope only has the series
+	req = httptest.NewRequest("GET", "/api/stats/pageviews", nil)
+	w = httptest.NewRecorder()
+	h.writePageviews(w, req, "example.com", time.Now(), time.Now(), "day", points, nil, nil)
+	if interval, got := decodePageviews(t, w.Body.Bytes()); interval != "day" || len(got) != 1 {
+		t.Errorf("body = %s", w.Body.String())
+	}
+
+	// legacy=true keeps the bare array
+	req = httptest.NewRequest("GET", "/api/stats/pageviews?legacy=true", nil)
+	w = httptest.NewRecorder()
+	h.writePageviews(w, req, "example.com", time.Now(), time.Now(), "day", points, nil, nil)
+	if w.Body.String()[0] != '[' {
+		t.Errorf("expected bare array, got %s", w.Body.String())
+	}
+}
+
+// decodePageviews decodes the pageviews envelope
+func decodePageviews(t *testing.T, body []byte) (string, []TimeSeriesPoint) {
+	t.Helper()
+	var envelope struct {
+		Interval string            `json:"interval"`
+		Points   []TimeSeriesPoint `json:"points"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatalf("invalid pageviews envelope: %v: %s", err, body)
+	}
+	return envelope.Interval, envelope.Points
+}
+
+// fakeStore satisfies StoreInterface; tests embed it and override what they need
+type fakeStore struct {
+	StoreInterface
+}
+
+func (fakeStore) Status() StoreStatus { return StoreStatus{} }
+func (fakeStore) GetDataGaps(ctx context.Context, domain string, from, to time.Time) ([]DataGap, error) {
+	return nil, nil
+}
+func (fakeStore) GetFreshness(ctx context.Context, domain string) (Freshness, error) {
+	return Freshness{Domain: domain}, nil
+}
+func (fakeStore) GetFirstEventAt(ctx context.Context, domain string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+// emptyStore answers like a store for a project that has not sent events yet
+type emptyStore struct {
+	fakeStore
+	first time.Time
+}
+
+func (emptyStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	return &Overview{}, nil
+}
+func (emptyStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetSourceBuckets(ctx context.Context, domain string, from, to time.Time, limit int) ([]SourceBucket, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopBrowsers(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopDevices(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopLanguages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetScreenSizes(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopCountries(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopUTMSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopUTMMediums(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetTopUTMCampaigns(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetUniquePages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, nil
+}
+func (emptyStore) GetErrorPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]ErrorPage, error) {
+	return nil, nil
+}
+func (emptyStore) GetAutocaptureEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]AutocaptureEvent, error) {
+	return nil, nil
+}
+func (emptyStore) GetSearchEngines(ctx context.Context, domain string, from, to time.Time, limit int) ([]SearchEngineItem, error) {
+	return nil, nil
+}
+func (s emptyStore) GetFirstEventAt(ctx context.Context, domain string) (time.Time, error) {
+	return s.first, nil
+}
+
+func TestHandlers_EmptyDomainListsAreEmpty(t *testing.T) {
+	h := NewHandler(emptyStore{})
+	for _, tt := range []struct {
+		path    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{"/api/stats/pages", h.HandlePages, `[]`},
+		{"/api/stats/sources", h.HandleSources, `[]`},
+		{"/api/stats/sources?classify=true", h.HandleSources, `[]`},
+		{"/api/stats/geo", h.HandleGeo, `[]`},
+		{"/api/stats/search", h.HandleSearch, `[]`},
+		{"/api/stats/unique-pages", h.HandleUniquePages, `[]`},
+		{"/api/stats/errors", h.HandleErrorPages, `[]`},
+		{"/api/stats/autocapture-events", h.HandleAutocaptureEvents, `[]`},
+		{"/api/stats/devices", h.HandleDevices, `{"browsers":[],"devices":[]}`},
+		{"/api/stats/devices?include=languages,screens", h.HandleDevices, `{"browsers":[],"devices":[],"languages":[],"screens":[]}`},
+		{"/api/stats/devices?include=screens", h.HandleDevices, `{"browsers":[],"devices":[],"screens":[]}`},
+		{"/api/stats/utm", h.HandleUTM, `{"sources":[],"mediums":[],"campaigns":[]}`},
+		{"/api/stats/funnel-init", h.HandleFunnelInit, `{"pages":[],"events":[]}`},
+	} {
+		sep := "?"
+		if strings.Contains(tt.path, "?") {
+			sep = "&"
+		}
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest("GET", tt.path+sep+"domain=new.example.com", nil))
+		if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s: %d %s, want %s", tt.path, w.Code, got, tt.want)
+		}
+	}
+}
+
+func TestHandlePageviews_EmptyDomainZeroFilled(t *testing.T) {
+	h := NewHandler(emptyStore{})
+	for _, tt := range []struct {
+		query  string
+		points int
+	}{
+		{"period=7d", 7 * 24},
+		{"period=7d&include_annotations=true", 7 * 24},
+		{"period=30d", 30},
+		{"period=30d&interval=hour", 30 * 24},
+	} {
+		w := httptest.NewRecorder()
+		h.HandlePageviews(w, httptest.NewRequest("GET", "/api/stats/pageviews?domain=new.example.com&"+tt.query, nil))
+		_, points := decodePageviews(t, w.Body.Bytes())
+		// The range starts mid-bucket, so it spans one more than its length
+		if len(points) != tt.points+1 {
+			t.Errorf("%s: %d points, want %d", tt.query, len(points), tt.points+1)
+		}
+		for i, p := range points {
+			if p.Value != 0 || (i > 0 && p.Time <= points[i-1].Time) {
+				t.Errorf("%s: point %d = %+v", tt.query, i, p)
+				break
+			}
+		}
+	}
+}
+
+func TestFillSeries(t *testing.T) {
+	from := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)
+	got := fillSeries([]TimeSeriesPoint{{"2024-03-01T12:00", 4}}, from, to, "hour")
+	want := []TimeSeriesPoint{{"2024-03-01T10:00", 0}, {"2024-03-01T11:00", 0}, {"2024-03-01T12:00", 4}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLocalSeries(t *testing.T) {
+	from := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	hourly := []TimeSeriesPoint{{"2024-03-01T05:00", 1}, {"2024-03-01T07:00", 2}}
+
+	got := localSeries(hourly, from, to, "hour", time.FixedZone("UTC-5", -5*60*60))
+	want := []TimeSeriesPoint{{"2024-03-01T00:00", 1}, {"2024-03-01T01:00", 0}, {"2024-03-01T02:00", 2}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("hours at -5 = %v, want %v", got, want)
+	}
+
+	// At +5:30 the range starts mid-hour and 07:00 UTC falls in 12:00 local
+	got = localSeries(hourly, from, to, "hour", time.FixedZone("IST", 5*60*60+30*60))
+	want = []TimeSeriesPoint{{"2024-03-01T10:00", 1}, {"2024-03-01T11:00", 0}, {"2024-03-01T12:00", 2}, {"2024-03-01T13:00", 0}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("hours at +5:30 = %v, want %v", got, want)
+	}
+
+	// 02:00 UTC on March 2nd is still March 1st at -5
+	to = time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)
+	got = localSeries(append(hourly, TimeSeriesPoint{"2024-03-02T02:00", 4}, TimeSeriesPoint{"2024-03-02T06:00", 8}), from, to, "day", time.FixedZone("UTC-5", -5*60*60))
+	want = []TimeSeriesPoint{{"2024-03-01", 7}, {"2024-03-02", 8}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("days at -5 = %v, want %v", got, want)
+	}
+}
+
+func TestHandlePageviews_IntervalCacheKey(t *testing.T) {
+	h := NewHandler(emptyStore{})
+	for _, tt := range []struct {
+		query, interval string
+		points          int
+	}{
+		{"period=7d", "hour", 7*24 + 1},
+		{"period=7d&interval=day", "day", 8},
+		{"period=7d", "hour", 7*24 + 1},
+		{"period=7d&interval=day&hour_offset=-5", "day", 8},
+	} {
+		w := httptest.NewRecorder()
+		h.HandlePageviews(w, httptest.NewRequest("GET", "/api/stats/pageviews?domain=new.example.com&"+tt.query, nil))
+		interval, points := decodePageviews(t, w.Body.Bytes())
+		if interval != tt.interval || len(points) != tt.points {
+			t.Errorf("%s: interval %q with %d points, want %q with %d", tt.query, interval, len(points), tt.interval, tt.points)
+		}
+	}
+}
+
+func TestHandleOverview_HasData(t *testing.T) {
+	overview := func(store StoreInterface) map[string]any {
+		w := httptest.NewRecorder()
+		NewHandler(store).HandleOverview(w, httptest.NewRequest("GET", "/api/stats/overview?domain=new.example.com", nil))
+		var body map[string]any
+		json.NewDecoder(w.Body).Decode(&body)
+		return body
+	}
+
+	body := overview(emptyStore{})
+	if body["has_data"] != false || body["pageviews"] != float64(0) {
+		t.Errorf("new domain: %v", body)
+	}
+	if _, ok := body["first_event_at"]; ok {
+		t.Errorf("new domain has first_event_at: %v", body)
+	}
+
+	// A domain with older events only still has data
+	body = overview(emptyStore{first: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)})
+	if body["has_data"] != true || body["first_event_at"] != "2024-05-01T08:00:00Z" {
+		t.Errorf("domain with events: %v", body)
+	}
+}
+
+func TestHandler_ForgetDomain(t *testing.T) {
+	h := NewHandler(fakeStore{})
+	h.SetBadgeSlugs(NewBadgeSlugs())
+	h.cache.Set("overview:gone.com:7d", 1)
+	h.cache.Set("overview:kept.com:7d", 2)
+	h.badgeCache.Set("badge:gone.com:2024-03", Badge{})
+
+	h.ForgetDomain("gone.com")
+	var v int
+	if h.cache.Get("overview:gone.com:7d", &v) {
+		t.Error("cached stats of the forgotten domain kept")
+	}
+	if !h.cache.Get("overview:kept.com:7d", &v) {
+		t.Error("cached stats of another domain dropped")
+	}
+	var b Badge
+	if h.badgeCache.Get("badge:gone.com:2024-03", &b) {
+		t.Error("cached badge of the forgotten domain kept")
+	}
+}
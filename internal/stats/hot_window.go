@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultHotDays is how many days of events the memory table holds unless
+// configured: most queries cover the last 30 days
+const defaultHotDays = 35
+
+// hotCutoff is where a load at now starts the memory table: hotRange before
+// the UTC midnight starting today, or zero to load everything. Whole days keep
+// the cutoff still between the refreshes of a day.
+func (s *Store) hotCutoff(now time.Time) time.Time {
+	if s.hotRange <= 0 {
+		return time.Time{}
+	}
+	return now.UTC().Truncate(24 * time.Hour).Add(-s.hotRange)
+}
+
+// hotCondition selects the events loaded into a memory table starting at
+// since; the plain comparison lets the scan skip older row groups, as in
+// tableSource. coldSource selects exactly the other events.
+func hotCondition(since time.Time) string {
+	if since.IsZero() {
+		return "true"
+	}
+	return fmt.Sprintf("timestamp >= make_timestamp(%d) AND epoch_us(timestamp) >= %d",
+		since.Add(-24*time.Hour).UnixMicro(), since.UnixMicro())
+}
+
+// coldSource is the part of [from, to) before st's memory table starts, read
+// from parquet with the transforms of a load, so queries answer the same
+// whichever side holds their events. A zero from or to leaves that end open.
+func (s *Store) coldSource(st *storeSnapshot, from, to time.Time) string {
+	end := st.hotSince
+	if !to.IsZero() && to.Before(end) {
+		end = to
+	}
+	cond := fmt.Sprintf("timestamp < make_timestamp(%d) AND epoch_us(timestamp) < %d",
+		end.Add(24*time.Hour).UnixMicro(), st.hotSince.UnixMicro())
+	if !from.IsZero() {
+		cond += fmt.Sprintf(" AND timestamp >= make_timestamp(%d)", from.Add(-24*time.Hour).UnixMicro())
+	}
+	scan, _ := s.ingestSource()
+	return fmt.Sprintf("(SELECT %s, %s FROM %s WHERE %s)", duckdbIngestColumns(s.timestamps.skew()), duckdbPropColumns(), scan, cond)
+}
+
+// coldFirstEvents memoizes each domain's first event in parquet before the
+// memory table, which only changes when the table's start moves on
+type coldFirstEvents struct {
+	mu    sync.Mutex
+	since time.Time
+	first map[string]time.Time
+}
+
+func (c *coldFirstEvents) reset() {
+	c.mu.Lock()
+	c.first = nil
+	c.mu.Unlock()
+}
+
+// coldFirstEventAt returns the first event of domain and the aliases ctx
+// carries before the memory table, or the zero time when they have none there. The caller holds the read lock.
+func (s *Store) coldFirstEventAt(ctx context.Context, st *storeSnapshot, domain string) (time.Time, error) {
+	c := &s.coldFirst
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.first != nil && c.since.Equal(st.hotSince) {
+		return earliest(c.first, queryDomains(ctx, domain)), nil
+	}
+
+	rows, err := s.queryContext(ctx, fmt.Sprintf(`
+		SELECT domain, MIN(timestamp)
+		FROM %s
+		WHERE domain IS NOT NULL
+		GROUP BY domain
+	`, s.coldSource(st, time.Time{}, time.Time{})))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rows.Close()
+	first := make(map[string]time.Time)
+	for rows.Next() {
+		var d string
+		var t time.Time
+		if err := rows.Scan(&d, &t); err != nil {
+			return time.Time{}, err
+		}
+		first[d] = t
+	}
+	if err := rows.Err(); err != nil {
+		return time.Time{}, err
+	}
+	c.first, c.since = first, st.hotSince
+	return earliest(first, queryDomains(ctx, domain)), nil
+}
+
+// earliest is the earliest first event of domains, zero when none has one
+func earliest(first map[string]time.Time, domains []string) time.Time {
+	var t time.Time
+	for _, d := range domains {
+		if f, ok := first[d]; ok && (t.IsZero() || f.Before(t)) {
+			t = f
+		}
+	}
+	return t
+}
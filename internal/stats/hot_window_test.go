@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// hotWindowStores loads the same parquet file into a store holding the whole
+// history in memory and one holding the last hotDays days
+func hotWindowStores(t *testing.T, now time.Time, hotDays int, events ...seedEvent) (full, hot *Store) {
+	t.Helper()
+	seeded := seedStore(t, now, events...)
+	path := filepath.Join(t.TempDir(), "events.parquet")
+	if _, err := seeded.db.Exec(fmt.Sprintf(`COPY raw_events TO '%s' (FORMAT PARQUET)`, path)); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(hotRange time.Duration) *Store {
+		s := seedStore(t, now)
+		s.state.Store(&storeSnapshot{ready: true, table: memoryTable})
+		s.parquetPath, s.hotRange = path, hotRange
+		if err := s.refreshMemoryTable(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	return load(0), load(time.Duration(hotDays) * 24 * time.Hour)
+}
+
+func TestStore_HotWindowConformance(t *testing.T) {
+	now := time.Now().UTC()
+	var events []seedEvent
+	for day := 0; day < 60; day++ {
+		for v := 0; v < 3; v++ {
+			visitor := fmt.Sprintf("v%d", (day+v)%7)
+			ago := daysAgo(day) + time.Duration(v*5+1)*time.Hour
+			events = append(events,
+				seedEvent{VisitorID: visitor, Pathname: []string{"/", "/pricing/", "/docs"}[v], Referrer: []string{"", "https://google.com/", "https://news.ycombinator.com/item"}[(day+v)%3],
+					Country: []string{"DE", "US", "FR"}[day%3], Browser: []string{"Chrome", "Firefox"}[v%2], Ago: ago},
+				seedEvent{VisitorID: visitor, Pathname: "/signup", Ago: ago - time.Minute},
+			)
+		}
+		if day%4 == 0 {
+			events = append(events, seedEvent{VisitorID: "v1", Name: "$autocapture", Props: `{"text":"Buy","tag":"button"}`, Ago: daysAgo(day)})
+			events = append(events, seedEvent{Domain: "other.com", VisitorID: "o1", Ago: daysAgo(day) + time.Hour})
+		}
+	}
+	full, hot := hotWindowStores(t, now, 10, events...)
+
+	var fullRows, hotRows int
+	full.db.QueryRow(`SELECT count(*) FROM events`).Scan(&fullRows)
+	hot.db.QueryRow(`SELECT count(*) FROM events`).Scan(&hotRows)
+	if hotRows >= fullRows || hotRows == 0 {
+		t.Fatalf("memory tables hold %d and %d events", fullRows, hotRows)
+	}
+	if st := hot.Status(); st.MemoryTableSince == "" {
+		t.Error("status doesn't report where the memory table starts")
+	}
+
+	ctx := WithFilters(context.Background(), Filters{})
+	ranges := map[string][2]time.Time{
+		"spanning": {now.Add(-daysAgo(30)), now},
+		"cold":     {now.Add(-daysAgo(50)), now.Add(-daysAgo(20))},
+		"hot":      {now.Add(-daysAgo(5)), now},
+		"boundary": {hot.snapshot().hotSince, now},
+	}
+	if o, _ := full.GetOverview(ctx, fixtureDomain, ranges["cold"][0], ranges["cold"][1]); o == nil || o.Pageviews == 0 {
+		t.Fatalf("no pageviews in the cold range: %+v", o)
+	}
+	if src := hot.tableSource(hot.snapshot(), ranges["spanning"][0], now); src == "events" {
+		t.Fatal("a range spanning the cutoff is read from the memory table alone")
+	}
+	for name, r := range ranges {
+		from, to := r[0], r[1]
+		queries := map[string]func(s *Store) (any, error){
+			"overview":  func(s *Store) (any, error) { return s.GetOverview(ctx, fixtureDomain, from, to) },
+			"series":    func(s *Store) (any, error) { return s.GetPageviewsTimeSeries(ctx, fixtureDomain, from, to, "day") },
+			"pages":     func(s *Store) (any, error) { return s.GetTopPages(ctx, fixtureDomain, from, to, 10) },
+			"sources":   func(s *Store) (any, error) { return s.GetTopSources(ctx, fixtureDomain, from, to, 10) },
+			"countries": func(s *Store) (any, error) { return s.GetTopCountries(ctx, fixtureDomain, from, to, 10) },
+			"browsers":  func(s *Store) (any, error) { return s.GetTopBrowsers(ctx, fixtureDomain, from, to, 10) },
+			"breakdown": func(s *Store) (any, error) { return s.GetEventBreakdown(ctx, fixtureDomain, from, to) },
+			"funnel": func(s *Store) (any, error) {
+				return s.GetFunnel(ctx, fixtureDomain, from, to, []string{"/pricing", "/signup"})
+			},
+			"autocapture": func(s *Store) (any, error) { return s.GetAutocaptureEvents(ctx, fixtureDomain, from, to, 10) },
+			"recent": func(s *Store) (any, error) {
+				return s.GetRecentEvents(ctx, fixtureDomain, from, to, 500, AllEventFields)
+			},
+		}
+		for query, run := range queries {
+			want, err := run(full)
+			if err != nil {
+				t.Fatalf("%s %s on the full table: %v", name, query, err)
+			}
+			got, err := run(hot)
+			if err != nil {
+				t.Fatalf("%s %s on the hot table: %v", name, query, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s:\n got %+v\nwant %+v", name, query, got, want)
+			}
+		}
+	}
+
+	for _, domain := range []string{fixtureDomain, "other.com"} {
+		want, err := full.GetFirstEventAt(ctx, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := hot.GetFirstEventAt(ctx, domain); err != nil || !got.Equal(want) {
+			t.Errorf("first event of %s = %v, %v; want %v", domain, got, err, want)
+		}
+	}
+	want, _ := full.GetActiveDomains(ctx, now.Add(-daysAgo(40)), 10)
+	if got, err := hot.GetActiveDomains(ctx, now.Add(-daysAgo(40)), 10); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("active domains = %v, %v; want %v", got, err, want)
+	}
+}
@@ -0,0 +1,77 @@
+package stats
+
+import (
+	"fmt"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// Display labels for values the tracker left empty. Both stores return raw
+// values and apply these in Go so DuckDB and ClickHouse report identical names.
+const (
+	LabelUnknown      = aggregate.LabelUnknown
+	LabelDirect       = aggregate.LabelDirect
+	LabelDirectTagged = aggregate.LabelDirectTagged
+	LabelDesktop      = aggregate.LabelDesktop
+)
+
+// duckdbReferrerHostExpr is the host of the referrer column in DuckDB, as
+// aggregate.ReferrerHost extracts it
+const duckdbReferrerHostExpr = `regexp_extract(COALESCE(referrer, ''), '` + aggregate.ReferrerHostPattern + `', 1)`
+
+// duckdbReferrerSourceExpr is the referrer host GetTopSources groups by in
+// DuckDB, like aggregate.ReferrerSource: referrers from the site's own domain,
+// the first of the domains bound to $1 (see duckdbDomains), or its subdomains
+// are internal and yield an empty source
+const duckdbReferrerSourceExpr = `CASE
+				WHEN ends_with('.' || ` + duckdbReferrerHostExpr + `, '.' || from_json($1, '["VARCHAR"]')[1]) THEN ''
+				ELSE ` + duckdbReferrerHostExpr + `
+			END`
+
+// clickhouseReferrerSourceExpr is duckdbReferrerSourceExpr for ClickHouse; its
+// placeholder takes the site's domain
+const clickhouseReferrerSourceExpr = `if(endsWith(concat('.', domain(ifNull(referrer, ''))), concat('.', ?)), '', domain(ifNull(referrer, '')))`
+
+// postgresReferrerHostExpr is duckdbReferrerHostExpr for Postgres
+const postgresReferrerHostExpr = `COALESCE((regexp_match(referrer, '` + aggregate.ReferrerHostPattern + `'))[1], '')`
+
+// postgresReferrerSourceExpr is duckdbReferrerSourceExpr for Postgres, where
+// $1 binds postgresDomains
+const postgresReferrerSourceExpr = `CASE
+				WHEN right('.' || ` + postgresReferrerHostExpr + `, length('.' || ($1::text[])[1])) = '.' || ($1::text[])[1] THEN ''
+				ELSE ` + postgresReferrerHostExpr + `
+			END`
+
+// duckdbLabelExpr is expr as dimension in DuckDB with the values
+// aggregate.Label gives one label merged: devices as their class, other values
+// trimmed. Breakdowns without overrides group by it, counting labels as groups.
+func duckdbLabelExpr(dimension, expr string) string {
+	if dimension == "device" {
+		return duckdbDeviceExpr(expr)
+	}
+	return fmt.Sprintf("trim(COALESCE(%s, ''))", expr)
+}
+
+// clickhouseLabelExpr is duckdbLabelExpr for ClickHouse
+func clickhouseLabelExpr(dimension, expr string) string {
+	if dimension == "device" {
+		return clickhouseDeviceExpr(expr)
+	}
+	return fmt.Sprintf("trimBoth(ifNull(%s, ''))", expr)
+}
+
+// postgresLabelExpr is duckdbLabelExpr for Postgres
+func postgresLabelExpr(dimension, expr string) string {
+	if dimension == "device" {
+		return postgresDeviceExpr(expr)
+	}
+	return fmt.Sprintf("trim(COALESCE(%s, ''))", expr)
+}
+
+// labelEvent applies display labels to the dimension fields of an event
+func labelEvent(e *EventItem) {
+	e.Country = aggregate.Label("country", e.Country)
+	e.Browser = aggregate.Label("browser", e.Browser)
+	e.OS = aggregate.Label("os", e.OS)
+	e.Device = aggregate.Label("device", e.Device)
+}
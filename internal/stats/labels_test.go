@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newLabelStore loads raw rows with the empty, NULL and mixed-case values both
+// backends see from the tracker
+func newLabelStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT *, '' AS utm_source, '' AS utm_medium FROM (VALUES
+			('example.com', 'v1', 'pageview', '', '/', '', NULL, 'Firefox', 'Linux', 'desktop', '', TIMESTAMP '2024-01-01 10:00:00'),
+			('example.com', 'v2', 'pageview', '', '/', 'https://user@google.com:443/search', 'DE', '', '', '', '', TIMESTAMP '2024-01-01 10:01:00'),
+			('example.com', 'v3', 'pageview', '', '/', 'https://example.com/blog', '', NULL, 'iOS', 'Mobile', '', TIMESTAMP '2024-01-01 10:02:00'),
+			('example.com', 'v4', 'pageview', '', '/', NULL, 'FR', 'Safari', 'iOS', 'mobile', '', TIMESTAMP '2024-01-01 10:03:00'),
+			('example.com', 'v5', 'pageview', '', '/', 'google.com', 'FR', 'Safari', 'macOS', NULL, '', TIMESTAMP '2024-01-01 10:04:00')
+		) t(domain, visitor_id, name, url, pathname, referrer, country, browser, os, device, props, timestamp)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+}
+
+func TestStoreLabels(t *testing.T) {
+	s := newLabelStore(t)
+	ctx := context.Background()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	devices, err := s.GetTopDevices(ctx, "example.com", from, to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []TopItem{{Name: "Desktop", Count: 3}, {Name: "Mobile", Count: 2}}; !reflect.DeepEqual(devices, want) {
+		t.Errorf("devices = %+v, want %+v", devices, want)
+	}
+
+	countries, err := s.GetTopCountries(ctx, "example.com", from, to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"Unknown": 2, "FR": 2, "DE": 1}; !reflect.DeepEqual(countsByName(countries), want) {
+		t.Errorf("countries = %+v, want %v", countries, want)
+	}
+
+	sources, err := s.GetTopSources(ctx, "example.com", from, to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []TopItem{{Name: "Direct", Count: 3}, {Name: "google.com", Count: 2}}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("sources = %+v, want %+v", sources, want)
+	}
+
+	events, err := s.GetRecentEvents(ctx, "example.com", from, to, 10, AllEventFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := events[3]
+	if v2.Country != "DE" || v2.Browser != "Unknown" || v2.OS != "Unknown" || v2.Device != "Desktop" {
+		t.Errorf("recent event labels = %+v", v2)
+	}
+
+	// The device filter accepts the display label and matches empty values as Desktop
+	ctx = WithFilters(ctx, Filters{Device: "Desktop"})
+	browsers, err := s.GetTopBrowsers(ctx, "example.com", from, to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"Firefox": 1, "Safari": 1, "Unknown": 1}; !reflect.DeepEqual(countsByName(browsers), want) {
+		t.Errorf("desktop browsers = %+v, want %v", browsers, want)
+	}
+}
+
+// countsByName ignores order, which SQL leaves unspecified between equal counts
+func countsByName(items []TopItem) map[string]int64 {
+	m := make(map[string]int64, len(items))
+	for _, item := range items {
+		m[item.Name] = item.Count
+	}
+	return m
+}
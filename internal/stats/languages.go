@@ -0,0 +1,11 @@
+package stats
+
+// duckdbLanguageExpr is the lowercased primary subtag of the lang prop in DuckDB
+// ("en-US" and "en_us" both give "en"); empty when the prop is missing
+const duckdbLanguageExpr = `regexp_extract(lower(trim(COALESCE(CASE WHEN json_valid(props) THEN json_extract_string(props, '$.lang') END, ''))), '^[a-z]*', 0)`
+
+// clickhouseLanguageExpr is duckdbLanguageExpr for ClickHouse
+const clickhouseLanguageExpr = `extract(lower(trimBoth(JSONExtractString(ifNull(props, ''), 'lang'))), '^[a-z]*')`
+
+// postgresLanguageExpr is duckdbLanguageExpr for Postgres
+const postgresLanguageExpr = `COALESCE((regexp_match(lower(trim(COALESCE(props->>'lang', ''))), '^([a-z]*)'))[1], '')`
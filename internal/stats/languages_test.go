@@ -0,0 +1,57 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newPropsStore loads pageviews carrying the lang and viewport_w props in the
+// shapes trackers send them, plus rows without them
+func newPropsStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, 'v' || i AS visitor_id, name, '' AS url, '/' AS pathname,
+			'' AS referrer, '' AS country, '' AS browser, '' AS os, '' AS device, props,
+			TIMESTAMP '2024-01-01 10:00:00' AS timestamp
+		FROM (VALUES
+			(1, 'pageview', '{"lang":"en-US","viewport_w":1280}'),
+			(2, 'pageview', '{"lang":"en-GB","viewport_w":"390"}'),
+			(3, 'pageview', '{"lang":"de","viewport_w":"1920.0"}'),
+			(4, 'pageview', '{"lang":"DE-at","viewport_w":" 800 "}'),
+			(5, 'pageview', '{"viewport_w":"wide"}'),
+			(6, 'pageview', ''),
+			(7, 'pageview', 'not json'),
+			(8, 'click', '{"lang":"fr","viewport_w":1500}')
+		) t(i, name, props)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+}
+
+func TestStore_GetTopLanguages(t *testing.T) {
+	s := newPropsStore(t)
+	ctx := WithFilters(context.Background(), Filters{})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	got, err := s.GetTopLanguages(ctx, "example.com", from, from.Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only pageviews count; rows without a lang prop are Unknown
+	want := map[string]int64{"English (en)": 2, "German (de)": 2, "Unknown": 3}
+	if !reflect.DeepEqual(countsByName(got), want) {
+		t.Errorf("languages = %+v, want %v", got, want)
+	}
+}
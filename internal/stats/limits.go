@@ -0,0 +1,81 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Size limits applied at query and response time. Lengths are in code points
+// (runes) so DuckDB left/length, ClickHouse leftUTF8/lengthUTF8 and Go agree.
+const (
+	// maxPathnameLen caps pathnames used as grouping keys; longer paths merge under one truncated key
+	maxPathnameLen = 500
+	// maxPropsBytes caps the props JSON returned per event
+	maxPropsBytes = 2048
+	// maxStoredFieldLen caps url, pathname and referrer when loading into the query table
+	maxStoredFieldLen = 2048
+	// maxStoredPropsLen drops props larger than this when loading; trimmed JSON would be unparseable
+	maxStoredPropsLen = 65536
+	// truncationMarker is appended to values cut by maxPathnameLen
+	truncationMarker = "…"
+)
+
+// duckdbPathExpr truncates a pathname expression to maxPathnameLen for grouping
+func duckdbPathExpr(expr string) string {
+	return fmt.Sprintf("CASE WHEN length(%[1]s) > %[2]d THEN left(%[1]s, %[2]d) || '%[3]s' ELSE %[1]s END",
+		expr, maxPathnameLen, truncationMarker)
+}
+
+// clickhousePathExpr truncates a pathname expression to maxPathnameLen for grouping
+func clickhousePathExpr(expr string) string {
+	return fmt.Sprintf("if(lengthUTF8(%[1]s) > %[2]d, concat(leftUTF8(%[1]s, %[2]d), '%[3]s'), %[1]s)",
+		expr, maxPathnameLen, truncationMarker)
+}
+
+// postgresPathExpr is duckdbPathExpr, whose functions Postgres has too
+func postgresPathExpr(expr string) string {
+	return duckdbPathExpr(expr)
+}
+
+// duckdbIngestColumns trims oversized fields, normalizes device classes and
+// clamps timestamps to within skew of received_at when copying parquet into
+// the events table
+func duckdbIngestColumns(skew time.Duration) string {
+	return fmt.Sprintf(`* REPLACE (
+			left(url, %[1]d) AS url,
+			left(pathname, %[1]d) AS pathname,
+			left(referrer, %[1]d) AS referrer,
+			CASE WHEN length(props) > %[2]d THEN '{}' ELSE %[4]s END AS props,
+			%[3]s AS device,
+			%[5]s AS timestamp
+		)`, maxStoredFieldLen, maxStoredPropsLen, duckdbDeviceExpr("device"),
+		duckdbClampedPropsExpr(skew), duckdbTimestampExpr(skew))
+}
+
+// clickhouseIngestColumns trims oversized fields, normalizes device classes and
+// clamps timestamps to within skew of received_at when syncing S3 into the
+// events table
+func clickhouseIngestColumns(skew time.Duration) string {
+	return fmt.Sprintf(`* REPLACE (
+			leftUTF8(url, %[1]d) AS url,
+			leftUTF8(pathname, %[1]d) AS pathname,
+			leftUTF8(referrer, %[1]d) AS referrer,
+			if(lengthUTF8(props) > %[2]d, '{}', %[4]s) AS props,
+			%[3]s AS device,
+			%[5]s AS timestamp
+		)`, maxStoredFieldLen, maxStoredPropsLen, clickhouseDeviceExpr("device"),
+		clickhouseClampedPropsExpr(skew), clickhouseTimestampExpr(skew))
+}
+
+// truncateBytes cuts s to at most max bytes without splitting a rune
+func truncateBytes(s string, max int) (string, bool) {
+	if len(s) <= max {
+		return s, false
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut], true
+}
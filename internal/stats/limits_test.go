@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateBytes(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            string
+		max           int
+		want          string
+		wantTruncated bool
+	}{
+		{"short", `{"a":1}`, 10, `{"a":1}`, false},
+		{"exact", "abcd", 4, "abcd", false},
+		{"ascii", "abcdef", 4, "abcd", true},
+		{"two-byte rune boundary", "aéé", 4, "aé", true}, // a(1) é(2) é(2): cutting at 4 would split the second é
+		{"three-byte rune", "€€", 4, "€", true},          // € is 3 bytes
+		{"four-byte rune", "😀x", 3, "", true},            // emoji is 4 bytes
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := truncateBytes(tt.in, tt.max)
+			if got != tt.want || truncated != tt.wantTruncated {
+				t.Errorf("truncateBytes(%q, %d) = %q, %v; want %q, %v", tt.in, tt.max, got, truncated, tt.want, tt.wantTruncated)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateBytes produced invalid UTF-8: %q", got)
+			}
+		})
+	}
+}
+
+func TestTruncateBytes_LargeProps(t *testing.T) {
+	props := `{"blob":"` + strings.Repeat("ü", maxPropsBytes) + `"}`
+	got, truncated := truncateBytes(props, maxPropsBytes)
+	if !truncated || len(got) > maxPropsBytes || !utf8.ValidString(got) {
+		t.Errorf("len = %d, truncated = %v, valid = %v", len(got), truncated, utf8.ValidString(got))
+	}
+}
+
+func TestPathExprs_Consistent(t *testing.T) {
+	duck := duckdbPathExpr("pathname")
+	ch := clickhousePathExpr("pathname")
+
+	// Both backends must cut at the same code point count with the same marker
+	for _, expr := range []string{duck, ch} {
+		if !strings.Contains(expr, "500") || !strings.Contains(expr, truncationMarker) {
+			t.Errorf("path expression missing limit or marker: %s", expr)
+		}
+	}
+	if !strings.Contains(ch, "leftUTF8") || !strings.Contains(ch, "lengthUTF8") {
+		t.Errorf("clickhouse expression must count code points, not bytes: %s", ch)
+	}
+}
@@ -0,0 +1,430 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// eventsStreamPath serves the live events stream; it is exempt from request deadlines
+	eventsStreamPath = "/api/stats/events/stream"
+	// liveHeartbeat is how often idle streams get a comment to keep proxies from closing them
+	liveHeartbeat = 15 * time.Second
+	// liveReplayWindow is how long batches stay available to reconnecting clients,
+	// and how long a domain keeps being polled after its last stream closes
+	liveReplayWindow = 5 * time.Minute
+	// liveReplayMaxEvents caps the events kept for replay per domain
+	liveReplayMaxEvents = 2000
+	// livePollLimit caps the events published per domain and refresh
+	livePollLimit = 1000
+	// livePollTimeout bounds the store queries of one refresh poll
+	livePollTimeout = 30 * time.Second
+	// liveSubscriberBuffer is how many batches a slow stream may fall behind before
+	// it is closed; the client reconnects and catches up from the replay buffer
+	liveSubscriberBuffer = 16
+	// DefaultLiveStreams caps concurrent live streams per process
+	DefaultLiveStreams = 200
+	// maxLiveStreamsPerDomain caps concurrent live streams per domain
+	maxLiveStreamsPerDomain = 20
+	// liveTimeLayout is the EventItem timestamp format
+	liveTimeLayout = "2006-01-02 15:04:05"
+)
+
+// errLiveStreamLimit is returned when no more live streams may be opened
+var errLiveStreamLimit = errors.New("too many live event streams, retry later")
+
+// liveBatch is a group of events published together; ID is the SSE event id
+type liveBatch struct {
+	ID     uint64
+	At     time.Time
+	Events []EventItem
+}
+
+// liveCursor is the newest event timestamp published for a domain, with how
+// often each event of that second was sent, so the next poll can start there
+type liveCursor struct {
+	ts   time.Time
+	seen map[EventItem]int
+}
+
+type liveDomain struct {
+	subs   map[chan liveBatch]struct{}
+	replay []liveBatch
+	cursor *liveCursor
+	// idleSince is when the last stream closed
+	idleSince time.Time
+}
+
+// liveHub fans newly observed events out to live streams, keeping recent
+// batches so reconnecting clients can resume from Last-Event-ID
+type liveHub struct {
+	mu      sync.Mutex
+	limit   int
+	streams int
+	seq     uint64
+	domains map[string]*liveDomain
+	polling bool
+	closed  bool
+	done    chan struct{}
+}
+
+func newLiveHub(limit int) *liveHub {
+	return &liveHub{limit: limit, domains: make(map[string]*liveDomain), done: make(chan struct{})}
+}
+
+// subscribe opens a stream of domain's batches, returning those newer than
+// lastID still in the replay buffer
+func (hub *liveHub) subscribe(domain string, lastID uint64) (chan liveBatch, []liveBatch, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return nil, nil, errLiveStreamLimit
+	}
+	d := hub.domains[domain]
+	if d == nil {
+		d = &liveDomain{subs: make(map[chan liveBatch]struct{})}
+		hub.domains[domain] = d
+	}
+	if hub.streams >= hub.limit || len(d.subs) >= maxLiveStreamsPerDomain {
+		return nil, nil, errLiveStreamLimit
+	}
+
+	var replay []liveBatch
+	// IDs above the current sequence come from before a restart
+	if lastID > 0 && lastID <= hub.seq {
+		for _, b := range d.replay {
+			if b.ID > lastID {
+				replay = append(replay, b)
+			}
+		}
+	}
+	ch := make(chan liveBatch, liveSubscriberBuffer)
+	d.subs[ch] = struct{}{}
+	hub.streams++
+	return ch, replay, nil
+}
+
+// unsubscribe closes a stream opened by subscribe
+func (hub *liveHub) unsubscribe(domain string, ch chan liveBatch) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	d := hub.domains[domain]
+	if d == nil {
+		return
+	}
+	if _, ok := d.subs[ch]; ok {
+		delete(d.subs, ch)
+		hub.streams--
+	}
+	if len(d.subs) == 0 {
+		d.idleSince = time.Now()
+	}
+}
+
+// needsCursor reports whether domain has no baseline to poll from yet
+func (hub *liveHub) needsCursor(domain string) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	d := hub.domains[domain]
+	return d == nil || d.cursor == nil
+}
+
+// setCursor sets domain's baseline unless one was set meanwhile
+func (hub *liveHub) setCursor(domain string, cur liveCursor) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if d := hub.domains[domain]; d != nil && d.cursor == nil {
+		d.cursor = &cur
+	}
+}
+
+// polled returns the domains to poll with their cursors, dropping domains idle
+// for longer than the replay window
+func (hub *liveHub) polled(now time.Time) map[string]liveCursor {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	result := make(map[string]liveCursor)
+	for domain, d := range hub.domains {
+		if len(d.subs) == 0 && now.Sub(d.idleSince) > liveReplayWindow {
+			delete(hub.domains, domain)
+			continue
+		}
+		if d.cursor != nil {
+			result[domain] = *d.cursor
+		}
+	}
+	return result
+}
+
+// publish sends events to domain's streams and keeps them for replay. Streams
+// too far behind are closed.
+func (hub *liveHub) publish(domain string, events []EventItem, cur *liveCursor) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	d := hub.domains[domain]
+	if d == nil || hub.closed {
+		return
+	}
+	if cur != nil {
+		d.cursor = cur
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	hub.seq++
+	batch := liveBatch{ID: hub.seq, At: time.Now(), Events: events}
+	d.replay = append(d.replay, batch)
+	kept := 0
+	for i := len(d.replay) - 1; i >= 0; i-- {
+		kept += len(d.replay[i].Events)
+		if kept > liveReplayMaxEvents || batch.At.Sub(d.replay[i].At) > liveReplayWindow {
+			d.replay = d.replay[i+1:]
+			break
+		}
+	}
+
+	for ch := range d.subs {
+		select {
+		case ch <- batch:
+		default:
+			delete(d.subs, ch)
+			hub.streams--
+			close(ch)
+		}
+	}
+}
+
+// close ends every stream; new ones are refused
+func (hub *liveHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if !hub.closed {
+		hub.closed = true
+		close(hub.done)
+	}
+}
+
+// EnableLiveEvents serves live event streams, diffing each domain's newest
+// events after every store refresh. limit caps concurrent streams.
+func (h *Handler) EnableLiveEvents(limit int) {
+	if h.store == nil {
+		return
+	}
+	if limit <= 0 {
+		limit = DefaultLiveStreams
+	}
+	h.live = newLiveHub(limit)
+	h.store.OnRefresh(h.pollLiveEvents)
+}
+
+// PublishLiveEvents pushes events of domain to its live streams directly, for
+// event sources that see events before the store does
+func (h *Handler) PublishLiveEvents(domain string, events []EventItem) {
+	if h.live != nil {
+		h.live.publish(domain, events, nil)
+	}
+}
+
+// CloseLiveStreams ends all live event and wallboard streams, for server shutdown
+func (h *Handler) CloseLiveStreams() {
+	if h.live != nil {
+		h.live.close()
+	}
+	if h.wallboard != nil {
+		h.wallboard.close()
+	}
+}
+
+// isStreamPath reports whether path serves a stream that stays open until
+// the client leaves
+func isStreamPath(path string) bool {
+	return path == eventsStreamPath || path == wallboardStreamPath
+}
+
+// pollLiveEvents publishes the events each streamed domain gained since its cursor
+func (h *Handler) pollLiveEvents() {
+	hub := h.live
+	hub.mu.Lock()
+	if hub.polling {
+		hub.mu.Unlock()
+		return
+	}
+	hub.polling = true
+	hub.mu.Unlock()
+	defer func() {
+		hub.mu.Lock()
+		hub.polling = false
+		hub.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), livePollTimeout)
+	defer cancel()
+	for domain, cur := range hub.polled(time.Now()) {
+		events, next, err := h.newLiveEvents(ctx, domain, cur)
+		if err != nil {
+			log.Printf("stats: live events of %s: %v", domain, err)
+			continue
+		}
+		hub.publish(domain, events, &next)
+	}
+}
+
+// newLiveEvents returns domain's events from cur on, oldest first, without
+// those already sent, and the cursor after them
+func (h *Handler) newLiveEvents(ctx context.Context, domain string, cur liveCursor) ([]EventItem, liveCursor, error) {
+	ctx, _, err := h.privacyContext(WithFilters(ctx, Filters{}), domain, "")
+	if err != nil {
+		return nil, cur, err
+	}
+	newest, err := collectEvents(func(fn func(EventItem) error) error {
+		return h.store.StreamRecentEvents(ctx, domain, cur.ts, time.Now().Add(time.Hour), livePollLimit, AllEventFields, fn)
+	})
+	if err != nil {
+		return nil, cur, err
+	}
+
+	// The store returns newest first; walk oldest first so the cursor only advances
+	skip := maps.Clone(cur.seen)
+	next := liveCursor{ts: cur.ts, seen: maps.Clone(cur.seen)}
+	if next.seen == nil {
+		next.seen = make(map[EventItem]int)
+	}
+	var events []EventItem
+	for i := len(newest) - 1; i >= 0; i-- {
+		e := newest[i]
+		ts, err := time.Parse(liveTimeLayout, e.Timestamp)
+		if err != nil || ts.Before(cur.ts) {
+			continue
+		}
+		if ts.Equal(cur.ts) && skip[e] > 0 {
+			skip[e]--
+			continue
+		}
+		if ts.After(next.ts) {
+			next = liveCursor{ts: ts, seen: make(map[EventItem]int)}
+		}
+		next.seen[e]++
+		events = append(events, e)
+	}
+	return events, next, nil
+}
+
+// liveBaseline returns a cursor after domain's newest event of the last day,
+// so streams only get events observed after they open
+func (h *Handler) liveBaseline(ctx context.Context, domain string) (liveCursor, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	newest, err := collectEvents(func(fn func(EventItem) error) error {
+		return h.store.StreamRecentEvents(WithFilters(ctx, Filters{}), domain, now.Add(-24*time.Hour), now.Add(time.Hour), 1, EventFields{"timestamp"}, fn)
+	})
+	if err != nil || len(newest) == 0 {
+		return liveCursor{ts: now}, err
+	}
+	ts, err := time.Parse(liveTimeLayout, newest[0].Timestamp)
+	if err != nil {
+		return liveCursor{ts: now}, nil
+	}
+	// Mark the events of the newest second as sent, so events of that second
+	// loaded later are still streamed
+	_, cur, err := h.newLiveEvents(ctx, domain, liveCursor{ts: ts})
+	return cur, err
+}
+
+// HandleEventsStream streams a domain's newly observed events as Server-Sent
+// Events, one "events" message per batch with a JSON array of events. Clients
+// reconnecting with Last-Event-ID get the batches they missed within
+// liveReplayWindow.
+func (h *Handler) HandleEventsStream(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil || h.live == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, _, _, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	var baseline *liveCursor
+	if h.live.needsCursor(domain) {
+		ctx, cancel := context.WithTimeout(r.Context(), livePollTimeout)
+		cur, err := h.liveBaseline(ctx, domain)
+		cancel()
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		baseline = &cur
+	}
+
+	ch, replay, err := h.live.subscribe(domain, lastID)
+	if err != nil {
+		w.Header().Set("Retry-After", "30")
+		writeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	defer h.live.unsubscribe(domain, ch)
+	if baseline != nil {
+		h.live.setCursor(domain, *baseline)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	send := func(b liveBatch) error {
+		data, err := json.Marshal(b.Events)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: events\ndata: %s\n\n", b.ID, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if _, err := io.WriteString(w, "retry: 5000\n\n"); err != nil {
+		return
+	}
+	for _, b := range replay {
+		if send(b) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.live.done:
+			io.WriteString(w, "event: close\ndata: {}\n\n")
+			rc.Flush()
+			return
+		case b, ok := <-ch:
+			if !ok || send(b) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package stats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// liveStore is a fake event source: events are added between refreshes
+type liveStore struct {
+	fakeStore
+	mu        sync.Mutex
+	events    []EventItem // oldest first
+	onRefresh []func()
+}
+
+func (s *liveStore) OnRefresh(fn func()) { s.onRefresh = append(s.onRefresh, fn) }
+
+func (s *liveStore) add(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := time.Now().UTC().Format(liveTimeLayout)
+	for _, n := range names {
+		s.events = append(s.events, EventItem{Name: n, Pathname: "/", Timestamp: ts})
+	}
+}
+
+func (s *liveStore) refresh() {
+	for _, fn := range s.onRefresh {
+		fn()
+	}
+}
+
+func (s *liveStore) StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields, fn func(EventItem) error) error {
+	s.mu.Lock()
+	events := append([]EventItem{}, s.events...)
+	s.mu.Unlock()
+	for i := len(events) - 1; i >= 0 && limit > 0; i-- {
+		ts, _ := time.Parse(liveTimeLayout, events[i].Timestamp)
+		if ts.Before(from) || !ts.Before(to) {
+			continue
+		}
+		if err := fn(events[i]); err != nil {
+			return err
+		}
+		limit--
+	}
+	return nil
+}
+
+// sseEvent is one parsed Server-Sent Events message
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSE parses messages from a stream, skipping comments and retry hints
+func readSSE(t *testing.T, resp *http.Response) <-chan sseEvent {
+	t.Helper()
+	ch := make(chan sseEvent)
+	go func() {
+		defer close(ch)
+		sc := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case line == "":
+				if ev.event != "" {
+					ch <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				ev.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				ev.data = line[6:]
+			}
+		}
+	}()
+	return ch
+}
+
+func nextSSE(t *testing.T, ch <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+func openStream(t *testing.T, url, lastID string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url+eventsStreamPath+"?domain=example.com", nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func batchNames(t *testing.T, ev sseEvent) string {
+	t.Helper()
+	var items []EventItem
+	if err := json.Unmarshal([]byte(ev.data), &items); err != nil {
+		t.Fatalf("data %q: %v", ev.data, err)
+	}
+	var names []string
+	for _, e := range items {
+		names = append(names, e.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestHandleEventsStream(t *testing.T) {
+	store := &liveStore{}
+	store.add("before")
+	h := NewHandler(store)
+	h.EnableLiveEvents(0)
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleEventsStream))
+	defer srv.Close()
+
+	resp := openStream(t, srv.URL, "")
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != "text/event-stream" {
+		t.Fatalf("status = %d, content type = %q", resp.StatusCode, ct)
+	}
+	events := readSSE(t, resp)
+
+	// Events already loaded when the stream opened are not sent
+	store.add("signup", "signup")
+	store.refresh()
+	first := nextSSE(t, events)
+	if first.event != "events" || batchNames(t, first) != "signup,signup" {
+		t.Fatalf("first batch = %+v", first)
+	}
+	store.add("purchase")
+	store.refresh()
+	second := nextSSE(t, events)
+	if batchNames(t, second) != "purchase" {
+		t.Fatalf("second batch = %+v", second)
+	}
+	resp.Body.Close()
+
+	// A reconnect resumes after the last batch it saw
+	resp = openStream(t, srv.URL, first.id)
+	defer resp.Body.Close()
+	events = readSSE(t, resp)
+	if replayed := nextSSE(t, events); replayed.id != second.id || batchNames(t, replayed) != "purchase" {
+		t.Errorf("replayed = %+v, want batch %s", replayed, second.id)
+	}
+
+	h.CloseLiveStreams()
+	if ev := nextSSE(t, events); ev.event != "close" {
+		t.Errorf("after shutdown got %+v, want close", ev)
+	}
+	if _, ok := <-events; ok {
+		t.Error("stream still open after shutdown")
+	}
+}
+
+func TestHandleEventsStream_Limit(t *testing.T) {
+	h := NewHandler(&liveStore{})
+	h.EnableLiveEvents(1)
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleEventsStream))
+	defer srv.Close()
+
+	resp := openStream(t, srv.URL, "")
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("first stream status = %d", resp.StatusCode)
+	}
+	second := openStream(t, srv.URL, "")
+	second.Body.Close()
+	if second.StatusCode != http.StatusServiceUnavailable || second.Header.Get("Retry-After") == "" {
+		t.Errorf("second stream status = %d, Retry-After %q", second.StatusCode, second.Header.Get("Retry-After"))
+	}
+}
+
+func TestNewLiveEvents_SameSecond(t *testing.T) {
+	store := &liveStore{}
+	h := NewHandler(store)
+	ts := time.Now().UTC().Truncate(time.Second)
+	click := EventItem{Name: "click", Timestamp: ts.Format(liveTimeLayout)}
+	store.events = []EventItem{click}
+
+	events, cur, err := h.newLiveEvents(context.Background(), "example.com", liveCursor{ts: ts.Add(-time.Minute)})
+	if err != nil || len(events) != 1 || !cur.ts.Equal(ts) {
+		t.Fatalf("events = %v, cursor = %v, err = %v", events, cur.ts, err)
+	}
+
+	// An identical event of the same second loaded later is still new
+	store.events = append(store.events, click)
+	events, cur, _ = h.newLiveEvents(context.Background(), "example.com", cur)
+	if len(events) != 1 || cur.seen[click] != 2 {
+		t.Errorf("events = %v, seen = %v", events, cur.seen)
+	}
+	if events, _, _ = h.newLiveEvents(context.Background(), "example.com", cur); len(events) != 0 {
+		t.Errorf("resent %v", events)
+	}
+}
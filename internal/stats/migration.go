@@ -0,0 +1,786 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+const (
+	// mirrorTimeout bounds a mirrored read on the secondary backend
+	mirrorTimeout = time.Minute
+	// maxMirrorDifferences caps the differences recorded per mismatch
+	maxMirrorDifferences = 10
+)
+
+// volatileFields are result fields that legitimately differ between backends,
+// such as timestamps formatted by the database and picks among ties; they
+// are neither compared nor used to match list items
+var volatileFields = map[string]bool{"last_seen": true, "top_referrer": true}
+
+// MigrationConfig tunes how a MigrationStore mirrors reads
+type MigrationConfig struct {
+	// SampleRate is the share of reads mirrored to the secondary, 0 to 1
+	SampleRate float64
+	// MaxConcurrent caps mirrored reads in flight; samples beyond it are dropped
+	MaxConcurrent int
+	// Tolerance is the relative difference allowed between two numbers
+	Tolerance float64
+	// MinOverlap is the share of list items both backends must return
+	MinOverlap float64
+	// LogSize is how many mismatches the diff log keeps
+	LogSize int
+}
+
+// DefaultMigrationConfig mirrors one read in ten and allows 2% drift, which
+// covers backends refreshing from S3 at different moments
+var DefaultMigrationConfig = MigrationConfig{
+	SampleRate:    0.1,
+	MaxConcurrent: 4,
+	Tolerance:     0.02,
+	MinOverlap:    0.8,
+	LogSize:       200,
+}
+
+// MigrationDiff is a mirrored read whose results differ, or that failed on
+// the secondary
+type MigrationDiff struct {
+	Time        string   `json:"time"`
+	Method      string   `json:"method"`
+	Domain      string   `json:"domain,omitempty"`
+	From        string   `json:"from,omitempty"`
+	To          string   `json:"to,omitempty"`
+	Params      string   `json:"params,omitempty"`
+	Filters     string   `json:"filters,omitempty"`
+	Differences []string `json:"differences,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// MigrationReport is the admin view of a migration: the mirror counters and
+// the most recent mismatches, newest first
+type MigrationReport struct {
+	Primary      string          `json:"primary"`
+	Secondary    string          `json:"secondary"`
+	SampleRate   float64         `json:"sample_rate"`
+	Tolerance    float64         `json:"tolerance"`
+	Mirrored     int64           `json:"mirrored"`
+	Matched      int64           `json:"matched"`
+	Mismatched   int64           `json:"mismatched"`
+	Failed       int64           `json:"failed"`
+	Dropped      int64           `json:"dropped"`
+	MismatchRate float64         `json:"mismatch_rate"`
+	Diffs        []MigrationDiff `json:"diffs"`
+}
+
+// MigrationStore answers every read from the primary backend and mirrors a
+// sample of them to the secondary, comparing the results, so a switch of
+// backends can be checked against production traffic. Mirrored reads never
+// delay the caller: within WithMirrors they start after the response is
+// written, elsewhere they run in the background.
+type MigrationStore struct {
+	primary   StoreInterface
+	secondary StoreInterface
+	cfg       MigrationConfig
+	sem       chan struct{}
+
+	mirrored, matched, mismatched, failed, dropped atomic.Int64
+
+	mu    sync.Mutex
+	diffs []MigrationDiff
+	next  int
+	full  bool
+}
+
+// NewMigrationStore mirrors reads of primary to secondary; zero fields of cfg
+// take their DefaultMigrationConfig values
+func NewMigrationStore(primary, secondary StoreInterface, cfg MigrationConfig) *MigrationStore {
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = DefaultMigrationConfig.SampleRate
+	}
+	cfg.SampleRate = math.Min(cfg.SampleRate, 1)
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = DefaultMigrationConfig.MaxConcurrent
+	}
+	if cfg.Tolerance <= 0 {
+		cfg.Tolerance = DefaultMigrationConfig.Tolerance
+	}
+	if cfg.MinOverlap <= 0 {
+		cfg.MinOverlap = DefaultMigrationConfig.MinOverlap
+	}
+	if cfg.LogSize <= 0 {
+		cfg.LogSize = DefaultMigrationConfig.LogSize
+	}
+	return &MigrationStore{
+		primary:   primary,
+		secondary: secondary,
+		cfg:       cfg,
+		sem:       make(chan struct{}, cfg.MaxConcurrent),
+		diffs:     make([]MigrationDiff, cfg.LogSize),
+	}
+}
+
+// mirrorQuery describes a read for the diff log
+type mirrorQuery struct {
+	method   string
+	domain   string
+	from, to time.Time
+	params   string
+}
+
+func newMirrorQuery(method, domain string, from, to time.Time, params ...any) mirrorQuery {
+	q := mirrorQuery{method: method, domain: domain, from: from, to: to}
+	parts := make([]string, 0, len(params)/2)
+	for i := 0; i+1 < len(params); i += 2 {
+		parts = append(parts, fmt.Sprintf("%v=%v", params[i], params[i+1]))
+	}
+	q.params = strings.Join(parts, " ")
+	return q
+}
+
+// mirrorRead runs read on the primary and, for a sample of successful reads,
+// schedules it on the secondary to compare with a snapshot of the result
+func mirrorRead[T any](s *MigrationStore, ctx context.Context, q mirrorQuery, read func(context.Context, StoreInterface) (T, error)) (T, error) {
+	result, err := read(ctx, s.primary)
+	if err != nil || rand.Float64() >= s.cfg.SampleRate {
+		return result, err
+	}
+	// Callers may change the result once it is returned, so it is compared as
+	// it was; a round trip through JSON is also what clients would see
+	snapshot, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		return result, err
+	}
+	mirrorCtx := context.WithoutCancel(ctx)
+	s.schedule(ctx, func() {
+		ctx, cancel := context.WithTimeout(mirrorCtx, mirrorTimeout)
+		defer cancel()
+		var want T
+		if err := json.Unmarshal(snapshot, &want); err != nil {
+			return
+		}
+		got, err := read(ctx, s.secondary)
+		s.record(ctx, q, want, got, err)
+	})
+	return result, err
+}
+
+type mirrorQueueKey struct{}
+
+// mirrorQueue holds the mirrored reads of a request until its response is written
+type mirrorQueue struct {
+	mu   sync.Mutex
+	jobs []func()
+	done bool
+}
+
+// WithMirrors holds back the mirrored reads of each request until the
+// response has been written
+func (s *MigrationStore) WithMirrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queue := &mirrorQueue{}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), mirrorQueueKey{}, queue)))
+		queue.mu.Lock()
+		jobs := queue.jobs
+		queue.jobs, queue.done = nil, true
+		queue.mu.Unlock()
+		for _, job := range jobs {
+			s.start(job)
+		}
+	})
+}
+
+// schedule queues job behind ctx's response, or starts it when there is none
+func (s *MigrationStore) schedule(ctx context.Context, job func()) {
+	if queue, ok := ctx.Value(mirrorQueueKey{}).(*mirrorQueue); ok {
+		queue.mu.Lock()
+		if !queue.done {
+			queue.jobs = append(queue.jobs, job)
+			queue.mu.Unlock()
+			return
+		}
+		queue.mu.Unlock()
+	}
+	s.start(job)
+}
+
+// start runs job in the background unless MaxConcurrent jobs are running,
+// in which case it is dropped
+func (s *MigrationStore) start(job func()) {
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		s.dropped.Add(1)
+		return
+	}
+	s.mirrored.Add(1)
+	go func() {
+		defer func() { <-s.sem }()
+		job()
+	}()
+}
+
+// record compares a mirrored read with the primary's result, logging mismatches
+func (s *MigrationStore) record(ctx context.Context, q mirrorQuery, want, got any, err error) {
+	var diffs []string
+	if err == nil {
+		c := resultComparer{tolerance: s.cfg.Tolerance, minOverlap: s.cfg.MinOverlap}
+		c.compare("", reflect.ValueOf(want), reflect.ValueOf(got))
+		if diffs = c.diffs; len(diffs) == 0 {
+			s.matched.Add(1)
+			return
+		}
+		s.mismatched.Add(1)
+	} else {
+		s.failed.Add(1)
+	}
+
+	diff := MigrationDiff{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		Method:      q.method,
+		Domain:      q.domain,
+		Params:      q.params,
+		Filters:     mirrorFilters(ctx),
+		Differences: diffs,
+	}
+	if !q.from.IsZero() {
+		diff.From = q.from.UTC().Format(time.RFC3339)
+	}
+	if !q.to.IsZero() {
+		diff.To = q.to.UTC().Format(time.RFC3339)
+	}
+	if err != nil {
+		diff.Error = err.Error()
+		log.Printf("Migration: %s %s on the secondary: %v", q.method, q.domain, err)
+	}
+	s.mu.Lock()
+	s.diffs[s.next] = diff
+	s.next = (s.next + 1) % len(s.diffs)
+	if s.next == 0 {
+		s.full = true
+	}
+	s.mu.Unlock()
+}
+
+// mirrorFilters describes the filters, prop filters and privacy mode of ctx
+func mirrorFilters(ctx context.Context) string {
+	var parts []string
+	if key := filtersFromContext(ctx).Key(); key != "" {
+		parts = append(parts, key)
+	}
+	if props, _ := ctx.Value(propFiltersKeyCtx{}).([]PropFilter); len(props) > 0 {
+		parts = append(parts, propFiltersKey(props))
+	}
+	if mode := privacyModeFromContext(ctx); mode != PrivacyOff {
+		parts = append(parts, "privacy="+string(mode))
+	}
+	return strings.Join(parts, "&")
+}
+
+// Report returns the mirror counters and logged mismatches
+func (s *MigrationStore) Report() MigrationReport {
+	report := MigrationReport{
+		Primary:    s.primary.Status().Backend,
+		Secondary:  s.secondary.Status().Backend,
+		SampleRate: s.cfg.SampleRate,
+		Tolerance:  s.cfg.Tolerance,
+		Mirrored:   s.mirrored.Load(),
+		Matched:    s.matched.Load(),
+		Mismatched: s.mismatched.Load(),
+		Failed:     s.failed.Load(),
+		Dropped:    s.dropped.Load(),
+		Diffs:      []MigrationDiff{},
+	}
+	if compared := report.Matched + report.Mismatched; compared > 0 {
+		report.MismatchRate = float64(report.Mismatched) / float64(compared)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.next
+	if s.full {
+		n = len(s.diffs)
+	}
+	for i := 1; i <= n; i++ {
+		report.Diffs = append(report.Diffs, s.diffs[(s.next-i+len(s.diffs))%len(s.diffs)])
+	}
+	return report
+}
+
+// HandleDiffs returns the migration report. Admin-only; wrapped by auth in main.
+func (s *MigrationStore) HandleDiffs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.Report())
+}
+
+// resultComparer collects the differences between two results of one read
+type resultComparer struct {
+	tolerance  float64
+	minOverlap float64
+	diffs      []string
+}
+
+func (c *resultComparer) add(path, format string, args ...any) {
+	if len(c.diffs) < maxMirrorDifferences {
+		if path == "" {
+			path = "result"
+		}
+		c.diffs = append(c.diffs, path+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+// compare walks want (the primary's result) and got (the secondary's)
+// together. Numbers may differ by the tolerance; lists are matched by
+// the string fields of their items and must overlap by minOverlap.
+func (c *resultComparer) compare(path string, want, got reflect.Value) {
+	if want.Kind() == reflect.Pointer || want.Kind() == reflect.Interface {
+		if want.IsNil() || got.IsNil() {
+			if want.IsNil() != got.IsNil() {
+				c.add(path, "nil in one backend only")
+			}
+			return
+		}
+		c.compare(path, want.Elem(), got.Elem())
+		return
+	}
+
+	switch want.Kind() {
+	case reflect.Struct:
+		if t, ok := want.Interface().(time.Time); ok {
+			if other := got.Interface().(time.Time); !t.Truncate(time.Second).Equal(other.Truncate(time.Second)) {
+				c.add(path, "%s vs %s", t.UTC().Format(time.RFC3339), other.UTC().Format(time.RFC3339))
+			}
+			return
+		}
+		fields := reflect.VisibleFields(want.Type())
+		for _, f := range fields {
+			name, ok := jsonFieldName(f)
+			if !ok || f.Anonymous || volatileFields[name] {
+				continue
+			}
+			c.compare(joinPath(path, name), want.FieldByIndex(f.Index), got.FieldByIndex(f.Index))
+		}
+	case reflect.Slice, reflect.Array:
+		c.compareList(path, want, got)
+	case reflect.String:
+		if want.String() != got.String() {
+			c.add(path, "%q vs %q", want.String(), got.String())
+		}
+	case reflect.Bool:
+		if want.Bool() != got.Bool() {
+			c.add(path, "%v vs %v", want.Bool(), got.Bool())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		c.compareNumber(path, float64(want.Int()), float64(got.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		c.compareNumber(path, float64(want.Uint()), float64(got.Uint()))
+	case reflect.Float32, reflect.Float64:
+		c.compareNumber(path, want.Float(), got.Float())
+	}
+}
+
+func (c *resultComparer) compareNumber(path string, want, got float64) {
+	if math.Abs(want-got) > c.tolerance*math.Max(math.Abs(want), math.Abs(got)) {
+		c.add(path, "%v vs %v", want, got)
+	}
+}
+
+// compareList matches the items of two lists by itemKey, ignoring order.
+// Lists of numbers, such as sparklines, are compared point by point.
+func (c *resultComparer) compareList(path string, want, got reflect.Value) {
+	switch want.Type().Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		if want.Len() != got.Len() {
+			c.add(path, "%d points vs %d", want.Len(), got.Len())
+			return
+		}
+		for i := 0; i < want.Len(); i++ {
+			c.compare(fmt.Sprintf("%s[%d]", path, i), want.Index(i), got.Index(i))
+		}
+		return
+	}
+
+	index := make(map[string]int, got.Len())
+	for i := 0; i < got.Len(); i++ {
+		index[itemKey(got.Index(i))] = i
+	}
+	var common int
+	var missing []string
+	for i := 0; i < want.Len(); i++ {
+		key := itemKey(want.Index(i))
+		j, ok := index[key]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		common++
+		delete(index, key)
+		c.compare(fmt.Sprintf("%s[%s]", path, key), want.Index(i), got.Index(j))
+	}
+	if longest := max(want.Len(), got.Len()); longest > 0 && float64(common)/float64(longest) < c.minOverlap {
+		extra := make([]string, 0, len(index))
+		for key := range index {
+			extra = append(extra, key)
+		}
+		sort.Strings(extra)
+		c.add(path, "%d of %d items in common; primary only %v, secondary only %v", common, longest, missing, extra)
+	}
+}
+
+// itemKey identifies a list item by its string values
+func itemKey(v reflect.Value) string {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Struct:
+		var parts []string
+		for _, f := range reflect.VisibleFields(v.Type()) {
+			name, ok := jsonFieldName(f)
+			if ok && !f.Anonymous && !volatileFields[name] && f.Type.Kind() == reflect.String {
+				parts = append(parts, v.FieldByIndex(f.Index).String())
+			}
+		}
+		return strings.Join(parts, "|")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// jsonFieldName returns the name a field is encoded under, and false for
+// fields JSON leaves out
+func jsonFieldName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return f.Name, true
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// Close closes both backends
+func (s *MigrationStore) Close() error {
+	err := s.primary.Close()
+	if serr := s.secondary.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Status is the primary's status, which readiness follows
+func (s *MigrationStore) Status() StoreStatus {
+	return s.primary.Status()
+}
+
+// OnRefresh follows the primary's refreshes, as reads come from it
+func (s *MigrationStore) OnRefresh(fn func()) {
+	s.primary.OnRefresh(fn)
+}
+
+// SetRefreshInterval applies to both backends so their data stays comparable
+func (s *MigrationStore) SetRefreshInterval(d time.Duration) {
+	s.primary.SetRefreshInterval(d)
+	s.secondary.SetRefreshInterval(d)
+}
+
+// EraseVisitor erases from both stores, so the secondary never serves the
+// visitor again; the count is the primary's
+func (s *MigrationStore) EraseVisitor(ctx context.Context, domain, visitorID string) (int64, error) {
+	n, err := s.primary.EraseVisitor(ctx, domain, visitorID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.secondary.EraseVisitor(ctx, domain, visitorID); err != nil {
+		return 0, fmt.Errorf("secondary: %w", err)
+	}
+	return n, nil
+}
+
+// GetDataGaps are the primary's, whose data reads come from
+func (s *MigrationStore) GetDataGaps(ctx context.Context, domain string, from, to time.Time) ([]DataGap, error) {
+	return s.primary.GetDataGaps(ctx, domain, from, to)
+}
+
+func (s *MigrationStore) GetActiveDomains(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetActiveDomains", "", since, time.Time{}, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]string, error) {
+			return store.GetActiveDomains(ctx, since, limit)
+		})
+}
+
+// GetFreshness follows the primary, as reads come from it
+func (s *MigrationStore) GetFreshness(ctx context.Context, domain string) (Freshness, error) {
+	return s.primary.GetFreshness(ctx, domain)
+}
+
+func (s *MigrationStore) GetFirstEventAt(ctx context.Context, domain string) (time.Time, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetFirstEventAt", domain, time.Time{}, time.Time{}),
+		func(ctx context.Context, store StoreInterface) (time.Time, error) {
+			return store.GetFirstEventAt(ctx, domain)
+		})
+}
+
+func (s *MigrationStore) GetDimensionValues(ctx context.Context, domain, column string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetDimensionValues", domain, from, to, "column", column, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetDimensionValues(ctx, domain, column, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetOverview", domain, from, to),
+		func(ctx context.Context, store StoreInterface) (*Overview, error) {
+			return store.GetOverview(ctx, domain, from, to)
+		})
+}
+
+func (s *MigrationStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetPageviewsTimeSeries", domain, from, to, "interval", interval),
+		func(ctx context.Context, store StoreInterface) ([]TimeSeriesPoint, error) {
+			return store.GetPageviewsTimeSeries(ctx, domain, from, to, interval)
+		})
+}
+
+func (s *MigrationStore) GetActivity(ctx context.Context, domain string, from, to time.Time, step time.Duration) ([]ActivityBucket, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetActivity", domain, from, to, "step", step),
+		func(ctx context.Context, store StoreInterface) ([]ActivityBucket, error) {
+			return store.GetActivity(ctx, domain, from, to, step)
+		})
+}
+
+func (s *MigrationStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopPages", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopPages(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopSources", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopSources(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetSourceBuckets(ctx context.Context, domain string, from, to time.Time, limit int) ([]SourceBucket, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetSourceBuckets", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]SourceBucket, error) {
+			return store.GetSourceBuckets(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopReferrerURLs(ctx context.Context, domain string, from, to time.Time, limit int) ([]ReferrerURLItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopReferrerURLs", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]ReferrerURLItem, error) {
+			return store.GetTopReferrerURLs(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetSearchEngines(ctx context.Context, domain string, from, to time.Time, limit int) ([]SearchEngineItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetSearchEngines", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]SearchEngineItem, error) {
+			return store.GetSearchEngines(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopBrowsers(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopBrowsers", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopBrowsers(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopCountries(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopCountries", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopCountries(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopDevices(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopDevices", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopDevices(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopLanguages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopLanguages", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopLanguages(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetScreenSizes(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetScreenSizes", domain, from, to),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetScreenSizes(ctx, domain, from, to)
+		})
+}
+
+func (s *MigrationStore) GetCountryMap(ctx context.Context, domain string, from, to time.Time) ([]GeoItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetCountryMap", domain, from, to),
+		func(ctx context.Context, store StoreInterface) ([]GeoItem, error) {
+			return store.GetCountryMap(ctx, domain, from, to)
+		})
+}
+
+func (s *MigrationStore) GetTopRegions(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopRegions", domain, from, to, "country", country, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]GeoItem, error) {
+			return store.GetTopRegions(ctx, domain, country, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopCities(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopCities", domain, from, to, "country", country, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]GeoItem, error) {
+			return store.GetTopCities(ctx, domain, country, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetDomainMismatches(ctx context.Context, domain string, subdomains bool, from, to time.Time, limit int) ([]HostnameItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetDomainMismatches", domain, from, to, "subdomains", subdomains, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]HostnameItem, error) {
+			return store.GetDomainMismatches(ctx, domain, subdomains, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopUTMSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopUTMSources", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopUTMSources(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopUTMMediums(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopUTMMediums", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopUTMMediums(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetTopUTMCampaigns(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetTopUTMCampaigns", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetTopUTMCampaigns(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields) ([]EventItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetRecentEvents", domain, from, to, "limit", limit, "fields", fields.String()),
+		func(ctx context.Context, store StoreInterface) ([]EventItem, error) {
+			return store.GetRecentEvents(ctx, domain, from, to, limit, fields)
+		})
+}
+
+// StreamRecentEvents is not mirrored: its events go straight to the client
+func (s *MigrationStore) StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields, fn func(EventItem) error) error {
+	return s.primary.StreamRecentEvents(ctx, domain, from, to, limit, fields, fn)
+}
+
+func (s *MigrationStore) GetEvent(ctx context.Context, domain, id string) (*EventItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetEvent", domain, time.Time{}, time.Time{}, "id", id),
+		func(ctx context.Context, store StoreInterface) (*EventItem, error) {
+			return store.GetEvent(ctx, domain, id)
+		})
+}
+
+func (s *MigrationStore) GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]EventBreakdownItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetEventBreakdown", domain, from, to),
+		func(ctx context.Context, store StoreInterface) ([]EventBreakdownItem, error) {
+			return store.GetEventBreakdown(ctx, domain, from, to)
+		})
+}
+
+func (s *MigrationStore) GetEventCardinality(ctx context.Context, domain string, from, to time.Time) (EventCardinality, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetEventCardinality", domain, from, to),
+		func(ctx context.Context, store StoreInterface) (EventCardinality, error) {
+			return store.GetEventCardinality(ctx, domain, from, to)
+		})
+}
+
+func (s *MigrationStore) GetUniquePages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetUniquePages", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]TopItem, error) {
+			return store.GetUniquePages(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetFunnel(ctx context.Context, domain string, from, to time.Time, steps []string) (*FunnelResult, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetFunnel", domain, from, to, "steps", strings.Join(steps, ",")),
+		func(ctx context.Context, store StoreInterface) (*FunnelResult, error) {
+			return store.GetFunnel(ctx, domain, from, to, steps)
+		})
+}
+
+func (s *MigrationStore) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, windowMinutes int) (*FunnelResult, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetFunnelAdvanced", domain, from, to, "steps", len(steps), "window_minutes", windowMinutes),
+		func(ctx context.Context, store StoreInterface) (*FunnelResult, error) {
+			return store.GetFunnelAdvanced(ctx, domain, from, to, steps, windowMinutes)
+		})
+}
+
+func (s *MigrationStore) GetStepMatchCounts(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step) ([]int64, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetStepMatchCounts", domain, from, to, "steps", len(steps)),
+		func(ctx context.Context, store StoreInterface) ([]int64, error) {
+			return store.GetStepMatchCounts(ctx, domain, from, to, steps)
+		})
+}
+
+func (s *MigrationStore) GetErrorPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]ErrorPage, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetErrorPages", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]ErrorPage, error) {
+			return store.GetErrorPages(ctx, domain, from, to, limit)
+		})
+}
+
+func (s *MigrationStore) GetCampaignConversions(ctx context.Context, domain string, goal funnel.Step, from, to time.Time, opts CampaignOptions, limit int) ([]CampaignConversion, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetCampaignConversions", domain, from, to, "goal", goal.Value, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]CampaignConversion, error) {
+			return store.GetCampaignConversions(ctx, domain, goal, from, to, opts, limit)
+		})
+}
+
+func (s *MigrationStore) GetRevenue(ctx context.Context, domain string, from, to time.Time) (*Revenue, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetRevenue", domain, from, to),
+		func(ctx context.Context, store StoreInterface) (*Revenue, error) {
+			return store.GetRevenue(ctx, domain, from, to)
+		})
+}
+
+func (s *MigrationStore) GetAutocaptureEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]AutocaptureEvent, error) {
+	return mirrorRead(s, ctx, newMirrorQuery("GetAutocaptureEvents", domain, from, to, "limit", limit),
+		func(ctx context.Context, store StoreInterface) ([]AutocaptureEvent, error) {
+			return store.GetAutocaptureEvents(ctx, domain, from, to, limit)
+		})
+}
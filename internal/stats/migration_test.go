@@ -0,0 +1,206 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mirrorStore answers top pages with fixed items and counts the reads
+type mirrorStore struct {
+	fakeStore
+	pages []TopItem
+	err   error
+	reads atomic.Int64
+}
+
+func (s *mirrorStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	s.reads.Add(1)
+	return s.pages, s.err
+}
+
+// waitMirrors waits until every mirrored read of s has been compared
+func waitMirrors(t *testing.T, s *MigrationStore) MigrationReport {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r := s.Report()
+		if r.Matched+r.Mismatched+r.Failed == r.Mirrored {
+			return r
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mirrored reads not compared: %+v", r)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResultComparer(t *testing.T) {
+	tests := []struct {
+		name      string
+		want, got any
+		diffs     int
+	}{
+		{"equal overview", Overview{Pageviews: 100, UniqueVisitors: 40}, Overview{Pageviews: 100, UniqueVisitors: 40}, 0},
+		{"count within tolerance", Overview{Pageviews: 100}, Overview{Pageviews: 101}, 0},
+		{"count beyond tolerance", Overview{Pageviews: 100}, Overview{Pageviews: 110}, 1},
+		{"reordered items", []TopItem{{Name: "/a", Count: 5}, {Name: "/b", Count: 5}}, []TopItem{{Name: "/b", Count: 5}, {Name: "/a", Count: 5}}, 0},
+		{"item count differs", []TopItem{{Name: "/a", Count: 5}}, []TopItem{{Name: "/a", Count: 9}}, 1},
+		{"little overlap", []TopItem{{Name: "/a"}, {Name: "/b"}}, []TopItem{{Name: "/a"}, {Name: "/c"}}, 1},
+		{"volatile field", []HostnameItem{{Hostname: "a.example.com", LastSeen: "1"}}, []HostnameItem{{Hostname: "a.example.com", LastSeen: "2"}}, 0},
+		{"sparkline point", []EventBreakdownItem{{TopItem: TopItem{Name: "x"}, Sparkline: []int64{1, 2}}}, []EventBreakdownItem{{TopItem: TopItem{Name: "x"}, Sparkline: []int64{1, 3}}}, 1},
+		{"nil in one", (*Overview)(nil), &Overview{}, 1},
+		{"time to the second", time.Unix(100, 1000), time.Unix(100, 0), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := resultComparer{tolerance: 0.02, minOverlap: 0.8}
+			c.compare("", reflect.ValueOf(tt.want), reflect.ValueOf(tt.got))
+			if len(c.diffs) != tt.diffs {
+				t.Errorf("differences = %q, want %d", c.diffs, tt.diffs)
+			}
+		})
+	}
+}
+
+func TestResultComparer_Paths(t *testing.T) {
+	c := resultComparer{tolerance: 0.02, minOverlap: 0.8}
+	c.compare("", reflect.ValueOf([]TopItem{{Name: "/a", Count: 5}}), reflect.ValueOf([]TopItem{{Name: "/a", Count: 9}}))
+	if len(c.diffs) != 1 || c.diffs[0] != "[/a].count: 5 vs 9" {
+		t.Errorf("differences = %q", c.diffs)
+	}
+}
+
+func TestMigrationStore_Mirror(t *testing.T) {
+	primary := &mirrorStore{pages: []TopItem{{Name: "/", Count: 10}}}
+	secondary := &mirrorStore{pages: []TopItem{{Name: "/", Count: 20}}}
+	s := NewMigrationStore(primary, secondary, MigrationConfig{SampleRate: 1})
+	ctx := WithFilters(context.Background(), Filters{Country: "DE"})
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	pages, err := s.GetTopPages(ctx, fixtureDomain, from, from.AddDate(0, 0, 7), 10)
+	if err != nil || len(pages) != 1 || pages[0].Count != 10 {
+		t.Fatalf("pages = %+v, %v; want the primary's", pages, err)
+	}
+	// Changing the result must not affect the comparison
+	pages[0].Count = 20
+
+	r := waitMirrors(t, s)
+	if r.Mirrored != 1 || r.Mismatched != 1 || len(r.Diffs) != 1 {
+		t.Fatalf("report = %+v", r)
+	}
+	d := r.Diffs[0]
+	if d.Method != "GetTopPages" || d.Domain != fixtureDomain || d.Params != "limit=10" || d.From != "2024-03-01T00:00:00Z" ||
+		!strings.Contains(d.Filters, "country=DE") || len(d.Differences) != 1 {
+		t.Errorf("diff = %+v", d)
+	}
+
+	// Secondary failures are logged, primary failures are not mirrored
+	secondary.err = errors.New("boom")
+	s.GetTopPages(ctx, fixtureDomain, from, from.AddDate(0, 0, 7), 10)
+	if r := waitMirrors(t, s); r.Failed != 1 || r.Diffs[0].Error != "boom" {
+		t.Errorf("report after a failure = %+v", r)
+	}
+	primary.err = errors.New("down")
+	if _, err := s.GetTopPages(ctx, fixtureDomain, from, from, 10); err == nil {
+		t.Error("primary error not returned")
+	}
+	if r := waitMirrors(t, s); r.Mirrored != 2 {
+		t.Errorf("primary error mirrored: %+v", r)
+	}
+}
+
+// heldStore holds top page reads until release is closed
+type heldStore struct {
+	fakeStore
+	release chan struct{}
+}
+
+func (s *heldStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	<-s.release
+	return nil, nil
+}
+
+func TestMigrationStore_MaxConcurrent(t *testing.T) {
+	secondary := &heldStore{release: make(chan struct{})}
+	s := NewMigrationStore(&mirrorStore{}, secondary, MigrationConfig{SampleRate: 1, MaxConcurrent: 2})
+	for i := 0; i < 5; i++ {
+		s.GetTopPages(context.Background(), fixtureDomain, time.Time{}, time.Time{}, 10)
+	}
+	if r := s.Report(); r.Mirrored != 2 || r.Dropped != 3 {
+		t.Errorf("report = %+v, want 2 mirrored and 3 dropped", r)
+	}
+	close(secondary.release)
+	waitMirrors(t, s)
+}
+
+func TestMigrationStore_WithMirrors(t *testing.T) {
+	primary := &mirrorStore{pages: []TopItem{{Name: "/", Count: 1}}}
+	secondary := &mirrorStore{pages: primary.pages}
+	s := NewMigrationStore(primary, secondary, MigrationConfig{SampleRate: 1})
+
+	h := s.WithMirrors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.GetTopPages(r.Context(), fixtureDomain, time.Time{}, time.Time{}, 10)
+		if n := secondary.reads.Load(); n != 0 {
+			t.Errorf("secondary read %d times before the response was written", n)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/stats/pages", nil))
+	if r := waitMirrors(t, s); r.Matched != 1 || secondary.reads.Load() != 1 {
+		t.Errorf("report = %+v", r)
+	}
+}
+
+func TestMigrationStore_DuckDB(t *testing.T) {
+	now := time.Now().UTC()
+	primary := seedStore(t, now,
+		seedEvent{VisitorID: "v1", Pathname: "/a", Ago: daysAgo(1)},
+		seedEvent{VisitorID: "v2", Pathname: "/b", Ago: daysAgo(2)},
+	)
+	secondary := seedStore(t, now,
+		seedEvent{VisitorID: "v1", Pathname: "/a", Ago: daysAgo(1)},
+		seedEvent{VisitorID: "v2", Pathname: "/c", Ago: daysAgo(2)},
+	)
+	s := NewMigrationStore(primary, secondary, MigrationConfig{SampleRate: 1})
+	h := NewHandler(s)
+
+	for _, tt := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/api/stats/overview", h.HandleOverview},
+		{"/api/stats/pages", h.HandlePages},
+	} {
+		w := httptest.NewRecorder()
+		s.WithMirrors(tt.handler).ServeHTTP(w, httptest.NewRequest("GET", tt.path+"?domain=example.com&period=7d", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.path, w.Code, w.Body)
+		}
+	}
+
+	r := waitMirrors(t, s)
+	if r.Primary != "duckdb" || r.Matched < 1 || r.Mismatched != 1 {
+		t.Fatalf("report = %+v", r)
+	}
+	if d := r.Diffs[0]; d.Method != "GetTopPages" {
+		t.Errorf("diff = %+v, want the top pages", d)
+	}
+
+	w := httptest.NewRecorder()
+	s.HandleDiffs(w, httptest.NewRequest("GET", "/api/admin/migration", nil))
+	var report MigrationReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Mismatched != 1 || report.MismatchRate <= 0 || len(report.Diffs) != 1 {
+		t.Errorf("admin report = %+v", report)
+	}
+}
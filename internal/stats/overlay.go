@@ -0,0 +1,163 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Overlay modes of HandlePageviews: the range right before the requested
+// one, or the same range a year earlier
+const (
+	OverlayPreviousPeriod = "previous_period"
+	OverlayPreviousYear   = "previous_year"
+)
+
+// overlayShifts is how far back previous_period moves each period's bounds,
+// in the reporting zone. Periods of whole months move by months, so
+// last_month is compared with the month before whatever its length; the
+// others move by local days, so DST doesn't shift their bucket boundaries.
+var overlayShifts = map[string]struct{ months, days int }{
+	"today": {days: 1}, "yesterday": {days: 1},
+	"this_week": {days: 7}, "": {days: 7}, "7d": {days: 7},
+	"30d": {days: 30}, "90d": {days: 90},
+	"this_month": {months: 1}, "last_month": {months: 1}, "last_12_months": {months: 12},
+}
+
+// parseOverlay reads the overlay mode of HandlePageviews; "" means none.
+// The legacy bare series has nowhere to put one.
+func parseOverlay(r *http.Request) (string, error) {
+	switch mode := r.URL.Query().Get("overlay"); mode {
+	case "":
+		return "", nil
+	case OverlayPreviousPeriod, OverlayPreviousYear:
+		if r.URL.Query().Get("legacy") == "true" {
+			return "", errors.New("overlay is not available with legacy=true")
+		}
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown overlay %q, valid options: %s, %s", mode, OverlayPreviousPeriod, OverlayPreviousYear)
+	}
+}
+
+// OverlayPoint is the previous series' point aligned with a point of the
+// requested one. Points without a counterpart have neither time nor value.
+type OverlayPoint struct {
+	Time  string `json:"time,omitempty"`
+	Value *int64 `json:"value"`
+	// Change is the percentage the aligned point is up or down on Value, or
+	// null where there is no value or it is zero
+	Change *float64 `json:"change"`
+}
+
+// overlaySeries is the cached payload of an overlay request: the requested
+// series and the previous one aligned with it, index by index
+type overlaySeries struct {
+	Mode     string            `json:"mode"`
+	Points   []TimeSeriesPoint `json:"points"`
+	Previous []OverlayPoint    `json:"previous"`
+}
+
+// addTo sets the overlay fields of a pageviews body; a nil overlay sets none
+func (o *overlaySeries) addTo(body map[string]any) {
+	if o == nil {
+		return
+	}
+	body["overlay"] = o.Mode
+	body["previous"] = emptyIfNil(o.Previous)
+}
+
+// overlaySeries fetches the series of [from, to) and of the range mode
+// compares it with, bucketed alike, and aligns them
+func (h *Handler) overlaySeries(ctx context.Context, domain, period string, from, to time.Time, interval string, weekStart WeekStart, loc *time.Location, mode string) (overlaySeries, error) {
+	points, err := h.pageviewSeries(ctx, domain, from, to, interval, weekStart, loc)
+	if err != nil {
+		return overlaySeries{}, err
+	}
+	prevFrom, prevTo := overlayRange(mode, period, from, to, loc)
+	previous, err := h.pageviewSeries(ctx, domain, prevFrom, prevTo, interval, weekStart, loc)
+	if err != nil {
+		return overlaySeries{}, err
+	}
+	// Weeks pair up by position; a year back they start on other dates anyway
+	skipLeapDays := mode == OverlayPreviousYear && interval != "week"
+	return overlaySeries{Mode: mode, Points: points, Previous: alignOverlay(points, previous, skipLeapDays)}, nil
+}
+
+// overlayRange returns the range mode compares [from, to) with: a year back,
+// or back by the period's shift for previous_period. Unknown periods were
+// served as 7d and shift like it.
+func overlayRange(mode, period string, from, to time.Time, loc *time.Location) (time.Time, time.Time) {
+	if mode == OverlayPreviousYear {
+		return shiftBack(from, loc, 12, 0), shiftBack(to, loc, 12, 0)
+	}
+	shift, ok := overlayShifts[period]
+	if !ok {
+		shift = overlayShifts[""]
+	}
+	return shiftBack(from, loc, shift.months, shift.days), shiftBack(to, loc, shift.months, shift.days)
+}
+
+// shiftBack moves t back by months and days on the calendar of loc, keeping
+// the wall clock. A day the target month lacks is clamped to its last day, so
+// Feb 29 moves a year back to Feb 28 and Mar 31 a month back to Feb 28 or 29.
+func shiftBack(t time.Time, loc *time.Location, months, days int) time.Time {
+	local := t.In(loc)
+	y, m, d := local.Date()
+	if months != 0 {
+		first := time.Date(y, m-time.Month(months), 1, 0, 0, 0, 0, loc)
+		y, m = first.Year(), first.Month()
+		if last := time.Date(y, m+1, 0, 0, 0, 0, 0, loc).Day(); d > last {
+			d = last
+		}
+	}
+	return time.Date(y, m, d-days, local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), loc).UTC()
+}
+
+// alignOverlay pairs the points of previous with those of points by index.
+// Ranges of different lengths in buckets, across DST changes or months of
+// different lengths, leave the extra points of points without a counterpart
+// and drop those of previous. With skipLeapDays Feb 29 pairs with nothing, so
+// a year back the days after it still pair with the same date: it gets no
+// counterpart in points and is left out of previous.
+func alignOverlay(points, previous []TimeSeriesPoint, skipLeapDays bool) []OverlayPoint {
+	if skipLeapDays {
+		kept := make([]TimeSeriesPoint, 0, len(previous))
+		for _, p := range previous {
+			if !isLeapDay(p.Time) {
+				kept = append(kept, p)
+			}
+		}
+		previous = kept
+	}
+
+	aligned := make([]OverlayPoint, len(points))
+	j := 0
+	for i, p := range points {
+		if (skipLeapDays && isLeapDay(p.Time)) || j >= len(previous) {
+			continue
+		}
+		prev := previous[j]
+		j++
+		value := prev.Value
+		aligned[i] = OverlayPoint{Time: prev.Time, Value: &value, Change: percentChange(prev.Value, p.Value)}
+	}
+	return aligned
+}
+
+// isLeapDay reports whether a point label, an ISO date or hour, falls on Feb 29
+func isLeapDay(label string) bool {
+	return len(label) >= 10 && label[4:10] == "-02-29"
+}
+
+// percentChange is how many percent current is up on previous, or nil for a
+// zero previous
+func percentChange(previous, current int64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	change := float64(current-previous) / float64(previous) * 100
+	return &change
+}
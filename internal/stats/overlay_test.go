@@ -0,0 +1,174 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOverlayRange(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(y int, m time.Month, d int, loc *time.Location) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, loc).UTC()
+	}
+	for _, tt := range []struct {
+		name, mode, period string
+		from, to           time.Time
+		loc                *time.Location
+		wantFrom, wantTo   time.Time
+	}{
+		{
+			// February is compared with all of January
+			"last_month", OverlayPreviousPeriod, "last_month",
+			day(2024, 2, 1, time.UTC), day(2024, 3, 1, time.UTC), time.UTC,
+			day(2024, 1, 1, time.UTC), day(2024, 2, 1, time.UTC),
+		},
+		{
+			"this_month on the 31st", OverlayPreviousPeriod, "this_month",
+			day(2024, 3, 1, time.UTC), time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC), time.UTC,
+			day(2024, 2, 1, time.UTC), time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			// The day before DST starts is 24 hours long, the day itself 23
+			"today across DST", OverlayPreviousPeriod, "today",
+			day(2024, 3, 10, ny), time.Date(2024, 3, 10, 12, 0, 0, 0, ny), ny,
+			day(2024, 3, 9, ny), time.Date(2024, 3, 9, 12, 0, 0, 0, ny).UTC(),
+		},
+		{
+			"unknown period", OverlayPreviousPeriod, "bogus",
+			day(2024, 3, 8, time.UTC), day(2024, 3, 15, time.UTC), time.UTC,
+			day(2024, 3, 1, time.UTC), day(2024, 3, 8, time.UTC),
+		},
+		{
+			"leap day a year back", OverlayPreviousYear, "today",
+			day(2024, 2, 29, time.UTC), time.Date(2024, 2, 29, 8, 0, 0, 0, time.UTC), time.UTC,
+			day(2023, 2, 28, time.UTC), time.Date(2023, 2, 28, 8, 0, 0, 0, time.UTC),
+		},
+	} {
+		from, to := overlayRange(tt.mode, tt.period, tt.from, tt.to, tt.loc)
+		if !from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo) {
+			t.Errorf("%s: [%v, %v), want [%v, %v)", tt.name, from, to, tt.wantFrom, tt.wantTo)
+		}
+	}
+}
+
+func TestAlignOverlay(t *testing.T) {
+	series := func(labels ...string) []TimeSeriesPoint {
+		points := make([]TimeSeriesPoint, len(labels))
+		for i, label := range labels {
+			points[i] = TimeSeriesPoint{Time: label, Value: int64(10 * (i + 1))}
+		}
+		return points
+	}
+	times := func(aligned []OverlayPoint) []string {
+		labels := make([]string, len(aligned))
+		for i, p := range aligned {
+			labels[i] = p.Time
+		}
+		return labels
+	}
+	equal := func(got, want []string) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// A longer previous series is cut, a shorter one padded
+	aligned := alignOverlay(series("a", "b"), series("x", "y", "z"), false)
+	if got := times(aligned); !equal(got, []string{"x", "y"}) {
+		t.Errorf("truncated = %v", got)
+	}
+	aligned = alignOverlay(series("a", "b", "c"), series("x", "y"), false)
+	if got := times(aligned); !equal(got, []string{"x", "y", ""}) || aligned[2].Value != nil || aligned[2].Change != nil {
+		t.Errorf("padded = %+v", aligned)
+	}
+	if *aligned[0].Value != 10 || *aligned[0].Change != 0 {
+		t.Errorf("first = %+v", aligned[0])
+	}
+
+	// A leap year's Feb 29 has no counterpart a year back
+	aligned = alignOverlay(series("2024-02-28", "2024-02-29", "2024-03-01"), series("2023-02-28", "2023-03-01", "2023-03-02"), true)
+	if got := times(aligned); !equal(got, []string{"2023-02-28", "", "2023-03-01"}) {
+		t.Errorf("current leap day = %v", got)
+	}
+	// and is left out of the previous series
+	aligned = alignOverlay(series("2025-02-28", "2025-03-01"), series("2024-02-28", "2024-02-29", "2024-03-01"), true)
+	if got := times(aligned); !equal(got, []string{"2024-02-28", "2024-03-01"}) {
+		t.Errorf("previous leap day = %v", got)
+	}
+	if *aligned[1].Value != 30 || *aligned[1].Change != float64(20-30)/30*100 {
+		t.Errorf("after previous leap day = %+v", aligned[1])
+	}
+
+	if percentChange(0, 5) != nil {
+		t.Error("change on zero should be nil")
+	}
+}
+
+// rangeStore answers each series with one pageview per call in its first hour
+type rangeStore struct {
+	fakeStore
+	froms []time.Time
+}
+
+func (s *rangeStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
+	s.froms = append(s.froms, from)
+	return []TimeSeriesPoint{{Time: from.UTC().Format("2006-01-02T15:00"), Value: int64(len(s.froms))}}, nil
+}
+
+func TestHandlePageviews_Overlay(t *testing.T) {
+	store := &rangeStore{}
+	h := NewHandler(store)
+	get := func(query string) (int, map[string]json.RawMessage) {
+		w := httptest.NewRecorder()
+		h.HandlePageviews(w, httptest.NewRequest("GET", "/api/stats/pageviews?domain=example.com&period=today&interval=hour&"+query, nil))
+		var body map[string]json.RawMessage
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	code, body := get("overlay=previous_period")
+	if code != 200 || len(store.froms) != 2 || !store.froms[1].Equal(store.froms[0].AddDate(0, 0, -1)) {
+		t.Fatalf("status %d, store ranges from %v", code, store.froms)
+	}
+	var points []TimeSeriesPoint
+	var previous []OverlayPoint
+	json.Unmarshal(body["points"], &points)
+	json.Unmarshal(body["previous"], &previous)
+	if string(body["overlay"]) != `"previous_period"` || len(previous) != len(points) {
+		t.Fatalf("overlay %s with %d previous points for %d", body["overlay"], len(previous), len(points))
+	}
+	// One pageview now against two yesterday
+	if previous[0].Value == nil || *previous[0].Value != 2 || previous[0].Change == nil || *previous[0].Change != -50 {
+		t.Errorf("first previous point = %+v", previous[0])
+	}
+
+	// The payload is cached per overlay mode
+	get("overlay=previous_period")
+	if len(store.froms) != 2 {
+		t.Errorf("cached overlay queried again: %d calls", len(store.froms))
+	}
+	get("overlay=previous_year")
+	get("")
+	if len(store.froms) != 5 {
+		t.Errorf("%d store calls, want an overlay and a plain series besides", len(store.froms))
+	}
+
+	if code, _ := get("overlay=previous_week"); code != 400 {
+		t.Errorf("unknown overlay: status %d", code)
+	}
+	if code, _ := get("overlay=previous_year&legacy=true"); code != 400 {
+		t.Errorf("legacy overlay: status %d", code)
+	}
+}
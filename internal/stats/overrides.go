@@ -0,0 +1,210 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// MaxValueOverrides caps the override rules admins can register; each rule in
+// effect adds a condition to breakdown queries
+const MaxValueOverrides = 20
+
+// OverrideColumns are the categorical columns value overrides can correct
+var OverrideColumns = []string{"browser", "os", "device", "country"}
+
+// ValueOverride replaces a wrong value the enrichment pipeline stored in a
+// column, for events between two dates (UTC, both inclusive) of one domain or,
+// with an empty Domain, every domain. Match compares case-insensitively with
+// the stored value, before display labels apply.
+type ValueOverride struct {
+	Domain      string `json:"domain"`
+	Column      string `json:"column"`
+	Match       string `json:"match"`
+	Replacement string `json:"replacement"`
+	StartDate   string `json:"start_date"`
+	EndDate     string `json:"end_date"`
+}
+
+// Validate checks a rule before it is stored
+func (o ValueOverride) Validate() error {
+	if !slices.Contains(OverrideColumns, o.Column) {
+		return fmt.Errorf("column must be one of %s", strings.Join(OverrideColumns, ", "))
+	}
+	if strings.TrimSpace(o.Match) == "" {
+		return fmt.Errorf("match is required")
+	}
+	if strings.TrimSpace(o.Replacement) == "" {
+		return fmt.Errorf("replacement is required")
+	}
+	if strings.EqualFold(strings.TrimSpace(o.Match), strings.TrimSpace(o.Replacement)) {
+		return fmt.Errorf("replacement must differ from match")
+	}
+	from, to, err := o.span()
+	if err != nil {
+		return err
+	}
+	if !to.After(from) {
+		return fmt.Errorf("end_date is before start_date")
+	}
+	return nil
+}
+
+// span returns the time range the rule covers, end exclusive
+func (o ValueOverride) span() (from, to time.Time, err error) {
+	if from, err = time.Parse("2006-01-02", o.StartDate); err != nil {
+		return from, to, fmt.Errorf("start_date must be YYYY-MM-DD")
+	}
+	if to, err = time.Parse("2006-01-02", o.EndDate); err != nil {
+		return from, to, fmt.Errorf("end_date must be YYYY-MM-DD")
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// ValueOverrides holds the override rules admins registered. It is shared
+// between the stores, which apply it to the rows they scan, and auth, which
+// reloads it.
+type ValueOverrides struct {
+	mu    sync.RWMutex
+	rules []ValueOverride
+}
+
+// NewValueOverrides returns an empty rule set
+func NewValueOverrides() *ValueOverrides {
+	return &ValueOverrides{}
+}
+
+// Set replaces the rules; earlier rules win where several match one value
+func (o *ValueOverrides) Set(rules []ValueOverride) {
+	o.mu.Lock()
+	o.rules = rules
+	o.mu.Unlock()
+}
+
+// overrideRule is a ValueOverride ready to apply
+type overrideRule struct {
+	match, replacement string
+	from, to           time.Time
+}
+
+// overrideSet is the rules of one column in effect for a query, in order
+type overrideSet []overrideRule
+
+// forColumn returns the rules for domain's column that overlap from..to
+func (o *ValueOverrides) forColumn(domain, column string, from, to time.Time) overrideSet {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	var set overrideSet
+	for _, rule := range o.rules {
+		if rule.Column != column || (rule.Domain != "" && rule.Domain != domain) {
+			continue
+		}
+		start, end, err := rule.span()
+		if err != nil || !start.Before(to) || !end.After(from) {
+			continue
+		}
+		set = append(set, overrideRule{
+			match:       strings.TrimSpace(rule.Match),
+			replacement: strings.TrimSpace(rule.Replacement),
+			from:        start,
+			to:          end,
+		})
+	}
+	return set
+}
+
+// maskExpr renders a SQL expression whose bit i is set when a row's timestamp
+// falls in rule i's range; inRange renders the condition for one range. Rows
+// are grouped by it so values can be replaced after the scan.
+func (set overrideSet) maskExpr(inRange func(from, to time.Time) string) string {
+	if len(set) == 0 {
+		return "0"
+	}
+	terms := make([]string, len(set))
+	for i, rule := range set {
+		terms[i] = fmt.Sprintf("(CASE WHEN %s THEN %d ELSE 0 END)", inRange(rule.from, rule.to), 1<<i)
+	}
+	return strings.Join(terms, " + ")
+}
+
+// scanLimit widens a breakdown's row limit, as grouping by the mask can split
+// one value over several rows
+func (set overrideSet) scanLimit(limit int) int {
+	return limit * (len(set) + 1)
+}
+
+// replace returns the value rows with mask report for value
+func (set overrideSet) replace(value string, mask int64) string {
+	for i, rule := range set {
+		if mask&(1<<i) != 0 && strings.EqualFold(strings.TrimSpace(value), rule.match) {
+			return rule.replacement
+		}
+	}
+	return value
+}
+
+// replaceAt returns the value an event at ts reports for value
+func (set overrideSet) replaceAt(value string, ts time.Time) string {
+	for _, rule := range set {
+		if !ts.Before(rule.from) && ts.Before(rule.to) && strings.EqualFold(strings.TrimSpace(value), rule.match) {
+			return rule.replacement
+		}
+	}
+	return value
+}
+
+// overrideEvent corrects the override columns of an event of domain at ts
+func (o *ValueOverrides) overrideEvent(domain string, e *EventItem, ts time.Time) {
+	if o == nil {
+		return
+	}
+	fields := map[string]*string{"browser": &e.Browser, "os": &e.OS, "device": &e.Device, "country": &e.Country}
+	for _, column := range OverrideColumns {
+		field := fields[column]
+		*field = o.forColumn(domain, column, ts, ts.Add(time.Microsecond)).replaceAt(*field, ts)
+	}
+}
+
+// maskedItem is a breakdown row grouped by override mask
+type maskedItem struct {
+	name  string
+	mask  int64
+	count int64
+}
+
+// overrideTopItems replaces the values of rows grouped by override mask and
+// labels them as dimension, merging rows that end up with the same label
+func overrideTopItems(dimension string, set overrideSet, rows []maskedItem) []TopItem {
+	items := make([]TopItem, len(rows))
+	for i, row := range rows {
+		items[i] = TopItem{Name: set.replace(row.name, row.mask), Count: row.count}
+	}
+	return aggregate.MergeLabels(dimension, items)
+}
+
+// labelledTopItems returns the limit largest labels of a breakdown whose rows
+// read returns, largest first and at most n of them, with the number of raw
+// groups they were cut from. Without overrides the rows are grouped by label
+// already (see duckdbLabelExpr), so the groups count the labels; with them each
+// group left out adds at most one label. It reports that count to the group
+// counter of ctx and reads once.
+func labelledTopItems(ctx context.Context, dimension string, set overrideSet, limit int, read func(n int) ([]maskedItem, int64, error)) ([]TopItem, error) {
+	rows, groups, err := read(set.scanLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	items := overrideTopItems(dimension, set, rows)
+	countGroups(ctx, int64(len(items))+max(groups-int64(len(rows)), 0))
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
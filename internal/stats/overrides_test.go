@@ -0,0 +1,213 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+func TestValueOverride_Validate(t *testing.T) {
+	valid := ValueOverride{Column: "browser", Match: "Chrome", Replacement: "Edge", StartDate: "2024-03-01", EndDate: "2024-03-01"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("one-day rule: %v", err)
+	}
+	tests := map[string]func(o *ValueOverride){
+		"column":      func(o *ValueOverride) { o.Column = "pathname" },
+		"match":       func(o *ValueOverride) { o.Match = " " },
+		"replacement": func(o *ValueOverride) { o.Replacement = "" },
+		"same value":  func(o *ValueOverride) { o.Replacement = "chrome" },
+		"date format": func(o *ValueOverride) { o.StartDate = "03/01/2024" },
+		"date order":  func(o *ValueOverride) { o.EndDate = "2024-02-28" },
+	}
+	for name, change := range tests {
+		o := valid
+		change(&o)
+		if err := o.Validate(); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestValueOverrides_ForColumn(t *testing.T) {
+	o := NewValueOverrides()
+	o.Set([]ValueOverride{
+		{Column: "browser", Match: "Chrome", Replacement: "Edge", StartDate: "2024-03-01", EndDate: "2024-03-14"},
+		{Domain: "other.com", Column: "browser", Match: "Safari", Replacement: "Chrome", StartDate: "2024-03-01", EndDate: "2024-03-14"},
+		{Column: "os", Match: "Linux", Replacement: "Android", StartDate: "2024-03-01", EndDate: "2024-03-14"},
+	})
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+
+	set := o.forColumn("example.com", "browser", day(10), day(20))
+	if len(set) != 1 || set[0].replacement != "Edge" {
+		t.Fatalf("set = %+v, want the global Chrome rule", set)
+	}
+	if got := o.forColumn("example.com", "browser", day(15), day(20)); len(got) != 0 {
+		t.Errorf("range after the rule: %+v", got)
+	}
+	if got := set.replace("chrome", 1); got != "Edge" {
+		t.Errorf("replace in range = %q", got)
+	}
+	if got := set.replace("Chrome", 0); got != "Chrome" {
+		t.Errorf("replace out of range = %q", got)
+	}
+	if got := set.replaceAt("Chrome", day(15)); got != "Chrome" {
+		t.Errorf("the end date is inclusive only up to its last moment: %q", got)
+	}
+	if got := set.replaceAt("Chrome", day(14).Add(23*time.Hour)); got != "Edge" {
+		t.Errorf("replaceAt on the end date = %q", got)
+	}
+	var none *ValueOverrides
+	if got := none.forColumn("example.com", "browser", day(1), day(20)); got != nil || got.maskExpr(duckdbTimeRange) != "0" {
+		t.Errorf("nil overrides = %+v", got)
+	}
+}
+
+// overrideFixture is one event per row: browser and days before today, at noon UTC
+var overrideFixture = []struct {
+	browser string
+	daysAgo int
+}{
+	{"Chrome", 20}, {"Chrome", 20},
+	{"Chrome", 10}, {"Chrome", 10}, {"Chrome", 10}, {"Firefox", 10},
+	{"Chrome", 2},
+}
+
+// overrideFixtureRows renders the fixture as SQL tuples of (visitor_id, browser, timestamp)
+func overrideFixtureRows() string {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	rows := make([]string, len(overrideFixture))
+	for i, e := range overrideFixture {
+		ts := today.AddDate(0, 0, -e.daysAgo).Add(12*time.Hour + time.Duration(i)*time.Minute)
+		rows[i] = fmt.Sprintf("('v%d', '%s', '%s')", i, e.browser, ts.Format("2006-01-02 15:04:05"))
+	}
+	return strings.Join(rows, ", ")
+}
+
+// overrideFixtureRule replaces Chrome with Edge from 12 to 8 days ago
+func overrideFixtureRule() *ValueOverrides {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	o := NewValueOverrides()
+	o.Set([]ValueOverride{{
+		Column:      "browser",
+		Match:       "Chrome",
+		Replacement: "Edge",
+		StartDate:   today.AddDate(0, 0, -12).Format("2006-01-02"),
+		EndDate:     today.AddDate(0, 0, -8).Format("2006-01-02"),
+	}})
+	return o
+}
+
+func newOverridesStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, visitor_id, 'pageview' AS name, '' AS url, '/' AS pathname,
+			'' AS referrer, '' AS country, browser, '' AS os, '' AS device, '' AS props, ts::TIMESTAMP AS timestamp
+		FROM (VALUES ` + overrideFixtureRows() + `) t(visitor_id, browser, ts)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	return withState(&Store{db: db, overrides: overrideFixtureRule()}, storeSnapshot{ready: true, useMemoryTable: true})
+}
+
+// browserCounts returns the browser breakdown of domain over the last 30 days
+func browserCounts(t *testing.T, s StoreInterface, domain string) map[string]int64 {
+	t.Helper()
+	ctx := WithFilters(context.Background(), Filters{})
+	items, err := s.GetTopBrowsers(ctx, domain, time.Now().AddDate(0, 0, -30), time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int64)
+	for _, item := range items {
+		got[item.Name] = item.Count
+	}
+	return got
+}
+
+var overrideFixtureWant = map[string]int64{"Chrome": 3, "Edge": 3, "Firefox": 1}
+
+func TestStore_ValueOverrides(t *testing.T) {
+	s := newOverridesStore(t)
+	ctx := WithFilters(context.Background(), Filters{})
+	from, to := time.Now().AddDate(0, 0, -30), time.Now()
+
+	got := browserCounts(t, s, "example.com")
+	if !reflect.DeepEqual(got, overrideFixtureWant) {
+		t.Errorf("browsers = %v, want %v", got, overrideFixtureWant)
+	}
+	if got := browserCounts(t, s, "other.com"); len(got) != 0 {
+		t.Errorf("other domain = %v", got)
+	}
+	if items, _ := s.GetTopBrowsers(ctx, "example.com", from, to, 1); len(items) != 1 {
+		t.Errorf("limit 1 returned %d items", len(items))
+	}
+
+	events, err := s.GetRecentEvents(ctx, "example.com", from, to, 10, AllEventFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browsers := make(map[string]int64)
+	for _, e := range events {
+		browsers[e.Browser]++
+	}
+	if !reflect.DeepEqual(browsers, overrideFixtureWant) {
+		t.Errorf("recent event browsers = %v, want %v", browsers, overrideFixtureWant)
+	}
+}
+
+// TestClickHouseIntegration_ValueOverrides checks ClickHouse reports the
+// corrected breakdown DuckDB does for the same fixture and rule
+func TestClickHouseIntegration_ValueOverrides(t *testing.T) {
+	addr := os.Getenv("CLICKHOUSE_TEST_ADDR")
+	if addr == "" {
+		t.Skip("CLICKHOUSE_TEST_ADDR not set")
+	}
+	ctx := context.Background()
+
+	admin, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	database := fmt.Sprintf("clickresearch_test_%d", time.Now().UnixNano())
+	if err := admin.Exec(ctx, "CREATE DATABASE "+database); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Exec(ctx, "DROP DATABASE IF EXISTS "+database)
+
+	conn, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}, Auth: clickhouse.Auth{Database: database}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := &ClickHouseStore{conn: conn, stopCh: make(chan struct{}), overrides: overrideFixtureRule()}
+	if err := s.ensureTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Exec(ctx, `
+		INSERT INTO events (domain, visitor_id, name, pathname, browser, timestamp, received_at)
+		SELECT 'example.com', visitor_id, 'pageview', '/', browser, toDateTime64(ts, 6, 'UTC'), now64(6, 'UTC')
+		FROM values('visitor_id String, browser String, ts String', `+overrideFixtureRows()+`)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	duckdb := browserCounts(t, newOverridesStore(t), "example.com")
+	got := browserCounts(t, s, "example.com")
+	if !reflect.DeepEqual(got, duckdb) || !reflect.DeepEqual(got, overrideFixtureWant) {
+		t.Errorf("clickhouse browsers = %v, duckdb %v, want %v", got, duckdb, overrideFixtureWant)
+	}
+}
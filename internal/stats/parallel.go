@@ -0,0 +1,17 @@
+package stats
+
+import (
+	"context"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// runParallel runs independent store calls concurrently. The first error cancels
+// the context passed to the others and is returned once all have finished.
+func runParallel(ctx context.Context, calls ...func(ctx context.Context) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for _, call := range calls {
+		g.Go(func() error { return call(ctx) })
+	}
+	return g.Wait()
+}
@@ -0,0 +1,83 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// overlapStore answers only once both breakdown calls are in flight at the same time
+type overlapStore struct {
+	fakeStore
+	started sync.WaitGroup
+}
+
+func newOverlapStore() *overlapStore {
+	s := &overlapStore{}
+	s.started.Add(2)
+	return s
+}
+
+func (s *overlapStore) await(ctx context.Context, name string) ([]TopItem, error) {
+	s.started.Done()
+	done := make(chan struct{})
+	go func() { s.started.Wait(); close(done) }()
+	select {
+	case <-done:
+		return []TopItem{{Name: name, Count: 1}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *overlapStore) GetTopBrowsers(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.await(ctx, "Firefox")
+}
+
+func (s *overlapStore) GetTopDevices(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.await(ctx, LabelDesktop)
+}
+
+func TestHandleDevices_Parallel(t *testing.T) {
+	h := NewHandler(newOverlapStore())
+	handler := WithDeadline(http.HandlerFunc(h.HandleDevices), time.Second)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/devices?domain=example.com", nil))
+
+	// Sequential calls would block on each other until the deadline
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRunParallel_CancelsSiblings(t *testing.T) {
+	errBoom := errors.New("boom")
+	err := runParallel(context.Background(),
+		func(ctx context.Context) error { return errBoom },
+		func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	)
+	if err != errBoom {
+		t.Errorf("err = %v, want %v", err, errBoom)
+	}
+}
+
+func TestStoreRLock_SharedByQueries(t *testing.T) {
+	s := &Store{}
+	s.mu.RLock() // another query in flight
+	defer s.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.rlock(ctx); err != nil {
+		t.Fatalf("rlock = %v, want nil", err)
+	}
+	s.mu.RUnlock()
+}
@@ -0,0 +1,110 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// CheckS3 verifies the DuckDB store can read its parquet: the files under the
+// bucket prefix (or LocalPath) are listed and the newest one's rows counted.
+// Files are named by time, so the newest sorts last.
+func CheckS3(ctx context.Context, cfg Config) (string, error) {
+	if cfg.LocalPath == "" {
+		if err := cfg.s3().validate(); err != nil {
+			return "", err
+		}
+	}
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return "", fmt.Errorf("failed to open duckdb: %w", err)
+	}
+	defer db.Close()
+	if cfg.LocalPath == "" {
+		for _, q := range cfg.s3().duckdbSetup() {
+			if _, err := db.ExecContext(ctx, q); err != nil {
+				return "", fmt.Errorf("S3 setup: %w", err)
+			}
+		}
+	}
+
+	glob := cfg.parquetGlob()
+	var files int
+	var newest sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT count(*), max(file) FROM glob(?)", glob).Scan(&files, &newest); err != nil {
+		return "", fmt.Errorf("listing %s: %w; check the S3 endpoint, credentials and bucket", glob, err)
+	}
+	if files == 0 {
+		if cfg.LocalPath != "" {
+			return "", fmt.Errorf("no parquet files match %s; check LOCAL_PARQUET_PATH or run scripts/sync-parquet.sh", glob)
+		}
+		return "", fmt.Errorf("no parquet files match %s; check S3_BUCKET and S3_PREFIX", glob)
+	}
+	var rows sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT sum(num_rows) FROM parquet_file_metadata(?)", newest.String).Scan(&rows); err != nil {
+		return "", fmt.Errorf("reading %s: %w", newest.String, err)
+	}
+	return fmt.Sprintf("%d files, newest %s has %d rows", files, newest.String, rows.Int64), nil
+}
+
+// clickhouseProbe is the part of a ClickHouse connection CheckClickHouse uses
+type clickhouseProbe interface {
+	Ping(ctx context.Context) error
+	QueryRow(ctx context.Context, query string, args ...any) driver.Row
+}
+
+// CheckClickHouse verifies the ClickHouse server answers and holds the events table
+func CheckClickHouse(ctx context.Context, cfg ClickHouseConfig) (string, error) {
+	if cfg.Addr == "" {
+		return "", errors.New("CLICKHOUSE_ADDR is not set")
+	}
+	conn, err := clickhouse.Open(cfg.options())
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clickhouse: %w", err)
+	}
+	defer conn.Close()
+	return checkClickHouse(ctx, conn, cfg.Addr)
+}
+
+func checkClickHouse(ctx context.Context, conn clickhouseProbe, addr string) (string, error) {
+	if err := conn.Ping(ctx); err != nil {
+		return "", fmt.Errorf("ping %s: %w; check CLICKHOUSE_ADDR and that the server is up", addr, err)
+	}
+	var tables uint64
+	if err := conn.QueryRow(ctx, "SELECT count() FROM system.tables WHERE database = currentDatabase() AND name = 'events'").Scan(&tables); err != nil {
+		return "", fmt.Errorf("looking up the events table: %w; check CLICKHOUSE_DB", err)
+	}
+	if tables == 0 {
+		return "", errors.New("no events table in the database; check CLICKHOUSE_DB or apply clickhouse/init.sql")
+	}
+	var rows uint64
+	if err := conn.QueryRow(ctx, "SELECT count() FROM events").Scan(&rows); err != nil {
+		return "", fmt.Errorf("counting events: %w", err)
+	}
+	return fmt.Sprintf("events table has %d rows", rows), nil
+}
+
+// CheckPostgres verifies the Postgres store's database answers and holds the
+// events table. The row count is the planner's estimate, which is cheap.
+func CheckPostgres(ctx context.Context, databaseURL string) (string, error) {
+	if databaseURL == "" {
+		return "", errors.New("neither STATS_DATABASE_URL nor DATABASE_URL is set")
+	}
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to open postgres: %w", err)
+	}
+	defer db.Close()
+	if err := checkPostgresEvents(ctx, db); err != nil {
+		return "", err
+	}
+	var rows float64
+	if err := db.QueryRowContext(ctx, "SELECT reltuples FROM pg_class WHERE oid = to_regclass($1)", postgresEventsTable).Scan(&rows); err != nil {
+		return "", fmt.Errorf("estimating events: %w", err)
+	}
+	return fmt.Sprintf("%s has about %d rows", postgresEventsTable, int64(max(rows, 0))), nil
+}
@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+func TestCheckS3_Local(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	if _, err := CheckS3(ctx, Config{LocalPath: dir}); err == nil || !strings.Contains(err.Error(), "LOCAL_PARQUET_PATH") {
+		t.Errorf("empty directory: err = %v", err)
+	}
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, rows := range []int{5, 3} {
+		day := filepath.Join(dir, fmt.Sprintf("2024/03/0%d", i+1))
+		if err := os.MkdirAll(day, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(fmt.Sprintf("COPY (SELECT range AS n FROM range(%d)) TO '%s' (FORMAT PARQUET)", rows, filepath.Join(day, "events.parquet"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	detail, err := CheckS3(ctx, Config{LocalPath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(detail, "2 files, newest ") || !strings.HasSuffix(detail, "2024/03/02/events.parquet has 3 rows") {
+		t.Errorf("detail = %q", detail)
+	}
+}
+
+func TestCheckS3_InvalidSettings(t *testing.T) {
+	_, err := CheckS3(context.Background(), Config{Bucket: "events"})
+	if err == nil || !strings.Contains(err.Error(), "S3_KEY") {
+		t.Errorf("err = %v, want the missing credentials", err)
+	}
+}
+
+// probeRow answers Scan with a count or an error
+type probeRow struct {
+	driver.Row
+	count uint64
+	err   error
+}
+
+func (r probeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	*dest[0].(*uint64) = r.count
+	return nil
+}
+
+// probeConn is a ClickHouse connection answering the checker's queries
+type probeConn struct {
+	pingErr error
+	tables  uint64
+	events  uint64
+}
+
+func (c probeConn) Ping(ctx context.Context) error { return c.pingErr }
+
+func (c probeConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	if strings.Contains(query, "system.tables") {
+		return probeRow{count: c.tables}
+	}
+	return probeRow{count: c.events}
+}
+
+func TestCheckClickHouse(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		conn probeConn
+		want string
+	}{
+		{"ready", probeConn{tables: 1, events: 42}, "events table has 42 rows"},
+		{"down", probeConn{pingErr: errors.New("connection refused")}, "CLICKHOUSE_ADDR"},
+		{"no table", probeConn{}, "clickhouse/init.sql"},
+	}
+	for _, tt := range tests {
+		detail, err := checkClickHouse(ctx, tt.conn, "clickhouse:9000")
+		got := detail
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("%s: got %q, want it to mention %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+)
+
+// PrivacyMode controls which hits count towards visitor-level reports (unique
+// visitors, funnels) based on the consent prop the tracker sets to "granted" or
+// "denied". Aggregate counts such as pageviews always include every hit.
+type PrivacyMode string
+
+const (
+	PrivacyOff PrivacyMode = "off"
+	// PrivacyExcludeDenied drops hits whose consent is "denied"; hits without it still count
+	PrivacyExcludeDenied PrivacyMode = "exclude_denied"
+	// PrivacyOnlyGranted counts only hits whose consent is "granted"
+	PrivacyOnlyGranted PrivacyMode = "only_granted"
+)
+
+// Valid reports whether m is a known mode
+func (m PrivacyMode) Valid() bool {
+	switch m {
+	case PrivacyOff, PrivacyExcludeDenied, PrivacyOnlyGranted:
+		return true
+	}
+	return false
+}
+
+// PrivacySource loads the privacy mode of the project a domain belongs to;
+// unknown domains are PrivacyOff
+type PrivacySource interface {
+	PrivacyMode(domain string) (PrivacyMode, error)
+}
+
+// SetPrivacySource enables per-project privacy modes on stats endpoints
+func (h *Handler) SetPrivacySource(src PrivacySource) {
+	h.privacy = src
+}
+
+type privacyKey struct{}
+
+// WithPrivacyMode attaches the privacy mode visitor-level store queries apply
+func WithPrivacyMode(ctx context.Context, mode PrivacyMode) context.Context {
+	return context.WithValue(ctx, privacyKey{}, mode)
+}
+
+// privacyModeFromContext returns the mode attached by WithPrivacyMode, or PrivacyOff
+func privacyModeFromContext(ctx context.Context) PrivacyMode {
+	if mode, ok := ctx.Value(privacyKey{}).(PrivacyMode); ok && mode.Valid() {
+		return mode
+	}
+	return PrivacyOff
+}
+
+// privacyContext attaches domain's privacy mode and extends filterKey with it,
+// so cached reports are never shared between modes
+func (h *Handler) privacyContext(ctx context.Context, domain, filterKey string) (context.Context, string, error) {
+	mode := PrivacyOff
+	if h.privacy != nil {
+		var err error
+		if mode, err = h.privacy.PrivacyMode(domain); err != nil {
+			return nil, "", err
+		}
+	}
+	if mode == PrivacyOff || !mode.Valid() {
+		return WithPrivacyMode(ctx, PrivacyOff), filterKey, nil
+	}
+	return WithPrivacyMode(ctx, mode), filterKey + "|privacy=" + string(mode), nil
+}
+
+// consentCondition renders the mode as a condition on the consent value expr,
+// or "" when every hit counts
+func (m PrivacyMode) consentCondition(expr string) string {
+	switch m {
+	case PrivacyExcludeDenied:
+		return fmt.Sprintf("%s <> 'denied'", expr)
+	case PrivacyOnlyGranted:
+		return fmt.Sprintf("%s = 'granted'", expr)
+	}
+	return ""
+}
+
+// duckdbConsentCondition is the privacy condition of ctx in DuckDB
+func duckdbConsentCondition(ctx context.Context) string {
+	return privacyModeFromContext(ctx).consentCondition(
+		"COALESCE(CASE WHEN json_valid(props) THEN json_extract_string(props, '$.consent') END, '')")
+}
+
+// clickhouseConsentCondition is the privacy condition of ctx in ClickHouse
+func clickhouseConsentCondition(ctx context.Context) string {
+	return privacyModeFromContext(ctx).consentCondition("JSONExtractString(ifNull(props, ''), 'consent')")
+}
+
+// postgresConsentCondition is the privacy condition of ctx in Postgres
+func postgresConsentCondition(ctx context.Context) string {
+	return privacyModeFromContext(ctx).consentCondition("COALESCE(props->>'consent', '')")
+}
+
+// andCondition prefixes a non-empty condition with AND for appending to a WHERE clause
+func andCondition(cond string) string {
+	if cond == "" {
+		return ""
+	}
+	return "AND " + cond
+}
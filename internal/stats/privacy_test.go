@@ -0,0 +1,161 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+// newConsentStore loads visitors with granted, denied, absent and unparseable consent
+func newConsentStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, v AS visitor_id, 'pageview' AS name, '' AS url, p AS pathname,
+			'' AS referrer, '' AS country, '' AS browser, '' AS os, '' AS device, props,
+			TIMESTAMP '2024-01-01 10:00:00' + INTERVAL (i) MINUTE AS timestamp
+		FROM (VALUES
+			(1, 'granted', '/', '{"consent":"granted"}'),
+			(2, 'granted', '/pricing', '{"consent":"granted"}'),
+			(3, 'denied', '/', '{"consent":"denied"}'),
+			(4, 'absent', '/', '{}'),
+			(5, 'broken', '/', 'not json')
+		) t(i, v, p, props)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+}
+
+func TestStorePrivacyModes(t *testing.T) {
+	s := newConsentStore(t)
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	tests := []struct {
+		mode    PrivacyMode
+		uniques int64
+		funnel  []int64
+	}{
+		{PrivacyOff, 4, []int64{4, 1}},
+		{PrivacyExcludeDenied, 3, []int64{3, 1}},
+		{PrivacyOnlyGranted, 1, []int64{1, 1}},
+	}
+	for _, tt := range tests {
+		ctx := WithPrivacyMode(WithFilters(context.Background(), Filters{}), tt.mode)
+
+		o, err := s.GetOverview(ctx, "example.com", from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Pageviews count every hit whatever the mode
+		if o.Pageviews != 5 || o.UniqueVisitors != tt.uniques {
+			t.Errorf("%s: pageviews = %d, uniques = %d, want 5 and %d", tt.mode, o.Pageviews, o.UniqueVisitors, tt.uniques)
+		}
+
+		f, err := s.GetFunnel(ctx, "example.com", from, to, []string{"/", "/pricing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Steps[0].Count != tt.funnel[0] || f.Steps[1].Count != tt.funnel[1] {
+			t.Errorf("%s: funnel = %d, %d, want %v", tt.mode, f.Steps[0].Count, f.Steps[1].Count, tt.funnel)
+		}
+
+		adv, err := s.GetFunnelAdvanced(ctx, "example.com", from, to, []funnel.Step{{Type: "pageview", Value: "/"}, {Type: "pageview", Value: "/pricing"}}, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if adv.TotalStart != tt.funnel[0] {
+			t.Errorf("%s: advanced funnel start = %d, want %d", tt.mode, adv.TotalStart, tt.funnel[0])
+		}
+	}
+}
+
+func TestClickhouseConsentCondition(t *testing.T) {
+	ctx := context.Background()
+	if got := clickhouseConsentCondition(ctx); got != "" {
+		t.Errorf("no mode: %q", got)
+	}
+	got := clickhouseConsentCondition(WithPrivacyMode(ctx, PrivacyExcludeDenied))
+	if got != "JSONExtractString(ifNull(props, ''), 'consent') <> 'denied'" {
+		t.Errorf("exclude_denied: %q", got)
+	}
+	// Unknown modes from storage fall back to off rather than into the query
+	if got := clickhouseConsentCondition(WithPrivacyMode(ctx, PrivacyMode("x' OR 1=1"))); got != "" {
+		t.Errorf("invalid mode: %q", got)
+	}
+}
+
+type fakePrivacy map[string]PrivacyMode
+
+func (p fakePrivacy) PrivacyMode(domain string) (PrivacyMode, error) {
+	if mode, ok := p[domain]; ok {
+		return mode, nil
+	}
+	return PrivacyOff, nil
+}
+
+// consentOverviewStore reports fewer visitors when a privacy mode is applied
+type consentOverviewStore struct {
+	fakeStore
+}
+
+func (consentOverviewStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	if privacyModeFromContext(ctx) == PrivacyOff {
+		return &Overview{Pageviews: 5, UniqueVisitors: 4}, nil
+	}
+	return &Overview{Pageviews: 5, UniqueVisitors: 1}, nil
+}
+
+func TestHandleOverview_PrivacyMode(t *testing.T) {
+	h := NewHandler(consentOverviewStore{})
+	privacy := fakePrivacy{}
+	h.SetPrivacySource(privacy)
+
+	get := func() Overview {
+		w := httptest.NewRecorder()
+		h.HandleOverview(w, httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period=7d", nil))
+		var o Overview
+		if err := json.NewDecoder(w.Body).Decode(&o); err != nil {
+			t.Fatalf("%v: %s", err, w.Body.String())
+		}
+		return o
+	}
+
+	if o := get(); o.PrivacyMode != PrivacyOff || o.UniqueVisitors != 4 {
+		t.Errorf("off overview = %+v", o)
+	}
+
+	// A mode change takes effect despite the cached unrestricted overview
+	privacy["example.com"] = PrivacyOnlyGranted
+	if o := get(); o.PrivacyMode != PrivacyOnlyGranted || o.UniqueVisitors != 1 || o.Pageviews != 5 {
+		t.Errorf("only_granted overview = %+v", o)
+	}
+}
+
+func TestPrivacyContext_Key(t *testing.T) {
+	h := NewHandler(nil)
+	h.SetPrivacySource(fakePrivacy{"eu.example.com": PrivacyExcludeDenied})
+
+	_, key, _ := h.privacyContext(context.Background(), "example.com", "country=DE")
+	if key != "country=DE" {
+		t.Errorf("off key = %q", key)
+	}
+	ctx, key, _ := h.privacyContext(context.Background(), "eu.example.com", "country=DE")
+	if !strings.HasSuffix(key, "privacy=exclude_denied") || privacyModeFromContext(ctx) != PrivacyExcludeDenied {
+		t.Errorf("key = %q, mode = %q", key, privacyModeFromContext(ctx))
+	}
+}
@@ -0,0 +1,56 @@
+package stats
+
+import (
+	"fmt"
+	"strings"
+)
+
+// extractedProps are the props fields copied into plain props_<field> columns at
+// load time so hot GROUP BY queries don't parse JSON per request
+var extractedProps = []string{"text", "tag", "href"}
+
+// propColumnNames returns the column names for extractedProps
+func propColumnNames() []string {
+	names := make([]string, len(extractedProps))
+	for i, field := range extractedProps {
+		names[i] = "props_" + field
+	}
+	return names
+}
+
+// duckdbPropColumns renders the extra columns added to the in-memory events table.
+// Invalid JSON yields NULL rather than failing the whole refresh.
+func duckdbPropColumns() string {
+	cols := make([]string, len(extractedProps))
+	for i, field := range extractedProps {
+		cols[i] = fmt.Sprintf("CASE WHEN json_valid(props) THEN json_extract_string(props, '$.%[1]s') END AS props_%[1]s", field)
+	}
+	return strings.Join(cols, ",\n\t\t\t")
+}
+
+// clickhousePropColumnsDDL renders MATERIALIZED column definitions for the events table
+func clickhousePropColumnsDDL() string {
+	cols := make([]string, len(extractedProps))
+	for i, field := range extractedProps {
+		cols[i] = fmt.Sprintf("props_%[1]s String MATERIALIZED simpleJSONExtractString(props, '%[1]s')", field)
+	}
+	return strings.Join(cols, ",\n\t\t\t")
+}
+
+// propExpr returns the DuckDB expression for a props field: the extracted column
+// when st's memory table has it, JSON extraction otherwise (raw parquet fallback)
+func (s *Store) propExpr(st *storeSnapshot, field string) string {
+	if st.propColumns {
+		return "props_" + field
+	}
+	return fmt.Sprintf("json_extract_string(props, '$.%s')", field)
+}
+
+// propExpr returns the ClickHouse expression for a props field, falling back to
+// JSON extraction on tables created before the materialized columns existed
+func (s *ClickHouseStore) propExpr(field string) string {
+	if s.propColumns {
+		return "props_" + field
+	}
+	return fmt.Sprintf("simpleJSONExtractString(props, '%s')", field)
+}
@@ -0,0 +1,82 @@
+package stats
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPropExpr(t *testing.T) {
+	s := &Store{}
+	if got := s.propExpr(s.snapshot(), "text"); got != "json_extract_string(props, '$.text')" {
+		t.Errorf("fallback propExpr = %q", got)
+	}
+	if got := s.propExpr(&storeSnapshot{propColumns: true}, "text"); got != "props_text" {
+		t.Errorf("column propExpr = %q", got)
+	}
+
+	ch := &ClickHouseStore{}
+	if got := ch.propExpr("tag"); got != "simpleJSONExtractString(props, 'tag')" {
+		t.Errorf("clickhouse fallback propExpr = %q", got)
+	}
+}
+
+// BenchmarkAutocaptureEvents compares JSON extraction against extracted columns on a
+// synthetic dataset. BENCH_ROWS overrides the default 10M rows.
+//
+//	go test ./internal/stats -run '^$' -bench AutocaptureEvents -benchtime 5x
+func BenchmarkAutocaptureEvents(b *testing.B) {
+	if testing.Short() {
+		b.Skip("synthetic dataset is large")
+	}
+
+	rows := 10_000_000
+	if v, err := strconv.Atoi(os.Getenv("BENCH_ROWS")); err == nil && v > 0 {
+		rows = v
+	}
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(fmt.Sprintf(`
+		CREATE TABLE events AS
+		SELECT *, %s
+		FROM (
+			SELECT
+				'example.com' as domain,
+				'v' || (i %% 100000) as visitor_id,
+				CASE i %% 3 WHEN 0 THEN 'click' WHEN 1 THEN 'submit' ELSE 'pageview' END as name,
+				'/page/' || (i %% 50) as pathname,
+				'{"text":"Button ' || (i %% 20) || '","tag":"button","href":"/x/' || (i %% 7) || '"}' as props,
+				TIMESTAMP '2024-01-01' + INTERVAL (i %% 2592000) SECOND as timestamp
+			FROM range(%d) t(i)
+		)
+	`, duckdbPropColumns(), rows))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	for _, columns := range []bool{false, true} {
+		name := "json"
+		if columns {
+			name = "columns"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true, propColumns: columns})
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GetAutocaptureEvents(b.Context(), "example.com", from, to, 50); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
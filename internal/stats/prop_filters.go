@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Prop filters narrow the events and event-breakdown reports to events whose
+// props JSON has an exact value under a top-level key: ?prop_plan=pro.
+// At most maxPropFilters keys per request; all must match.
+const (
+	propFilterPrefix = "prop_"
+	maxPropFilters   = 5
+)
+
+// propKeyRe restricts keys to identifiers; keys are rendered into the JSON path
+var propKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// PropFilter is a props key that must equal Value
+type PropFilter struct {
+	Key   string
+	Value string
+}
+
+// ParsePropFilters reads prop_<key>=<value> query params, sorted by key.
+// Empty values are ignored, like other filters.
+func ParsePropFilters(q url.Values) ([]PropFilter, error) {
+	var props []PropFilter
+	for param, values := range q {
+		key, ok := strings.CutPrefix(param, propFilterPrefix)
+		if !ok {
+			continue
+		}
+		value := strings.TrimSpace(values[0])
+		if value == "" {
+			continue
+		}
+		if !propKeyRe.MatchString(key) {
+			return nil, fmt.Errorf("invalid prop filter key %q", key)
+		}
+		if len(value) > maxFilterValueLen {
+			return nil, fmt.Errorf("filter %s exceeds %d characters", param, maxFilterValueLen)
+		}
+		props = append(props, PropFilter{Key: key, Value: value})
+	}
+	if len(props) > maxPropFilters {
+		return nil, fmt.Errorf("at most %d prop filters allowed", maxPropFilters)
+	}
+	sort.Slice(props, func(i, j int) bool { return props[i].Key < props[j].Key })
+	return props, nil
+}
+
+// propFiltersKey returns a canonical representation for cache keys
+func propFiltersKey(props []PropFilter) string {
+	parts := make([]string, len(props))
+	for i, p := range props {
+		parts[i] = propFilterPrefix + p.Key + "=" + url.QueryEscape(p.Value)
+	}
+	return strings.Join(parts, "&")
+}
+
+// propContext attaches the request's prop filters to ctx and returns their cache key.
+// On failure the error is written.
+func propContext(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, string, bool) {
+	props, err := ParsePropFilters(r.URL.Query())
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return nil, "", false
+	}
+	return withPropFilters(ctx, props), propFiltersKey(props), true
+}
+
+type propFiltersKeyCtx struct{}
+
+// withPropFilters attaches prop filters to the context passed to store methods
+func withPropFilters(ctx context.Context, props []PropFilter) context.Context {
+	return context.WithValue(ctx, propFiltersKeyCtx{}, props)
+}
+
+// duckdbPropClause renders prop filters as AND conditions with numbered params starting at argIndex
+func duckdbPropClause(ctx context.Context, argIndex int) (string, []any) {
+	props, _ := ctx.Value(propFiltersKeyCtx{}).([]PropFilter)
+	var sb strings.Builder
+	var args []any
+	for _, p := range props {
+		fmt.Fprintf(&sb, " AND (CASE WHEN json_valid(props) THEN json_extract_string(props, '$.%s') END) = $%d", p.Key, argIndex)
+		args = append(args, p.Value)
+		argIndex++
+	}
+	return sb.String(), args
+}
+
+// postgresPropClause renders prop filters as AND conditions with numbered params starting at argIndex
+func postgresPropClause(ctx context.Context, argIndex int) (string, []any) {
+	props, _ := ctx.Value(propFiltersKeyCtx{}).([]PropFilter)
+	var sb strings.Builder
+	var args []any
+	for _, p := range props {
+		fmt.Fprintf(&sb, " AND props->>'%s' = $%d", p.Key, argIndex)
+		args = append(args, p.Value)
+		argIndex++
+	}
+	return sb.String(), args
+}
+
+// clickhousePropClause renders prop filters as AND conditions with positional params
+func clickhousePropClause(ctx context.Context) (string, []any) {
+	props, _ := ctx.Value(propFiltersKeyCtx{}).([]PropFilter)
+	var sb strings.Builder
+	var args []any
+	for _, p := range props {
+		fmt.Fprintf(&sb, " AND JSONExtractString(props, '%s') = ?", p.Key)
+		args = append(args, p.Value)
+	}
+	return sb.String(), args
+}
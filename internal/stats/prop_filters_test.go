@@ -0,0 +1,124 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePropFilters(t *testing.T) {
+	q, _ := url.ParseQuery("prop_plan=pro&prop_source=+ads+&prop_empty=&country=DE")
+	props, err := ParsePropFilters(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PropFilter{{Key: "plan", Value: "pro"}, {Key: "source", Value: "ads"}}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("props = %+v, want %+v", props, want)
+	}
+	if key := propFiltersKey(props); key != "prop_plan=pro&prop_source=ads" {
+		t.Errorf("key = %q", key)
+	}
+}
+
+func TestParsePropFilters_Invalid(t *testing.T) {
+	tests := []string{
+		"prop_plan')%20OR%201=1--=x",
+		"prop_a.b=x",
+		"prop_=x",
+		"prop_1plan=x",
+		"prop_a=1&prop_b=2&prop_c=3&prop_d=4&prop_e=5&prop_f=6",
+	}
+	for _, raw := range tests {
+		q, _ := url.ParseQuery(raw)
+		if _, err := ParsePropFilters(q); err == nil {
+			t.Errorf("ParsePropFilters(%q) should fail", raw)
+		}
+	}
+}
+
+func TestPropClauses(t *testing.T) {
+	ctx := withPropFilters(context.Background(), []PropFilter{{"plan", "pro"}, {"seats", "5"}})
+
+	clause, args := duckdbPropClause(ctx, 7)
+	want := " AND (CASE WHEN json_valid(props) THEN json_extract_string(props, '$.plan') END) = $7" +
+		" AND (CASE WHEN json_valid(props) THEN json_extract_string(props, '$.seats') END) = $8"
+	if clause != want || !reflect.DeepEqual(args, []any{"pro", "5"}) {
+		t.Errorf("duckdb clause = %q %v", clause, args)
+	}
+
+	clause, args = clickhousePropClause(ctx)
+	if clause != " AND JSONExtractString(props, 'plan') = ? AND JSONExtractString(props, 'seats') = ?" || len(args) != 2 {
+		t.Errorf("clickhouse clause = %q %v", clause, args)
+	}
+
+	if clause, args := duckdbPropClause(context.Background(), 5); clause != "" || args != nil {
+		t.Errorf("empty clause = %q %v", clause, args)
+	}
+}
+
+func TestStorePropFilters(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT * FROM (VALUES
+			('example.com', 'v1', 'signup', '', '/', '{"plan":"pro","seats":"5"}', '', '', '', '', TIMESTAMP '2024-01-01 10:00:00'),
+			('example.com', 'v2', 'signup', '', '/', '{"plan":"free"}', '', '', '', '', TIMESTAMP '2024-01-01 10:01:00'),
+			('example.com', 'v3', 'upgrade', '', '/', '{"plan":"pro"}', '', '', '', '', TIMESTAMP '2024-01-01 10:02:00'),
+			('example.com', 'v4', 'pageview', '', '/', '', '', '', '', '', TIMESTAMP '2024-01-01 10:03:00')
+		) t(domain, visitor_id, name, url, pathname, props, country, browser, os, device, timestamp)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	ctx := withPropFilters(context.Background(), []PropFilter{{"plan", "pro"}})
+	breakdown, err := s.GetEventBreakdown(ctx, "example.com", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"signup": 1, "upgrade": 1}; !reflect.DeepEqual(countsByName(topItems(breakdown)), want) {
+		t.Errorf("breakdown = %+v, want %v", breakdown, want)
+	}
+
+	// Multiple props are ANDed
+	ctx = withPropFilters(context.Background(), []PropFilter{{"plan", "pro"}, {"seats", "5"}})
+	events, err := s.GetRecentEvents(ctx, "example.com", from, to, 10, AllEventFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Name != "signup" {
+		t.Errorf("events = %+v, want one signup", events)
+	}
+
+	ctx = withPropFilters(context.Background(), []PropFilter{{"coupon", "x"}})
+	events, err = s.GetRecentEvents(ctx, "example.com", from, to, 10, AllEventFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("missing key matched %d events", len(events))
+	}
+}
+
+func TestHandleEvents_InvalidPropFilter(t *testing.T) {
+	h := NewHandler(fakeStore{})
+	w := httptest.NewRecorder()
+	h.HandleEvents(w, httptest.NewRequest("GET", "/api/stats/events?domain=example.com&prop_a%27b=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
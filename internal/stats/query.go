@@ -0,0 +1,223 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/access"
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+// Query asks for a domain's stats outside HTTP, as the gRPC server does. The
+// Handler methods taking one apply the checks of the matching endpoints,
+// access policy, privacy mode and strict domain policy included, and share
+// their cache entries.
+type Query struct {
+	Domain string
+	// Period is a period param value; "" means 7d
+	Period string
+	// Timezone is the IANA zone calendar periods and buckets follow; "" means UTC
+	Timezone string
+	// Filters are inline filters by query param name, as on the endpoints
+	Filters map[string]string
+}
+
+// QueryError is a Query rejected before the store is read, the 400 of the
+// endpoints
+type QueryError struct {
+	Err error
+}
+
+func (e *QueryError) Error() string { return e.Err.Error() }
+func (e *QueryError) Unwrap() error { return e.Err }
+
+// ErrStatsUnavailable is returned by Query methods of a Handler without a store
+var ErrStatsUnavailable = errors.New("stats not available")
+
+// queryRange is a Query resolved into what the store reads
+type queryRange struct {
+	domain    string
+	from, to  time.Time
+	loc       *time.Location
+	filterKey string
+}
+
+// queryContext resolves q like requestParams and filterContext resolve a
+// strict-mode request, returning the store context and the filter key of the
+// endpoints' cache keys
+func (h *Handler) queryContext(ctx context.Context, q Query) (context.Context, queryRange, error) {
+	if h.store == nil {
+		return nil, queryRange{}, ErrStatsUnavailable
+	}
+	qr := queryRange{domain: strings.TrimSpace(q.Domain), loc: time.UTC}
+	if qr.domain == "" {
+		return nil, qr, &QueryError{fmt.Errorf("domain is required")}
+	}
+	if !access.PolicyFromContext(ctx).AllowsDomain(qr.domain) {
+		return nil, qr, ErrDomainForbidden
+	}
+	if q.Timezone != "" {
+		loc, err := time.LoadLocation(q.Timezone)
+		if err != nil {
+			return nil, qr, &QueryError{fmt.Errorf("unknown tz %q", q.Timezone)}
+		}
+		qr.loc = loc
+	}
+	var err error
+	if qr.from, qr.to, err = PeriodRange(q.Period, time.Now().In(qr.loc)); err != nil {
+		return nil, qr, &QueryError{err}
+	}
+
+	params := url.Values{}
+	for name, value := range q.Filters {
+		params.Set(name, value)
+	}
+	filters := ParseFilters(params)
+	if err := filters.Validate(); err != nil {
+		return nil, qr, &QueryError{err}
+	}
+
+	ctx, key, err := h.privacyContext(WithFilters(ctx, filters), qr.domain, filters.Key())
+	if err != nil {
+		return nil, qr, err
+	}
+	if ctx, key, err = h.aliasContext(ctx, qr.domain, key); err != nil {
+		return nil, qr, err
+	}
+	if ctx, key, err = h.domainMatchContext(ctx, qr.domain, key); err != nil {
+		return nil, qr, err
+	}
+	// Warnings other than the overview's have no place to go outside HTTP
+	header := http.Header{}
+	ctx, partialKey := h.partialDataContext(ctx, header, qr.from, qr.to)
+	ctx = h.cacheTTLContext(ctx, header, qr.loc, qr.to)
+	qr.filterKey = key + partialKey + calendarKey(q.Period, qr.from)
+	return ctx, qr, nil
+}
+
+// Overview returns what the overview endpoint does for q
+func (h *Handler) Overview(ctx context.Context, q Query) (*Overview, error) {
+	ctx, qr, err := h.queryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	ctx, spamKey := h.spamContext(ctx)
+	cacheKey := overviewCacheKey(qr.domain, q.Period, qr.filterKey, spamKey)
+
+	var data *Overview
+	if !h.cacheGet(ctx, cacheKey, &data) {
+		if data, err = h.store.GetOverview(ctx, qr.domain, qr.from, qr.to); err != nil {
+			return nil, err
+		}
+		h.spamExcluded.Add(data.ExcludedSpam)
+		h.cacheSet(ctx, cacheKey, data)
+	}
+	h.annotateOverview(ctx, qr.domain, data)
+	return data, nil
+}
+
+// TimeSeries returns the pageviews series the pageviews endpoint does for q,
+// with weeks starting on Monday; "" picks the interval from the period
+func (h *Handler) TimeSeries(ctx context.Context, q Query, interval string) ([]TimeSeriesPoint, error) {
+	ctx, qr, err := h.queryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	filterKey := qr.filterKey
+	if qr.loc != time.UTC {
+		filterKey += "|tz=" + qr.loc.String()
+	}
+	switch interval {
+	case "":
+		interval = periodInterval(q.Period, qr.from, qr.to)
+	case "hour", "day":
+	case "week":
+		filterKey += fmt.Sprintf("|week_start=%s", WeekStartMonday)
+	default:
+		return nil, &QueryError{fmt.Errorf("unknown interval %q, valid options: hour, day, week", interval)}
+	}
+
+	cacheKey := pageviewsCacheKey(qr.domain, q.Period, interval, filterKey)
+	var data []TimeSeriesPoint
+	if h.cacheGet(ctx, cacheKey, &data) {
+		return data, nil
+	}
+	if data, err = h.pageviewSeries(ctx, qr.domain, qr.from, qr.to, interval, WeekStartMonday, qr.loc); err != nil {
+		return nil, err
+	}
+	h.cacheSet(ctx, cacheKey, data)
+	return data, nil
+}
+
+// BreakdownDimensions are the dimensions Breakdown accepts
+var BreakdownDimensions = []string{"pages", "sources", "countries", "browsers", "events"}
+
+// Breakdown returns the top limit values of a dimension for q, as the pages,
+// sources, geo, devices and event breakdown endpoints count them, with how
+// many values they were cut from. Events are not limited, as on their endpoint.
+func (h *Handler) Breakdown(ctx context.Context, q Query, dimension string, limit int) (BreakdownResult, error) {
+	ctx, qr, err := h.queryContext(ctx, q)
+	if err != nil {
+		return BreakdownResult{}, err
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+
+	var cacheKey string
+	var fetch func(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
+	switch dimension {
+	case "pages":
+		cacheKey, fetch = pagesCacheKey(qr.domain, q.Period, limit, qr.filterKey), h.store.GetTopPages
+	case "sources":
+		var spamKey string
+		ctx, spamKey = h.spamContext(ctx)
+		cacheKey = fmt.Sprintf("sources:%s:%s:%d:%s:%s", qr.domain, q.Period, limit, qr.filterKey, spamKey)
+		fetch = h.store.GetTopSources
+	case "countries":
+		cacheKey, fetch = fmt.Sprintf("geo:%s:%s:%d:%s", qr.domain, q.Period, limit, qr.filterKey), h.store.GetTopCountries
+	case "browsers":
+		cacheKey, fetch = fmt.Sprintf("browsers:%s:%s:%d:%s", qr.domain, q.Period, limit, qr.filterKey), h.store.GetTopBrowsers
+	case "events":
+		cacheKey = fmt.Sprintf("event-breakdown:%s:%s:%s:%s", qr.domain, q.Period, qr.filterKey, "")
+		var data eventBreakdownResult
+		if !h.cacheGet(ctx, cacheKey, &data) {
+			if data, err = h.eventBreakdown(ctx, qr.domain, qr.from, qr.to); err != nil {
+				return BreakdownResult{}, err
+			}
+			h.cacheSet(ctx, cacheKey, data)
+		}
+		return newBreakdownResult(topItems(data.Items), 0), nil
+	default:
+		return BreakdownResult{}, &QueryError{fmt.Errorf("unknown dimension %q, valid options: %s", dimension, strings.Join(BreakdownDimensions, ", "))}
+	}
+	return h.topBreakdown(ctx, cacheKey, fetch, qr.domain, qr.from, qr.to, limit)
+}
+
+// Funnel runs the funnel endpoint's funnel over steps in its grammar; window
+// <= 0 means the default window between event steps. Like the endpoint it
+// isn't cached.
+func (h *Handler) Funnel(ctx context.Context, q Query, steps []string, window int) (*FunnelResult, error) {
+	ctx, qr, err := h.queryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := ParseFunnelSteps(strings.Join(steps, ","))
+	if err != nil {
+		return nil, &QueryError{err}
+	}
+	if len(parsed) < 2 {
+		return nil, &QueryError{fmt.Errorf("a funnel needs at least 2 steps")}
+	}
+	if window <= 0 {
+		window = defaultFunnelWindow
+	} else if window > funnel.MaxWindow {
+		return nil, &QueryError{fmt.Errorf("window must be at most %d minutes (30 days)", funnel.MaxWindow)}
+	}
+	return h.funnel(ctx, qr.domain, qr.from, qr.to, parsed, window)
+}
@@ -0,0 +1,95 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+const (
+	// maxReferrerURLLen caps referrer URLs; longer ones are cut before grouping
+	// so every visit from the same long URL lands in one row
+	maxReferrerURLLen = 300
+	// referrerURLsPerSource is how many URLs detail=url nests under each source
+	referrerURLsPerSource = 5
+)
+
+// referrerURLPattern keeps a referrer URL up to its query string or fragment
+const referrerURLPattern = `^([^?#]*)`
+
+// duckdbReferrerURLExpr is the referrer URL GetTopReferrerURLs groups by in DuckDB
+var duckdbReferrerURLExpr = fmt.Sprintf("left(regexp_extract(COALESCE(referrer, ''), '%s', 1), %d)", referrerURLPattern, maxReferrerURLLen)
+
+// clickhouseReferrerURLExpr is duckdbReferrerURLExpr for ClickHouse
+var clickhouseReferrerURLExpr = fmt.Sprintf("leftUTF8(extract(ifNull(referrer, ''), '%s'), %d)", referrerURLPattern, maxReferrerURLLen)
+
+// postgresReferrerURLExpr is duckdbReferrerURLExpr for Postgres
+var postgresReferrerURLExpr = fmt.Sprintf("left(COALESCE((regexp_match(referrer, '%s'))[1], ''), %d)", referrerURLPattern, maxReferrerURLLen)
+
+// ReferrerURLItem counts pageviews from one referrer URL. Source is the host it
+// is reported under by GetTopSources.
+type ReferrerURLItem struct {
+	Source string `json:"source"`
+	URL    string `json:"url"`
+	Count  int64  `json:"count"`
+}
+
+// nestReferrerURLs attaches each source's URLs, already ordered by count, to it
+func nestReferrerURLs(sources []SourceItem, urls []ReferrerURLItem) {
+	index := make(map[string]int, len(sources))
+	for i, s := range sources {
+		index[s.Name] = i
+	}
+	for _, u := range urls {
+		i, ok := index[aggregate.Label("referrer", u.Source)]
+		if !ok || len(sources[i].URLs) >= referrerURLsPerSource {
+			continue
+		}
+		sources[i].URLs = append(sources[i].URLs, TopItem{Name: u.URL, Count: u.Count})
+	}
+}
+
+// sourceURLs is the cached result of the detail=url sources query
+type sourceURLs struct {
+	Sources []SourceBucket    `json:"sources"`
+	URLs    []ReferrerURLItem `json:"urls"`
+}
+
+// handleSourceURLs serves HandleSources with detail=url: the top sources with
+// up to referrerURLsPerSource referring URLs each
+func (h *Handler) handleSourceURLs(ctx context.Context, w http.ResponseWriter, domain string, from, to time.Time, limit int, cacheKey string, classify bool) {
+	var data sourceURLs
+	if !h.cacheGet(ctx, cacheKey, &data) {
+		err := runParallel(ctx,
+			func(ctx context.Context) (err error) {
+				data.Sources, err = h.store.GetSourceBuckets(ctx, domain, from, to, limit)
+				return err
+			},
+			func(ctx context.Context) (err error) {
+				data.URLs, err = h.store.GetTopReferrerURLs(ctx, domain, from, to, referrerURLsPerSource)
+				return err
+			},
+		)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		h.cacheSet(ctx, cacheKey, data)
+	}
+
+	var items []SourceItem
+	if classify {
+		items = classifySources(data.Sources)
+	} else {
+		sources := topSources(data.Sources)
+		items = make([]SourceItem, len(sources))
+		for i, s := range sources {
+			items[i] = SourceItem{Name: s.Name, Count: s.Count}
+		}
+	}
+	nestReferrerURLs(items, data.URLs)
+	writeJSON(w, items)
+}
@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreTopReferrerURLs(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	long := "https://blog.example.org/" + strings.Repeat("a", 400)
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, 'v' || i AS visitor_id, 'pageview' AS name, '' AS url, '/' AS pathname,
+			ref AS referrer, '' AS country, '' AS browser, '' AS os, '' AS device, '' AS props,
+			'' AS utm_source, '' AS utm_medium, TIMESTAMP '2024-01-01 10:00:00' AS timestamp
+		FROM (VALUES
+			(1, 'https://github.com/acme/widget/blob/main/README.md'),
+			(2, 'https://github.com/acme/widget/blob/main/README.md?plain=1'),
+			(3, 'https://github.com/acme/widget/blob/main/README.md#install'),
+			(4, 'https://github.com/acme/other'),
+			(5, 'https://github.com/a'), (6, 'https://github.com/b'), (7, 'https://github.com/c'),
+			(8, 'https://github.com/d'), (9, 'https://github.com/e'),
+			(10, $1), (11, $1 || 'b'),
+			(12, 'https://example.com/pricing'),
+			(13, NULL),
+			(14, '')
+		) t(i, ref)
+	`, long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+
+	ctx := WithFilters(context.Background(), Filters{})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	got, err := s.GetTopReferrerURLs(ctx, "example.com", from, from.Add(24*time.Hour), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReferrerURLItem{
+		{Source: "github.com", URL: "https://github.com/acme/widget/blob/main/README.md", Count: 3},
+		// Both long URLs share their first 300 characters
+		{Source: "blog.example.org", URL: long[:maxReferrerURLLen], Count: 2},
+		{Source: "github.com", URL: "https://github.com/a", Count: 1},
+		{Source: "github.com", URL: "https://github.com/acme/other", Count: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTopReferrerURLs = %+v, want %+v", got, want)
+	}
+
+	// URL sources agree with the hosts GetTopSources reports
+	sources, err := s.GetTopSources(ctx, "example.com", from, from.Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := countsByName(sources)
+	for _, u := range got {
+		if counts[u.Source] == 0 {
+			t.Errorf("URL source %q not among sources %+v", u.Source, sources)
+		}
+	}
+}
+
+func TestNestReferrerURLs(t *testing.T) {
+	sources := []SourceItem{{Name: LabelDirect, Count: 4}, {Name: "github.com", Count: 9}}
+	var urls []ReferrerURLItem
+	for i := 0; i < 7; i++ {
+		urls = append(urls, ReferrerURLItem{Source: "github.com", URL: "https://github.com/" + string(rune('a'+i)), Count: int64(7 - i)})
+	}
+	urls = append(urls, ReferrerURLItem{Source: "gitlab.com", URL: "https://gitlab.com/x", Count: 1})
+
+	nestReferrerURLs(sources, urls)
+	if sources[0].URLs != nil {
+		t.Errorf("Direct got URLs: %+v", sources[0].URLs)
+	}
+	if len(sources[1].URLs) != referrerURLsPerSource || sources[1].URLs[0] != (TopItem{Name: "https://github.com/a", Count: 7}) {
+		t.Errorf("github.com URLs = %+v", sources[1].URLs)
+	}
+}
+
+// referrerURLStore returns fixed sources and referrer URLs
+type referrerURLStore struct {
+	sourcesStore
+}
+
+func (referrerURLStore) GetTopReferrerURLs(ctx context.Context, domain string, from, to time.Time, limit int) ([]ReferrerURLItem, error) {
+	return []ReferrerURLItem{{Source: "bing.com", URL: "https://bing.com/search", Count: 1}}, nil
+}
+
+func TestHandleSources_DetailURL(t *testing.T) {
+	h := NewHandler(referrerURLStore{})
+
+	for _, query := range []string{"detail=url", "detail=url&classify=true"} {
+		w := httptest.NewRecorder()
+		h.HandleSources(w, httptest.NewRequest("GET", "/api/stats/sources?domain=example.com&"+query, nil))
+		var items []SourceItem
+		json.NewDecoder(w.Body).Decode(&items)
+		if len(items) != 2 || len(items[1].URLs) != 1 || items[1].URLs[0].Name != "https://bing.com/search" {
+			t.Errorf("%s: items = %+v", query, items)
+		}
+		if classified := items[1].Channel != ""; classified != strings.Contains(query, "classify") {
+			t.Errorf("%s: channel = %q", query, items[1].Channel)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // logo formats
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/access"
+	"github.com/shortid/clickresearch-stats/internal/jobs"
+	"github.com/shortid/clickresearch-stats/internal/report"
+)
+
+const (
+	// reportSyncMaxRange is the longest range reported in the response; longer
+	// ones answer with a job to download the report from once it is ready
+	reportSyncMaxRange = 93 * 24 * time.Hour
+	// reportTopLimit is the rows of each table of a report
+	reportTopLimit = 10
+	// reportDownloadPath serves the reports of jobs
+	reportDownloadPath = "/api/stats/report/download"
+	// maxLogoBytes and maxLogoPixels bound the logos fetched for reports
+	maxLogoBytes  = 2 << 20
+	maxLogoPixels = 2000 * 2000
+)
+
+// errReportsDisabled is returned when no job runner generates reports
+var errReportsDisabled = errors.New("report generation is not enabled")
+
+// ReportBranding styles a project's reports: a logo drawn at the top and an
+// accent color for the header band and charts
+type ReportBranding struct {
+	LogoURL     string `json:"logo_url"`
+	AccentColor string `json:"accent_color"`
+}
+
+var accentColorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Validate checks branding before it is stored; both fields may be empty
+func (b ReportBranding) Validate() error {
+	if b.LogoURL != "" {
+		u, err := url.Parse(b.LogoURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" || len(b.LogoURL) > 2048 {
+			return fmt.Errorf("logo_url must be an https URL of at most 2048 characters")
+		}
+	}
+	if b.AccentColor != "" && !accentColorRe.MatchString(b.AccentColor) {
+		return fmt.Errorf("accent_color must be a hex color like #2563eb")
+	}
+	return nil
+}
+
+// accent is the accent color, zero when unset
+func (b ReportBranding) accent() color.RGBA {
+	if !accentColorRe.MatchString(b.AccentColor) {
+		return color.RGBA{}
+	}
+	v, _ := strconv.ParseUint(b.AccentColor[1:], 16, 32)
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
+
+// BrandingSource loads the report branding of the project a domain belongs
+// to; unknown domains get none
+type BrandingSource interface {
+	ReportBranding(domain string) (ReportBranding, error)
+}
+
+// SetBrandingSource enables per-project branding of reports
+func (h *Handler) SetBrandingSource(src BrandingSource) {
+	h.branding = src
+}
+
+// SetReportRunner enables POST /api/stats/report, generating reports on runner
+func (h *Handler) SetReportRunner(r *jobs.Runner) {
+	h.reports = r
+	if h.logoClient == nil {
+		h.logoClient = &http.Client{Timeout: 10 * time.Second}
+	}
+}
+
+// reportFile is a generated report
+type reportFile struct {
+	Domain      string
+	Filename    string
+	ContentType string
+	Body        []byte
+}
+
+// reportJob is the response for reports generated in the background
+type reportJob struct {
+	JobID       string     `json:"job_id"`
+	Status      jobs.State `json:"status"`
+	DownloadURL string     `json:"download_url"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// HandleReport renders the overview, pageviews and top pages, sources and
+// countries of a domain and period as a PDF, or with format=png the first
+// page as a PNG. Filters apply as on the dashboard. Ranges up to
+// reportSyncMaxRange answer with the file; longer ones with 202 and a job
+// whose report reportDownloadPath serves once ready.
+func (h *Handler) HandleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+	if h.reports == nil {
+		writeError(w, errReportsDisabled, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "pdf"
+	case "pdf", "png":
+	default:
+		writeError(w, fmt.Errorf("unknown format %q, valid options: pdf, png", format), http.StatusBadRequest)
+		return
+	}
+	loc, err := reportingLocation(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx, _, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	interval := periodInterval(r.URL.Query().Get("period"), from, to)
+
+	// The job outlives the request when it runs in the background
+	base := context.WithoutCancel(ctx)
+	id, err := h.reports.Submit("report", func(jobCtx context.Context) (any, error) {
+		ctx, cancel := context.WithCancel(base)
+		defer cancel()
+		stop := context.AfterFunc(jobCtx, cancel)
+		defer stop()
+		return h.renderReport(ctx, domain, from, to, loc, interval, format)
+	})
+	if errors.Is(err, jobs.ErrQueueFull) {
+		writeError(w, ErrBusy, http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if to.Sub(from) > reportSyncMaxRange {
+		writeReportJob(w, http.StatusAccepted, reportJob{JobID: id, Status: jobs.StateQueued, DownloadURL: reportDownloadPath + "?id=" + id})
+		return
+	}
+	job, err := h.reports.Wait(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if job.State == jobs.StateFailed {
+		writeError(w, job.Err, http.StatusInternalServerError)
+		return
+	}
+	writeReportFile(w, job.Result.(reportFile))
+}
+
+// HandleReportDownload serves the report of a job from HandleReport, or its
+// status with 202 while it is generated
+func (h *Handler) HandleReportDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, nil, http.StatusMethodNotAllowed)
+		return
+	}
+	if h.reports == nil {
+		writeError(w, errReportsDisabled, http.StatusServiceUnavailable)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	job, err := h.reports.Get(id)
+	if err != nil || job.Kind != "report" {
+		writeError(w, fmt.Errorf("report %q not found or expired", id), http.StatusNotFound)
+		return
+	}
+
+	status := reportJob{JobID: id, Status: job.State, DownloadURL: reportDownloadPath + "?id=" + id}
+	switch job.State {
+	case jobs.StateDone:
+		file := job.Result.(reportFile)
+		if !access.PolicyFromContext(r.Context()).AllowsDomain(file.Domain) {
+			writeError(w, ErrDomainForbidden, http.StatusForbidden)
+			return
+		}
+		writeReportFile(w, file)
+	case jobs.StateFailed:
+		status.Error = job.Error
+		writeReportJob(w, http.StatusInternalServerError, status)
+	default:
+		writeReportJob(w, http.StatusAccepted, status)
+	}
+}
+
+func writeReportJob(w http.ResponseWriter, code int, job reportJob) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, job)
+}
+
+func writeReportFile(w http.ResponseWriter, f reportFile) {
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.Filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.Body)))
+	w.Write(f.Body)
+}
+
+// renderReport queries the report of [from, to) and renders it in format
+func (h *Handler) renderReport(ctx context.Context, domain string, from, to time.Time, loc *time.Location, interval, format string) (reportFile, error) {
+	rep, err := h.reportContent(ctx, domain, from, to, loc, interval)
+	if err != nil {
+		return reportFile{}, err
+	}
+	h.brandReport(ctx, domain, &rep)
+
+	pages := report.Layout(rep)
+	var buf bytes.Buffer
+	f := reportFile{
+		Domain:   domain,
+		Filename: fmt.Sprintf("%s-%s-%s.%s", domain, from.In(loc).Format("20060102"), to.Add(-time.Nanosecond).In(loc).Format("20060102"), format),
+	}
+	if format == "png" {
+		f.ContentType = "image/png"
+		err = report.WritePNG(&buf, pages[0], rep.Logo)
+	} else {
+		f.ContentType = "application/pdf"
+		err = report.WritePDF(&buf, pages, rep.Logo)
+	}
+	f.Body = buf.Bytes()
+	return f, err
+}
+
+// reportContent queries the numbers of a report
+func (h *Handler) reportContent(ctx context.Context, domain string, from, to time.Time, loc *time.Location, interval string) (report.Report, error) {
+	rep := report.Report{
+		Title:  "Traffic report",
+		Domain: domain,
+		Period: from.In(loc).Format("2 Jan 2006") + " - " + to.Add(-time.Nanosecond).In(loc).Format("2 Jan 2006"),
+	}
+
+	overview, err := h.store.GetOverview(ctx, domain, from, to)
+	if err != nil {
+		return rep, err
+	}
+	rep.Metrics = []report.Metric{
+		{Label: "Pageviews", Value: report.FormatCount(overview.Pageviews)},
+		{Label: "Unique visitors", Value: report.FormatCount(overview.UniqueVisitors)},
+		{Label: "Events", Value: report.FormatCount(overview.Events)},
+	}
+
+	series, err := h.pageviewSeries(ctx, domain, from, to, interval, WeekStartMonday, loc)
+	if err != nil {
+		return rep, err
+	}
+	rep.Series = report.Series{Title: "Pageviews"}
+	for _, p := range series {
+		rep.Series.Points = append(rep.Series.Points, report.Point{Label: seriesLabel(p.Time, interval), Value: float64(p.Value)})
+	}
+
+	for _, t := range []struct {
+		title string
+		get   func(context.Context, string, time.Time, time.Time, int) ([]TopItem, error)
+		label func(string) string
+	}{
+		{"Top pages", h.store.GetTopPages, nil},
+		{"Top sources", h.store.GetTopSources, nil},
+		{"Top countries", h.store.GetTopCountries, countryLabel},
+	} {
+		items, err := t.get(ctx, domain, from, to, reportTopLimit)
+		if err != nil {
+			return rep, err
+		}
+		table := report.Table{Title: t.title}
+		for _, item := range items {
+			label := item.Name
+			if t.label != nil {
+				label = t.label(label)
+			}
+			table.Rows = append(table.Rows, report.Row{Label: label, Value: item.Count})
+		}
+		rep.Tables = append(rep.Tables, table)
+	}
+	return rep, nil
+}
+
+// seriesLabel shortens a series time for the chart's axis
+func seriesLabel(t, interval string) string {
+	if interval == "hour" {
+		if ts, err := time.Parse("2006-01-02T15:00", t); err == nil {
+			return ts.Format("Jan 2 15:00")
+		}
+	}
+	if ts, err := time.Parse("2006-01-02", t); err == nil {
+		return ts.Format("Jan 2")
+	}
+	return t
+}
+
+// countryLabel names a country code, keeping values that aren't one
+func countryLabel(code string) string {
+	if c, ok := lookupCountry(strings.ToUpper(code)); ok {
+		return c.Name
+	}
+	return code
+}
+
+// brandReport applies the project's branding; a logo that can't be fetched
+// is left out
+func (h *Handler) brandReport(ctx context.Context, domain string, rep *report.Report) {
+	if h.branding == nil {
+		return
+	}
+	b, err := h.branding.ReportBranding(domain)
+	if err != nil {
+		log.Printf("stats: report branding of %s: %v", domain, err)
+		return
+	}
+	rep.Accent = b.accent()
+	if b.LogoURL == "" {
+		return
+	}
+	if rep.Logo, err = h.fetchLogo(ctx, b.LogoURL); err != nil {
+		log.Printf("stats: report logo of %s: %v", domain, err)
+	}
+}
+
+// fetchLogo downloads and decodes a PNG, JPEG or GIF logo
+func (h *Handler) fetchLogo(ctx context.Context, logoURL string) (image.Image, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, logoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.logoClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLogoBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxLogoBytes {
+		return nil, fmt.Errorf("logo exceeds %d bytes", maxLogoBytes)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxLogoPixels {
+		return nil, fmt.Errorf("logo of %dx%d pixels is too large", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
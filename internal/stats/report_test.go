@@ -0,0 +1,198 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/jobs"
+)
+
+// reportStore answers the queries of a report with fixed numbers
+type reportStore struct {
+	emptyStore
+}
+
+func (reportStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	return &Overview{Pageviews: 12_437, UniqueVisitors: 3_210, Events: 15_002}, nil
+}
+func (reportStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
+	return []TimeSeriesPoint{{Time: "2024-03-01", Value: 40}, {Time: "2024-03-02", Value: 55}}, nil
+}
+func (reportStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return []TopItem{{Name: "/", Count: 900}, {Name: "/pricing", Count: 120}}, nil
+}
+func (reportStore) GetTopCountries(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return []TopItem{{Name: "de", Count: 70}, {Name: "Atlantis", Count: 1}}, nil
+}
+
+type fakeBranding ReportBranding
+
+func (b fakeBranding) ReportBranding(domain string) (ReportBranding, error) {
+	return ReportBranding(b), nil
+}
+
+func reportHandler(t *testing.T) *Handler {
+	t.Helper()
+	logo := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	logo.Set(0, 0, color.RGBA{0xff, 0, 0, 0xff})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		png.Encode(w, logo)
+	}))
+	t.Cleanup(srv.Close)
+
+	h := NewHandler(reportStore{})
+	h.SetReportRunner(jobs.NewRunner(jobs.Config{Concurrency: 1}))
+	h.SetBrandingSource(fakeBranding{LogoURL: srv.URL + "/logo.png", AccentColor: "#ff8800"})
+	return h
+}
+
+func TestHandleReport_PDF(t *testing.T) {
+	h := reportHandler(t)
+	w := httptest.NewRecorder()
+	h.HandleReport(w, httptest.NewRequest("POST", "/api/stats/report?domain=example.com&period=30d", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, `filename="example.com-`) || !strings.HasSuffix(cd, `.pdf"`) {
+		t.Errorf("Content-Disposition = %s", cd)
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "%PDF-") || !strings.Contains(body, "/XObject << /Logo") {
+		t.Error("want a PDF with the project's logo")
+	}
+}
+
+func TestHandleReport_PNG(t *testing.T) {
+	h := reportHandler(t)
+	w := httptest.NewRecorder()
+	h.HandleReport(w, httptest.NewRequest("POST", "/api/stats/report?domain=example.com&period=7d&format=png", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("status = %d, Content-Type = %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := color.RGBAModel.Convert(img.At(10, 2)).(color.RGBA); c != (color.RGBA{0xff, 0x88, 0x00, 0xff}) {
+		t.Errorf("header band %v, want the accent color", c)
+	}
+}
+
+func TestHandleReport_LongRangeRunsAsJob(t *testing.T) {
+	h := reportHandler(t)
+	w := httptest.NewRecorder()
+	h.HandleReport(w, httptest.NewRequest("POST", "/api/stats/report?domain=example.com&period=last_12_months", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", w.Code)
+	}
+	var job reportJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || job.JobID == "" || job.DownloadURL != reportDownloadPath+"?id="+job.JobID {
+		t.Fatalf("job = %+v, %v", job, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w = httptest.NewRecorder()
+		h.HandleReportDownload(w, httptest.NewRequest("GET", job.DownloadURL, nil))
+		if w.Code != http.StatusAccepted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("report not generated in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "%PDF-") {
+		t.Errorf("download = %d, want the PDF", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h.HandleReportDownload(w, httptest.NewRequest("GET", reportDownloadPath+"?id=unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown job = %d, want 404", w.Code)
+	}
+}
+
+func TestHandleReport_Invalid(t *testing.T) {
+	h := reportHandler(t)
+	for _, tt := range []struct {
+		method, query string
+		code          int
+	}{
+		{"GET", "?domain=example.com", http.StatusMethodNotAllowed},
+		{"POST", "?domain=example.com&format=docx", http.StatusBadRequest},
+		{"POST", "?domain=example.com&period=forever", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.SetStrictParams(true)
+		h.HandleReport(w, httptest.NewRequest(tt.method, "/api/stats/report"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.query, w.Code, tt.code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	NewHandler(reportStore{}).HandleReport(w, httptest.NewRequest("POST", "/api/stats/report?domain=example.com", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without a runner = %d, want 503", w.Code)
+	}
+}
+
+func TestReportContent(t *testing.T) {
+	h := NewHandler(reportStore{})
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rep, err := h.reportContent(WithFilters(context.Background(), Filters{}), "example.com", from, from.AddDate(0, 1, 0), time.UTC, "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Period != "1 Mar 2024 - 31 Mar 2024" {
+		t.Errorf("period = %q", rep.Period)
+	}
+	if rep.Metrics[0].Value != "12,437" {
+		t.Errorf("metrics = %+v", rep.Metrics)
+	}
+	// Days without pageviews are filled in
+	if p := rep.Series.Points; len(p) != 31 || p[0].Label != "Mar 1" || p[1].Value != 55 || p[30].Label != "Mar 31" {
+		t.Errorf("series = %+v", p)
+	}
+	countries := rep.Tables[2]
+	if countries.Rows[0].Label != "Germany" || countries.Rows[1].Label != "Atlantis" {
+		t.Errorf("countries = %+v, want codes named", countries.Rows)
+	}
+}
+
+func TestReportBranding_Validate(t *testing.T) {
+	for _, b := range []ReportBranding{
+		{},
+		{LogoURL: "https://cdn.example.com/logo.png", AccentColor: "#2563eb"},
+	} {
+		if err := b.Validate(); err != nil {
+			t.Errorf("%+v: %v", b, err)
+		}
+	}
+	for _, b := range []ReportBranding{
+		{LogoURL: "http://cdn.example.com/logo.png"},
+		{LogoURL: "javascript:alert(1)"},
+		{AccentColor: "orange"},
+		{AccentColor: "#fff"},
+	} {
+		if err := b.Validate(); err == nil {
+			t.Errorf("%+v: no error", b)
+		}
+	}
+	if c := (ReportBranding{AccentColor: "#FF8800"}).accent(); c != (color.RGBA{0xff, 0x88, 0x00, 0xff}) {
+		t.Errorf("accent = %v", c)
+	}
+}
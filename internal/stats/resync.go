@@ -0,0 +1,414 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// resyncTable is the shadow table a resync rebuilds the events into
+	resyncTable = "events_resync"
+	// resyncStateTable records the partitions a resync has copied, so a
+	// restarted server resumes the rebuild rather than starting over
+	resyncStateTable = "events_resync_state"
+)
+
+// resyncStateDDL creates resyncStateTable, a row per copied month
+const resyncStateDDL = `
+	CREATE TABLE IF NOT EXISTS ` + resyncStateTable + ` (
+		month UInt32,
+		rows UInt64,
+		done_at DateTime DEFAULT now()
+	) ENGINE = MergeTree ORDER BY month`
+
+// ErrResyncRunning is returned when a resync is started while one runs
+var ErrResyncRunning = errors.New("a resync is already running")
+
+// ResyncProgress reports a full resync of the ClickHouse events table
+type ResyncProgress struct {
+	State      string `json:"state"` // running, done or failed
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	// Partitions are months of events, copied oldest first
+	PartitionsDone  int   `json:"partitions_done"`
+	PartitionsTotal int   `json:"partitions_total"`
+	RowsDone        int64 `json:"rows_done"`
+	RowsTotal       int64 `json:"rows_total"`
+	// Resumed counts the partitions an earlier run had copied already
+	Resumed    int    `json:"resumed,omitempty"`
+	ETASeconds int64  `json:"eta_seconds,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// resyncPartition is a month of events, as toYYYYMM(timestamp), and its rows
+type resyncPartition struct {
+	id   uint32
+	rows uint64
+}
+
+// ResyncJob rebuilds the events table of a ClickHouseStore without taking it
+// offline. It copies the source into a shadow table a month at a time, leaving
+// out tombstoned visitors and columns the table or the source lacks, then
+// exchanges the tables atomically. Queries read the live table throughout;
+// the sync lock is only held to copy the current month and exchange.
+type ResyncJob struct {
+	s *ClickHouseStore
+
+	mu       sync.Mutex
+	running  bool
+	progress *ResyncProgress
+	// copied counts the rows this run copied and started when, for the ETA
+	copied  int64
+	started time.Time
+}
+
+// Progress returns the running or last resync, or nil if none ran
+func (j *ResyncJob) Progress() *ResyncProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.progress == nil {
+		return nil
+	}
+	p := *j.progress
+	return &p
+}
+
+// Start runs a resync from scan in the background, resuming one a previous
+// run left unfinished
+func (j *ResyncJob) Start(scan string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		return ErrResyncRunning
+	}
+	j.running = true
+	j.started = time.Now()
+	j.copied = 0
+	j.progress = &ResyncProgress{State: "running", StartedAt: j.started.UTC().Format(time.RFC3339)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-j.s.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer cancel()
+		err := j.run(ctx, scan)
+		j.finish(err)
+	}()
+	return nil
+}
+
+// finish records the outcome of a run
+func (j *ResyncJob) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.running = false
+	j.progress.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	j.progress.ETASeconds = 0
+	if err != nil {
+		j.progress.State = "failed"
+		j.progress.Error = err.Error()
+		log.Printf("ClickHouse: resync failed after %d of %d partitions: %v", j.progress.PartitionsDone, j.progress.PartitionsTotal, err)
+		return
+	}
+	j.progress.State = "done"
+	log.Printf("ClickHouse: resync done, %d rows in %v", j.progress.RowsDone, time.Since(j.started).Round(time.Second))
+}
+
+// planned records the partitions to copy and those copied before
+func (j *ResyncJob) planned(partitions []resyncPartition, done map[uint32]uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.progress.PartitionsTotal = len(partitions)
+	for _, p := range partitions {
+		j.progress.RowsTotal += int64(p.rows)
+		if rows, ok := done[p.id]; ok {
+			j.progress.PartitionsDone++
+			j.progress.Resumed++
+			j.progress.RowsDone += int64(rows)
+		}
+	}
+}
+
+// copiedPartition records a partition of rows copied, updating the ETA
+func (j *ResyncJob) copiedPartition(rows uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.copied += int64(rows)
+	j.progress.PartitionsDone++
+	j.progress.RowsDone += int64(rows)
+	j.progress.ETASeconds = resyncETA(time.Since(j.started), j.copied, j.progress.RowsTotal-j.progress.RowsDone)
+}
+
+// resyncETA estimates the seconds left to copy remaining rows at the rate
+// copied rows took elapsed
+func resyncETA(elapsed time.Duration, copied, remaining int64) int64 {
+	if copied <= 0 || remaining <= 0 {
+		return 0
+	}
+	return int64((elapsed.Seconds()*float64(remaining))/float64(copied) + 0.5)
+}
+
+// intersectColumns lists the columns of target that source has as well, in
+// target's order. Columns new to the table keep their defaults; columns the
+// table dropped are left behind.
+func intersectColumns(source, target []string) []string {
+	var columns []string
+	for _, c := range target {
+		if slices.Contains(source, c) {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// run copies scan into the shadow table and exchanges it with the events table
+func (j *ResyncJob) run(ctx context.Context, scan string) error {
+	s := j.s
+	if err := s.conn.Exec(ctx, resyncStateDDL); err != nil {
+		return fmt.Errorf("creating resync state failed: %w", err)
+	}
+	done, err := j.donePartitions(ctx)
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		// Nothing to resume: start from an empty shadow with the current schema
+		if err := s.conn.Exec(ctx, "DROP TABLE IF EXISTS "+resyncTable); err != nil {
+			return err
+		}
+	}
+	if err := s.conn.Exec(ctx, eventsTableDDL(resyncTable)); err != nil {
+		return fmt.Errorf("creating shadow table failed: %w", err)
+	}
+
+	columns, err := j.columns(ctx, scan)
+	if err != nil {
+		return err
+	}
+	partitions, err := j.partitions(ctx, scan, 0)
+	if err != nil {
+		return err
+	}
+	j.planned(partitions, done)
+	if len(done) > 0 {
+		log.Printf("ClickHouse: resuming resync, %d of %d partitions copied before", len(done), len(partitions))
+	}
+
+	// Months from the current one on still change; they are copied with the
+	// sync lock held, right before the exchange
+	current := uint32(yyyymm(time.Now()))
+	for _, p := range partitions {
+		if p.id >= current {
+			break
+		}
+		if _, ok := done[p.id]; ok {
+			continue
+		}
+		if err := j.copyPartition(ctx, scan, columns, p); err != nil {
+			return err
+		}
+		if err := s.conn.Exec(ctx, `INSERT INTO `+resyncStateTable+` (month, rows) VALUES (?, ?)`, p.id, p.rows); err != nil {
+			return fmt.Errorf("recording partition %d failed: %w", p.id, err)
+		}
+		j.copiedPartition(p.rows)
+	}
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	live, err := j.partitions(ctx, scan, current)
+	if err != nil {
+		return err
+	}
+	for _, p := range live {
+		if err := j.copyPartition(ctx, scan, columns, p); err != nil {
+			return err
+		}
+		j.copiedPartition(p.rows)
+	}
+	return j.exchange(ctx)
+}
+
+// donePartitions loads the partitions a previous run copied
+func (j *ResyncJob) donePartitions(ctx context.Context) (map[uint32]uint64, error) {
+	rows, err := j.s.conn.Query(ctx, `SELECT month, max(rows) FROM `+resyncStateTable+` GROUP BY month`)
+	if err != nil {
+		return nil, fmt.Errorf("reading resync state failed: %w", err)
+	}
+	defer rows.Close()
+	done := make(map[uint32]uint64)
+	for rows.Next() {
+		var p uint32
+		var n uint64
+		if err := rows.Scan(&p, &n); err != nil {
+			return nil, err
+		}
+		done[p] = n
+	}
+	return done, rows.Err()
+}
+
+// source is scan as syncs load it: tombstoned visitors left out, event names
+// outside allow-lists folded and fields capped. The tombstones are read anew
+// for each partition, so visitors erased during a long resync stay erased.
+func (j *ResyncJob) source(scan string) string {
+	s := j.s
+	source, _ := s.tombstones.exclude(scan, clickhouseQuote)
+	return fmt.Sprintf("(SELECT %s FROM %s)", clickhouseIngestColumns(s.timestamps.skew()), s.eventNames.clickhouseIngestSource(source))
+}
+
+// columns are the shadow table's stored columns the source has too
+func (j *ResyncJob) columns(ctx context.Context, scan string) ([]string, error) {
+	rows, err := j.s.conn.Query(ctx, "SELECT * FROM "+j.source(scan)+" LIMIT 0")
+	if err != nil {
+		return nil, fmt.Errorf("reading source columns failed: %w", err)
+	}
+	source := rows.Columns()
+	rows.Close()
+
+	var target []string
+	rows, err = j.s.conn.Query(ctx, `
+		SELECT name FROM system.columns
+		WHERE database = currentDatabase() AND table = ?
+		AND default_kind NOT IN ('MATERIALIZED', 'ALIAS')
+		ORDER BY position
+	`, resyncTable)
+	if err != nil {
+		return nil, fmt.Errorf("reading shadow table columns failed: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		target = append(target, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	columns := intersectColumns(source, target)
+	for _, required := range []string{"domain", "timestamp"} {
+		if !slices.Contains(columns, required) {
+			return nil, fmt.Errorf("source has no %s column", required)
+		}
+	}
+	return columns, nil
+}
+
+// partitions lists the source's months from since on, oldest first
+func (j *ResyncJob) partitions(ctx context.Context, scan string, since uint32) ([]resyncPartition, error) {
+	rows, err := j.s.conn.Query(ctx, `
+		SELECT toUInt32(toYYYYMM(timestamp)) AS month, count()
+		FROM `+j.source(scan)+`
+		WHERE toYYYYMM(timestamp) >= ?
+		GROUP BY month
+		ORDER BY month
+	`, since)
+	if err != nil {
+		return nil, fmt.Errorf("listing partitions failed: %w", err)
+	}
+	defer rows.Close()
+	var partitions []resyncPartition
+	for rows.Next() {
+		var p resyncPartition
+		if err := rows.Scan(&p.id, &p.rows); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// copyPartition replaces a month of the shadow table with the source's
+func (j *ResyncJob) copyPartition(ctx context.Context, scan string, columns []string, p resyncPartition) error {
+	s := j.s
+	// A run stopped mid-copy may have left part of the month behind
+	if err := s.conn.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DROP PARTITION %d", resyncTable, p.id)); err != nil {
+		return fmt.Errorf("clearing partition %d failed: %w", p.id, err)
+	}
+	list := strings.Join(columns, ", ")
+	if err := s.conn.Exec(ctx, fmt.Sprintf(`
+		INSERT INTO %[1]s (%[2]s)
+		SELECT %[2]s FROM %[3]s
+		WHERE toYYYYMM(timestamp) = %[4]d
+	`, resyncTable, list, j.source(scan), p.id)); err != nil {
+		return fmt.Errorf("copying partition %d failed: %w", p.id, err)
+	}
+	return nil
+}
+
+// exchange swaps the shadow table in for the events table and drops the old
+// one. The caller holds the sync lock.
+func (j *ResyncJob) exchange(ctx context.Context) error {
+	s := j.s
+	// Partitions copied by a run before a restart predate later erasures
+	if cond, _ := s.tombstones.condition(clickhouseQuote); cond != "" {
+		if err := s.conn.Exec(ctx, "DELETE FROM "+resyncTable+" WHERE "+cond); err != nil {
+			return fmt.Errorf("erasing tombstoned visitors failed: %w", err)
+		}
+	}
+	// EXCHANGE is atomic on databases with the Atomic engine, the default
+	if err := s.conn.Exec(ctx, "EXCHANGE TABLES events AND "+resyncTable); err != nil {
+		return fmt.Errorf("exchanging tables failed: %w", err)
+	}
+	if err := s.conn.Exec(ctx, "DROP TABLE IF EXISTS "+resyncTable); err != nil {
+		log.Printf("ClickHouse: dropping the replaced events table failed: %v", err)
+	}
+	if err := s.conn.Exec(ctx, "TRUNCATE TABLE IF EXISTS "+resyncStateTable); err != nil {
+		log.Printf("ClickHouse: clearing resync state failed: %v", err)
+	}
+
+	s.recordLoad(ctx)
+	s.recordSync(nil)
+	return nil
+}
+
+// pendingResync reports whether a resync stopped before its exchange
+func (j *ResyncJob) pendingResync(ctx context.Context) bool {
+	var n uint64
+	if err := j.s.conn.QueryRow(ctx, `
+		SELECT count() FROM system.tables
+		WHERE database = currentDatabase() AND name IN (?, ?)
+	`, resyncTable, resyncStateTable).Scan(&n); err != nil || n < 2 {
+		return false
+	}
+	done, err := j.donePartitions(ctx)
+	return err == nil && len(done) > 0
+}
+
+// StartResync rebuilds the events table from S3 in the background; see ResyncJob
+func (s *ClickHouseStore) StartResync() error {
+	return s.resync.Start(s.s3.clickhouseSource())
+}
+
+// HandleResync starts a full resync (POST) or reports the running or last one
+// (GET), as the store status does. Admin-only; wrapped by auth in main.
+func (s *ClickHouseStore) HandleResync(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.resync.Progress())
+	case http.MethodPost:
+		if err := s.StartResync(); err != nil {
+			writeError(w, err, http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, s.resync.Progress())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,149 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+func TestIntersectColumns(t *testing.T) {
+	target := []string{"domain", "visitor_id", "timestamp", "city", "received_at"}
+	// The source predates city and still has a column the table dropped
+	source := []string{"received_at", "legacy_flag", "timestamp", "visitor_id", "domain"}
+	want := []string{"domain", "visitor_id", "timestamp", "received_at"}
+	if got := intersectColumns(source, target); !reflect.DeepEqual(got, want) {
+		t.Errorf("intersectColumns = %v, want %v", got, want)
+	}
+}
+
+func TestResyncETA(t *testing.T) {
+	tests := []struct {
+		elapsed           time.Duration
+		copied, remaining int64
+		want              int64
+	}{
+		{time.Minute, 1000, 3000, 180},
+		{10 * time.Second, 500, 25, 1},
+		{time.Minute, 0, 3000, 0}, // no rate yet
+		{time.Minute, 1000, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := resyncETA(tt.elapsed, tt.copied, tt.remaining); got != tt.want {
+			t.Errorf("resyncETA(%v, %d, %d) = %d, want %d", tt.elapsed, tt.copied, tt.remaining, got, tt.want)
+		}
+	}
+}
+
+// TestClickHouseIntegration_Resync needs a ClickHouse server. It resumes a
+// resync an earlier run left after its first month and checks the exchanged
+// table: months copied before are kept, the rest come from the source, and
+// tombstoned visitors are left out.
+func TestClickHouseIntegration_Resync(t *testing.T) {
+	addr := os.Getenv("CLICKHOUSE_TEST_ADDR")
+	if addr == "" {
+		t.Skip("CLICKHOUSE_TEST_ADDR not set")
+	}
+	ctx := context.Background()
+
+	admin, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	database := fmt.Sprintf("clickresearch_test_%d", time.Now().UnixNano())
+	if err := admin.Exec(ctx, "CREATE DATABASE "+database); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Exec(ctx, "DROP DATABASE IF EXISTS "+database)
+
+	conn, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}, Auth: clickhouse.Auth{Database: database}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tombstones := NewTombstones()
+	tombstones.Set(map[string][]string{"example.com": {"erased"}})
+	s := &ClickHouseStore{conn: conn, stopCh: make(chan struct{}), tombstones: tombstones}
+	s.resync.s = s
+	if err := s.ensureTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source has a visitor in each of the last three months and this one
+	insert := func(table, visitor string, monthsAgo int) {
+		t.Helper()
+		if err := conn.Exec(ctx, fmt.Sprintf(`
+			INSERT INTO %s (domain, visitor_id, name, timestamp, received_at)
+			SELECT 'example.com', '%s', 'pageview', ts, ts
+			FROM (SELECT toDateTime64(toStartOfMonth(today()), 6, 'UTC') - toIntervalMonth(%d) + toIntervalHour(1) AS ts)
+		`, table, visitor, monthsAgo)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.Exec(ctx, eventsTableDDL("source_events")); err != nil {
+		t.Fatal(err)
+	}
+	for ago := 3; ago >= 0; ago-- {
+		insert("source_events", fmt.Sprintf("source-%d", ago), ago)
+	}
+	insert("source_events", "erased", 1)
+	insert("events", "stale", 0)
+
+	// An earlier run copied the oldest month before the server restarted
+	if err := conn.Exec(ctx, resyncStateDDL); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Exec(ctx, eventsTableDDL(resyncTable)); err != nil {
+		t.Fatal(err)
+	}
+	insert(resyncTable, "resumed", 3)
+	oldest := uint32(yyyymm(time.Now().UTC().AddDate(0, -3, 0)))
+	if err := conn.Exec(ctx, `INSERT INTO `+resyncStateTable+` (month, rows) VALUES (?, 1)`, oldest); err != nil {
+		t.Fatal(err)
+	}
+	if !s.resync.pendingResync(ctx) {
+		t.Fatal("unfinished resync not detected")
+	}
+
+	s.resync.progress = &ResyncProgress{State: "running"}
+	if err := s.resync.run(ctx, "source_events"); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := conn.Query(ctx, "SELECT visitor_id FROM events ORDER BY timestamp, visitor_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var visitors []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		visitors = append(visitors, v)
+	}
+	rows.Close()
+	if want := []string{"resumed", "source-2", "source-1", "source-0"}; !reflect.DeepEqual(visitors, want) {
+		t.Errorf("events after the exchange = %v, want %v", visitors, want)
+	}
+
+	p := s.resync.Progress()
+	if p.Resumed != 1 || p.PartitionsDone != 4 || p.PartitionsTotal != 4 {
+		t.Errorf("progress = %+v, want 4 partitions, 1 resumed", p)
+	}
+	if s.resync.pendingResync(ctx) {
+		t.Error("resync still pending after the exchange")
+	}
+	var shadows uint64
+	if err := conn.QueryRow(ctx, `SELECT count() FROM system.tables WHERE database = currentDatabase() AND name = ?`, resyncTable).Scan(&shadows); err != nil || shadows != 0 {
+		t.Errorf("shadow tables left = %d, %v", shadows, err)
+	}
+	if s.Status().LastRefresh == "" {
+		t.Error("the exchange did not count as a refresh")
+	}
+}
@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxRefreshBackoff caps the wait between failing refreshes
+const maxRefreshBackoff = time.Hour
+
+// refreshRetrier spaces out the background refreshes of a store. After a
+// success the next refresh follows the regular interval; consecutive failures
+// double the wait up to maxRefreshBackoff, with jitter so replicas sharing a
+// broken bucket don't retry in lockstep.
+type refreshRetrier struct {
+	now   func() time.Time    // time.Now when nil
+	randN func(n int64) int64 // rand.Int63n when nil; returns [0, n)
+
+	mu       sync.Mutex
+	failures int
+	next     time.Time
+}
+
+// schedule records the outcome of a refresh and returns how long to wait
+// before the next one, given the regular interval
+func (r *refreshRetrier) schedule(interval time.Duration, err error) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wait := interval
+	if err == nil {
+		r.failures = 0
+	} else {
+		r.failures++
+		limit := maxRefreshBackoff
+		if interval > limit {
+			limit = interval
+		}
+		for i := 1; i < r.failures && wait < limit; i++ {
+			wait *= 2
+		}
+		if wait > limit {
+			wait = limit
+		}
+		// Equal jitter: somewhere in the second half of the backoff
+		randN := r.randN
+		if randN == nil {
+			randN = rand.Int63n
+		}
+		if half := int64(wait / 2); half > 0 {
+			wait = time.Duration(half + randN(half))
+		}
+	}
+
+	now := time.Now
+	if r.now != nil {
+		now = r.now
+	}
+	r.next = now().Add(wait)
+	return wait
+}
+
+// status adds the scheduled refresh and the failure streak to st
+func (r *refreshRetrier) status(st *StoreStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.next.IsZero() {
+		st.NextRefresh = r.next.UTC().Format(time.RFC3339)
+	}
+	st.ConsecutiveFailures = r.failures
+}
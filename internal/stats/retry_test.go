@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRefreshRetrier_BacksOffAndResets(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	r := &refreshRetrier{
+		now:   func() time.Time { return now },
+		randN: func(n int64) int64 { return n - 1 }, // the top of the jitter range
+	}
+	fail := errors.New("bucket not found")
+
+	if wait := r.schedule(5*time.Minute, nil); wait != 5*time.Minute {
+		t.Fatalf("after success: wait %v, want the interval", wait)
+	}
+	// Failures double the backoff up to the one-hour cap; jitter stays below it
+	for i, want := range []time.Duration{5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour} {
+		wait := r.schedule(5*time.Minute, fail)
+		if wait >= want || wait < want/2 {
+			t.Errorf("failure %d: wait %v, want in [%v, %v)", i+1, wait, want/2, want)
+		}
+	}
+
+	var st StoreStatus
+	r.status(&st)
+	if st.ConsecutiveFailures != 6 {
+		t.Errorf("ConsecutiveFailures = %d, want 6", st.ConsecutiveFailures)
+	}
+	if want := now.Add(time.Hour - time.Nanosecond).Format(time.RFC3339); st.NextRefresh != want {
+		t.Errorf("NextRefresh = %s, want %s", st.NextRefresh, want)
+	}
+
+	now = now.Add(time.Hour)
+	if wait := r.schedule(5*time.Minute, nil); wait != 5*time.Minute {
+		t.Errorf("after recovery: wait %v, want the interval", wait)
+	}
+	st = StoreStatus{}
+	r.status(&st)
+	if st.ConsecutiveFailures != 0 || st.NextRefresh != "2024-03-01T13:05:00Z" {
+		t.Errorf("status after recovery = %+v", st)
+	}
+}
+
+func TestRefreshRetrier_Jitter(t *testing.T) {
+	r := &refreshRetrier{randN: func(int64) int64 { return 0 }}
+	fail := errors.New("timeout")
+	r.schedule(time.Minute, fail)
+	if wait := r.schedule(time.Minute, fail); wait != time.Minute {
+		t.Errorf("bottom of jitter range: wait %v, want half of 2m", wait)
+	}
+
+	// Replicas failing together spread out
+	waits := map[time.Duration]bool{}
+	for i := 0; i < 10; i++ {
+		waits[(&refreshRetrier{}).schedule(time.Hour, fail)] = true
+	}
+	if len(waits) < 2 {
+		t.Errorf("10 replicas got the same wait %v", waits)
+	}
+}
+
+func TestRefreshRetrier_LongIntervalIsNotCapped(t *testing.T) {
+	r := &refreshRetrier{randN: func(n int64) int64 { return n - 1 }}
+	fail := errors.New("timeout")
+	for i := 0; i < 3; i++ {
+		if wait := r.schedule(2*time.Hour, fail); wait > 2*time.Hour || wait < time.Hour {
+			t.Errorf("failure %d: wait %v, want at most the 2h interval", i+1, wait)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RevenueSettings name the event a project records purchases with, whose
+// revenue and currency props are summed, and the currency revenue is reported in
+type RevenueSettings struct {
+	Event    string `json:"revenue_event"`
+	Currency string `json:"currency"`
+}
+
+// DefaultRevenueSettings sum "purchase" events in US dollars
+var DefaultRevenueSettings = RevenueSettings{Event: "purchase", Currency: "USD"}
+
+// Validate checks settings before they are stored
+func (s RevenueSettings) Validate() error {
+	if strings.TrimSpace(s.Event) == "" {
+		return fmt.Errorf("revenue_event is required")
+	}
+	if len(s.Event) > maxFilterValueLen {
+		return fmt.Errorf("revenue_event exceeds %d characters", maxFilterValueLen)
+	}
+	if !currencyRe.MatchString(s.Currency) {
+		return fmt.Errorf("currency must be a three-letter ISO 4217 code")
+	}
+	return nil
+}
+
+// RevenueSource loads the revenue settings of the project a domain belongs
+// to; unknown domains get DefaultRevenueSettings
+type RevenueSource interface {
+	RevenueSettings(domain string) (RevenueSettings, error)
+}
+
+// SetRevenueSource enables per-project revenue settings on stats endpoints
+func (h *Handler) SetRevenueSource(src RevenueSource) {
+	h.revenue = src
+}
+
+// SetExchangeRates sets the rates revenue is converted with; without them the
+// embedded table applies
+func (h *Handler) SetExchangeRates(rates *ExchangeRates) {
+	h.rates = rates
+}
+
+// Revenue sums the revenue of a range's purchase events in one currency.
+// Purchases counts every purchase event; Excluded of them had a missing or
+// invalid revenue prop, or a currency the rates table lacks, and are left out
+// of Total and AverageOrderValue.
+type Revenue struct {
+	Currency          string         `json:"currency"`
+	Total             float64        `json:"total"`
+	Purchases         int64          `json:"purchases"`
+	Excluded          int64          `json:"excluded"`
+	AverageOrderValue float64        `json:"average_order_value"`
+	Series            []RevenuePoint `json:"series"`
+	// RatesDate is the date of the rates table used
+	RatesDate string `json:"rates_date,omitempty"`
+}
+
+// RevenuePoint is the revenue and purchases of one bucket. Stores return UTC
+// hours; HandleRevenue sums them into days of the reporting zone.
+type RevenuePoint struct {
+	Time      string  `json:"time"`
+	Revenue   float64 `json:"revenue"`
+	Purchases int64   `json:"purchases"`
+	// Excluded is left out of responses, which report it for the range only
+	Excluded int64 `json:"-"`
+}
+
+// newRevenue totals hourly points into a report in currency
+func newRevenue(currency string, hours []RevenuePoint) *Revenue {
+	r := &Revenue{Currency: currency, Series: hours}
+	for _, p := range hours {
+		r.Total += p.Revenue
+		r.Purchases += p.Purchases
+		r.Excluded += p.Excluded
+	}
+	if counted := r.Purchases - r.Excluded; counted > 0 {
+		r.AverageOrderValue = roundMoney(r.Total / float64(counted))
+	}
+	r.Total = roundMoney(r.Total)
+	return r
+}
+
+// roundMoney rounds an amount to cents, hiding float sums' noise
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// revenueDays sums hourly points into the days of [from, to) in loc, keeping
+// days without purchases at zero
+func revenueDays(hours []RevenuePoint, from, to time.Time, loc *time.Location) []RevenuePoint {
+	day := func(t time.Time) time.Time {
+		y, m, d := t.In(loc).Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+	type sums struct {
+		revenue   float64
+		purchases int64
+	}
+	byDay := make(map[int64]sums, len(hours))
+	for _, p := range hours {
+		t, err := time.Parse("2006-01-02T15:04", p.Time)
+		if err != nil {
+			continue
+		}
+		key := day(t).Unix()
+		s := byDay[key]
+		s.revenue += p.Revenue
+		s.purchases += p.Purchases
+		byDay[key] = s
+	}
+
+	days := []RevenuePoint{}
+	for t := day(from); t.Before(to); t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc) {
+		s := byDay[t.Unix()]
+		days = append(days, RevenuePoint{Time: t.Format("2006-01-02"), Revenue: roundMoney(s.revenue), Purchases: s.purchases})
+	}
+	return days
+}
+
+// revenueConversion is what a store needs to sum revenue: the purchase event
+// and what one unit of each known currency is worth in the reported one, as of
+// ratesDate
+type revenueConversion struct {
+	event, currency string
+	factors         map[string]float64
+	ratesDate       string
+}
+
+func newRevenueConversion(settings RevenueSettings, rates rateTable) revenueConversion {
+	return revenueConversion{event: settings.Event, currency: settings.Currency, factors: rates.factors(settings.Currency), ratesDate: rates.Date}
+}
+
+type revenueKey struct{}
+
+// withRevenue asks GetRevenue, and GetCampaignConversions for goals on c's
+// event, to sum revenue with c
+func withRevenue(ctx context.Context, c revenueConversion) context.Context {
+	return context.WithValue(ctx, revenueKey{}, c)
+}
+
+// revenueFromContext returns the conversion attached by withRevenue
+func revenueFromContext(ctx context.Context) (revenueConversion, bool) {
+	c, ok := ctx.Value(revenueKey{}).(revenueConversion)
+	return c, ok
+}
+
+// revenueConversionFromContext is the conversion GetRevenue applies: the one in
+// ctx, or the default settings with the embedded rates
+func revenueConversionFromContext(ctx context.Context) revenueConversion {
+	if c, ok := revenueFromContext(ctx); ok {
+		return c
+	}
+	return newRevenueConversion(DefaultRevenueSettings, frozenRates)
+}
+
+// valueExpr renders an event's revenue in c's currency, or NULL when the
+// amount isn't a finite non-negative number or its currency is unknown. An
+// empty currency is c's own. Codes and factors are validated, so they are
+// rendered as literals. isFinite names the dialect's finiteness test, "" for
+// amounts that are finite or NULL already.
+func (c revenueConversion) valueExpr(amount, currency, isFinite string) string {
+	codes := make([]string, 0, len(c.factors))
+	for code := range c.factors {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	var factor strings.Builder
+	fmt.Fprintf(&factor, "CASE (CASE WHEN %[1]s = '' THEN '%[2]s' ELSE %[1]s END)", currency, c.currency)
+	for _, code := range codes {
+		fmt.Fprintf(&factor, " WHEN '%s' THEN %s", code, strconv.FormatFloat(c.factors[code], 'g', -1, 64))
+	}
+	factor.WriteString(" END")
+	if isFinite == "" {
+		return fmt.Sprintf("CASE WHEN %[1]s >= 0 THEN %[1]s * %[2]s END", amount, factor.String())
+	}
+	return fmt.Sprintf("CASE WHEN %[2]s(%[1]s) AND %[1]s >= 0 THEN %[1]s * %[3]s END", amount, isFinite, factor.String())
+}
+
+// Revenue and currency props in each dialect; amounts may be JSON numbers or
+// numeric strings, currencies are compared upper-cased
+const (
+	duckdbRevenueAmount       = `TRY_CAST(CASE WHEN json_valid(props) THEN json_extract_string(props, '$.revenue') END AS DOUBLE)`
+	duckdbRevenueCurrency     = `upper(trim(COALESCE(CASE WHEN json_valid(props) THEN json_extract_string(props, '$.currency') END, '')))`
+	clickhouseRevenueAmount   = `toFloat64OrNull(trim(BOTH '"' FROM JSONExtractRaw(ifNull(props, ''), 'revenue')))`
+	clickhouseRevenueCurrency = `upper(trimBoth(JSONExtractString(ifNull(props, ''), 'currency')))`
+	postgresRevenueCurrency   = `upper(trim(COALESCE(props->>'currency', '')))`
+)
+
+// postgresRevenueAmount is finite or NULL, so needs no finiteness test
+var postgresRevenueAmount = postgresTryDouble(`props->>'revenue'`)
+
+func (c revenueConversion) duckdbValueExpr() string {
+	return c.valueExpr(duckdbRevenueAmount, duckdbRevenueCurrency, "isfinite")
+}
+
+func (c revenueConversion) clickhouseValueExpr() string {
+	return c.valueExpr(clickhouseRevenueAmount, clickhouseRevenueCurrency, "isFinite")
+}
+
+func (c revenueConversion) postgresValueExpr() string {
+	return c.valueExpr(postgresRevenueAmount, postgresRevenueCurrency, "")
+}
+
+// revenueContext attaches the revenue settings of domain's project converted
+// with the current rates, and returns a cache key part that changes with both
+func (h *Handler) revenueContext(ctx context.Context, domain string) (context.Context, revenueConversion, string, error) {
+	settings := DefaultRevenueSettings
+	if h.revenue != nil {
+		var err error
+		if settings, err = h.revenue.RevenueSettings(domain); err != nil {
+			return nil, revenueConversion{}, "", err
+		}
+	}
+	c := newRevenueConversion(settings, h.rates.current())
+	key := fmt.Sprintf("revenue=%s|currency=%s|rates=%s", c.event, c.currency, c.ratesDate)
+	return withRevenue(ctx, c), c, key, nil
+}
+
+// HandleRevenue reports the revenue of the project's purchase events: totals,
+// average order value and a daily series in the reporting zone, in the
+// project's currency
+func (h *Handler) HandleRevenue(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	loc, err := reportingLocation(r)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if loc != time.UTC {
+		filterKey += "|tz=" + loc.String()
+	}
+	ctx, conversion, revenueKey, err := h.revenueContext(ctx, domain)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	cacheKey := fmt.Sprintf("revenue:%s:%s:%s:%s", domain, r.URL.Query().Get("period"), revenueKey, filterKey)
+	var data Revenue
+	if h.cacheGet(r.Context(), cacheKey, &data) {
+		writeJSON(w, data)
+		return
+	}
+
+	result, err := h.store.GetRevenue(ctx, domain, from, to)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	data = *result
+	data.Series = revenueDays(data.Series, from, to, loc)
+	data.RatesDate = conversion.ratesDate
+	h.cacheSet(ctx, cacheKey, data)
+	writeJSON(w, data)
+}
@@ -0,0 +1,185 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+func TestRevenueSettings_Validate(t *testing.T) {
+	for _, tt := range []struct {
+		settings RevenueSettings
+		ok       bool
+	}{
+		{DefaultRevenueSettings, true},
+		{RevenueSettings{Event: "order", Currency: "EUR"}, true},
+		{RevenueSettings{Event: " ", Currency: "EUR"}, false},
+		{RevenueSettings{Event: "order", Currency: "eur"}, false},
+		{RevenueSettings{Event: "order", Currency: "EURO"}, false},
+	} {
+		if err := tt.settings.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: err = %v", tt.settings, err)
+		}
+	}
+}
+
+func TestRevenueDays(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hours := []RevenuePoint{
+		{Time: "2024-03-02T03:00", Revenue: 10, Purchases: 1}, // Mar 1 in New York
+		{Time: "2024-03-02T15:00", Revenue: 5.1, Purchases: 2},
+		{Time: "2024-03-02T16:00", Revenue: 0.2, Purchases: 1},
+	}
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, ny)
+	days := revenueDays(hours, from, from.AddDate(0, 0, 3), ny)
+	want := []RevenuePoint{
+		{Time: "2024-03-01", Revenue: 10, Purchases: 1},
+		{Time: "2024-03-02", Revenue: 5.3, Purchases: 3},
+		{Time: "2024-03-03"},
+	}
+	if len(days) != len(want) {
+		t.Fatalf("days = %+v", days)
+	}
+	for i := range want {
+		if days[i] != want[i] {
+			t.Errorf("day %d = %+v, want %+v", i, days[i], want[i])
+		}
+	}
+}
+
+// revenueEvents seeds purchases of v1 and v2 in several currencies and forms
+func revenueEvents() []seedEvent {
+	purchase := func(visitor, props string, hours int) seedEvent {
+		return seedEvent{VisitorID: visitor, Name: "purchase", Props: props, Ago: time.Duration(hours) * time.Hour}
+	}
+	return []seedEvent{
+		{VisitorID: "v1", Ago: 30 * time.Hour},
+		{VisitorID: "v2", Ago: 30 * time.Hour},
+		purchase("v1", `{"revenue":20,"currency":"USD"}`, 26),
+		purchase("v1", `{"revenue":"10","currency":"eur"}`, 2),
+		purchase("v2", `{"revenue":5}`, 2),
+		purchase("v2", `{"currency":"USD"}`, 2),
+		purchase("v2", `{"revenue":"free","currency":"USD"}`, 2),
+		purchase("v2", `{"revenue":-3,"currency":"USD"}`, 2),
+		purchase("v2", `{"revenue":7,"currency":"XXX"}`, 2),
+		{VisitorID: "v2", Name: "signup", Props: `{"revenue":100}`, Ago: 2 * time.Hour},
+	}
+}
+
+func TestStore_GetRevenue(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Hour).Add(30 * time.Minute)
+	s := seedStore(t, now, revenueEvents()...)
+	rates := rateTable{Base: "USD", Date: "2026-10-01", Rates: map[string]float64{"USD": 1, "EUR": 0.8}}
+	ctx := withRevenue(WithFilters(context.Background(), Filters{}), newRevenueConversion(DefaultRevenueSettings, rates))
+
+	got, err := s.GetRevenue(ctx, fixtureDomain, now.Add(-48*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20 USD, 10 EUR at 1.25 and 5 in the default currency; four are excluded
+	if got.Total != 37.5 || got.Purchases != 7 || got.Excluded != 4 || got.AverageOrderValue != 12.5 || got.Currency != "USD" {
+		t.Errorf("revenue = %+v", got)
+	}
+	if len(got.Series) != 2 || got.Series[0].Revenue != 20 || got.Series[1].Revenue != 17.5 || got.Series[1].Purchases != 6 {
+		t.Errorf("series = %+v", got.Series)
+	}
+
+	// Other purchase events, other currencies; amounts without one are in the project's
+	ctx = withRevenue(ctx, newRevenueConversion(RevenueSettings{Event: "signup", Currency: "EUR"}, rates))
+	if got, err := s.GetRevenue(ctx, fixtureDomain, now.Add(-48*time.Hour), now); err != nil || got.Total != 100 || got.Purchases != 1 {
+		t.Errorf("signup revenue in EUR = %+v, %v", got, err)
+	}
+}
+
+func TestStore_CampaignConversionsRevenue(t *testing.T) {
+	now := time.Now().UTC()
+	s := seedStore(t, now, revenueEvents()...)
+	// v2 came from a campaign
+	if _, err := s.db.Exec(`UPDATE events SET utm_campaign = 'spring' WHERE visitor_id = 'v2'`); err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithFilters(context.Background(), Filters{})
+	goal := funnel.Step{Type: "event", Value: "purchase"}
+	opts := CampaignOptions{Attribution: "first"}
+
+	rows, err := s.GetCampaignConversions(ctx, fixtureDomain, goal, now.Add(-48*time.Hour), now, opts, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if row.Revenue != nil {
+			t.Errorf("%s: revenue without a revenue context", row.Campaign)
+		}
+	}
+
+	ctx = withRevenue(ctx, newRevenueConversion(DefaultRevenueSettings, rateTable{Rates: map[string]float64{"USD": 1}}))
+	if rows, err = s.GetCampaignConversions(ctx, fixtureDomain, goal, now.Add(-48*time.Hour), now, opts, 10); err != nil {
+		t.Fatal(err)
+	}
+	revenue := map[string]float64{}
+	for _, row := range rows {
+		if row.Revenue == nil {
+			t.Fatalf("%s: no revenue", row.Campaign)
+		}
+		revenue[row.Campaign] = *row.Revenue
+	}
+	// The EUR purchase has no rate in this table
+	if revenue[DirectCampaign] != 20 || revenue["spring"] != 5 {
+		t.Errorf("revenue by campaign = %v", revenue)
+	}
+
+	// Goals on other events report none
+	rows, _ = s.GetCampaignConversions(ctx, fixtureDomain, funnel.Step{Type: "event", Value: "signup"}, now.Add(-48*time.Hour), now, opts, 10)
+	for _, row := range rows {
+		if row.Revenue != nil {
+			t.Errorf("%s: revenue on a signup goal", row.Campaign)
+		}
+	}
+}
+
+// revenueSettings serves fixed settings for every domain
+type revenueSettings RevenueSettings
+
+func (s revenueSettings) RevenueSettings(domain string) (RevenueSettings, error) {
+	return RevenueSettings(s), nil
+}
+
+func TestHandleRevenue(t *testing.T) {
+	now := time.Now().UTC()
+	h := NewHandler(seedStore(t, now, revenueEvents()...))
+	h.SetRevenueSource(revenueSettings{Event: "purchase", Currency: "EUR"})
+	get := func() Revenue {
+		w := httptest.NewRecorder()
+		h.HandleRevenue(w, httptest.NewRequest("GET", "/api/stats/revenue?domain=example.com&period=7d", nil))
+		if w.Code != 200 {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var body Revenue
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body
+	}
+
+	body := get()
+	if body.Currency != "EUR" || body.RatesDate != frozenRates.Date || len(body.Series) < 7 || body.Purchases != 7 {
+		t.Errorf("revenue = %+v", body)
+	}
+	// 10 EUR, 5 in the project's currency and 20 USD at the embedded rate
+	if want := roundMoney(15 + 20*frozenRates.factors("EUR")["USD"]); body.Total != want {
+		t.Errorf("total = %v, want %v", body.Total, want)
+	}
+
+	// Refreshed rates miss the cache
+	rates := NewExchangeRates()
+	rates.table = rateTable{Base: "EUR", Date: "2099-01-01", Rates: map[string]float64{"EUR": 1, "USD": 2}}
+	h.SetExchangeRates(rates)
+	if body := get(); body.Total != 25 || body.RatesDate != "2099-01-01" {
+		t.Errorf("revenue with refreshed rates = %+v", body)
+	}
+}
@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RangeClass groups endpoints by what a long date range costs them
+type RangeClass string
+
+const (
+	// RangeUnlimited endpoints read aggregates or bound their work otherwise
+	RangeUnlimited RangeClass = ""
+	// RangeEvents endpoints return raw events
+	RangeEvents RangeClass = "events"
+	// RangeFunnels endpoints match every visitor's events against steps
+	RangeFunnels RangeClass = "funnels"
+	// RangeBreakdowns endpoints group events by a dimension
+	RangeBreakdowns RangeClass = "breakdowns"
+)
+
+// RangeClasses are the classes whose endpoints have a range cap
+var RangeClasses = []RangeClass{RangeEvents, RangeFunnels, RangeBreakdowns}
+
+// DefaultRangeCaps are the longest date ranges endpoints of each class serve
+var DefaultRangeCaps = RangeCaps{
+	RangeEvents:     31 * 24 * time.Hour,
+	RangeFunnels:    92 * 24 * time.Hour,
+	RangeBreakdowns: 366 * 24 * time.Hour,
+}
+
+// rangeCapSlack lets calendar periods spanning a DST change, an hour longer
+// than their days, fit the cap of their length in days
+const rangeCapSlack = time.Hour
+
+// RangeCaps are the longest date ranges by class; a missing or zero cap lifts it
+type RangeCaps map[RangeClass]time.Duration
+
+// RangeTooLongError is returned for date ranges over the cap of an endpoint
+type RangeTooLongError struct {
+	Path     string
+	MaxRange time.Duration
+}
+
+func (e *RangeTooLongError) Error() string {
+	return fmt.Sprintf("%s covers at most %d days; request a shorter period, or use the export API (/api/projects/exports) for bulk data",
+		e.Path, int(e.MaxRange/(24*time.Hour)))
+}
+
+// Route is a stats endpoint with the class its date range is capped by
+type Route struct {
+	Path    string
+	Handler http.HandlerFunc
+	Range   RangeClass
+}
+
+// Routes lists the stats endpoints served without the auth handler
+func (h *Handler) Routes() []Route {
+	return []Route{
+		{"/ready", h.HandleReady, RangeUnlimited},
+		{"/api/stats/overview", h.HandleOverview, RangeUnlimited},
+		{"/api/stats/freshness", h.HandleFreshness, RangeUnlimited},
+		{"/api/stats/batch", h.HandleBatch, RangeUnlimited},
+		{"/api/stats/pageviews", h.HandlePageviews, RangeUnlimited},
+		{"/api/stats/pages", h.HandlePages, RangeBreakdowns},
+		{"/api/stats/sources", h.HandleSources, RangeBreakdowns},
+		{"/api/stats/search", h.HandleSearch, RangeBreakdowns},
+		{"/api/stats/devices", h.HandleDevices, RangeBreakdowns},
+		{"/api/stats/geo", h.HandleGeo, RangeBreakdowns},
+		{"/api/stats/geo/map", h.HandleGeoMap, RangeBreakdowns},
+		{"/api/stats/meta/countries", h.HandleCountries, RangeUnlimited},
+		{"/api/stats/utm", h.HandleUTM, RangeBreakdowns},
+		{"/api/stats/events", h.HandleEvents, RangeEvents},
+		{"/api/stats/event", h.HandleEvent, RangeEvents},
+		{"/api/stats/events/stream", h.HandleEventsStream, RangeUnlimited},
+		{"/api/stats/wallboard/stream", h.HandleWallboardStream, RangeUnlimited},
+		{"/api/stats/funnel", h.HandleFunnel, RangeFunnels},
+		{"/api/stats/funnel-advanced", h.HandleFunnelAdvanced, RangeFunnels},
+		{"/api/stats/event-breakdown", h.HandleEventBreakdown, RangeBreakdowns},
+		{"/api/stats/unique-pages", h.HandleUniquePages, RangeBreakdowns},
+		{"/api/stats/errors", h.HandleErrorPages, RangeBreakdowns},
+		{"/api/stats/campaign-conversions", h.HandleCampaignConversions, RangeBreakdowns},
+		{"/api/stats/autocapture-events", h.HandleAutocaptureEvents, RangeBreakdowns},
+		{"/api/stats/revenue", h.HandleRevenue, RangeBreakdowns},
+		{"/api/stats/funnel-init", h.HandleFunnelInit, RangeFunnels},
+		{"/api/stats/suggest", h.HandleSuggest, RangeUnlimited},
+		// Reports over long ranges run as jobs
+		{"/api/stats/report", h.HandleReport, RangeUnlimited},
+		{"/api/stats/report/download", h.HandleReportDownload, RangeUnlimited},
+	}
+}
+
+// routeRanges maps the paths of Routes to their range classes
+func (h *Handler) routeRanges() map[string]RangeClass {
+	ranges := make(map[string]RangeClass)
+	for _, route := range h.Routes() {
+		ranges[route.Path] = route.Range
+	}
+	return ranges
+}
+
+// SetRangeCaps changes the longest date ranges endpoints serve
+func (h *Handler) SetRangeCaps(caps RangeCaps) {
+	h.rangeCaps = caps
+}
+
+// MaxRange is the longest date range the endpoint at path serves, or 0 for no cap
+func (h *Handler) MaxRange(path string) time.Duration {
+	return h.rangeCaps[h.rangeClasses[path]]
+}
+
+// checkRange reports a range from from to to longer than the cap of the
+// endpoint at path
+func (h *Handler) checkRange(path string, from, to time.Time) error {
+	limit := h.MaxRange(path)
+	if limit > 0 && to.Sub(from) > limit+rangeCapSlack {
+		return &RangeTooLongError{Path: path, MaxRange: limit}
+	}
+	return nil
+}
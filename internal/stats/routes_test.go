@@ -0,0 +1,100 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler_CheckRange(t *testing.T) {
+	h := NewHandler(emptyStore{})
+	to := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	for _, route := range h.Routes() {
+		limit := DefaultRangeCaps[route.Range]
+		if limit == 0 {
+			if err := h.checkRange(route.Path, to.AddDate(-5, 0, 0), to); err != nil {
+				t.Errorf("%s: five years = %v, want no cap", route.Path, err)
+			}
+			continue
+		}
+		if err := h.checkRange(route.Path, to.Add(-limit-rangeCapSlack), to); err != nil {
+			t.Errorf("%s: range at the cap = %v", route.Path, err)
+		}
+		var rangeErr *RangeTooLongError
+		if err := h.checkRange(route.Path, to.Add(-limit-rangeCapSlack-time.Second), to); !errors.As(err, &rangeErr) || rangeErr.MaxRange != limit {
+			t.Errorf("%s: range over the cap = %v, want the %v cap", route.Path, err, limit)
+		}
+	}
+
+	wantDays := map[string]int{"/api/stats/events": 31, "/api/stats/funnel": 92, "/api/stats/pages": 366, "/api/stats/overview": 0}
+	for path, days := range wantDays {
+		if got := h.MaxRange(path); got != time.Duration(days)*24*time.Hour {
+			t.Errorf("MaxRange(%s) = %v, want %d days", path, got, days)
+		}
+	}
+
+	h.SetRangeCaps(RangeCaps{RangeEvents: 0, RangeFunnels: 7 * 24 * time.Hour})
+	if err := h.checkRange("/api/stats/events", to.AddDate(-1, 0, 0), to); err != nil {
+		t.Errorf("lifted events cap = %v", err)
+	}
+	if err := h.checkRange("/api/stats/funnel", to.AddDate(0, 0, -8), to); err == nil {
+		t.Error("funnel range over a configured 7 day cap accepted")
+	}
+}
+
+func TestHandler_RangeTooLong(t *testing.T) {
+	h := NewHandler(emptyStore{})
+	for _, tc := range []struct {
+		path, period string
+		want         int
+	}{
+		{"/api/stats/events", "90d", http.StatusBadRequest},
+		{"/api/stats/event", "90d", http.StatusBadRequest},
+		{"/api/stats/funnel", "last_12_months", http.StatusBadRequest},
+		{"/api/stats/funnel-init", "last_12_months", http.StatusBadRequest},
+		{"/api/stats/pages", "last_12_months", http.StatusOK},
+		{"/api/stats/overview", "last_12_months", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		route := routeHandler(t, h, tc.path)
+		route(w, httptest.NewRequest("GET", tc.path+"?domain=example.com&period="+tc.period+"&id=1", nil))
+		if w.Code != tc.want {
+			t.Errorf("%s %s: status = %d, want %d: %s", tc.path, tc.period, w.Code, tc.want, w.Body)
+			continue
+		}
+		if tc.want != http.StatusBadRequest {
+			continue
+		}
+		var body map[string]any
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if body["code"] != "range_too_long" || body["max_days"] == nil || body["retryable"] != false {
+			t.Errorf("%s %s: body = %v, want range_too_long with max_days", tc.path, tc.period, body)
+		}
+	}
+
+	// Sub-requests of a batch are capped like the endpoints they call
+	w := httptest.NewRecorder()
+	h.HandleBatch(w, batchRequest("?domain=example.com&period=90d", `[{"id": "e", "endpoint": "events"}, {"id": "o", "endpoint": "overview"}]`))
+	var results map[string]BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if results["e"].Status != http.StatusBadRequest || results["o"].Status != http.StatusOK {
+		t.Errorf("batch statuses = %d, %d; want 400 for events, 200 for overview", results["e"].Status, results["o"].Status)
+	}
+}
+
+// routeHandler is the handler Routes lists for path
+func routeHandler(t *testing.T, h *Handler, path string) http.HandlerFunc {
+	t.Helper()
+	for _, route := range h.Routes() {
+		if route.Path == path {
+			return route.Handler
+		}
+	}
+	t.Fatalf("no route %s", path)
+	return nil
+}
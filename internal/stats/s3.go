@@ -0,0 +1,151 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// S3CredentialsMode picks where the stores get S3 credentials from
+type S3CredentialsMode string
+
+const (
+	// S3CredentialsStatic uses the configured key and secret (the default)
+	S3CredentialsStatic S3CredentialsMode = "static"
+	// S3CredentialsEnv uses AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN from the server's environment
+	S3CredentialsEnv S3CredentialsMode = "env"
+	// S3CredentialsIAM uses the instance credentials chain (IAM roles, web
+	// identity, profiles). With ClickHouse the ClickHouse server resolves them,
+	// so it needs use_environment_credentials enabled.
+	S3CredentialsIAM S3CredentialsMode = "iam"
+)
+
+// S3 URL styles: path for MinIO and most S3-compatible stores, vhost for AWS
+const (
+	S3URLStylePath  = "path"
+	S3URLStyleVHost = "vhost"
+)
+
+// s3Settings is the S3 access shared by the DuckDB and ClickHouse stores
+type s3Settings struct {
+	endpoint, region string
+	bucket, prefix   string
+	key, secret      string
+	urlStyle         string
+	useSSL           bool
+	credentials      S3CredentialsMode
+	getenv           func(string) string // reads env credentials; os.Getenv by default
+}
+
+// normalize fills in the defaults: static credentials, path style and, when
+// only a region is set, the AWS endpoint of that region
+func (c s3Settings) normalize() s3Settings {
+	if c.credentials == "" {
+		c.credentials = S3CredentialsStatic
+	}
+	if c.urlStyle == "" {
+		c.urlStyle = S3URLStylePath
+	}
+	if c.endpoint == "" && c.region != "" {
+		c.endpoint = fmt.Sprintf("s3.%s.amazonaws.com", c.region)
+	}
+	if c.getenv == nil {
+		c.getenv = os.Getenv
+	}
+	return c
+}
+
+// validate reports every setting that can't work together, so a bad
+// deployment fails at startup instead of on the first refresh
+func (c s3Settings) validate() error {
+	var errs []error
+	switch c.credentials {
+	case S3CredentialsStatic:
+		if c.key == "" || c.secret == "" {
+			errs = append(errs, errors.New("static S3 credentials need S3_KEY and S3_SECRET"))
+		}
+	case S3CredentialsEnv, S3CredentialsIAM:
+		if c.key != "" || c.secret != "" {
+			errs = append(errs, fmt.Errorf("S3_KEY and S3_SECRET are not used with %s credentials; unset them or use static", c.credentials))
+		}
+		if c.credentials == S3CredentialsEnv && (c.getenv("AWS_ACCESS_KEY_ID") == "" || c.getenv("AWS_SECRET_ACCESS_KEY") == "") {
+			errs = append(errs, errors.New("env S3 credentials need AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown S3 credentials mode %q; use static, env or iam", c.credentials))
+	}
+	switch c.urlStyle {
+	case S3URLStylePath:
+	case S3URLStyleVHost:
+		// The bucket becomes part of the host name and must match the certificate
+		if c.useSSL && strings.Contains(c.bucket, ".") {
+			errs = append(errs, fmt.Errorf("bucket %q contains dots, which vhost style can't reach over SSL; use path style", c.bucket))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown S3 URL style %q; use path or vhost", c.urlStyle))
+	}
+	if c.endpoint == "" {
+		errs = append(errs, errors.New("S3 needs S3_ENDPOINT or S3_REGION"))
+	}
+	if c.bucket == "" {
+		errs = append(errs, errors.New("S3 needs S3_BUCKET"))
+	}
+	return errors.Join(errs...)
+}
+
+// duckdbSetup returns the statements giving DuckDB's httpfs access to the bucket
+func (c s3Settings) duckdbSetup() []string {
+	setup := []string{"INSTALL httpfs", "LOAD httpfs"}
+	opts := []string{
+		"TYPE S3",
+		"ENDPOINT " + duckdbQuote(c.endpoint),
+		"URL_STYLE " + duckdbQuote(c.urlStyle),
+		"USE_SSL " + strconv.FormatBool(c.useSSL),
+	}
+	if c.region != "" {
+		opts = append(opts, "REGION "+duckdbQuote(c.region))
+	}
+	switch c.credentials {
+	case S3CredentialsStatic:
+		opts = append(opts, "KEY_ID "+duckdbQuote(c.key), "SECRET "+duckdbQuote(c.secret))
+	case S3CredentialsEnv:
+		setup = append(setup, "INSTALL aws", "LOAD aws")
+		opts = append(opts, "PROVIDER CREDENTIAL_CHAIN", "CHAIN 'env'")
+	case S3CredentialsIAM:
+		setup = append(setup, "INSTALL aws", "LOAD aws")
+		opts = append(opts, "PROVIDER CREDENTIAL_CHAIN")
+	}
+	return append(setup, "CREATE OR REPLACE SECRET events_s3 ("+strings.Join(opts, ", ")+")")
+}
+
+// clickhouseURL is the parquet glob in the bucket as ClickHouse's s3() addresses it
+func (c s3Settings) clickhouseURL() string {
+	scheme := "https"
+	if !c.useSSL {
+		scheme = "http"
+	}
+	if c.urlStyle == S3URLStyleVHost {
+		return fmt.Sprintf("%s://%s.%s/%s**/*.parquet", scheme, c.bucket, c.endpoint, c.prefix)
+	}
+	return fmt.Sprintf("%s://%s/%s/%s**/*.parquet", scheme, c.endpoint, c.bucket, c.prefix)
+}
+
+// clickhouseSource is the s3() table function reading the bucket's parquet.
+// Without arguments for credentials ClickHouse falls back to its own chain.
+func (c s3Settings) clickhouseSource() string {
+	url := clickhouseQuote(c.clickhouseURL())
+	switch c.credentials {
+	case S3CredentialsIAM:
+		return fmt.Sprintf("s3(%s, 'Parquet')", url)
+	case S3CredentialsEnv:
+		key, secret := clickhouseQuote(c.getenv("AWS_ACCESS_KEY_ID")), clickhouseQuote(c.getenv("AWS_SECRET_ACCESS_KEY"))
+		if token := c.getenv("AWS_SESSION_TOKEN"); token != "" {
+			return fmt.Sprintf("s3(%s, %s, %s, %s, 'Parquet')", url, key, secret, clickhouseQuote(token))
+		}
+		return fmt.Sprintf("s3(%s, %s, %s, 'Parquet')", url, key, secret)
+	}
+	return fmt.Sprintf("s3(%s, %s, %s, 'Parquet')", url, clickhouseQuote(c.key), clickhouseQuote(c.secret))
+}
@@ -0,0 +1,194 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+func TestS3Settings_Validate(t *testing.T) {
+	awsEnv := func(key string) string {
+		return map[string]string{"AWS_ACCESS_KEY_ID": "AKIA", "AWS_SECRET_ACCESS_KEY": "s"}[key]
+	}
+	noEnv := func(string) string { return "" }
+	tests := []struct {
+		name    string
+		s       s3Settings
+		wantErr string
+	}{
+		{"static", s3Settings{endpoint: "minio:9000", bucket: "b", key: "k", secret: "s"}, ""},
+		{"static without keys", s3Settings{endpoint: "minio:9000", bucket: "b"}, "need S3_KEY and S3_SECRET"},
+		{"iam on AWS", s3Settings{region: "eu-west-1", bucket: "b", urlStyle: "vhost", useSSL: true, credentials: "iam"}, ""},
+		{"iam with keys", s3Settings{region: "eu-west-1", bucket: "b", key: "k", secret: "s", credentials: "iam"}, "not used with iam"},
+		{"env", s3Settings{region: "eu-west-1", bucket: "b", credentials: "env", getenv: awsEnv}, ""},
+		{"env without variables", s3Settings{region: "eu-west-1", bucket: "b", credentials: "env", getenv: noEnv}, "AWS_ACCESS_KEY_ID"},
+		{"unknown mode", s3Settings{endpoint: "minio:9000", bucket: "b", credentials: "sso"}, "unknown S3 credentials mode"},
+		{"unknown style", s3Settings{endpoint: "minio:9000", bucket: "b", key: "k", secret: "s", urlStyle: "virtual"}, "unknown S3 URL style"},
+		{"vhost dotted bucket over SSL", s3Settings{region: "eu-west-1", bucket: "a.b", key: "k", secret: "s", urlStyle: "vhost", useSSL: true}, "contains dots"},
+		{"no endpoint", s3Settings{bucket: "b", key: "k", secret: "s"}, "S3_ENDPOINT or S3_REGION"},
+	}
+	for _, tt := range tests {
+		err := tt.s.normalize().validate()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestS3Settings_DuckDBSetup(t *testing.T) {
+	static := s3Settings{endpoint: "minio:9000", bucket: "b", key: "k'ey", secret: "s"}.normalize()
+	got := strings.Join(static.duckdbSetup(), "; ")
+	for _, want := range []string{"ENDPOINT 'minio:9000'", "URL_STYLE 'path'", "USE_SSL false", "KEY_ID 'k''ey'", "SECRET 's'"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("static setup %q lacks %q", got, want)
+		}
+	}
+
+	iam := s3Settings{region: "eu-west-1", bucket: "b", urlStyle: "vhost", useSSL: true, credentials: "iam"}.normalize()
+	got = strings.Join(iam.duckdbSetup(), "; ")
+	for _, want := range []string{"LOAD aws", "PROVIDER CREDENTIAL_CHAIN", "ENDPOINT 's3.eu-west-1.amazonaws.com'", "REGION 'eu-west-1'", "URL_STYLE 'vhost'", "USE_SSL true"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("iam setup %q lacks %q", got, want)
+		}
+	}
+	if strings.Contains(got, "KEY_ID") || strings.Contains(got, "CHAIN 'env'") {
+		t.Errorf("iam setup %q sets static keys or limits the chain", got)
+	}
+}
+
+func TestS3Settings_ClickHouseSource(t *testing.T) {
+	tests := []struct {
+		s    s3Settings
+		want string
+	}{
+		{
+			s3Settings{endpoint: "minio:9000", bucket: "events", prefix: "data/", key: "k", secret: "s"},
+			"s3('http://minio:9000/events/data/**/*.parquet', 'k', 's', 'Parquet')",
+		},
+		{
+			s3Settings{region: "us-east-2", bucket: "events", urlStyle: "vhost", useSSL: true, credentials: "iam"},
+			"s3('https://events.s3.us-east-2.amazonaws.com/**/*.parquet', 'Parquet')",
+		},
+		{
+			s3Settings{region: "us-east-2", bucket: "events", useSSL: true, credentials: "env", getenv: func(key string) string {
+				return map[string]string{"AWS_ACCESS_KEY_ID": "AKIA", "AWS_SECRET_ACCESS_KEY": "s", "AWS_SESSION_TOKEN": "t"}[key]
+			}},
+			"s3('https://s3.us-east-2.amazonaws.com/events/**/*.parquet', 'AKIA', 's', 't', 'Parquet')",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.s.normalize().clickhouseSource(); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+// TestS3Integration_MinIO loads fixture parquet from MinIO through DuckDB and,
+// with CLICKHOUSE_TEST_ADDR set, ClickHouse. Start both with
+// docker compose --profile test up minio clickhouse and set
+// MINIO_TEST_ENDPOINT=localhost:9002; ClickHouse reaches MinIO at
+// MINIO_TEST_CLICKHOUSE_ENDPOINT (default minio:9000).
+func TestS3Integration_MinIO(t *testing.T) {
+	endpoint := os.Getenv("MINIO_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_TEST_ENDPOINT not set")
+	}
+	const bucket, key, secret = "events-test", "minioadmin", "minioadmin"
+	prefix := fmt.Sprintf("run-%d/", time.Now().UnixNano())
+	ctx := WithFilters(context.Background(), Filters{})
+	from, to := time.Now().Add(-24*time.Hour), time.Now().Add(time.Hour)
+
+	// Write the fixture through DuckDB's httpfs, with the settings the store uses
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	writer := s3Settings{endpoint: endpoint, bucket: bucket, prefix: prefix, key: key, secret: secret}.normalize()
+	for _, q := range writer.duckdbSetup() {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(fmt.Sprintf(`
+		COPY (
+			SELECT 'example.com' AS domain, 'v' || (i %% 3) AS visitor_id, 'pageview' AS name,
+				'https://example.com/' AS url, '/' AS pathname, '' AS referrer,
+				(now() - INTERVAL 1 HOUR)::TIMESTAMP AS timestamp, '{}' AS props,
+				'Chrome' AS browser, '120' AS browser_version, 'Linux' AS os, '' AS os_version,
+				'desktop' AS device, 'DE' AS country, '' AS city, now()::TIMESTAMP AS received_at
+			FROM range(5) t(i)
+		) TO 's3://%s/%sevents.parquet' (FORMAT PARQUET)
+	`, bucket, prefix)); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("duckdb", func(t *testing.T) {
+		s, err := NewStore(Config{S3Endpoint: endpoint, S3Key: key, S3Secret: secret, Bucket: bucket, Prefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		for deadline := time.Now().Add(time.Minute); !s.Status().MemoryTable; time.Sleep(100 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("no data loaded: %+v", s.Status())
+			}
+		}
+		o, err := s.GetOverview(ctx, "example.com", from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.Pageviews != 5 || o.UniqueVisitors != 3 {
+			t.Errorf("overview = %+v, want 5 pageviews from 3 visitors", o)
+		}
+	})
+
+	t.Run("clickhouse", func(t *testing.T) {
+		addr := os.Getenv("CLICKHOUSE_TEST_ADDR")
+		if addr == "" {
+			t.Skip("CLICKHOUSE_TEST_ADDR not set")
+		}
+		chEndpoint := os.Getenv("MINIO_TEST_CLICKHOUSE_ENDPOINT")
+		if chEndpoint == "" {
+			chEndpoint = "minio:9000"
+		}
+		admin, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer admin.Close()
+		database := fmt.Sprintf("clickresearch_test_%d", time.Now().UnixNano())
+		if err := admin.Exec(context.Background(), "CREATE DATABASE "+database); err != nil {
+			t.Fatal(err)
+		}
+		defer admin.Exec(context.Background(), "DROP DATABASE IF EXISTS "+database)
+
+		s, err := NewClickHouseStore(ClickHouseConfig{
+			Addr: addr, Database: database,
+			S3Endpoint: chEndpoint, S3Key: key, S3Secret: secret, S3Bucket: bucket, S3Prefix: prefix,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if st := s.Status(); st.LastError != "" {
+			t.Fatalf("sync failed: %s", st.LastError)
+		}
+		o, err := s.GetOverview(ctx, "example.com", from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.Pageviews != 5 || o.UniqueVisitors != 3 {
+			t.Errorf("overview = %+v, want 5 pageviews from 3 visitors", o)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// screenBuckets are the viewport width classes, narrowest first; a width falls
+// in the last bucket whose min it reaches
+var screenBuckets = []struct {
+	label string
+	min   int
+}{
+	{"<640", 0},
+	{"640–1023", 640},
+	{"1024–1439", 1024},
+	{"≥1440", 1440},
+}
+
+// screenCaseExpr buckets the numeric width w; missing and negative widths give
+// an empty value, which is labeled Unknown
+func screenCaseExpr(w string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CASE WHEN %[1]s IS NULL OR %[1]s < 0 THEN ''", w)
+	for i := len(screenBuckets) - 1; i > 0; i-- {
+		fmt.Fprintf(&sb, " WHEN %s >= %d THEN '%s'", w, screenBuckets[i].min, screenBuckets[i].label)
+	}
+	fmt.Fprintf(&sb, " ELSE '%s' END", screenBuckets[0].label)
+	return sb.String()
+}
+
+// The viewport_w prop may be a JSON number or a string holding one
+var (
+	duckdbScreenExpr = screenCaseExpr(`TRY_CAST(trim(CASE WHEN json_valid(props) THEN json_extract_string(props, '$.viewport_w') END) AS DOUBLE)`)
+
+	clickhouseScreenExpr = screenCaseExpr(`toFloat64OrNull(trim(BOTH '"' FROM JSONExtractRaw(ifNull(props, ''), 'viewport_w')))`)
+
+	postgresScreenExpr = screenCaseExpr(postgresTryDouble(`props->>'viewport_w'`))
+)
+
+// sortScreenBuckets orders labeled screen items narrowest first, Unknown last
+func sortScreenBuckets(items []TopItem) []TopItem {
+	rank := func(name string) int {
+		for i, b := range screenBuckets {
+			if b.label == name {
+				return i
+			}
+		}
+		return len(screenBuckets)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return rank(items[i].Name) < rank(items[j].Name)
+	})
+	return items
+}
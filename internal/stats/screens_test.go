@@ -0,0 +1,37 @@
+package stats
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore_GetScreenSizes(t *testing.T) {
+	s := newPropsStore(t)
+	ctx := WithFilters(context.Background(), Filters{})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	got, err := s.GetScreenSizes(ctx, "example.com", from, from.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// String-encoded widths count; widths that aren't numbers are Unknown
+	want := []TopItem{
+		{Name: "<640", Count: 1},
+		{Name: "640–1023", Count: 1},
+		{Name: "1024–1439", Count: 1},
+		{Name: "≥1440", Count: 1},
+		{Name: "Unknown", Count: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("screens = %+v, want %+v", got, want)
+	}
+}
+
+func TestScreenCaseExpr(t *testing.T) {
+	want := "CASE WHEN w IS NULL OR w < 0 THEN '' WHEN w >= 1440 THEN '≥1440' WHEN w >= 1024 THEN '1024–1439' WHEN w >= 640 THEN '640–1023' ELSE '<640' END"
+	if got := screenCaseExpr("w"); got != want {
+		t.Errorf("screenCaseExpr = %s", got)
+	}
+}
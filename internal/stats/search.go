@@ -0,0 +1,270 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// Traffic channels reported by the sources endpoint with classify=true
+const (
+	ChannelDirect   = "direct"
+	ChannelSearch   = "organic_search"
+	ChannelReferral = "referral"
+	ChannelEmail    = "email"
+	ChannelPaid     = "paid"
+	ChannelSocial   = "social"
+)
+
+// mediumChannels maps the lowercased utm_medium of tagged direct traffic to
+// the channel it implies; other mediums stay direct
+var mediumChannels = map[string]string{
+	"email": ChannelEmail, "e-mail": ChannelEmail, "e_mail": ChannelEmail, "newsletter": ChannelEmail,
+	"cpc": ChannelPaid, "ppc": ChannelPaid, "cpm": ChannelPaid, "paid": ChannelPaid, "display": ChannelPaid,
+	"banner": ChannelPaid, "paidsearch": ChannelPaid, "paid_search": ChannelPaid, "paid-search": ChannelPaid,
+	"paid_social": ChannelPaid, "paid-social": ChannelPaid, "paidsocial": ChannelPaid,
+	"social": ChannelSocial, "sm": ChannelSocial, "social_media": ChannelSocial, "social-media": ChannelSocial,
+	"social_network": ChannelSocial, "social-network": ChannelSocial,
+}
+
+// searchEngine matches referrer hosts of one engine, including subdomains and
+// regional TLDs. Patterns use [.] rather than \. so they read the same in Go,
+// DuckDB and ClickHouse string literals.
+type searchEngine struct {
+	name    string
+	pattern string
+}
+
+// searchEngines are tried in order; hosts matching none are plain referrals
+var searchEngines = []searchEngine{
+	{"Google", `(^|[.])google[.](com|co[.][a-z]{2}|com[.][a-z]{2}|[a-z]{2})$`},
+	{"Bing", `(^|[.])bing[.]com$`},
+	{"DuckDuckGo", `(^|[.])duckduckgo[.]com$`},
+	{"Baidu", `(^|[.])baidu[.](com|cn)$`},
+	{"Yandex", `(^|[.])(yandex[.](com|com[.]tr|[a-z]{2})|ya[.]ru)$`},
+}
+
+var searchEngineRes = func() []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(searchEngines))
+	for i, e := range searchEngines {
+		res[i] = regexp.MustCompile(e.pattern)
+	}
+	return res
+}()
+
+// classifySearchEngine returns the engine a referrer host belongs to, or ""
+func classifySearchEngine(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	for i, re := range searchEngineRes {
+		if re.MatchString(host) {
+			return searchEngines[i].name
+		}
+	}
+	return ""
+}
+
+// searchEngineCaseExpr renders searchEngines over the lowercased host h, using
+// match to build a regex test; non-search hosts yield ''
+func searchEngineCaseExpr(h string, match func(h, pattern string) string) string {
+	var sb strings.Builder
+	sb.WriteString("CASE")
+	for _, e := range searchEngines {
+		fmt.Fprintf(&sb, " WHEN %s THEN '%s'", match(h, e.pattern), e.name)
+	}
+	sb.WriteString(" ELSE '' END")
+	return sb.String()
+}
+
+// duckdbSearchEngineExpr classifies the referrer column in DuckDB like classifySearchEngine
+func duckdbSearchEngineExpr(column string) string {
+	host := fmt.Sprintf("rtrim(lower(regexp_extract(COALESCE(%s, ''), '%s', 1)), '.')", column, aggregate.ReferrerHostPattern)
+	return searchEngineCaseExpr(host, func(h, pattern string) string {
+		return fmt.Sprintf("regexp_matches(%s, '%s')", h, pattern)
+	})
+}
+
+// clickhouseSearchEngineExpr classifies the referrer column in ClickHouse like classifySearchEngine
+func clickhouseSearchEngineExpr(column string) string {
+	host := fmt.Sprintf("trimRight(lower(domain(ifNull(%s, ''))), '.')", column)
+	return searchEngineCaseExpr(host, func(h, pattern string) string {
+		return fmt.Sprintf("match(%s, '%s')", h, pattern)
+	})
+}
+
+// postgresSearchEngineExpr classifies the referrer column in Postgres like classifySearchEngine
+func postgresSearchEngineExpr(column string) string {
+	host := fmt.Sprintf("rtrim(lower(COALESCE((regexp_match(%s, '%s'))[1], '')), '.')", column, aggregate.ReferrerHostPattern)
+	return searchEngineCaseExpr(host, func(h, pattern string) string {
+		return fmt.Sprintf("%s ~ '%s'", h, pattern)
+	})
+}
+
+// SearchEngineItem is organic search traffic from one engine
+type SearchEngineItem struct {
+	Engine    string `json:"engine"`
+	Pageviews int64  `json:"pageviews"`
+	Visitors  int64  `json:"visitors"`
+}
+
+// SourceItem is a top source annotated with its traffic channel
+type SourceItem struct {
+	Name    string `json:"name"`
+	Count   int64  `json:"count"`
+	Channel string `json:"channel,omitempty"`
+	Engine  string `json:"engine,omitempty"`
+	// URLs are the top referring URLs of the source, with detail=url
+	URLs []TopItem `json:"urls,omitempty"`
+}
+
+// SourceBucket is the pageviews of one labelled source. Direct (tagged)
+// pageviews are split by their lowercased utm_medium so the channel they imply
+// can be told apart.
+type SourceBucket struct {
+	Name   string `json:"name"`
+	Medium string `json:"medium,omitempty"`
+	Count  int64  `json:"count"`
+}
+
+// sourceBuckets is the cached result of the sources endpoint: its buckets and
+// the number of sources they were cut from
+type sourceBuckets struct {
+	Buckets     []SourceBucket `json:"buckets"`
+	TotalGroups int64          `json:"total_groups"`
+}
+
+// sourceRow is a raw group of the sources query: pageviews from one referrer
+// source ("" when direct) with the same utm_source and utm_medium
+type sourceRow struct {
+	Source    string
+	UTMSource string
+	UTMMedium string
+	Count     int64
+}
+
+// bucketSources labels rows and keeps the buckets of the limit sources with
+// the most pageviews, ties broken by name, reporting how many sources there
+// were to the group counter of ctx. Direct pageviews that carried a
+// utm_source are Direct (tagged).
+func bucketSources(ctx context.Context, rows []sourceRow, limit int) []SourceBucket {
+	type key struct{ name, medium string }
+	counts := make(map[key]int64)
+	totals := make(map[string]int64)
+	for _, row := range rows {
+		k := key{name: aggregate.Label("referrer", row.Source)}
+		if k.name == LabelDirect && strings.TrimSpace(row.UTMSource) != "" {
+			k = key{LabelDirectTagged, strings.ToLower(strings.TrimSpace(row.UTMMedium))}
+		}
+		counts[k] += row.Count
+		totals[k.name] += row.Count
+	}
+	countGroups(ctx, int64(len(totals)))
+
+	var result []SourceBucket
+	for _, top := range aggregate.TopN(totals, limit) {
+		start := len(result)
+		for k, count := range counts {
+			if k.name == top.Name {
+				result = append(result, SourceBucket{Name: k.name, Medium: k.medium, Count: count})
+			}
+		}
+		mediums := result[start:]
+		sort.Slice(mediums, func(i, j int) bool {
+			if mediums[i].Count != mediums[j].Count {
+				return mediums[i].Count > mediums[j].Count
+			}
+			return mediums[i].Medium < mediums[j].Medium
+		})
+	}
+	return result
+}
+
+// topSources merges buckets back into one item per source, in order
+func topSources(buckets []SourceBucket) []TopItem {
+	result := make([]TopItem, 0, len(buckets))
+	for _, b := range buckets {
+		if n := len(result); n > 0 && result[n-1].Name == b.Name {
+			result[n-1].Count += b.Count
+			continue
+		}
+		result = append(result, TopItem{Name: b.Name, Count: b.Count})
+	}
+	return result
+}
+
+// sourceChannel is the channel of a labelled source, and its search engine
+func sourceChannel(b SourceBucket) (channel, engine string) {
+	switch engine := classifySearchEngine(b.Name); {
+	case b.Name == LabelDirect:
+		return ChannelDirect, ""
+	case b.Name == LabelDirectTagged:
+		if channel, ok := mediumChannels[b.Medium]; ok {
+			return channel, ""
+		}
+		return ChannelDirect, ""
+	case engine != "":
+		return ChannelSearch, engine
+	}
+	return ChannelReferral, ""
+}
+
+// classifySources annotates labelled sources with their channel. Tagged direct
+// buckets whose mediums imply the same channel are merged.
+func classifySources(buckets []SourceBucket) []SourceItem {
+	result := make([]SourceItem, 0, len(buckets))
+	index := make(map[[2]string]int, len(buckets))
+	for _, b := range buckets {
+		channel, engine := sourceChannel(b)
+		k := [2]string{b.Name, channel}
+		if i, ok := index[k]; ok {
+			result[i].Count += b.Count
+			continue
+		}
+		index[k] = len(result)
+		result = append(result, SourceItem{Name: b.Name, Count: b.Count, Channel: channel, Engine: engine})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+	return result
+}
+
+// HandleSearch returns pageviews and visitors per search engine
+func (h *Handler) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, from, to, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+	ctx, filterKey, ok := h.filterContext(w, r, domain, from, to)
+	if !ok {
+		return
+	}
+	limit := parseLimit(r, 10)
+
+	cacheKey := fmt.Sprintf("search:%s:%s:%d:%s", domain, r.URL.Query().Get("period"), limit, filterKey)
+	var data []SearchEngineItem
+	if h.cacheGet(r.Context(), cacheKey, &data) {
+		writeJSON(w, data)
+		return
+	}
+
+	data, err := h.store.GetSearchEngines(ctx, domain, from, to, limit)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		data = []SearchEngineItem{}
+	}
+	h.cacheSet(ctx, cacheKey, data)
+	writeJSON(w, data)
+}
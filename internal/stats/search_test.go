@@ -0,0 +1,222 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var searchHostCases = []struct {
+	host string
+	want string
+}{
+	{"google.com", "Google"},
+	{"www.google.com", "Google"},
+	{"www.google.co.uk", "Google"},
+	{"google.com.br", "Google"},
+	{"www.google.de", "Google"},
+	{"WWW.GOOGLE.FR.", "Google"},
+	{"bing.com", "Bing"},
+	{"cn.bing.com", "Bing"},
+	{"duckduckgo.com", "DuckDuckGo"},
+	{"html.duckduckgo.com", "DuckDuckGo"},
+	{"www.baidu.com", "Baidu"},
+	{"m.baidu.cn", "Baidu"},
+	{"yandex.ru", "Yandex"},
+	{"yandex.com.tr", "Yandex"},
+	{"ya.ru", "Yandex"},
+	{"", ""},
+	{"notgoogle.com", ""},
+	{"google.example.com", ""},
+	{"bing.co", ""},
+	{"news.ycombinator.com", ""},
+	{"kinopoisk.ya.ru.evil.com", ""},
+}
+
+func TestClassifySearchEngine(t *testing.T) {
+	for _, tt := range searchHostCases {
+		if got := classifySearchEngine(tt.host); got != tt.want {
+			t.Errorf("classifySearchEngine(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestDuckDBSearchEngineExpr_MatchesClassifier(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	query := "SELECT " + duckdbSearchEngineExpr("$1::VARCHAR")
+	for _, tt := range searchHostCases {
+		referrer := "https://" + tt.host + "/search?q=x"
+		var got string
+		if err := db.QueryRow(query, referrer).Scan(&got); err != nil {
+			t.Fatalf("%q: %v", referrer, err)
+		}
+		if got != tt.want {
+			t.Errorf("SQL engine of %q = %q, want %q", referrer, got, tt.want)
+		}
+	}
+}
+
+func TestClickhouseSearchEngineExpr_NoEscapes(t *testing.T) {
+	// ClickHouse string literals treat backslashes as escapes
+	if expr := clickhouseSearchEngineExpr("referrer"); strings.Contains(expr, `\`) {
+		t.Errorf("expression contains a backslash: %s", expr)
+	}
+}
+
+func TestClassifySources(t *testing.T) {
+	got := classifySources([]SourceBucket{
+		{Name: LabelDirect, Count: 5},
+		{Name: "www.google.de", Count: 3},
+		{Name: LabelDirectTagged, Medium: "email", Count: 2},
+		{Name: LabelDirectTagged, Medium: "newsletter", Count: 2},
+		{Name: LabelDirectTagged, Medium: "qr", Count: 1},
+		{Name: "news.ycombinator.com", Count: 1},
+	})
+	want := []SourceItem{
+		{Name: LabelDirect, Count: 5, Channel: ChannelDirect},
+		// Tagged direct traffic is counted toward the channel its medium implies
+		{Name: LabelDirectTagged, Count: 4, Channel: ChannelEmail},
+		{Name: "www.google.de", Count: 3, Channel: ChannelSearch, Engine: "Google"},
+		{Name: LabelDirectTagged, Count: 1, Channel: ChannelDirect},
+		{Name: "news.ycombinator.com", Count: 1, Channel: ChannelReferral},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("classifySources = %+v, want %+v", got, want)
+	}
+}
+
+func TestStore_GetSourceBuckets(t *testing.T) {
+	now := time.Now().UTC()
+	s := seedStore(t, now,
+		seedEvent{Referrer: "", Ago: time.Hour},
+		seedEvent{Referrer: "", UTMSource: "newsletter", UTMMedium: "email", Ago: time.Hour},
+		seedEvent{Referrer: "", UTMSource: "newsletter", UTMMedium: "Email ", Ago: time.Hour},
+		seedEvent{Referrer: "https://example.com/pricing", UTMSource: "google", UTMMedium: "cpc", Ago: time.Hour},
+		seedEvent{Referrer: "https://news.ycombinator.com/", UTMSource: "hn", UTMMedium: "social", Ago: time.Hour},
+		seedEvent{Referrer: "https://news.ycombinator.com/", Ago: time.Hour},
+		seedEvent{Referrer: "https://www.bing.com/", Ago: time.Hour},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+	from := now.Add(-24 * time.Hour)
+
+	buckets, err := s.GetSourceBuckets(ctx, fixtureDomain, from, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tagged visits without an external referrer leave the Direct bucket;
+	// those with one stay with their source
+	want := []SourceBucket{
+		{Name: LabelDirectTagged, Medium: "email", Count: 2},
+		{Name: LabelDirectTagged, Medium: "cpc", Count: 1},
+		{Name: "news.ycombinator.com", Count: 2},
+		{Name: LabelDirect, Count: 1},
+		{Name: "www.bing.com", Count: 1},
+	}
+	if !reflect.DeepEqual(buckets, want) {
+		t.Errorf("GetSourceBuckets = %+v, want %+v", buckets, want)
+	}
+
+	// The limit counts sources, not mediums
+	if buckets, err := s.GetSourceBuckets(ctx, fixtureDomain, from, now, 1); err != nil || len(buckets) != 2 {
+		t.Errorf("limit 1 = %+v, %v", buckets, err)
+	}
+	sources, err := s.GetTopSources(ctx, fixtureDomain, from, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := topSources(want); !reflect.DeepEqual(sources, want) {
+		t.Errorf("GetTopSources = %+v, want %+v", sources, want)
+	}
+
+	channels := classifySources(buckets)
+	wantChannels := []SourceItem{
+		{Name: LabelDirectTagged, Count: 2, Channel: ChannelEmail},
+		{Name: "news.ycombinator.com", Count: 2, Channel: ChannelReferral},
+		{Name: LabelDirectTagged, Count: 1, Channel: ChannelPaid},
+		{Name: LabelDirect, Count: 1, Channel: ChannelDirect},
+		{Name: "www.bing.com", Count: 1, Channel: ChannelSearch, Engine: "Bing"},
+	}
+	if !reflect.DeepEqual(channels, wantChannels) {
+		t.Errorf("channels = %+v, want %+v", channels, wantChannels)
+	}
+}
+
+func TestStoreSearchEngines(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE events AS
+		SELECT 'example.com' AS domain, v AS visitor_id, n AS name, '' AS url, '/' AS pathname,
+			ref AS referrer, '' AS country, '' AS browser, '' AS os, '' AS device, '' AS props,
+			TIMESTAMP '2024-01-01 10:00:00' AS timestamp
+		FROM (VALUES
+			('v1', 'pageview', 'https://www.google.com/'),
+			('v1', 'pageview', 'https://www.google.de/'),
+			('v2', 'pageview', 'https://google.co.uk/search'),
+			('v3', 'pageview', 'https://www.bing.com/'),
+			('v3', 'signup', 'https://www.bing.com/'),
+			('v4', 'pageview', 'https://news.ycombinator.com/'),
+			('v5', 'pageview', NULL)
+		) t(v, n, ref)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true})
+
+	ctx := WithFilters(context.Background(), Filters{})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	got, err := s.GetSearchEngines(ctx, "example.com", from, from.Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SearchEngineItem{
+		{Engine: "Google", Pageviews: 3, Visitors: 2},
+		{Engine: "Bing", Pageviews: 1, Visitors: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetSearchEngines = %+v, want %+v", got, want)
+	}
+}
+
+// sourcesStore returns fixed labelled sources
+type sourcesStore struct {
+	fakeStore
+}
+
+func (sourcesStore) GetSourceBuckets(ctx context.Context, domain string, from, to time.Time, limit int) ([]SourceBucket, error) {
+	return []SourceBucket{{Name: LabelDirect, Count: 2}, {Name: "bing.com", Count: 1}}, nil
+}
+
+func TestHandleSources_Classify(t *testing.T) {
+	h := NewHandler(sourcesStore{})
+
+	w := httptest.NewRecorder()
+	h.HandleSources(w, httptest.NewRequest("GET", "/api/stats/sources?domain=example.com&classify=true", nil))
+	var classified []SourceItem
+	json.NewDecoder(w.Body).Decode(&classified)
+	if len(classified) != 2 || classified[1].Channel != ChannelSearch || classified[1].Engine != "Bing" {
+		t.Errorf("classified = %+v", classified)
+	}
+
+	// The plain response is unchanged, also when served from the shared cache entry
+	w = httptest.NewRecorder()
+	h.HandleSources(w, httptest.NewRequest("GET", "/api/stats/sources?domain=example.com", nil))
+	if strings.Contains(w.Body.String(), "channel") {
+		t.Errorf("unclassified response has channels: %s", w.Body.String())
+	}
+}
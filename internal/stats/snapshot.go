@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"time"
+)
+
+// memoryTable is the name of the loaded events table
+const memoryTable = "events"
+
+// storeSnapshot is the state of a Store that refreshes change. A published
+// snapshot is never modified: refreshes publish a new one, and queries read
+// the current one once at their start and build all their SQL from it, so a
+// refresh midway through a request can't mix the tables or windows of two
+// loads.
+type storeSnapshot struct {
+	// ready is set once the first load has been attempted
+	ready bool
+	// useMemoryTable is set once table holds loaded events; queries read
+	// parquet directly before
+	useMemoryTable bool
+	// table is the memory table queries read
+	table string
+	// propColumns is set when table has props_<field> columns
+	propColumns bool
+	// hotSince is where table starts, zero when it holds everything
+	hotSince time.Time
+	// lastRefresh is when table was loaded
+	lastRefresh time.Time
+}
+
+// notReady is the snapshot of a store before its first load
+var notReady = &storeSnapshot{table: memoryTable}
+
+// snapshot returns the store's current state, to be read once per query
+func (s *Store) snapshot() *storeSnapshot {
+	if st := s.state.Load(); st != nil {
+		return st
+	}
+	return notReady
+}
+
+// publish swaps in a copy of the current snapshot changed by update
+func (s *Store) publish(update func(st *storeSnapshot)) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	next := *s.snapshot()
+	update(&next)
+	s.state.Store(&next)
+}
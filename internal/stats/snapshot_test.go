@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStore_PublishKeepsSnapshots(t *testing.T) {
+	s := &Store{}
+	if st := s.snapshot(); st.ready || st.useMemoryTable || st.table != memoryTable {
+		t.Fatalf("initial snapshot = %+v, want not ready", st)
+	}
+	s.publish(func(st *storeSnapshot) { st.ready = true })
+	before := s.snapshot()
+	s.publish(func(st *storeSnapshot) { st.useMemoryTable, st.hotSince = true, time.Unix(100, 0) })
+
+	if before.useMemoryTable || !before.hotSince.IsZero() {
+		t.Errorf("a published snapshot changed: %+v", before)
+	}
+	if st := s.snapshot(); !st.ready || !st.useMemoryTable || !st.hotSince.Equal(time.Unix(100, 0)) {
+		t.Errorf("snapshot = %+v, want both updates", st)
+	}
+}
+
+// TestStore_ConcurrentQueriesDuringRefresh queries a store while it becomes
+// ready and refreshes its memory table over and over; run with -race
+func TestStore_ConcurrentQueriesDuringRefresh(t *testing.T) {
+	now := time.Now().UTC()
+	var events []seedEvent
+	for day := 0; day < 20; day++ {
+		events = append(events, seedEvent{VisitorID: fmt.Sprintf("v%d", day%5), Pathname: "/docs", Ago: daysAgo(day) + time.Hour})
+	}
+	seeded := seedStore(t, now, events...)
+	path := filepath.Join(t.TempDir(), "events.parquet")
+	if _, err := seeded.db.Exec(fmt.Sprintf(`COPY raw_events TO '%s' (FORMAT PARQUET)`, path)); err != nil {
+		t.Fatal(err)
+	}
+	s := &Store{db: seedStore(t, now).db, parquetPath: path, hotRange: 10 * 24 * time.Hour, fallbackMaxRange: 90 * 24 * time.Hour}
+
+	ctx, cancel := context.WithCancel(WithFilters(context.Background(), Filters{}))
+	defer cancel()
+	from := now.Add(-daysAgo(30))
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				o, err := s.GetOverview(ctx, fixtureDomain, from, now)
+				if errors.Is(err, ErrNotReady) {
+					continue
+				}
+				if err == nil && o.Pageviews != int64(len(events)) {
+					err = fmt.Errorf("%d pageviews, want %d", o.Pageviews, len(events))
+				}
+				if err == nil {
+					_, err = s.GetTopPages(ctx, fixtureDomain, from, now, 10)
+				}
+				if err == nil {
+					_, err = s.GetFirstEventAt(ctx, fixtureDomain)
+				}
+				if err != nil && ctx.Err() == nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	s.publish(func(st *storeSnapshot) { st.ready = true })
+	for i := 0; i < 5; i++ {
+		if err := s.refreshMemoryTable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("query during refresh: %v", err)
+	}
+	if st := s.snapshot(); !st.useMemoryTable || st.hotSince.IsZero() || st.lastRefresh.IsZero() {
+		t.Errorf("snapshot after refresh = %+v", st)
+	}
+}
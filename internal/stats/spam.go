@@ -0,0 +1,139 @@
+package stats
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//go:embed spam_referrers.txt
+var defaultSpamReferrers string
+
+var spamDomainRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+
+// NormalizeSpamDomain lowercases and validates a blocklist entry
+func NormalizeSpamDomain(d string) (string, error) {
+	d = strings.ToLower(strings.TrimSpace(d))
+	d = strings.TrimPrefix(d, "www.")
+	if len(d) > 253 || !spamDomainRe.MatchString(d) {
+		return "", fmt.Errorf("invalid domain %q", d)
+	}
+	return d, nil
+}
+
+// SpamList is the referrer blocklist: the embedded defaults plus admin-managed extras.
+// Matching is suffix-based on the referrer host, so "semalt.com" also blocks "x.semalt.com".
+type SpamList struct {
+	mu       sync.RWMutex
+	defaults []string
+	extra    []string
+	pattern  string
+	version  int
+}
+
+// NewSpamList loads the embedded default list
+func NewSpamList() *SpamList {
+	l := &SpamList{}
+	for _, line := range strings.Split(defaultSpamReferrers, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if d, err := NormalizeSpamDomain(line); err == nil {
+			l.defaults = append(l.defaults, d)
+		}
+	}
+	l.rebuild()
+	return l
+}
+
+// SetExtra replaces the admin-managed domains; invalid entries are skipped
+func (l *SpamList) SetExtra(domains []string) {
+	var extra []string
+	for _, d := range domains {
+		if n, err := NormalizeSpamDomain(d); err == nil {
+			extra = append(extra, n)
+		}
+	}
+
+	l.mu.Lock()
+	l.extra = extra
+	l.rebuild()
+	l.mu.Unlock()
+}
+
+// rebuild recompiles the host pattern; callers hold mu (or own l exclusively)
+func (l *SpamList) rebuild() {
+	seen := make(map[string]bool)
+	var quoted []string
+	for _, d := range append(append([]string{}, l.defaults...), l.extra...) {
+		if !seen[d] {
+			seen[d] = true
+			quoted = append(quoted, regexp.QuoteMeta(d))
+		}
+	}
+	sort.Strings(quoted)
+	l.pattern = ""
+	if len(quoted) > 0 {
+		l.pattern = `(^|\.)(` + strings.Join(quoted, "|") + `)$`
+	}
+	l.version++
+}
+
+// Pattern returns an RE2 pattern matching blocked lowercase hosts; both backends use RE2
+func (l *SpamList) Pattern() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.pattern
+}
+
+// Version changes whenever the list does, for cache keys
+func (l *SpamList) Version() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.version
+}
+
+// Size returns the number of default and extra entries
+func (l *SpamList) Size() (defaults, extra int) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.defaults), len(l.extra)
+}
+
+type spamKey struct{}
+
+// withSpamPattern asks the store to exclude referrers whose host matches pattern
+func withSpamPattern(ctx context.Context, pattern string) context.Context {
+	return context.WithValue(ctx, spamKey{}, pattern)
+}
+
+// duckdbSpamExpr returns a boolean spam expression and its arg, or "" when exclusion is off
+func duckdbSpamExpr(ctx context.Context, argIndex int) (string, []any) {
+	pattern, _ := ctx.Value(spamKey{}).(string)
+	if pattern == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("regexp_matches(lower(regexp_extract(COALESCE(referrer, ''), '^https?://([^/:?#]+)', 1)), $%d)", argIndex), []any{pattern}
+}
+
+// clickhouseSpamExpr returns a boolean spam expression and its arg, or "" when exclusion is off
+func clickhouseSpamExpr(ctx context.Context) (string, []any) {
+	pattern, _ := ctx.Value(spamKey{}).(string)
+	if pattern == "" {
+		return "", nil
+	}
+	return "match(lower(domain(referrer)), ?)", []any{pattern}
+}
+
+// postgresSpamExpr returns a boolean spam expression and its arg, or "" when exclusion is off
+func postgresSpamExpr(ctx context.Context, argIndex int) (string, []any) {
+	pattern, _ := ctx.Value(spamKey{}).(string)
+	if pattern == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("lower(COALESCE((regexp_match(referrer, '^https?://([^/:?#]+)'))[1], '')) ~ $%d", argIndex), []any{pattern}
+}
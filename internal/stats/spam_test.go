@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"context"
+	"regexp"
+	"testing"
+)
+
+func TestSpamList_Pattern(t *testing.T) {
+	l := NewSpamList()
+	l.SetExtra([]string{"Spammy.Example", "www.junk-links.net", "not a domain"})
+
+	re := regexp.MustCompile(l.Pattern())
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"semalt.com", true},           // embedded default
+		{"x.semalt.com", true},         // suffix match
+		{"notsemalt.com", false},       // not a label boundary
+		{"semalt.com.evil.org", false}, // must be the suffix
+		{"spammy.example", true},       // extra, lowercased
+		{"junk-links.net", true},       // www. stripped on add
+		{"google.com", false},
+	}
+	for _, tt := range tests {
+		if got := re.MatchString(tt.host); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	if _, extra := l.Size(); extra != 2 {
+		t.Errorf("extra = %d, want 2 (invalid entry skipped)", extra)
+	}
+}
+
+func TestSpamList_VersionChanges(t *testing.T) {
+	l := NewSpamList()
+	v := l.Version()
+	l.SetExtra([]string{"spammy.example"})
+	if l.Version() == v {
+		t.Error("Version should change when the list changes")
+	}
+}
+
+func TestSpamExpr_Disabled(t *testing.T) {
+	if expr, args := duckdbSpamExpr(context.Background(), 4); expr != "" || args != nil {
+		t.Errorf("duckdbSpamExpr without pattern = %q %v", expr, args)
+	}
+
+	ctx := withSpamPattern(context.Background(), `(^|\.)(semalt\.com)$`)
+	if expr, args := clickhouseSpamExpr(ctx); expr == "" || len(args) != 1 {
+		t.Errorf("clickhouseSpamExpr with pattern = %q %v", expr, args)
+	}
+}
+
+func TestHandler_SpamContext(t *testing.T) {
+	h := &Handler{}
+	if _, key := h.spamContext(context.Background()); key != "" {
+		t.Errorf("no spam list: key = %q", key)
+	}
+
+	h.SetSpamList(NewSpamList(), false)
+	if _, key := h.spamContext(context.Background()); key != "" {
+		t.Errorf("exclusion disabled: key = %q", key)
+	}
+
+	h.SetSpamList(NewSpamList(), true)
+	if _, key := h.spamContext(context.Background()); key == "" {
+		t.Error("exclusion enabled: expected a cache key suffix")
+	}
+}
@@ -5,18 +5,53 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/marcboeker/go-duckdb"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
 )
 
+// lockPollInterval is how often a waiting query retries the read lock on mu
+const lockPollInterval = 5 * time.Millisecond
+
 type Store struct {
-	db             *sql.DB
-	mu             sync.Mutex
-	parquetPath    string
-	ready          bool
-	useMemoryTable bool
+	db *sql.DB
+	mu sync.RWMutex // refreshes write-lock; queries share the read lock
+	// parquetPath is the glob loads and fallback queries read; it is set
+	// before the first load and never changes
+	parquetPath string
+	// state is what refreshes change; see storeSnapshot
+	state   atomic.Pointer[storeSnapshot]
+	stateMu sync.Mutex // serializes publish
+	// fallbackMaxRange caps the date range of queries that read parquet directly
+	fallbackMaxRange time.Duration
+	// hotRange is how far back loads fill the memory table; 0 loads everything
+	hotRange time.Duration
+	// coldFirst memoizes first events older than the memory table
+	coldFirst coldFirstEvents
+	// eventNames maps names outside project allow-lists to OtherEventName on load
+	eventNames *EventNameRules
+	// tombstones are the erased visitors loads leave out
+	tombstones *Tombstones
+	// overrides corrects values of categorical columns in scanned rows
+	overrides *ValueOverrides
+	// timestamps clamps skewed timestamps on load and may exclude future ones from queries
+	timestamps TimestampRules
+
+	// status is kept separately so diagnostics never wait on a refresh holding mu
+	statusMu  sync.Mutex
+	status    StoreStatus
+	onRefresh []func()
+	retry     refreshRetrier
+
+	refreshInterval
+	hourlyCounts
+	watermarks
 }
 
 type Config struct {
@@ -26,26 +61,95 @@ type Config struct {
 	Bucket     string
 	Prefix     string
 	LocalPath  string // If set, read from local files instead of S3
+	// S3UrlStyle is "path" (MinIO, Spaces; the default) or "vhost" (AWS)
+	S3UrlStyle string
+	// S3Region is the bucket's region; without S3Endpoint it selects the AWS endpoint
+	S3Region string
+	// S3UseSSL connects to S3 over HTTPS
+	S3UseSSL bool
+	// S3CredentialsMode picks where S3 credentials come from; "" means static
+	S3CredentialsMode S3CredentialsMode
+	// FallbackMaxDays caps the range of queries while no memory table is loaded;
+	// longer ranges report their most recent days only. 0 uses defaultFallbackMaxDays.
+	FallbackMaxDays int
+	// HotDays is how many days of events the DuckDB memory table holds; ranges
+	// reaching further back read the older part from parquet. 0 uses
+	// defaultHotDays, a negative value keeps the whole history in memory.
+	HotDays int
+	// EventNames holds the project allow-lists applied when events are loaded; optional
+	EventNames *EventNameRules
+	// Tombstones holds the erased visitors left out when events are loaded; optional
+	Tombstones *Tombstones
+	// Overrides holds the admin value override rules applied to reports; optional
+	Overrides *ValueOverrides
+	// Gaps tunes the data gaps GetDataGaps reports; zero fields use DefaultGapThresholds
+	Gaps GapThresholds
+	// Timestamps sanitizes event timestamps from skewed client clocks
+	Timestamps TimestampRules
+}
+
+// s3 returns the store's S3 access with defaults applied
+func (cfg Config) s3() s3Settings {
+	return s3Settings{
+		endpoint:    cfg.S3Endpoint,
+		region:      cfg.S3Region,
+		bucket:      cfg.Bucket,
+		prefix:      cfg.Prefix,
+		key:         cfg.S3Key,
+		secret:      cfg.S3Secret,
+		urlStyle:    cfg.S3UrlStyle,
+		useSSL:      cfg.S3UseSSL,
+		credentials: cfg.S3CredentialsMode,
+	}.normalize()
+}
+
+// parquetGlob is the glob of the parquet files the store reads
+func (cfg Config) parquetGlob() string {
+	if cfg.LocalPath != "" {
+		return cfg.LocalPath + "/**/*.parquet"
+	}
+	return fmt.Sprintf("s3://%s/%s**/*.parquet", cfg.Bucket, cfg.Prefix)
 }
 
 func NewStore(cfg Config) (*Store, error) {
+	if cfg.LocalPath == "" {
+		if err := cfg.s3().validate(); err != nil {
+			return nil, fmt.Errorf("invalid S3 settings: %w", err)
+		}
+	}
+
 	db, err := sql.Open("duckdb", "?threads=2&memory_limit=1GB")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open duckdb: %w", err)
 	}
 
+	maxDays := cfg.FallbackMaxDays
+	if maxDays <= 0 {
+		maxDays = defaultFallbackMaxDays
+	}
+	hotDays := cfg.HotDays
+	if hotDays == 0 {
+		hotDays = defaultHotDays
+	}
 	s := &Store{
-		db: db,
+		db:               db,
+		fallbackMaxRange: time.Duration(maxDays) * 24 * time.Hour,
+		hotRange:         time.Duration(max(hotDays, 0)) * 24 * time.Hour,
+		eventNames:       cfg.EventNames,
+		tombstones:       cfg.Tombstones,
+		overrides:        cfg.Overrides,
+		timestamps:       cfg.Timestamps,
 	}
+	s.gapThresholds = cfg.Gaps
+	s.status.FallbackMaxDays = maxDays
 
 	// Use local path if configured, otherwise S3
+	s.parquetPath = cfg.parquetGlob()
 	if cfg.LocalPath != "" {
-		s.parquetPath = cfg.LocalPath + "/**/*.parquet"
 		log.Printf("DuckDB: using local parquet path: %s", s.parquetPath)
 		go s.initLocal()
 	} else {
-		s.parquetPath = fmt.Sprintf("s3://%s/%s**/*.parquet", cfg.Bucket, cfg.Prefix)
-		go s.initS3(cfg)
+		go s.initS3(cfg.s3())
 	}
 
 	return s, nil
@@ -55,34 +159,20 @@ func (s *Store) initLocal() {
 	log.Println("DuckDB: initializing local parquet access...")
 
 	// Initial load
-	s.refreshMemoryTable()
+	err := s.refreshMemoryTable()
 
-	s.ready = true
+	s.publish(func(st *storeSnapshot) { st.ready = true })
+	s.setStatus(func(st *StoreStatus) { st.Ready = true })
 	log.Println("DuckDB: local parquet initialized successfully")
 
-	// Periodic refresh every 2 minutes (local is fast)
-	go func() {
-		ticker := time.NewTicker(2 * time.Minute)
-		for range ticker.C {
-			s.refreshMemoryTable()
-		}
-	}()
+	// Periodic refresh every 2 minutes by default (local is fast)
+	go s.refreshLoop(2*time.Minute, err)
 }
 
-func (s *Store) initS3(cfg Config) {
-	log.Println("DuckDB: initializing S3 access...")
-
-	queries := []string{
-		"INSTALL httpfs",
-		"LOAD httpfs",
-		fmt.Sprintf("SET s3_endpoint='%s'", cfg.S3Endpoint),
-		fmt.Sprintf("SET s3_access_key_id='%s'", cfg.S3Key),
-		fmt.Sprintf("SET s3_secret_access_key='%s'", cfg.S3Secret),
-		"SET s3_url_style='path'",
-		"SET s3_use_ssl=true",
-	}
+func (s *Store) initS3(cfg s3Settings) {
+	log.Printf("DuckDB: initializing S3 access (%s credentials, %s style)...", cfg.credentials, cfg.urlStyle)
 
-	for _, q := range queries {
+	for _, q := range cfg.duckdbSetup() {
 		if _, err := s.db.Exec(q); err != nil {
 			log.Printf("DuckDB setup error: %v", err)
 			return
@@ -90,52 +180,380 @@ func (s *Store) initS3(cfg Config) {
 	}
 
 	// Initial load
-	s.refreshMemoryTable()
+	err := s.refreshMemoryTable()
 
-	s.ready = true
+	s.publish(func(st *storeSnapshot) { st.ready = true })
+	s.setStatus(func(st *StoreStatus) { st.Ready = true })
 	log.Println("DuckDB: S3 access initialized successfully")
 
-	// Periodic refresh every 5 minutes
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		for range ticker.C {
-			s.refreshMemoryTable()
+	// Periodic refresh every 5 minutes by default
+	go s.refreshLoop(5*time.Minute, err)
+}
+
+// refreshLoop refreshes the memory table every interval, backing off while
+// refreshes fail; err is the outcome of the refresh before the loop
+func (s *Store) refreshLoop(interval time.Duration, err error) {
+	for {
+		wait := s.retry.schedule(s.every(interval), err)
+		if err != nil {
+			log.Printf("DuckDB: %d refreshes failed in a row, next in %v", s.Status().ConsecutiveFailures, wait.Round(time.Second))
+		}
+		time.Sleep(wait)
+		err = s.refreshMemoryTable()
+	}
+}
+
+// refreshMemoryTable loads parquet into a staging table while queries keep
+// using the current events table, then swaps it in. Only the events of the
+// last hotRange are loaded. A failed load leaves the previous table in place.
+func (s *Store) refreshMemoryTable() error {
+	log.Println("DuckDB: refreshing data from S3...")
+
+	s.db.Exec("DROP TABLE IF EXISTS events_staging")
+	source, erased := s.ingestSource()
+	since := s.hotCutoff(time.Now())
+	createTable := fmt.Sprintf(`
+		CREATE TABLE events_staging AS
+		SELECT
+			%s,
+			%s
+		FROM %s
+		WHERE %s
+	`, duckdbIngestColumns(s.timestamps.skew()), duckdbPropColumns(), source, hotCondition(since))
+
+	err := func() error {
+		if _, err := s.db.Exec(createTable); err != nil {
+			s.db.Exec("DROP TABLE IF EXISTS events_staging")
+			return err
 		}
+		return s.swapMemoryTable(erased, since)
 	}()
+	if err != nil {
+		log.Printf("DuckDB: failed to refresh memory table: %v", err)
+		s.setStatus(func(st *StoreStatus) {
+			st.LastError = err.Error()
+		})
+		return err
+	}
+
+	log.Println("DuckDB: data refreshed")
+	if err := s.recordHourlyCounts(); err != nil {
+		log.Printf("DuckDB: failed to record hourly counts: %v", err)
+	}
+	if err := s.recordTimestampCounts(); err != nil {
+		log.Printf("DuckDB: failed to count clamped timestamps: %v", err)
+	}
+	if err := s.recordWatermarks(); err != nil {
+		log.Printf("DuckDB: failed to record freshness watermarks: %v", err)
+	}
+	s.setStatus(func(st *StoreStatus) {
+		st.LastRefresh = time.Now().UTC().Format(time.RFC3339)
+		st.LastError = ""
+		st.MemoryTable = true
+		st.MemoryTableSince = ""
+		if !since.IsZero() {
+			st.MemoryTableSince = since.Format(time.RFC3339)
+		}
+	})
+
+	s.statusMu.Lock()
+	onRefresh := s.onRefresh
+	s.statusMu.Unlock()
+	for _, fn := range onRefresh {
+		go fn()
+	}
+	return nil
+}
+
+// recordHourlyCounts records each domain's events per hour of the last
+// dataGapWindow from the memory table, for GetDataGaps
+func (s *Store) recordHourlyCounts() error {
+	until := time.Now().UTC().Truncate(time.Hour)
+	since := until.Add(-dataGapWindow)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT domain, date_trunc('hour', timestamp) AS hour, count(*)
+		FROM %s
+		WHERE timestamp >= $1 AND timestamp < $2
+		GROUP BY ALL
+	`, s.snapshot().table), since, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	hours := make(map[string]map[time.Time]int64)
+	for rows.Next() {
+		var domain string
+		var hour time.Time
+		var n int64
+		if err := rows.Scan(&domain, &hour, &n); err != nil {
+			return err
+		}
+		if hours[domain] == nil {
+			hours[domain] = make(map[time.Time]int64)
+		}
+		hours[domain][hour.UTC()] = n
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.recordHours(hours, since, until)
+	return nil
+}
+
+// ingestSource is the parquet scan events are loaded from, without tombstoned
+// visitors and with allow-lists applied, and the version of the tombstones left out
+func (s *Store) ingestSource() (string, uint64) {
+	scan, erased := s.tombstones.exclude(fmt.Sprintf("read_parquet('%s')", s.parquetPath), duckdbQuote)
+	return s.eventNames.duckdbIngestSource(scan), erased
 }
 
-func (s *Store) refreshMemoryTable() {
+// swapMemoryTable replaces events with events_staging, holding the events
+// since since, waiting for running queries. Visitors tombstoned after version
+// erased, while staging loaded, are deleted first.
+func (s *Store) swapMemoryTable(erased uint64, since time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	log.Println("DuckDB: refreshing data from S3...")
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if s.tombstones.changedSince(erased) {
+		if cond, _ := s.tombstones.condition(duckdbQuote); cond != "" {
+			if _, err := tx.Exec("DELETE FROM events_staging WHERE " + cond); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec("DROP TABLE IF EXISTS events"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("ALTER TABLE events_staging RENAME TO events"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.publish(func(st *storeSnapshot) {
+		st.useMemoryTable, st.propColumns = true, true
+		st.table, st.hotSince, st.lastRefresh = memoryTable, since, time.Now().UTC()
+	})
+	return nil
+}
 
-	// Drop and recreate table
-	s.db.Exec("DROP TABLE IF EXISTS events")
+// OnRefresh adds fn to the callbacks run in the background after each successful refresh
+func (s *Store) OnRefresh(fn func()) {
+	s.statusMu.Lock()
+	s.onRefresh = append(s.onRefresh, fn)
+	s.statusMu.Unlock()
+}
 
-	createTable := fmt.Sprintf(`
-		CREATE TABLE events AS
-		SELECT * FROM read_parquet('%s')
-	`, s.parquetPath)
+// GetDimensionValues returns the most common non-empty values of column, which
+// must come from a whitelist. Values longer than a filter accepts are skipped.
+func (s *Store) GetDimensionValues(ctx context.Context, domain, column string, from, to time.Time, limit int) ([]TopItem, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
 
-	if _, err := s.db.Exec(createTable); err != nil {
-		log.Printf("DuckDB: failed to refresh memory table: %v", err)
-		s.useMemoryTable = false
-	} else {
-		s.useMemoryTable = true
-		log.Println("DuckDB: data refreshed")
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
 	}
+	defer s.mu.RUnlock()
+
+	query := fmt.Sprintf(`
+		SELECT %[1]s as name, COUNT(*) as count
+		FROM %[2]s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+		AND COALESCE(%[1]s, '') <> ''
+		AND length(%[1]s) <= %[3]d
+		GROUP BY 1
+		ORDER BY count DESC, name
+		LIMIT $4
+	`, column, s.tableSource(st, from, to), maxFilterValueLen)
+
+	rows, err := s.queryContext(ctx, query, duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTopItems(rows)
+}
+
+// GetActiveDomains returns domains with events since since, busiest first
+func (s *Store) GetActiveDomains(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	rows, err := s.queryContext(ctx, fmt.Sprintf(`
+		SELECT domain
+		FROM %s
+		WHERE epoch_us(timestamp) >= $1
+		GROUP BY domain
+		ORDER BY COUNT(*) DESC
+		LIMIT $2
+	`, s.tableSource(st, since, time.Time{})), since.UnixMicro(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// GetFirstEventAt returns the time of domain's earliest event. Without a memory
+// table only the fallback window is searched.
+func (s *Store) GetFirstEventAt(ctx context.Context, domain string) (time.Time, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return time.Time{}, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return time.Time{}, err
+	}
+	defer s.mu.RUnlock()
+
+	if st.useMemoryTable && !st.hotSince.IsZero() {
+		first, err := s.coldFirstEventAt(ctx, st, domain)
+		if err != nil || !first.IsZero() {
+			return first, err
+		}
+	}
+
+	var first sql.NullTime
+	err := s.queryRowContext(ctx, fmt.Sprintf(`
+		SELECT MIN(timestamp)
+		FROM %s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+	`, s.tableSource(st, time.Now().Add(-s.fallbackMaxRange), time.Time{})), duckdbDomains(ctx, domain)).Scan(&first)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !first.Valid {
+		return time.Time{}, ErrDomainUnknown
+	}
+	return first.Time, nil
+}
+
+// EraseVisitor deletes the events of visitorID on domain and the aliases of ctx
+// from the memory table and returns how many there were. Add the visitor to the tombstones first: the
+// next load would bring the events back otherwise. Without a memory table
+// there is nothing to delete, as parquet scans leave tombstoned visitors out.
+func (s *Store) EraseVisitor(ctx context.Context, domain, visitorID string) (int64, error) {
+	if !s.snapshot().ready {
+		return 0, ErrNotReady
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Swaps hold the write lock too, so the table can't change from here on
+	st := s.snapshot()
+	if !st.useMemoryTable {
+		return 0, nil
+	}
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE list_contains(from_json($1, '["VARCHAR"]'), domain) AND visitor_id = $2`, st.table), duckdbDomains(ctx, domain), visitorID)
+	if err != nil {
+		return 0, err
+	}
+	// The visitor may have been a domain's first in parquet
+	s.coldFirst.reset()
+	return res.RowsAffected()
 }
 
 func (s *Store) Close() error {
 	return s.db.Close()
 }
 
-func (s *Store) tableSource() string {
-	if s.useMemoryTable {
-		return "events"
+// rlock acquires a read lock on mu, giving up when ctx ends so requests queued
+// behind a memory table refresh can time out instead of waiting for it to finish
+func (s *Store) rlock(ctx context.Context) error {
+	for !s.mu.TryRLock() {
+		select {
+		case <-ctx.Done():
+			return storeError(ctx, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
 	}
-	return fmt.Sprintf("read_parquet('%s')", s.parquetPath)
+	return nil
+}
+
+func (s *Store) setStatus(update func(st *StoreStatus)) {
+	s.statusMu.Lock()
+	update(&s.status)
+	s.statusMu.Unlock()
+}
+
+// Status reports readiness and the last memory table refresh
+func (s *Store) Status() StoreStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	st := s.status
+	st.Backend = "duckdb"
+	s.retry.status(&st)
+	return st
+}
+
+// tableSource is st's memory table or, while none is loaded, the parquet
+// files narrowed to [from, to) so the scan can skip row groups by their
+// timestamp statistics. Ranges over fallbackMaxRange keep their most recent
+// part; see partialRange. A zero to leaves the range open-ended. Ranges
+// starting before a memory table of recent events read the older part from
+// parquet; see coldSource. Future-dated events are left out when the
+// timestamp rules exclude them.
+func (s *Store) tableSource(st *storeSnapshot, from, to time.Time) string {
+	source := s.rangeSource(st, from, to)
+	if s.timestamps.ExcludeFuture {
+		return fmt.Sprintf("(SELECT * FROM %s WHERE %s)", source, duckdbFutureCondition(time.Now()))
+	}
+	return source
+}
+
+// rangeSource is tableSource with future-dated events
+func (s *Store) rangeSource(st *storeSnapshot, from, to time.Time) string {
+	if st.useMemoryTable {
+		if st.hotSince.IsZero() || !from.Before(st.hotSince) {
+			return st.table
+		}
+		if !to.IsZero() && !to.After(st.hotSince) {
+			return s.coldSource(st, from, to)
+		}
+		return fmt.Sprintf("(SELECT * FROM %s UNION ALL BY NAME SELECT * FROM %s)", st.table, s.coldSource(st, from, to))
+	}
+	from, _ = partialRange(from, to, s.fallbackMaxRange)
+	// The plain timestamp comparisons are what parquet statistics can prune on;
+	// a day of slack keeps them correct whatever zone they are compared in, and
+	// epoch_us applies the exact bound
+	cond := fmt.Sprintf("timestamp >= make_timestamp(%[1]d) AND epoch_us(timestamp) >= %[2]d",
+		from.Add(-24*time.Hour).UnixMicro(), from.UnixMicro())
+	if !to.IsZero() {
+		cond += fmt.Sprintf(" AND timestamp < make_timestamp(%d)", to.Add(24*time.Hour).UnixMicro())
+	}
+	scan, _ := s.ingestSource()
+	return fmt.Sprintf("(SELECT * FROM %s WHERE %s)", scan, cond)
 }
 
 // Overview stats
@@ -143,30 +561,59 @@ type Overview struct {
 	Pageviews      int64 `json:"pageviews"`
 	UniqueVisitors int64 `json:"unique_visitors"`
 	Events         int64 `json:"events"`
+	// ExcludedSpam counts events dropped by the referrer blocklist; reported via the debug endpoint
+	ExcludedSpam int64 `json:"-"`
+	// PrivacyMode is the project's privacy mode, which UniqueVisitors reflects; set by the handler
+	PrivacyMode PrivacyMode `json:"privacy_mode,omitempty"`
+	// Warning is dataWarningPartial when only the most recent part of the range was read
+	Warning string `json:"warning,omitempty"`
+	// HasData is false until the domain's first event arrives, whatever the range;
+	// FirstEventAt (RFC 3339) is when that was. Both are set by the handler.
+	HasData      bool   `json:"has_data"`
+	FirstEventAt string `json:"first_event_at,omitempty"`
+	// DataAsOf (RFC 3339) is the latest received_at of the domain's queryable
+	// events, whatever the range; set by the handler
+	DataAsOf string `json:"data_as_of,omitempty"`
 }
 
 func (s *Store) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
-	if !s.ready {
-		return &Overview{}, nil
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(4)
+	spam, spamArgs := duckdbSpamExpr(ctx, 4+len(filterArgs))
+	if spam == "" {
+		spam = "false"
+	}
+	consent := duckdbConsentCondition(ctx)
+	if consent == "" {
+		consent = "true"
+	}
 	query := fmt.Sprintf(`
 		SELECT
-			COUNT(*) FILTER (WHERE name = 'pageview') as pageviews,
-			COUNT(DISTINCT visitor_id) as unique_visitors,
-			COUNT(*) as events
-		FROM %s
-		WHERE domain = $1
+			COUNT(*) FILTER (WHERE name = 'pageview' AND NOT (%[3]s)) as pageviews,
+			COUNT(DISTINCT visitor_id) FILTER (WHERE NOT (%[3]s) AND %[4]s) as unique_visitors,
+			COUNT(*) FILTER (WHERE NOT (%[3]s)) as events,
+			COUNT(*) FILTER (WHERE %[3]s) as excluded_spam
+		FROM %[1]s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
 		AND epoch_us(timestamp) >= $2
 		AND epoch_us(timestamp) < $3
-	`, s.tableSource())
+		%[2]s
+	`, s.tableSource(st, from, to), filterClause, spam, consent)
 
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro()}, filterArgs...)
+	args = append(args, spamArgs...)
 	var o Overview
-	err := s.db.QueryRowContext(ctx, query, domain, from.UnixMicro(), to.UnixMicro()).Scan(
-		&o.Pageviews, &o.UniqueVisitors, &o.Events,
+	err := s.queryRowContext(ctx, query, args...).Scan(
+		&o.Pageviews, &o.UniqueVisitors, &o.Events, &o.ExcludedSpam,
 	)
 	if err != nil {
 		return nil, err
@@ -181,13 +628,17 @@ type TimeSeriesPoint struct {
 }
 
 func (s *Store) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
-	if !s.ready {
-		return nil, nil
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(4)
 	dateFormat := "date_trunc('day', timestamp::timestamp)"
 	if interval == "hour" {
 		dateFormat = "date_trunc('hour', timestamp::timestamp)"
@@ -198,15 +649,17 @@ func (s *Store) GetPageviewsTimeSeries(ctx context.Context, domain string, from,
 			%s as time_bucket,
 			COUNT(*) as count
 		FROM %s
-		WHERE domain = $1
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
 		AND name = 'pageview'
 		AND epoch_us(timestamp) >= $2
 		AND epoch_us(timestamp) < $3
+		%s
 		GROUP BY time_bucket
 		ORDER BY time_bucket
-	`, dateFormat, s.tableSource())
+	`, dateFormat, s.tableSource(st, from, to), filterClause)
 
-	rows, err := s.db.QueryContext(ctx, query, domain, from.UnixMicro(), to.UnixMicro())
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro()}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -228,52 +681,360 @@ func (s *Store) GetPageviewsTimeSeries(ctx context.Context, domain string, from,
 	return result, nil
 }
 
-// TopItem for rankings
-type TopItem struct {
-	Name  string `json:"name"`
-	Count int64  `json:"count"`
+// ActivityBucket is one step of GetActivity
+type ActivityBucket struct {
+	Start          time.Time
+	Pageviews      int64
+	UniqueVisitors int64
+}
+
+func (s *Store) GetActivity(ctx context.Context, domain string, from, to time.Time, step time.Duration) ([]ActivityBucket, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(4)
+	spam, spamArgs := duckdbSpamExpr(ctx, 4+len(filterArgs))
+	if spam == "" {
+		spam = "false"
+	}
+	consent := duckdbConsentCondition(ctx)
+	if consent == "" {
+		consent = "true"
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			(epoch_us(timestamp) - $2) // %[5]d as step,
+			COUNT(*) FILTER (WHERE name = 'pageview' AND NOT (%[3]s)) as pageviews,
+			COUNT(DISTINCT visitor_id) FILTER (WHERE NOT (%[3]s) AND %[4]s) as unique_visitors
+		FROM %[1]s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+		%[2]s
+		GROUP BY step
+		ORDER BY step
+	`, s.tableSource(st, from, to), filterClause, spam, consent, step.Microseconds())
+
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro()}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, append(args, spamArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ActivityBucket
+	for rows.Next() {
+		var i int64
+		var b ActivityBucket
+		if err := rows.Scan(&i, &b.Pageviews, &b.UniqueVisitors); err != nil {
+			return nil, err
+		}
+		b.Start = from.Add(time.Duration(i) * step)
+		result = append(result, b)
+	}
+	return result, rows.Err()
 }
 
+// TopItem for rankings
+type TopItem = aggregate.Item
+
 // PageItem is alias for TopItem for unique pages
 type PageItem = TopItem
 
 func (s *Store) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
-	return s.getTopBy(ctx, "pathname", "pageview", domain, from, to, limit)
+	return s.getTopBy(ctx, duckdbPathExpr("pathname"), "pageview", domain, from, to, limit)
 }
 
 func (s *Store) GetTopSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
-	if !s.ready {
-		return nil, nil
+	rows, err := s.sourceRows(ctx, domain, from, to)
+	if err != nil {
+		return nil, err
 	}
+	return topSources(bucketSources(ctx, rows, limit)), nil
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Store) GetSourceBuckets(ctx context.Context, domain string, from, to time.Time, limit int) ([]SourceBucket, error) {
+	rows, err := s.sourceRows(ctx, domain, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return bucketSources(ctx, rows, limit), nil
+}
+
+// sourceRows counts pageviews by referrer source and UTM values for bucketSources
+func (s *Store) sourceRows(ctx context.Context, domain string, from, to time.Time) ([]sourceRow, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(4)
+	spamClause, spamArgs := duckdbSpamExpr(ctx, 4+len(filterArgs))
+	if spamClause != "" {
+		spamClause = "AND NOT " + spamClause
+	}
 	query := fmt.Sprintf(`
 		SELECT
-			CASE
-				WHEN referrer = '' OR referrer IS NULL THEN 'Direct'
-				WHEN referrer LIKE '%%' || $1 || '%%' THEN 'Direct'
-				ELSE regexp_extract(referrer, 'https?://([^/]+)', 1)
-			END as source,
+			%s as source,
+			COALESCE(utm_source, '') as utm_source,
+			COALESCE(utm_medium, '') as utm_medium,
 			COUNT(*) as count
 		FROM %s
-		WHERE domain = $1
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
 		AND name = 'pageview'
 		AND epoch_us(timestamp) >= $2
 		AND epoch_us(timestamp) < $3
-		GROUP BY source
-		ORDER BY count DESC
+		%s
+		%s
+		GROUP BY ALL
+	`, duckdbReferrerSourceExpr, s.tableSource(st, from, to), filterClause, spamClause)
+
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro()}, filterArgs...)
+	args = append(args, spamArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []sourceRow
+	for rows.Next() {
+		var row sourceRow
+		if err := rows.Scan(&row.Source, &row.UTMSource, &row.UTMMedium, &row.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (s *Store) GetTopReferrerURLs(ctx context.Context, domain string, from, to time.Time, limit int) ([]ReferrerURLItem, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	spamClause, spamArgs := duckdbSpamExpr(ctx, 5+len(filterArgs))
+	if spamClause != "" {
+		spamClause = "AND NOT " + spamClause
+	}
+	query := fmt.Sprintf(`
+		SELECT source, url, COUNT(*) as count
+		FROM (
+			SELECT %s as source, %s as url
+			FROM %s
+			WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+			AND name = 'pageview'
+			AND epoch_us(timestamp) >= $2
+			AND epoch_us(timestamp) < $3
+			%s
+			%s
+		)
+		WHERE source <> ''
+		GROUP BY source, url
+		QUALIFY row_number() OVER (PARTITION BY source ORDER BY COUNT(*) DESC, url) <= $4
+		ORDER BY count DESC, url
+	`, duckdbReferrerSourceExpr, duckdbReferrerURLExpr, s.tableSource(st, from, to), filterClause, spamClause)
+
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit}, filterArgs...)
+	args = append(args, spamArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ReferrerURLItem
+	for rows.Next() {
+		var item ReferrerURLItem
+		if err := rows.Scan(&item.Source, &item.URL, &item.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// GetSearchEngines returns pageviews and visitors per search engine, busiest first
+func (s *Store) GetSearchEngines(ctx context.Context, domain string, from, to time.Time, limit int) ([]SearchEngineItem, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	query := fmt.Sprintf(`
+		SELECT engine, COUNT(*) as pageviews, COUNT(DISTINCT visitor_id) as visitors
+		FROM (
+			SELECT %s as engine, visitor_id
+			FROM %s
+			WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+			AND name = 'pageview'
+			AND epoch_us(timestamp) >= $2
+			AND epoch_us(timestamp) < $3
+			%s
+		)
+		WHERE engine <> ''
+		GROUP BY engine
+		ORDER BY pageviews DESC, engine
 		LIMIT $4
-	`, s.tableSource())
+	`, duckdbSearchEngineExpr("referrer"), s.tableSource(st, from, to), filterClause)
 
-	rows, err := s.db.QueryContext(ctx, query, domain, from.UnixMicro(), to.UnixMicro(), limit)
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	return scanTopItems(rows)
+	var result []SearchEngineItem
+	for rows.Next() {
+		var item SearchEngineItem
+		if err := rows.Scan(&item.Engine, &item.Pageviews, &item.Visitors); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// geoMapLimit bounds the country map; there are fewer ISO 3166-1 codes
+const geoMapLimit = 300
+
+func (s *Store) GetCountryMap(ctx context.Context, domain string, from, to time.Time) ([]GeoItem, error) {
+	return s.geoBreakdown(ctx, duckdbCountryCodeExpr, "", domain, from, to, geoMapLimit)
+}
+
+func (s *Store) GetTopRegions(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	where := fmt.Sprintf("AND %s = %s", duckdbCountryCodeExpr, duckdbQuote(country))
+	return s.geoBreakdown(ctx, duckdbRegionExpr(country), where, domain, from, to, limit)
+}
+
+func (s *Store) GetTopCities(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	where := fmt.Sprintf("AND %s = %s", duckdbCountryCodeExpr, duckdbQuote(country))
+	items, err := s.geoBreakdown(ctx, `trim(COALESCE(city, ''))`, where, domain, from, to, limit)
+	return geoNames(items), err
+}
+
+// geoBreakdown counts pageviews and visitors by the non-empty values of expr,
+// busiest first; where adds conditions on the scanned events
+func (s *Store) geoBreakdown(ctx context.Context, expr, where, domain string, from, to time.Time, limit int) ([]GeoItem, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	propClause, propArgs := duckdbPropClause(ctx, 5+len(filterArgs))
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	query := fmt.Sprintf(`
+		SELECT code, COUNT(*) as pageviews, COUNT(DISTINCT visitor_id) as visitors
+		FROM (
+			SELECT %s as code, visitor_id
+			FROM %s
+			WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+			AND name = 'pageview'
+			AND epoch_us(timestamp) >= $2
+			AND epoch_us(timestamp) < $3
+			%s
+			%s
+		)
+		WHERE code <> ''
+		GROUP BY code
+		ORDER BY pageviews DESC, code
+		LIMIT $4
+	`, expr, s.tableSource(st, from, to), where, filterClause)
+
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []GeoItem
+	for rows.Next() {
+		var item GeoItem
+		if err := rows.Scan(&item.Code, &item.Count, &item.Visitors); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// GetDomainMismatches returns the page hosts of domain's events that aren't
+// the domain itself (nor, with subdomains, one of its subdomains), busiest first
+func (s *Store) GetDomainMismatches(ctx context.Context, domain string, subdomains bool, from, to time.Time, limit int) ([]HostnameItem, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	scope := hostScope{domain: NormalizeHost(domain), subdomains: subdomains}
+	query := fmt.Sprintf(`
+		SELECT %[1]s as hostname, COUNT(*) as events, MAX(timestamp) as last_seen
+		FROM %[2]s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+		AND NOT %[3]s
+		GROUP BY hostname
+		ORDER BY events DESC, hostname
+		LIMIT $4
+	`, duckdbURLHostExpr, s.tableSource(st, from, to), scope.duckdbCondition())
+
+	rows, err := s.queryContext(ctx, query, duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []HostnameItem
+	for rows.Next() {
+		var item HostnameItem
+		var lastSeen time.Time
+		if err := rows.Scan(&item.Hostname, &item.Events, &lastSeen); err != nil {
+			return nil, err
+		}
+		item.LastSeen = lastSeen.UTC().Format(time.RFC3339)
+		result = append(result, item)
+	}
+	return result, rows.Err()
 }
 
 func (s *Store) GetTopBrowsers(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
@@ -288,6 +1049,15 @@ func (s *Store) GetTopDevices(ctx context.Context, domain string, from, to time.
 	return s.getTopBy(ctx, "device", "", domain, from, to, limit)
 }
 
+func (s *Store) GetTopLanguages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopByExpr(ctx, "language", duckdbLanguageExpr, "pageview", domain, from, to, limit)
+}
+
+func (s *Store) GetScreenSizes(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error) {
+	items, err := s.getTopByExpr(ctx, "screen", duckdbScreenExpr, "pageview", domain, from, to, len(screenBuckets)+1)
+	return sortScreenBuckets(items), err
+}
+
 // UTM stats
 func (s *Store) GetTopUTMSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
 	return s.getTopByNonEmpty(ctx, "utm_source", "pageview", domain, from, to, limit)
@@ -303,34 +1073,40 @@ func (s *Store) GetTopUTMCampaigns(ctx context.Context, domain string, from, to
 
 // getTopByNonEmpty excludes empty/null values (for UTM params)
 func (s *Store) getTopByNonEmpty(ctx context.Context, field, eventFilter, domain string, from, to time.Time, limit int) ([]TopItem, error) {
-	if !s.ready {
-		return nil, nil
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
 	eventClause := ""
 	if eventFilter != "" {
 		eventClause = fmt.Sprintf("AND name = '%s'", eventFilter)
 	}
 
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
 	query := fmt.Sprintf(`
 		SELECT
 			%s as name,
 			COUNT(*) as count
 		FROM %s
-		WHERE domain = $1
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
 		%s
 		AND %s IS NOT NULL AND %s != ''
 		AND epoch_us(timestamp) >= $2
 		AND epoch_us(timestamp) < $3
+		%s
 		GROUP BY 1
 		ORDER BY count DESC
 		LIMIT $4
-	`, field, s.tableSource(), eventClause, field, field)
+	`, field, s.tableSource(st, from, to), eventClause, field, field, filterClause)
 
-	rows, err := s.db.QueryContext(ctx, query, domain, from.UnixMicro(), to.UnixMicro(), limit)
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -340,42 +1116,79 @@ func (s *Store) getTopByNonEmpty(ctx context.Context, field, eventFilter, domain
 }
 
 func (s *Store) getTopBy(ctx context.Context, field, eventFilter, domain string, from, to time.Time, limit int) ([]TopItem, error) {
-	if !s.ready {
-		return nil, nil
+	return s.getTopByExpr(ctx, field, field, eventFilter, domain, from, to, limit)
+}
+
+// getTopByExpr counts events by the SQL expression expr, labeling the values as dimension
+func (s *Store) getTopByExpr(ctx context.Context, dimension, expr, eventFilter, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
 	eventClause := ""
 	if eventFilter != "" {
 		eventClause = fmt.Sprintf("AND name = '%s'", eventFilter)
 	}
 
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	propClause, propArgs := duckdbPropClause(ctx, 5+len(filterArgs))
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	overrides := s.overrides.forColumn(domain, dimension, from, to)
+	// Overrides match stored values, so only rows without them group by label
+	if len(overrides) == 0 {
+		expr = duckdbLabelExpr(dimension, expr)
+	}
 	query := fmt.Sprintf(`
 		SELECT
-			COALESCE(NULLIF(%s, ''), 'Unknown') as name,
-			COUNT(*) as count
+			COALESCE(%s, '') as name,
+			(%s)::BIGINT as override_mask,
+			COUNT(*) as count,
+			COUNT(*) OVER () as total_groups
 		FROM %s
-		WHERE domain = $1
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
 		%s
 		AND epoch_us(timestamp) >= $2
 		AND epoch_us(timestamp) < $3
-		GROUP BY 1
+		%s
+		GROUP BY 1, 2
 		ORDER BY count DESC
 		LIMIT $4
-	`, field, s.tableSource(), eventClause)
+	`, expr, overrides.maskExpr(duckdbTimeRange), s.tableSource(st, from, to), eventClause, filterClause)
 
-	rows, err := s.db.QueryContext(ctx, query, domain, from.UnixMicro(), to.UnixMicro(), limit)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return labelledTopItems(ctx, dimension, overrides, limit, func(n int) ([]maskedItem, int64, error) {
+		args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), n}, filterArgs...)
+		rows, err := s.queryContext(ctx, query, args...)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer rows.Close()
+
+		var items []maskedItem
+		var groups int64
+		for rows.Next() {
+			var item maskedItem
+			if err := rows.Scan(&item.name, &item.mask, &item.count, &groups); err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+		}
+		return items, groups, rows.Err()
+	})
+}
 
-	return scanTopItems(rows)
+// duckdbTimeRange renders a condition on the timestamp column for from..to, to exclusive
+func duckdbTimeRange(from, to time.Time) string {
+	return fmt.Sprintf("epoch_us(timestamp) >= %d AND epoch_us(timestamp) < %d", from.UnixMicro(), to.UnixMicro())
 }
 
-func scanTopItems(rows *sql.Rows) ([]TopItem, error) {
+func scanTopItems(rows *sqlRows) ([]TopItem, error) {
 	var result []TopItem
 	for rows.Next() {
 		var item TopItem
@@ -387,6 +1200,130 @@ func scanTopItems(rows *sql.Rows) ([]TopItem, error) {
 	return result, nil
 }
 
+// ErrorPage is a path that returned a 4xx/5xx status or fired an error event
+type ErrorPage struct {
+	Path           string `json:"path"`
+	Count          int64  `json:"count"`
+	UniqueVisitors int64  `json:"unique_visitors"`
+	TopReferrer    string `json:"top_referrer"`
+}
+
+// referrerCount is a raw referrer hit count for an error path
+type referrerCount struct {
+	path     string
+	referrer string
+	count    int64
+}
+
+// duckdbErrorCondition matches error events and pageviews with a 4xx/5xx status prop
+const duckdbErrorCondition = `(name = 'error' OR (name = 'pageview' AND TRY_CAST(CASE WHEN json_valid(props) THEN json_extract_string(props, '$.status') END AS INTEGER) BETWEEN 400 AND 599))`
+
+// duckdbNormalizedPath strips query string, fragment and trailing slash
+const duckdbNormalizedPath = `regexp_replace(regexp_replace(COALESCE(pathname, ''), '[?#].*$', ''), '(.)/$', '\1')`
+
+func (s *Store) GetErrorPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]ErrorPage, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	query := fmt.Sprintf(`
+		SELECT
+			%s as path,
+			COUNT(*) as count,
+			COUNT(DISTINCT visitor_id) as unique_visitors
+		FROM %s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND %s
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+		%s
+		GROUP BY 1
+		ORDER BY count DESC
+		LIMIT $4
+	`, duckdbPathExpr(duckdbNormalizedPath), s.tableSource(st, from, to), duckdbErrorCondition, filterClause)
+
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ErrorPage
+	for rows.Next() {
+		var p ErrorPage
+		if err := rows.Scan(&p.Path, &p.Count, &p.UniqueVisitors); err != nil {
+			continue
+		}
+		result = append(result, p)
+	}
+	rows.Close()
+
+	if len(result) == 0 {
+		return result, nil
+	}
+
+	// Referrers are cleaned in Go so internal and direct hits collapse the same way as top sources
+	filterClause, filterArgs = filtersFromContext(ctx).duckdbClause(4)
+	refQuery := fmt.Sprintf(`
+		SELECT
+			%s as path,
+			COALESCE(referrer, '') as referrer,
+			COUNT(*) as count
+		FROM %s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND %s
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+		%s
+		GROUP BY 1, 2
+	`, duckdbPathExpr(duckdbNormalizedPath), s.tableSource(st, from, to), duckdbErrorCondition, filterClause)
+
+	args = append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro()}, filterArgs...)
+	refRows, err := s.queryContext(ctx, refQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer refRows.Close()
+
+	var refs []referrerCount
+	for refRows.Next() {
+		var rc referrerCount
+		if err := refRows.Scan(&rc.path, &rc.referrer, &rc.count); err != nil {
+			continue
+		}
+		refs = append(refs, rc)
+	}
+
+	attachTopReferrers(result, refs, domain)
+	return result, nil
+}
+
+// attachTopReferrers sets the most common cleaned referrer on each error page
+func attachTopReferrers(pages []ErrorPage, refs []referrerCount, domain string) {
+	byPath := make(map[string]map[string]int64)
+	for _, rc := range refs {
+		counts, ok := byPath[rc.path]
+		if !ok {
+			counts = make(map[string]int64)
+			byPath[rc.path] = counts
+		}
+		counts[aggregate.CleanReferrer(rc.referrer, domain)] += rc.count
+	}
+
+	for i := range pages {
+		if top := aggregate.TopN(byPath[pages[i].Path], 1); len(top) > 0 {
+			pages[i].TopReferrer = top[0].Name
+		}
+	}
+}
+
 // EventItem for recent events
 type EventItem struct {
 	Name      string `json:"name"`
@@ -397,57 +1334,199 @@ type EventItem struct {
 	OS        string `json:"os"`
 	Device    string `json:"device"`
 	Timestamp string `json:"timestamp"`
-	Props     string `json:"props,omitempty"`
+	// ID identifies the event for GetEvent; see eventID
+	ID    string `json:"id,omitempty"`
+	Props string `json:"props,omitempty"`
+	// PropsTruncated is set when props exceeded maxPropsBytes and was cut
+	PropsTruncated bool `json:"props_truncated,omitempty"`
+}
+
+func (s *Store) GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields) ([]EventItem, error) {
+	return collectEvents(func(fn func(EventItem) error) error {
+		return s.StreamRecentEvents(ctx, domain, from, to, limit, fields, fn)
+	})
 }
 
-func (s *Store) GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]EventItem, error) {
-	if !s.ready {
-		return nil, nil
+// StreamRecentEvents passes the newest events to fn one row at a time; an error
+// from fn stops the query and is returned. Columns of unselected fields are not
+// read at all.
+func (s *Store) StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields, fn func(EventItem) error) error {
+	st := s.snapshot()
+	if !st.ready {
+		return ErrNotReady
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.rlock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.RUnlock()
 
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	propClause, propArgs := duckdbPropClause(ctx, 5+len(filterArgs))
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	columns := fields.columns("COALESCE", fmt.Sprintf("left(COALESCE(props, ''), %d)", maxPropsBytes+1))
 	query := fmt.Sprintf(`
 		SELECT
-			name,
-			COALESCE(url, '') as url,
-			COALESCE(pathname, '') as pathname,
-			COALESCE(country, 'Unknown') as country,
-			COALESCE(browser, 'Unknown') as browser,
-			COALESCE(os, 'Unknown') as os,
-			COALESCE(device, 'desktop') as device,
-			timestamp as ts,
-			COALESCE(props, '') as props
+			%s
 		FROM %s
-		WHERE domain = $1
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
 		AND epoch_us(timestamp) >= $2
 		AND epoch_us(timestamp) < $3
+		%s
 		ORDER BY timestamp DESC
 		LIMIT $4
-	`, s.tableSource())
+	`, columns, s.tableSource(st, from, to), filterClause)
 
-	rows, err := s.db.QueryContext(ctx, query, domain, from.UnixMicro(), to.UnixMicro(), limit)
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var result []EventItem
 	for rows.Next() {
-		var e EventItem
-		var ts time.Time
-		if err := rows.Scan(&e.Name, &e.URL, &e.Pathname, &e.Country, &e.Browser, &e.OS, &e.Device, &ts, &e.Props); err != nil {
+		e, ok := scanEvent(rows, domain, fields, s.overrides)
+		if !ok {
 			continue
 		}
-		e.Timestamp = ts.Format("2006-01-02 15:04:05")
-		result = append(result, e)
+		e.Props, e.PropsTruncated = truncateBytes(e.Props, maxPropsBytes)
+		if err := fn(e); err != nil {
+			return err
+		}
 	}
-	return result, nil
+	return rows.Err()
+}
+
+// GetEvent returns the event id names with its full props, or nil when there
+// is none
+func (s *Store) GetEvent(ctx context.Context, domain, id string) (*EventItem, error) {
+	at, err := parseEventID(id)
+	if err != nil {
+		return nil, err
+	}
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	// Events of the same microsecond are told apart by their visitor in Go
+	from, to := at, at.Add(time.Microsecond)
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM %s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+	`, AllEventFields.columns("COALESCE", "COALESCE(props, '')"), s.tableSource(st, from, to))
+	rows, err := s.queryContext(ctx, query, duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return findEvent(rows, domain, id, s.overrides)
+}
+
+func (s *Store) GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]EventBreakdownItem, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	propClause, propArgs := duckdbPropClause(ctx, 5+len(filterArgs))
+	consent := duckdbConsentCondition(ctx)
+	if consent == "" {
+		consent = "true"
+	}
+	// Counts per name and day since from, for the names with the most events
+	query := fmt.Sprintf(`
+		WITH scoped AS (
+			SELECT
+				COALESCE(name, '') as name,
+				visitor_id,
+				%[4]s as consented,
+				(epoch_us(timestamp) - $2) // %[5]d as day
+			FROM %[1]s
+			WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+			AND epoch_us(timestamp) >= $2
+			AND epoch_us(timestamp) < $3
+			%[2]s
+			%[3]s
+		),
+		ranked AS (
+			SELECT name, COUNT(*) as count, COUNT(DISTINCT visitor_id) FILTER (WHERE consented) as visitors
+			FROM scoped
+			GROUP BY name
+			ORDER BY count DESC, name
+			LIMIT $4
+		)
+		SELECT ranked.name, ranked.count, ranked.visitors, scoped.day, COUNT(*) as day_count
+		FROM scoped
+		JOIN ranked ON scoped.name = ranked.name
+		GROUP BY 1, 2, 3, 4
+		ORDER BY ranked.count DESC, ranked.name, scoped.day
+	`, s.tableSource(st, from, to), filterClause, propClause, consent, (24 * time.Hour).Microseconds())
+
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), eventBreakdownLimit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, append(args, propArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []breakdownRow
+	for rows.Next() {
+		var row breakdownRow
+		if err := rows.Scan(&row.name, &row.count, &row.visitors, &row.day, &row.dayCount); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return pivotBreakdown(result, from, to), nil
 }
 
-func (s *Store) GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error) {
-	return s.getTopBy(ctx, "name", "", domain, from, to, 10)
+func (s *Store) GetEventCardinality(ctx context.Context, domain string, from, to time.Time) (EventCardinality, error) {
+	var card EventCardinality
+	st := s.snapshot()
+	if !st.ready {
+		return card, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return card, err
+	}
+	defer s.mu.RUnlock()
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(4)
+	propClause, propArgs := duckdbPropClause(ctx, 4+len(filterArgs))
+	query := fmt.Sprintf(`
+		SELECT COUNT(DISTINCT name), COUNT(*)
+		FROM %s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+		%s
+		%s
+	`, s.tableSource(st, from, to), filterClause, propClause)
+
+	args := append(append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro()}, filterArgs...), propArgs...)
+	err := s.queryRowContext(ctx, query, args...).Scan(&card.Names, &card.Events)
+	return card, err
 }
 
 func (s *Store) GetUniquePages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
@@ -469,31 +1548,47 @@ type FunnelResult struct {
 }
 
 func (s *Store) GetFunnel(ctx context.Context, domain string, from, to time.Time, steps []string) (*FunnelResult, error) {
-	if !s.ready || len(steps) < 2 {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+	if len(steps) < 2 {
 		return &FunnelResult{Steps: make([]FunnelStep, len(steps))}, nil
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
 	// Simple funnel: count visitors who visited each page in sequence
 	result := &FunnelResult{
 		Steps: make([]FunnelStep, len(steps)),
 	}
 
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	consentClause := andCondition(duckdbConsentCondition(ctx))
 	for i, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		query := fmt.Sprintf(`
 			SELECT COUNT(DISTINCT visitor_id)
 			FROM %s
-			WHERE domain = $1
+			WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
 			AND name = 'pageview'
-			AND pathname = $2
+			AND %s = $2
 			AND epoch_us(timestamp) >= $3
 			AND epoch_us(timestamp) < $4
-		`, s.tableSource())
+			%s
+			%s
+		`, s.tableSource(st, from, to), duckdbFunnelPath("COALESCE(pathname, '')"), filterClause, consentClause)
 
+		args := append([]any{duckdbDomains(ctx, domain), funnel.NormalizePath(step), from.UnixMicro(), to.UnixMicro()}, filterArgs...)
 		var count int64
-		s.db.QueryRowContext(ctx, query, domain, step, from.UnixMicro(), to.UnixMicro()).Scan(&count)
+		if err := s.queryRowContext(ctx, query, args...).Scan(&count); err != nil {
+			return nil, fmt.Errorf("funnel step %d: %w", i+1, err)
+		}
 
 		result.Steps[i] = FunnelStep{
 			Name:  step,
@@ -519,23 +1614,270 @@ func (s *Store) GetFunnel(ctx context.Context, domain string, from, to time.Time
 	return result, nil
 }
 
-// FunnelStepDef for advanced funnel
-type FunnelStepDef struct {
-	Type  string `json:"type"`
-	Value string `json:"value"`
-	Text  string `json:"text,omitempty"`
-	Tag   string `json:"tag,omitempty"`
+// GetFunnelAdvanced loads matching events per visitor and evaluates ordered,
+// windowed steps in Go so pageview and event steps can be mixed
+func (s *Store) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, windowMinutes int) (*FunnelResult, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+	if included := len(funnel.Included(steps)); included < 2 {
+		return newFunnelResult(steps, make([]int64, included)), nil
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	scanTo, entryEnd := funnelScan(ctx, to, windowMinutes)
+	names := funnelEventNames(steps)
+	placeholders := make([]string, len(names))
+	args := []any{duckdbDomains(ctx, domain), from.UnixMicro(), scanTo.UnixMicro()}
+	for i, name := range names {
+		placeholders[i] = fmt.Sprintf("$%d", 4+i)
+		args = append(args, name)
+	}
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(4 + len(names))
+	query := fmt.Sprintf(`
+		SELECT
+			visitor_id,
+			name,
+			%s as normalized_pathname,
+			COALESCE(props, '') as props,
+			timestamp
+		FROM %s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+		AND name IN (%s)
+		%s
+		%s
+		ORDER BY visitor_id, timestamp
+		LIMIT %d
+	`, duckdbFunnelPath("COALESCE(pathname, '')"), s.tableSource(st, from, scanTo), strings.Join(placeholders, ", "), filterClause, andCondition(duckdbConsentCondition(ctx)), maxFunnelEvents)
+
+	rows, err := s.queryContext(ctx, query, append(args, filterArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.VisitorID, &e.Name, &e.Pathname, &e.Props, &e.Timestamp); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	counts := evaluateFunnel(events, steps, time.Duration(windowMinutes)*time.Minute, entryEnd)
+	return newFunnelResult(steps, counts), nil
+}
+
+// GetStepMatchCounts counts the events matching each step from the events of
+// each name and normalized pathname
+func (s *Store) GetStepMatchCounts(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step) ([]int64, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+	if len(steps) == 0 {
+		return []int64{}, nil
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	names := funnelEventNames(steps)
+	placeholders := make([]string, len(names))
+	args := []any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro()}
+	for i, name := range names {
+		placeholders[i] = fmt.Sprintf("$%d", 4+i)
+		args = append(args, name)
+	}
+
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(4 + len(names))
+	query := fmt.Sprintf(`
+		SELECT
+			name,
+			%s as normalized_pathname,
+			COUNT(*) as count
+		FROM %s
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+		AND epoch_us(timestamp) >= $2
+		AND epoch_us(timestamp) < $3
+		AND name IN (%s)
+		%s
+		%s
+		GROUP BY 1, 2
+	`, duckdbFunnelPath("COALESCE(pathname, '')"), s.tableSource(st, from, to), strings.Join(placeholders, ", "), filterClause, andCondition(duckdbConsentCondition(ctx)))
+
+	rows, err := s.queryContext(ctx, query, append(args, filterArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []pathCount
+	for rows.Next() {
+		var c pathCount
+		if err := rows.Scan(&c.Name, &c.Pathname, &c.Count); err != nil {
+			continue
+		}
+		counts = append(counts, c)
+	}
+	return sumStepMatches(counts, steps), rows.Err()
+}
+
+// GetCampaignConversions reports sessions and goal conversions per campaign, one session per visitor
+func (s *Store) GetCampaignConversions(ctx context.Context, domain string, goal funnel.Step, from, to time.Time, opts CampaignOptions, limit int) ([]CampaignConversion, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	touch := "arg_min"
+	if opts.Attribution == "last" {
+		touch = "arg_max"
+	}
+	dims := "'', ''"
+	if opts.BySourceMedium {
+		dims = "t.source, t.medium"
+	}
+
+	conversion, withRevenue := goalRevenue(ctx, goal)
+	revenueSum := "0::DOUBLE"
+	if withRevenue {
+		revenueSum = "SUM(" + conversion.duckdbValueExpr() + ")"
+	}
+
+	goalClause, goalArgs := duckdbGoalClause(goal, 5)
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5 + len(goalArgs))
+	query := fmt.Sprintf(`
+		WITH touches AS (
+			SELECT
+				visitor_id,
+				%[1]s(COALESCE(NULLIF(utm_campaign, ''), '%[2]s'), timestamp) as campaign,
+				%[1]s(COALESCE(utm_source, ''), timestamp) as source,
+				%[1]s(COALESCE(utm_medium, ''), timestamp) as medium
+			FROM %[3]s
+			WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+			AND name = 'pageview'
+			AND epoch_us(timestamp) >= $2
+			AND epoch_us(timestamp) < $3
+			%[4]s
+			GROUP BY visitor_id
+		), conversions AS (
+			SELECT visitor_id, COUNT(*) as completions, %[7]s as revenue
+			FROM %[3]s
+			WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+			AND %[5]s
+			AND epoch_us(timestamp) >= $2
+			AND epoch_us(timestamp) < $3
+			GROUP BY visitor_id
+		)
+		SELECT
+			t.campaign,
+			%[6]s,
+			COUNT(*) as sessions,
+			COUNT(c.visitor_id) as conversions,
+			COALESCE(SUM(c.completions), 0) as completions,
+			COALESCE(SUM(c.revenue), 0) as revenue
+		FROM touches t
+		LEFT JOIN conversions c ON t.visitor_id = c.visitor_id
+		GROUP BY 1, 2, 3
+		ORDER BY sessions DESC
+		LIMIT $4
+	`, touch, DirectCampaign, s.tableSource(st, from, to), filterClause, goalClause, dims, revenueSum)
+
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit}, goalArgs...)
+	args = append(args, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []CampaignConversion
+	for rows.Next() {
+		var c CampaignConversion
+		var revenue float64
+		if err := rows.Scan(&c.Campaign, &c.Source, &c.Medium, &c.Sessions, &c.Conversions, &c.Completions, &revenue); err != nil {
+			continue
+		}
+		if withRevenue {
+			c.Revenue = &revenue
+		}
+		result = append(result, c)
+	}
+	setConversionRates(result)
+	return result, nil
 }
 
-func (s *Store) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []FunnelStepDef, windowMinutes int) (*FunnelResult, error) {
-	// Simplified: just use basic funnel for pageviews
-	var simpleSteps []string
-	for _, step := range steps {
-		if step.Type == "pageview" {
-			simpleSteps = append(simpleSteps, step.Value)
+// GetRevenue sums the revenue of the purchase events of [from, to) per UTC
+// hour, with the settings and rates attached by withRevenue
+func (s *Store) GetRevenue(ctx context.Context, domain string, from, to time.Time) (*Revenue, error) {
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
+	}
+
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	conversion := revenueConversionFromContext(ctx)
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
+	query := fmt.Sprintf(`
+		SELECT
+			hour,
+			COALESCE(SUM(value), 0) as revenue,
+			COUNT(*) as purchases,
+			COUNT(*) - COUNT(value) as excluded
+		FROM (
+			SELECT
+				date_trunc('hour', timestamp::timestamp) as hour,
+				%s as value
+			FROM %s
+			WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
+			AND name = $4
+			AND epoch_us(timestamp) >= $2
+			AND epoch_us(timestamp) < $3
+			%s
+		)
+		GROUP BY hour
+		ORDER BY hour
+	`, conversion.duckdbValueExpr(), s.tableSource(st, from, to), filterClause)
+
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), conversion.event}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hours []RevenuePoint
+	for rows.Next() {
+		var t time.Time
+		var p RevenuePoint
+		if err := rows.Scan(&t, &p.Revenue, &p.Purchases, &p.Excluded); err != nil {
+			continue
 		}
+		p.Time = t.Format("2006-01-02T15:00")
+		hours = append(hours, p)
 	}
-	return s.GetFunnel(ctx, domain, from, to, simpleSteps)
+	return newRevenue(conversion.currency, hours), nil
 }
 
 // AutocaptureEvent type
@@ -548,31 +1890,37 @@ type AutocaptureEvent struct {
 }
 
 func (s *Store) GetAutocaptureEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]AutocaptureEvent, error) {
-	if !s.ready {
-		return nil, nil
+	st := s.snapshot()
+	if !st.ready {
+		return nil, ErrNotReady
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
+	filterClause, filterArgs := filtersFromContext(ctx).duckdbClause(5)
 	query := fmt.Sprintf(`
 		SELECT
 			name as event_type,
-			COALESCE(json_extract_string(props, '$.text'), '') as text,
-			COALESCE(json_extract_string(props, '$.tag'), '') as tag,
-			COALESCE(pathname, '') as pathname,
+			COALESCE(%s, '') as text,
+			COALESCE(%s, '') as tag,
+			%s as pathname,
 			COUNT(*) as count
 		FROM %s
-		WHERE domain = $1
+		WHERE list_contains(from_json($1, '["VARCHAR"]'), domain)
 		AND name IN ('click', 'submit', 'change')
 		AND epoch_us(timestamp) >= $2
 		AND epoch_us(timestamp) < $3
-		GROUP BY name, json_extract_string(props, '$.text'), json_extract_string(props, '$.tag'), pathname
+		%s
+		GROUP BY 1, 2, 3, 4
 		ORDER BY count DESC
 		LIMIT $4
-	`, s.tableSource())
+	`, s.propExpr(st, "text"), s.propExpr(st, "tag"), duckdbPathExpr("COALESCE(pathname, '')"), s.tableSource(st, from, to), filterClause)
 
-	rows, err := s.db.QueryContext(ctx, query, domain, from.UnixMicro(), to.UnixMicro(), limit)
+	args := append([]any{duckdbDomains(ctx, domain), from.UnixMicro(), to.UnixMicro(), limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -4,21 +4,44 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
 )
 
 type ClickHouseStore struct {
 	conn       driver.Conn
-	s3Path     string
-	s3Key      string
-	s3Secret   string
+	s3         s3Settings
 	stopCh     chan struct{}
 	lastSync   time.Time
+	lastErr    string
 	syncMu     sync.Mutex
+	statusMu   sync.Mutex
+	onRefresh  []func()
+	retry      refreshRetrier
+	// propColumns is set when the events table has materialized props_<field> columns
+	propColumns bool
+	// eventNames maps names outside project allow-lists to OtherEventName on sync
+	eventNames *EventNameRules
+	// tombstones are the erased visitors syncs leave out
+	tombstones *Tombstones
+	// overrides corrects values of categorical columns in scanned rows
+	overrides *ValueOverrides
+	// timestamps clamps skewed timestamps on sync and may exclude future ones from queries
+	timestamps TimestampRules
+	// clampedEvents and futureEvents are counted after each sync; guarded by statusMu
+	clampedEvents, futureEvents int64
+	// resync rebuilds the events table on request, see ResyncJob
+	resync ResyncJob
+
+	refreshInterval
+	hourlyCounts
+	watermarks
 }
 
 type ClickHouseConfig struct {
@@ -29,10 +52,41 @@ type ClickHouseConfig struct {
 	S3Secret  string
 	S3Bucket  string
 	S3Prefix  string
+	// S3UrlStyle, S3Region, S3UseSSL and S3CredentialsMode work as in Config
+	S3UrlStyle        string
+	S3Region          string
+	S3UseSSL          bool
+	S3CredentialsMode S3CredentialsMode
+	// EventNames holds the project allow-lists applied when events are synced; optional
+	EventNames *EventNameRules
+	// Tombstones holds the erased visitors left out when events are synced; optional
+	Tombstones *Tombstones
+	// Overrides holds the admin value override rules applied to reports; optional
+	Overrides *ValueOverrides
+	// Gaps tunes the data gaps GetDataGaps reports; zero fields use DefaultGapThresholds
+	Gaps GapThresholds
+	// Timestamps sanitizes event timestamps from skewed client clocks
+	Timestamps TimestampRules
 }
 
-func NewClickHouseStore(cfg ClickHouseConfig) (*ClickHouseStore, error) {
-	conn, err := clickhouse.Open(&clickhouse.Options{
+// s3 returns the store's S3 access with defaults applied
+func (cfg ClickHouseConfig) s3() s3Settings {
+	return s3Settings{
+		endpoint:    cfg.S3Endpoint,
+		region:      cfg.S3Region,
+		bucket:      cfg.S3Bucket,
+		prefix:      cfg.S3Prefix,
+		key:         cfg.S3Key,
+		secret:      cfg.S3Secret,
+		urlStyle:    cfg.S3UrlStyle,
+		useSSL:      cfg.S3UseSSL,
+		credentials: cfg.S3CredentialsMode,
+	}.normalize()
+}
+
+// options are the connection options of the store
+func (cfg ClickHouseConfig) options() *clickhouse.Options {
+	return &clickhouse.Options{
 		Addr: []string{cfg.Addr},
 		Auth: clickhouse.Auth{
 			Database: cfg.Database,
@@ -47,7 +101,16 @@ func NewClickHouseStore(cfg ClickHouseConfig) (*ClickHouseStore, error) {
 		MaxOpenConns:    10,
 		MaxIdleConns:    5,
 		ConnMaxLifetime: time.Hour,
-	})
+	}
+}
+
+func NewClickHouseStore(cfg ClickHouseConfig) (*ClickHouseStore, error) {
+	s3 := cfg.s3()
+	if err := s3.validate(); err != nil {
+		return nil, fmt.Errorf("invalid S3 settings: %w", err)
+	}
+
+	conn, err := clickhouse.Open(cfg.options())
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to clickhouse: %w", err)
 	}
@@ -56,18 +119,20 @@ func NewClickHouseStore(cfg ClickHouseConfig) (*ClickHouseStore, error) {
 		return nil, fmt.Errorf("failed to ping clickhouse: %w", err)
 	}
 
-	s3Path := fmt.Sprintf("https://%s/%s/%s**/*.parquet",
-		cfg.S3Endpoint, cfg.S3Bucket, cfg.S3Prefix)
-
-	log.Printf("ClickHouse: connected, syncing from %s", s3Path)
+	log.Printf("ClickHouse: connected, syncing from %s (%s credentials)", s3.clickhouseURL(), s3.credentials)
 
 	store := &ClickHouseStore{
-		conn:     conn,
-		s3Path:   s3Path,
-		s3Key:    cfg.S3Key,
-		s3Secret: cfg.S3Secret,
-		stopCh:   make(chan struct{}),
+		conn:   conn,
+		s3:     s3,
+		stopCh: make(chan struct{}),
+
+		eventNames: cfg.EventNames,
+		tombstones: cfg.Tombstones,
+		overrides:  cfg.Overrides,
+		timestamps: cfg.Timestamps,
 	}
+	store.gapThresholds = cfg.Gaps
+	store.resync.s = store
 
 	// Create local table if not exists
 	if err := store.ensureTable(); err != nil {
@@ -75,16 +140,45 @@ func NewClickHouseStore(cfg ClickHouseConfig) (*ClickHouseStore, error) {
 	}
 
 	// Initial sync from S3
-	if err := store.syncFromS3(); err != nil {
+	err = store.sync()
+	if err != nil {
 		log.Printf("Warning: initial S3 sync failed: %v", err)
 	}
 
 	// Start background refresh every 5 minutes
-	go store.refreshLoop()
+	go store.refreshLoop(err)
+
+	// A resync a restart interrupted picks up at the partition it stopped at
+	if store.resync.pendingResync(context.Background()) {
+		if err := store.StartResync(); err != nil {
+			log.Printf("Warning: resuming resync failed: %v", err)
+		}
+	}
 
 	return store, nil
 }
 
+// EraseVisitor deletes the events of visitorID on domain and the aliases of ctx
+// from the events table with a lightweight delete and returns how many there were. Add the visitor to the
+// tombstones first: the next sync would bring the events back otherwise.
+func (s *ClickHouseStore) EraseVisitor(ctx context.Context, domain, visitorID string) (int64, error) {
+	var count uint64
+	if err := s.queryRow(ctx, `
+		SELECT count()
+		FROM events
+		WHERE domain IN ? AND visitor_id = ?
+	`, queryDomains(ctx, domain), visitorID).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	if err := s.conn.Exec(ctx, `DELETE FROM events WHERE domain IN ? AND visitor_id = ?`, queryDomains(ctx, domain), visitorID); err != nil {
+		return 0, storeError(ctx, err)
+	}
+	return int64(count), nil
+}
+
 func (s *ClickHouseStore) Close() error {
 	close(s.stopCh)
 	return s.conn.Close()
@@ -96,9 +190,17 @@ func (s *ClickHouseStore) ensureTable() error {
 	// Drop old table with wrong schema
 	s.conn.Exec(ctx, "DROP TABLE IF EXISTS events")
 
-	// Create table matching S3 parquet schema (16 columns)
-	createTable := `
-		CREATE TABLE IF NOT EXISTS events (
+	if err := s.conn.Exec(ctx, eventsTableDDL("events")); err != nil {
+		return err
+	}
+	return s.detectPropColumns(ctx)
+}
+
+// eventsTableDDL creates table with the events schema: the S3 parquet
+// columns (16) plus materialized props columns
+func eventsTableDDL(table string) string {
+	return `
+		CREATE TABLE IF NOT EXISTS ` + table + ` (
 			domain LowCardinality(String),
 			visitor_id String,
 			name LowCardinality(String),
@@ -114,7 +216,8 @@ func (s *ClickHouseStore) ensureTable() error {
 			device LowCardinality(String) DEFAULT '',
 			country LowCardinality(String) DEFAULT '',
 			city LowCardinality(String) DEFAULT '',
-			received_at DateTime64(6, 'UTC')
+			received_at DateTime64(6, 'UTC'),
+			` + clickhousePropColumnsDDL() + `
 		)
 		ENGINE = ReplacingMergeTree()
 		PARTITION BY toYYYYMM(timestamp)
@@ -122,7 +225,25 @@ func (s *ClickHouseStore) ensureTable() error {
 		TTL toDate(timestamp) + INTERVAL 1 YEAR
 		SETTINGS index_granularity = 8192
 	`
-	return s.conn.Exec(ctx, createTable)
+}
+
+// detectPropColumns checks the events table for every materialized props column,
+// so tables created by older versions (or init.sql) keep using JSON extraction
+func (s *ClickHouseStore) detectPropColumns(ctx context.Context) error {
+	var count uint64
+	err := s.conn.QueryRow(ctx, `
+		SELECT count()
+		FROM system.columns
+		WHERE database = currentDatabase()
+		AND table = 'events'
+		AND name IN ?
+	`, propColumnNames()).Scan(&count)
+	if err != nil {
+		return err
+	}
+	s.propColumns = int(count) == len(extractedProps)
+	log.Printf("ClickHouse: materialized props columns: %v", s.propColumns)
+	return nil
 }
 
 func (s *ClickHouseStore) syncFromS3() error {
@@ -139,69 +260,315 @@ func (s *ClickHouseStore) syncFromS3() error {
 	}
 
 	// Table schema matches S3 parquet (16 columns)
+	source, erased := s.tombstones.exclude(s.s3.clickhouseSource(), clickhouseQuote)
 	insertQuery := fmt.Sprintf(`
 		INSERT INTO events
-		SELECT * FROM s3('%s', '%s', '%s', 'Parquet')
-	`, s.s3Path, s.s3Key, s.s3Secret)
+		SELECT %s FROM %s
+	`, clickhouseIngestColumns(s.timestamps.skew()), s.eventNames.clickhouseIngestSource(source))
 
 	if err := s.conn.Exec(ctx, insertQuery); err != nil {
 		return fmt.Errorf("insert from s3 failed: %w", err)
 	}
+	// Visitors erased while the insert ran may have been loaded again
+	if s.tombstones.changedSince(erased) {
+		if cond, _ := s.tombstones.condition(clickhouseQuote); cond != "" {
+			if err := s.conn.Exec(ctx, "DELETE FROM events WHERE "+cond); err != nil {
+				return fmt.Errorf("erasing tombstoned visitors failed: %w", err)
+			}
+		}
+	}
+
+	s.recordLoad(ctx)
 
 	// Get row count
+	// The data is loaded; a failed count only costs the log line its number
 	var count uint64
-	s.conn.QueryRow(ctx, "SELECT count() FROM events").Scan(&count)
+	if err := s.conn.QueryRow(ctx, "SELECT count() FROM events").Scan(&count); err != nil {
+		log.Printf("ClickHouse: synced events from S3 in %v, count failed: %v", time.Since(start), err)
+		return nil
+	}
 
-	s.lastSync = time.Now()
 	log.Printf("ClickHouse: synced %d events from S3 in %v", count, time.Since(start))
 
 	return nil
 }
 
-func (s *ClickHouseStore) refreshLoop() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+// recordLoad records what reports derive from a fresh load of the events table;
+// failures only log, as the data itself is loaded
+func (s *ClickHouseStore) recordLoad(ctx context.Context) {
+	if err := s.recordHourlyCounts(ctx); err != nil {
+		log.Printf("ClickHouse: failed to record hourly counts: %v", err)
+	}
+	if err := s.recordTimestampCounts(ctx); err != nil {
+		log.Printf("ClickHouse: failed to count clamped timestamps: %v", err)
+	}
+	if err := s.recordWatermarks(ctx); err != nil {
+		log.Printf("ClickHouse: failed to record freshness watermarks: %v", err)
+	}
+}
+
+// recordHourlyCounts records each domain's events per hour of the last
+// dataGapWindow from the local table, for GetDataGaps
+func (s *ClickHouseStore) recordHourlyCounts(ctx context.Context) error {
+	until := time.Now().UTC().Truncate(time.Hour)
+	since := until.Add(-dataGapWindow)
+
+	rows, err := s.conn.Query(ctx, `
+		SELECT domain, toStartOfHour(timestamp) AS hour, count()
+		FROM events
+		WHERE timestamp >= ? AND timestamp < ?
+		GROUP BY domain, hour
+	`, since, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	hours := make(map[string]map[time.Time]int64)
+	for rows.Next() {
+		var domain string
+		var hour time.Time
+		var n uint64
+		if err := rows.Scan(&domain, &hour, &n); err != nil {
+			return err
+		}
+		if hours[domain] == nil {
+			hours[domain] = make(map[time.Time]int64)
+		}
+		hours[domain][hour.UTC()] = int64(n)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.recordHours(hours, since, until)
+	return nil
+}
+
+// sync runs syncFromS3 and records the outcome for Status
+func (s *ClickHouseStore) sync() error {
+	err := s.syncFromS3()
+	s.recordSync(err)
+	return err
+}
+
+// recordSync records the outcome of a load for Status, running the refresh
+// callbacks after a successful one
+func (s *ClickHouseStore) recordSync(err error) {
+	s.statusMu.Lock()
+	if err != nil {
+		s.lastErr = err.Error()
+	} else {
+		s.lastSync = time.Now()
+		s.lastErr = ""
+	}
+	onRefresh := s.onRefresh
+	s.statusMu.Unlock()
+
+	if err == nil {
+		for _, fn := range onRefresh {
+			go fn()
+		}
+	}
+}
+
+// OnRefresh adds fn to the callbacks run in the background after each successful sync
+func (s *ClickHouseStore) OnRefresh(fn func()) {
+	s.statusMu.Lock()
+	s.onRefresh = append(s.onRefresh, fn)
+	s.statusMu.Unlock()
+}
+
+// GetDimensionValues returns the most common non-empty values of column, which
+// must come from a whitelist. Values longer than a filter accepts are skipped.
+func (s *ClickHouseStore) GetDimensionValues(ctx context.Context, domain, column string, from, to time.Time, limit int) ([]TopItem, error) {
+	query := fmt.Sprintf(`
+		SELECT %[1]s as item_name, count() as count
+		FROM %[2]s
+		WHERE domain IN ?
+		AND timestamp >= ?
+		AND timestamp < ?
+		%[4]s
+		AND ifNull(%[1]s, '') != ''
+		AND lengthUTF8(%[1]s) <= %[3]d
+		GROUP BY item_name
+		ORDER BY count DESC, item_name
+		LIMIT ?
+	`, column, s.s3Source(), maxFilterValueLen, clickhousePartitionClause(from, to))
+
+	rows, err := s.query(ctx, query, queryDomains(ctx, domain), from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return s.scanTopItems(rows)
+}
+
+// GetFirstEventAt returns the time of domain's earliest event; the events table
+// is ordered by domain and timestamp, so this reads little beyond the primary key
+func (s *ClickHouseStore) GetFirstEventAt(ctx context.Context, domain string) (time.Time, error) {
+	var first *time.Time
+	if err := s.queryRow(ctx, fmt.Sprintf(`
+		SELECT minOrNull(timestamp)
+		FROM %s
+		WHERE domain IN ?
+	`, s.s3Source()), queryDomains(ctx, domain)).Scan(&first); err != nil {
+		return time.Time{}, err
+	}
+	if first == nil {
+		return time.Time{}, ErrDomainUnknown
+	}
+	return *first, nil
+}
+
+// GetActiveDomains returns domains with events since since, busiest first
+func (s *ClickHouseStore) GetActiveDomains(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	rows, err := s.query(ctx, fmt.Sprintf(`
+		SELECT domain
+		FROM %s
+		WHERE timestamp >= ?
+		AND toYYYYMM(timestamp) >= %d
+		GROUP BY domain
+		ORDER BY count() DESC
+		LIMIT ?
+	`, s.s3Source(), yyyymm(since)), since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// Status reports whether a sync has succeeded and when
+func (s *ClickHouseStore) Status() StoreStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	st := StoreStatus{
+		Backend:   "clickhouse",
+		Ready:     !s.lastSync.IsZero(),
+		LastError: s.lastErr,
+
+		ClampedEvents: s.clampedEvents,
+		FutureEvents:  s.futureEvents,
+	}
+	if !s.lastSync.IsZero() {
+		st.LastRefresh = s.lastSync.UTC().Format(time.RFC3339)
+	}
+	st.Resync = s.resync.Progress()
+	s.retry.status(&st)
+	return st
+}
+
+// refreshLoop syncs every 5 minutes by default, backing off while syncs fail;
+// err is the outcome of the initial sync
+func (s *ClickHouseStore) refreshLoop(err error) {
+	timer := time.NewTimer(s.retry.schedule(s.every(5*time.Minute), err))
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-s.stopCh:
 			log.Println("ClickHouse: refresh loop stopped")
 			return
-		case <-ticker.C:
-			if err := s.syncFromS3(); err != nil {
-				log.Printf("ClickHouse: sync error: %v", err)
+		case <-timer.C:
+			err := s.sync()
+			wait := s.retry.schedule(s.every(5*time.Minute), err)
+			if err != nil {
+				log.Printf("ClickHouse: sync error, next attempt in %v: %v", wait.Round(time.Second), err)
 			}
+			timer.Reset(wait)
 		}
 	}
 }
 
+// s3Source is the local events table queries read, without future-dated
+// events when the timestamp rules exclude them
 func (s *ClickHouseStore) s3Source() string {
-	// Now read from local table instead of S3
-	return "events"
+	if !s.timestamps.ExcludeFuture {
+		return "events"
+	}
+	// SELECT * leaves out materialized columns
+	columns := "*"
+	if s.propColumns {
+		columns += ", " + strings.Join(propColumnNames(), ", ")
+	}
+	return fmt.Sprintf("(SELECT %s FROM events WHERE %s)", columns, clickhouseFutureCondition(time.Now()))
+}
+
+// clickhousePartitionClause constrains the partition key toYYYYMM(timestamp) to the
+// months overlapping [from, to), so pruning doesn't depend on the optimizer
+func clickhousePartitionClause(from, to time.Time) string {
+	last := to.Add(-time.Microsecond)
+	if last.Before(from) {
+		last = from
+	}
+	return fmt.Sprintf(" AND toYYYYMM(timestamp) BETWEEN %d AND %d", yyyymm(from), yyyymm(last))
+}
+
+// yyyymm matches ClickHouse toYYYYMM for the UTC events table
+func yyyymm(t time.Time) int {
+	t = t.UTC()
+	return t.Year()*100 + int(t.Month())
+}
+
+// clickhouseScanClause is the partition predicate for [from, to) followed by the
+// request filters. Ranged events queries append it right after their timestamp bounds.
+func clickhouseScanClause(ctx context.Context, from, to time.Time) (string, []any) {
+	filterClause, filterArgs := filtersFromContext(ctx).clickhouseClause()
+	return clickhousePartitionClause(from, to) + filterClause, filterArgs
 }
 
 // Overview stats
 func (s *ClickHouseStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	spam, spamArgs := clickhouseSpamExpr(ctx)
+	if spam == "" {
+		spam = "0"
+	}
+	consent := clickhouseConsentCondition(ctx)
+	if consent == "" {
+		consent = "1"
+	}
+	// The spam expression appears four times, so its args are repeated per use
 	query := fmt.Sprintf(`
 		SELECT
-			countIf(name = 'pageview') as pageviews,
-			uniq(visitor_id) as unique_visitors,
-			count() as events
-		FROM %s
-		WHERE domain = ?
+			countIf(name = 'pageview' AND NOT (%[3]s)) as pageviews,
+			uniqIf(visitor_id, NOT (%[3]s) AND %[4]s) as unique_visitors,
+			countIf(NOT (%[3]s)) as events,
+			countIf(%[3]s) as excluded_spam
+		FROM %[1]s
+		WHERE domain IN ?
 		AND timestamp >= ?
 		AND timestamp < ?
-	`, s.s3Source())
+		%[2]s
+	`, s.s3Source(), filterClause, spam, consent)
 
-	var pageviews, uniqueVisitors, events uint64
-	row := s.conn.QueryRow(ctx, query, domain, from, to)
-	if err := row.Scan(&pageviews, &uniqueVisitors, &events); err != nil {
+	var pageviews, uniqueVisitors, events, excluded uint64
+	var args []any
+	for i := 0; i < 4; i++ {
+		args = append(args, spamArgs...)
+	}
+	args = append(args, queryDomains(ctx, domain), from, to)
+	args = append(args, filterArgs...)
+	row := s.queryRow(ctx, query, args...)
+	if err := row.Scan(&pageviews, &uniqueVisitors, &events, &excluded); err != nil {
 		return nil, err
 	}
 	return &Overview{
 		Pageviews:      int64(pageviews),
 		UniqueVisitors: int64(uniqueVisitors),
 		Events:         int64(events),
+		ExcludedSpam:   int64(excluded),
 	}, nil
 }
 
@@ -212,20 +579,23 @@ func (s *ClickHouseStore) GetPageviewsTimeSeries(ctx context.Context, domain str
 		dateFunc = "toStartOfHour(timestamp)"
 	}
 
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
 	query := fmt.Sprintf(`
 		SELECT
 			%s as time_bucket,
 			count() as count
 		FROM %s
-		WHERE domain = ?
+		WHERE domain IN ?
 		AND name = 'pageview'
 		AND timestamp >= ?
 		AND timestamp < ?
+		%s
 		GROUP BY time_bucket
 		ORDER BY time_bucket
-	`, dateFunc, s.s3Source())
+	`, dateFunc, s.s3Source(), filterClause)
 
-	rows, err := s.conn.Query(ctx, query, domain, from, to)
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -247,38 +617,304 @@ func (s *ClickHouseStore) GetPageviewsTimeSeries(ctx context.Context, domain str
 	return result, nil
 }
 
+// Activity per step, for wallboards
+func (s *ClickHouseStore) GetActivity(ctx context.Context, domain string, from, to time.Time, step time.Duration) ([]ActivityBucket, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	spam, spamArgs := clickhouseSpamExpr(ctx)
+	if spam == "" {
+		spam = "0"
+	}
+	consent := clickhouseConsentCondition(ctx)
+	if consent == "" {
+		consent = "1"
+	}
+	// The spam expression appears twice, so its args are repeated per use
+	query := fmt.Sprintf(`
+		SELECT
+			intDiv(toUnixTimestamp64Micro(timestamp) - ?, %[5]d) as step,
+			countIf(name = 'pageview' AND NOT (%[3]s)) as pageviews,
+			uniqIf(visitor_id, NOT (%[3]s) AND %[4]s) as unique_visitors
+		FROM %[1]s
+		WHERE domain IN ?
+		AND timestamp >= ?
+		AND timestamp < ?
+		%[2]s
+		GROUP BY step
+		ORDER BY step
+	`, s.s3Source(), filterClause, spam, consent, step.Microseconds())
+
+	args := append([]any{from.UnixMicro()}, spamArgs...)
+	args = append(args, spamArgs...)
+	args = append(append(args, queryDomains(ctx, domain), from, to), filterArgs...)
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ActivityBucket
+	for rows.Next() {
+		var i int64
+		var pageviews, visitors uint64
+		if err := rows.Scan(&i, &pageviews, &visitors); err != nil {
+			return nil, err
+		}
+		result = append(result, ActivityBucket{Start: from.Add(time.Duration(i) * step), Pageviews: int64(pageviews), UniqueVisitors: int64(visitors)})
+	}
+	return result, rows.Err()
+}
+
 // Top pages
 func (s *ClickHouseStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
-	return s.getTopBy(ctx, "pathname", "pageview", domain, from, to, limit)
+	return s.getTopBy(ctx, clickhousePathExpr("pathname"), "pageview", domain, from, to, limit)
 }
 
 // Top sources (referrers)
 func (s *ClickHouseStore) GetTopSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	rows, err := s.sourceRows(ctx, domain, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return topSources(bucketSources(ctx, rows, limit)), nil
+}
+
+// Top sources with tagged direct traffic split by medium
+func (s *ClickHouseStore) GetSourceBuckets(ctx context.Context, domain string, from, to time.Time, limit int) ([]SourceBucket, error) {
+	rows, err := s.sourceRows(ctx, domain, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return bucketSources(ctx, rows, limit), nil
+}
+
+// sourceRows counts pageviews by referrer source and UTM values for bucketSources
+func (s *ClickHouseStore) sourceRows(ctx context.Context, domain string, from, to time.Time) ([]sourceRow, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	spamClause, spamArgs := clickhouseSpamExpr(ctx)
+	if spamClause != "" {
+		spamClause = "AND NOT " + spamClause
+	}
 	query := fmt.Sprintf(`
 		SELECT
-			multiIf(
-				referrer = '' OR referrer IS NULL, 'Direct',
-				position(referrer, ?) > 0, 'Direct',
-				domain(referrer)
-			) as source,
+			%s as source,
+			ifNull(utm_source, '') as utm_source,
+			ifNull(utm_medium, '') as utm_medium,
 			count() as count
 		FROM %s
-		WHERE domain = ?
+		WHERE domain IN ?
 		AND name = 'pageview'
 		AND timestamp >= ?
 		AND timestamp < ?
-		GROUP BY source
-		ORDER BY count DESC
+		%s
+		%s
+		GROUP BY source, utm_source, utm_medium
+	`, clickhouseReferrerSourceExpr, s.s3Source(), filterClause, spamClause)
+
+	args := append([]any{domain, queryDomains(ctx, domain), from, to}, filterArgs...)
+	args = append(args, spamArgs...)
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []sourceRow
+	for rows.Next() {
+		var row sourceRow
+		var count uint64
+		if err := rows.Scan(&row.Source, &row.UTMSource, &row.UTMMedium, &count); err != nil {
+			return nil, err
+		}
+		row.Count = int64(count)
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// Top referrer URLs per source
+func (s *ClickHouseStore) GetTopReferrerURLs(ctx context.Context, domain string, from, to time.Time, limit int) ([]ReferrerURLItem, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	spamClause, spamArgs := clickhouseSpamExpr(ctx)
+	if spamClause != "" {
+		spamClause = "AND NOT " + spamClause
+	}
+	query := fmt.Sprintf(`
+		SELECT source, url, count() as count
+		FROM (
+			SELECT %s as source, %s as url
+			FROM %s
+			WHERE domain IN ?
+			AND name = 'pageview'
+			AND timestamp >= ?
+			AND timestamp < ?
+			%s
+			%s
+		)
+		WHERE source != ''
+		GROUP BY source, url
+		ORDER BY count DESC, url
+		LIMIT ? BY source
+	`, clickhouseReferrerSourceExpr, clickhouseReferrerURLExpr, s.s3Source(), filterClause, spamClause)
+
+	args := append([]any{domain, queryDomains(ctx, domain), from, to}, filterArgs...)
+	args = append(args, spamArgs...)
+	rows, err := s.query(ctx, query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ReferrerURLItem
+	for rows.Next() {
+		var item ReferrerURLItem
+		var count uint64
+		if err := rows.Scan(&item.Source, &item.URL, &count); err != nil {
+			return nil, err
+		}
+		item.Count = int64(count)
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// Search engines
+func (s *ClickHouseStore) GetSearchEngines(ctx context.Context, domain string, from, to time.Time, limit int) ([]SearchEngineItem, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	query := fmt.Sprintf(`
+		SELECT engine, count() as pageviews, uniq(visitor_id) as visitors
+		FROM (
+			SELECT %s as engine, visitor_id
+			FROM %s
+			WHERE domain IN ?
+			AND name = 'pageview'
+			AND timestamp >= ?
+			AND timestamp < ?
+			%s
+		)
+		WHERE engine != ''
+		GROUP BY engine
+		ORDER BY pageviews DESC, engine
 		LIMIT ?
-	`, s.s3Source())
+	`, clickhouseSearchEngineExpr("referrer"), s.s3Source(), filterClause)
 
-	rows, err := s.conn.Query(ctx, query, domain, domain, from, to, limit)
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.query(ctx, query, append(args, limit)...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	return s.scanTopItems(rows)
+	var result []SearchEngineItem
+	for rows.Next() {
+		var item SearchEngineItem
+		var pageviews, visitors uint64
+		if err := rows.Scan(&item.Engine, &pageviews, &visitors); err != nil {
+			return nil, err
+		}
+		item.Pageviews = int64(pageviews)
+		item.Visitors = int64(visitors)
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// Visitor map
+func (s *ClickHouseStore) GetCountryMap(ctx context.Context, domain string, from, to time.Time) ([]GeoItem, error) {
+	return s.geoBreakdown(ctx, clickhouseCountryCodeExpr, "", domain, from, to, geoMapLimit)
+}
+
+func (s *ClickHouseStore) GetTopRegions(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	where := fmt.Sprintf("AND %s = %s", clickhouseCountryCodeExpr, clickhouseQuote(country))
+	return s.geoBreakdown(ctx, clickhouseRegionExpr(country), where, domain, from, to, limit)
+}
+
+func (s *ClickHouseStore) GetTopCities(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	where := fmt.Sprintf("AND %s = %s", clickhouseCountryCodeExpr, clickhouseQuote(country))
+	items, err := s.geoBreakdown(ctx, `trimBoth(ifNull(city, ''))`, where, domain, from, to, limit)
+	return geoNames(items), err
+}
+
+// geoBreakdown counts pageviews and visitors by the non-empty values of expr,
+// busiest first; where adds conditions on the scanned events
+func (s *ClickHouseStore) geoBreakdown(ctx context.Context, expr, where, domain string, from, to time.Time, limit int) ([]GeoItem, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	propClause, propArgs := clickhousePropClause(ctx)
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	query := fmt.Sprintf(`
+		SELECT code, count() as pageviews, uniq(visitor_id) as visitors
+		FROM (
+			SELECT %s as code, visitor_id
+			FROM %s
+			WHERE domain IN ?
+			AND name = 'pageview'
+			AND timestamp >= ?
+			AND timestamp < ?
+			%s
+			%s
+		)
+		WHERE code != ''
+		GROUP BY code
+		ORDER BY pageviews DESC, code
+		LIMIT ?
+	`, expr, s.s3Source(), where, filterClause)
+
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.query(ctx, query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []GeoItem
+	for rows.Next() {
+		var item GeoItem
+		var pageviews, visitors uint64
+		if err := rows.Scan(&item.Code, &pageviews, &visitors); err != nil {
+			return nil, err
+		}
+		item.Count = int64(pageviews)
+		item.Visitors = int64(visitors)
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// Domain mismatches
+func (s *ClickHouseStore) GetDomainMismatches(ctx context.Context, domain string, subdomains bool, from, to time.Time, limit int) ([]HostnameItem, error) {
+	scope := hostScope{domain: NormalizeHost(domain), subdomains: subdomains}
+	query := fmt.Sprintf(`
+		SELECT %[1]s as hostname, count() as events, max(timestamp) as last_seen
+		FROM %[2]s
+		WHERE domain IN ?
+		AND timestamp >= ?
+		AND timestamp < ?
+		%[3]s
+		AND NOT %[4]s
+		GROUP BY hostname
+		ORDER BY events DESC, hostname
+		LIMIT ?
+	`, clickhouseURLHostExpr, s.s3Source(), clickhousePartitionClause(from, to), scope.clickhouseCondition())
+
+	rows, err := s.query(ctx, query, queryDomains(ctx, domain), from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []HostnameItem
+	for rows.Next() {
+		var item HostnameItem
+		var events uint64
+		var lastSeen time.Time
+		if err := rows.Scan(&item.Hostname, &events, &lastSeen); err != nil {
+			return nil, err
+		}
+		item.Events = int64(events)
+		item.LastSeen = lastSeen.UTC().Format(time.RFC3339)
+		result = append(result, item)
+	}
+	return result, rows.Err()
 }
 
 // Top browsers
@@ -296,6 +932,15 @@ func (s *ClickHouseStore) GetTopDevices(ctx context.Context, domain string, from
 	return s.getTopBy(ctx, "device", "", domain, from, to, limit)
 }
 
+func (s *ClickHouseStore) GetTopLanguages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopByExpr(ctx, "language", clickhouseLanguageExpr, "pageview", domain, from, to, limit)
+}
+
+func (s *ClickHouseStore) GetScreenSizes(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error) {
+	items, err := s.getTopByExpr(ctx, "screen", clickhouseScreenExpr, "pageview", domain, from, to, len(screenBuckets)+1)
+	return sortScreenBuckets(items), err
+}
+
 // UTM stats
 func (s *ClickHouseStore) GetTopUTMSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
 	return s.getTopByNonEmpty(ctx, "utm_source", "pageview", domain, from, to, limit)
@@ -315,22 +960,25 @@ func (s *ClickHouseStore) getTopByNonEmpty(ctx context.Context, field, eventFilt
 		eventClause = fmt.Sprintf("AND name = '%s'", eventFilter)
 	}
 
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
 	query := fmt.Sprintf(`
 		SELECT
 			%s as item_name,
 			count() as count
 		FROM %s
-		WHERE domain = ?
+		WHERE domain IN ?
 		%s
 		AND %s IS NOT NULL AND %s != ''
 		AND timestamp >= ?
 		AND timestamp < ?
+		%s
 		GROUP BY item_name
 		ORDER BY count DESC
 		LIMIT ?
-	`, field, s.s3Source(), eventClause, field, field)
+	`, field, s.s3Source(), eventClause, field, field, filterClause)
 
-	rows, err := s.conn.Query(ctx, query, domain, from, to, limit)
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.query(ctx, query, append(args, limit)...)
 	if err != nil {
 		return nil, err
 	}
@@ -340,32 +988,69 @@ func (s *ClickHouseStore) getTopByNonEmpty(ctx context.Context, field, eventFilt
 }
 
 func (s *ClickHouseStore) getTopBy(ctx context.Context, field, eventFilter, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopByExpr(ctx, field, field, eventFilter, domain, from, to, limit)
+}
+
+// getTopByExpr counts events by the SQL expression expr, labeling the values as dimension
+func (s *ClickHouseStore) getTopByExpr(ctx context.Context, dimension, expr, eventFilter, domain string, from, to time.Time, limit int) ([]TopItem, error) {
 	eventClause := ""
 	if eventFilter != "" {
 		eventClause = fmt.Sprintf("AND name = '%s'", eventFilter)
 	}
 
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	propClause, propArgs := clickhousePropClause(ctx)
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	overrides := s.overrides.forColumn(domain, dimension, from, to)
+	// Overrides match stored values, so only rows without them group by label
+	if len(overrides) == 0 {
+		expr = clickhouseLabelExpr(dimension, expr)
+	}
 	query := fmt.Sprintf(`
 		SELECT
-			if(%s = '' OR %s IS NULL, 'Unknown', %s) as item_name,
-			count() as count
+			ifNull(%s, '') as item_name,
+			toInt64(%s) as override_mask,
+			count() as count,
+			count() OVER () as total_groups
 		FROM %s
-		WHERE domain = ?
+		WHERE domain IN ?
 		%s
 		AND timestamp >= ?
 		AND timestamp < ?
-		GROUP BY item_name
+		%s
+		GROUP BY item_name, override_mask
 		ORDER BY count DESC
 		LIMIT ?
-	`, field, field, field, s.s3Source(), eventClause)
+	`, expr, overrides.maskExpr(clickhouseTimeRange), s.s3Source(), eventClause, filterClause)
 
-	rows, err := s.conn.Query(ctx, query, domain, from, to, limit)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	return labelledTopItems(ctx, dimension, overrides, limit, func(n int) ([]maskedItem, int64, error) {
+		rows, err := s.query(ctx, query, append(args, n)...)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer rows.Close()
+
+		var items []maskedItem
+		var groups uint64
+		for rows.Next() {
+			var item maskedItem
+			var count uint64
+			if err := rows.Scan(&item.name, &item.mask, &count, &groups); err != nil {
+				return nil, 0, err
+			}
+			item.count = int64(count)
+			items = append(items, item)
+		}
+		return items, int64(groups), rows.Err()
+	})
+}
 
-	return s.scanTopItems(rows)
+// clickhouseTimeRange renders a condition on the timestamp column for from..to, to exclusive
+func clickhouseTimeRange(from, to time.Time) string {
+	return fmt.Sprintf("timestamp >= toDateTime64('%s', 6, 'UTC') AND timestamp < toDateTime64('%s', 6, 'UTC')",
+		from.UTC().Format("2006-01-02 15:04:05"), to.UTC().Format("2006-01-02 15:04:05"))
 }
 
 func (s *ClickHouseStore) scanTopItems(rows driver.Rows) ([]TopItem, error) {
@@ -382,49 +1067,245 @@ func (s *ClickHouseStore) scanTopItems(rows driver.Rows) ([]TopItem, error) {
 	return result, nil
 }
 
+// clickhouseErrorCondition matches error events and pageviews with a 4xx/5xx status prop.
+// The status may be sent as a JSON number or string, so the raw value is unquoted first.
+const clickhouseErrorCondition = `(name = 'error' OR (name = 'pageview' AND toInt32OrZero(trim(BOTH '"' FROM JSONExtractRaw(props, 'status'))) BETWEEN 400 AND 599))`
+
+// clickhouseNormalizedPath strips query string, fragment and trailing slash
+const clickhouseNormalizedPath = `replaceRegexpOne(replaceRegexpOne(pathname, '[?#].*$', ''), '(.)/$', '\\1')`
+
+// Error pages
+func (s *ClickHouseStore) GetErrorPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]ErrorPage, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	query := fmt.Sprintf(`
+		SELECT
+			%s as path,
+			count() as count,
+			uniq(visitor_id) as unique_visitors
+		FROM %s
+		WHERE domain IN ?
+		AND %s
+		AND timestamp >= ?
+		AND timestamp < ?
+		%s
+		GROUP BY path
+		ORDER BY count DESC
+		LIMIT ?
+	`, clickhousePathExpr(clickhouseNormalizedPath), s.s3Source(), clickhouseErrorCondition, filterClause)
+
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.query(ctx, query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ErrorPage, 0)
+	for rows.Next() {
+		var p ErrorPage
+		var count, uniqueVisitors uint64
+		if err := rows.Scan(&p.Path, &count, &uniqueVisitors); err != nil {
+			continue
+		}
+		p.Count = int64(count)
+		p.UniqueVisitors = int64(uniqueVisitors)
+		result = append(result, p)
+	}
+	rows.Close()
+
+	if len(result) == 0 {
+		return result, nil
+	}
+
+	refQuery := fmt.Sprintf(`
+		SELECT
+			%s as path,
+			referrer,
+			count() as count
+		FROM %s
+		WHERE domain IN ?
+		AND %s
+		AND timestamp >= ?
+		AND timestamp < ?
+		%s
+		GROUP BY path, referrer
+	`, clickhousePathExpr(clickhouseNormalizedPath), s.s3Source(), clickhouseErrorCondition, filterClause)
+
+	refRows, err := s.query(ctx, refQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer refRows.Close()
+
+	var refs []referrerCount
+	for refRows.Next() {
+		var rc referrerCount
+		var count uint64
+		if err := refRows.Scan(&rc.path, &rc.referrer, &count); err != nil {
+			continue
+		}
+		rc.count = int64(count)
+		refs = append(refs, rc)
+	}
+
+	attachTopReferrers(result, refs, domain)
+	return result, nil
+}
+
 // Recent events
-func (s *ClickHouseStore) GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]EventItem, error) {
+func (s *ClickHouseStore) GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields) ([]EventItem, error) {
+	return collectEvents(func(fn func(EventItem) error) error {
+		return s.StreamRecentEvents(ctx, domain, from, to, limit, fields, fn)
+	})
+}
+
+// StreamRecentEvents passes the newest events to fn one row at a time; an error
+// from fn stops the query and is returned. Columns of unselected fields are not
+// read at all.
+func (s *ClickHouseStore) StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields, fn func(EventItem) error) error {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	propClause, propArgs := clickhousePropClause(ctx)
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	columns := fields.columns("ifNull", fmt.Sprintf("leftUTF8(ifNull(props, ''), %d)", maxPropsBytes+1))
 	query := fmt.Sprintf(`
 		SELECT
-			name,
-			ifNull(url, '') as url,
-			ifNull(pathname, '') as pathname,
-			if(country = '' OR country IS NULL, 'Unknown', country) as country,
-			if(browser = '' OR browser IS NULL, 'Unknown', browser) as browser,
-			if(os = '' OR os IS NULL, 'Unknown', os) as os,
-			if(device = '' OR device IS NULL, 'desktop', device) as device,
-			timestamp as ts,
-			ifNull(props, '') as props
+			%s
 		FROM %s
-		WHERE domain = ?
+		WHERE domain IN ?
 		AND timestamp >= ?
 		AND timestamp < ?
+		%s
 		ORDER BY timestamp DESC
 		LIMIT ?
-	`, s.s3Source())
+	`, columns, s.s3Source(), filterClause)
 
-	rows, err := s.conn.Query(ctx, query, domain, from, to, limit)
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.query(ctx, query, append(args, limit)...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var result []EventItem
 	for rows.Next() {
-		var e EventItem
-		var ts time.Time
-		if err := rows.Scan(&e.Name, &e.URL, &e.Pathname, &e.Country, &e.Browser, &e.OS, &e.Device, &ts, &e.Props); err != nil {
+		e, ok := scanEvent(rows, domain, fields, s.overrides)
+		if !ok {
 			continue
 		}
-		e.Timestamp = ts.Format("2006-01-02 15:04:05")
-		result = append(result, e)
+		e.Props, e.PropsTruncated = truncateBytes(e.Props, maxPropsBytes)
+		if err := fn(e); err != nil {
+			return err
+		}
 	}
-	return result, nil
+	return rows.Err()
+}
+
+// GetEvent returns the event id names with its full props, or nil when there
+// is none
+func (s *ClickHouseStore) GetEvent(ctx context.Context, domain, id string) (*EventItem, error) {
+	at, err := parseEventID(id)
+	if err != nil {
+		return nil, err
+	}
+	// Events of the same microsecond are told apart by their visitor in Go
+	from, to := at, at.Add(time.Microsecond)
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM %s
+		WHERE domain IN ?
+		AND timestamp >= ?
+		AND timestamp < ?
+		%s
+	`, AllEventFields.columns("ifNull", "ifNull(props, '')"), s.s3Source(), clickhousePartitionClause(from, to))
+	rows, err := s.query(ctx, query, queryDomains(ctx, domain), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return findEvent(rows, domain, id, s.overrides)
 }
 
 // Event breakdown
-func (s *ClickHouseStore) GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error) {
-	return s.getTopBy(ctx, "name", "", domain, from, to, 10)
+func (s *ClickHouseStore) GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]EventBreakdownItem, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	propClause, propArgs := clickhousePropClause(ctx)
+	consent := clickhouseConsentCondition(ctx)
+	if consent == "" {
+		consent = "1"
+	}
+	// Counts per name and day since from, for the names with the most events
+	query := fmt.Sprintf(`
+		WITH scoped AS (
+			SELECT
+				ifNull(name, '') as item_name,
+				visitor_id,
+				%[4]s as consented,
+				intDiv(toUnixTimestamp64Micro(timestamp) - ?, %[5]d) as day
+			FROM %[1]s
+			WHERE domain IN ?
+			AND timestamp >= ?
+			AND timestamp < ?
+			%[2]s
+			%[3]s
+		),
+		ranked AS (
+			SELECT item_name, count() as total, uniqIf(visitor_id, consented) as visitors
+			FROM scoped
+			GROUP BY item_name
+			ORDER BY total DESC, item_name
+			LIMIT ?
+		)
+		SELECT item_name, total, visitors, day, count() as day_count
+		FROM scoped
+		INNER JOIN ranked USING (item_name)
+		GROUP BY item_name, total, visitors, day
+		ORDER BY total DESC, item_name, day
+	`, s.s3Source(), filterClause, propClause, consent, (24 * time.Hour).Microseconds())
+
+	args := append([]any{from.UnixMicro(), queryDomains(ctx, domain), from, to}, filterArgs...)
+	args = append(append(args, propArgs...), eventBreakdownLimit)
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []breakdownRow
+	for rows.Next() {
+		var row breakdownRow
+		var count, visitors, dayCount uint64
+		if err := rows.Scan(&row.name, &count, &visitors, &row.day, &dayCount); err != nil {
+			return nil, err
+		}
+		row.count, row.visitors, row.dayCount = int64(count), int64(visitors), int64(dayCount)
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return pivotBreakdown(result, from, to), nil
+}
+
+// Distinct event names, for the breakdown cardinality guard
+func (s *ClickHouseStore) GetEventCardinality(ctx context.Context, domain string, from, to time.Time) (EventCardinality, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	propClause, propArgs := clickhousePropClause(ctx)
+	query := fmt.Sprintf(`
+		SELECT uniqExact(name), count()
+		FROM %s
+		WHERE domain IN ?
+		AND timestamp >= ?
+		AND timestamp < ?
+		%s
+		%s
+	`, s.s3Source(), filterClause, propClause)
+
+	args := append(append([]any{queryDomains(ctx, domain), from, to}, filterArgs...), propArgs...)
+	var names, events uint64
+	if err := s.queryRow(ctx, query, args...).Scan(&names, &events); err != nil {
+		return EventCardinality{}, err
+	}
+	return EventCardinality{Names: int64(names), Events: int64(events)}, nil
 }
 
 // Unique pages
@@ -442,19 +1323,30 @@ func (s *ClickHouseStore) GetFunnel(ctx context.Context, domain string, from, to
 		Steps: make([]FunnelStep, len(steps)),
 	}
 
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	consentClause := andCondition(clickhouseConsentCondition(ctx))
 	for i, step := range steps {
+		// A cancelled request must not keep issuing step queries
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		query := fmt.Sprintf(`
 			SELECT uniq(visitor_id)
 			FROM %s
-			WHERE domain = ?
+			WHERE domain IN ?
 			AND name = 'pageview'
-			AND pathname = ?
+			AND %s = ?
 			AND timestamp >= ?
 			AND timestamp < ?
-		`, s.s3Source())
+			%s
+			%s
+		`, s.s3Source(), clickhouseFunnelPath("pathname"), filterClause, consentClause)
 
+		args := append([]any{queryDomains(ctx, domain), funnel.NormalizePath(step), from, to}, filterArgs...)
 		var count uint64
-		s.conn.QueryRow(ctx, query, domain, step, from, to).Scan(&count)
+		if err := s.queryRow(ctx, query, args...).Scan(&count); err != nil {
+			return nil, fmt.Errorf("funnel step %d: %w", i+1, err)
+		}
 
 		result.Steps[i] = FunnelStep{
 			Name:  step,
@@ -480,37 +1372,249 @@ func (s *ClickHouseStore) GetFunnel(ctx context.Context, domain string, from, to
 	return result, nil
 }
 
-// Advanced funnel
-func (s *ClickHouseStore) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []FunnelStepDef, windowMinutes int) (*FunnelResult, error) {
-	var simpleSteps []string
-	for _, step := range steps {
-		if step.Type == "pageview" {
-			simpleSteps = append(simpleSteps, step.Value)
+// Advanced funnel: matching events are evaluated in Go, same as the DuckDB store
+func (s *ClickHouseStore) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, windowMinutes int) (*FunnelResult, error) {
+	if included := len(funnel.Included(steps)); included < 2 {
+		return newFunnelResult(steps, make([]int64, included)), nil
+	}
+
+	scanTo, entryEnd := funnelScan(ctx, to, windowMinutes)
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, scanTo)
+	query := fmt.Sprintf(`
+		SELECT
+			visitor_id,
+			name,
+			%s as normalized_pathname,
+			props,
+			timestamp
+		FROM %s
+		WHERE domain IN ?
+		AND timestamp >= ?
+		AND timestamp < ?
+		AND name IN ?
+		%s
+		%s
+		ORDER BY visitor_id, timestamp
+		LIMIT %d
+	`, clickhouseFunnelPath("pathname"), s.s3Source(), filterClause, andCondition(clickhouseConsentCondition(ctx)), maxFunnelEvents)
+
+	args := append([]any{queryDomains(ctx, domain), from, scanTo, funnelEventNames(steps)}, filterArgs...)
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.VisitorID, &e.Name, &e.Pathname, &e.Props, &e.Timestamp); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	counts := evaluateFunnel(events, steps, time.Duration(windowMinutes)*time.Minute, entryEnd)
+	return newFunnelResult(steps, counts), nil
+}
+
+func (s *ClickHouseStore) GetStepMatchCounts(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step) ([]int64, error) {
+	if len(steps) == 0 {
+		return []int64{}, nil
+	}
+
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	query := fmt.Sprintf(`
+		SELECT
+			name,
+			%s as normalized_pathname,
+			count() as count
+		FROM %s
+		WHERE domain IN ?
+		AND timestamp >= ?
+		AND timestamp < ?
+		AND name IN ?
+		%s
+		%s
+		GROUP BY name, normalized_pathname
+	`, clickhouseFunnelPath("pathname"), s.s3Source(), filterClause, andCondition(clickhouseConsentCondition(ctx)))
+
+	args := append([]any{queryDomains(ctx, domain), from, to, funnelEventNames(steps)}, filterArgs...)
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []pathCount
+	for rows.Next() {
+		var c pathCount
+		var count uint64
+		if err := rows.Scan(&c.Name, &c.Pathname, &count); err != nil {
+			continue
+		}
+		c.Count = int64(count)
+		counts = append(counts, c)
+	}
+	return sumStepMatches(counts, steps), rows.Err()
+}
+
+// Campaign conversions, one session per visitor
+func (s *ClickHouseStore) GetCampaignConversions(ctx context.Context, domain string, goal funnel.Step, from, to time.Time, opts CampaignOptions, limit int) ([]CampaignConversion, error) {
+	touch := "argMin"
+	if opts.Attribution == "last" {
+		touch = "argMax"
+	}
+	dims := "'', ''"
+	if opts.BySourceMedium {
+		dims = "t.source, t.medium"
+	}
+
+	conversion, withRevenue := goalRevenue(ctx, goal)
+	revenueSum := "toFloat64(0)"
+	if withRevenue {
+		revenueSum = "ifNull(sum(" + conversion.clickhouseValueExpr() + "), 0)"
+	}
+
+	goalClause, goalArgs := clickhouseGoalClause(goal)
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	query := fmt.Sprintf(`
+		WITH touches AS (
+			SELECT
+				visitor_id,
+				%[1]s(if(utm_campaign = '', '%[2]s', utm_campaign), timestamp) as campaign,
+				%[1]s(utm_source, timestamp) as source,
+				%[1]s(utm_medium, timestamp) as medium
+			FROM %[3]s
+			WHERE domain IN ?
+			AND name = 'pageview'
+			AND timestamp >= ?
+			AND timestamp < ?
+			%[4]s
+			GROUP BY visitor_id
+		), conversions AS (
+			SELECT visitor_id, count() as completions, %[8]s as revenue
+			FROM %[3]s
+			WHERE domain IN ?
+			AND %[5]s
+			AND timestamp >= ?
+			AND timestamp < ?
+			%[7]s
+			GROUP BY visitor_id
+		)
+		SELECT
+			t.campaign,
+			%[6]s,
+			count() as sessions,
+			countIf(c.completions > 0) as conversions,
+			sum(c.completions) as completions,
+			sum(c.revenue) as revenue
+		FROM touches t
+		LEFT JOIN conversions c ON t.visitor_id = c.visitor_id
+		GROUP BY 1, 2, 3
+		ORDER BY sessions DESC
+		LIMIT ?
+	`, touch, DirectCampaign, s.s3Source(), filterClause, goalClause, dims, clickhousePartitionClause(from, to), revenueSum)
+
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	args = append(args, queryDomains(ctx, domain))
+	args = append(args, goalArgs...)
+	args = append(args, from, to, limit)
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]CampaignConversion, 0)
+	for rows.Next() {
+		var c CampaignConversion
+		var sessions, conversions, completions uint64
+		var revenue float64
+		if err := rows.Scan(&c.Campaign, &c.Source, &c.Medium, &sessions, &conversions, &completions, &revenue); err != nil {
+			continue
+		}
+		c.Sessions = int64(sessions)
+		c.Conversions = int64(conversions)
+		c.Completions = int64(completions)
+		if withRevenue {
+			c.Revenue = &revenue
+		}
+		result = append(result, c)
+	}
+	setConversionRates(result)
+	return result, nil
+}
+
+// GetRevenue sums the revenue of the purchase events of [from, to) per UTC
+// hour, with the settings and rates attached by withRevenue
+func (s *ClickHouseStore) GetRevenue(ctx context.Context, domain string, from, to time.Time) (*Revenue, error) {
+	conversion := revenueConversionFromContext(ctx)
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
+	query := fmt.Sprintf(`
+		SELECT
+			hour,
+			ifNull(sum(value), 0) as revenue,
+			count() as purchases,
+			count() - count(value) as excluded
+		FROM (
+			SELECT
+				toStartOfHour(timestamp) as hour,
+				%s as value
+			FROM %s
+			WHERE domain IN ?
+			AND name = ?
+			AND timestamp >= ?
+			AND timestamp < ?
+			%s
+		)
+		GROUP BY hour
+		ORDER BY hour
+	`, conversion.clickhouseValueExpr(), s.s3Source(), filterClause)
+
+	args := append([]any{queryDomains(ctx, domain), conversion.event, from, to}, filterArgs...)
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hours []RevenuePoint
+	for rows.Next() {
+		var t time.Time
+		var revenue float64
+		var purchases, excluded uint64
+		if err := rows.Scan(&t, &revenue, &purchases, &excluded); err != nil {
+			continue
 		}
+		hours = append(hours, RevenuePoint{Time: t.Format("2006-01-02T15:00"), Revenue: revenue, Purchases: int64(purchases), Excluded: int64(excluded)})
 	}
-	return s.GetFunnel(ctx, domain, from, to, simpleSteps)
+	return newRevenue(conversion.currency, hours), nil
 }
 
 // Autocapture events
 func (s *ClickHouseStore) GetAutocaptureEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]AutocaptureEvent, error) {
+	filterClause, filterArgs := clickhouseScanClause(ctx, from, to)
 	query := fmt.Sprintf(`
 		SELECT
 			name as event_type,
-			ifNull(simpleJSONExtractString(props, 'text'), '') as text,
-			ifNull(simpleJSONExtractString(props, 'tag'), '') as tag,
-			ifNull(pathname, '') as pathname,
+			ifNull(%s, '') as text,
+			ifNull(%s, '') as tag,
+			%s as pathname,
 			count() as count
 		FROM %s
-		WHERE domain = ?
+		WHERE domain IN ?
 		AND name IN ('click', 'submit', 'change')
 		AND timestamp >= ?
 		AND timestamp < ?
+		%s
 		GROUP BY name, text, tag, pathname
 		ORDER BY count DESC
 		LIMIT ?
-	`, s.s3Source())
+	`, s.propExpr("text"), s.propExpr("tag"), clickhousePathExpr("ifNull(pathname, '')"), s.s3Source(), filterClause)
 
-	rows, err := s.conn.Query(ctx, query, domain, from, to, limit)
+	args := append([]any{queryDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.query(ctx, query, append(args, limit)...)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,165 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+func TestClickhousePartitionClause(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		from, to time.Time
+		want     string
+	}{
+		{day(2024, 3, 1), day(2024, 3, 8), " AND toYYYYMM(timestamp) BETWEEN 202403 AND 202403"},
+		// to is exclusive, so a range ending at midnight on the 1st stays in the previous month
+		{day(2024, 3, 25), day(2024, 4, 1), " AND toYYYYMM(timestamp) BETWEEN 202403 AND 202403"},
+		{day(2023, 12, 28), day(2024, 1, 4), " AND toYYYYMM(timestamp) BETWEEN 202312 AND 202401"},
+		{day(2024, 1, 1), day(2024, 4, 1), " AND toYYYYMM(timestamp) BETWEEN 202401 AND 202403"},
+		{day(2024, 5, 1), day(2024, 5, 1), " AND toYYYYMM(timestamp) BETWEEN 202405 AND 202405"},
+		// Months are UTC regardless of the caller's zone
+		{time.Date(2024, 7, 1, 1, 0, 0, 0, time.FixedZone("CEST", 2*3600)), day(2024, 7, 2), " AND toYYYYMM(timestamp) BETWEEN 202406 AND 202407"},
+	}
+	for _, tt := range tests {
+		if got := clickhousePartitionClause(tt.from, tt.to); got != tt.want {
+			t.Errorf("clickhousePartitionClause(%v, %v) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// TestClickHouseIntegration_PartitionPruning needs a ClickHouse server; it runs in
+// a throwaway database and checks system.query_log for the parts a query read
+func TestClickHouseIntegration_PartitionPruning(t *testing.T) {
+	addr := os.Getenv("CLICKHOUSE_TEST_ADDR")
+	if addr == "" {
+		t.Skip("CLICKHOUSE_TEST_ADDR not set")
+	}
+	ctx := context.Background()
+
+	admin, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	database := fmt.Sprintf("clickresearch_test_%d", time.Now().UnixNano())
+	if err := admin.Exec(ctx, "CREATE DATABASE "+database); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Exec(ctx, "DROP DATABASE IF EXISTS "+database)
+
+	conn, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}, Auth: clickhouse.Auth{Database: database}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := &ClickHouseStore{conn: conn, stopCh: make(chan struct{})}
+	if err := s.ensureTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	// One insert with a row in each of the last 12 months: one part per partition
+	if err := conn.Exec(ctx, `
+		INSERT INTO events (domain, visitor_id, name, timestamp, received_at)
+		SELECT 'example.com', toString(number), 'pageview',
+			toDateTime64(toStartOfMonth(today()), 6, 'UTC') - toIntervalMonth(number) + toIntervalDay(1),
+			now64(6, 'UTC')
+		FROM numbers(12)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// A 7-day range straddling the start of this month
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Add(-3 * 24 * time.Hour)
+	to := from.Add(7 * 24 * time.Hour)
+
+	queryID := fmt.Sprintf("partition-pruning-%d", time.Now().UnixNano())
+	qctx := clickhouse.Context(WithFilters(ctx, Filters{}), clickhouse.WithQueryID(queryID))
+	if _, err := s.GetOverview(qctx, "example.com", from, to); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Exec(ctx, "SYSTEM FLUSH LOGS"); err != nil {
+		t.Fatal(err)
+	}
+	var parts uint64
+	if err := conn.QueryRow(ctx, `
+		SELECT ProfileEvents['SelectedParts']
+		FROM system.query_log
+		WHERE query_id = ? AND type = 'QueryFinish'
+	`, queryID).Scan(&parts); err != nil {
+		t.Fatal(err)
+	}
+	if parts > 2 {
+		t.Errorf("7-day query read %d parts, want at most 2", parts)
+	}
+}
+
+// fakeCHConn answers QueryRow with the row of the n-th query; the other
+// driver.Conn methods are left nil
+type fakeCHConn struct {
+	driver.Conn
+	queries int
+	row     func(n int) driver.Row
+}
+
+func (c *fakeCHConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	c.queries++
+	return c.row(c.queries)
+}
+
+// countRow scans a single uint64
+type countRow uint64
+
+func (r countRow) Err() error           { return nil }
+func (r countRow) ScanStruct(any) error { return nil }
+func (r countRow) Scan(dest ...any) error {
+	*dest[0].(*uint64) = uint64(r)
+	return nil
+}
+
+func TestClickHouseGetFunnel_StopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(WithFilters(context.Background(), Filters{}))
+	defer cancel()
+	conn := &fakeCHConn{row: func(n int) driver.Row {
+		// The dashboard request goes away while the first step runs
+		cancel()
+		return countRow(10)
+	}}
+	s := &ClickHouseStore{conn: conn, lastSync: time.Now()}
+
+	_, err := s.GetFunnel(ctx, "example.com", time.Now().Add(-time.Hour), time.Now(), []string{"/", "/pricing", "/signup"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if conn.queries != 1 {
+		t.Errorf("ran %d queries, want 1", conn.queries)
+	}
+}
+
+func TestClickHouseGetFunnel_ScanError(t *testing.T) {
+	boom := errors.New("connection reset")
+	conn := &fakeCHConn{row: func(n int) driver.Row {
+		if n == 2 {
+			return errRow{boom}
+		}
+		return countRow(10)
+	}}
+	s := &ClickHouseStore{conn: conn, lastSync: time.Now()}
+
+	_, err := s.GetFunnel(WithFilters(context.Background(), Filters{}), "example.com", time.Now().Add(-time.Hour), time.Now(), []string{"/", "/pricing", "/signup"})
+	if !errors.Is(err, boom) || !strings.Contains(err.Error(), "funnel step 2") {
+		t.Errorf("err = %v, want step 2 failure", err)
+	}
+	if conn.queries != 2 {
+		t.Errorf("ran %d queries, want 2", conn.queries)
+	}
+}
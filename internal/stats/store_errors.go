@@ -0,0 +1,77 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/lib/pq"
+)
+
+// Store errors handlers map to statuses other than 500; see writeError
+var (
+	// ErrNotReady means the store has no data loaded yet, as opposed to a domain without traffic
+	ErrNotReady = errors.New("stats are not available yet, retry shortly")
+	// ErrDomainUnknown means the store has never seen an event for the domain
+	ErrDomainUnknown = errors.New("no events recorded for this domain")
+	// ErrQueryTimeout means the query ran past its deadline; the cause stays wrapped
+	ErrQueryTimeout = errors.New("query timed out")
+	// ErrBusy means the backend has no capacity for the query right now
+	ErrBusy = errors.New("stats backend is busy, retry shortly")
+)
+
+// ClickHouse exception codes classified by storeError
+const (
+	clickhouseTimeoutExceeded            = 159
+	clickhouseTooSlow                    = 160
+	clickhouseTooManySimultaneousQueries = 202
+)
+
+// Postgres error codes classified by storeError; statement_timeout cancels
+// queries with query_canceled
+const (
+	postgresQueryCanceled      = "57014"
+	postgresTooManyConnections = "53300"
+)
+
+// storeError classifies err from a query run with ctx as ErrQueryTimeout or
+// ErrBusy, wrapping the original error; other errors are returned as is
+func storeError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrQueryTimeout) || errors.Is(err, ErrBusy) || errors.Is(err, ErrNotReady) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) || (errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, context.Canceled)) {
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	}
+	if errors.Is(err, clickhouse.ErrAcquireConnTimeout) {
+		return fmt.Errorf("%w: %w", ErrBusy, err)
+	}
+	var exc *clickhouse.Exception
+	if errors.As(err, &exc) {
+		switch exc.Code {
+		case clickhouseTimeoutExceeded, clickhouseTooSlow:
+			return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+		case clickhouseTooManySimultaneousQueries:
+			return fmt.Errorf("%w: %w", ErrBusy, err)
+		}
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case postgresQueryCanceled:
+			return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+		case postgresTooManyConnections:
+			return fmt.Errorf("%w: %w", ErrBusy, err)
+		}
+	}
+	return err
+}
+
+// statusError is the error a store in state st answers queries with
+func statusError(st StoreStatus) error {
+	if !st.Ready {
+		return ErrNotReady
+	}
+	return nil
+}
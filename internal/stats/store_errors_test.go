@@ -0,0 +1,189 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// errStore fails page queries with err and reports st
+type errStore struct {
+	fakeStore
+	err error
+	st  StoreStatus
+}
+
+func (s errStore) Status() StoreStatus { return s.st }
+func (s errStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return nil, s.err
+}
+
+func TestWriteError_StoreErrors(t *testing.T) {
+	tests := []struct {
+		err        error
+		status     int
+		code       string
+		retryAfter string
+		retryable  bool
+	}{
+		{ErrNotReady, http.StatusServiceUnavailable, "not_ready", "10", true},
+		{ErrDomainUnknown, http.StatusNotFound, "domain_unknown", "", false},
+		{fmt.Errorf("%w: %w", ErrQueryTimeout, context.DeadlineExceeded), http.StatusGatewayTimeout, "query_timeout", "", true},
+		{fmt.Errorf("%w: too many queries", ErrBusy), http.StatusTooManyRequests, "busy", "2", true},
+		{errors.New("syntax error"), http.StatusInternalServerError, "", "", false},
+	}
+	for _, tt := range tests {
+		h := NewHandler(errStore{err: tt.err, st: StoreStatus{Ready: true}})
+		w := httptest.NewRecorder()
+		h.HandlePages(w, httptest.NewRequest("GET", "/api/stats/pages?domain=example.com", nil))
+
+		var body map[string]any
+		json.NewDecoder(w.Body).Decode(&body)
+		code, _ := body["code"].(string)
+		if w.Code != tt.status || code != tt.code || w.Header().Get("Retry-After") != tt.retryAfter || body["retryable"] != tt.retryable {
+			t.Errorf("%v: %d %v Retry-After %q, want %d %q %q retryable %v", tt.err, w.Code, body, w.Header().Get("Retry-After"), tt.status, tt.code, tt.retryAfter, tt.retryable)
+		}
+	}
+}
+
+// TestWriteError_Retryable asserts the retry hints of every error and status
+// stats handlers answer with
+func TestWriteError_Retryable(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		status       int
+		header       string // Retry-After set by the handler
+		wantStatus   int
+		retryable    bool
+		retryAfterMS float64
+	}{
+		{"not ready", ErrNotReady, http.StatusInternalServerError, "", http.StatusServiceUnavailable, true, 10000},
+		{"busy", ErrBusy, http.StatusInternalServerError, "", http.StatusTooManyRequests, true, 2000},
+		{"query timeout", ErrQueryTimeout, http.StatusInternalServerError, "", http.StatusGatewayTimeout, true, 0},
+		{"deadline", context.DeadlineExceeded, http.StatusInternalServerError, "", http.StatusGatewayTimeout, true, 0},
+		{"query budget", &BudgetExceededError{Domain: "example.com", RetryAfter: 1500 * time.Millisecond}, http.StatusInternalServerError, "", http.StatusTooManyRequests, true, 1500},
+		{"domain unknown", ErrDomainUnknown, http.StatusInternalServerError, "", http.StatusNotFound, false, 0},
+		{"range too long", &RangeTooLongError{Path: "/api/stats/events", MaxRange: 31 * 24 * time.Hour}, http.StatusBadRequest, "", http.StatusBadRequest, false, 0},
+		{"canceled", context.Canceled, http.StatusInternalServerError, "", statusClientClosedRequest, false, 0},
+		{"domain forbidden", ErrDomainForbidden, http.StatusForbidden, "", http.StatusForbidden, false, 0},
+		{"invalid embed token", ErrInvalidEmbedToken, http.StatusUnauthorized, "", http.StatusUnauthorized, false, 0},
+		{"segment not found", ErrSegmentNotFound, http.StatusNotFound, "", http.StatusNotFound, false, 0},
+		{"validation", errors.New("unknown period"), http.StatusBadRequest, "", http.StatusBadRequest, false, 0},
+		{"method", nil, http.StatusMethodNotAllowed, "", http.StatusMethodNotAllowed, false, 0},
+		{"conflict", errors.New("job running"), http.StatusConflict, "", http.StatusConflict, false, 0},
+		{"too large", errors.New("too large"), http.StatusRequestEntityTooLarge, "", http.StatusRequestEntityTooLarge, false, 0},
+		{"internal", errors.New("syntax error"), http.StatusInternalServerError, "", http.StatusInternalServerError, false, 0},
+		{"no store", nil, http.StatusServiceUnavailable, "", http.StatusServiceUnavailable, false, 0},
+		{"feature off", errors.New("reports are not enabled"), http.StatusServiceUnavailable, "", http.StatusServiceUnavailable, false, 0},
+		{"stream limit", errLiveStreamLimit, http.StatusServiceUnavailable, "30", http.StatusServiceUnavailable, true, 30000},
+		{"too many", errors.New("slow down"), http.StatusTooManyRequests, "", http.StatusTooManyRequests, true, 0},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		if tt.header != "" {
+			w.Header().Set("Retry-After", tt.header)
+		}
+		writeError(w, tt.err, tt.status)
+
+		var body map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		ms, _ := body["retry_after_ms"].(float64)
+		if w.Code != tt.wantStatus || body["retryable"] != tt.retryable || ms != tt.retryAfterMS {
+			t.Errorf("%s: %d %v, want %d retryable %v retry_after_ms %v", tt.name, w.Code, body, tt.wantStatus, tt.retryable, tt.retryAfterMS)
+		}
+		wantHeader := ""
+		if tt.retryAfterMS > 0 {
+			wantHeader = strconv.Itoa(int(math.Ceil(tt.retryAfterMS / 1000)))
+		}
+		if got := w.Header().Get("Retry-After"); got != wantHeader {
+			t.Errorf("%s: Retry-After = %q, want %q", tt.name, got, wantHeader)
+		}
+	}
+}
+
+func TestStore_NotReadyIsAnError(t *testing.T) {
+	s := &Store{}
+	ctx := WithFilters(context.Background(), Filters{})
+	if _, err := s.GetOverview(ctx, "example.com", time.Now().Add(-time.Hour), time.Now()); !errors.Is(err, ErrNotReady) {
+		t.Errorf("GetOverview err = %v, want ErrNotReady", err)
+	}
+	if _, err := s.GetTopPages(ctx, "example.com", time.Now().Add(-time.Hour), time.Now(), 10); !errors.Is(err, ErrNotReady) {
+		t.Errorf("GetTopPages err = %v, want ErrNotReady", err)
+	}
+}
+
+func TestStore_FirstEventOfUnknownDomain(t *testing.T) {
+	s := newExplainStore(t)
+	if _, err := s.GetFirstEventAt(context.Background(), "nobody.example.com"); !errors.Is(err, ErrDomainUnknown) {
+		t.Errorf("err = %v, want ErrDomainUnknown", err)
+	}
+	if first, err := s.GetFirstEventAt(context.Background(), "example.com"); err != nil || first.IsZero() {
+		t.Errorf("first = %v, %v", first, err)
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	tests := []struct {
+		ctx  context.Context
+		err  error
+		want error
+	}{
+		{context.Background(), &clickhouse.Exception{Code: clickhouseTimeoutExceeded}, ErrQueryTimeout},
+		{context.Background(), &clickhouse.Exception{Code: clickhouseTooManySimultaneousQueries}, ErrBusy},
+		{context.Background(), fmt.Errorf("acquire: %w", clickhouse.ErrAcquireConnTimeout), ErrBusy},
+		{context.Background(), context.DeadlineExceeded, ErrQueryTimeout},
+		// Drivers report an interrupted query in their own words
+		{expired, errors.New("INTERRUPT Error: Interrupted!"), ErrQueryTimeout},
+	}
+	for _, tt := range tests {
+		got := storeError(tt.ctx, tt.err)
+		if !errors.Is(got, tt.want) || !errors.Is(got, tt.err) {
+			t.Errorf("storeError(%v) = %v, want %v wrapping it", tt.err, got, tt.want)
+		}
+	}
+
+	plain := &clickhouse.Exception{Code: 62}
+	if got := storeError(context.Background(), plain); got != plain {
+		t.Errorf("syntax error classified as %v", got)
+	}
+	if got := storeError(context.Background(), context.Canceled); got != context.Canceled {
+		t.Errorf("cancellation classified as %v", got)
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewHandler(errStore{}).HandleReady(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("not ready: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	w = httptest.NewRecorder()
+	NewHandler(errStore{st: StoreStatus{Ready: true, Backend: "duckdb"}}).HandleReady(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("ready: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestStaleDataWarning(t *testing.T) {
+	h := NewHandler(errStore{st: StoreStatus{Ready: true, MemoryTable: true, ConsecutiveFailures: 2}})
+	w := httptest.NewRecorder()
+	h.HandlePages(w, httptest.NewRequest("GET", "/api/stats/pages?domain=example.com", nil))
+	if got := w.Header().Get(dataWarningHeader); got != dataWarningStale {
+		t.Errorf("%s = %q, want %q", dataWarningHeader, got, dataWarningStale)
+	}
+}
@@ -2,26 +2,140 @@ package stats
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
 )
 
-// StoreInterface defines the analytics store contract
+// StoreStatus describes backend readiness and data freshness for diagnostics
+type StoreStatus struct {
+	// Backend is duckdb, clickhouse or postgres. Postgres queries its events
+	// table in place and stays responsive up to EventLimit events.
+	Backend     string `json:"backend"`
+	Ready       bool   `json:"ready"`
+	LastRefresh string `json:"last_refresh,omitempty"` // RFC3339
+	LastError   string `json:"last_error,omitempty"`
+	MemoryTable bool   `json:"memory_table,omitempty"` // DuckDB only
+	// MemoryTableSince is where a memory table holding recent events only starts (RFC3339); DuckDB only
+	MemoryTableSince string `json:"memory_table_since,omitempty"`
+	// FallbackMaxDays caps ranges read from parquet without a memory table; DuckDB only
+	FallbackMaxDays int `json:"fallback_max_days,omitempty"`
+	// NextRefresh is when the background refresh runs next (RFC3339); failures push it back
+	NextRefresh         string `json:"next_refresh,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures,omitempty"`
+	// ClampedEvents counts loaded events whose timestamp was clamped to their
+	// received_at window; FutureEvents those more than a day ahead of the load,
+	// which queries leave out when configured to
+	ClampedEvents int64 `json:"clamped_events"`
+	FutureEvents  int64 `json:"future_events"`
+	// Events counts the stored events as of the last refresh, and EventLimit
+	// how many the backend is sized for; Postgres only
+	Events     int64 `json:"events,omitempty"`
+	EventLimit int64 `json:"event_limit,omitempty"`
+	// Resync is the running or last full resync; ClickHouse only
+	Resync *ResyncProgress `json:"resync,omitempty"`
+}
+
+// refreshInterval is a store's reload period, read again before every wait
+type refreshInterval struct {
+	d atomic.Int64
+}
+
+func (r *refreshInterval) SetRefreshInterval(d time.Duration) {
+	r.d.Store(int64(d))
+}
+
+// every returns the configured period, or def when none is set
+func (r *refreshInterval) every(def time.Duration) time.Duration {
+	if d := time.Duration(r.d.Load()); d > 0 {
+		return d
+	}
+	return def
+}
+
+// StoreInterface defines the analytics store contract. Queries fail with
+// ErrNotReady before the first data load, and with ErrQueryTimeout or ErrBusy
+// when the backend gives up on them.
 type StoreInterface interface {
 	Close() error
+	Status() StoreStatus
+	// OnRefresh adds a callback run in the background after each successful data refresh
+	OnRefresh(fn func())
+	// SetRefreshInterval changes how often data is reloaded, from the next refresh on;
+	// d <= 0 restores the backend default
+	SetRefreshInterval(d time.Duration)
+	// EraseVisitor deletes the stored events of visitorID on domain and the
+	// aliases of ctx (see AliasContext) and returns how many there were; loads
+	// leave out the visitors of the store's Tombstones
+	EraseVisitor(ctx context.Context, domain, visitorID string) (int64, error)
+	// GetDataGaps returns the hours of domain's loaded data that look missing,
+	// from counts recorded after each load; it doesn't query
+	GetDataGaps(ctx context.Context, domain string, from, to time.Time) ([]DataGap, error)
+	// GetFreshness returns how current domain's queryable data is, from
+	// watermarks recorded after each load and buffer flush; it doesn't query
+	GetFreshness(ctx context.Context, domain string) (Freshness, error)
+	GetActiveDomains(ctx context.Context, since time.Time, limit int) ([]string, error)
+	// GetFirstEventAt returns when the earliest stored event of domain happened,
+	// or ErrDomainUnknown when it has none; it ignores filters and is cheap to call
+	GetFirstEventAt(ctx context.Context, domain string) (time.Time, error)
+	// GetDimensionValues returns the most common non-empty values of a whitelisted column
+	GetDimensionValues(ctx context.Context, domain, column string, from, to time.Time, limit int) ([]TopItem, error)
 	GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error)
 	GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error)
+	// GetActivity counts pageviews and visitors per step from from in one
+	// read, leaving out steps without events; spam is excluded as in GetOverview
+	GetActivity(ctx context.Context, domain string, from, to time.Time, step time.Duration) ([]ActivityBucket, error)
 	GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
 	GetTopSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
+	// GetSourceBuckets returns the same top sources as GetTopSources with
+	// Direct (tagged) split by utm_medium, for classifying channels
+	GetSourceBuckets(ctx context.Context, domain string, from, to time.Time, limit int) ([]SourceBucket, error)
+	// GetTopReferrerURLs returns up to limit referrer URLs per source host, query
+	// strings stripped; internal and empty referrers are left out
+	GetTopReferrerURLs(ctx context.Context, domain string, from, to time.Time, limit int) ([]ReferrerURLItem, error)
+	// GetSearchEngines returns organic search pageviews and visitors per known engine
+	GetSearchEngines(ctx context.Context, domain string, from, to time.Time, limit int) ([]SearchEngineItem, error)
 	GetTopBrowsers(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
 	GetTopCountries(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
 	GetTopDevices(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
+	// GetTopLanguages counts pageviews by the primary subtag of the lang prop
+	GetTopLanguages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
+	// GetScreenSizes counts pageviews by viewport_w prop bucket, narrowest first
+	GetScreenSizes(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error)
+	// GetCountryMap returns pageviews and visitors per upper-cased country value
+	GetCountryMap(ctx context.Context, domain string, from, to time.Time) ([]GeoItem, error)
+	// GetTopRegions returns pageviews and visitors per ISO 3166-2 code of the
+	// region prop within country, which must be an upper-case alpha-2 code
+	GetTopRegions(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error)
+	// GetTopCities returns pageviews and visitors per city within country
+	GetTopCities(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error)
+	// GetDomainMismatches returns the page hosts of domain's events that don't
+	// match it, for spotting the snippet on unrelated sites; it ignores filters
+	GetDomainMismatches(ctx context.Context, domain string, subdomains bool, from, to time.Time, limit int) ([]HostnameItem, error)
 	GetTopUTMSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
 	GetTopUTMMediums(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
 	GetTopUTMCampaigns(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
-	GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]EventItem, error)
-	GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error)
+	// GetRecentEvents and StreamRecentEvents read only the columns of fields
+	GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields) ([]EventItem, error)
+	StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields, fn func(EventItem) error) error
+	// GetEvent returns the event with an EventItem.ID and its full props, or nil
+	GetEvent(ctx context.Context, domain, id string) (*EventItem, error)
+	GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]EventBreakdownItem, error)
+	// GetEventCardinality counts the distinct event names and the events of a range
+	GetEventCardinality(ctx context.Context, domain string, from, to time.Time) (EventCardinality, error)
 	GetUniquePages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error)
 	GetFunnel(ctx context.Context, domain string, from, to time.Time, steps []string) (*FunnelResult, error)
-	GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []FunnelStepDef, windowMinutes int) (*FunnelResult, error)
+	GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, windowMinutes int) (*FunnelResult, error)
+	// GetStepMatchCounts counts the events matching each of steps in one read,
+	// whatever funnels they belong to; event steps match on the name alone
+	GetStepMatchCounts(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step) ([]int64, error)
+	GetErrorPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]ErrorPage, error)
+	// GetCampaignConversions adds each campaign's revenue when ctx asks for
+	// revenue on goal's event; see withRevenue
+	GetCampaignConversions(ctx context.Context, domain string, goal funnel.Step, from, to time.Time, opts CampaignOptions, limit int) ([]CampaignConversion, error)
+	// GetRevenue sums the revenue of the purchase events of a range, hour by
+	// hour, converted into one currency; see withRevenue
+	GetRevenue(ctx context.Context, domain string, from, to time.Time) (*Revenue, error)
 	GetAutocaptureEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]AutocaptureEvent, error)
 }
@@ -0,0 +1,1650 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+	"github.com/shortid/clickresearch-stats/internal/stats/aggregate"
+)
+
+// postgresEventsTable is the events table migrations/027_create_events.sql creates
+const postgresEventsTable = "clickresearch_events"
+
+// postgresEventColumns are the columns Write copies events into
+var postgresEventColumns = []string{
+	"domain", "visitor_id", "name", "url", "pathname", "referrer", "timestamp", "props",
+	"browser", "browser_version", "os", "os_version", "device", "country", "city",
+	"utm_source", "utm_medium", "utm_campaign", "received_at",
+}
+
+// postgresEventLimit is how many events PostgresStore stays responsive to;
+// Status reports it next to the count
+const postgresEventLimit = 5_000_000
+
+// PostgresStore keeps events in one Postgres table, written event by event by
+// the ingestion buffer and queried in place. It suits a single small site:
+// queries scan the range of the (domain, timestamp) index, which stays fast up
+// to postgresEventLimit events.
+type PostgresStore struct {
+	db     *sql.DB
+	stopCh chan struct{}
+	// eventNames maps names outside project allow-lists to OtherEventName on write
+	eventNames *EventNameRules
+	// tombstones are the erased visitors writes leave out
+	tombstones *Tombstones
+	// overrides corrects values of categorical columns in scanned rows
+	overrides *ValueOverrides
+	// timestamps clamps skewed timestamps on write and may exclude future ones from queries
+	timestamps TimestampRules
+
+	statusMu    sync.Mutex
+	lastRefresh time.Time
+	lastErr     string
+	// scannedID is the id of the last event refreshes counted into events,
+	// clampedEvents and the watermarks; 0 has the next refresh count the whole
+	// table again. These and futureEvents are guarded by statusMu.
+	scannedID                           int64
+	events, clampedEvents, futureEvents int64
+	onRefresh                           []func()
+	retry                               refreshRetrier
+
+	refreshInterval
+	hourlyCounts
+	watermarks
+}
+
+type PostgresConfig struct {
+	// DatabaseURL is the connection string of the database holding the events table
+	DatabaseURL string
+	// EventNames holds the project allow-lists applied when events are written; optional
+	EventNames *EventNameRules
+	// Tombstones holds the erased visitors left out when events are written; optional
+	Tombstones *Tombstones
+	// Overrides holds the admin value override rules applied to reports; optional
+	Overrides *ValueOverrides
+	// Gaps tunes the data gaps GetDataGaps reports; zero fields use DefaultGapThresholds
+	Gaps GapThresholds
+	// Timestamps sanitizes event timestamps from skewed client clocks
+	Timestamps TimestampRules
+}
+
+func NewPostgresStore(cfg PostgresConfig) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres: %w", err)
+	}
+	if err := checkPostgresEvents(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Printf("Postgres: connected, events in %s", postgresEventsTable)
+
+	s := &PostgresStore{
+		db:     db,
+		stopCh: make(chan struct{}),
+
+		eventNames: cfg.EventNames,
+		tombstones: cfg.Tombstones,
+		overrides:  cfg.Overrides,
+		timestamps: cfg.Timestamps,
+	}
+	s.gapThresholds = cfg.Gaps
+
+	// Events are queryable once written; refreshes only record what Status,
+	// GetDataGaps and GetFreshness report
+	err = s.refresh()
+	if err != nil {
+		log.Printf("Warning: initial Postgres refresh failed: %v", err)
+	}
+	go s.refreshLoop(err)
+
+	return s, nil
+}
+
+// checkPostgresEvents pings db and makes sure it has the events table
+func checkPostgresEvents(ctx context.Context, db *sql.DB) error {
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping postgres: %w", err)
+	}
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", postgresEventsTable).Scan(&exists); err != nil {
+		return fmt.Errorf("looking up %s: %w", postgresEventsTable, err)
+	}
+	if !exists {
+		return fmt.Errorf("table %s is missing; run migrations/027_create_events.sql", postgresEventsTable)
+	}
+	return nil
+}
+
+// refreshLoop refreshes every minute by default, backing off while refreshes
+// fail; err is the outcome of the initial refresh
+func (s *PostgresStore) refreshLoop(err error) {
+	timer := time.NewTimer(s.retry.schedule(s.every(time.Minute), err))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			log.Println("Postgres: refresh loop stopped")
+			return
+		case <-timer.C:
+			err := s.refresh()
+			wait := s.retry.schedule(s.every(time.Minute), err)
+			if err != nil {
+				log.Printf("Postgres: refresh error, next attempt in %v: %v", wait.Round(time.Second), err)
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// refresh records the hourly counts, event counts and watermarks of the
+// events table, then the outcome for Status. Every query reads an index range,
+// so refreshes stay cheap as the table grows.
+func (s *PostgresStore) refresh() error {
+	ctx := context.Background()
+	err := s.recordHourlyCounts(ctx)
+	if err == nil {
+		err = s.recordNewEvents(ctx)
+	}
+	if err == nil {
+		err = s.recordFutureEvents(ctx)
+	}
+
+	s.statusMu.Lock()
+	if err != nil {
+		s.lastErr = err.Error()
+	} else {
+		s.lastRefresh = time.Now()
+		s.lastErr = ""
+	}
+	onRefresh := s.onRefresh
+	s.statusMu.Unlock()
+
+	if err == nil {
+		for _, fn := range onRefresh {
+			go fn()
+		}
+	}
+	return err
+}
+
+// recordHourlyCounts records each domain's events per hour of the last
+// dataGapWindow, for GetDataGaps
+func (s *PostgresStore) recordHourlyCounts(ctx context.Context) error {
+	until := time.Now().UTC().Truncate(time.Hour)
+	since := until.Add(-dataGapWindow)
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT domain, date_trunc('hour', timestamp AT TIME ZONE 'UTC') AS hour, count(*)
+		FROM %s
+		WHERE timestamp >= $1 AND timestamp < $2
+		GROUP BY 1, 2
+	`, postgresEventsTable), since, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	hours := make(map[string]map[time.Time]int64)
+	for rows.Next() {
+		var domain string
+		var hour time.Time
+		var n int64
+		if err := rows.Scan(&domain, &hour, &n); err != nil {
+			return err
+		}
+		if hours[domain] == nil {
+			hours[domain] = make(map[time.Time]int64)
+		}
+		hours[domain][hour.UTC()] = n
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.recordHours(hours, since, until)
+	return nil
+}
+
+// recordNewEvents adds the events written since the last refresh to the
+// event and clamped counts and raises the watermarks of their domains, for
+// Status and GetFreshness. The ingestion buffer writes one batch at a time, so
+// ids grow in commit order and no event is passed over.
+func (s *PostgresStore) recordNewEvents(ctx context.Context) error {
+	s.statusMu.Lock()
+	after := s.scannedID
+	s.statusMu.Unlock()
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT domain, max(id), count(*),
+			count(*) FILTER (WHERE strpos(props::text, '"%s"') > 0),
+			max(received_at)
+		FROM %s
+		WHERE id > $1
+		GROUP BY domain
+	`, originalTimestampProp, postgresEventsTable), after)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	last := after
+	var events, clamped int64
+	marks := make(map[string]time.Time)
+	for rows.Next() {
+		var domain string
+		var id, n, c int64
+		var at sql.NullTime
+		if err := rows.Scan(&domain, &id, &n, &c, &at); err != nil {
+			return err
+		}
+		last, events, clamped = max(last, id), events+n, clamped+c
+		if at.Valid {
+			marks[domain] = at.Time.UTC()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	switch {
+	case s.scannedID != after:
+		// An erasure started the count over meanwhile
+		return nil
+	case after == 0:
+		s.events, s.clampedEvents = events, clamped
+		s.recordMarks(marks)
+	default:
+		s.events += events
+		s.clampedEvents += clamped
+		s.raiseMarks(marks)
+	}
+	s.scannedID = last
+	return nil
+}
+
+// recordFutureEvents counts the events table's future-dated events for Status
+func (s *PostgresStore) recordFutureEvents(ctx context.Context) error {
+	var future int64
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*) FROM %s WHERE timestamp >= $1`, postgresEventsTable),
+		futureCutoff(time.Now())).Scan(&future)
+	if err != nil {
+		return err
+	}
+	s.statusMu.Lock()
+	s.futureEvents = future
+	s.statusMu.Unlock()
+	return nil
+}
+
+// OnRefresh adds fn to the callbacks run in the background after each successful refresh
+func (s *PostgresStore) OnRefresh(fn func()) {
+	s.statusMu.Lock()
+	s.onRefresh = append(s.onRefresh, fn)
+	s.statusMu.Unlock()
+}
+
+// Status reports the last refresh; the store is ready once it is connected
+func (s *PostgresStore) Status() StoreStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	st := StoreStatus{
+		Backend:   "postgres",
+		Ready:     true,
+		LastError: s.lastErr,
+
+		ClampedEvents: s.clampedEvents,
+		FutureEvents:  s.futureEvents,
+		Events:        s.events,
+		EventLimit:    postgresEventLimit,
+	}
+	if !s.lastRefresh.IsZero() {
+		st.LastRefresh = s.lastRefresh.UTC().Format(time.RFC3339)
+	}
+	s.retry.status(&st)
+	return st
+}
+
+// GetFreshness returns how current domain's data in the events table is
+func (s *PostgresStore) GetFreshness(ctx context.Context, domain string) (Freshness, error) {
+	return s.freshness(queryDomains(ctx, domain), s.Status()), nil
+}
+
+func (s *PostgresStore) Close() error {
+	close(s.stopCh)
+	return s.db.Close()
+}
+
+// postgresEvent is an event as the ingestion buffer hands it to Write
+type postgresEvent struct {
+	Domain         string          `json:"domain"`
+	VisitorID      string          `json:"visitor_id"`
+	Name           string          `json:"name"`
+	URL            string          `json:"url"`
+	Pathname       string          `json:"pathname"`
+	Referrer       string          `json:"referrer"`
+	Timestamp      time.Time       `json:"timestamp"`
+	Props          json.RawMessage `json:"props"`
+	Browser        string          `json:"browser"`
+	BrowserVersion string          `json:"browser_version"`
+	OS             string          `json:"os"`
+	OSVersion      string          `json:"os_version"`
+	Device         string          `json:"device"`
+	Country        string          `json:"country"`
+	City           string          `json:"city"`
+	UTMSource      string          `json:"utm_source"`
+	UTMMedium      string          `json:"utm_medium"`
+	UTMCampaign    string          `json:"utm_campaign"`
+	ReceivedAt     time.Time       `json:"received_at"`
+}
+
+// Write copies batch into the events table, applying on the way what DuckDB
+// and ClickHouse apply when loading parquet: tombstoned visitors are left out,
+// names outside allow-lists become OtherEventName, oversized fields are cut,
+// devices normalized and skewed timestamps clamped. Malformed events and
+// events without a domain are dropped. It implements ingest.Sink.
+func (s *PostgresStore) Write(ctx context.Context, batch []json.RawMessage) error {
+	now := time.Now().UTC()
+	rows := make([][]any, 0, len(batch))
+	marks := make(map[string]time.Time)
+	for _, raw := range batch {
+		var e postgresEvent
+		if err := json.Unmarshal(raw, &e); err != nil || e.Domain == "" {
+			continue
+		}
+		if s.tombstones.erased(e.Domain, e.VisitorID) {
+			continue
+		}
+		row := e.row(s.eventNames, s.timestamps.skew(), now)
+		rows = append(rows, row)
+		if at := row[len(row)-1].(time.Time); at.After(marks[e.Domain]) {
+			marks[e.Domain] = at
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(postgresEventsTable, postgresEventColumns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.raiseMarks(marks)
+	return nil
+}
+
+// row is e as the values of postgresEventColumns. Events without received_at
+// count as received at now.
+func (e postgresEvent) row(names *EventNameRules, skew time.Duration, now time.Time) []any {
+	receivedAt := e.ReceivedAt.UTC()
+	if receivedAt.IsZero() {
+		receivedAt = now
+	}
+	ts := e.Timestamp.UTC()
+	if ts.IsZero() {
+		ts = receivedAt
+	}
+
+	name, props := e.Name, postgresProps(e.Props)
+	if names.unknownName(e.Domain, name) {
+		if !strings.HasPrefix(props, "{") {
+			props = "{}"
+		}
+		props, name = withProp(props, originalNameProp, name), OtherEventName
+	}
+	if len(props) > maxStoredPropsLen {
+		props = "{}"
+	}
+	if skew > 0 && (ts.After(receivedAt.Add(skew)) || ts.Before(receivedAt.Add(-skew))) {
+		if strings.HasPrefix(props, "{") {
+			props = withProp(props, originalTimestampProp, ts.Format("2006-01-02T15:04:05Z"))
+		}
+		if ts.After(receivedAt) {
+			ts = receivedAt.Add(skew)
+		} else {
+			ts = receivedAt.Add(-skew)
+		}
+	}
+
+	return []any{
+		postgresText(e.Domain), postgresText(e.VisitorID), postgresText(name),
+		postgresText(leftRunes(e.URL, maxStoredFieldLen)),
+		postgresText(leftRunes(e.Pathname, maxStoredFieldLen)),
+		postgresText(leftRunes(e.Referrer, maxStoredFieldLen)),
+		ts, props,
+		postgresText(e.Browser), postgresText(e.BrowserVersion), postgresText(e.OS), postgresText(e.OSVersion),
+		aggregate.NormalizeDevice(e.Device), postgresText(e.Country), postgresText(e.City),
+		postgresText(e.UTMSource), postgresText(e.UTMMedium), postgresText(e.UTMCampaign),
+		receivedAt,
+	}
+}
+
+// postgresProps is the props of an event, which the tracker sends as a JSON
+// object or a string holding one, trimmed. The json column only takes valid
+// JSON, so anything else is stored as {}.
+func postgresProps(raw json.RawMessage) string {
+	var props string
+	if err := json.Unmarshal(raw, &props); err != nil {
+		props = string(raw)
+	}
+	props = strings.TrimSpace(postgresText(props))
+	if props == "" || props == "null" || !json.Valid([]byte(props)) {
+		return "{}"
+	}
+	return props
+}
+
+// withProp adds key with the string value to the front of props, a JSON object
+func withProp(props, key, value string) string {
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+	rest := strings.TrimSpace(strings.TrimPrefix(props, "{"))
+	if strings.HasPrefix(rest, "}") {
+		return "{" + string(k) + ":" + string(v) + "}"
+	}
+	return "{" + string(k) + ":" + string(v) + "," + rest
+}
+
+// postgresText is s without what text columns refuse: NUL bytes and invalid UTF-8
+func postgresText(s string) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(s, "\x00", ""), "�")
+}
+
+// leftRunes is s cut to its first n runes, like SQL left()
+func leftRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// postgresEndsWith holds when the string expression s ends with suffix
+func postgresEndsWith(s, suffix string) string {
+	return fmt.Sprintf("right(%s, length(%s)) = %s", s, suffix, suffix)
+}
+
+// postgresTryDouble casts the text expression expr to a double, or NULL when
+// it isn't a finite number, like DuckDB's TRY_CAST
+func postgresTryDouble(expr string) string {
+	return fmt.Sprintf(`CASE WHEN trim(%[1]s) ~ '^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]{1,3})?$' THEN CASE WHEN abs(trim(%[1]s)::numeric) < 1e300 THEN trim(%[1]s)::double precision END END`, expr)
+}
+
+// postgresTimestamp renders t as a timestamptz literal
+func postgresTimestamp(t time.Time) string {
+	return "'" + t.UTC().Format("2006-01-02 15:04:05.999999") + "+00'::timestamptz"
+}
+
+// postgresTimeRange renders a condition on the timestamp column for from..to, to exclusive
+func postgresTimeRange(from, to time.Time) string {
+	return fmt.Sprintf("timestamp >= %s AND timestamp < %s", postgresTimestamp(from), postgresTimestamp(to))
+}
+
+// postgresNormalizedPath is duckdbNormalizedPath, whose functions Postgres has too
+const postgresNormalizedPath = duckdbNormalizedPath
+
+// postgresErrorCondition matches error events and pageviews with a 4xx/5xx status prop
+var postgresErrorCondition = `(name = 'error' OR (name = 'pageview' AND ` + postgresTryDouble(`props->>'status'`) + ` BETWEEN 400 AND 599))`
+
+// source is the events table queries read, without future-dated events when
+// the timestamp rules exclude them
+func (s *PostgresStore) source() string {
+	if !s.timestamps.ExcludeFuture {
+		return postgresEventsTable
+	}
+	return fmt.Sprintf("(SELECT * FROM %s WHERE %s) AS events", postgresEventsTable, postgresFutureCondition(time.Now()))
+}
+
+// EraseVisitor deletes the events of visitorID on domain and the aliases of
+// ctx and returns how many there were. Add the visitor to the tombstones first, so buffered events of the
+// visitor aren't written afterwards.
+func (s *PostgresStore) EraseVisitor(ctx context.Context, domain, visitorID string) (int64, error) {
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE domain = ANY($1) AND visitor_id = $2`, postgresEventsTable), postgresDomains(ctx, domain), visitorID)
+	if err != nil {
+		return 0, storeError(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if n > 0 {
+		// The deleted events may be counted; the next refresh counts anew
+		s.statusMu.Lock()
+		s.scannedID = 0
+		s.statusMu.Unlock()
+	}
+	return n, err
+}
+
+// GetDimensionValues returns the most common non-empty values of column, which
+// must come from a whitelist. Values longer than a filter accepts are skipped.
+func (s *PostgresStore) GetDimensionValues(ctx context.Context, domain, column string, from, to time.Time, limit int) ([]TopItem, error) {
+	query := fmt.Sprintf(`
+		SELECT %[1]s as name, COUNT(*) as count
+		FROM %[2]s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+		AND COALESCE(%[1]s, '') <> ''
+		AND length(%[1]s) <= %[3]d
+		GROUP BY 1
+		ORDER BY count DESC, name
+		LIMIT $4
+	`, column, s.source(), maxFilterValueLen)
+
+	rows, err := s.queryContext(ctx, query, postgresDomains(ctx, domain), from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTopItems(rows)
+}
+
+// GetActiveDomains returns domains with events since since, busiest first
+func (s *PostgresStore) GetActiveDomains(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	rows, err := s.queryContext(ctx, fmt.Sprintf(`
+		SELECT domain
+		FROM %s
+		WHERE timestamp >= $1
+		GROUP BY domain
+		ORDER BY COUNT(*) DESC
+		LIMIT $2
+	`, s.source()), since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// GetFirstEventAt returns the time of domain's earliest event, read from the
+// (domain, timestamp) index
+func (s *PostgresStore) GetFirstEventAt(ctx context.Context, domain string) (time.Time, error) {
+	var first sql.NullTime
+	err := s.queryRowContext(ctx, fmt.Sprintf(`
+		SELECT MIN(timestamp)
+		FROM %s
+		WHERE domain = ANY($1)
+	`, s.source()), postgresDomains(ctx, domain)).Scan(&first)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !first.Valid {
+		return time.Time{}, ErrDomainUnknown
+	}
+	return first.Time.UTC(), nil
+}
+
+func (s *PostgresStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(4)
+	spam, spamArgs := postgresSpamExpr(ctx, 4+len(filterArgs))
+	if spam == "" {
+		spam = "false"
+	}
+	consent := postgresConsentCondition(ctx)
+	if consent == "" {
+		consent = "true"
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			COUNT(*) FILTER (WHERE name = 'pageview' AND NOT (%[3]s)) as pageviews,
+			COUNT(DISTINCT visitor_id) FILTER (WHERE NOT (%[3]s) AND %[4]s) as unique_visitors,
+			COUNT(*) FILTER (WHERE NOT (%[3]s)) as events,
+			COUNT(*) FILTER (WHERE %[3]s) as excluded_spam
+		FROM %[1]s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+		%[2]s
+	`, s.source(), filterClause, spam, consent)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to}, filterArgs...)
+	args = append(args, spamArgs...)
+	var o Overview
+	err := s.queryRowContext(ctx, query, args...).Scan(
+		&o.Pageviews, &o.UniqueVisitors, &o.Events, &o.ExcludedSpam,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (s *PostgresStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(4)
+	dateFormat := "date_trunc('day', timestamp AT TIME ZONE 'UTC')"
+	if interval == "hour" {
+		dateFormat = "date_trunc('hour', timestamp AT TIME ZONE 'UTC')"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			%s as time_bucket,
+			COUNT(*) as count
+		FROM %s
+		WHERE domain = ANY($1)
+		AND name = 'pageview'
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		GROUP BY time_bucket
+		ORDER BY time_bucket
+	`, dateFormat, s.source(), filterClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []TimeSeriesPoint
+	for rows.Next() {
+		var t time.Time
+		var count int64
+		if err := rows.Scan(&t, &count); err != nil {
+			continue
+		}
+		format := "2006-01-02"
+		if interval == "hour" {
+			format = "2006-01-02T15:00"
+		}
+		result = append(result, TimeSeriesPoint{Time: t.Format(format), Value: count})
+	}
+	return result, nil
+}
+
+func (s *PostgresStore) GetActivity(ctx context.Context, domain string, from, to time.Time, step time.Duration) ([]ActivityBucket, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(4)
+	spam, spamArgs := postgresSpamExpr(ctx, 4+len(filterArgs))
+	if spam == "" {
+		spam = "false"
+	}
+	consent := postgresConsentCondition(ctx)
+	if consent == "" {
+		consent = "true"
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			floor(extract(epoch FROM timestamp - $2::timestamptz) * 1000000 / %[5]d)::bigint as step,
+			COUNT(*) FILTER (WHERE name = 'pageview' AND NOT (%[3]s)) as pageviews,
+			COUNT(DISTINCT visitor_id) FILTER (WHERE NOT (%[3]s) AND %[4]s) as unique_visitors
+		FROM %[1]s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+		%[2]s
+		GROUP BY step
+		ORDER BY step
+	`, s.source(), filterClause, spam, consent, step.Microseconds())
+
+	args := append([]any{postgresDomains(ctx, domain), from, to}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, append(args, spamArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ActivityBucket
+	for rows.Next() {
+		var i int64
+		var b ActivityBucket
+		if err := rows.Scan(&i, &b.Pageviews, &b.UniqueVisitors); err != nil {
+			return nil, err
+		}
+		b.Start = from.Add(time.Duration(i) * step)
+		result = append(result, b)
+	}
+	return result, rows.Err()
+}
+
+func (s *PostgresStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopBy(ctx, postgresPathExpr("pathname"), "pageview", domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetTopSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	rows, err := s.sourceRows(ctx, domain, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return topSources(bucketSources(ctx, rows, limit)), nil
+}
+
+func (s *PostgresStore) GetSourceBuckets(ctx context.Context, domain string, from, to time.Time, limit int) ([]SourceBucket, error) {
+	rows, err := s.sourceRows(ctx, domain, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return bucketSources(ctx, rows, limit), nil
+}
+
+// sourceRows counts pageviews by referrer source and UTM values for bucketSources
+func (s *PostgresStore) sourceRows(ctx context.Context, domain string, from, to time.Time) ([]sourceRow, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(4)
+	spamClause, spamArgs := postgresSpamExpr(ctx, 4+len(filterArgs))
+	if spamClause != "" {
+		spamClause = "AND NOT " + spamClause
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			%s as source,
+			utm_source,
+			utm_medium,
+			COUNT(*) as count
+		FROM %s
+		WHERE domain = ANY($1)
+		AND name = 'pageview'
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		%s
+		GROUP BY 1, 2, 3
+	`, postgresReferrerSourceExpr, s.source(), filterClause, spamClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to}, filterArgs...)
+	args = append(args, spamArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []sourceRow
+	for rows.Next() {
+		var row sourceRow
+		if err := rows.Scan(&row.Source, &row.UTMSource, &row.UTMMedium, &row.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (s *PostgresStore) GetTopReferrerURLs(ctx context.Context, domain string, from, to time.Time, limit int) ([]ReferrerURLItem, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	spamClause, spamArgs := postgresSpamExpr(ctx, 5+len(filterArgs))
+	if spamClause != "" {
+		spamClause = "AND NOT " + spamClause
+	}
+	query := fmt.Sprintf(`
+		SELECT source, url, count
+		FROM (
+			SELECT source, url, COUNT(*) as count,
+				row_number() OVER (PARTITION BY source ORDER BY COUNT(*) DESC, url) as url_rank
+			FROM (
+				SELECT %s as source, %s as url
+				FROM %s
+				WHERE domain = ANY($1)
+				AND name = 'pageview'
+				AND timestamp >= $2
+				AND timestamp < $3
+				%s
+				%s
+			) AS scoped
+			WHERE source <> ''
+			GROUP BY source, url
+		) AS ranked
+		WHERE url_rank <= $4
+		ORDER BY count DESC, url
+	`, postgresReferrerSourceExpr, postgresReferrerURLExpr, s.source(), filterClause, spamClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, limit}, filterArgs...)
+	args = append(args, spamArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ReferrerURLItem
+	for rows.Next() {
+		var item ReferrerURLItem
+		if err := rows.Scan(&item.Source, &item.URL, &item.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// GetSearchEngines returns pageviews and visitors per search engine, busiest first
+func (s *PostgresStore) GetSearchEngines(ctx context.Context, domain string, from, to time.Time, limit int) ([]SearchEngineItem, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	query := fmt.Sprintf(`
+		SELECT engine, COUNT(*) as pageviews, COUNT(DISTINCT visitor_id) as visitors
+		FROM (
+			SELECT %s as engine, visitor_id
+			FROM %s
+			WHERE domain = ANY($1)
+			AND name = 'pageview'
+			AND timestamp >= $2
+			AND timestamp < $3
+			%s
+		) AS scoped
+		WHERE engine <> ''
+		GROUP BY engine
+		ORDER BY pageviews DESC, engine
+		LIMIT $4
+	`, postgresSearchEngineExpr("referrer"), s.source(), filterClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []SearchEngineItem
+	for rows.Next() {
+		var item SearchEngineItem
+		if err := rows.Scan(&item.Engine, &item.Pageviews, &item.Visitors); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+func (s *PostgresStore) GetCountryMap(ctx context.Context, domain string, from, to time.Time) ([]GeoItem, error) {
+	return s.geoBreakdown(ctx, postgresCountryCodeExpr, "", domain, from, to, geoMapLimit)
+}
+
+func (s *PostgresStore) GetTopRegions(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	where := fmt.Sprintf("AND %s = %s", postgresCountryCodeExpr, postgresQuote(country))
+	return s.geoBreakdown(ctx, postgresRegionExpr(country), where, domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetTopCities(ctx context.Context, domain, country string, from, to time.Time, limit int) ([]GeoItem, error) {
+	where := fmt.Sprintf("AND %s = %s", postgresCountryCodeExpr, postgresQuote(country))
+	items, err := s.geoBreakdown(ctx, `trim(COALESCE(city, ''))`, where, domain, from, to, limit)
+	return geoNames(items), err
+}
+
+// geoBreakdown counts pageviews and visitors by the non-empty values of expr,
+// busiest first; where adds conditions on the scanned events
+func (s *PostgresStore) geoBreakdown(ctx context.Context, expr, where, domain string, from, to time.Time, limit int) ([]GeoItem, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	propClause, propArgs := postgresPropClause(ctx, 5+len(filterArgs))
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	query := fmt.Sprintf(`
+		SELECT code, COUNT(*) as pageviews, COUNT(DISTINCT visitor_id) as visitors
+		FROM (
+			SELECT %s as code, visitor_id
+			FROM %s
+			WHERE domain = ANY($1)
+			AND name = 'pageview'
+			AND timestamp >= $2
+			AND timestamp < $3
+			%s
+			%s
+		) AS scoped
+		WHERE code <> ''
+		GROUP BY code
+		ORDER BY pageviews DESC, code
+		LIMIT $4
+	`, expr, s.source(), where, filterClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []GeoItem
+	for rows.Next() {
+		var item GeoItem
+		if err := rows.Scan(&item.Code, &item.Count, &item.Visitors); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// GetDomainMismatches returns the page hosts of domain's events that aren't
+// the domain itself (nor, with subdomains, one of its subdomains), busiest first
+func (s *PostgresStore) GetDomainMismatches(ctx context.Context, domain string, subdomains bool, from, to time.Time, limit int) ([]HostnameItem, error) {
+	scope := hostScope{domain: NormalizeHost(domain), subdomains: subdomains}
+	query := fmt.Sprintf(`
+		SELECT %[1]s as hostname, COUNT(*) as events, MAX(timestamp) as last_seen
+		FROM %[2]s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+		AND NOT %[3]s
+		GROUP BY 1
+		ORDER BY events DESC, hostname
+		LIMIT $4
+	`, postgresURLHostExpr, s.source(), scope.postgresCondition())
+
+	rows, err := s.queryContext(ctx, query, postgresDomains(ctx, domain), from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []HostnameItem
+	for rows.Next() {
+		var item HostnameItem
+		var lastSeen time.Time
+		if err := rows.Scan(&item.Hostname, &item.Events, &lastSeen); err != nil {
+			return nil, err
+		}
+		item.LastSeen = lastSeen.UTC().Format(time.RFC3339)
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+func (s *PostgresStore) GetTopBrowsers(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopBy(ctx, "browser", "", domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetTopCountries(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopBy(ctx, "country", "", domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetTopDevices(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopBy(ctx, "device", "", domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetTopLanguages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopByExpr(ctx, "language", postgresLanguageExpr, "pageview", domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetScreenSizes(ctx context.Context, domain string, from, to time.Time) ([]TopItem, error) {
+	items, err := s.getTopByExpr(ctx, "screen", postgresScreenExpr, "pageview", domain, from, to, len(screenBuckets)+1)
+	return sortScreenBuckets(items), err
+}
+
+// UTM stats
+func (s *PostgresStore) GetTopUTMSources(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopByNonEmpty(ctx, "utm_source", "pageview", domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetTopUTMMediums(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopByNonEmpty(ctx, "utm_medium", "pageview", domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetTopUTMCampaigns(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopByNonEmpty(ctx, "utm_campaign", "pageview", domain, from, to, limit)
+}
+
+// getTopByNonEmpty excludes empty/null values (for UTM params)
+func (s *PostgresStore) getTopByNonEmpty(ctx context.Context, field, eventFilter, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	eventClause := ""
+	if eventFilter != "" {
+		eventClause = fmt.Sprintf("AND name = '%s'", eventFilter)
+	}
+
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	query := fmt.Sprintf(`
+		SELECT
+			%s as name,
+			COUNT(*) as count
+		FROM %s
+		WHERE domain = ANY($1)
+		%s
+		AND %s IS NOT NULL AND %s != ''
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		GROUP BY 1
+		ORDER BY count DESC
+		LIMIT $4
+	`, field, s.source(), eventClause, field, field, filterClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTopItems(rows)
+}
+
+func (s *PostgresStore) getTopBy(ctx context.Context, field, eventFilter, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.getTopByExpr(ctx, field, field, eventFilter, domain, from, to, limit)
+}
+
+// getTopByExpr counts events by the SQL expression expr, labeling the values as dimension
+func (s *PostgresStore) getTopByExpr(ctx context.Context, dimension, expr, eventFilter, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	eventClause := ""
+	if eventFilter != "" {
+		eventClause = fmt.Sprintf("AND name = '%s'", eventFilter)
+	}
+
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	propClause, propArgs := postgresPropClause(ctx, 5+len(filterArgs))
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	overrides := s.overrides.forColumn(domain, dimension, from, to)
+	// Overrides match stored values, so only rows without them group by label
+	if len(overrides) == 0 {
+		expr = postgresLabelExpr(dimension, expr)
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			COALESCE(%s, '') as name,
+			(%s)::BIGINT as override_mask,
+			COUNT(*) as count,
+			COUNT(*) OVER () as total_groups
+		FROM %s
+		WHERE domain = ANY($1)
+		%s
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		GROUP BY 1, 2
+		ORDER BY count DESC
+		LIMIT $4
+	`, expr, overrides.maskExpr(postgresTimeRange), s.source(), eventClause, filterClause)
+
+	return labelledTopItems(ctx, dimension, overrides, limit, func(n int) ([]maskedItem, int64, error) {
+		args := append([]any{postgresDomains(ctx, domain), from, to, n}, filterArgs...)
+		rows, err := s.queryContext(ctx, query, args...)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer rows.Close()
+
+		var items []maskedItem
+		var groups int64
+		for rows.Next() {
+			var item maskedItem
+			if err := rows.Scan(&item.name, &item.mask, &item.count, &groups); err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+		}
+		return items, groups, rows.Err()
+	})
+}
+
+func (s *PostgresStore) GetErrorPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]ErrorPage, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	query := fmt.Sprintf(`
+		SELECT
+			%s as path,
+			COUNT(*) as count,
+			COUNT(DISTINCT visitor_id) as unique_visitors
+		FROM %s
+		WHERE domain = ANY($1)
+		AND %s
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		GROUP BY 1
+		ORDER BY count DESC
+		LIMIT $4
+	`, postgresPathExpr(postgresNormalizedPath), s.source(), postgresErrorCondition, filterClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ErrorPage
+	for rows.Next() {
+		var p ErrorPage
+		if err := rows.Scan(&p.Path, &p.Count, &p.UniqueVisitors); err != nil {
+			continue
+		}
+		result = append(result, p)
+	}
+	rows.Close()
+
+	if len(result) == 0 {
+		return result, nil
+	}
+
+	// Referrers are cleaned in Go so internal and direct hits collapse the same way as top sources
+	filterClause, filterArgs = filtersFromContext(ctx).postgresClause(4)
+	refQuery := fmt.Sprintf(`
+		SELECT
+			%s as path,
+			COALESCE(referrer, '') as referrer,
+			COUNT(*) as count
+		FROM %s
+		WHERE domain = ANY($1)
+		AND %s
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		GROUP BY 1, 2
+	`, postgresPathExpr(postgresNormalizedPath), s.source(), postgresErrorCondition, filterClause)
+
+	args = append([]any{postgresDomains(ctx, domain), from, to}, filterArgs...)
+	refRows, err := s.queryContext(ctx, refQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer refRows.Close()
+
+	var refs []referrerCount
+	for refRows.Next() {
+		var rc referrerCount
+		if err := refRows.Scan(&rc.path, &rc.referrer, &rc.count); err != nil {
+			continue
+		}
+		refs = append(refs, rc)
+	}
+
+	attachTopReferrers(result, refs, domain)
+	return result, nil
+}
+
+func (s *PostgresStore) GetRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields) ([]EventItem, error) {
+	return collectEvents(func(fn func(EventItem) error) error {
+		return s.StreamRecentEvents(ctx, domain, from, to, limit, fields, fn)
+	})
+}
+
+// StreamRecentEvents passes the newest events to fn one row at a time; an error
+// from fn stops the query and is returned. Columns of unselected fields are not
+// read at all.
+func (s *PostgresStore) StreamRecentEvents(ctx context.Context, domain string, from, to time.Time, limit int, fields EventFields, fn func(EventItem) error) error {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	propClause, propArgs := postgresPropClause(ctx, 5+len(filterArgs))
+	filterClause += propClause
+	filterArgs = append(filterArgs, propArgs...)
+	columns := fields.columns("COALESCE", fmt.Sprintf("left(props::text, %d)", maxPropsBytes+1))
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM %s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		ORDER BY timestamp DESC
+		LIMIT $4
+	`, columns, s.source(), filterClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, ok := scanEvent(rows, domain, fields, s.overrides)
+		if !ok {
+			continue
+		}
+		e.Props, e.PropsTruncated = truncateBytes(e.Props, maxPropsBytes)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetEvent returns the event id names with its full props, or nil when there
+// is none
+func (s *PostgresStore) GetEvent(ctx context.Context, domain, id string) (*EventItem, error) {
+	at, err := parseEventID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Events of the same microsecond are told apart by their visitor in Go
+	query := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM %s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+	`, AllEventFields.columns("COALESCE", "props::text"), s.source())
+	rows, err := s.queryContext(ctx, query, postgresDomains(ctx, domain), at, at.Add(time.Microsecond))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return findEvent(rows, domain, id, s.overrides)
+}
+
+func (s *PostgresStore) GetEventBreakdown(ctx context.Context, domain string, from, to time.Time) ([]EventBreakdownItem, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	propClause, propArgs := postgresPropClause(ctx, 5+len(filterArgs))
+	consent := postgresConsentCondition(ctx)
+	if consent == "" {
+		consent = "true"
+	}
+	// Counts per name and day since from, for the names with the most events
+	query := fmt.Sprintf(`
+		WITH scoped AS (
+			SELECT
+				COALESCE(name, '') as name,
+				visitor_id,
+				%[4]s as consented,
+				floor(extract(epoch FROM timestamp - $2::timestamptz) / 86400)::bigint as day
+			FROM %[1]s
+			WHERE domain = ANY($1)
+			AND timestamp >= $2
+			AND timestamp < $3
+			%[2]s
+			%[3]s
+		),
+		ranked AS (
+			SELECT name, COUNT(*) as count, COUNT(DISTINCT visitor_id) FILTER (WHERE consented) as visitors
+			FROM scoped
+			GROUP BY name
+			ORDER BY count DESC, name
+			LIMIT $4
+		)
+		SELECT ranked.name, ranked.count, ranked.visitors, scoped.day, COUNT(*) as day_count
+		FROM scoped
+		JOIN ranked ON scoped.name = ranked.name
+		GROUP BY 1, 2, 3, 4
+		ORDER BY ranked.count DESC, ranked.name, scoped.day
+	`, s.source(), filterClause, propClause, consent)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, eventBreakdownLimit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, append(args, propArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []breakdownRow
+	for rows.Next() {
+		var row breakdownRow
+		if err := rows.Scan(&row.name, &row.count, &row.visitors, &row.day, &row.dayCount); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return pivotBreakdown(result, from, to), nil
+}
+
+func (s *PostgresStore) GetEventCardinality(ctx context.Context, domain string, from, to time.Time) (EventCardinality, error) {
+	var card EventCardinality
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(4)
+	propClause, propArgs := postgresPropClause(ctx, 4+len(filterArgs))
+	query := fmt.Sprintf(`
+		SELECT COUNT(DISTINCT name), COUNT(*)
+		FROM %s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		%s
+	`, s.source(), filterClause, propClause)
+
+	args := append(append([]any{postgresDomains(ctx, domain), from, to}, filterArgs...), propArgs...)
+	err := s.queryRowContext(ctx, query, args...).Scan(&card.Names, &card.Events)
+	return card, err
+}
+
+func (s *PostgresStore) GetUniquePages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return s.GetTopPages(ctx, domain, from, to, limit)
+}
+
+func (s *PostgresStore) GetFunnel(ctx context.Context, domain string, from, to time.Time, steps []string) (*FunnelResult, error) {
+	if len(steps) < 2 {
+		return &FunnelResult{Steps: make([]FunnelStep, len(steps))}, nil
+	}
+
+	// Simple funnel: count visitors who visited each page in sequence
+	result := &FunnelResult{
+		Steps: make([]FunnelStep, len(steps)),
+	}
+
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	consentClause := andCondition(postgresConsentCondition(ctx))
+	for i, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		query := fmt.Sprintf(`
+			SELECT COUNT(DISTINCT visitor_id)
+			FROM %s
+			WHERE domain = ANY($1)
+			AND name = 'pageview'
+			AND %s = $2
+			AND timestamp >= $3
+			AND timestamp < $4
+			%s
+			%s
+		`, s.source(), postgresFunnelPath("COALESCE(pathname, '')"), filterClause, consentClause)
+
+		args := append([]any{postgresDomains(ctx, domain), funnel.NormalizePath(step), from, to}, filterArgs...)
+		var count int64
+		if err := s.queryRowContext(ctx, query, args...).Scan(&count); err != nil {
+			return nil, fmt.Errorf("funnel step %d: %w", i+1, err)
+		}
+
+		result.Steps[i] = FunnelStep{
+			Name:  step,
+			Count: count,
+		}
+	}
+
+	result.TotalStart = result.Steps[0].Count
+	result.TotalFinish = result.Steps[len(result.Steps)-1].Count
+	if result.TotalStart > 0 {
+		for i := range result.Steps {
+			result.Steps[i].Percent = float64(result.Steps[i].Count) / float64(result.TotalStart) * 100
+		}
+		result.Conversion = float64(result.TotalFinish) / float64(result.TotalStart) * 100
+	}
+	return result, nil
+}
+
+// GetFunnelAdvanced loads matching events per visitor and evaluates ordered,
+// windowed steps in Go so pageview and event steps can be mixed
+func (s *PostgresStore) GetFunnelAdvanced(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step, windowMinutes int) (*FunnelResult, error) {
+	if included := len(funnel.Included(steps)); included < 2 {
+		return newFunnelResult(steps, make([]int64, included)), nil
+	}
+
+	scanTo, entryEnd := funnelScan(ctx, to, windowMinutes)
+	names := funnelEventNames(steps)
+	placeholders := make([]string, len(names))
+	args := []any{postgresDomains(ctx, domain), from, scanTo}
+	for i, name := range names {
+		placeholders[i] = fmt.Sprintf("$%d", 4+i)
+		args = append(args, name)
+	}
+
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(4 + len(names))
+	query := fmt.Sprintf(`
+		SELECT
+			visitor_id,
+			name,
+			%s as normalized_pathname,
+			props::text as props,
+			timestamp
+		FROM %s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+		AND name IN (%s)
+		%s
+		%s
+		ORDER BY visitor_id, timestamp
+		LIMIT %d
+	`, postgresFunnelPath("COALESCE(pathname, '')"), s.source(), strings.Join(placeholders, ", "), filterClause, andCondition(postgresConsentCondition(ctx)), maxFunnelEvents)
+
+	rows, err := s.queryContext(ctx, query, append(args, filterArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.VisitorID, &e.Name, &e.Pathname, &e.Props, &e.Timestamp); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	counts := evaluateFunnel(events, steps, time.Duration(windowMinutes)*time.Minute, entryEnd)
+	return newFunnelResult(steps, counts), nil
+}
+
+func (s *PostgresStore) GetStepMatchCounts(ctx context.Context, domain string, from, to time.Time, steps []funnel.Step) ([]int64, error) {
+	if len(steps) == 0 {
+		return []int64{}, nil
+	}
+
+	names := funnelEventNames(steps)
+	placeholders := make([]string, len(names))
+	args := []any{postgresDomains(ctx, domain), from, to}
+	for i, name := range names {
+		placeholders[i] = fmt.Sprintf("$%d", 4+i)
+		args = append(args, name)
+	}
+
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(4 + len(names))
+	query := fmt.Sprintf(`
+		SELECT
+			name,
+			%s as normalized_pathname,
+			COUNT(*) as count
+		FROM %s
+		WHERE domain = ANY($1)
+		AND timestamp >= $2
+		AND timestamp < $3
+		AND name IN (%s)
+		%s
+		%s
+		GROUP BY 1, 2
+	`, postgresFunnelPath("COALESCE(pathname, '')"), s.source(), strings.Join(placeholders, ", "), filterClause, andCondition(postgresConsentCondition(ctx)))
+
+	rows, err := s.queryContext(ctx, query, append(args, filterArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []pathCount
+	for rows.Next() {
+		var c pathCount
+		if err := rows.Scan(&c.Name, &c.Pathname, &c.Count); err != nil {
+			continue
+		}
+		counts = append(counts, c)
+	}
+	return sumStepMatches(counts, steps), rows.Err()
+}
+
+// GetCampaignConversions reports sessions and goal conversions per campaign, one session per visitor
+func (s *PostgresStore) GetCampaignConversions(ctx context.Context, domain string, goal funnel.Step, from, to time.Time, opts CampaignOptions, limit int) ([]CampaignConversion, error) {
+	// The first (or last) pageview of each visitor is its touch
+	touch := "ASC"
+	if opts.Attribution == "last" {
+		touch = "DESC"
+	}
+	dims := "'', ''"
+	if opts.BySourceMedium {
+		dims = "t.source, t.medium"
+	}
+
+	conversion, withRevenue := goalRevenue(ctx, goal)
+	revenueSum := "0::double precision"
+	if withRevenue {
+		revenueSum = "SUM(" + conversion.postgresValueExpr() + ")"
+	}
+
+	goalClause, goalArgs := postgresGoalClause(goal, 5)
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5 + len(goalArgs))
+	query := fmt.Sprintf(`
+		WITH touches AS (
+			SELECT DISTINCT ON (visitor_id)
+				visitor_id,
+				COALESCE(NULLIF(utm_campaign, ''), '%[2]s') as campaign,
+				COALESCE(utm_source, '') as source,
+				COALESCE(utm_medium, '') as medium
+			FROM %[3]s
+			WHERE domain = ANY($1)
+			AND name = 'pageview'
+			AND timestamp >= $2
+			AND timestamp < $3
+			%[4]s
+			ORDER BY visitor_id, timestamp %[1]s
+		), conversions AS (
+			SELECT visitor_id, COUNT(*) as completions, %[7]s as revenue
+			FROM %[3]s
+			WHERE domain = ANY($1)
+			AND %[5]s
+			AND timestamp >= $2
+			AND timestamp < $3
+			GROUP BY visitor_id
+		)
+		SELECT
+			t.campaign,
+			%[6]s,
+			COUNT(*) as sessions,
+			COUNT(c.visitor_id) as conversions,
+			COALESCE(SUM(c.completions), 0) as completions,
+			COALESCE(SUM(c.revenue), 0) as revenue
+		FROM touches t
+		LEFT JOIN conversions c ON t.visitor_id = c.visitor_id
+		GROUP BY 1, 2, 3
+		ORDER BY sessions DESC
+		LIMIT $4
+	`, touch, DirectCampaign, s.source(), filterClause, goalClause, dims, revenueSum)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, limit}, goalArgs...)
+	args = append(args, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []CampaignConversion
+	for rows.Next() {
+		var c CampaignConversion
+		var revenue float64
+		if err := rows.Scan(&c.Campaign, &c.Source, &c.Medium, &c.Sessions, &c.Conversions, &c.Completions, &revenue); err != nil {
+			continue
+		}
+		if withRevenue {
+			c.Revenue = &revenue
+		}
+		result = append(result, c)
+	}
+	setConversionRates(result)
+	return result, nil
+}
+
+// GetRevenue sums the revenue of the purchase events of [from, to) per UTC
+// hour, with the settings and rates attached by withRevenue
+func (s *PostgresStore) GetRevenue(ctx context.Context, domain string, from, to time.Time) (*Revenue, error) {
+	conversion := revenueConversionFromContext(ctx)
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	query := fmt.Sprintf(`
+		SELECT
+			hour,
+			COALESCE(SUM(value), 0) as revenue,
+			COUNT(*) as purchases,
+			COUNT(*) - COUNT(value) as excluded
+		FROM (
+			SELECT
+				date_trunc('hour', timestamp AT TIME ZONE 'UTC') as hour,
+				%s as value
+			FROM %s
+			WHERE domain = ANY($1)
+			AND name = $4
+			AND timestamp >= $2
+			AND timestamp < $3
+			%s
+		) AS purchases
+		GROUP BY hour
+		ORDER BY hour
+	`, conversion.postgresValueExpr(), s.source(), filterClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, conversion.event}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hours []RevenuePoint
+	for rows.Next() {
+		var t time.Time
+		var p RevenuePoint
+		if err := rows.Scan(&t, &p.Revenue, &p.Purchases, &p.Excluded); err != nil {
+			continue
+		}
+		p.Time = t.Format("2006-01-02T15:00")
+		hours = append(hours, p)
+	}
+	return newRevenue(conversion.currency, hours), nil
+}
+
+func (s *PostgresStore) GetAutocaptureEvents(ctx context.Context, domain string, from, to time.Time, limit int) ([]AutocaptureEvent, error) {
+	filterClause, filterArgs := filtersFromContext(ctx).postgresClause(5)
+	query := fmt.Sprintf(`
+		SELECT
+			name as event_type,
+			COALESCE(props->>'text', '') as text,
+			COALESCE(props->>'tag', '') as tag,
+			%s as pathname,
+			COUNT(*) as count
+		FROM %s
+		WHERE domain = ANY($1)
+		AND name IN ('click', 'submit', 'change')
+		AND timestamp >= $2
+		AND timestamp < $3
+		%s
+		GROUP BY 1, 2, 3, 4
+		ORDER BY count DESC
+		LIMIT $4
+	`, postgresPathExpr("COALESCE(pathname, '')"), s.source(), filterClause)
+
+	args := append([]any{postgresDomains(ctx, domain), from, to, limit}, filterArgs...)
+	rows, err := s.queryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []AutocaptureEvent
+	for rows.Next() {
+		var e AutocaptureEvent
+		if err := rows.Scan(&e.EventType, &e.Text, &e.Tag, &e.Pathname, &e.Count); err != nil {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
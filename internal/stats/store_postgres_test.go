@@ -0,0 +1,262 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
+
+func TestPostgresEvent_Row(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	names := NewEventNameRules()
+	names.Set(map[string][]string{fixtureDomain: {"signup"}}, nil)
+	skew := 48 * time.Hour
+
+	row := func(raw string) []any {
+		t.Helper()
+		var e postgresEvent
+		if err := json.Unmarshal([]byte(raw), &e); err != nil {
+			t.Fatal(err)
+		}
+		return e.row(names, skew, now)
+	}
+
+	// Props sent as a string are stored as the object it holds
+	r := row(`{"domain":"example.com","name":"signup","props":"{\"plan\":\"pro\"}","device":"Phone","received_at":"2024-03-10T11:00:00Z"}`)
+	if r[2] != "signup" || r[7] != `{"plan":"pro"}` || r[12] != "Mobile" {
+		t.Errorf("row = %v", r)
+	}
+	if r[6] != time.Date(2024, 3, 10, 11, 0, 0, 0, time.UTC) {
+		t.Errorf("timestamp = %v, want received_at", r[6])
+	}
+
+	// Names outside the allow-list keep theirs in props
+	r = row(`{"domain":"example.com","name":"promo","props":{"a":1},"timestamp":"2024-03-10T11:00:00Z"}`)
+	if r[2] != OtherEventName || r[7] != `{"original_name":"promo","a":1}` {
+		t.Errorf("unknown name row = %v", r)
+	}
+
+	// Skewed timestamps are clamped, keeping the client's in props
+	r = row(`{"domain":"example.com","name":"signup","props":"not json","timestamp":"2020-01-01T00:00:00Z","received_at":"2024-03-10T11:00:00Z"}`)
+	if r[6] != time.Date(2024, 3, 8, 11, 0, 0, 0, time.UTC) || r[7] != `{"original_timestamp":"2020-01-01T00:00:00Z"}` {
+		t.Errorf("clamped row = %v", r)
+	}
+
+	// Text columns refuse NUL bytes and invalid UTF-8; long URLs are cut
+	r = row(`{"domain":"example.com","name":"signup","browser":"Fire\u0000fox","url":"https://example.com/` + strings.Repeat("é", maxStoredFieldLen) + `"}`)
+	if r[8] != "Firefox" || len([]rune(r[3].(string))) != maxStoredFieldLen {
+		t.Errorf("browser = %q, url of %d runes", r[8], len([]rune(r[3].(string))))
+	}
+}
+
+func TestWithProp(t *testing.T) {
+	for _, tt := range []struct{ props, want string }{
+		{`{}`, `{"k":"v"}`},
+		{`{ }`, `{"k":"v"}`},
+		{`{"a":1}`, `{"k":"v","a":1}`},
+	} {
+		if got := withProp(tt.props, "k", "v"); got != tt.want {
+			t.Errorf("withProp(%s) = %s, want %s", tt.props, got, tt.want)
+		}
+	}
+}
+
+// seedPostgres writes events into a PostgresStore on POSTGRES_TEST_URL, whose
+// events table is created and emptied first. The test is skipped without one,
+// leaving the store unverified: run scripts/test-postgres.sh before changing
+// its queries.
+func seedPostgres(t *testing.T, now time.Time, events ...seedEvent) *PostgresStore {
+	t.Helper()
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if url == "" {
+		t.Skip("POSTGRES_TEST_URL not set; the Postgres store is unverified, run scripts/test-postgres.sh")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ddl, err := os.ReadFile("../../migrations/027_create_events.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(ddl)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("TRUNCATE " + postgresEventsTable); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewPostgresStore(PostgresConfig{DatabaseURL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	batch := make([]json.RawMessage, len(events))
+	for i, e := range events {
+		e = e.withDefaults(now)
+		batch[i], _ = json.Marshal(map[string]any{
+			"domain": e.Domain, "visitor_id": e.VisitorID, "name": e.Name, "url": e.URL,
+			"pathname": e.Pathname, "referrer": e.Referrer, "timestamp": e.At.UTC(), "props": e.Props,
+			"browser": e.Browser, "os": e.OS, "device": e.Device, "country": e.Country, "city": e.City,
+			"utm_source": e.UTMSource, "utm_medium": e.UTMMedium, "received_at": e.ReceivedAt.UTC(),
+		})
+	}
+	if err := s.Write(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestPostgresStore_Conformance seeds the same events into DuckDB and Postgres
+// and expects every report to agree. The seeded events carry no utm_campaign,
+// so the campaign reports are left out.
+func TestPostgresStore_Conformance(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Hour)
+	events := []seedEvent{
+		{VisitorID: "a", Pathname: "/", URL: "https://example.com/", Referrer: "https://www.google.com/search?q=x", Browser: "Chrome", Country: "DE", City: "Berlin", Props: `{"lang":"de-DE","viewport_w":1280,"region":"BE"}`, Ago: time.Hour},
+		{VisitorID: "a", Pathname: "/pricing", URL: "https://example.com/pricing", Referrer: "https://example.com/", Browser: "Chrome", Country: "DE", Ago: 50 * time.Minute},
+		{VisitorID: "a", Name: "signup", Pathname: "/pricing", Props: `{"plan":"pro"}`, Ago: 45 * time.Minute},
+		{VisitorID: "b", Pathname: "/", URL: "https://staging.example.com/", Referrer: "https://news.ycombinator.com/item?id=1", Browser: "Firefox", Device: "Mobile", Country: "us", Props: `{"lang":"en","viewport_w":"390"}`, Ago: daysAgo(1)},
+		{VisitorID: "b", Pathname: "/missing", Props: `{"status":404}`, Referrer: "https://news.ycombinator.com/", Ago: daysAgo(1) - time.Minute},
+		{VisitorID: "c", Name: "click", Pathname: "/", Props: `{"text":"Buy","tag":"button"}`, Ago: daysAgo(2)},
+		{VisitorID: "c", Name: "error", Pathname: "/checkout?step=2", Ago: daysAgo(2)},
+		{Domain: "other.com", VisitorID: "d", Ago: daysAgo(3)},
+		// Tagged visits that lost their referrer, as from email clients
+		{VisitorID: "e", UTMSource: "newsletter", UTMMedium: "email", Ago: daysAgo(4)},
+		{VisitorID: "f", UTMSource: "newsletter", UTMMedium: "email", Ago: daysAgo(4)},
+		{VisitorID: "g", Referrer: "https://example.com/", UTMSource: "google", UTMMedium: "cpc", Ago: daysAgo(4)},
+	}
+	pg := seedPostgres(t, now, events...)
+	duck := seedStore(t, now, events...)
+
+	ctx := context.Background()
+	from, to := now.Add(-daysAgo(7)), now.Add(time.Hour)
+	steps := []funnel.Step{{Type: "pageview", Value: "/"}, {Type: "pageview", Value: "/pricing"}, {Type: "event", Value: "signup"}}
+	for name, read := range map[string]func(StoreInterface) (any, error){
+		"GetOverview": func(s StoreInterface) (any, error) { return s.GetOverview(ctx, fixtureDomain, from, to) },
+		"GetPageviewsTimeSeries": func(s StoreInterface) (any, error) {
+			return s.GetPageviewsTimeSeries(ctx, fixtureDomain, from, to, "hour")
+		},
+		"GetTopPages":         func(s StoreInterface) (any, error) { return s.GetTopPages(ctx, fixtureDomain, from, to, 10) },
+		"GetTopSources":       func(s StoreInterface) (any, error) { return s.GetTopSources(ctx, fixtureDomain, from, to, 10) },
+		"GetSourceBuckets":    func(s StoreInterface) (any, error) { return s.GetSourceBuckets(ctx, fixtureDomain, from, to, 10) },
+		"GetTopUTMSources":    func(s StoreInterface) (any, error) { return s.GetTopUTMSources(ctx, fixtureDomain, from, to, 10) },
+		"GetTopUTMMediums":    func(s StoreInterface) (any, error) { return s.GetTopUTMMediums(ctx, fixtureDomain, from, to, 10) },
+		"GetTopReferrerURLs":  func(s StoreInterface) (any, error) { return s.GetTopReferrerURLs(ctx, fixtureDomain, from, to, 10) },
+		"GetSearchEngines":    func(s StoreInterface) (any, error) { return s.GetSearchEngines(ctx, fixtureDomain, from, to, 10) },
+		"GetCountryMap":       func(s StoreInterface) (any, error) { return s.GetCountryMap(ctx, fixtureDomain, from, to) },
+		"GetTopRegions":       func(s StoreInterface) (any, error) { return s.GetTopRegions(ctx, fixtureDomain, "DE", from, to, 10) },
+		"GetTopCities":        func(s StoreInterface) (any, error) { return s.GetTopCities(ctx, fixtureDomain, "DE", from, to, 10) },
+		"GetTopBrowsers":      func(s StoreInterface) (any, error) { return s.GetTopBrowsers(ctx, fixtureDomain, from, to, 10) },
+		"GetTopCountries":     func(s StoreInterface) (any, error) { return s.GetTopCountries(ctx, fixtureDomain, from, to, 10) },
+		"GetTopDevices":       func(s StoreInterface) (any, error) { return s.GetTopDevices(ctx, fixtureDomain, from, to, 10) },
+		"GetTopLanguages":     func(s StoreInterface) (any, error) { return s.GetTopLanguages(ctx, fixtureDomain, from, to, 10) },
+		"GetScreenSizes":      func(s StoreInterface) (any, error) { return s.GetScreenSizes(ctx, fixtureDomain, from, to) },
+		"GetErrorPages":       func(s StoreInterface) (any, error) { return s.GetErrorPages(ctx, fixtureDomain, from, to, 10) },
+		"GetEventBreakdown":   func(s StoreInterface) (any, error) { return s.GetEventBreakdown(ctx, fixtureDomain, from, to) },
+		"GetEventCardinality": func(s StoreInterface) (any, error) { return s.GetEventCardinality(ctx, fixtureDomain, from, to) },
+		"GetActivity": func(s StoreInterface) (any, error) {
+			return s.GetActivity(ctx, fixtureDomain, from, to, time.Hour)
+		},
+		"GetFunnel": func(s StoreInterface) (any, error) {
+			return s.GetFunnel(ctx, fixtureDomain, from, to, []string{"/", "/pricing"})
+		},
+		"GetFunnelAdvanced": func(s StoreInterface) (any, error) {
+			return s.GetFunnelAdvanced(ctx, fixtureDomain, from, to, steps, 60)
+		},
+		"GetStepMatchCounts": func(s StoreInterface) (any, error) {
+			return s.GetStepMatchCounts(ctx, fixtureDomain, from, to, steps)
+		},
+		"GetAutocaptureEvents": func(s StoreInterface) (any, error) { return s.GetAutocaptureEvents(ctx, fixtureDomain, from, to, 10) },
+		"GetDimensionValues": func(s StoreInterface) (any, error) {
+			return s.GetDimensionValues(ctx, fixtureDomain, "browser", from, to, 10)
+		},
+		"GetDomainMismatches": func(s StoreInterface) (any, error) {
+			return s.GetDomainMismatches(ctx, fixtureDomain, false, from, to, 10)
+		},
+		"GetRecentEvents": func(s StoreInterface) (any, error) {
+			return s.GetRecentEvents(ctx, fixtureDomain, from, to, 10, AllEventFields)
+		},
+		"GetActiveDomains": func(s StoreInterface) (any, error) { return s.GetActiveDomains(ctx, from, 10) },
+		"GetFirstEventAt":  func(s StoreInterface) (any, error) { return s.GetFirstEventAt(ctx, fixtureDomain) },
+	} {
+		want, err := read(duck)
+		if err != nil {
+			t.Fatalf("DuckDB %s: %v", name, err)
+		}
+		got, err := read(pg)
+		if err != nil {
+			t.Errorf("Postgres %s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %+v, DuckDB has %+v", name, got, want)
+		}
+	}
+
+	// Tagged direct email traffic lands in the Email channel
+	buckets, err := pg.GetSourceBuckets(ctx, fixtureDomain, from, to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var email int64
+	for _, item := range classifySources(buckets) {
+		if item.Channel == ChannelEmail {
+			email += item.Count
+		}
+	}
+	if email != 2 {
+		t.Errorf("email channel = %d pageviews, want 2 in %+v", email, buckets)
+	}
+
+	if n, err := pg.EraseVisitor(ctx, fixtureDomain, "a"); err != nil || n != 3 {
+		t.Errorf("EraseVisitor = %d, %v; want 3", n, err)
+	}
+}
+
+// TestPostgresStore_RefreshCounts expects refreshes to count only the events
+// written since the last one, and to count anew after an erasure
+func TestPostgresStore_RefreshCounts(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Hour)
+	s := seedPostgres(t, now,
+		seedEvent{VisitorID: "a", Ago: time.Hour},
+		seedEvent{VisitorID: "b", Ago: time.Hour},
+		seedEvent{VisitorID: "c", At: now.Add(72 * time.Hour), ReceivedAt: now},
+	)
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.Events != 3 || st.FutureEvents != 1 || st.EventLimit != postgresEventLimit {
+		t.Fatalf("Status = %+v, want 3 events, 1 future", st)
+	}
+
+	raw, _ := json.Marshal(map[string]any{"domain": fixtureDomain, "visitor_id": "d", "name": "pageview", "received_at": now})
+	if err := s.Write(context.Background(), []json.RawMessage{raw}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.Events != 4 {
+		t.Errorf("events after a write = %d, want 4", st.Events)
+	}
+
+	if _, err := s.EraseVisitor(context.Background(), fixtureDomain, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.Events != 3 {
+		t.Errorf("events after an erasure = %d, want 3", st.Events)
+	}
+}
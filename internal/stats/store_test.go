@@ -1,137 +1,13 @@
 package stats
 
 import (
+	"context"
+	"reflect"
 	"testing"
-)
-
-func TestCleanReferrer(t *testing.T) {
-	tests := []struct {
-		referrer string
-		domain   string
-		expected string
-	}{
-		{"", "example.com", "Direct"},
-		{"https://google.com/search?q=test", "example.com", "google.com"},
-		{"https://facebook.com/share", "example.com", "facebook.com"},
-		{"https://example.com/page", "example.com", "Direct"}, // internal
-		{"https://sub.example.com/page", "example.com", "Direct"}, // internal subdomain
-		{"invalid-url", "example.com", "Direct"},
-		{"https://twitter.com", "example.com", "twitter.com"},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.referrer, func(t *testing.T) {
-			got := cleanReferrer(tt.referrer, tt.domain)
-			if got != tt.expected {
-				t.Errorf("cleanReferrer(%q, %q) = %q, want %q", tt.referrer, tt.domain, got, tt.expected)
-			}
-		})
-	}
-}
-
-func TestTopN(t *testing.T) {
-	counts := map[string]int64{
-		"page1": 100,
-		"page2": 50,
-		"page3": 200,
-		"page4": 75,
-		"page5": 25,
-	}
-
-	tests := []struct {
-		n        int
-		expected int
-		first    string
-	}{
-		{3, 3, "page3"},
-		{5, 5, "page3"},
-		{10, 5, "page3"}, // more than available
-		{1, 1, "page3"},
-	}
-
-	for _, tt := range tests {
-		t.Run("", func(t *testing.T) {
-			result := topN(counts, tt.n)
-			if len(result) != tt.expected {
-				t.Errorf("topN(counts, %d) returned %d items, want %d", tt.n, len(result), tt.expected)
-			}
-			if len(result) > 0 && result[0].Name != tt.first {
-				t.Errorf("First item = %s, want %s", result[0].Name, tt.first)
-			}
-		})
-	}
-}
-
-func TestTopN_Sorted(t *testing.T) {
-	counts := map[string]int64{
-		"a": 10,
-		"b": 30,
-		"c": 20,
-	}
+	"time"
 
-	result := topN(counts, 3)
-
-	if result[0].Count != 30 || result[1].Count != 20 || result[2].Count != 10 {
-		t.Errorf("topN should be sorted descending: %v", result)
-	}
-}
-
-func TestTopN_Empty(t *testing.T) {
-	counts := map[string]int64{}
-	result := topN(counts, 10)
-	if len(result) != 0 {
-		t.Errorf("topN on empty map should return empty slice")
-	}
-}
-
-func TestMatchesStep(t *testing.T) {
-	tests := []struct {
-		pathname string
-		step     string
-		expected bool
-	}{
-		{"/dashboard", "/dashboard", true},
-		{"/dashboard/settings", "/dashboard", false},
-		{"/dashboard/settings", "/dashboard/*", true},
-		{"/dashboard", "/dashboard/*", false}, // no trailing content
-		{"/", "/", true},
-		{"/page", "/other", false},
-		{"/api/v1/users", "/api/*", true},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.pathname+"_"+tt.step, func(t *testing.T) {
-			got := matchesStep(tt.pathname, tt.step)
-			if got != tt.expected {
-				t.Errorf("matchesStep(%q, %q) = %v, want %v", tt.pathname, tt.step, got, tt.expected)
-			}
-		})
-	}
-}
-
-func TestExtractJSONField(t *testing.T) {
-	tests := []struct {
-		json     string
-		field    string
-		expected string
-	}{
-		{`{"text":"hello","tag":"button"}`, "text", "hello"},
-		{`{"text":"hello","tag":"button"}`, "tag", "button"},
-		{`{"text":"hello","tag":"button"}`, "missing", ""},
-		{`{"text": "spaced"}`, "text", "spaced"},
-		{`{}`, "text", ""},
-		{`{"nested":{"text":"inner"}}`, "text", "inner"},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.field, func(t *testing.T) {
-			got := extractJSONField(tt.json, tt.field)
-			if got != tt.expected {
-				t.Errorf("extractJSONField(%q, %q) = %q, want %q", tt.json, tt.field, got, tt.expected)
-			}
-		})
-	}
-}
+	"github.com/shortid/clickresearch-stats/internal/funnel"
+)
 
 func TestMatchesStepDef_Pageview(t *testing.T) {
 	event := Event{
@@ -140,14 +16,14 @@ func TestMatchesStepDef_Pageview(t *testing.T) {
 	}
 
 	tests := []struct {
-		step     FunnelStepDef
+		step     funnel.Step
 		expected bool
 	}{
-		{FunnelStepDef{Type: "pageview", Value: "/dashboard"}, true},
-		{FunnelStepDef{Type: "pageview", Value: "/other"}, false},
-		{FunnelStepDef{Type: "pageview", Value: "/dash*"}, true},
-		{FunnelStepDef{Type: "event", Value: "pageview"}, true}, // matches event.Name
-		{FunnelStepDef{Type: "event", Value: "click"}, false},   // different event
+		{funnel.Step{Type: "pageview", Value: "/dashboard"}, true},
+		{funnel.Step{Type: "pageview", Value: "/other"}, false},
+		{funnel.Step{Type: "pageview", Value: "/dash*"}, true},
+		{funnel.Step{Type: "event", Value: "pageview"}, true}, // matches event.Name
+		{funnel.Step{Type: "event", Value: "click"}, false},   // different event
 	}
 
 	for _, tt := range tests {
@@ -167,16 +43,20 @@ func TestMatchesStepDef_Event(t *testing.T) {
 	}
 
 	tests := []struct {
-		step     FunnelStepDef
+		step     funnel.Step
 		expected bool
 	}{
-		{FunnelStepDef{Type: "event", Value: "click"}, true},
-		{FunnelStepDef{Type: "event", Value: "click", Text: "Submit"}, true},
-		{FunnelStepDef{Type: "event", Value: "click", Text: "Cancel"}, false},
-		{FunnelStepDef{Type: "event", Value: "click", Tag: "button"}, true},
-		{FunnelStepDef{Type: "event", Value: "click", Tag: "a"}, false},
-		{FunnelStepDef{Type: "event", Value: "submit"}, false}, // wrong event
-		{FunnelStepDef{Type: "pageview", Value: "/page"}, false}, // wrong type
+		{funnel.Step{Type: "event", Value: "click"}, true},
+		{funnel.Step{Type: "event", Value: "click", Text: "Submit"}, true},
+		{funnel.Step{Type: "event", Value: "click", Text: "Cancel"}, false},
+		{funnel.Step{Type: "event", Value: "click", Tag: "button"}, true},
+		{funnel.Step{Type: "event", Value: "click", Tag: "a"}, false},
+		{funnel.Step{Type: "event", Value: "submit"}, false}, // wrong event
+		{funnel.Step{Type: "pageview", Value: "/page"}, false}, // wrong type
+		{funnel.Step{Type: "event", Value: "click", Text: "submit", Tag: "BUTTON"}, true},
+		{funnel.Step{Type: "event", Value: "click", Text: "~ubm"}, true},
+		{funnel.Step{Type: "event", Value: "click", Text: "~cancel"}, false},
+		{funnel.Step{Type: "event", Value: "click", Href: "/pricing"}, false}, // no href prop
 	}
 
 	for _, tt := range tests {
@@ -265,3 +145,187 @@ func TestAutocaptureEvent_Struct(t *testing.T) {
 		t.Errorf("EventType = %s, want click", event.EventType)
 	}
 }
+
+func TestMatchesStepDef_EscapedAndNestedProps(t *testing.T) {
+	event := Event{
+		Name:  "click",
+		Props: `{"text":"Get \"Pro\" – 20% off","element":{"tag":"a","href":"https://example.com/Pricing?plan=pro"}}`,
+	}
+
+	tests := []struct {
+		step     funnel.Step
+		expected bool
+	}{
+		{funnel.Step{Type: "event", Value: "click", Text: `get "pro" – 20% OFF`}, true},
+		{funnel.Step{Type: "event", Value: "click", Text: `~"pro"`}, true},
+		{funnel.Step{Type: "event", Value: "click", Text: "Get "}, false},
+		{funnel.Step{Type: "event", Value: "click", Tag: "a", Href: "~/pricing"}, true},
+		{funnel.Step{Type: "event", Value: "click", Href: "~/checkout"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step.Text+tt.step.Href, func(t *testing.T) {
+			if got := matchesStepDef(event, tt.step); got != tt.expected {
+				t.Errorf("matchesStepDef = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestStore_GetOverview(t *testing.T) {
+	now := time.Now().UTC()
+	s := seedStore(t, now,
+		seedEvent{VisitorID: "v1", Ago: daysAgo(1)},
+		seedEvent{VisitorID: "v1", Ago: daysAgo(2)},
+		seedEvent{VisitorID: "v2", Ago: time.Hour},
+		seedEvent{VisitorID: "v3", Name: "click", Ago: daysAgo(3)},
+		seedEvent{VisitorID: "v4", Ago: daysAgo(8)},
+		seedEvent{Domain: "other.com", VisitorID: "v5", Ago: daysAgo(1)},
+	)
+	from, to, err := PeriodRange("7d", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := s.GetOverview(WithFilters(context.Background(), Filters{}), fixtureDomain, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 3 || o.UniqueVisitors != 3 || o.Events != 4 {
+		t.Errorf("overview = %+v, want 3 pageviews, 3 visitors and 4 events", o)
+	}
+}
+
+func TestStore_GetTopPages(t *testing.T) {
+	now := time.Now().UTC()
+	var events []seedEvent
+	for path, n := range map[string]int{"/pricing": 3, "/": 2, "/blog": 1} {
+		for i := 0; i < n; i++ {
+			events = append(events, seedEvent{Pathname: path, Ago: daysAgo(1)})
+		}
+	}
+	events = append(events,
+		seedEvent{Name: "click", Pathname: "/blog", Ago: daysAgo(1)},
+		seedEvent{Name: "click", Pathname: "/blog", Ago: daysAgo(1)},
+		seedEvent{Pathname: "/old", Ago: daysAgo(30)},
+	)
+	s := seedStore(t, now, events...)
+	ctx := WithFilters(context.Background(), Filters{})
+
+	items, err := s.GetTopPages(ctx, fixtureDomain, now.AddDate(0, 0, -7), now, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TopItem{{Name: "/pricing", Count: 3}, {Name: "/", Count: 2}}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("top pages = %v, want %v", items, want)
+	}
+}
+
+func TestStore_GetTopSources(t *testing.T) {
+	now := time.Now().UTC()
+	s := seedStore(t, now,
+		seedEvent{Referrer: "https://www.google.com/search?q=analytics", Ago: daysAgo(1)},
+		seedEvent{Referrer: "https://www.google.com/", Ago: daysAgo(2)},
+		seedEvent{Referrer: "https://news.ycombinator.com/item?id=1", Ago: daysAgo(1)},
+		seedEvent{Referrer: "", Ago: daysAgo(1)},
+		seedEvent{Referrer: "https://example.com/pricing", Ago: daysAgo(1)},
+		seedEvent{Referrer: "https://blog.example.com/post", Ago: daysAgo(1)},
+		seedEvent{Name: "click", Referrer: "https://twitter.com/", Ago: daysAgo(1)},
+		seedEvent{Domain: "other.com", Referrer: "https://example.com/", Ago: daysAgo(1)},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+	from := now.AddDate(0, 0, -7)
+
+	items, err := s.GetTopSources(ctx, fixtureDomain, from, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Referrers on the site's own domain or its subdomains count as direct
+	want := map[string]int64{LabelDirect: 3, "www.google.com": 2, "news.ycombinator.com": 1}
+	if got := countsByName(items); !reflect.DeepEqual(got, want) {
+		t.Errorf("sources = %v, want %v", got, want)
+	}
+
+	if items, err := s.GetTopSources(ctx, fixtureDomain, from, now, 1); err != nil || len(items) != 1 || items[0].Name != LabelDirect {
+		t.Errorf("limit 1: %v, %v", items, err)
+	}
+	items, err = s.GetTopSources(ctx, "other.com", from, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"example.com": 1}; !reflect.DeepEqual(countsByName(items), want) {
+		t.Errorf("other.com sources = %v, want %v", items, want)
+	}
+}
+
+func TestStore_GetPageviewsTimeSeries(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := seedStore(t, day,
+		seedEvent{At: day},
+		seedEvent{At: day.Add(24*time.Hour - time.Microsecond)},
+		seedEvent{At: day.Add(24 * time.Hour)},
+		seedEvent{At: day.Add(24*time.Hour + 59*time.Minute + 59*time.Second)},
+		seedEvent{At: day.Add(25 * time.Hour)},
+		seedEvent{At: day.Add(48 * time.Hour)},
+		seedEvent{At: day.Add(-time.Microsecond)},
+		seedEvent{Name: "click", At: day.Add(time.Hour)},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+
+	// from is inclusive and to exclusive
+	points, err := s.GetPageviewsTimeSeries(ctx, fixtureDomain, day, day.Add(48*time.Hour), "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TimeSeriesPoint{{Time: "2024-03-01", Value: 2}, {Time: "2024-03-02", Value: 3}}
+	if !reflect.DeepEqual(points, want) {
+		t.Errorf("daily points = %v, want %v", points, want)
+	}
+
+	points, err = s.GetPageviewsTimeSeries(ctx, fixtureDomain, day.Add(24*time.Hour), day.Add(26*time.Hour), "hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []TimeSeriesPoint{{Time: "2024-03-02T00:00", Value: 2}, {Time: "2024-03-02T01:00", Value: 1}}
+	if !reflect.DeepEqual(points, want) {
+		t.Errorf("hourly points = %v, want %v", points, want)
+	}
+}
+
+func TestStore_GetAutocaptureEvents(t *testing.T) {
+	now := time.Now().UTC()
+	signup := `{"text":"Sign up","tag":"button","href":"/signup"}`
+	s := seedStore(t, now,
+		seedEvent{Name: "click", Pathname: "/pricing", Props: signup, Ago: daysAgo(1)},
+		seedEvent{Name: "click", Pathname: "/pricing", Props: signup, Ago: daysAgo(2)},
+		seedEvent{Name: "click", Pathname: "/docs", Props: `{"tag":"a","text":"Get \"Pro\" – 20% off"}`, Ago: daysAgo(1)},
+		seedEvent{Name: "submit", Pathname: "/contact", Props: `{"tag":"form","fields":{"text":"nested"}}`, Ago: daysAgo(1)},
+		seedEvent{Name: "change", Pathname: "/contact", Props: "not json", Ago: daysAgo(1)},
+		seedEvent{Name: "pageview", Pathname: "/pricing", Props: signup, Ago: daysAgo(1)},
+		seedEvent{Name: "signup", Pathname: "/pricing", Props: signup, Ago: daysAgo(1)},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+
+	events, err := s.GetAutocaptureEvents(ctx, fixtureDomain, now.AddDate(0, 0, -7), now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[AutocaptureEvent]bool, len(events))
+	for _, e := range events {
+		got[e] = true
+	}
+	// Only top-level fields are extracted; invalid JSON yields empty fields
+	want := map[AutocaptureEvent]bool{
+		{EventType: "click", Text: "Sign up", Tag: "button", Pathname: "/pricing", Count: 2}:     true,
+		{EventType: "click", Text: `Get "Pro" – 20% off`, Tag: "a", Pathname: "/docs", Count: 1}: true,
+		{EventType: "submit", Text: "", Tag: "form", Pathname: "/contact", Count: 1}:             true,
+		{EventType: "change", Text: "", Tag: "", Pathname: "/contact", Count: 1}:                 true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("autocapture events = %+v, want %+v", events, want)
+	}
+	if len(events) > 0 && events[0].Count != 2 {
+		t.Errorf("events are not ordered by count: %+v", events)
+	}
+}
@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// suggestPoolSize is how many of the most common values are cached per dimension
+	suggestPoolSize = 1000
+	// suggestWindow is how far back suggestions look
+	suggestWindow   = 30 * 24 * time.Hour
+	maxSuggestLimit = 100
+)
+
+// suggestDimensions whitelists dimensions for /api/stats/suggest and maps them to
+// events columns; only these names are ever rendered into SQL
+var suggestDimensions = map[string]string{
+	"country":      "country",
+	"browser":      "browser",
+	"os":           "os",
+	"device":       "device",
+	"pathname":     "pathname",
+	"utm_source":   "utm_source",
+	"utm_medium":   "utm_medium",
+	"utm_campaign": "utm_campaign",
+	"event":        "name",
+}
+
+// suggestDimensionNames lists the whitelist for error messages
+func suggestDimensionNames() string {
+	names := make([]string, 0, len(suggestDimensions))
+	for name := range suggestDimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// filterSuggestions returns up to limit values matching q case-insensitively,
+// prefix matches first; values keep their count order within each group
+func filterSuggestions(values []TopItem, q string, limit int) []TopItem {
+	q = strings.ToLower(strings.TrimSpace(q))
+	result := make([]TopItem, 0, limit)
+	var contains []TopItem
+	for _, v := range values {
+		if len(result) == limit {
+			break
+		}
+		name := strings.ToLower(v.Name)
+		switch {
+		case strings.HasPrefix(name, q):
+			result = append(result, v)
+		case strings.Contains(name, q):
+			contains = append(contains, v)
+		}
+	}
+	for _, v := range contains {
+		if len(result) == limit {
+			break
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// HandleSuggest returns existing values of a dimension matching q, for filter autocomplete
+func (h *Handler) HandleSuggest(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, _, _, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+
+	dimension := r.URL.Query().Get("dimension")
+	column, ok := suggestDimensions[dimension]
+	if !ok {
+		writeError(w, fmt.Errorf("unknown dimension %q, valid options: %s", dimension, suggestDimensionNames()), http.StatusBadRequest)
+		return
+	}
+	limit := parseLimit(r, 10)
+	if limit > maxSuggestLimit {
+		limit = maxSuggestLimit
+	}
+
+	// One query per (domain, dimension); keystrokes filter the cached pool
+	cacheKey := fmt.Sprintf("suggest:%s:%s", domain, dimension)
+	var pool []TopItem
+	if !h.cacheGet(r.Context(), cacheKey, &pool) {
+		to := time.Now().UTC()
+		var err error
+		pool, err = h.store.GetDimensionValues(r.Context(), domain, column, to.Add(-suggestWindow), to, suggestPoolSize)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		h.cache.Set(cacheKey, pool)
+	}
+
+	writeJSON(w, filterSuggestions(pool, r.URL.Query().Get("q"), limit))
+}
@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterSuggestions(t *testing.T) {
+	pool := []TopItem{
+		{Name: "summer-sale", Count: 50},
+		{Name: "spring-launch", Count: 40},
+		{Name: "early-spring", Count: 30},
+		{Name: "Spring-Promo", Count: 20},
+	}
+
+	got := filterSuggestions(pool, "spring", 10)
+	want := []TopItem{{Name: "spring-launch", Count: 40}, {Name: "Spring-Promo", Count: 20}, {Name: "early-spring", Count: 30}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("filterSuggestions = %+v, want %+v", got, want)
+	}
+
+	if got := filterSuggestions(pool, "", 2); len(got) != 2 || got[0].Name != "summer-sale" {
+		t.Errorf("empty q = %+v, want the 2 most common", got)
+	}
+	if got := filterSuggestions(pool, "winter", 10); len(got) != 0 {
+		t.Errorf("no match = %+v", got)
+	}
+}
+
+type suggestStore struct {
+	fakeStore
+	calls  int
+	column string
+}
+
+func (s *suggestStore) GetDimensionValues(ctx context.Context, domain, column string, from, to time.Time, limit int) ([]TopItem, error) {
+	s.calls++
+	s.column = column
+	return []TopItem{{Name: "Germany", Count: 9}, {Name: "France", Count: 5}, {Name: "Georgia", Count: 1}}, nil
+}
+
+func TestHandleSuggest_CachesPool(t *testing.T) {
+	store := &suggestStore{}
+	h := NewHandler(store)
+
+	for _, q := range []string{"G", "Ge", "Ger"} {
+		w := httptest.NewRecorder()
+		h.HandleSuggest(w, httptest.NewRequest("GET", "/api/stats/suggest?domain=example.com&dimension=country&q="+q, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("q=%s: status = %d", q, w.Code)
+		}
+		var items []TopItem
+		json.NewDecoder(w.Body).Decode(&items)
+		if q == "Ger" && (len(items) != 1 || items[0].Name != "Germany") {
+			t.Errorf("q=Ger: %+v, want Germany", items)
+		}
+	}
+	if store.calls != 1 {
+		t.Errorf("store queried %d times, want 1", store.calls)
+	}
+
+	w := httptest.NewRecorder()
+	h.HandleSuggest(w, httptest.NewRequest("GET", "/api/stats/suggest?domain=example.com&dimension=event", nil))
+	if store.column != "name" {
+		t.Errorf("event dimension queried column %q, want name", store.column)
+	}
+}
+
+func TestHandleSuggest_UnknownDimension(t *testing.T) {
+	h := NewHandler(&suggestStore{})
+	for _, dim := range []string{"", "props", "country; DROP TABLE events"} {
+		w := httptest.NewRecorder()
+		h.HandleSuggest(w, httptest.NewRequest("GET", "/api/stats/suggest?domain=example.com&dimension="+url.QueryEscape(dim), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("dimension %q: status = %d, want 400", dim, w.Code)
+		}
+	}
+}
+
+func TestStoreDimensionValues(t *testing.T) {
+	s := newLabelStore(t)
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	values, err := s.GetDimensionValues(context.Background(), "example.com", "browser", from, from.Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TopItem{{Name: "Safari", Count: 2}, {Name: "Firefox", Count: 1}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %+v, want %+v (empty and NULL skipped)", values, want)
+	}
+}
@@ -0,0 +1,148 @@
+package stats
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fixtureDomain is the domain seeded events default to
+const fixtureDomain = "example.com"
+
+// seedEvent is one event to seed into a test store. Empty fields default to a
+// pageview of / on fixtureDomain by visitor v1; the rest stay empty.
+type seedEvent struct {
+	Domain    string
+	VisitorID string
+	Name      string
+	URL       string
+	Pathname  string
+	Referrer  string
+	Props     string
+	Browser   string
+	OS        string
+	Device    string
+	Country   string
+	City      string
+	UTMSource string
+	UTMMedium string
+	// At is when the event happened. When it is zero the event happened Ago
+	// before the now passed to seedStore.
+	At  time.Time
+	Ago time.Duration
+	// ReceivedAt is when the event arrived; it defaults to At
+	ReceivedAt time.Time
+}
+
+// daysAgo is n days as an Ago offset
+func daysAgo(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// rawEventsSchema is the parquet schema the event writer produces
+const rawEventsSchema = `
+	CREATE TABLE raw_events (
+		domain VARCHAR,
+		visitor_id VARCHAR,
+		name VARCHAR,
+		url VARCHAR,
+		pathname VARCHAR,
+		referrer VARCHAR,
+		timestamp TIMESTAMP,
+		props VARCHAR,
+		browser VARCHAR,
+		browser_version VARCHAR,
+		os VARCHAR,
+		os_version VARCHAR,
+		device VARCHAR,
+		country VARCHAR,
+		city VARCHAR,
+		utm_source VARCHAR,
+		utm_medium VARCHAR,
+		utm_campaign VARCHAR,
+		received_at TIMESTAMP
+	)`
+
+// seedStore returns a Store on an in-memory DuckDB whose events table holds
+// events, loaded the way refreshMemoryTable loads parquet so the ingest
+// transforms and extracted props columns apply. Relative events are placed
+// before now.
+func seedStore(t testing.TB, now time.Time, events ...seedEvent) *Store {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(rawEventsSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert, err := tx.Prepare(`INSERT INTO raw_events VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', ?, '', ?, ?, ?, ?, ?, '', ?)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range events {
+		e = e.withDefaults(now)
+		if _, err := insert.Exec(e.Domain, e.VisitorID, e.Name, e.URL, e.Pathname, e.Referrer, e.At.UTC(), e.Props,
+			e.Browser, e.OS, e.Device, e.Country, e.City, e.UTMSource, e.UTMMedium, e.ReceivedAt.UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert.Close()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := withState(&Store{db: db}, storeSnapshot{ready: true, useMemoryTable: true, propColumns: true})
+	if _, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE events AS
+		SELECT
+			%s,
+			%s
+		FROM %s
+	`, duckdbIngestColumns(s.timestamps.skew()), duckdbPropColumns(), s.eventNames.duckdbIngestSource("raw_events"))); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// withState publishes st as the snapshot of s, a store built by a test; the
+// memory table defaults to events
+func withState(s *Store, st storeSnapshot) *Store {
+	if st.table == "" {
+		st.table = memoryTable
+	}
+	s.state.Store(&st)
+	return s
+}
+
+func (e seedEvent) withDefaults(now time.Time) seedEvent {
+	if e.Domain == "" {
+		e.Domain = fixtureDomain
+	}
+	if e.VisitorID == "" {
+		e.VisitorID = "v1"
+	}
+	if e.Name == "" {
+		e.Name = "pageview"
+	}
+	if e.Pathname == "" {
+		e.Pathname = "/"
+	}
+	if e.Props == "" {
+		e.Props = "{}"
+	}
+	if e.At.IsZero() {
+		e.At = now.Add(-e.Ago)
+	}
+	if e.ReceivedAt.IsZero() {
+		e.ReceivedAt = e.At
+	}
+	return e
+}
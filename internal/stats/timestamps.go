@@ -0,0 +1,160 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// futureEventSlack is how far ahead of now an event may be before queries
+	// excluding future events leave it out
+	futureEventSlack = 24 * time.Hour
+	// originalTimestampProp is the props key keeping a clamped event's client timestamp
+	originalTimestampProp = "original_timestamp"
+)
+
+// TimestampRules sanitize event timestamps, which come from client clocks
+type TimestampRules struct {
+	// Skew is how far an event's timestamp may stray from its received_at;
+	// loads clamp it into that window and keep the original in props. 0 uses
+	// DefaultTimestampSkew, a negative value loads timestamps as they are.
+	Skew time.Duration
+	// ExcludeFuture leaves events more than a day ahead of now out of queries
+	ExcludeFuture bool
+}
+
+// DefaultTimestampSkew is the skew allowed unless configured
+const DefaultTimestampSkew = 48 * time.Hour
+
+// skew is the clamping window, zero when clamping is off
+func (r TimestampRules) skew() time.Duration {
+	switch {
+	case r.Skew < 0:
+		return 0
+	case r.Skew == 0:
+		return DefaultTimestampSkew
+	}
+	return r.Skew
+}
+
+// duckdbClampedCondition holds for events whose timestamp is outside skew of received_at
+func duckdbClampedCondition(skew time.Duration) string {
+	if skew <= 0 {
+		return "false"
+	}
+	return fmt.Sprintf("(timestamp > received_at + to_microseconds(%[1]d) OR timestamp < received_at - to_microseconds(%[1]d))",
+		skew.Microseconds())
+}
+
+// duckdbTimestampExpr clamps timestamp to within skew of received_at; rows
+// without received_at keep their timestamp
+func duckdbTimestampExpr(skew time.Duration) string {
+	if skew <= 0 {
+		return "timestamp"
+	}
+	return fmt.Sprintf(`CASE
+				WHEN timestamp > received_at + to_microseconds(%[1]d) THEN received_at + to_microseconds(%[1]d)
+				WHEN timestamp < received_at - to_microseconds(%[1]d) THEN received_at - to_microseconds(%[1]d)
+				ELSE timestamp
+			END`, skew.Microseconds())
+}
+
+// duckdbClampedPropsExpr adds the client timestamp of clamped events to props.
+// Props that aren't a JSON object are left alone.
+func duckdbClampedPropsExpr(skew time.Duration) string {
+	return fmt.Sprintf(`CASE
+				WHEN NOT %[1]s OR NOT starts_with(trim(coalesce(props, '{}')), '{') THEN props
+				ELSE '{"%[2]s":"' || strftime(timestamp, '%%Y-%%m-%%dT%%H:%%M:%%SZ') || '"' ||
+					CASE WHEN trim(coalesce(props, '{}')) = '{}' THEN '}' ELSE ',' || substr(trim(props), 2) END
+			END`, duckdbClampedCondition(skew), originalTimestampProp)
+}
+
+// clickhouseClampedCondition holds for events whose timestamp is outside skew of received_at
+func clickhouseClampedCondition(skew time.Duration) string {
+	if skew <= 0 {
+		return "0"
+	}
+	return fmt.Sprintf("(timestamp > addSeconds(received_at, %[1]d) OR timestamp < subtractSeconds(received_at, %[1]d))",
+		int64(skew.Seconds()))
+}
+
+// clickhouseTimestampExpr clamps timestamp to within skew of received_at
+func clickhouseTimestampExpr(skew time.Duration) string {
+	if skew <= 0 {
+		return "timestamp"
+	}
+	return fmt.Sprintf(`multiIf(
+				timestamp > addSeconds(received_at, %[1]d), addSeconds(received_at, %[1]d),
+				timestamp < subtractSeconds(received_at, %[1]d), subtractSeconds(received_at, %[1]d),
+				timestamp)`, int64(skew.Seconds()))
+}
+
+// clickhouseClampedPropsExpr adds the client timestamp of clamped events to props.
+// Props that aren't a JSON object are left alone.
+func clickhouseClampedPropsExpr(skew time.Duration) string {
+	return fmt.Sprintf(`if(NOT %[1]s OR NOT startsWith(trimBoth(props), '{'), props,
+				concat('{"%[2]s":"', formatDateTime(timestamp, '%%Y-%%m-%%dT%%H:%%i:%%SZ'), '"',
+					if(trimBoth(props) = '{}', '}', concat(',', substring(trimBoth(props), 2)))))`,
+		clickhouseClampedCondition(skew), originalTimestampProp)
+}
+
+// futureCutoff is the timestamp from which events count as future-dated
+func futureCutoff(now time.Time) time.Time {
+	return now.UTC().Add(futureEventSlack)
+}
+
+// duckdbFutureCondition keeps events before the future cutoff
+func duckdbFutureCondition(now time.Time) string {
+	return fmt.Sprintf("epoch_us(timestamp) < %d", futureCutoff(now).UnixMicro())
+}
+
+// clickhouseFutureCondition keeps events before the future cutoff
+func clickhouseFutureCondition(now time.Time) string {
+	return fmt.Sprintf("timestamp < fromUnixTimestamp64Micro(%d)", futureCutoff(now).UnixMicro())
+}
+
+// postgresFutureCondition keeps events before the future cutoff
+func postgresFutureCondition(now time.Time) string {
+	return "timestamp < " + postgresTimestamp(futureCutoff(now))
+}
+
+// recordTimestampCounts counts the memory table's clamped and future-dated
+// events for Status
+func (s *Store) recordTimestampCounts() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var clamped, future int64
+	err := s.db.QueryRow(fmt.Sprintf(`
+		SELECT
+			count(*) FILTER (WHERE strpos(props, '"%s"') > 0),
+			count(*) FILTER (WHERE NOT (%s))
+		FROM %s
+	`, originalTimestampProp, duckdbFutureCondition(time.Now()), s.snapshot().table)).Scan(&clamped, &future)
+	if err != nil {
+		return err
+	}
+	s.setStatus(func(st *StoreStatus) {
+		st.ClampedEvents, st.FutureEvents = clamped, future
+	})
+	return nil
+}
+
+// recordTimestampCounts counts the events table's clamped and future-dated
+// events for Status
+func (s *ClickHouseStore) recordTimestampCounts(ctx context.Context) error {
+	var clamped, future uint64
+	err := s.conn.QueryRow(ctx, fmt.Sprintf(`
+		SELECT
+			countIf(position(props, '"%s"') > 0),
+			countIf(NOT (%s))
+		FROM events
+	`, originalTimestampProp, clickhouseFutureCondition(time.Now()))).Scan(&clamped, &future)
+	if err != nil {
+		return err
+	}
+	s.statusMu.Lock()
+	s.clampedEvents, s.futureEvents = int64(clamped), int64(future)
+	s.statusMu.Unlock()
+	return nil
+}
@@ -0,0 +1,137 @@
+package stats
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampRules_Skew(t *testing.T) {
+	for _, tt := range []struct {
+		skew, want time.Duration
+	}{
+		{0, DefaultTimestampSkew},
+		{time.Hour, time.Hour},
+		{-time.Second, 0},
+	} {
+		if got := (TimestampRules{Skew: tt.skew}).skew(); got != tt.want {
+			t.Errorf("skew of %v = %v, want %v", tt.skew, got, tt.want)
+		}
+	}
+}
+
+func TestStore_ClampsSkewedTimestampsOnLoad(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	skewed := time.Date(2037, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := seedStore(t, now,
+		seedEvent{VisitorID: "future", At: skewed, ReceivedAt: now, Props: `{"tag":"a"}`},
+		seedEvent{VisitorID: "past", At: now.AddDate(-3, 0, 0), ReceivedAt: now},
+		seedEvent{VisitorID: "close", At: now.Add(-47 * time.Hour), ReceivedAt: now},
+	)
+
+	rows, err := s.db.Query(`SELECT visitor_id, timestamp, props, props_tag FROM events`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[string]time.Time)
+	props := make(map[string]string)
+	for rows.Next() {
+		var visitor, p string
+		var tag *string
+		var ts time.Time
+		if err := rows.Scan(&visitor, &ts, &p, &tag); err != nil {
+			t.Fatal(err)
+		}
+		got[visitor], props[visitor] = ts.UTC(), p
+		if visitor == "future" && (tag == nil || *tag != "a") {
+			t.Errorf("props_tag of the clamped event = %v, want a", tag)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := now.Add(DefaultTimestampSkew); !got["future"].Equal(want) {
+		t.Errorf("future event at %v, want clamped to %v", got["future"], want)
+	}
+	if want := now.Add(-DefaultTimestampSkew); !got["past"].Equal(want) {
+		t.Errorf("ancient event at %v, want clamped to %v", got["past"], want)
+	}
+	if want := now.Add(-47 * time.Hour); !got["close"].Equal(want) {
+		t.Errorf("event within the skew at %v, want %v", got["close"], want)
+	}
+	if want := `{"original_timestamp":"2037-01-01T00:00:00Z","tag":"a"}`; props["future"] != want {
+		t.Errorf("props of the future event = %s, want %s", props["future"], want)
+	}
+	if want := `{"original_timestamp":"2021-03-01T12:00:00Z"}`; props["past"] != want {
+		t.Errorf("props of the ancient event = %s, want %s", props["past"], want)
+	}
+	if props["close"] != "{}" {
+		t.Errorf("props of the event within the skew = %s, want them untouched", props["close"])
+	}
+
+	if err := s.recordTimestampCounts(); err != nil {
+		t.Fatal(err)
+	}
+	// The seeded events are long past, so the clamped one isn't ahead of now
+	if st := s.Status(); st.ClampedEvents != 2 || st.FutureEvents != 0 {
+		t.Errorf("status = %+v, want 2 clamped and no future events", st)
+	}
+}
+
+func TestStore_ExcludesFutureEvents(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	// Received in the future too, as by a skewed server clock, so no clamping applies
+	future := now.Add(30 * 24 * time.Hour)
+	s := seedStore(t, now,
+		seedEvent{VisitorID: "v1", Ago: time.Hour},
+		seedEvent{VisitorID: "v2", At: now.Add(time.Hour)},
+		seedEvent{VisitorID: "v3", At: future},
+	)
+	ctx := WithFilters(context.Background(), Filters{})
+	from, to := now.Add(-24*time.Hour), future.Add(time.Hour)
+
+	o, err := s.GetOverview(ctx, fixtureDomain, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 3 {
+		t.Errorf("pageviews = %d, want 3 with future events kept", o.Pageviews)
+	}
+
+	s.timestamps.ExcludeFuture = true
+	if o, err = s.GetOverview(ctx, fixtureDomain, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if o.Pageviews != 2 || o.UniqueVisitors != 2 {
+		t.Errorf("overview = %+v, want the event a month ahead left out", o)
+	}
+	if src := s.tableSource(s.snapshot(), from, to); !strings.Contains(src, "epoch_us(timestamp) <") {
+		t.Errorf("tableSource = %s, want the future cutoff", src)
+	}
+
+	if err := s.recordTimestampCounts(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.FutureEvents != 1 || st.ClampedEvents != 0 {
+		t.Errorf("status = %+v, want 1 future and no clamped events", st)
+	}
+}
+
+func TestClickHouseTimestampExprs(t *testing.T) {
+	if got := clickhouseTimestampExpr(0); got != "timestamp" {
+		t.Errorf("clamping off = %s, want the plain column", got)
+	}
+	if got := clickhouseClampedCondition(48 * time.Hour); !strings.Contains(got, "addSeconds(received_at, 172800)") {
+		t.Errorf("condition = %s, want the skew in seconds", got)
+	}
+	s := &ClickHouseStore{timestamps: TimestampRules{ExcludeFuture: true}, propColumns: true}
+	if src := s.s3Source(); !strings.Contains(src, "props_") || !strings.Contains(src, "fromUnixTimestamp64Micro") {
+		t.Errorf("s3Source = %s, want materialized columns and the future cutoff", src)
+	}
+	if src := (&ClickHouseStore{}).s3Source(); src != "events" {
+		t.Errorf("s3Source = %s, want the plain table", src)
+	}
+}
@@ -0,0 +1,126 @@
+package stats
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxVisitorIDLen caps the visitor ids an erasure accepts
+const MaxVisitorIDLen = 255
+
+// Tombstones are the visitors whose events projects had erased. Stored events
+// are deleted by EraseVisitor; loads and syncs leave the visitors out, since
+// the parquet files in S3 still hold their events. It is shared between the
+// stores and auth, which reloads it.
+type Tombstones struct {
+	mu       sync.RWMutex
+	visitors map[string][]string
+	// version changes with every update, so a load that started before one can
+	// tell it missed it
+	version uint64
+}
+
+// NewTombstones returns an empty set
+func NewTombstones() *Tombstones {
+	return &Tombstones{}
+}
+
+// Set replaces the tombstones with visitors, which maps domains to visitor ids
+func (t *Tombstones) Set(visitors map[string][]string) {
+	t.mu.Lock()
+	t.visitors = visitors
+	t.version++
+	t.mu.Unlock()
+}
+
+// Add tombstones one visitor, ahead of the next reload
+func (t *Tombstones) Add(domain, visitorID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if slices.Contains(t.visitors[domain], visitorID) {
+		return
+	}
+	visitors := make(map[string][]string, len(t.visitors)+1)
+	for d, ids := range t.visitors {
+		visitors[d] = ids
+	}
+	visitors[domain] = append(slices.Clone(visitors[domain]), visitorID)
+	t.visitors = visitors
+	t.version++
+}
+
+// snapshot returns the tombstones in domain order and their version
+func (t *Tombstones) snapshot() (domains []string, visitors [][]string, version uint64) {
+	if t == nil {
+		return nil, nil, 0
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for d := range t.visitors {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		visitors = append(visitors, t.visitors[d])
+	}
+	return domains, visitors, t.version
+}
+
+// condition renders a condition true for events of tombstoned visitors, or ""
+// when there are none, and the version it reflects
+func (t *Tombstones) condition(quote func(string) string) (string, uint64) {
+	domains, visitors, version := t.snapshot()
+	var b strings.Builder
+	for i, d := range domains {
+		if len(visitors[i]) == 0 {
+			continue
+		}
+		if b.Len() == 0 {
+			b.WriteString("CASE domain")
+		}
+		quoted := make([]string, len(visitors[i]))
+		for j, v := range visitors[i] {
+			quoted[j] = quote(v)
+		}
+		fmt.Fprintf(&b, " WHEN %s THEN COALESCE(visitor_id, '') IN (%s)", quote(d), strings.Join(quoted, ", "))
+	}
+	if b.Len() == 0 {
+		return "", version
+	}
+	b.WriteString(" ELSE false END")
+	return b.String(), version
+}
+
+// erased reports whether visitorID of domain is tombstoned, for stores that
+// leave the visitors out event by event
+func (t *Tombstones) erased(domain, visitorID string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return slices.Contains(t.visitors[domain], visitorID)
+}
+
+// changedSince reports whether the tombstones changed after version
+func (t *Tombstones) changedSince(version uint64) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.version != version
+}
+
+// exclude wraps a scan so tombstoned visitors are left out, returning the
+// version of the tombstones applied
+func (t *Tombstones) exclude(scan string, quote func(string) string) (string, uint64) {
+	cond, version := t.condition(quote)
+	if cond == "" {
+		return scan, version
+	}
+	return fmt.Sprintf("(SELECT * FROM %s WHERE NOT (%s))", scan, cond), version
+}
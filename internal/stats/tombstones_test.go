@@ -0,0 +1,132 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTombstones_Condition(t *testing.T) {
+	var tombstones *Tombstones
+	if cond, _ := tombstones.condition(duckdbQuote); cond != "" {
+		t.Errorf("nil tombstones: %q", cond)
+	}
+
+	tombstones = NewTombstones()
+	tombstones.Set(map[string][]string{"b.com": {"it's"}, "a.com": {"v1", `back\slash`}, "c.com": {}})
+	got, version := tombstones.condition(clickhouseQuote)
+	want := `CASE domain WHEN 'a.com' THEN COALESCE(visitor_id, '') IN ('v1', 'back\\slash') WHEN 'b.com' THEN COALESCE(visitor_id, '') IN ('it\'s') ELSE false END`
+	if got != want {
+		t.Errorf("condition =\n%s\nwant\n%s", got, want)
+	}
+	if got, _ := tombstones.condition(duckdbQuote); !strings.Contains(got, `'it''s'`) {
+		t.Errorf("duckdb condition = %s", got)
+	}
+
+	tombstones.Add("b.com", "it's")
+	if tombstones.changedSince(version) {
+		t.Error("adding a tombstoned visitor again changed the version")
+	}
+	tombstones.Add("d.com", "v9")
+	if !tombstones.changedSince(version) {
+		t.Error("Add kept the version")
+	}
+	if got, _ := tombstones.condition(duckdbQuote); !strings.Contains(got, `WHEN 'd.com' THEN COALESCE(visitor_id, '') IN ('v9')`) {
+		t.Errorf("condition after Add = %s", got)
+	}
+}
+
+func TestStore_EraseVisitor_Resync(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	path := filepath.Join(t.TempDir(), "events.parquet")
+	_, err = db.Exec(`
+		COPY (
+			SELECT * FROM (VALUES
+				('example.com', 'v1', 'pageview'),
+				('example.com', 'v1', 'signup'),
+				('example.com', 'v2', 'pageview'),
+				('other.com', 'v1', 'pageview'),
+				('example.com', NULL, 'pageview')
+			) t(domain, visitor_id, name)
+			CROSS JOIN (SELECT '' AS url, '/' AS pathname, '' AS referrer, '{}' AS props, '' AS country, '' AS browser,
+				'' AS os, '' AS device, TIMESTAMP '2024-01-02 12:00:00' AS timestamp, TIMESTAMP '2024-01-02 12:00:00' AS received_at)
+		) TO '` + path + `' (FORMAT PARQUET)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tombstones := NewTombstones()
+	s := withState(&Store{db: db, parquetPath: path, tombstones: tombstones}, storeSnapshot{ready: true})
+	ctx := WithFilters(context.Background(), Filters{})
+	from, to := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+	events := func(domain string) int64 {
+		t.Helper()
+		o, err := s.GetOverview(ctx, domain, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o.Events
+	}
+
+	if err := s.refreshMemoryTable(); err != nil {
+		t.Fatal(err)
+	}
+	if n := events("example.com"); n != 4 {
+		t.Fatalf("example.com events before erasure = %d, want 4", n)
+	}
+
+	tombstones.Add("example.com", "v1")
+	n, err := s.EraseVisitor(context.Background(), "example.com", "v1")
+	if err != nil || n != 2 {
+		t.Errorf("EraseVisitor = %d, %v; want 2", n, err)
+	}
+	if n := events("example.com"); n != 2 {
+		t.Errorf("example.com events after erasure = %d, want 2", n)
+	}
+
+	// The parquet file still holds v1; the next load must leave them out
+	if err := s.refreshMemoryTable(); err != nil {
+		t.Fatal(err)
+	}
+	if n := events("example.com"); n != 2 {
+		t.Errorf("example.com events after resync = %d, want 2", n)
+	}
+	// The same visitor id on another domain is a different visitor
+	if n := events("other.com"); n != 1 {
+		t.Errorf("other.com events = %d, want 1", n)
+	}
+	if n, err := s.EraseVisitor(context.Background(), "example.com", "v1"); err != nil || n != 0 {
+		t.Errorf("erasing again = %d, %v; want 0", n, err)
+	}
+}
+
+func TestStore_SwapAppliesLateTombstones(t *testing.T) {
+	s := seedStore(t, time.Now(),
+		seedEvent{VisitorID: "v1"},
+		seedEvent{VisitorID: "v2"},
+	)
+	s.tombstones = NewTombstones()
+	if _, err := s.db.Exec(`CREATE TABLE events_staging AS SELECT * FROM events`); err != nil {
+		t.Fatal(err)
+	}
+	// Tombstoned while staging loaded with version 0
+	s.tombstones.Add(fixtureDomain, "v1")
+	if err := s.swapMemoryTable(0, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	var visitors string
+	if err := s.db.QueryRow(`SELECT string_agg(DISTINCT visitor_id, ',') FROM events`).Scan(&visitors); err != nil {
+		t.Fatal(err)
+	}
+	if visitors != "v2" {
+		t.Errorf("visitors after swap = %q, want v2", visitors)
+	}
+}
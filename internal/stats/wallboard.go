@@ -0,0 +1,278 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// wallboardStreamPath serves wallboard counters; like the live events
+	// stream it is exempt from request deadlines
+	wallboardStreamPath = "/api/stats/wallboard/stream"
+	// DefaultWallboardInterval is how often wallboard counters are pushed
+	// when no interval is configured
+	DefaultWallboardInterval = 10 * time.Second
+	// minWallboardInterval keeps a configured interval from hammering the store
+	minWallboardInterval = 5 * time.Second
+	// maxWallboardStreamsPerDomain caps concurrent wallboard streams per domain
+	maxWallboardStreamsPerDomain = 20
+	// wallboardActiveWindow is how recently a visitor was seen to count as active
+	wallboardActiveWindow = 5 * time.Minute
+	// wallboardSparkBuckets splits the last hour into wallboardActiveWindow buckets
+	wallboardSparkBuckets = int(time.Hour / wallboardActiveWindow)
+	// wallboardComputeTimeout bounds the store queries of one push
+	wallboardComputeTimeout = 30 * time.Second
+)
+
+// errWallboardStreamLimit is returned when a domain has its most wallboard streams open
+var errWallboardStreamLimit = errors.New("too many wallboard streams for this domain, retry later")
+
+// WallboardCounters are the figures pushed to wallboards of a domain
+type WallboardCounters struct {
+	At             time.Time `json:"at"`
+	ActiveVisitors int64     `json:"active_visitors"`
+	TodayPageviews int64     `json:"today_pageviews"`
+	// Sparkline is the pageviews of the last hour by wallboardActiveWindow, oldest first
+	Sparkline []TimeSeriesPoint `json:"sparkline"`
+}
+
+// wallboardCaster computes one domain's counters for all its streams
+type wallboardCaster struct {
+	subs map[chan WallboardCounters]struct{}
+	last *WallboardCounters
+	stop context.CancelFunc
+}
+
+// wallboardHub runs a caster per domain with open streams. Casters start
+// with their domain's first stream and stop with its last.
+type wallboardHub struct {
+	mu       sync.Mutex
+	interval time.Duration
+	compute  func(ctx context.Context, domain string, now time.Time) (WallboardCounters, error)
+	domains  map[string]*wallboardCaster
+	closed   bool
+	done     chan struct{}
+}
+
+func newWallboardHub(interval time.Duration, compute func(context.Context, string, time.Time) (WallboardCounters, error)) *wallboardHub {
+	return &wallboardHub{interval: interval, compute: compute, domains: make(map[string]*wallboardCaster), done: make(chan struct{})}
+}
+
+// subscribe opens a stream of domain's counters, returning the latest ones
+// already computed
+func (hub *wallboardHub) subscribe(domain string) (chan WallboardCounters, *WallboardCounters, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return nil, nil, errWallboardStreamLimit
+	}
+	c := hub.domains[domain]
+	if c == nil {
+		ctx, stop := context.WithCancel(context.Background())
+		c = &wallboardCaster{subs: make(map[chan WallboardCounters]struct{}), stop: stop}
+		hub.domains[domain] = c
+		go hub.run(ctx, domain, c)
+	}
+	if len(c.subs) >= maxWallboardStreamsPerDomain {
+		return nil, nil, errWallboardStreamLimit
+	}
+	// Streams only need the newest counters, so one is buffered and replaced
+	ch := make(chan WallboardCounters, 1)
+	c.subs[ch] = struct{}{}
+	return ch, c.last, nil
+}
+
+// unsubscribe closes a stream opened by subscribe, stopping the domain's
+// caster with its last stream
+func (hub *wallboardHub) unsubscribe(domain string, ch chan WallboardCounters) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	c := hub.domains[domain]
+	if c == nil {
+		return
+	}
+	delete(c.subs, ch)
+	if len(c.subs) == 0 {
+		c.stop()
+		delete(hub.domains, domain)
+	}
+}
+
+// run computes domain's counters now and every interval until ctx is done
+func (hub *wallboardHub) run(ctx context.Context, domain string, c *wallboardCaster) {
+	ticker := time.NewTicker(hub.interval)
+	defer ticker.Stop()
+	for {
+		qctx, cancel := context.WithTimeout(ctx, wallboardComputeTimeout)
+		counters, err := hub.compute(qctx, domain, time.Now())
+		cancel()
+		if err == nil {
+			hub.publish(c, counters)
+		} else if ctx.Err() == nil {
+			log.Printf("stats: wallboard counters of %s: %v", domain, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-hub.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish hands counters to c's streams, replacing any they haven't read yet
+func (hub *wallboardHub) publish(c *wallboardCaster, counters WallboardCounters) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	c.last = &counters
+	for ch := range c.subs {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- counters
+	}
+}
+
+// close ends every stream; new ones are refused
+func (hub *wallboardHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if !hub.closed {
+		hub.closed = true
+		close(hub.done)
+	}
+}
+
+// EnableWallboard serves wallboard streams, pushing each domain's counters
+// every interval, at least minWallboardInterval; 0 uses DefaultWallboardInterval
+func (h *Handler) EnableWallboard(interval time.Duration) {
+	if h.store == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultWallboardInterval
+	}
+	h.wallboard = newWallboardHub(max(interval, minWallboardInterval), h.wallboardCounters)
+}
+
+// wallboardCounters queries domain's counters as of now
+func (h *Handler) wallboardCounters(ctx context.Context, domain string, now time.Time) (WallboardCounters, error) {
+	ctx, _, err := h.privacyContext(WithFilters(ctx, Filters{}), domain, "")
+	if err != nil {
+		return WallboardCounters{}, err
+	}
+	if ctx, _, err = h.aliasContext(ctx, domain, ""); err != nil {
+		return WallboardCounters{}, err
+	}
+	if ctx, _, err = h.domainMatchContext(ctx, domain, ""); err != nil {
+		return WallboardCounters{}, err
+	}
+
+	y, m, d := now.UTC().Date()
+	today, err := h.store.GetOverview(ctx, domain, time.Date(y, m, d, 0, 0, 0, 0, time.UTC), now)
+	if err != nil {
+		return WallboardCounters{}, err
+	}
+	// The sparkline and the active visitors come from one read of the last hour
+	start := now.Add(-time.Duration(wallboardSparkBuckets) * wallboardActiveWindow)
+	buckets, err := h.store.GetActivity(ctx, domain, start, now, wallboardActiveWindow)
+	if err != nil {
+		return WallboardCounters{}, err
+	}
+	counters := WallboardCounters{At: now.UTC(), TodayPageviews: today.Pageviews, Sparkline: make([]TimeSeriesPoint, wallboardSparkBuckets)}
+	for i := range counters.Sparkline {
+		counters.Sparkline[i].Time = start.Add(time.Duration(i) * wallboardActiveWindow).UTC().Format(time.RFC3339)
+	}
+	for _, b := range buckets {
+		i := int(b.Start.Sub(start) / wallboardActiveWindow)
+		if i < 0 || i >= wallboardSparkBuckets {
+			continue
+		}
+		counters.Sparkline[i].Value = b.Pageviews
+		// The newest bucket spans wallboardActiveWindow up to now
+		if i == wallboardSparkBuckets-1 {
+			counters.ActiveVisitors = b.UniqueVisitors
+		}
+	}
+	return counters, nil
+}
+
+// HandleWallboardStream streams a domain's wallboard counters as Server-Sent
+// Events, one "counters" message per interval. The counters are computed once
+// per interval however many wallboards show them.
+func (h *Handler) HandleWallboardStream(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil || h.wallboard == nil {
+		writeError(w, nil, http.StatusServiceUnavailable)
+		return
+	}
+
+	domain, _, _, ok := h.requestParams(w, r)
+	if !ok {
+		return
+	}
+
+	ch, last, err := h.wallboard.subscribe(domain)
+	if err != nil {
+		w.Header().Set("Retry-After", "30")
+		writeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	defer h.wallboard.unsubscribe(domain, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	send := func(c WallboardCounters) error {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: counters\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if _, err := io.WriteString(w, "retry: 5000\n\n"); err != nil {
+		return
+	}
+	if last != nil && send(*last) != nil {
+		return
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.wallboard.done:
+			io.WriteString(w, "event: close\ndata: {}\n\n")
+			rc.Flush()
+			return
+		case c := <-ch:
+			if send(c) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCompute counts wallboard computations, each waiting for gate
+type countingCompute struct {
+	calls atomic.Int64
+	gate  chan struct{}
+}
+
+func (c *countingCompute) compute(ctx context.Context, domain string, now time.Time) (WallboardCounters, error) {
+	if c.gate != nil {
+		select {
+		case <-c.gate:
+		case <-ctx.Done():
+			return WallboardCounters{}, ctx.Err()
+		}
+	}
+	n := c.calls.Add(1)
+	return WallboardCounters{At: now, TodayPageviews: n}, nil
+}
+
+func nextCounters(t *testing.T, ch chan WallboardCounters) WallboardCounters {
+	t.Helper()
+	select {
+	case c := <-ch:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for counters")
+	}
+	return WallboardCounters{}
+}
+
+func TestWallboardHub_FanOut(t *testing.T) {
+	c := &countingCompute{gate: make(chan struct{})}
+	hub := newWallboardHub(time.Hour, c.compute)
+	defer hub.close()
+
+	var subs []chan WallboardCounters
+	for range 3 {
+		ch, last, err := hub.subscribe("example.com")
+		if err != nil || last != nil {
+			t.Fatalf("subscribe = %v, last %v", err, last)
+		}
+		subs = append(subs, ch)
+	}
+	other, _, err := hub.subscribe("other.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(c.gate)
+
+	for i, ch := range subs {
+		if got := nextCounters(t, ch); got.TodayPageviews == 0 {
+			t.Errorf("stream %d got %+v", i, got)
+		}
+	}
+	nextCounters(t, other)
+	if n := c.calls.Load(); n != 2 {
+		t.Errorf("computed %d times, want once per domain", n)
+	}
+
+	// A later stream starts from the counters already computed
+	_, last, err := hub.subscribe("example.com")
+	if err != nil || last == nil {
+		t.Errorf("late subscribe = %v, last %v; want the latest counters", err, last)
+	}
+}
+
+func TestWallboardHub_Lifecycle(t *testing.T) {
+	c := &countingCompute{}
+	hub := newWallboardHub(5*time.Millisecond, c.compute)
+	defer hub.close()
+
+	a, _, _ := hub.subscribe("example.com")
+	b, _, _ := hub.subscribe("example.com")
+	nextCounters(t, a)
+	hub.unsubscribe("example.com", a)
+	// The caster keeps running for the remaining stream
+	before := c.calls.Load()
+	nextCounters(t, b)
+	nextCounters(t, b)
+	if c.calls.Load() == before {
+		t.Error("caster stopped with a stream left")
+	}
+
+	hub.unsubscribe("example.com", b)
+	hub.mu.Lock()
+	casters := len(hub.domains)
+	hub.mu.Unlock()
+	if casters != 0 {
+		t.Errorf("%d casters after the last stream closed", casters)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stopped := c.calls.Load()
+	time.Sleep(30 * time.Millisecond)
+	if n := c.calls.Load(); n != stopped {
+		t.Errorf("caster computed %d more times after its last stream closed", n-stopped)
+	}
+
+	// A new stream starts a new caster
+	ch, _, _ := hub.subscribe("example.com")
+	nextCounters(t, ch)
+}
+
+func TestWallboardHub_Limit(t *testing.T) {
+	hub := newWallboardHub(time.Hour, (&countingCompute{}).compute)
+	defer hub.close()
+	for range maxWallboardStreamsPerDomain {
+		if _, _, err := hub.subscribe("example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := hub.subscribe("example.com"); err != errWallboardStreamLimit {
+		t.Errorf("stream over the cap = %v", err)
+	}
+	if _, _, err := hub.subscribe("other.com"); err != nil {
+		t.Errorf("other domain = %v; the cap is per domain", err)
+	}
+}
+
+// activityCountingStore counts overview and activity queries
+type activityCountingStore struct {
+	overviewCountingStore
+	activity *atomic.Int64
+}
+
+func (s activityCountingStore) GetActivity(ctx context.Context, domain string, from, to time.Time, step time.Duration) ([]ActivityBucket, error) {
+	s.activity.Add(1)
+	return []ActivityBucket{{Start: to.Add(-step), Pageviews: 4, UniqueVisitors: 2}}, nil
+}
+
+func TestWallboardCounters(t *testing.T) {
+	now := time.Date(2026, 5, 4, 12, 0, 0, 0, time.UTC)
+	s := seedStore(t, now,
+		seedEvent{VisitorID: "v1", Ago: time.Minute},
+		seedEvent{VisitorID: "v2", Ago: 2 * time.Minute},
+		seedEvent{VisitorID: "v1", Ago: 7 * time.Minute},
+		seedEvent{VisitorID: "v3", Ago: 2 * time.Hour},
+	)
+	rec := &QueryRecorder{}
+	h := NewHandler(s)
+	c, err := h.wallboardCounters(WithQueryRecorder(context.Background(), rec), fixtureDomain, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TodayPageviews != 4 || c.ActiveVisitors != 2 || len(c.Sparkline) != wallboardSparkBuckets {
+		t.Fatalf("counters = %+v", c)
+	}
+	last := c.Sparkline[wallboardSparkBuckets-1]
+	if last.Value != 2 || last.Time != now.Add(-wallboardActiveWindow).Format(time.RFC3339) || c.Sparkline[wallboardSparkBuckets-2].Value != 1 {
+		t.Errorf("sparkline = %+v", c.Sparkline)
+	}
+	// Today's pageviews, then the sparkline and active visitors in one read
+	if n := len(rec.Queries()); n != 2 {
+		t.Errorf("%d queries, want 2", n)
+	}
+}
+
+func TestHandleWallboardStream(t *testing.T) {
+	var overviews, activity atomic.Int64
+	h := NewHandler(activityCountingStore{overviewCountingStore{overviews: &overviews}, &activity})
+	h.EnableWallboard(time.Millisecond)
+	if h.wallboard.interval != minWallboardInterval {
+		t.Errorf("interval = %v, want the %v minimum", h.wallboard.interval, minWallboardInterval)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleWallboardStream))
+	defer srv.Close()
+
+	open := func() <-chan sseEvent {
+		resp, err := http.Get(srv.URL + wallboardStreamPath + "?domain=example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != "text/event-stream" {
+			t.Fatalf("status = %d, content type = %q", resp.StatusCode, ct)
+		}
+		return readSSE(t, resp)
+	}
+	first, second := open(), open()
+	for _, events := range []<-chan sseEvent{first, second} {
+		ev := nextSSE(t, events)
+		var c WallboardCounters
+		if err := json.Unmarshal([]byte(ev.data), &c); err != nil || ev.event != "counters" {
+			t.Fatalf("event = %+v: %v", ev, err)
+		}
+		if c.TodayPageviews != 3 || c.ActiveVisitors != 2 || len(c.Sparkline) != wallboardSparkBuckets || c.Sparkline[wallboardSparkBuckets-1].Value != 4 {
+			t.Errorf("counters = %+v", c)
+		}
+	}
+	// One push queries today and the last hour once, whatever the streams
+	if o, a := overviews.Load(), activity.Load(); o != 1 || a != 1 {
+		t.Errorf("%d overview and %d activity queries, want 1 each", o, a)
+	}
+
+	h.CloseLiveStreams()
+	if ev := nextSSE(t, first); ev.event != "close" {
+		t.Errorf("after shutdown got %+v, want close", ev)
+	}
+}
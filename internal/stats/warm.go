@@ -0,0 +1,235 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPeriod is what an empty period param means
+const defaultPeriod = "7d"
+
+// warmPagesLimit matches the pages endpoint's default limit
+const warmPagesLimit = 10
+
+// WarmConfig bounds cache warming after a store refresh
+type WarmConfig struct {
+	// MaxDomains caps how many of the busiest domains are warmed
+	MaxDomains int
+	// Concurrency is the number of domains warmed in parallel
+	Concurrency int
+	// Budget is the total time allowed per warm; unfinished domains are skipped
+	Budget time.Duration
+	// ActiveWindow is how far back a domain needs traffic to count as active
+	ActiveWindow time.Duration
+}
+
+// DefaultWarmConfig keeps warming well inside the shortest refresh interval
+var DefaultWarmConfig = WarmConfig{
+	MaxDomains:   50,
+	Concurrency:  4,
+	Budget:       60 * time.Second,
+	ActiveWindow: 24 * time.Hour,
+}
+
+// WarmStats reports the last cache warm for the debug endpoint
+type WarmStats struct {
+	Enabled       bool    `json:"enabled"`
+	Runs          int64   `json:"runs"`
+	LastRun       string  `json:"last_run,omitempty"`
+	LastDuration  float64 `json:"last_duration_ms"`
+	DomainsWarmed int     `json:"domains_warmed"`
+	DomainsFailed int     `json:"domains_failed"`
+	LastError     string  `json:"last_error,omitempty"`
+}
+
+// cacheWarmer precomputes the default dashboard for active domains
+type cacheWarmer struct {
+	cfg     WarmConfig
+	running atomic.Bool
+
+	mu    sync.Mutex
+	stats WarmStats
+}
+
+// overviewCacheKey is the cache key of the overview endpoint
+func overviewCacheKey(domain, period, filterKey, spamKey string) string {
+	return fmt.Sprintf("overview:%s:%s:%s:%s", domain, periodKey(period), filterKey, spamKey)
+}
+
+// pageviewsCacheKey is the cache key of the pageviews endpoint
+func pageviewsCacheKey(domain, period, interval, filterKey string) string {
+	return fmt.Sprintf("pageviews:%s:%s:%s:%s", domain, periodKey(period), interval, filterKey)
+}
+
+// pagesCacheKey is the cache key of the pages endpoint
+func pagesCacheKey(domain, period string, limit int, filterKey string) string {
+	return fmt.Sprintf("pages:%s:%s:%d:%s", domain, periodKey(period), limit, filterKey)
+}
+
+// periodKey makes an omitted period share cache entries with the default
+func periodKey(period string) string {
+	if period == "" {
+		return defaultPeriod
+	}
+	return period
+}
+
+// seriesInterval picks hourly points up to a week and daily points beyond
+func seriesInterval(from, to time.Time) string {
+	if to.Sub(from) > 7*24*time.Hour {
+		return "day"
+	}
+	return "hour"
+}
+
+// periodInterval is seriesInterval for a period value: calendar months get
+// daily points even early in the month, and last_12_months weekly points
+func periodInterval(period string, from, to time.Time) string {
+	switch period {
+	case "this_month", "last_month":
+		return "day"
+	case "last_12_months":
+		return "week"
+	}
+	return seriesInterval(from, to)
+}
+
+// EnableCacheWarming recomputes the default 7d overview, pageviews and top pages
+// of the busiest domains after every store refresh
+func (h *Handler) EnableCacheWarming(cfg WarmConfig) {
+	if h.store == nil {
+		return
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultWarmConfig.Concurrency
+	}
+	if cfg.Budget <= 0 {
+		cfg.Budget = DefaultWarmConfig.Budget
+	}
+	if cfg.ActiveWindow <= 0 {
+		cfg.ActiveWindow = DefaultWarmConfig.ActiveWindow
+	}
+	h.warmer = &cacheWarmer{cfg: cfg}
+	h.warmer.stats.Enabled = true
+	h.store.OnRefresh(h.WarmCache)
+}
+
+// WarmCache runs one warm pass; a pass already in progress makes this a no-op
+func (h *Handler) WarmCache() {
+	wm := h.warmer
+	if wm == nil || !wm.running.CompareAndSwap(false, true) {
+		return
+	}
+	defer wm.running.Store(false)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), wm.cfg.Budget)
+	defer cancel()
+
+	warmed, failed, err := h.warmDomains(ctx, wm.cfg, start)
+
+	elapsed := time.Since(start)
+	wm.mu.Lock()
+	wm.stats.Runs++
+	wm.stats.LastRun = start.UTC().Format(time.RFC3339)
+	wm.stats.LastDuration = float64(elapsed.Microseconds()) / 1000
+	wm.stats.DomainsWarmed = warmed
+	wm.stats.DomainsFailed = failed
+	wm.stats.LastError = ""
+	if err != nil {
+		wm.stats.LastError = err.Error()
+	}
+	wm.mu.Unlock()
+
+	log.Printf("Cache warm: %d domains warmed, %d failed in %v", warmed, failed, elapsed)
+}
+
+// warmDomains fans active domains out to cfg.Concurrency workers until ctx ends
+func (h *Handler) warmDomains(ctx context.Context, cfg WarmConfig, now time.Time) (warmed, failed int, err error) {
+	domains, err := h.store.GetActiveDomains(ctx, now.Add(-cfg.ActiveWindow), cfg.MaxDomains)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	jobs := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range jobs {
+				werr := h.warmDomain(ctx, domain)
+				mu.Lock()
+				if werr != nil {
+					failed++
+				} else {
+					warmed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, domain := range domains {
+		select {
+		case jobs <- domain:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return warmed, failed, ctx.Err()
+}
+
+// warmDomain computes and caches the unfiltered default-period dashboard for one domain
+func (h *Handler) warmDomain(ctx context.Context, domain string) error {
+	from, to, err := PeriodRange(defaultPeriod, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	// Warm the keys unfiltered requests use, which carry the domain's privacy mode
+	ctx, filterKey, err := h.privacyContext(withBudgetExempt(WithFilters(ctx, Filters{})), domain, "")
+	if err != nil {
+		return err
+	}
+
+	overviewCtx, spamKey := h.spamContext(ctx)
+	overview, err := h.store.GetOverview(overviewCtx, domain, from, to)
+	if err != nil {
+		return err
+	}
+	h.cache.Set(overviewCacheKey(domain, defaultPeriod, filterKey, spamKey), overview)
+
+	interval := seriesInterval(from, to)
+	points, err := h.store.GetPageviewsTimeSeries(ctx, domain, from, to, interval)
+	if err != nil {
+		return err
+	}
+	h.cache.Set(pageviewsCacheKey(domain, defaultPeriod, interval, filterKey), fillSeries(points, from, to, interval))
+
+	pagesCtx, counter := withGroupCounter(ctx)
+	pages, err := h.store.GetTopPages(pagesCtx, domain, from, to, warmPagesLimit)
+	if err != nil {
+		return err
+	}
+	h.cache.Set(pagesCacheKey(domain, defaultPeriod, warmPagesLimit, filterKey), newBreakdownResult(pages, counter.count()))
+	return nil
+}
+
+// warmStats returns the last warm result, or a disabled marker
+func (h *Handler) warmStats() WarmStats {
+	if h.warmer == nil {
+		return WarmStats{}
+	}
+	h.warmer.mu.Lock()
+	defer h.warmer.mu.Unlock()
+	return h.warmer.stats
+}
@@ -0,0 +1,101 @@
+package stats
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// warmStore counts queries and serves fixed results
+type warmStore struct {
+	fakeStore
+	domains   []string
+	overviews atomic.Int64
+	delay     time.Duration
+	onRefresh func()
+}
+
+func (s *warmStore) OnRefresh(fn func()) { s.onRefresh = fn }
+
+func (s *warmStore) GetActiveDomains(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	if len(s.domains) > limit {
+		return s.domains[:limit], nil
+	}
+	return s.domains, nil
+}
+
+func (s *warmStore) GetOverview(ctx context.Context, domain string, from, to time.Time) (*Overview, error) {
+	s.overviews.Add(1)
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &Overview{Pageviews: 42}, nil
+}
+
+func (s *warmStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
+	return []TimeSeriesPoint{{Time: "2024-01-01 00:00", Value: 1}}, nil
+}
+
+func (s *warmStore) GetTopPages(ctx context.Context, domain string, from, to time.Time, limit int) ([]TopItem, error) {
+	return []TopItem{{Name: "/", Count: 1}}, nil
+}
+
+func TestWarmCache_ServesFromCache(t *testing.T) {
+	store := &warmStore{domains: []string{"a.com", "b.com", "c.com"}}
+	h := NewHandler(store)
+	h.EnableCacheWarming(WarmConfig{MaxDomains: 2})
+	if store.onRefresh == nil {
+		t.Fatal("warming not registered with the store")
+	}
+
+	store.onRefresh()
+	if got := store.overviews.Load(); got != 2 {
+		t.Fatalf("warmed %d overviews, want 2 (MaxDomains)", got)
+	}
+
+	// Explicit and omitted default period both hit the warmed entry
+	for _, query := range []string{"?domain=a.com&period=7d", "?domain=b.com"} {
+		w := httptest.NewRecorder()
+		h.HandleOverview(w, httptest.NewRequest("GET", "/api/stats/overview"+query, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: status = %d", query, w.Code)
+		}
+	}
+	if got := store.overviews.Load(); got != 2 {
+		t.Errorf("overview queried %d times, want 2 (served from cache)", got)
+	}
+
+	st := h.warmStats()
+	if !st.Enabled || st.Runs != 1 || st.DomainsWarmed != 2 || st.DomainsFailed != 0 {
+		t.Errorf("warm stats = %+v", st)
+	}
+}
+
+func TestWarmCache_Budget(t *testing.T) {
+	store := &warmStore{domains: []string{"a.com", "b.com", "c.com", "d.com"}, delay: time.Second}
+	h := NewHandler(store)
+	h.EnableCacheWarming(WarmConfig{MaxDomains: 10, Concurrency: 1, Budget: 20 * time.Millisecond})
+
+	start := time.Now()
+	h.WarmCache()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("warm took %v, budget was 20ms", elapsed)
+	}
+
+	st := h.warmStats()
+	if st.DomainsWarmed != 0 || st.LastError == "" {
+		t.Errorf("warm stats = %+v, want nothing warmed and a deadline error", st)
+	}
+}
+
+func TestWarmCache_Disabled(t *testing.T) {
+	h := NewHandler(&warmStore{})
+	h.WarmCache()
+	if st := h.warmStats(); st.Enabled || st.Runs != 0 {
+		t.Errorf("warm stats = %+v, want disabled", st)
+	}
+}
@@ -0,0 +1,81 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+)
+
+// WeekStart is the first day of the week for weekly buckets and the this_week period
+type WeekStart string
+
+const (
+	WeekStartMonday WeekStart = "monday"
+	WeekStartSunday WeekStart = "sunday"
+)
+
+// ParseWeekStart parses a week_start value; "" means Monday
+func ParseWeekStart(s string) (WeekStart, error) {
+	switch WeekStart(s) {
+	case "", WeekStartMonday:
+		return WeekStartMonday, nil
+	case WeekStartSunday:
+		return WeekStartSunday, nil
+	}
+	return WeekStartMonday, fmt.Errorf("unknown week_start %q, valid options: monday, sunday", s)
+}
+
+func (ws WeekStart) weekday() time.Weekday {
+	if ws == WeekStartSunday {
+		return time.Sunday
+	}
+	return time.Monday
+}
+
+// StartOfWeek returns midnight on the first day of the week containing t, in
+// t's location. Calendar arithmetic keeps it at local midnight across DST changes.
+func (ws WeekStart) StartOfWeek(t time.Time) time.Time {
+	back := (int(t.Weekday()) - int(ws.weekday()) + 7) % 7
+	y, m, d := t.Date()
+	return time.Date(y, m, d-back, 0, 0, 0, 0, t.Location())
+}
+
+// weekBoundaries returns the starts of the weeks overlapping [from, to) in loc,
+// followed by the end of the last one
+func weekBoundaries(from, to time.Time, ws WeekStart, loc *time.Location) []time.Time {
+	start := ws.StartOfWeek(from.In(loc))
+	bounds := []time.Time{start}
+	for start.Before(to) {
+		y, m, d := start.Date()
+		start = time.Date(y, m, d+7, 0, 0, 0, 0, loc)
+		bounds = append(bounds, start)
+	}
+	return bounds
+}
+
+// bucketWeeks sums hourly points, as returned by GetPageviewsTimeSeries, into
+// weeks starting on ws in loc. Each point's Time is the ISO date its week starts
+// on in loc. Weeks without pageviews are kept with zero, as with other intervals.
+func bucketWeeks(points []TimeSeriesPoint, from, to time.Time, ws WeekStart, loc *time.Location) []TimeSeriesPoint {
+	bounds := weekBoundaries(from, to, ws, loc)
+	counts := make([]int64, len(bounds)-1)
+	for _, p := range points {
+		t, err := time.Parse("2006-01-02T15:04", p.Time)
+		if err != nil {
+			continue
+		}
+		for i := range counts {
+			if t.Before(bounds[i+1]) {
+				if !t.Before(bounds[i]) {
+					counts[i] += p.Value
+				}
+				break
+			}
+		}
+	}
+
+	result := make([]TimeSeriesPoint, len(counts))
+	for i, c := range counts {
+		result[i] = TimeSeriesPoint{Time: bounds[i].Format("2006-01-02"), Value: c}
+	}
+	return result
+}
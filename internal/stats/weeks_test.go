@@ -0,0 +1,183 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no tzdata for %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestStartOfWeek(t *testing.T) {
+	wed := time.Date(2024, 3, 13, 15, 0, 0, 0, time.UTC)
+	if got := WeekStartMonday.StartOfWeek(wed); !got.Equal(time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("monday start = %v", got)
+	}
+	if got := WeekStartSunday.StartOfWeek(wed); !got.Equal(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("sunday start = %v", got)
+	}
+	sun := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	if got := WeekStartSunday.StartOfWeek(sun); !got.Equal(sun) {
+		t.Errorf("sunday start of a sunday = %v", got)
+	}
+	if got := WeekStartMonday.StartOfWeek(sun); !got.Equal(time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("monday start of a sunday = %v", got)
+	}
+}
+
+func TestWeekBoundaries_DST(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	// US clocks went forward on Sunday 2024-03-10
+	bounds := weekBoundaries(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC), WeekStartSunday, ny)
+	want := []string{"2024-03-03T05:00:00Z", "2024-03-10T05:00:00Z", "2024-03-17T04:00:00Z"}
+	if len(bounds) != len(want) {
+		t.Fatalf("bounds = %v, want %v", bounds, want)
+	}
+	for i, b := range bounds {
+		if got := b.UTC().Format(time.RFC3339); got != want[i] {
+			t.Errorf("bound %d = %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestBucketWeeks(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	// European clocks went forward on Sunday 2024-03-31, so the week starting
+	// Monday 2024-04-01 starts at 22:00 UTC, not 23:00
+	points := []TimeSeriesPoint{
+		{Time: "2024-03-24T22:00", Value: 1}, // Sunday 23:00 CET, week of 03-18
+		{Time: "2024-03-24T23:00", Value: 2}, // Monday 00:00 CET
+		{Time: "2024-03-31T21:00", Value: 3}, // Sunday 23:00 CEST
+		{Time: "2024-03-31T22:00", Value: 4}, // Monday 00:00 CEST
+	}
+	from := time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC)
+
+	got := bucketWeeks(points, from, to, WeekStartMonday, berlin)
+	want := []TimeSeriesPoint{{"2024-03-18", 1}, {"2024-03-25", 5}, {"2024-04-01", 4}}
+	if len(got) != len(want) {
+		t.Fatalf("weeks = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("week %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// Sunday weeks in UTC start with the late Sunday hours; empty weeks stay in
+	got = bucketWeeks(points, from, to, WeekStartSunday, time.UTC)
+	want = []TimeSeriesPoint{{"2024-03-17", 0}, {"2024-03-24", 3}, {"2024-03-31", 7}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("sunday weeks = %v, want %v", got, want)
+	}
+}
+
+// hourlyStore returns one pageview per requested-interval point, recording the interval
+type hourlyStore struct {
+	fakeStore
+	interval string
+	calls    int
+}
+
+func (s *hourlyStore) GetPageviewsTimeSeries(ctx context.Context, domain string, from, to time.Time, interval string) ([]TimeSeriesPoint, error) {
+	s.interval = interval
+	s.calls++
+	return []TimeSeriesPoint{{Time: from.UTC().Format("2006-01-02T15:00"), Value: 1}}, nil
+}
+
+func TestHandlePageviews_WeekInterval(t *testing.T) {
+	store := &hourlyStore{}
+	h := NewHandler(store)
+
+	w := httptest.NewRecorder()
+	h.HandlePageviews(w, httptest.NewRequest("GET", "/api/stats/pageviews?domain=example.com&period=30d&interval=week&week_start=sunday&tz=UTC", nil))
+	if w.Code != 200 || store.interval != "hour" {
+		t.Fatalf("status = %d, store interval = %q", w.Code, store.interval)
+	}
+	interval, points := decodePageviews(t, w.Body.Bytes())
+	// Every week of the range is listed, the store's one pageview in the first
+	if interval != "week" || len(points) < 5 || points[0].Value != 1 {
+		t.Fatalf("points = %v", points)
+	}
+	for _, p := range points {
+		day, err := time.Parse("2006-01-02", p.Time)
+		if err != nil || day.Weekday() != time.Sunday {
+			t.Errorf("week start = %q, want an ISO Sunday", p.Time)
+		}
+	}
+
+	for _, query := range []string{"interval=fortnight", "interval=week&week_start=friday", "interval=week&tz=Mars/Olympus"} {
+		w := httptest.NewRecorder()
+		h.HandlePageviews(w, httptest.NewRequest("GET", "/api/stats/pageviews?domain=example.com&"+query, nil))
+		if w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestHandlePageviews_PeriodInterval(t *testing.T) {
+	store := &hourlyStore{}
+	h := NewHandler(store)
+
+	for _, tt := range []struct {
+		period, interval, storeInterval string
+		points                          int
+	}{
+		{"yesterday", "hour", "hour", 24},
+		{"this_month", "day", "day", 0},
+		{"last_month", "day", "day", 28},
+		{"last_12_months", "week", "hour", 48},
+	} {
+		w := httptest.NewRecorder()
+		h.HandlePageviews(w, httptest.NewRequest("GET", "/api/stats/pageviews?domain=example.com&period="+tt.period, nil))
+		interval, points := decodePageviews(t, w.Body.Bytes())
+		if w.Code != 200 || interval != tt.interval || store.interval != tt.storeInterval || len(points) < tt.points {
+			t.Errorf("%s: status %d, interval %q, store interval %q, %d points", tt.period, w.Code, interval, store.interval, len(points))
+		}
+		// last_12_months is summed into weeks
+		if tt.period == "last_12_months" && len(points) > 54 {
+			t.Errorf("last_12_months: %d points, want weeks", len(points))
+		}
+	}
+}
+
+func TestHandlePageviews_CalendarCacheKey(t *testing.T) {
+	store := &hourlyStore{}
+	h := NewHandler(store)
+	// The store reports its one pageview at the start of the range, which is
+	// local midnight of yesterday in each zone
+	for i, offset := range []int{0, -5} {
+		w := httptest.NewRecorder()
+		h.HandlePageviews(w, httptest.NewRequest("GET", fmt.Sprintf("/api/stats/pageviews?domain=example.com&period=yesterday&hour_offset=%d", offset), nil))
+		_, points := decodePageviews(t, w.Body.Bytes())
+		yesterday := time.Now().In(time.FixedZone("", offset*60*60)).AddDate(0, 0, -1).Format("2006-01-02")
+		if len(points) != 24 || points[0] != (TimeSeriesPoint{Time: yesterday + "T00:00", Value: 1}) {
+			t.Fatalf("hour_offset=%d: points = %v", offset, points)
+		}
+		if store.calls != i+1 {
+			t.Errorf("yesterday at %d served the series cached for another zone", offset)
+		}
+	}
+}
+
+func TestParseParams_ThisWeek(t *testing.T) {
+	for _, ws := range []WeekStart{WeekStartMonday, WeekStartSunday} {
+		req := httptest.NewRequest("GET", "/api/stats/overview?domain=example.com&period=this_week&week_start="+string(ws), nil)
+		_, from, to, err := parseParams(req, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.Weekday() != ws.weekday() || from.Hour() != 0 || to.Sub(from) >= 7*24*time.Hour {
+			t.Errorf("%s: this_week = %v to %v", ws, from, to)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package urlbuilder builds the absolute URLs the server hands out: OAuth
+// redirect URIs, share and badge links, and links in emails. Behind a reverse
+// proxy the server sees plain HTTP on an internal host, so the public origin
+// comes from PUBLIC_URL, or from the X-Forwarded-Proto and X-Forwarded-Host
+// headers when the proxy is trusted to set them. Clients can send those
+// headers too, so untrusted they can only upgrade links to https, and
+// X-Forwarded-For is ignored when telling the client's address.
+package urlbuilder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Builder builds absolute URLs of paths on this server. The zero Builder
+// derives them from the request, trusting proxy headers only to ask for https.
+type Builder struct {
+	base       string // PUBLIC_URL without a trailing slash; empty derives it from requests
+	trustProxy bool
+}
+
+// New builds URLs on publicURL when it is set, and otherwise on the origin
+// requests were sent to, as told by the proxy headers when trustProxy is set
+func New(publicURL string, trustProxy bool) (Builder, error) {
+	if publicURL == "" {
+		return Builder{trustProxy: trustProxy}, nil
+	}
+	if err := Check(publicURL); err != nil {
+		return Builder{}, fmt.Errorf("PUBLIC_URL %w", err)
+	}
+	return Builder{base: strings.TrimSuffix(publicURL, "/"), trustProxy: trustProxy}, nil
+}
+
+// Check reports what makes raw unfit as the base of links sent to users. It
+// must be an absolute URL without query or fragment, and https unless its
+// host is a loopback address, so links never downgrade to plain HTTP.
+func Check(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("must be an absolute http(s) URL")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" || strings.HasSuffix(raw, "?") {
+		return errors.New("must not have credentials, a query or a fragment")
+	}
+	if u.Scheme == "http" && !isLoopback(u.Hostname()) {
+		return errors.New("must use https")
+	}
+	return nil
+}
+
+// isLoopback reports whether host only reaches this machine
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Configured reports whether URLs come from PUBLIC_URL rather than requests
+func (b Builder) Configured() bool {
+	return b.base != ""
+}
+
+// URL returns the absolute URL of path, which starts with a slash, as
+// clients reach it
+func (b Builder) URL(r *http.Request, path string) string {
+	return b.Base(r) + path
+}
+
+// Base is the URL paths on this server are relative to, without a trailing slash
+func (b Builder) Base(r *http.Request) string {
+	if b.base != "" {
+		return b.base
+	}
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// Upgrading to https can't point a link anywhere else, so a TLS proxy
+	// is honored even untrusted, as links were built before PUBLIC_URL
+	proto := firstValue(r.Header.Get("X-Forwarded-Proto"))
+	if proto == "https" || (b.trustProxy && proto == "http") {
+		scheme = proto
+	}
+	if b.trustProxy {
+		if fwd := firstValue(r.Header.Get("X-Forwarded-Host")); validHost(fwd) {
+			host = fwd
+		}
+	}
+	return scheme + "://" + host
+}
+
+// ClientIP is the address of the client that sent r: the first address of
+// X-Forwarded-For when the proxy is trusted, and otherwise the peer address
+func (b Builder) ClientIP(r *http.Request) string {
+	if b.trustProxy {
+		if fwd := firstValue(r.Header.Get("X-Forwarded-For")); net.ParseIP(fwd) != nil {
+			return fwd
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// firstValue is the value the proxy nearest the client set in a header
+// proxies append to
+func firstValue(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.ToLower(strings.TrimSpace(first))
+}
+
+// validHost reports whether host is a bare host[:port], with nothing that
+// would change the meaning of a URL built on it
+func validHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/\\@?#% ") {
+		return false
+	}
+	u, err := url.Parse("http://" + host)
+	return err == nil && u.Host == host
+}
@@ -0,0 +1,12 @@
+-- Create segments table for storing named, reusable filter sets
+CREATE TABLE IF NOT EXISTS clickresearch_segments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    filters JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Index for fast lookup by project
+CREATE INDEX IF NOT EXISTS idx_segments_project_id ON clickresearch_segments(project_id);
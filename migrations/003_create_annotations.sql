@@ -0,0 +1,14 @@
+-- Create annotations table for chart markers (deploys, campaigns)
+-- Note: "date" is a reserved word in PostgreSQL, so we use "annotation_date"
+CREATE TABLE IF NOT EXISTS clickresearch_annotations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    annotation_date DATE NOT NULL,
+    label VARCHAR(120) NOT NULL,
+    color VARCHAR(7) NOT NULL DEFAULT '',
+    created_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Index for range lookups by project
+CREATE INDEX IF NOT EXISTS idx_annotations_project_date ON clickresearch_annotations(project_id, annotation_date);
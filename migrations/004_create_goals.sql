@@ -0,0 +1,12 @@
+-- Create goals table for conversion tracking (a pageview path or a custom event)
+CREATE TABLE IF NOT EXISTS clickresearch_goals (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    goal_type VARCHAR(20) NOT NULL,
+    goal_value VARCHAR(500) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Index for fast lookup by project
+CREATE INDEX IF NOT EXISTS idx_goals_project_id ON clickresearch_goals(project_id);
@@ -0,0 +1,6 @@
+-- Admin-managed referrer spam domains, in addition to the list compiled into the binary
+CREATE TABLE IF NOT EXISTS clickresearch_spam_referrers (
+    domain VARCHAR(253) PRIMARY KEY,
+    created_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
@@ -0,0 +1,18 @@
+-- Create funnel snapshots table: frozen funnel results shared by public link
+CREATE TABLE IF NOT EXISTS clickresearch_funnel_snapshots (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    slug VARCHAR(64) NOT NULL UNIQUE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    payload TEXT NOT NULL, -- JSON served as-is by the public endpoint
+    anonymized BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Index for listing and capping snapshots per project
+CREATE INDEX IF NOT EXISTS idx_funnel_snapshots_project_id ON clickresearch_funnel_snapshots(project_id);
+
+-- Projects can hide pathnames from shared snapshots
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS anonymize_snapshots BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,10 @@
+-- Create funnel results table: one precomputed FunnelResult per saved funnel per UTC day
+CREATE TABLE IF NOT EXISTS clickresearch_funnel_results (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    funnel_id UUID NOT NULL REFERENCES clickresearch_funnels(id) ON DELETE CASCADE,
+    date DATE NOT NULL,
+    result JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    -- The history job may run twice for a day; the second insert is a no-op
+    UNIQUE (funnel_id, date)
+);
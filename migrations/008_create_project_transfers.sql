@@ -0,0 +1,16 @@
+-- Create project transfers table: ownership changes between users, kept as an audit trail.
+-- Transfers to an email without an account stay pending until that user first logs in.
+CREATE TABLE IF NOT EXISTS clickresearch_project_transfers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    from_user_id UUID NOT NULL,
+    to_email VARCHAR(255) NOT NULL,
+    to_user_id UUID,
+    initiated_by UUID NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, completed
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Index for completing pending transfers on login
+CREATE INDEX IF NOT EXISTS idx_project_transfers_pending ON clickresearch_project_transfers(lower(to_email)) WHERE status = 'pending';
@@ -0,0 +1,3 @@
+-- Projects can restrict visitor-level reports by the consent prop of events:
+-- off, exclude_denied (drop "denied" hits) or only_granted (keep only "granted" hits)
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS privacy_mode VARCHAR(20) NOT NULL DEFAULT 'off';
@@ -0,0 +1,12 @@
+-- Event name protection, off by default. With enforce_event_names, events whose name
+-- is not in the project's allow-list load as "_other" with the sent name kept in props.
+-- event_cardinality_guard rolls up the long tail of event breakdowns with many names.
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS enforce_event_names BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS event_cardinality_guard BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS clickresearch_project_event_names (
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    name VARCHAR(200) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (project_id, name)
+);
@@ -0,0 +1,22 @@
+-- Create export destinations table: where a project's events are pushed nightly.
+-- Credentials are sealed with the EXPORT_SECRET_KEY secretbox key and never returned by the API.
+CREATE TABLE IF NOT EXISTS clickresearch_export_destinations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL, -- s3, webhook
+    bucket VARCHAR(255) NOT NULL DEFAULT '',
+    region VARCHAR(64) NOT NULL DEFAULT '',
+    endpoint VARCHAR(255) NOT NULL DEFAULT '',
+    prefix VARCHAR(255) NOT NULL DEFAULT '',
+    url TEXT NOT NULL DEFAULT '',
+    credentials BYTEA NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, ok, failing
+    last_run_at TIMESTAMP WITH TIME ZONE,
+    last_exported_date DATE,
+    last_error TEXT NOT NULL DEFAULT '',
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Index for listing a project's destinations
+CREATE INDEX IF NOT EXISTS idx_export_destinations_project_id ON clickresearch_export_destinations(project_id);
@@ -0,0 +1,3 @@
+-- Embed tokens carry a fingerprint of their project's embed secret; rotating the
+-- secret revokes every token issued before
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS embed_secret VARCHAR(64) NOT NULL DEFAULT '';
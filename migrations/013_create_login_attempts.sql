@@ -0,0 +1,12 @@
+-- Consecutive failed logins per email, shared by every instance. Emails without
+-- an account are tracked too, so throttling does not reveal which exist.
+CREATE TABLE IF NOT EXISTS clickresearch_login_attempts (
+    email VARCHAR(255) PRIMARY KEY, -- lower-cased
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP WITH TIME ZONE,
+    unlock_token_hash VARCHAR(64) -- sha256 of the token emailed when locking
+);
+
+-- Index for unlocking by emailed link
+CREATE INDEX IF NOT EXISTS idx_login_attempts_unlock ON clickresearch_login_attempts(unlock_token_hash) WHERE unlock_token_hash IS NOT NULL;
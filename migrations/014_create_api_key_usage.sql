@@ -0,0 +1,13 @@
+-- Hourly request counts per project API key, written in batches. Keys are
+-- identified by their first 8 characters so the table holds no secrets.
+CREATE TABLE IF NOT EXISTS clickresearch_api_key_usage (
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    key_prefix VARCHAR(8) NOT NULL,
+    hour TIMESTAMP WITH TIME ZONE NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    last_used_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (project_id, key_prefix, hour)
+);
+
+-- Index for pruning old hours
+CREATE INDEX IF NOT EXISTS idx_api_key_usage_hour ON clickresearch_api_key_usage(hour);
@@ -0,0 +1,5 @@
+-- Per-project overrides of how many funnels, goals and segments a project may
+-- have; NULL uses the server default
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS max_funnels INT;
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS max_goals INT;
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS max_segments INT;
@@ -0,0 +1,15 @@
+-- Responses to create requests sent with an Idempotency-Key header, kept for
+-- 24 hours so a retried request gets the original response instead of a duplicate
+CREATE TABLE IF NOT EXISTS clickresearch_idempotency_keys (
+    user_id UUID NOT NULL REFERENCES clickresearch_users(id) ON DELETE CASCADE,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64) NOT NULL, -- sha256 of method, path, query and body
+    status INT, -- NULL while the first request is in progress
+    body BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, idempotency_key)
+);
+
+-- Index for deleting expired keys
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON clickresearch_idempotency_keys(expires_at);
@@ -0,0 +1,5 @@
+-- Projects can leave events recorded on other sites out of their reports:
+-- strict_domain drops events whose page host isn't the project's domain, and
+-- match_subdomains (on by default) counts its subdomains as the domain
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS strict_domain BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS match_subdomains BOOLEAN NOT NULL DEFAULT TRUE;
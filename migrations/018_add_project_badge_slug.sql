@@ -0,0 +1,3 @@
+-- Projects can publish a badge with this month's pageviews and visitors at
+-- /api/public/badge/{badge_slug}.svg; NULL keeps it disabled
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS badge_slug VARCHAR(64) UNIQUE;
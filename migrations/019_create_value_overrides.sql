@@ -0,0 +1,15 @@
+-- Admin-registered corrections for values the enrichment pipeline got wrong,
+-- e.g. Edge parsed as Chrome. Reports replace match with replacement in column
+-- for events from start_date to end_date (UTC, inclusive); an empty domain
+-- applies to every project. Stored events are left as they are.
+CREATE TABLE IF NOT EXISTS clickresearch_value_overrides (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    domain VARCHAR(255) NOT NULL DEFAULT '',
+    column_name VARCHAR(20) NOT NULL,
+    match_value VARCHAR(255) NOT NULL,
+    replacement VARCHAR(255) NOT NULL,
+    start_date DATE NOT NULL,
+    end_date DATE NOT NULL,
+    created_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
@@ -0,0 +1,11 @@
+-- Projects Shortodella created through the sync flow get a stats digest pushed
+-- back. synced_from tags them; projects of users Shortodella created before the
+-- tag existed are backfilled. digest_sent_at and digest_zero record the last
+-- delivered digest, so a domain without traffic is reported once, not every run.
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS synced_from VARCHAR(50);
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS digest_sent_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS digest_zero BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE clickresearch_projects p SET synced_from = u.synced_from
+FROM clickresearch_users u
+WHERE p.user_id = u.id AND u.synced_from = 'shortodella' AND p.synced_from IS NULL;
@@ -0,0 +1,12 @@
+-- Visitors erased on request (GDPR erasure). Their events are deleted from the
+-- analytics store and left out of every later load, as the parquet files in S3
+-- still hold them. Keyed by domain rather than project, so erasures outlive
+-- deleted and transferred projects.
+CREATE TABLE IF NOT EXISTS clickresearch_visitor_tombstones (
+    domain VARCHAR(255) NOT NULL,
+    visitor_id VARCHAR(255) NOT NULL,
+    events_erased BIGINT NOT NULL DEFAULT 0,
+    created_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (domain, visitor_id)
+);
@@ -0,0 +1,4 @@
+-- Revenue reports sum the revenue prop of each project's purchase events,
+-- converted into the project's currency with the daily exchange rates
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS revenue_event VARCHAR(255) NOT NULL DEFAULT 'purchase';
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
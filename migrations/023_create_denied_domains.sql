@@ -0,0 +1,7 @@
+-- Domains of deleted projects. Ingestion refuses their events right away
+-- instead of once peers refresh their domain lists; registering the domain
+-- again removes it.
+CREATE TABLE IF NOT EXISTS clickresearch_denied_domains (
+    domain VARCHAR(255) PRIMARY KEY,
+    denied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
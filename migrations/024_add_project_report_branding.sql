@@ -0,0 +1,4 @@
+-- Reports generated for a project carry its logo and accent color; empty
+-- values use the defaults
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS report_logo_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE clickresearch_projects ADD COLUMN IF NOT EXISTS report_accent_color VARCHAR(7) NOT NULL DEFAULT '';
@@ -0,0 +1,13 @@
+-- Domain aliases: other hostnames whose events count toward a project, such as
+-- www.example.com or a staging subdomain. Events stay stored under the hostname
+-- the tracker reported; reports merge them. A hostname is the alias of one
+-- project at most, and never also a project's domain (checked on insert).
+CREATE TABLE IF NOT EXISTS clickresearch_project_domain_aliases (
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    hostname VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (project_id, hostname)
+);
+
+-- One project per alias; also serves the ownership check of new aliases
+CREATE UNIQUE INDEX IF NOT EXISTS idx_project_domain_aliases_hostname ON clickresearch_project_domain_aliases(hostname);
@@ -0,0 +1,19 @@
+-- Campaign registry: the canonical UTM values of a project's campaigns, so
+-- reports can fold mistyped utm_campaign values onto them. campaign_key is
+-- utm_campaign lowercased without separators, which observed values are
+-- matched by; a project registers each key once.
+CREATE TABLE IF NOT EXISTS clickresearch_campaigns (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    project_id UUID NOT NULL REFERENCES clickresearch_projects(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    utm_source VARCHAR(255) NOT NULL,
+    utm_medium VARCHAR(255) NOT NULL,
+    utm_campaign VARCHAR(255) NOT NULL,
+    utm_content VARCHAR(255) NOT NULL DEFAULT '',
+    utm_term VARCHAR(255) NOT NULL DEFAULT '',
+    campaign_key VARCHAR(255) NOT NULL,
+    landing_path VARCHAR(2000) NOT NULL DEFAULT '/',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (project_id, campaign_key)
+);
@@ -0,0 +1,33 @@
+-- Events of ANALYTICS_BACKEND=postgres, for small installs without S3 or
+-- ClickHouse. The ingestion buffer writes them as they arrive; the columns
+-- follow the parquet schema of the other backends, with the UTM values of the
+-- landing URL. Reports read a domain's range of (domain, timestamp).
+CREATE TABLE IF NOT EXISTS clickresearch_events (
+    -- Write order; refreshes count the events after the last one they saw
+    id BIGSERIAL PRIMARY KEY,
+    domain TEXT NOT NULL,
+    visitor_id TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    url TEXT NOT NULL DEFAULT '',
+    pathname TEXT NOT NULL DEFAULT '',
+    referrer TEXT NOT NULL DEFAULT '',
+    timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
+    props JSON NOT NULL DEFAULT '{}',
+    browser TEXT NOT NULL DEFAULT '',
+    browser_version TEXT NOT NULL DEFAULT '',
+    os TEXT NOT NULL DEFAULT '',
+    os_version TEXT NOT NULL DEFAULT '',
+    device TEXT NOT NULL DEFAULT '',
+    country TEXT NOT NULL DEFAULT '',
+    city TEXT NOT NULL DEFAULT '',
+    utm_source TEXT NOT NULL DEFAULT '',
+    utm_medium TEXT NOT NULL DEFAULT '',
+    utm_campaign TEXT NOT NULL DEFAULT '',
+    received_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Index for reports, which scan one domain's date range
+CREATE INDEX IF NOT EXISTS idx_events_domain_timestamp ON clickresearch_events(domain, timestamp);
+
+-- Index for the active domains digest and future-dated event counts
+CREATE INDEX IF NOT EXISTS idx_events_timestamp ON clickresearch_events(timestamp);
@@ -0,0 +1,23 @@
+#!/bin/bash
+# Regenerate internal/stats/countries.tsv from the GeoNames country list:
+# ISO 3166-1 alpha-2 code, English name and continent code, plus Kosovo (XK)
+# and the XX placeholder for unknown countries
+
+set -e
+
+SOURCE="https://download.geonames.org/export/dump/countryInfo.txt"
+OUT="$(dirname "$0")/../internal/stats/countries.tsv"
+
+{
+  echo "# Generated by scripts/gen-countries.sh from GeoNames countryInfo.txt (CC BY 4.0). Do not edit."
+  printf '# code\tname\tcontinent\n'
+  # Columns: ISO, ISO3, ISO-Numeric, fips, Country, Capital, Area, Population, Continent, ...
+  # AN (Netherlands Antilles) and CS (Serbia and Montenegro) no longer exist
+  curl -fsSL "$SOURCE" \
+    | awk -F'\t' '!/^#/ && $1 != "AN" && $1 != "CS" { print $1 "\t" $5 "\t" $9 }' \
+    | LC_ALL=C sort
+  printf 'XX\tUnknown\t\n'
+} > "$OUT.tmp"
+mv "$OUT.tmp" "$OUT"
+
+echo "$(date): $(grep -vc '^#' "$OUT") countries written to $OUT"